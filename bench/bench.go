@@ -0,0 +1,63 @@
+// Package bench provides end-to-end benchmarks of the broker, measuring
+// publish throughput and fan-out latency over network connections.
+//
+//	go test -run - -bench . -benchmem github.com/mrwill84/mq/bench
+package bench
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latencies records message latencies and reports percentiles. It is
+// safe for concurrent use.
+type Latencies struct {
+	mu sync.Mutex
+	d  durations
+}
+
+// Record records the latency of a message.
+func (l *Latencies) Record(d time.Duration) {
+	l.mu.Lock()
+	l.d = append(l.d, d)
+	l.mu.Unlock()
+}
+
+// Len returns the number of recorded latencies.
+func (l *Latencies) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.d)
+}
+
+// Percentile returns the latency below which p percent of the recorded
+// latencies fall, or zero if no latencies were recorded.
+func (l *Latencies) Percentile(p float64) time.Duration {
+	l.mu.Lock()
+	d := make(durations, len(l.d))
+	copy(d, l.d)
+	l.mu.Unlock()
+	if len(d) == 0 {
+		return 0
+	}
+	sort.Sort(d)
+	i := int(float64(len(d)) * p / 100)
+	if i >= len(d) {
+		i = len(d) - 1
+	}
+	return d[i]
+}
+
+// Reset discards the recorded latencies.
+func (l *Latencies) Reset() {
+	l.mu.Lock()
+	l.d = l.d[:0]
+	l.mu.Unlock()
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,205 @@
+package bench
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/server"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// fanout is the number of subscribers in the fan-out benchmark.
+const fanout = 8
+
+func TestLatencies(t *testing.T) {
+	var l Latencies
+	if got := l.Percentile(50); got != 0 {
+		t.Errorf("Expect zero percentile without latencies, got %s", got)
+	}
+	for i := 100; i > 0; i-- {
+		l.Record(time.Duration(i) * time.Millisecond)
+	}
+	if got := l.Percentile(50); got != 51*time.Millisecond {
+		t.Errorf("Expect p50 of 51ms, got %s", got)
+	}
+	if got := l.Percentile(99); got != 100*time.Millisecond {
+		t.Errorf("Expect p99 of 100ms, got %s", got)
+	}
+	if got := l.Percentile(100); got != 100*time.Millisecond {
+		t.Errorf("Expect p100 of 100ms, got %s", got)
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	for _, size := range []int{64, 1024, 16384} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			benchmarkPublish(b, size)
+		})
+	}
+}
+
+func benchmarkPublish(b *testing.B, size int) {
+	addr, done := serve(b, server.NewServer())
+	defer done()
+
+	var received int64
+	finished := make(chan struct{})
+	consumer := dial(b, addr)
+	defer consumer.Disconnect()
+	_, err := consumer.Subscribe("/queue/bench", stomp.HandlerFunc(func(m *stomp.Message) {
+		m.Release()
+		if atomic.AddInt64(&received, 1) == int64(b.N) {
+			close(finished)
+		}
+	}), stomp.WithReceipt())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	producer := dial(b, addr)
+	defer producer.Disconnect()
+	// bodies are printable, since text frames are terminated by a NUL
+	// byte.
+	body := bytes.Repeat([]byte("x"), size)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := producer.Send("/queue/bench", body); err != nil {
+			b.Fatal(err)
+		}
+	}
+	wait(b, finished)
+}
+
+func BenchmarkFanout(b *testing.B) {
+	addr, done := serve(b, server.NewServer())
+	defer done()
+
+	var (
+		latencies Latencies
+		wg        sync.WaitGroup
+	)
+	wg.Add(fanout)
+	for i := 0; i < fanout; i++ {
+		var received int
+		consumer := dial(b, addr)
+		defer consumer.Disconnect()
+		_, err := consumer.Subscribe("/topic/bench", stomp.HandlerFunc(func(m *stomp.Message) {
+			sent, _ := strconv.ParseInt(string(m.Body), 10, 64)
+			latencies.Record(time.Duration(time.Now().UnixNano() - sent))
+			m.Release()
+			if received++; received == b.N {
+				wg.Done()
+			}
+		}), stomp.WithReceipt())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	producer := dial(b, addr)
+	defer producer.Disconnect()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		body := strconv.AppendInt(nil, time.Now().UnixNano(), 10)
+		if err := producer.Send("/topic/bench", body); err != nil {
+			b.Fatal(err)
+		}
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	wait(b, finished)
+	b.StopTimer()
+
+	b.ReportMetric(float64(latencies.Percentile(50).Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(latencies.Percentile(99).Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkPublishPipe(b *testing.B) {
+	s := server.NewServer()
+
+	var received int64
+	finished := make(chan struct{})
+	consumer := s.Client()
+	if err := consumer.Connect(); err != nil {
+		b.Fatal(err)
+	}
+	defer consumer.Disconnect()
+	_, err := consumer.Subscribe("/queue/bench", stomp.HandlerFunc(func(m *stomp.Message) {
+		m.Release()
+		if atomic.AddInt64(&received, 1) == int64(b.N) {
+			close(finished)
+		}
+	}), stomp.WithReceipt())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		b.Fatal(err)
+	}
+	defer producer.Disconnect()
+	body := bytes.Repeat([]byte("x"), 64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := producer.Send("/queue/bench", body); err != nil {
+			b.Fatal(err)
+		}
+	}
+	wait(b, finished)
+}
+
+// serve serves the server on a loopback listener and returns the
+// listener address and a function closing the listener.
+func serve(b *testing.B, s *server.Server) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeConn(conn)
+		}
+	}()
+	return "tcp://" + l.Addr().String(), func() { l.Close() }
+}
+
+// dial returns a client connected to the server address.
+func dial(b *testing.B, addr string) *stomp.Client {
+	client, err := stomp.Dial(addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := client.Connect(); err != nil {
+		b.Fatal(err)
+	}
+	return client
+}
+
+// wait waits for the channel to close.
+func wait(b *testing.B, finished <-chan struct{}) {
+	select {
+	case <-finished:
+	case <-time.After(time.Minute):
+		b.Fatal("Timeout waiting for messages")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
@@ -18,6 +19,8 @@ var client *stomp.Client
 
 func main() {
 	app := cli.NewApp()
+	app.Name = "mq"
+	app.Usage = "publish, subscribe, serve and benchmark a STOMP message broker"
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "server, s",
@@ -35,6 +38,11 @@ func main() {
 			Usage:  "stomp server password",
 			EnvVar: "STOMP_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "host",
+			Usage:  "stomp server virtual host",
+			EnvVar: "STOMP_HOST",
+		},
 		cli.IntFlag{
 			Name:   "level",
 			Usage:  "logging level",
@@ -44,11 +52,12 @@ func main() {
 	}
 	app.Commands = []cli.Command{
 		{
-			Name:   "publish",
-			Usage:  "publish to a topic",
-			Action: send,
-			Before: setup,
-			After:  teardown,
+			Name:    "pub",
+			Aliases: []string{"publish"},
+			Usage:   "publish to a topic",
+			Action:  send,
+			Before:  setup,
+			After:   teardown,
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "data, d",
@@ -81,11 +90,12 @@ func main() {
 			},
 		},
 		{
-			Name:   "subscribe",
-			Usage:  "subscribe to a topic",
-			Action: subscribe,
-			Before: setup,
-			After:  teardown,
+			Name:    "sub",
+			Aliases: []string{"subscribe"},
+			Usage:   "subscribe to a topic",
+			Action:  subscribe,
+			Before:  setup,
+			After:   teardown,
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "where",
@@ -99,10 +109,18 @@ func main() {
 					Name:  "ack",
 					Usage: "subscribes with ack settings",
 				},
+				cli.IntFlag{
+					Name:  "count, n",
+					Usage: "exits after receiving the number of messages",
+				},
 			},
 		},
 		comandServe,
+		comandSchema,
 		comandBench,
+		comandVectors,
+		comandMove,
+		comandCopy,
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -144,6 +162,12 @@ func createClient(c *cli.Context) (*stomp.Client, error) {
 		)
 	}
 
+	if host := c.GlobalString("host"); host != "" {
+		opts = append(opts,
+			stomp.WithHost(host),
+		)
+	}
+
 	if err := cli.Connect(opts...); err != nil {
 		return nil, err
 	}
@@ -163,8 +187,21 @@ func send(c *cli.Context) (err error) {
 	var (
 		path = c.Args().First()
 		args = c.Args().Get(1)
+		data = []byte(args)
 	)
 
+	switch file := c.String("data"); file {
+	case "":
+	case "-":
+		if data, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	default:
+		if data, err = ioutil.ReadFile(file); err != nil {
+			return err
+		}
+	}
+
 	var opts []stomp.MessageOption
 	if expires := c.Int64("expires"); expires != 0 {
 		opts = append(opts, stomp.WithExpires(expires))
@@ -191,14 +228,16 @@ func send(c *cli.Context) (err error) {
 		}
 	}
 
-	return client.Send(path, []byte(args), opts...)
+	return client.Send(path, data, opts...)
 }
 
 // subscribe subscribes to the specified topic.
 func subscribe(c *cli.Context) (err error) {
 	var (
-		path = c.Args().First()
-		quit = make(chan os.Signal, 1)
+		path  = c.Args().First()
+		quit  = make(chan os.Signal, 1)
+		done  = make(chan struct{})
+		count = c.Int("count")
 	)
 
 	var opts []stomp.MessageOption
@@ -215,9 +254,14 @@ func subscribe(c *cli.Context) (err error) {
 	handler := func(m *stomp.Message) {
 		log.Println(m)
 		m.Release()
+
+		// exit once the requested number of messages is received.
+		if count--; count == 0 {
+			close(done)
+		}
 	}
 
-	id, err := client.Subscribe(path, stomp.HandlerFunc(handler), opts...)
+	sub, err := client.Subscribe(path, stomp.HandlerFunc(handler), opts...)
 	if err != nil {
 		return err
 	}
@@ -228,8 +272,9 @@ func subscribe(c *cli.Context) (err error) {
 
 	select {
 	case <-quit:
+	case <-done:
 	case <-client.Done():
 	}
 
-	return client.Unsubscribe(id)
+	return sub.Unsubscribe()
 }
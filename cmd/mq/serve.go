@@ -2,25 +2,44 @@ package main
 
 import (
 	"crypto/tls"
-	"io"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/tidwall/redlog"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/acme/autocert"
 
+	"github.com/mrwill84/mq/config"
 	"github.com/mrwill84/mq/logger"
 	"github.com/mrwill84/mq/server"
+	"github.com/mrwill84/mq/server/gateway"
 )
 
 var comandServe = cli.Command{
-	Name:   "start",
-	Usage:  "start the message broker daemon",
-	Action: serve,
+	Name:    "serve",
+	Aliases: []string{"start"},
+	Usage:   "start the message broker daemon",
+	Action:  serve,
 	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "stomp configuration file (yaml, toml or json), which cannot be combined with the flags it replaces",
+			EnvVar: "STOMP_CONFIG",
+		},
+		cli.DurationFlag{
+			Name:   "reload-interval",
+			Usage:  "stomp poll the configuration file for changes at this interval, or reload on SIGHUP only when zero",
+			Value:  5 * time.Second,
+			EnvVar: "STOMP_RELOAD_INTERVAL",
+		},
 		cli.StringFlag{
 			Name:   "tcp",
 			Usage:  "stomp tcp server address",
@@ -43,6 +62,21 @@ var comandServe = cli.Command{
 			Usage:  "stomp ssl key",
 			EnvVar: "STOMP_KEY",
 		},
+		cli.StringFlag{
+			Name:   "client-ca",
+			Usage:  "stomp require client certificates signed by this ca, which authenticate connections",
+			EnvVar: "STOMP_CLIENT_CA",
+		},
+		cli.BoolFlag{
+			Name:   "proxy-protocol",
+			Usage:  "stomp accept proxy protocol headers sent by load balancers on the trusted networks",
+			EnvVar: "STOMP_PROXY_PROTOCOL",
+		},
+		cli.StringSliceFlag{
+			Name:   "proxy-trusted",
+			Usage:  "stomp accept proxy protocol headers only from this network, in cidr notation; required by --proxy-protocol",
+			EnvVar: "STOMP_PROXY_TRUSTED",
+		},
 		cli.BoolFlag{
 			Name:   "lets-encrypt",
 			Usage:  "stomp ssl using lets encrypt",
@@ -69,9 +103,161 @@ var comandServe = cli.Command{
 			Value:  "/",
 			EnvVar: "STOMP_BASE",
 		},
+		cli.StringFlag{
+			Name:   "store",
+			Usage:  "stomp datastore directory for persistent messages",
+			EnvVar: "STOMP_STORE",
+		},
+		cli.BoolFlag{
+			Name:   "replication",
+			Usage:  "stomp replicate queues to standby servers",
+			EnvVar: "STOMP_REPLICATION",
+		},
+		cli.StringSliceFlag{
+			Name:   "replication-user",
+			Usage:  "stomp allow the authenticated user to replicate as a standby",
+			EnvVar: "STOMP_REPLICATION_USERS",
+		},
+		cli.StringFlag{
+			Name:   "standby",
+			Usage:  "stomp run as a standby of the primary server address",
+			EnvVar: "STOMP_STANDBY",
+		},
+		cli.DurationFlag{
+			Name:   "failover",
+			Usage:  "stomp promote the standby when the primary is unreachable for this duration",
+			EnvVar: "STOMP_FAILOVER",
+		},
+		cli.DurationFlag{
+			Name:   "idle-timeout",
+			Usage:  "stomp delete destinations without subscribers after this idle duration",
+			EnvVar: "STOMP_IDLE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "session-idle-timeout",
+			Usage:  "stomp close sessions without frames or heart-beats for this duration",
+			EnvVar: "STOMP_SESSION_IDLE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "resume-timeout",
+			Usage:  "stomp hold disconnected sessions for resumption for this duration",
+			EnvVar: "STOMP_RESUME_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "dedup-window",
+			Usage:  "stomp drop messages with a dedup-id seen within this duration",
+			EnvVar: "STOMP_DEDUP_WINDOW",
+		},
+		cli.IntFlag{
+			Name:   "shards",
+			Usage:  "stomp destination map shards",
+			EnvVar: "STOMP_SHARDS",
+		},
+		cli.IntFlag{
+			Name:   "slow-consumer-limit",
+			Usage:  "stomp messages pending per session before the session is a slow consumer",
+			EnvVar: "STOMP_SLOW_CONSUMER_LIMIT",
+		},
+		cli.DurationFlag{
+			Name:   "slow-consumer-window",
+			Usage:  "stomp duration a session is a slow consumer before the policy applies",
+			EnvVar: "STOMP_SLOW_CONSUMER_WINDOW",
+		},
+		cli.StringFlag{
+			Name:   "slow-consumer-policy",
+			Usage:  "stomp slow consumer policy: drop, close or advisory",
+			EnvVar: "STOMP_SLOW_CONSUMER_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "flush",
+			Usage:  "stomp flush buffered writes on an interval, immediately, or by size",
+			EnvVar: "STOMP_FLUSH",
+		},
+		cli.IntFlag{
+			Name:   "flush-size",
+			Usage:  "stomp buffered bytes flushed by the size flush policy",
+			EnvVar: "STOMP_FLUSH_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "affinity",
+			Usage:  "stomp session affinity token issued by this node",
+			EnvVar: "STOMP_AFFINITY",
+		},
+		cli.StringFlag{
+			Name:   "overflow-dir",
+			Usage:  "stomp spill deep queue backlogs to segment files in this directory",
+			EnvVar: "STOMP_OVERFLOW_DIR",
+		},
+		cli.IntFlag{
+			Name:   "overflow-limit",
+			Usage:  "stomp messages held in memory per queue before spilling to disk",
+			Value:  10000,
+			EnvVar: "STOMP_OVERFLOW_LIMIT",
+		},
+		cli.IntFlag{
+			Name:   "queue-memory",
+			Usage:  "stomp bytes held in memory per queue before spilling to disk",
+			EnvVar: "STOMP_QUEUE_MEMORY",
+		},
+		cli.StringFlag{
+			Name:   "read-only",
+			Usage:  "stomp run as a read-only replica redirecting producers to this address",
+			EnvVar: "STOMP_READ_ONLY",
+		},
+		cli.BoolFlag{
+			Name:   "explicit-destinations",
+			Usage:  "stomp reject destinations not created through the admin api",
+			EnvVar: "STOMP_EXPLICIT_DESTINATIONS",
+		},
+		cli.StringSliceFlag{
+			Name:   "reconnect-target",
+			Usage:  "stomp allow the admin api to redirect draining clients to this address",
+			EnvVar: "STOMP_RECONNECT_TARGETS",
+		},
+		cli.IntFlag{
+			Name:   "read-buffer",
+			Usage:  "stomp connection read buffer size in bytes",
+			EnvVar: "STOMP_READ_BUFFER",
+		},
+		cli.IntFlag{
+			Name:   "write-buffer",
+			Usage:  "stomp connection write buffer size in bytes",
+			EnvVar: "STOMP_WRITE_BUFFER",
+		},
+		cli.IntFlag{
+			Name:   "max-frame-size",
+			Usage:  "stomp maximum frame size in bytes",
+			EnvVar: "STOMP_MAX_FRAME_SIZE",
+		},
+		cli.DurationFlag{
+			Name:   "heartbeat",
+			Usage:  "stomp interval at which heart-beats are sent",
+			EnvVar: "STOMP_HEARTBEAT",
+		},
+		cli.DurationFlag{
+			Name:   "heartbeat-timeout",
+			Usage:  "stomp close connections without heart-beats for this duration",
+			EnvVar: "STOMP_HEARTBEAT_TIMEOUT",
+		},
+		cli.StringSliceFlag{
+			Name:   "feature",
+			Usage:  "stomp enable an experimental feature",
+			EnvVar: "STOMP_FEATURES",
+		},
 	},
 }
 
+var comandSchema = cli.Command{
+	Name:   "config-schema",
+	Usage:  "print the json schema of the broker configuration",
+	Action: schema,
+}
+
+func schema(c *cli.Context) error {
+	_, err := os.Stdout.Write(append(server.ConfigSchema(), '\n'))
+	return err
+}
+
 func serve(c *cli.Context) error {
 	var (
 		errc = make(chan error)
@@ -84,6 +270,9 @@ func serve(c *cli.Context) error {
 		route = c.String("path")
 		cert  = c.String("cert")
 		key   = c.String("key")
+		ca    = c.String("client-ca")
+		proxy = c.Bool("proxy-protocol")
+		trust = c.StringSlice("proxy-trusted")
 
 		acme  = c.Bool("lets-encrypt")
 		host  = c.String("lets-encrypt-host")
@@ -91,13 +280,65 @@ func serve(c *cli.Context) error {
 		cache = c.String("lets-encrypt-cache")
 	)
 
-	var opts []server.Option
-	if user != "" || pass != "" {
-		opts = append(opts,
-			server.WithCredentials(user, pass),
-		)
+	cfg := server.Config{
+		Auth: server.AuthConfig{
+			Username: user,
+			Password: pass,
+			ClientCerts: server.ClientCertsConfig{
+				Enabled: ca != "",
+			},
+		},
+		Listeners: []server.ListenerConfig{
+			{Protocol: "tcp", Address: addr1, ProxyProtocol: proxy, TrustedProxies: trust},
+			{Protocol: "http", Address: addr2, Cert: cert, Key: key, ClientCA: ca, ProxyProtocol: proxy, TrustedProxies: trust},
+		},
+		Limits: server.LimitsConfig{
+			ReadBuffer:   c.Int("read-buffer"),
+			WriteBuffer:  c.Int("write-buffer"),
+			MaxFrameSize: c.Int("max-frame-size"),
+			QueueMemory:  c.Int("queue-memory"),
+			SlowConsumer: c.Int("slow-consumer-limit"),
+			Shards:       c.Int("shards"),
+			FlushSize:    c.Int("flush-size"),
+		},
+		Timeouts: server.TimeoutsConfig{
+			Heartbeat:        server.Duration(c.Duration("heartbeat")),
+			HeartbeatTimeout: server.Duration(c.Duration("heartbeat-timeout")),
+			Idle:             server.Duration(c.Duration("idle-timeout")),
+			SessionIdle:      server.Duration(c.Duration("session-idle-timeout")),
+			Resume:           server.Duration(c.Duration("resume-timeout")),
+			Dedup:            server.Duration(c.Duration("dedup-window")),
+			Failover:         server.Duration(c.Duration("failover")),
+			SlowConsumer:     server.Duration(c.Duration("slow-consumer-window")),
+		},
+		Policies: server.PoliciesConfig{
+			Store:        c.String("store"),
+			OverflowDir:  c.String("overflow-dir"),
+			Replication:  c.Bool("replication"),
+			Standbys:     c.StringSlice("replication-user"),
+			Standby:      c.String("standby"),
+			ReadOnly:     c.String("read-only"),
+			Affinity:     c.String("affinity"),
+			Explicit:     c.Bool("explicit-destinations"),
+			Reconnect:    c.StringSlice("reconnect-target"),
+			Features:     c.StringSlice("feature"),
+			SlowConsumer: c.String("slow-consumer-policy"),
+			Flush:        c.String("flush"),
+		},
+	}
+	if cfg.Policies.OverflowDir != "" {
+		cfg.Limits.OverflowLimit = c.Int("overflow-limit")
+	}
+	if file := c.String("config"); file != "" {
+		if err := checkConfigFlags(c); err != nil {
+			return err
+		}
+		loaded, err := config.Load(file)
+		if err != nil {
+			return err
+		}
+		cfg = *loaded
 	}
-
 	logs := redlog.New(os.Stderr)
 	logs.SetLevel(
 		c.GlobalInt("level"),
@@ -105,43 +346,80 @@ func serve(c *cli.Context) error {
 	logger.SetLogger(logs)
 	logger.Noticef("stomp: starting server")
 
-	server := server.NewServer(opts...)
-	http.HandleFunc(path.Join("/", base, "meta/sessions"), server.HandleSessions)
-	http.HandleFunc(path.Join("/", base, "meta/destinations"), server.HandleDests)
-	http.Handle(path.Join("/", base, route), server)
-
-	go func() {
-		switch {
-		case acme:
-			errc <- listendAndServeAcme(host, email, cache)
-		case cert != "":
-			errc <- http.ListenAndServeTLS(addr2, cert, key, nil)
-		default:
-			errc <- http.ListenAndServe(addr2, nil)
+	server, err := server.NewFromConfig(&cfg)
+	if err != nil {
+		return err
+	}
+	var (
+		pairs     []*config.KeyPair
+		listeners []net.Listener
+		protocols []string
+	)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
 		}
 	}()
-
-	go func() {
-		l, err := net.Listen("tcp", addr1)
+	for _, lc := range cfg.Listeners {
+		// the let's encrypt server replaces the http listeners.
+		if lc.Address == "" || acme && lc.Protocol == "http" {
+			continue
+		}
+		tc, pair, err := tlsConfig(lc)
+		if err != nil {
+			return err
+		}
+		l, err := listen(lc, tc)
 		if err != nil {
-			errc <- err
-			return
+			return err
 		}
-		defer l.Close()
+		pairs = append(pairs, pair)
+		listeners = append(listeners, l)
+		protocols = append(protocols, lc.Protocol)
+	}
+	if file := c.String("config"); file != "" {
+		w := config.Watch(file, c.Duration("reload-interval"), reloader(server, pairs...))
+		defer w.Close()
+	}
+	http.HandleFunc(path.Join("/", base, "meta/sessions"), server.HandleSessions)
+	http.HandleFunc(path.Join("/", base, "meta/connections"), server.HandleConnections)
+	http.HandleFunc(path.Join("/", base, "meta/destinations"), server.HandleDests)
+	http.HandleFunc(path.Join("/", base, "meta/hosts"), server.HandleHosts)
+	http.HandleFunc(path.Join("/", base, "meta/limits"), server.HandleLimits)
+	http.HandleFunc(path.Join("/", base, "meta/versions"), server.HandleVersions)
+	http.HandleFunc(path.Join("/", base, "meta/topology"), server.HandleTopology)
+	http.HandleFunc(path.Join("/", base, "meta/sampling"), server.HandleSampling)
+	http.HandleFunc(path.Join("/", base, "meta/acklevels"), server.HandleAckLevels)
+	http.HandleFunc(path.Join("/", base, "meta/standby"), server.HandleStandby)
+	http.HandleFunc(path.Join("/", base, "meta/usage"), server.HandleUsage)
+	http.HandleFunc(path.Join("/", base, "meta/stats"), server.HandleStats)
+	http.HandleFunc(path.Join("/", base, "meta/purge"), server.HandlePurge)
+	http.HandleFunc(path.Join("/", base, "meta/admin"), server.HandleAdmin)
+	http.HandleFunc(path.Join("/", base, "meta/admin")+"/", server.HandleAdmin)
+	http.HandleFunc(path.Join("/", base, "meta/features"), server.HandleFeatures)
+	http.HandleFunc(path.Join("/", base, "meta/browse"), server.HandleBrowse)
+	http.HandleFunc(path.Join("/", base, "meta/transfer"), server.HandleTransfer)
+	http.HandleFunc(path.Join("/", base, "meta/webhooks"), server.HandleWebhooks)
+	http.HandleFunc(path.Join("/", base, "meta/cron"), server.HandleCron)
+	http.HandleFunc(path.Join("/", base, "meta/drain"), server.HandleDrain)
+	http.Handle(path.Join("/", base, "mq.Broker")+"/",
+		http.StripPrefix(strings.TrimSuffix(path.Join("/", base), "/"), gateway.New(server)))
+	http.Handle(path.Join("/", base, route), server)
 
-		for {
-			conn, err := l.Accept()
-			if err == io.EOF {
-				errc <- nil
-				return
-			}
-			if err != nil {
-				errc <- err
+	if acme {
+		go func() {
+			errc <- listendAndServeAcme(host, email, cache)
+		}()
+	}
+	for i, l := range listeners {
+		go func(l net.Listener, protocol string) {
+			if protocol == "http" {
+				errc <- gateway.Serve(l, nil)
 				return
 			}
-			go server.Serve(conn)
-		}
-	}()
+			errc <- server.Serve(l)
+		}(l, protocols[i])
+	}
 
 	return <-errc
 }
@@ -163,3 +441,124 @@ func listendAndServeAcme(host, email, cache string) error {
 	}
 	return s.ListenAndServeTLS("", "")
 }
+
+// fileFlags are the serve flags that still apply when the configuration
+// is loaded from a file.
+var fileFlags = map[string]bool{
+	"config":             true,
+	"reload-interval":    true,
+	"base":               true,
+	"lets-encrypt":       true,
+	"lets-encrypt-host":  true,
+	"lets-encrypt-email": true,
+	"lets-encrypt-cache": true,
+}
+
+// checkConfigFlags returns an error naming the flags, set on the command
+// line or through their environment variables, that the configuration
+// file would otherwise silently replace.
+func checkConfigFlags(c *cli.Context) error {
+	var set []string
+	for _, f := range c.Command.Flags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if !fileFlags[name] && (c.IsSet(name) || envSet(f)) {
+			set = append(set, "--"+name)
+		}
+	}
+	for _, name := range []string{"username", "password"} {
+		if c.GlobalIsSet(name) {
+			set = append(set, "--"+name)
+		}
+	}
+	if len(set) != 0 {
+		return fmt.Errorf("--config cannot be combined with %s, which the configuration file replaces",
+			strings.Join(set, ", "),
+		)
+	}
+	return nil
+}
+
+// envSet reports whether an environment variable of the flag is set.
+func envSet(f cli.Flag) bool {
+	v := reflect.ValueOf(f).FieldByName("EnvVar")
+	if !v.IsValid() || v.String() == "" {
+		return false
+	}
+	for _, name := range strings.Split(v.String(), ",") {
+		if os.Getenv(strings.TrimSpace(name)) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// reloader returns a function reloading the server configuration and
+// the tls certificates.
+func reloader(s *server.Server, pairs ...*config.KeyPair) func(*server.Config) error {
+	return func(c *server.Config) error {
+		for _, pair := range pairs {
+			if pair == nil {
+				continue
+			}
+			if err := pair.Reload(); err != nil {
+				logger.Warningf("stomp: reload certificate: %s", err)
+			}
+		}
+		return s.Reload(c)
+	}
+}
+
+// tlsConfig returns the tls configuration of the listener, or nil if
+// the listener does not serve tls. Client certificates are required
+// and verified if the listener has a client ca.
+func tlsConfig(l server.ListenerConfig) (*tls.Config, *config.KeyPair, error) {
+	if l.Cert == "" {
+		return nil, nil, nil
+	}
+	pair, err := config.LoadKeyPair(l.Cert, l.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &tls.Config{GetCertificate: pair.GetCertificate}
+	if l.ClientCA != "" {
+		pem, err := ioutil.ReadFile(l.ClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("%s: no certificates", l.ClientCA)
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, pair, nil
+}
+
+// listen announces on the listener address. Connections beyond the
+// listener limit are closed, and proxy protocol headers are read before
+// the tls handshake.
+func listen(l server.ListenerConfig, c *tls.Config) (net.Listener, error) {
+	network := "tcp"
+	if l.Protocol == "unix" {
+		network = "unix"
+	}
+	ln, err := net.Listen(network, l.Address)
+	if err != nil {
+		return nil, err
+	}
+	if l.MaxConnections > 0 {
+		ln = server.LimitListener(ln, l.MaxConnections)
+	}
+	if l.ProxyProtocol {
+		proxied, err := server.ProxyListener(ln, l.TrustedProxies...)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = proxied
+	}
+	if c != nil {
+		ln = tls.NewListener(ln, c)
+	}
+	return ln, nil
+}
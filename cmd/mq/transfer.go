@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mrwill84/mq/server"
+	"github.com/urfave/cli"
+)
+
+// the move and copy commands transfer queued messages between
+// destinations using the admin api of a running broker, for example to
+// re-drive messages from a dead-letter queue after a bug fix.
+
+var transferFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "admin",
+		Usage:  "stomp admin api address",
+		Value:  "http://localhost:8000",
+		EnvVar: "STOMP_ADMIN",
+	},
+	cli.StringFlag{
+		Name:   "base",
+		Usage:  "stomp admin api base path",
+		EnvVar: "STOMP_BASE",
+	},
+	cli.StringFlag{
+		Name:  "where",
+		Usage: "transfers messages matching the SQL filter",
+	},
+	cli.IntFlag{
+		Name:  "count, n",
+		Usage: "transfers at most the number of messages",
+	},
+}
+
+var comandMove = cli.Command{
+	Name:      "move",
+	Usage:     "move queued messages to another destination",
+	ArgsUsage: "<source> [destination]",
+	Action: func(c *cli.Context) error {
+		return transfer(c, false)
+	},
+	Flags: transferFlags,
+}
+
+var comandCopy = cli.Command{
+	Name:      "copy",
+	Usage:     "copy queued messages to another destination",
+	ArgsUsage: "<source> <destination>",
+	Action: func(c *cli.Context) error {
+		return transfer(c, true)
+	},
+	Flags: transferFlags,
+}
+
+// transfer requests the broker to move or copy the messages. Messages
+// moved without a destination are returned to the destination they were
+// dead-lettered from. The request authenticates with the username and
+// password, if set.
+func transfer(c *cli.Context, copies bool) error {
+	params := url.Values{}
+	params.Set("source", c.Args().First())
+	params.Set("destination", c.Args().Get(1))
+	params.Set("selector", c.String("where"))
+	params.Set("limit", strconv.Itoa(c.Int("count")))
+	params.Set("host", c.GlobalString("host"))
+	params.Set("copy", strconv.FormatBool(copies))
+
+	target := strings.TrimSuffix(c.String("admin"), "/") +
+		path.Join("/", c.String("base"), "meta/transfer")
+	req, err := http.NewRequest("POST", target, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(server.HeaderAdminRequest, "1")
+	if user := c.GlobalString("username"); user != "" {
+		req.SetBasicAuth(user, c.GlobalString("password"))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("transfer failed: %s", strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Transferred int `json:"transferred"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	fmt.Printf("%d messages transferred\n", result.Transferred)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/mrwill84/mq/stomp"
+
+	"github.com/urfave/cli"
+)
+
+// the vectors command emits canonical frame test vectors for validating
+// parsers of clients written in other languages against this broker.
+
+var comandVectors = cli.Command{
+	Name:   "vectors",
+	Usage:  "print canonical frame test vectors as json",
+	Action: vectors,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "out, o",
+			Usage: "write the test vectors to a file",
+		},
+	},
+}
+
+func vectors(c *cli.Context) error {
+	out := os.Stdout
+	if path := c.String("out"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stomp.Vectors())
+}
@@ -0,0 +1,257 @@
+// Package config loads the broker configuration from YAML, TOML or JSON
+// files, with environment variable overrides.
+//
+// The file mirrors server.Config, for example in YAML:
+//
+//	auth:
+//	  username: admin
+//	  password: secret
+//	listeners:
+//	  - protocol: tcp
+//	    address: ":9000"
+//	limits:
+//	  max_frame_size: 1048576
+//	timeouts:
+//	  heartbeat: 30s
+//	policies:
+//	  store: /var/lib/mq
+//
+// Every scalar setting may be overridden by an environment variable
+// named after its path, such as STOMP_LIMITS_MAX_FRAME_SIZE or
+// STOMP_AUTH_PASSWORD. Lists are overridden by comma-separated values.
+//
+// Watch reloads the file when it changes or on SIGHUP, applying the
+// credentials, rate limits and destination policies to a running server.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrwill84/mq/server"
+)
+
+// EnvPrefix prefixes the environment variables overriding settings.
+const EnvPrefix = "STOMP_"
+
+// Format is the encoding of a configuration file.
+type Format string
+
+// Configuration file formats.
+const (
+	YAML Format = "yaml"
+	TOML Format = "toml"
+	JSON Format = "json"
+)
+
+// FormatOf returns the format of the file, selected by its extension.
+func FormatOf(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return YAML, nil
+	case ".toml":
+		return TOML, nil
+	case ".json":
+		return JSON, nil
+	}
+	return "", fmt.Errorf("config: unknown file format %q", filepath.Ext(path))
+}
+
+// Load reads the configuration file, applies the environment variable
+// overrides, and validates the result.
+func Load(path string) (*server.Config, error) {
+	format, err := FormatOf(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := Override(c, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Parse decodes the configuration. Unknown settings are rejected.
+func Parse(data []byte, format Format) (*server.Config, error) {
+	var (
+		v   interface{}
+		err error
+	)
+	switch format {
+	case YAML:
+		v, err = parseYAML(data)
+	case TOML:
+		v, err = parseTOML(data)
+	case JSON:
+		err = json.Unmarshal(data, &v)
+	default:
+		err = fmt.Errorf("config: unknown format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(server.Config)
+	if v == nil {
+		return c, nil
+	}
+	if err := checkKeys(v, reflect.TypeOf(*c), ""); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	return c, nil
+}
+
+// checkKeys returns an error naming the first setting of the decoded
+// value that is not a field of the type.
+func checkKeys(v interface{}, t reflect.Type, path string) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if t.Kind() == reflect.Map {
+			for key, item := range v {
+				if err := checkKeys(item, t.Elem(), join(path, key)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if t.Kind() != reflect.Struct || t == durationType {
+			return fmt.Errorf("config: %s: unexpected table", path)
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			f, ok := fieldByTag(t, key)
+			if !ok {
+				return fmt.Errorf("config: %s: unknown setting", join(path, key))
+			}
+			if err := checkKeys(v[key], f.Type, join(path, key)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return fmt.Errorf("config: %s: unexpected list", path)
+		}
+		for i, item := range v {
+			if err := checkKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(server.Duration(0))
+
+// fieldByTag returns the struct field with the JSON name.
+func fieldByTag(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if strings.Split(f.Tag.Get("json"), ",")[0] == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Override sets the settings named by environment variables, looked up
+// with the lookup function, such as os.LookupEnv. Settings within lists,
+// such as listeners, cannot be overridden.
+func Override(c *server.Config, lookup func(string) (string, bool)) error {
+	return override(reflect.ValueOf(c).Elem(), "", lookup)
+}
+
+func override(v reflect.Value, path string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		field := v.Field(i)
+		fpath := join(path, name)
+		if field.Kind() == reflect.Struct {
+			if err := override(field, fpath, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		env := EnvPrefix + strings.ToUpper(strings.Replace(fpath, ".", "_", -1))
+		s, ok := lookup(env)
+		if !ok {
+			continue
+		}
+		if err := setValue(field, s); err != nil {
+			return fmt.Errorf("config: %s: %s", env, err)
+		}
+	}
+	return nil
+}
+
+// setValue parses the string into the value.
+func setValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		var d server.Duration
+		if err := d.UnmarshalJSON([]byte(strconv.Quote(s))); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
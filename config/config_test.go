@@ -0,0 +1,197 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/server"
+)
+
+const testYAML = `
+# broker settings
+auth:
+  username: admin
+  password: "s3cret # not a comment"
+listeners:
+  - protocol: tcp
+    address: :9000
+  - protocol: http
+    address: ":8000"
+    cert: cert.pem
+    key: key.pem
+limits:
+  max_frame_size: 65536
+  slow_consumer: 100
+timeouts:
+  heartbeat: 10s
+  slow_consumer: 1m
+policies:
+  store: /var/lib/mq
+  replication: true
+  standbys: [admin]
+  features: [work-stealing]
+  slow_consumer: advisory
+`
+
+const testTOML = `
+# broker settings
+[auth]
+username = "admin"
+password = "s3cret # not a comment"
+
+[[listeners]]
+protocol = "tcp"
+address = ":9000"
+
+[[listeners]]
+protocol = "http"
+address = ":8000"
+cert = "cert.pem"
+key = 'key.pem'
+
+[limits]
+max_frame_size = 65_536
+slow_consumer = 100
+
+[timeouts]
+heartbeat = "10s"
+slow_consumer = "1m"
+
+[policies]
+store = "/var/lib/mq"
+replication = true
+standbys = ["admin"]
+features = [
+  "work-stealing", # comment
+]
+slow_consumer = "advisory"
+`
+
+var testConfig = server.Config{
+	Auth: server.AuthConfig{Username: "admin", Password: "s3cret # not a comment"},
+	Listeners: []server.ListenerConfig{
+		{Protocol: "tcp", Address: ":9000"},
+		{Protocol: "http", Address: ":8000", Cert: "cert.pem", Key: "key.pem"},
+	},
+	Limits: server.LimitsConfig{MaxFrameSize: 65536, SlowConsumer: 100},
+	Timeouts: server.TimeoutsConfig{
+		Heartbeat:    server.Duration(10 * time.Second),
+		SlowConsumer: server.Duration(time.Minute),
+	},
+	Policies: server.PoliciesConfig{
+		Store:        "/var/lib/mq",
+		Replication:  true,
+		Standbys:     []string{"admin"},
+		Features:     []string{"work-stealing"},
+		SlowConsumer: "advisory",
+	},
+}
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		format Format
+		data   string
+	}{
+		{YAML, testYAML},
+		{TOML, testTOML},
+	} {
+		c, err := Parse([]byte(test.data), test.format)
+		if err != nil {
+			t.Errorf("Want %s parsed, got %s", test.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(*c, testConfig) {
+			t.Errorf("Want %s config %+v, got %+v", test.format, testConfig, *c)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		format Format
+		data   string
+		want   string
+	}{
+		{YAML, "limits:\n  read_bufer: 10\n", "limits.read_bufer: unknown setting"},
+		{YAML, "limits:\n  read_buffer: 10\n   write_buffer: 10\n", "line 3: mapping values are not allowed"},
+		{YAML, "limits:\n  1: 10\n", "limits: invalid key 1"},
+		{YAML, "timeouts:\n  heartbeat: soon\n", "time: invalid duration"},
+		{YAML, "listeners:\n  protocol: tcp\n", "listeners: unexpected table"},
+		{TOML, "[limits]\nread_buffer = ten\n", "line 2 (last key parsed 'limits.read_buffer'): expected value"},
+		{TOML, "[limits]\nread_buffer = 1\nread_buffer = 2\n", "'limits.read_buffer' has already been defined"},
+		{TOML, "[[listeners]]\nport = 9000\n", "listeners[0].port: unknown setting"},
+	} {
+		_, err := Parse([]byte(test.data), test.format)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Want %s error %q, got %v", test.format, test.want, err)
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	env := map[string]string{
+		"STOMP_AUTH_PASSWORD":                  "override",
+		"STOMP_LIMITS_READ_BUFFER":             "4096",
+		"STOMP_TIMEOUTS_IDLE":                  "5m",
+		"STOMP_POLICIES_EXPLICIT_DESTINATIONS": "true",
+		"STOMP_POLICIES_FEATURES":              "presence, webhooks",
+	}
+	var c server.Config
+	err := Override(&c, func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Auth.Password != "override" || c.Limits.ReadBuffer != 4096 ||
+		time.Duration(c.Timeouts.Idle) != 5*time.Minute || !c.Policies.Explicit ||
+		!reflect.DeepEqual(c.Policies.Features, []string{"presence", "webhooks"}) {
+		t.Errorf("Want settings overridden, got %+v", c)
+	}
+
+	err = Override(&c, func(name string) (string, bool) {
+		return "many", name == "STOMP_LIMITS_READ_BUFFER"
+	})
+	if err == nil || !strings.Contains(err.Error(), "STOMP_LIMITS_READ_BUFFER") {
+		t.Errorf("Want invalid override reported, got %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mq.yml")
+	if err := ioutil.WriteFile(path, []byte(testYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("STOMP_AUTH_USERNAME", "operator")
+	defer os.Unsetenv("STOMP_AUTH_USERNAME")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Auth.Username != "operator" {
+		t.Errorf("Want environment override applied, got %q", c.Auth.Username)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("limits:\n  read_buffer: 10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Errorf("Want invalid configuration rejected")
+	}
+	if _, err := Load(filepath.Join(dir, "mq.ini")); err == nil {
+		t.Errorf("Want unknown format rejected")
+	}
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// KeyPair is a TLS certificate loaded from a certificate and key file,
+// which may be reloaded while serving connections.
+type KeyPair struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value // *tls.Certificate
+}
+
+// LoadKeyPair loads the certificate and key files.
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	k := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reloads the certificate and key files. New TLS handshakes use
+// the reloaded certificate; established connections are unaffected. If
+// the files fail to load the current certificate is kept.
+func (k *KeyPair) Reload() error {
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return err
+	}
+	k.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate returns the current certificate, for use as the
+// tls.Config GetCertificate callback.
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.cert.Load().(*tls.Certificate), nil
+}
@@ -0,0 +1,20 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// parseTOML decodes a TOML document into maps and lists, so that it can
+// be checked and converted like a JSON document.
+func parseTOML(data []byte) (interface{}, error) {
+	var v map[string]interface{}
+	if _, err := toml.Decode(string(data), &v); err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	if len(v) == 0 {
+		return nil, nil
+	}
+	return normalize(v, "")
+}
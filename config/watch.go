@@ -0,0 +1,94 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/server"
+)
+
+// Watcher reloads a configuration file when it changes or when the
+// process receives SIGHUP.
+type Watcher struct {
+	path   string
+	reload func(*server.Config) error
+	hup    chan os.Signal
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// Watch starts watching the configuration file, polling its
+// modification time at the interval. Each configuration loaded is
+// passed to the reload function, such as Server.Reload. A file that
+// fails to load or validate is logged and the current configuration is
+// kept. A zero interval disables polling.
+func Watch(path string, interval time.Duration, reload func(*server.Config) error) *Watcher {
+	w := &Watcher{
+		path:   path,
+		reload: reload,
+		hup:    make(chan os.Signal, 1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	signal.Notify(w.hup, syscall.SIGHUP)
+	go w.run(interval, w.modified())
+	return w
+}
+
+// Close stops watching the configuration file.
+func (w *Watcher) Close() error {
+	signal.Stop(w.hup)
+	close(w.done)
+	<-w.exited
+	return nil
+}
+
+func (w *Watcher) run(interval time.Duration, last time.Time) {
+	defer close(w.exited)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.hup:
+			logger.Noticef("stomp: reloading %s on SIGHUP", w.path)
+			last = w.modified()
+			w.load()
+		case <-tick:
+			if mod := w.modified(); !mod.Equal(last) {
+				logger.Noticef("stomp: reloading %s, file changed", w.path)
+				last = mod
+				w.load()
+			}
+		}
+	}
+}
+
+// modified returns the modification time of the file, or the zero time
+// if the file cannot be read.
+func (w *Watcher) modified() time.Time {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (w *Watcher) load() {
+	c, err := Load(w.path)
+	if err == nil {
+		err = w.reload(c)
+	}
+	if err != nil {
+		logger.Warningf("stomp: reload %s: %s", w.path, err)
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/server"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mq.yml")
+	write := func(data string, mod time.Time) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("auth:\n  username: admin\n", start)
+
+	reloaded := make(chan *server.Config, 1)
+	w := Watch(path, 10*time.Millisecond, func(c *server.Config) error {
+		reloaded <- c
+		return nil
+	})
+	defer w.Close()
+
+	write("limits:\n  read_buffer: 10\n", start.Add(time.Second))
+	write("auth:\n  username: operator\n", start.Add(2*time.Second))
+	select {
+	case c := <-reloaded:
+		if c.Auth.Username != "operator" {
+			t.Errorf("Want changed configuration reloaded, got %+v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want configuration reloaded when the file changes")
+	}
+
+	select {
+	case c := <-reloaded:
+		t.Errorf("Want unchanged configuration not reloaded, got %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// parseYAML decodes a YAML document into maps with string keys, so that
+// it can be checked and converted like a JSON document.
+func parseYAML(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	return normalize(v, "")
+}
+
+// normalize converts the maps and lists of a decoded document to the
+// types produced by encoding/json.
+func normalize(v interface{}, path string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("config: %s: invalid key %v", path, key)
+			}
+			n, err := normalize(item, join(path, k))
+			if err != nil {
+				return nil, err
+			}
+			m[k] = n
+		}
+		return m, nil
+	case map[string]interface{}:
+		for key, item := range v {
+			n, err := normalize(item, join(path, key))
+			if err != nil {
+				return nil, err
+			}
+			v[key] = n
+		}
+		return v, nil
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			n, err := normalize(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = n
+		}
+		return items, nil
+	case []interface{}:
+		for i, item := range v {
+			n, err := normalize(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+		return v, nil
+	}
+	return v, nil
+}
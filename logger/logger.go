@@ -27,11 +27,23 @@ func Printf(format string, args ...interface{}) {
 	std.Printf(format, args...)
 }
 
+// DebugEnabled returns false if the standard logger discards all
+// messages, so that hot paths can skip formatting debug messages.
+func DebugEnabled() bool {
+	_, ok := std.(*none)
+	return !ok
+}
+
 // SetLogger sets the standard logger.
 func SetLogger(logger Logger) {
 	std = logger
 }
 
+// GetLogger returns the standard logger.
+func GetLogger() Logger {
+	return std
+}
+
 // Logger represents a logger.
 type Logger interface {
 
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+var (
+	// ErrNoReplicas is returned when a message requests the majority
+	// ack level and the server has no replicas.
+	ErrNoReplicas = errors.New("stomp: majority ack level requires replicas")
+
+	// ErrNoStore is returned when a message requests the fsync ack
+	// level and the server has no datastore.
+	ErrNoStore = errors.New("stomp: fsync ack level requires a datastore")
+
+	// ErrNotDurable is returned when a message sent to a topic requests
+	// the majority or fsync ack level, or a scheduled message requests
+	// the majority ack level. Topic messages are never persisted or
+	// replicated, and scheduled messages are replicated once published.
+	ErrNotDurable = errors.New("stomp: ack level requires a queue")
+
+	errAckLevel = errors.New("stomp: unknown ack level")
+)
+
+// publishLevel publishes the message and blocks until the message
+// reaches the requested ack level, recording the latency for the level.
+// A message sent with the majority ack level becomes visible to
+// subscribers only once a majority of the cluster holds it, so that a
+// message that fails to replicate is not delivered.
+func (r *router) publishLevel(m *stomp.Message, level []byte) error {
+	start := time.Now()
+	err := r.checkLevel(m, level)
+	if err == nil {
+		var wait func() error
+		if bytes.Equal(level, stomp.AckLevelMajority) {
+			wait = r.replicas.expect(m)
+		}
+		err = r.publishWait(m, wait)
+	}
+	r.acks.record(string(level), time.Since(start), err)
+	return err
+}
+
+// checkLevel returns an error if the server cannot provide the
+// requested ack level for the message.
+func (r *router) checkLevel(m *stomp.Message, level []byte) error {
+	switch {
+	case bytes.Equal(level, stomp.AckLevelLeader):
+		return nil
+	case bytes.Equal(level, stomp.AckLevelMajority):
+		if r.replicas.len() == 0 {
+			return ErrNoReplicas
+		}
+		if bytes.HasPrefix(m.Dest, routeTopic) || isPresence(m.Dest) {
+			return ErrNotDurable
+		}
+		if !scheduledTime(m, time.Now()).IsZero() {
+			return ErrNotDurable
+		}
+		return nil
+	case bytes.Equal(level, stomp.AckLevelFsync):
+		if r.store == nil {
+			return ErrNoStore
+		}
+		if bytes.HasPrefix(m.Dest, routeTopic) {
+			return ErrNotDurable
+		}
+		return nil
+	default:
+		return errAckLevel
+	}
+}
+
+// ackMetrics tracks the number of messages, errors and latency for
+// each ack level.
+type ackMetrics struct {
+	sync.Mutex
+	levels map[string]*ackLevelStats
+}
+
+type ackLevelStats struct {
+	Count   int64 `json:"count"`
+	Errors  int64 `json:"errors"`
+	Latency int64 `json:"latency_ns"` // cumulative latency
+}
+
+func newAckMetrics() *ackMetrics {
+	return &ackMetrics{levels: make(map[string]*ackLevelStats)}
+}
+
+func (a *ackMetrics) record(level string, latency time.Duration, err error) {
+	a.Lock()
+	defer a.Unlock()
+	stats, ok := a.levels[level]
+	if !ok {
+		stats = new(ackLevelStats)
+		a.levels[level] = stats
+	}
+	stats.Count++
+	stats.Latency += int64(latency)
+	if err != nil {
+		stats.Errors++
+	}
+}
+
+// snapshot adds the ack level stats to the map.
+func (a *ackMetrics) snapshot(levels map[string]*ackLevelStats) {
+	a.Lock()
+	defer a.Unlock()
+	for level, stats := range a.levels {
+		total, ok := levels[level]
+		if !ok {
+			total = new(ackLevelStats)
+			levels[level] = total
+		}
+		total.Count += stats.Count
+		total.Errors += stats.Errors
+		total.Latency += stats.Latency
+	}
+}
+
+// HandleAckLevels writes a JSON-encoded summary of the messages, errors
+// and average latency for each ack level to the http.Request.
+func (s *Server) HandleAckLevels(w http.ResponseWriter, r *http.Request) {
+	type levelResp struct {
+		Count   int64   `json:"count"`
+		Errors  int64   `json:"errors"`
+		Latency float64 `json:"avg_latency_ms"`
+	}
+
+	levels := map[string]*ackLevelStats{}
+	for _, router := range s.routers() {
+		router.acks.snapshot(levels)
+	}
+
+	resp := map[string]levelResp{}
+	for level, stats := range levels {
+		resp[level] = levelResp{
+			Count:   stats.Count,
+			Errors:  stats.Errors,
+			Latency: float64(stats.Latency) / float64(stats.Count) / float64(time.Millisecond),
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
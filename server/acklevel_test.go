@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestAckLevels(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err := client.Send("/queue/test", []byte("hello"),
+		stomp.WithAckLevel(stomp.AckLevelLeader),
+	)
+	if err != nil {
+		t.Errorf("Expect receipt for leader ack level, got error %s", err)
+	}
+	err = client.Send("/queue/test", []byte("hello"),
+		stomp.WithAckLevel(stomp.AckLevelMajority),
+	)
+	if err == nil {
+		t.Errorf("Expect error for majority ack level without replicas")
+	}
+	err = client.Send("/queue/test", []byte("hello"),
+		stomp.WithAckLevel(stomp.AckLevelFsync),
+	)
+	if err == nil {
+		t.Errorf("Expect error for fsync ack level without a datastore")
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleAckLevels(w, httptest.NewRequest("GET", "/meta/acklevels", nil))
+	var levels map[string]struct {
+		Count  int64 `json:"count"`
+		Errors int64 `json:"errors"`
+	}
+	json.NewDecoder(w.Body).Decode(&levels)
+	if got := levels["leader"]; got.Count != 1 || got.Errors != 0 {
+		t.Errorf("Expect 1 leader ack without errors, got %+v", got)
+	}
+	if got := levels["majority"]; got.Count != 1 || got.Errors != 1 {
+		t.Errorf("Expect 1 majority ack with error, got %+v", got)
+	}
+}
+
+func TestAckLevelFsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer(WithStore(dir))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	err = client.Send("/queue/test", []byte("hello"),
+		stomp.WithAckLevel(stomp.AckLevelFsync),
+	)
+	if err != nil {
+		t.Errorf("Expect receipt for fsync ack level, got error %s", err)
+	}
+	err = client.Send("/topic/test", []byte("hello"),
+		stomp.WithAckLevel(stomp.AckLevelFsync),
+	)
+	if err == nil {
+		t.Errorf("Expect error for fsync ack level sent to a topic")
+	}
+	client.Disconnect()
+	s.router.store.close()
+
+	// the persisted message is restored when the server restarts,
+	// whatever the order of the options.
+	s = NewServer(WithStore(dir), WithShards(4))
+	defer s.router.store.close()
+	h, ok := s.router.destinations.load("/queue/test")
+	if !ok {
+		t.Fatalf("Expect persisted queue restored")
+	}
+	if got := h.(*queue).list.Len(); got != 1 {
+		t.Errorf("Expect persisted message restored, got %d messages", got)
+	}
+}
+
+func TestAckLevelFsyncUnacked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer(WithStore(dir))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *stomp.Message, 2)
+	_, err = client.Subscribe("/queue/test", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m.Clone()
+	}), stomp.WithAck("client-individual"), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"acked", "unacked"} {
+		err = client.Send("/queue/test", []byte(body),
+			stomp.WithAckLevel(stomp.AckLevelFsync),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		m := waitMessage(t, received)
+		if string(m.Body) == "acked" {
+			client.Ack(m.Ack, stomp.WithReceipt())
+		}
+	}
+
+	// the server stops without the session ending, as in a crash.
+	s.router.store.close()
+
+	s = NewServer(WithStore(dir))
+	defer s.router.store.close()
+	h, ok := s.router.destinations.load("/queue/test")
+	if !ok {
+		t.Fatalf("Expect unacknowledged message restored")
+	}
+	q := h.(*queue)
+	if got := q.list.Len(); got != 1 {
+		t.Fatalf("Expect only the unacknowledged message restored, got %d messages", got)
+	}
+	if got := q.list.Front().Value.(*stomp.Message); string(got.Body) != "unacked" {
+		t.Errorf("Expect unacknowledged message restored, got %q", got.Body)
+	}
+}
+
+func TestAckLevelMajorityTimeout(t *testing.T) {
+	defer func(d time.Duration) { replicaTimeout = d }(replicaTimeout)
+	replicaTimeout = 10 * time.Millisecond
+
+	s := NewServer(WithReplication("standby"))
+	peer, standby := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = peer
+	defer sess.release()
+	sub := sess.subs(stomp.NewMessage())
+	s.router.replicas.subs[sub] = &replica{}
+
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/test")
+	m.Body = []byte("hello")
+	if err := s.router.publishLevel(m, stomp.AckLevelMajority); err != ErrReplicaTimeout {
+		t.Errorf("Expect ErrReplicaTimeout, got %v", err)
+	}
+	if stats, _ := s.Stats("", "/queue/test"); stats.Depth != 0 {
+		t.Errorf("Expect message not queued when replication fails, got depth %d", stats.Depth)
+	}
+	for _, op := range [][]byte{replicaPublish, replicaRemove} {
+		got := <-standby.Receive()
+		if !bytes.Equal(got.Header.Get(headerReplicaOp), op) {
+			t.Errorf("Expect replica %s, got %s", op, got.Header.Get(headerReplicaOp))
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// ErrForbidden is returned when a session sends to or subscribes to a
+// destination it is not permitted to.
+var ErrForbidden = errors.New("stomp: permission denied")
+
+// Destination permissions.
+const (
+	permSend      = "send"
+	permSubscribe = "subscribe"
+)
+
+// acl is the destination permissions of a session, granted by scopes of
+// the form "send:pattern" or "subscribe:pattern". A scope without a
+// pattern grants the permission for every destination.
+type acl struct {
+	send      []string
+	subscribe []string
+}
+
+func newACL(scopes []string) *acl {
+	a := new(acl)
+	for _, scope := range scopes {
+		perm, pattern := scope, "*"
+		if i := strings.Index(scope, ":"); i != -1 {
+			perm, pattern = scope[:i], scope[i+1:]
+		}
+		switch perm {
+		case permSend:
+			a.send = append(a.send, pattern)
+		case permSubscribe:
+			a.subscribe = append(a.subscribe, pattern)
+		}
+	}
+	return a
+}
+
+// allowed returns true if the permission is granted for the
+// destination. A nil acl grants every permission.
+func (a *acl) allowed(perm string, dest []byte) bool {
+	if a == nil {
+		return true
+	}
+	patterns := a.send
+	if perm == permSubscribe {
+		patterns = a.subscribe
+	}
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		if ok, _ := path.Match(pattern, string(dest)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+var (
+	// ErrSessionClosed is the reason a session is closed by an
+	// administrator.
+	ErrSessionClosed = errors.New("stomp: session closed by administrator")
+
+	errNoSession = errors.New("stomp: no such session")
+)
+
+// HeaderAdminRequest must be set, to any value, on admin API requests
+// that change the server. Browsers do not send custom headers on
+// cross-site requests, so the header prevents a page on another site
+// from submitting admin requests using the credentials of the browser.
+const HeaderAdminRequest = "X-MQ-Admin"
+
+// WithAdminAuth returns an Option which authenticates the admin API
+// requests that change the server using the authorizer, instead of the
+// authentication of the default host. Requests pass the username and
+// password using HTTP basic authentication.
+func WithAdminAuth(auth Authorizer) Option {
+	return func(s *Server) {
+		s.admin = auth
+	}
+}
+
+// authorizeAdmin returns true if the admin API request may change the
+// server, and otherwise writes the error response. The request must set
+// HeaderAdminRequest and authenticate with the admin authorizer or, if
+// none is set, as a connection to the default host: with a verified
+// client certificate, a bearer token or HTTP basic credentials. Requests
+// are not authenticated if neither configures authentication.
+func (s *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := s.authorizeAdminACL(w, r)
+	return ok
+}
+
+// authorizeAdminACL is like authorizeAdmin, and also returns the
+// permissions of the authenticated identity, or nil if unrestricted.
+func (s *Server) authorizeAdminACL(w http.ResponseWriter, r *http.Request) (*acl, bool) {
+	if r.Header.Get(HeaderAdminRequest) == "" {
+		http.Error(w, "stomp: missing "+HeaderAdminRequest+" header", http.StatusForbidden)
+		return nil, false
+	}
+	acl, err := s.authenticateAdmin(r)
+	if err != nil {
+		logger.Noticef("stomp: admin request %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", `Basic realm="mq"`)
+		http.Error(w, ErrNotAuthorized.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return acl, true
+}
+
+// authenticateAdmin authenticates the admin API request and returns the
+// permissions of the identity.
+func (s *Server) authenticateAdmin(r *http.Request) (*acl, error) {
+	var (
+		auth  = s.admin
+		jwt   *jwtVerifier
+		certs CertAuthorizer
+	)
+	if auth == nil {
+		s.router.RLock()
+		auth, jwt, certs = s.router.authorizer, s.router.jwt, s.router.certs
+		s.router.RUnlock()
+	}
+
+	m := stomp.NewMessage()
+	defer m.Release()
+	user, pass, ok := r.BasicAuth()
+	m.User, m.Pass = []byte(user), []byte(pass)
+	switch {
+	case certs != nil:
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return nil, errNoClientCert
+		}
+		id, err := certs.AuthorizeCert(r.TLS.PeerCertificates[0])
+		if err != nil || id.Scopes == nil {
+			return nil, err
+		}
+		return newACL(id.Scopes), nil
+	case jwt != nil:
+		if token := r.Header.Get("Authorization"); strings.HasPrefix(token, "Bearer ") {
+			m.Pass = []byte(strings.TrimPrefix(token, "Bearer "))
+		}
+		acl, _, err := jwt.authenticate(m)
+		return acl, err
+	case auth != nil:
+		if !ok {
+			return nil, ErrNotAuthorized
+		}
+		return nil, auth(m)
+	}
+	return nil, nil
+}
+
+// sessionSeq numbers the sessions of the server.
+var sessionSeq int64
+
+// CloseSession closes the session with the id, as listed by
+// HandleSessions, on any virtual host.
+func (s *Server) CloseSession(id int64) error {
+	for _, r := range s.routers() {
+		var found *session
+		r.RLock()
+		for sess := range r.sessions {
+			if sess.id == id {
+				found = sess
+				break
+			}
+		}
+		r.RUnlock()
+		if found != nil {
+			logger.Noticef("stomp: closing session %s", found.peer.Addr())
+			return stomp.CloseWithError(found.peer, ErrSessionClosed)
+		}
+	}
+	return errNoSession
+}
+
+// PurgeDestination removes the queued messages of the queue, or the
+// retained messages of the topic, on the named virtual host, or the
+// default host if empty. It returns the number of messages removed.
+func (s *Server) PurgeDestination(host, dest string) (int, error) {
+	r := s.lookup([]byte(host))
+	if r == nil {
+		return 0, ErrUnknownHost
+	}
+	h, ok := r.destinations.load(dest)
+	if !ok {
+		return 0, errNoDestination
+	}
+	var n int
+	switch h := h.(type) {
+	case *queue:
+		n = h.discard()
+	case *topic:
+		n = h.purge()
+	}
+	logger.Noticef("stomp: destination %s purged: %d messages", dest, n)
+	return n, nil
+}
+
+// handleCloseSession closes the session with the id query parameter.
+// It requires admin authentication.
+func (s *Server) handleCloseSession(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err := s.CloseSession(id); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errNoSession:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// HandlePurge purges the destination query parameter on a POST request,
+// and writes the JSON-encoded number of messages removed to the
+// http.Request. It requires admin authentication.
+func (s *Server) HandlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	n, err := s.PurgeDestination(r.FormValue("host"), r.FormValue("destination"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Purged int `json:"purged"`
+	}{n})
+}
@@ -0,0 +1,119 @@
+(function() {
+	var refresh = 2000;
+
+	// the admin api is served next to meta/admin, so urls are resolved
+	// against the script, which is served below meta/admin/.
+	var api = new URL("../", document.currentScript.src);
+
+	function request(method, path, done) {
+		var url = new URL(path, api).href;
+		var xhr = new XMLHttpRequest();
+		xhr.open(method, url);
+		// the admin api rejects requests without the header, which
+		// browsers do not send on cross-site requests.
+		xhr.setRequestHeader("X-MQ-Admin", "1");
+		xhr.onload = function() {
+			if (xhr.status >= 300) {
+				fail(method + " " + url + ": " + xhr.responseText);
+				return;
+			}
+			done(xhr.responseText ? JSON.parse(xhr.responseText) : null);
+		};
+		xhr.onerror = function() {
+			fail(method + " " + url + ": request failed");
+		};
+		xhr.send();
+	}
+
+	function fail(msg) {
+		document.getElementById("error").textContent = msg;
+	}
+
+	function cell(row, text, num) {
+		var td = document.createElement("td");
+		td.textContent = text;
+		if (num) {
+			td.className = "num";
+		}
+		row.appendChild(td);
+	}
+
+	function button(row, label, confirmText, action) {
+		var td = document.createElement("td");
+		var b = document.createElement("button");
+		b.textContent = label;
+		b.onclick = function() {
+			if (confirm(confirmText)) {
+				action();
+			}
+		};
+		td.appendChild(b);
+		row.appendChild(td);
+	}
+
+	function query(params) {
+		var q = [];
+		for (var k in params) {
+			if (params[k]) {
+				q.push(k + "=" + encodeURIComponent(params[k]));
+			}
+		}
+		return q.join("&");
+	}
+
+	function destinations(stats) {
+		var body = document.getElementById("destinations");
+		body.innerHTML = "";
+		(stats || []).forEach(function(d) {
+			var row = document.createElement("tr");
+			cell(row, d.host || "");
+			cell(row, d.destination);
+			cell(row, d.depth, true);
+			cell(row, d.oldest_age_seconds.toFixed(1), true);
+			cell(row, d.subscribers, true);
+			cell(row, d.enqueued, true);
+			cell(row, d.dequeued, true);
+			cell(row, d.bytes_in, true);
+			cell(row, d.bytes_out, true);
+			button(row, "Purge", "Purge " + d.destination + "?", function() {
+				request("POST", "purge?" + query({host: d.host, destination: d.destination}), load);
+			});
+			body.appendChild(row);
+		});
+	}
+
+	function sessions(list) {
+		var body = document.getElementById("sessions");
+		body.innerHTML = "";
+		(list || []).forEach(function(s) {
+			var row = document.createElement("tr");
+			cell(row, s.id, true);
+			cell(row, s.host || "");
+			cell(row, s.address);
+			cell(row, s.username);
+			cell(row, s.client || "");
+			cell(row, new Date(s.connected).toLocaleString());
+			cell(row, s.idle_seconds.toFixed(1), true);
+			cell(row, s.frames, true);
+			button(row, "Kick", "Close session " + s.id + "?", function() {
+				request("DELETE", "sessions?" + query({id: String(s.id)}), load);
+			});
+			body.appendChild(row);
+		});
+	}
+
+	function load() {
+		request("GET", "stats", function(stats) {
+			destinations(stats);
+			request("GET", "sessions", function(list) {
+				sessions(list);
+				fail("");
+				document.getElementById("status").textContent =
+					"Updated " + new Date().toLocaleTimeString();
+			});
+		});
+	}
+
+	load();
+	setInterval(load, refresh);
+})();
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// adminRequest returns an admin API request with the admin header set.
+func adminRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set(HeaderAdminRequest, "1")
+	return r
+}
+
+func TestPurgeDestination(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	for _, body := range []string{"1", "2"} {
+		client.Send("/queue/orders", []byte(body), stomp.WithReceipt())
+	}
+	client.Send("/topic/prices", []byte("1"), stomp.WithRetain(string(stomp.RetainAll)), stomp.WithReceipt())
+
+	w := httptest.NewRecorder()
+	s.HandlePurge(w, httptest.NewRequest("POST", "/meta/purge?destination=/queue/orders", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Want purge rejected without the admin header, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.HandlePurge(w, adminRequest("POST", "/meta/purge?destination=/queue/orders"))
+	var resp struct {
+		Purged int `json:"purged"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Purged != 2 {
+		t.Errorf("Want 2 messages purged, got %d", resp.Purged)
+	}
+	if stats, _ := s.Stats("", "/queue/orders"); stats.Depth != 0 {
+		t.Errorf("Want queue emptied, got depth %d", stats.Depth)
+	}
+	if n, err := s.PurgeDestination("", "/topic/prices"); err != nil || n != 1 {
+		t.Errorf("Want retained message purged, got %d, %v", n, err)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandlePurge(w, adminRequest("POST", "/meta/purge?destination=/queue/missing"))
+	if w.Code != 404 {
+		t.Errorf("Want 404 purging a missing destination, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.HandlePurge(w, httptest.NewRequest("GET", "/meta/purge?destination=/queue/orders", nil))
+	if w.Code != 405 {
+		t.Errorf("Want 405 purging with GET, got %d", w.Code)
+	}
+}
+
+func TestCloseSession(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleSessions(w, httptest.NewRequest("GET", "/meta/sessions", nil))
+	var sessions []struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID == 0 {
+		t.Fatalf("Want session listed with an id, got %+v", sessions)
+	}
+
+	w = httptest.NewRecorder()
+	id := strconv.FormatInt(sessions[0].ID, 10)
+	s.HandleSessions(w, httptest.NewRequest("DELETE", "/meta/sessions?id="+id, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Want session close rejected without the admin header, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.HandleSessions(w, adminRequest("DELETE", "/meta/sessions?id="+id))
+	if w.Code != 204 {
+		t.Errorf("Want session closed, got %d", w.Code)
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Want client disconnected")
+	}
+
+	if err := s.CloseSession(0); err != errNoSession {
+		t.Errorf("Want errNoSession closing an unknown session, got %v", err)
+	}
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	tests := []struct {
+		server *Server
+		header bool
+		user   string
+		pass   string
+		code   int
+	}{
+		{NewServer(), false, "", "", http.StatusForbidden},
+		{NewServer(), true, "", "", 0},
+		{NewServer(WithCredentials("admin", "secret")), true, "", "", http.StatusUnauthorized},
+		{NewServer(WithCredentials("admin", "secret")), true, "admin", "wrong", http.StatusUnauthorized},
+		{NewServer(WithCredentials("admin", "secret")), false, "admin", "secret", http.StatusForbidden},
+		{NewServer(WithCredentials("admin", "secret")), true, "admin", "secret", 0},
+		{NewServer(WithCredentials("admin", "secret"), WithAdminAuth(BasicAuth("root", "toor"))), true, "admin", "secret", http.StatusUnauthorized},
+		{NewServer(WithCredentials("admin", "secret"), WithAdminAuth(BasicAuth("root", "toor"))), true, "root", "toor", 0},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("POST", "/meta/purge", nil)
+		if test.header {
+			r.Header.Set(HeaderAdminRequest, "1")
+		}
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.pass)
+		}
+		w := httptest.NewRecorder()
+		ok := test.server.authorizeAdmin(w, r)
+		if ok != (test.code == 0) || !ok && w.Code != test.code {
+			t.Errorf("test %d: want status %d, got authorized=%v status %d", i, test.code, ok, w.Code)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+//go:build go1.16
+// +build go1.16
+
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// adminFiles holds the static assets of the admin console. They are
+// compiled into the binary so that the broker serves the console
+// without static files.
+//
+//go:embed admin
+var adminFiles embed.FS
+
+// adminAssets serves the admin console assets.
+var adminAssets = http.FileServer(http.FS(adminRoot()))
+
+func adminRoot() fs.FS {
+	root, err := fs.Sub(adminFiles, "admin")
+	if err != nil {
+		panic(err)
+	}
+	return root
+}
+
+// HandleAdmin serves the admin console, a single page listing the
+// destinations and sessions of the server that refreshes itself and
+// purges destinations and closes sessions using the admin API. The
+// page is served at meta/admin, meta/admin/ redirecting to it, and its
+// assets below meta/admin/. The console expects the admin API handlers
+// to be registered alongside it: meta/admin next to meta/stats,
+// meta/sessions and meta/purge.
+func (s *Server) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	name := "/"
+	if i := strings.LastIndex(r.URL.Path, "/meta/admin/"); i != -1 {
+		name = r.URL.Path[i+len("/meta/admin"):]
+	}
+	// the page loads its assets relative to meta/admin.
+	if name == "/" && strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, "../admin", http.StatusMovedPermanently)
+		return
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = name
+	r2.URL.RawPath = ""
+
+	w.Header().Set("Cache-Control", "no-cache")
+	adminAssets.ServeHTTP(w, r2)
+}
@@ -0,0 +1,13 @@
+//go:build !go1.16
+// +build !go1.16
+
+package server
+
+import "net/http"
+
+// HandleAdmin serves the admin console. The console assets are embedded
+// in the binary, which requires Go 1.16, so older builds respond with
+// 404 Not Found.
+func (s *Server) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "stomp: admin console requires Go 1.16", http.StatusNotFound)
+}
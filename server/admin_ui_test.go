@@ -0,0 +1,49 @@
+//go:build go1.16
+// +build go1.16
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleAdmin(t *testing.T) {
+	s := NewServer()
+	w := httptest.NewRecorder()
+	s.HandleAdmin(w, httptest.NewRequest("GET", "/meta/admin", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Want html console, got %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), `src="admin/admin.js"`) {
+		t.Errorf("Want console to load its script")
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleAdmin(w, httptest.NewRequest("GET", "/mq/meta/admin/", nil))
+	if loc := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || loc != "/mq/meta/admin" {
+		t.Errorf("Want console redirected to meta/admin, got %d %s", w.Code, loc)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleAdmin(w, httptest.NewRequest("GET", "/mq/meta/admin/admin.js", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Want console script served, got status %d", w.Code)
+	}
+	for _, api := range []string{`"stats"`, `"sessions"`, `"purge?"`} {
+		if !strings.Contains(w.Body.String(), api) {
+			t.Errorf("Want console to use the %s admin api", api)
+		}
+	}
+	if !strings.Contains(w.Body.String(), `"`+HeaderAdminRequest+`"`) {
+		t.Errorf("Want console to send the %s header", HeaderAdminRequest)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleAdmin(w, httptest.NewRequest("GET", "/meta/admin/missing.js", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Want missing asset not found, got status %d", w.Code)
+	}
+}
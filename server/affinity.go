@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+
+	"golang.org/x/net/websocket"
+)
+
+// handshake validates the websocket handshake and issues the affinity
+// token for this node. Load balancers configured for cookie-based
+// session affinity use the token to route reconnections back to this
+// node, where the client session state is held.
+func (s *Server) handshake(config *websocket.Config, r *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, r)
+	if err == nil && config.Origin == nil {
+		return fmt.Errorf("null origin")
+	}
+	if err != nil {
+		return err
+	}
+
+	node := string(s.router.affinity)
+	if c, err := r.Cookie(stomp.AffinityCookie); err == nil && c.Value != node {
+		logger.Noticef("stomp: affinity token for node %s received by node %s",
+			c.Value,
+			node,
+		)
+	}
+
+	cookie := &http.Cookie{Name: stomp.AffinityCookie, Value: node, Path: "/"}
+	config.Header = http.Header{}
+	config.Header.Set("Set-Cookie", cookie.String())
+	return nil
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestAffinityHandshake(t *testing.T) {
+	s := NewServer(WithAffinity("node-1"))
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Origin", "http://localhost")
+	r.AddCookie(&http.Cookie{Name: stomp.AffinityCookie, Value: "node-2"})
+
+	config := &websocket.Config{Version: websocket.ProtocolVersionHybi13}
+	if err := s.handshake(config, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Header.Get("Set-Cookie"); !strings.HasPrefix(got, stomp.AffinityCookie+"=node-1") {
+		t.Errorf("Expect affinity cookie issued for node-1, got %q", got)
+	}
+}
+
+func TestAffinityConnected(t *testing.T) {
+	s := NewServer(WithAffinity("node-1"))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	if got := client.Affinity(); got != "node-1" {
+		t.Errorf("Expect affinity token reported when connecting, got %q", got)
+	}
+}
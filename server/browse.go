@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+	"github.com/mrwill84/mq/stomp/selector"
+)
+
+// browseLimit is the default number of messages returned by the browse
+// admin endpoint.
+var browseLimit = 100
+
+// snapshot returns copies of up to limit queued messages matching the
+// selector, including messages spilled to disk, without removing the
+// messages from the queue. A limit of zero returns all matching
+// messages.
+func (q *queue) snapshot(sel *selector.Selector, limit int) []*stomp.Message {
+	q.RLock()
+	defer q.RUnlock()
+
+	var messages []*stomp.Message
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		m := e.Value.(*stomp.Message)
+		if sel != nil {
+			if ok, _ := sel.Eval(m.Header); !ok {
+				continue
+			}
+		}
+		messages = append(messages, m.Clone())
+		if limit > 0 && len(messages) == limit {
+			return messages
+		}
+	}
+
+	err := q.overflow.each(func(m *stomp.Message) bool {
+		if sel != nil {
+			if ok, _ := sel.Eval(m.Header); !ok {
+				m.Release()
+				return true
+			}
+		}
+		messages = append(messages, m)
+		return limit == 0 || len(messages) < limit
+	})
+	if err != nil {
+		logger.Warningf("stomp: browse %s: overflow: %s", string(q.dest), err)
+	}
+	return messages
+}
+
+// browse sends copies of the queued messages to the session without
+// consuming them. A browse subscription is not registered with the
+// queue and receives no further messages; the receipt, if requested,
+// follows the last message.
+func (r *router) browse(sess *session, m *stomp.Message) error {
+	h, ok := r.destinations.load(string(m.Dest))
+	q, isQueue := h.(*queue)
+	if !ok || !isQueue {
+		return nil
+	}
+
+	var sel *selector.Selector
+	if len(m.Selector) != 0 {
+		var err error
+		if sel, err = selector.Parse(m.Selector); err != nil {
+			return err
+		}
+	}
+	for _, c := range q.snapshot(sel, 0) {
+		c.Method = stomp.MethodMessage
+		c.Subs = append(c.Subs[:0], m.ID...)
+		c.Ack = c.Ack[:0]
+		sess.send(c)
+	}
+	return nil
+}
+
+// HandleBrowse writes a JSON-encoded list of the messages queued for the
+// destination query parameter to the http.Request, without consuming the
+// messages. The number of messages is limited by the limit query
+// parameter, 100 by default. The request requires admin authentication
+// and permission to subscribe to the destination.
+func (s *Server) HandleBrowse(w http.ResponseWriter, r *http.Request) {
+	acl, ok := s.authorizeAdminACL(w, r)
+	if !ok {
+		return
+	}
+	dest := r.FormValue("destination")
+	if !acl.allowed(permSubscribe, []byte(dest)) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	type messageResp struct {
+		ID      string            `json:"message-id"`
+		Dest    string            `json:"destination"`
+		Expires string            `json:"expires,omitempty"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+		Size    int               `json:"size"`
+	}
+
+	limit := browseLimit
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	router := s.lookup([]byte(r.FormValue("host")))
+	if router == nil {
+		http.Error(w, ErrUnknownHost.Error(), http.StatusNotFound)
+		return
+	}
+	h, ok := router.destinations.load(dest)
+	q, isQueue := h.(*queue)
+	if !ok || !isQueue {
+		http.Error(w, errNoDestination.Error(), http.StatusNotFound)
+		return
+	}
+
+	messages := []messageResp{}
+	for _, m := range q.snapshot(nil, limit) {
+		headers := map[string]string{}
+		for i := 0; i < m.Header.Len(); i++ {
+			k, v := m.Header.Index(i)
+			headers[string(k)] = string(v)
+		}
+		messages = append(messages, messageResp{
+			ID:      string(m.ID),
+			Dest:    string(m.Dest),
+			Expires: string(m.Expires),
+			Headers: headers,
+			Body:    string(m.Body),
+			Size:    len(m.Body),
+		})
+		m.Release()
+	}
+	json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestBrowse(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	client.Send("/queue/test", []byte("hello"), stomp.WithHeader("lang", "en"))
+	client.Send("/queue/test", []byte("bonjour"), stomp.WithHeader("lang", "fr"),
+		stomp.WithReceipt(),
+	)
+
+	messages, err := client.Browse("/queue/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Want 2 messages browsed, got %d", len(messages))
+	}
+	if string(messages[0].Body) != "hello" || string(messages[1].Body) != "bonjour" {
+		t.Errorf("Want messages browsed in queue order")
+	}
+
+	messages, err = client.Browse("/queue/test", stomp.WithSelector("lang == 'fr'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || string(messages[0].Body) != "bonjour" {
+		t.Errorf("Want browsed messages filtered by selector")
+	}
+
+	h, _ := s.router.destinations.load("/queue/test")
+	q := h.(*queue)
+	q.RLock()
+	n := q.list.Len()
+	q.RUnlock()
+	if n != 2 {
+		t.Errorf("Want browsed messages to remain queued, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleBrowse(w, httptest.NewRequest("GET", "/meta/browse?destination=/queue/test", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Want browse rejected without the admin header, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleBrowse(w, adminRequest("GET", "/meta/browse?destination=/queue/test&limit=1"))
+	var resp []struct {
+		Body    string            `json:"body"`
+		Headers map[string]string `json:"headers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || resp[0].Body != "hello" || resp[0].Headers["lang"] != "en" {
+		t.Errorf("Want first queued message, got %v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleBrowse(w, adminRequest("GET", "/meta/browse?destination=/queue/missing"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Want 404 for unknown destination, got %d", w.Code)
+	}
+}
+
+func TestHandleBrowseACL(t *testing.T) {
+	secret := []byte("secret")
+	s := NewServer(WithJWT(JWTOptions{Secret: secret}))
+	token := signJWT(t, "HS256", "", secret, map[string]interface{}{
+		"sub":   "alice",
+		"scope": "subscribe:/queue/orders",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	for _, dest := range []string{"/queue/orders", "/queue/payments"} {
+		m := stomp.NewMessage()
+		m.Dest = []byte(dest)
+		m.Body = []byte("secret")
+		s.router.publish(m)
+	}
+
+	for _, test := range []struct {
+		dest string
+		code int
+	}{
+		{"/queue/orders", http.StatusOK},
+		{"/queue/payments", http.StatusForbidden},
+	} {
+		r := adminRequest("GET", "/meta/browse?destination="+test.dest)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.HandleBrowse(w, r)
+		if w.Code != test.code {
+			t.Errorf("Want browse %s status %d, got %d", test.dest, test.code, w.Code)
+		}
+	}
+}
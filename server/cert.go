@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// errNoClientCert is returned when client certificates are required and
+// the connection did not present one.
+var errNoClientCert = errors.New("stomp: client certificate required")
+
+// Identity is the broker identity of an authenticated connection.
+type Identity struct {
+	Name   string   // username
+	Scopes []string // destination permissions, nil grants every permission
+}
+
+// CertAuthorizer maps the verified client certificate of a TLS
+// connection to a broker identity. If it returns an error the
+// connection is rejected.
+type CertAuthorizer interface {
+	AuthorizeCert(cert *x509.Certificate) (*Identity, error)
+}
+
+// CertAuthorizerFunc is an adapter to allow the use of ordinary
+// functions as a CertAuthorizer.
+type CertAuthorizerFunc func(cert *x509.Certificate) (*Identity, error)
+
+// AuthorizeCert calls f(cert).
+func (f CertAuthorizerFunc) AuthorizeCert(cert *x509.Certificate) (*Identity, error) {
+	return f(cert)
+}
+
+// CertNames returns a CertAuthorizer which identifies the certificate
+// by its common name, or its first DNS, email or URI subject alternative
+// name. If scopes is nil every certificate is accepted with every
+// permission. Otherwise the certificate must have a name in the map,
+// checked in the same order, which selects the scopes of the identity.
+func CertNames(scopes map[string][]string) CertAuthorizer {
+	return CertAuthorizerFunc(func(cert *x509.Certificate) (*Identity, error) {
+		names := certNames(cert)
+		if scopes == nil {
+			if len(names) == 0 {
+				return nil, ErrNotAuthorized
+			}
+			return &Identity{Name: names[0]}, nil
+		}
+		for _, name := range names {
+			if s, ok := scopes[name]; ok {
+				return &Identity{Name: name, Scopes: append([]string{}, s...)}, nil
+			}
+		}
+		return nil, ErrNotAuthorized
+	})
+}
+
+// certNames returns the common name and subject alternative names of
+// the certificate.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// authenticateCert authenticates the session with its client
+// certificate and returns the access control list of its identity.
+func (r *router) authenticateCert(auth CertAuthorizer, sess *session, m *stomp.Message) (*acl, error) {
+	if sess.cert == nil {
+		return nil, errNoClientCert
+	}
+	id, err := auth.AuthorizeCert(sess.cert)
+	if err != nil {
+		logger.Noticef("stomp: connect: client certificate %q: %s", sess.cert.Subject.CommonName, err)
+		return nil, err
+	}
+	m.User = append(m.User[:0], id.Name...)
+	if id.Scopes == nil {
+		return nil, nil
+	}
+	return newACL(id.Scopes), nil
+}
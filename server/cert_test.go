@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// testCert returns a certificate with the common name, signed by the
+// parent certificate, or self-signed if parent is nil.
+func testCert(t *testing.T, name string, parent *tls.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCerts(t *testing.T) {
+	ca := testCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	serverCert := testCert(t, "broker", &ca, x509.ExtKeyUsageServerAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	s := NewServer(WithClientCerts(CertNames(map[string][]string{
+		"alice": {"subscribe:/topic/*"},
+	})))
+
+	connect := func(client *tls.Certificate) stomp.Peer {
+		a, b := net.Pipe()
+		go s.ServeConn(tls.Server(b, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}))
+		config := &tls.Config{RootCAs: pool, ServerName: "broker"}
+		if client != nil {
+			config.Certificates = []tls.Certificate{*client}
+		}
+		peer := stomp.Conn(tls.Client(a, config))
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodStomp
+		peer.Send(m)
+		return peer
+	}
+	connected := func(peer stomp.Peer) bool {
+		select {
+		case m, ok := <-peer.Receive():
+			return ok && bytes.Equal(m.Method, stomp.MethodConnected)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for message")
+		}
+		return false
+	}
+
+	anonymous := connect(nil)
+	if connected(anonymous) {
+		t.Errorf("Want connection without a client certificate rejected")
+	}
+	anonymous.Close()
+
+	mallory := testCert(t, "mallory", &ca, x509.ExtKeyUsageClientAuth)
+	unknown := connect(&mallory)
+	if connected(unknown) {
+		t.Errorf("Want unknown identity rejected")
+	}
+	unknown.Close()
+
+	alice := testCert(t, "alice", &ca, x509.ExtKeyUsageClientAuth)
+	peer := connect(&alice)
+	defer peer.Close()
+	if !connected(peer) {
+		t.Fatalf("Want client certificate accepted")
+	}
+	sub := stomp.NewMessage()
+	sub.Method = stomp.MethodSubscribe
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/queue/orders")
+	peer.Send(sub)
+	if m := receive(t, peer); !bytes.Equal(m.Method, stomp.MethodError) {
+		t.Errorf("Want identity scopes enforced, got %s", m.Method)
+	}
+}
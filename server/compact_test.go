@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer(WithStore(dir), WithCompaction("/topic/prices/*"))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, send := range []struct{ key, body string }{
+		{"a", "a1"},
+		{"b", "b1"},
+		{"a", "a2"},
+		{"c", "c1"},
+		{"c", ""},
+		{"", "unkeyed"},
+	} {
+		opts := []stomp.MessageOption{stomp.WithPersistence(), stomp.WithReceipt()}
+		if send.key != "" {
+			opts = append(opts, stomp.WithKey(send.key))
+		}
+		client.Send("/topic/prices/eur", []byte(send.body), opts...)
+		client.Send("/topic/audit", []byte(send.body), opts...)
+	}
+
+	for dest, want := range map[string][]string{
+		"/topic/prices/eur": {"b1", "a2", "unkeyed"},
+		"/topic/audit":      {"a1", "b1", "a2", "c1", "", "unkeyed"},
+	} {
+		replayed := make(chan *stomp.Message, 10)
+		sub, err := client.Subscribe(dest, stomp.HandlerFunc(func(m *stomp.Message) {
+			replayed <- m.Clone()
+		}), stomp.WithReplayFrom(stomp.ReplayBeginning), stomp.WithReceipt())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, body := range want {
+			if m := waitMessage(t, replayed); string(m.Body) != body {
+				t.Errorf("Want %s replayed from %s, got %q", body, dest, m.Body)
+			}
+		}
+		if len(replayed) != 0 {
+			t.Errorf("Want %d messages replayed from %s, got %d more", len(want), dest, len(replayed))
+		}
+		sub.Unsubscribe()
+	}
+	client.Disconnect()
+	s.router.store.close()
+}
+
+func TestCompactRetained(t *testing.T) {
+	var hist []*stomp.Message
+	for _, send := range []struct{ key, body string }{
+		{"a", "a1"},
+		{"b", "b1"},
+		{"a", "a2"},
+		{"", "unkeyed"},
+		{"b", ""},
+	} {
+		m := stomp.NewMessage()
+		m.Body = []byte(send.body)
+		if send.key != "" {
+			m.Header.Set(stomp.HeaderKey, []byte(send.key))
+		}
+		hist = compact(hist, m)
+	}
+	var got []string
+	for _, m := range hist {
+		got = append(got, string(m.Body))
+	}
+	if len(got) != 2 || got[0] != "a2" || got[1] != "unkeyed" {
+		t.Errorf("Want retained messages [a2 unkeyed], got %v", got)
+	}
+}
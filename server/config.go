@@ -0,0 +1,743 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// minBufferSize is the smallest connection buffer size accepted by the
+// configuration.
+const minBufferSize = 512
+
+// Config is the server configuration. The zero value is valid and
+// configures a server with the defaults.
+type Config struct {
+	Auth      AuthConfig       `json:"auth" doc:"client credentials"`
+	Listeners []ListenerConfig `json:"listeners" doc:"network listeners"`
+	Limits    LimitsConfig     `json:"limits" doc:"buffer and memory limits"`
+	Timeouts  TimeoutsConfig   `json:"timeouts" doc:"connection and session timeouts"`
+	Policies  PoliciesConfig   `json:"policies" doc:"broker policies"`
+
+	RateLimits   []RateLimitConfig   `json:"rate_limits,omitempty" doc:"destination and session rate limits"`
+	Destinations []DestinationConfig `json:"destinations,omitempty" doc:"destination policies"`
+	CronJobs     []CronConfig        `json:"cron_jobs,omitempty" doc:"messages published on a schedule"`
+	Quotas       QuotasConfig        `json:"quotas" doc:"session quotas"`
+}
+
+// AuthConfig configures basic authentication.
+type AuthConfig struct {
+	Username string `json:"username,omitempty" doc:"username required to connect"`
+	Password string `json:"password,omitempty" doc:"password required to connect"`
+
+	JWT         JWTConfig         `json:"jwt" doc:"json web token authentication, replacing the username and password"`
+	ClientCerts ClientCertsConfig `json:"client_certs" doc:"tls client certificate authentication, replacing jwt and password authentication"`
+
+	Anonymous bool `json:"anonymous,omitempty" doc:"allow unauthenticated connections; required for a reload to remove authentication"`
+}
+
+// ClientCertsConfig configures client certificate authentication. The
+// certificate common name, or subject alternative name, is the broker
+// identity.
+type ClientCertsConfig struct {
+	Enabled bool                `json:"enabled,omitempty" doc:"authenticate connections by their client certificate"`
+	Scopes  map[string][]string `json:"scopes,omitempty" doc:"destination permissions by identity; other identities are rejected when set"`
+}
+
+// JWTConfig configures JWT authentication.
+type JWTConfig struct {
+	Secret   string `json:"secret,omitempty" doc:"hmac secret"`
+	KeyFile  string `json:"key_file,omitempty" doc:"pem-encoded public key file"`
+	JWKSURL  string `json:"jwks_url,omitempty" doc:"json web key set url"`
+	Issuer   string `json:"issuer,omitempty" doc:"required token issuer"`
+	Audience string `json:"audience,omitempty" doc:"required token audience"`
+
+	AllowNoExpiry bool `json:"allow_no_expiry,omitempty" doc:"accept tokens without an exp claim, which otherwise are rejected"`
+}
+
+// enabled returns true if a token key is configured.
+func (c JWTConfig) enabled() bool {
+	return c.Secret != "" || c.KeyFile != "" || c.JWKSURL != ""
+}
+
+func (c JWTConfig) options() JWTOptions {
+	return JWTOptions{
+		Secret:        []byte(c.Secret),
+		KeyFile:       c.KeyFile,
+		JWKSURL:       c.JWKSURL,
+		Issuer:        c.Issuer,
+		Audience:      c.Audience,
+		AllowNoExpiry: c.AllowNoExpiry,
+	}
+}
+
+// ListenerConfig configures a network listener.
+type ListenerConfig struct {
+	Protocol string `json:"protocol" doc:"listener protocol" enum:"tcp,http,unix"`
+	Address  string `json:"address" doc:"listen address, in host:port form, or the socket path of a unix listener"`
+	Cert     string `json:"cert,omitempty" doc:"tls certificate file"`
+	Key      string `json:"key,omitempty" doc:"tls key file"`
+	ClientCA string `json:"client_ca,omitempty" doc:"ca file verifying required client certificates"`
+
+	ProxyProtocol  bool     `json:"proxy_protocol,omitempty" doc:"accept proxy protocol headers from load balancers"`
+	TrustedProxies []string `json:"trusted_proxies,omitempty" doc:"networks allowed to send proxy protocol headers, in cidr notation; required by proxy_protocol"`
+
+	MaxConnections int `json:"max_connections,omitempty" doc:"open connections accepted by the listener, unlimited when zero"`
+}
+
+// RateLimitConfig configures the rate limit of a destination, or of
+// each session when the destination is omitted.
+type RateLimitConfig struct {
+	Destination string  `json:"destination,omitempty" doc:"destination, or every session when omitted"`
+	Messages    float64 `json:"messages,omitempty" doc:"messages per second"`
+	Bytes       float64 `json:"bytes,omitempty" doc:"bytes per second"`
+	Reject      bool    `json:"reject,omitempty" doc:"reject messages instead of applying backpressure"`
+}
+
+// DestinationConfig configures the policies of destinations matching a
+// pattern.
+type DestinationConfig struct {
+	Pattern  string `json:"pattern" doc:"destination pattern, such as /queue/orders.*"`
+	Critical bool   `json:"critical,omitempty" doc:"accept messages when the server is under memory pressure"`
+	Compact  bool   `json:"compact,omitempty" doc:"keep only the latest persisted or retained message for each key header"`
+	Ack      string `json:"ack,omitempty" doc:"default subscription ack mode" enum:"auto,client,client-individual"`
+	Prefetch int    `json:"prefetch,omitempty" doc:"default subscription prefetch count"`
+	Selector string `json:"selector,omitempty" doc:"selector permission, allow by default" enum:"allow,deny"`
+
+	Schema  string            `json:"schema,omitempty" doc:"json schema file validating published message bodies"`
+	Require []string          `json:"require,omitempty" doc:"json body fields required in published messages, such as user.id"`
+	Redact  []string          `json:"redact,omitempty" doc:"json body fields redacted from published messages"`
+	Headers map[string]string `json:"headers,omitempty" doc:"headers stamped on published messages"`
+}
+
+// transforms returns the transformers of the destination, validating
+// the schema and required fields before redacting fields and stamping
+// headers.
+func (d DestinationConfig) transforms() []Transformer {
+	var chain []Transformer
+	if d.Schema != "" {
+		schema, err := loadSchema(d.Schema)
+		if err != nil {
+			// the schema was loaded by Validate. Messages are rejected,
+			// rather than published unvalidated, if it fails to load again.
+			logger.Warningf("stomp: destination %s: %s", d.Pattern, err)
+			schema = TransformerFunc(func(*stomp.Message) error { return err })
+		}
+		chain = append(chain, schema)
+	}
+	if len(d.Require) != 0 {
+		chain = append(chain, RequireFields(d.Require...))
+	}
+	if len(d.Redact) != 0 {
+		chain = append(chain, RedactJSON(d.Redact...))
+	}
+	if len(d.Headers) != 0 {
+		chain = append(chain, StampHeaders(d.Headers))
+	}
+	return chain
+}
+
+// validField returns true if the dotted field path has no empty keys.
+func validField(field string) bool {
+	for _, key := range strings.Split(field, ".") {
+		if key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// CronConfig configures a cron job publishing a message on a schedule.
+type CronConfig struct {
+	Destination string            `json:"destination" doc:"destination the message is published to"`
+	Cron        string            `json:"cron" doc:"cron schedule, such as */5 * * * * or @every 1m"`
+	Body        string            `json:"body,omitempty" doc:"message body template, with .Time, .Seq and .Dest"`
+	Headers     map[string]string `json:"headers,omitempty" doc:"message headers"`
+}
+
+// QuotasConfig configures the quota of each session and of the sessions
+// of authenticated users.
+type QuotasConfig struct {
+	Session QuotaConfig            `json:"session" doc:"quota of each session"`
+	Users   map[string]QuotaConfig `json:"users,omitempty" doc:"quota by username, replacing the non-zero session quota values"`
+}
+
+// QuotaConfig configures a session quota. Zero values are unlimited.
+type QuotaConfig struct {
+	Subscriptions int     `json:"subscriptions,omitempty" doc:"concurrent subscriptions"`
+	Unacked       int     `json:"unacked,omitempty" doc:"messages delivered and awaiting an ack"`
+	Messages      float64 `json:"messages,omitempty" doc:"messages published per second"`
+	Bytes         float64 `json:"bytes,omitempty" doc:"bytes published per second"`
+}
+
+func (q QuotaConfig) quota() Quota {
+	return Quota{
+		Subscriptions: q.Subscriptions,
+		Unacked:       q.Unacked,
+		Messages:      q.Messages,
+		Bytes:         q.Bytes,
+	}
+}
+
+// LimitsConfig configures buffer and memory limits. Zero values select
+// the defaults.
+type LimitsConfig struct {
+	ReadBuffer    int `json:"read_buffer,omitempty" doc:"connection read buffer size in bytes"`
+	WriteBuffer   int `json:"write_buffer,omitempty" doc:"connection write buffer size in bytes"`
+	MaxFrameSize  int `json:"max_frame_size,omitempty" doc:"maximum frame size in bytes"`
+	QueueMemory   int `json:"queue_memory,omitempty" doc:"bytes held in memory per queue before spilling to disk"`
+	OverflowLimit int `json:"overflow_limit,omitempty" doc:"messages held in memory per queue before spilling to disk"`
+	SlowConsumer  int `json:"slow_consumer,omitempty" doc:"messages pending per session before the session is a slow consumer"`
+	Shards        int `json:"shards,omitempty" doc:"locks the destinations are spread across"`
+	FlushSize     int `json:"flush_size,omitempty" doc:"buffered bytes flushed by the size flush policy"`
+	Memory        int `json:"memory,omitempty" doc:"bytes held by queued messages before non-critical messages are rejected"`
+	Scheduled     int `json:"scheduled,omitempty" doc:"messages held for delayed delivery before scheduled messages are rejected"`
+}
+
+// TimeoutsConfig configures timeouts. Zero values select the defaults.
+type TimeoutsConfig struct {
+	Flush            Duration `json:"flush,omitempty" doc:"interval at which buffered writes are flushed"`
+	Heartbeat        Duration `json:"heartbeat,omitempty" doc:"interval at which heart-beats are sent"`
+	HeartbeatTimeout Duration `json:"heartbeat_timeout,omitempty" doc:"time without heart-beats after which a connection is closed"`
+	Idle             Duration `json:"idle,omitempty" doc:"delete destinations without subscribers after this idle time"`
+	SessionIdle      Duration `json:"session_idle,omitempty" doc:"close sessions without frames or heart-beats after this idle time"`
+	Resume           Duration `json:"resume,omitempty" doc:"hold disconnected sessions for resumption for this time"`
+	Dedup            Duration `json:"dedup,omitempty" doc:"drop messages with a dedup-id seen within this time"`
+	Failover         Duration `json:"failover,omitempty" doc:"promote the standby when the primary is unreachable for this time"`
+	SlowConsumer     Duration `json:"slow_consumer,omitempty" doc:"time a session is a slow consumer before the slow consumer policy applies"`
+	MaxDelay         Duration `json:"max_delay,omitempty" doc:"longest delay of a scheduled message"`
+}
+
+// PoliciesConfig configures broker policies.
+type PoliciesConfig struct {
+	Store        string   `json:"store,omitempty" doc:"datastore directory for persistent messages"`
+	OverflowDir  string   `json:"overflow_dir,omitempty" doc:"directory of queue overflow segments"`
+	Replication  bool     `json:"replication,omitempty" doc:"replicate queues to standby servers"`
+	Standbys     []string `json:"standbys,omitempty" doc:"authenticated users allowed to replicate from this server"`
+	Standby      string   `json:"standby,omitempty" doc:"run as a standby of the primary at this address"`
+	ReadOnly     string   `json:"read_only,omitempty" doc:"run as a read-only replica redirecting producers to this address"`
+	Affinity     string   `json:"affinity,omitempty" doc:"session affinity token issued by this node"`
+	Explicit     bool     `json:"explicit_destinations,omitempty" doc:"reject destinations not created through the admin api"`
+	Reconnect    []string `json:"reconnect_targets,omitempty" doc:"addresses the admin api may redirect draining clients to"`
+	Features     []string `json:"features,omitempty" doc:"experimental features to enable"`
+	SlowConsumer string   `json:"slow_consumer,omitempty" doc:"slow consumer policy, close by default" enum:"drop,close,advisory"`
+	Flush        string   `json:"flush,omitempty" doc:"when buffered writes are flushed, interval by default" enum:"interval,immediate,size"`
+}
+
+// Duration is a time.Duration encoded in JSON as a string, such as "30s".
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes the duration from a string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string, such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ConfigError is a validation error of a configuration field.
+type ConfigError struct {
+	Path    string // field path, such as listeners[0].address
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ConfigErrors is the list of validation errors of a configuration.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("stomp: invalid configuration")
+	for _, err := range e {
+		buf.WriteString("\n  ")
+		buf.WriteString(err.Error())
+	}
+	return buf.String()
+}
+
+// Validate checks the configuration and returns ConfigErrors listing
+// every invalid field, or nil if the configuration is valid.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	fail := func(path, format string, args ...interface{}) {
+		errs = append(errs, ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if jwt := c.Auth.JWT; jwt.enabled() {
+		if c.Auth.Username != "" || c.Auth.Password != "" {
+			fail("auth.jwt", "cannot be combined with auth.username and auth.password")
+		}
+		if jwt.KeyFile != "" {
+			if _, err := readPublicKeys(jwt.KeyFile); err != nil {
+				fail("auth.jwt.key_file", "%s", err)
+			}
+		}
+		if u, err := url.Parse(jwt.JWKSURL); jwt.JWKSURL != "" && (err != nil || u.Scheme != "http" && u.Scheme != "https") {
+			fail("auth.jwt.jwks_url", "must be an http or https url, got %q", jwt.JWKSURL)
+		}
+	} else if c.Auth.JWT != (JWTConfig{}) {
+		fail("auth.jwt", "requires secret, key_file or jwks_url")
+	}
+	if c.Auth.Anonymous && (c.Auth.Username != "" || c.Auth.Password != "" || c.Auth.JWT.enabled() || c.Auth.ClientCerts.Enabled) {
+		fail("auth.anonymous", "cannot be combined with authentication")
+	}
+
+	addrs := map[string]int{}
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		if l.Protocol != "tcp" && l.Protocol != "http" && l.Protocol != "unix" {
+			fail(path+".protocol", "must be tcp, http or unix, got %q", l.Protocol)
+		}
+		_, _, err := net.SplitHostPort(l.Address)
+		switch j, dup := addrs[l.Address]; {
+		case l.Protocol == "unix" && l.Address == "":
+			fail(path+".address", "must be a socket path")
+		case l.Protocol != "unix" && err != nil:
+			fail(path+".address", "must be in host:port form, got %q", l.Address)
+		case dup:
+			fail(path+".address", "duplicates listeners[%d].address %q", j, l.Address)
+		default:
+			addrs[l.Address] = i
+		}
+		if l.MaxConnections < 0 {
+			fail(path+".max_connections", "must not be negative, got %d", l.MaxConnections)
+		}
+		if (l.Cert == "") != (l.Key == "") {
+			fail(path, "cert and key must be set together")
+		}
+		if l.ClientCA != "" && l.Cert == "" {
+			fail(path+".client_ca", "requires cert and key")
+		}
+		if l.ProxyProtocol && len(l.TrustedProxies) == 0 {
+			fail(path+".trusted_proxies", "required by proxy_protocol")
+		}
+		for j, cidr := range l.TrustedProxies {
+			if !l.ProxyProtocol {
+				fail(path+".trusted_proxies", "requires proxy_protocol")
+				break
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				fail(fmt.Sprintf("%s.trusted_proxies[%d]", path, j), "must be in cidr notation, got %q", cidr)
+			}
+		}
+	}
+	if c.Auth.ClientCerts.Enabled && len(c.Listeners) != 0 {
+		var verified bool
+		for _, l := range c.Listeners {
+			verified = verified || l.ClientCA != ""
+		}
+		if !verified {
+			fail("auth.client_certs", "requires a listener with client_ca")
+		}
+	}
+
+	for _, f := range []struct {
+		path  string
+		value int
+	}{
+		{"limits.read_buffer", c.Limits.ReadBuffer},
+		{"limits.write_buffer", c.Limits.WriteBuffer},
+	} {
+		if f.value != 0 && f.value < minBufferSize {
+			fail(f.path, "must be at least %d bytes, got %d", minBufferSize, f.value)
+		}
+	}
+	if c.Limits.MaxFrameSize < 0 {
+		fail("limits.max_frame_size", "must not be negative, got %d", c.Limits.MaxFrameSize)
+	}
+	if c.Limits.QueueMemory < 0 {
+		fail("limits.queue_memory", "must not be negative, got %d", c.Limits.QueueMemory)
+	}
+	if c.Limits.OverflowLimit < 0 {
+		fail("limits.overflow_limit", "must not be negative, got %d", c.Limits.OverflowLimit)
+	}
+	if c.Limits.OverflowLimit != 0 && c.Policies.OverflowDir == "" {
+		fail("limits.overflow_limit", "requires policies.overflow_dir")
+	}
+	if c.Limits.SlowConsumer < 0 {
+		fail("limits.slow_consumer", "must not be negative, got %d", c.Limits.SlowConsumer)
+	}
+	if c.Limits.FlushSize < 0 {
+		fail("limits.flush_size", "must not be negative, got %d", c.Limits.FlushSize)
+	}
+	if c.Limits.Memory < 0 {
+		fail("limits.memory", "must not be negative, got %d", c.Limits.Memory)
+	}
+	if c.Limits.Scheduled < 0 {
+		fail("limits.scheduled", "must not be negative, got %d", c.Limits.Scheduled)
+	}
+	if c.Limits.Shards < 0 {
+		fail("limits.shards", "must not be negative, got %d", c.Limits.Shards)
+	}
+
+	for _, f := range []struct {
+		path  string
+		value Duration
+	}{
+		{"timeouts.flush", c.Timeouts.Flush},
+		{"timeouts.heartbeat", c.Timeouts.Heartbeat},
+		{"timeouts.heartbeat_timeout", c.Timeouts.HeartbeatTimeout},
+		{"timeouts.idle", c.Timeouts.Idle},
+		{"timeouts.session_idle", c.Timeouts.SessionIdle},
+		{"timeouts.resume", c.Timeouts.Resume},
+		{"timeouts.dedup", c.Timeouts.Dedup},
+		{"timeouts.failover", c.Timeouts.Failover},
+		{"timeouts.slow_consumer", c.Timeouts.SlowConsumer},
+		{"timeouts.max_delay", c.Timeouts.MaxDelay},
+	} {
+		if f.value < 0 {
+			fail(f.path, "must not be negative, got %s", time.Duration(f.value))
+		}
+	}
+	if c.Timeouts.Heartbeat > 0 && c.Timeouts.HeartbeatTimeout > 0 &&
+		c.Timeouts.HeartbeatTimeout <= c.Timeouts.Heartbeat {
+		fail("timeouts.heartbeat_timeout", "must be longer than timeouts.heartbeat")
+	}
+	if c.Timeouts.Failover != 0 && c.Policies.Standby == "" {
+		fail("timeouts.failover", "requires policies.standby")
+	}
+
+	if c.Policies.Replication && len(c.Policies.Standbys) == 0 {
+		fail("policies.replication", "requires policies.standbys")
+	}
+	if len(c.Policies.Standbys) != 0 && !c.Policies.Replication {
+		fail("policies.standbys", "requires policies.replication")
+	}
+	if c.Policies.Standby != "" && c.Policies.Replication {
+		fail("policies.replication", "cannot be enabled on a standby")
+	}
+	switch SlowConsumerPolicy(c.Policies.SlowConsumer) {
+	case "", SlowConsumerDrop, SlowConsumerClose, SlowConsumerAdvisory:
+	default:
+		fail("policies.slow_consumer", "must be drop, close or advisory, got %q", c.Policies.SlowConsumer)
+	}
+	if c.Policies.SlowConsumer != "" && c.Limits.SlowConsumer == 0 {
+		fail("policies.slow_consumer", "requires limits.slow_consumer")
+	}
+	switch stomp.FlushStrategy(c.Policies.Flush) {
+	case "", stomp.FlushOnInterval, stomp.FlushImmediate, stomp.FlushOnSize:
+	default:
+		fail("policies.flush", "must be interval, immediate or size, got %q", c.Policies.Flush)
+	}
+	for i, name := range c.Policies.Features {
+		if !isKnownFeature(name) {
+			fail(fmt.Sprintf("policies.features[%d]", i), "unknown feature %q, expected one of %s",
+				name, strings.Join(knownFeatures, ", "))
+		}
+	}
+
+	rates := map[string]int{}
+	for i, l := range c.RateLimits {
+		path := fmt.Sprintf("rate_limits[%d]", i)
+		if l.Messages < 0 {
+			fail(path+".messages", "must not be negative, got %g", l.Messages)
+		}
+		if l.Bytes < 0 {
+			fail(path+".bytes", "must not be negative, got %g", l.Bytes)
+		}
+		if j, ok := rates[l.Destination]; ok {
+			fail(path+".destination", "duplicates rate_limits[%d].destination %q", j, l.Destination)
+		} else {
+			rates[l.Destination] = i
+		}
+	}
+	for i, d := range c.Destinations {
+		path := fmt.Sprintf("destinations[%d]", i)
+		if !validPattern(d.Pattern) {
+			fail(path+".pattern", "must be a destination pattern, got %q", d.Pattern)
+		}
+		switch d.Ack {
+		case "", "auto", "client", "client-individual":
+		default:
+			fail(path+".ack", "must be auto, client or client-individual, got %q", d.Ack)
+		}
+		if d.Prefetch < 0 {
+			fail(path+".prefetch", "must not be negative, got %d", d.Prefetch)
+		}
+		switch d.Selector {
+		case "", SelectorAllow, SelectorDeny:
+		default:
+			fail(path+".selector", "must be allow or deny, got %q", d.Selector)
+		}
+		if d.Schema != "" {
+			if _, err := loadSchema(d.Schema); err != nil {
+				fail(path+".schema", "%s", err)
+			}
+		}
+		for j, field := range d.Require {
+			if !validField(field) {
+				fail(fmt.Sprintf("%s.require[%d]", path, j), "must be a dotted field path, got %q", field)
+			}
+		}
+		for j, field := range d.Redact {
+			if !validField(field) {
+				fail(fmt.Sprintf("%s.redact[%d]", path, j), "must be a dotted field path, got %q", field)
+			}
+		}
+	}
+	for i, job := range c.CronJobs {
+		path := fmt.Sprintf("cron_jobs[%d]", i)
+		if job.Destination == "" {
+			fail(path+".destination", "must be set")
+		}
+		if _, err := parseCron(job.Cron); err != nil {
+			fail(path+".cron", "%s", strings.TrimPrefix(err.Error(), "stomp: "))
+		}
+		if _, err := template.New("").Parse(job.Body); err != nil {
+			fail(path+".body", "%s", err)
+		}
+	}
+	quotas := map[string]QuotaConfig{"quotas.session": c.Quotas.Session}
+	for user, q := range c.Quotas.Users {
+		quotas[fmt.Sprintf("quotas.users[%q]", user)] = q
+	}
+	var quotaPaths []string
+	for path := range quotas {
+		quotaPaths = append(quotaPaths, path)
+	}
+	sort.Strings(quotaPaths)
+	for _, path := range quotaPaths {
+		q := quotas[path]
+		if q.Subscriptions < 0 || q.Unacked < 0 || q.Messages < 0 || q.Bytes < 0 {
+			fail(path, "must not be negative")
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// isKnownFeature returns true if the feature is registered.
+func isKnownFeature(name string) bool {
+	for _, known := range knownFeatures {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Options returns the server options for the configuration. Listeners
+// are not configured by options and are served by the caller.
+func (c *Config) Options() []Option {
+	var opts []Option
+	if c.Auth.Username != "" || c.Auth.Password != "" {
+		opts = append(opts, WithCredentials(c.Auth.Username, c.Auth.Password))
+	}
+	if c.Auth.JWT.enabled() {
+		opts = append(opts, WithJWT(c.Auth.JWT.options()))
+	}
+	if c.Auth.ClientCerts.Enabled {
+		opts = append(opts, WithClientCerts(CertNames(c.Auth.ClientCerts.Scopes)))
+	}
+	opts = append(opts, WithConnConfig(stomp.ConnConfig{
+		ReadBufferSize:    c.Limits.ReadBuffer,
+		WriteBufferSize:   c.Limits.WriteBuffer,
+		MaxFrameSize:      c.Limits.MaxFrameSize,
+		FlushInterval:     time.Duration(c.Timeouts.Flush),
+		FlushStrategy:     stomp.FlushStrategy(c.Policies.Flush),
+		FlushSize:         c.Limits.FlushSize,
+		HeartbeatInterval: time.Duration(c.Timeouts.Heartbeat),
+		HeartbeatTimeout:  time.Duration(c.Timeouts.HeartbeatTimeout),
+	}))
+	if c.Policies.Affinity != "" {
+		opts = append(opts, WithAffinity(c.Policies.Affinity))
+	}
+	if c.Policies.Store != "" {
+		opts = append(opts, WithStore(c.Policies.Store))
+	}
+	if c.Timeouts.Idle > 0 {
+		opts = append(opts, WithIdleTimeout(time.Duration(c.Timeouts.Idle)))
+	}
+	if c.Timeouts.SessionIdle > 0 {
+		opts = append(opts, WithSessionIdleTimeout(time.Duration(c.Timeouts.SessionIdle)))
+	}
+	if c.Timeouts.Resume > 0 {
+		opts = append(opts, WithResumption(time.Duration(c.Timeouts.Resume)))
+	}
+	if c.Timeouts.Dedup > 0 {
+		opts = append(opts, WithDeduplication(time.Duration(c.Timeouts.Dedup), 0))
+	}
+	if c.Limits.Shards > 0 {
+		opts = append(opts, WithShards(c.Limits.Shards))
+	}
+	if c.Limits.SlowConsumer > 0 {
+		policy := SlowConsumerPolicy(c.Policies.SlowConsumer)
+		if policy == "" {
+			policy = SlowConsumerClose
+		}
+		opts = append(opts, WithSlowConsumerPolicy(c.Limits.SlowConsumer,
+			time.Duration(c.Timeouts.SlowConsumer), policy))
+	}
+	if c.Policies.OverflowDir != "" {
+		opts = append(opts, WithOverflow(c.Policies.OverflowDir, c.Limits.OverflowLimit))
+	}
+	if c.Limits.QueueMemory > 0 {
+		opts = append(opts, WithQueueMemory(c.Limits.QueueMemory))
+	}
+	if c.Policies.ReadOnly != "" {
+		opts = append(opts, WithReadOnly(c.Policies.ReadOnly))
+	}
+	if c.Policies.Explicit {
+		opts = append(opts, WithExplicitDestinations())
+	}
+	if len(c.Policies.Reconnect) != 0 {
+		opts = append(opts, WithReconnectTargets(c.Policies.Reconnect...))
+	}
+	if len(c.Policies.Features) != 0 {
+		opts = append(opts, WithFeatures(c.Policies.Features...))
+	}
+	if c.Limits.Memory > 0 {
+		opts = append(opts, WithMemoryLimit(int64(c.Limits.Memory)))
+	}
+	if c.Limits.Scheduled > 0 || c.Timeouts.MaxDelay > 0 {
+		maxDelay, scheduled := defaultMaxDelay, defaultScheduled
+		if c.Timeouts.MaxDelay > 0 {
+			maxDelay = time.Duration(c.Timeouts.MaxDelay)
+		}
+		if c.Limits.Scheduled > 0 {
+			scheduled = c.Limits.Scheduled
+		}
+		opts = append(opts, WithScheduleLimits(maxDelay, scheduled))
+	}
+	for _, l := range c.RateLimits {
+		limit := Limit{Messages: l.Messages, Bytes: l.Bytes, Reject: l.Reject}
+		if l.Destination == "" {
+			opts = append(opts, WithSessionRateLimit(limit))
+		} else {
+			opts = append(opts, WithRateLimit(l.Destination, limit))
+		}
+	}
+	for _, d := range c.Destinations {
+		if d.Critical {
+			opts = append(opts, WithCriticalDestinations(d.Pattern))
+		}
+		if d.Compact {
+			opts = append(opts, WithCompaction(d.Pattern))
+		}
+		if d.Ack != "" || d.Prefetch != 0 || d.Selector != "" {
+			opts = append(opts, WithSubscriptionDefaults(d.Pattern, SubscriptionDefaults{
+				Ack:      d.Ack,
+				Prefetch: d.Prefetch,
+				Selector: d.Selector,
+			}))
+		}
+		if chain := d.transforms(); len(chain) != 0 {
+			t := transform{d.Pattern, chain, true}
+			opts = append(opts, func(s *Server) {
+				s.router.transforms = append(s.router.transforms, t)
+			})
+		}
+	}
+	if q := c.Quotas.Session.quota(); q != (Quota{}) {
+		opts = append(opts, WithQuota(q))
+	}
+	for user, q := range c.Quotas.Users {
+		opts = append(opts, WithUserQuota(user, q.quota()))
+	}
+	for _, job := range c.CronJobs {
+		opts = append(opts, WithCron(CronJob{
+			Dest:    job.Destination,
+			Cron:    job.Cron,
+			Body:    job.Body,
+			Headers: job.Headers,
+		}))
+	}
+	if c.Policies.Replication {
+		opts = append(opts, WithReplication(c.Policies.Standbys...))
+	}
+	if c.Policies.Standby != "" {
+		opts = append(opts, WithStandby(c.Policies.Standby, time.Duration(c.Timeouts.Failover),
+			stomp.WithCredentials(c.Auth.Username, c.Auth.Password),
+		))
+	}
+	return opts
+}
+
+// NewFromConfig validates the configuration and returns a server
+// configured by it. Listeners are not served; the caller accepts
+// connections and passes them to Serve.
+func NewFromConfig(c *Config) (*Server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	s := NewServer(c.Options()...)
+	s.config = c.clone()
+	return s, nil
+}
+
+// ConfigSchema returns the JSON schema of the configuration file.
+func ConfigSchema() []byte {
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "mq server configuration"
+	b, _ := json.MarshalIndent(schema, "", "  ")
+	return b
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// typeSchema returns the JSON schema of the type.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == durationType:
+		return map[string]interface{}{"type": "string", "pattern": `^([0-9.]+(ns|us|µs|ms|s|m|h))+$`}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Int:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number", "minimum": 0}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	}
+
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		prop := typeSchema(f.Type)
+		if doc := f.Tag.Get("doc"); doc != "" {
+			prop["description"] = doc
+		}
+		if enum := f.Tag.Get("enum"); enum != "" {
+			prop["enum"] = strings.Split(enum, ",")
+		}
+		props[name] = prop
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
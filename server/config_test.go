@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	var config Config
+	if err := config.Validate(); err != nil {
+		t.Errorf("Want zero config valid, got %s", err)
+	}
+
+	config = Config{
+		Listeners: []ListenerConfig{
+			{Protocol: "tcp", Address: ":9000", ClientCA: "ca.pem", ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0"}, MaxConnections: -1},
+			{Protocol: "udp", Address: ":9000", Cert: "cert.pem"},
+		},
+		Limits: LimitsConfig{
+			ReadBuffer:    64,
+			OverflowLimit: 100,
+		},
+		Timeouts: TimeoutsConfig{
+			Heartbeat:        Duration(time.Minute),
+			HeartbeatTimeout: Duration(time.Second),
+		},
+		Policies: PoliciesConfig{
+			Features: []string{"teleport"},
+			Flush:    "never",
+		},
+		RateLimits: []RateLimitConfig{
+			{Destination: "/queue/a", Messages: -1},
+			{Destination: "/queue/a"},
+		},
+		Destinations: []DestinationConfig{
+			{Pattern: "[", Selector: "maybe", Schema: "missing.json", Require: []string{"a..b"}},
+		},
+		CronJobs: []CronConfig{
+			{Destination: "/queue/a", Cron: "often"},
+		},
+		Quotas: QuotasConfig{
+			Users: map[string]QuotaConfig{"bob": {Unacked: -1}},
+		},
+	}
+	err := config.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Want ConfigErrors, got %v", err)
+	}
+	want := []string{
+		"listeners[0].max_connections",
+		"listeners[0].client_ca",
+		"listeners[0].trusted_proxies[0]",
+		"listeners[1].protocol",
+		"listeners[1].address",
+		"listeners[1]",
+		"limits.read_buffer",
+		"limits.overflow_limit",
+		"timeouts.heartbeat_timeout",
+		"policies.flush",
+		"policies.features[0]",
+		"rate_limits[0].messages",
+		"rate_limits[1].destination",
+		"destinations[0].pattern",
+		"destinations[0].selector",
+		"destinations[0].schema",
+		"destinations[0].require[0]",
+		"cron_jobs[0].cron",
+		`quotas.users["bob"]`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Want %d errors, got %s", len(want), err)
+	}
+	for i, path := range want {
+		if errs[i].Path != path {
+			t.Errorf("Want error for %s, got %s", path, errs[i])
+		}
+	}
+	if !strings.Contains(err.Error(), "listeners[1].address: duplicates listeners[0].address") {
+		t.Errorf("Want path-qualified error message, got %s", err)
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	var config Config
+	err := json.Unmarshal([]byte(`{"timeouts":{"heartbeat":"10s"},"policies":{"features":["work-stealing"]}}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(config.Timeouts.Heartbeat) != 10*time.Second {
+		t.Errorf("Want duration decoded from string, got %v", config.Timeouts.Heartbeat)
+	}
+
+	s := NewServer(config.Options()...)
+	if s.conn.HeartbeatInterval != 10*time.Second {
+		t.Errorf("Want heart-beat interval configured, got %s", s.conn.HeartbeatInterval)
+	}
+	if !s.features.enabled(FeatureWorkStealing) {
+		t.Errorf("Want feature enabled by configuration")
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(ConfigSchema(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	props := schema["properties"].(map[string]interface{})
+	for _, name := range []string{"auth", "listeners", "limits", "timeouts", "policies"} {
+		if _, ok := props[name]; !ok {
+			t.Errorf("Want schema property %s", name)
+		}
+	}
+}
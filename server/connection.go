@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// churnRate is the default rate of new connections per second above
+// which a client is reported as churning.
+var churnRate = 0.5
+
+// connExpiry is the time after which clients without active connections
+// are no longer reported.
+var connExpiry = time.Hour
+
+// clientConns tracks the connections of a single client, identified by
+// the client-id connect header, or by the username if the client does
+// not send a client id.
+type clientConns struct {
+	id          string
+	user        string
+	active      int
+	connects    int64
+	duplicates  int64 // connects while another connection was active
+	lastConnect time.Time
+	connectRate rate
+}
+
+// connTracker tracks connections grouped by client.
+type connTracker struct {
+	sync.Mutex
+	clients map[string]*clientConns
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{clients: make(map[string]*clientConns)}
+}
+
+// clientKey returns the key grouping the session's connections.
+func clientKey(sess *session) string {
+	if id := sess.msg.Header.Get(stomp.HeaderClientID); len(id) != 0 {
+		return "id:" + string(id)
+	}
+	return "user:" + string(sess.msg.User)
+}
+
+// connect records a new connection for the session. A client id that
+// is already connected is logged as a duplicate connection.
+func (c *connTracker) connect(sess *session) {
+	key := clientKey(sess)
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+	cc, ok := c.clients[key]
+	if !ok {
+		cc = &clientConns{
+			id:   string(sess.msg.Header.Get(stomp.HeaderClientID)),
+			user: string(sess.msg.User),
+		}
+		c.clients[key] = cc
+	}
+	if cc.id != "" && cc.active != 0 {
+		cc.duplicates++
+		logger.Warningf("stomp: duplicate connection for client id %s", cc.id)
+	}
+	cc.active++
+	cc.connects++
+	cc.lastConnect = now
+	cc.connectRate.add(now)
+}
+
+// disconnect records the end of the session's connection.
+func (c *connTracker) disconnect(sess *session) {
+	if sess.msg == nil {
+		return
+	}
+	key := clientKey(sess)
+
+	c.Lock()
+	if cc, ok := c.clients[key]; ok && cc.active > 0 {
+		cc.active--
+	}
+	c.Unlock()
+}
+
+// expire stops tracking clients without active connections that have
+// not connected within the expiry.
+func (c *connTracker) expire(now time.Time) {
+	c.Lock()
+	for key, cc := range c.clients {
+		if cc.active == 0 && now.Sub(cc.lastConnect) > connExpiry {
+			delete(c.clients, key)
+		}
+	}
+	c.Unlock()
+}
+
+// HandleConnections writes a JSON-encoded list of connections grouped by
+// client id, or by username for clients without a client id, to the
+// http.Request. Client ids with more than one active connection are
+// flagged as duplicates, and clients connecting faster than the churn
+// query parameter, in connections per second, are flagged as churning.
+func (s *Server) HandleConnections(w http.ResponseWriter, r *http.Request) {
+	threshold := churnRate
+	if v := r.FormValue("churn"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		threshold = f
+	}
+
+	type connResp struct {
+		Host        string    `json:"host,omitempty"`
+		Client      string    `json:"client_id,omitempty"`
+		User        string    `json:"username"`
+		Active      int       `json:"active"`
+		Connects    int64     `json:"connects"`
+		Duplicates  int64     `json:"duplicates"`
+		ConnectRate float64   `json:"connect_rate"`
+		LastConnect time.Time `json:"last_connect"`
+		Duplicate   bool      `json:"duplicate"`
+		Churning    bool      `json:"churning"`
+	}
+
+	now := time.Now()
+	conns := []connResp{}
+	for _, router := range s.routers() {
+		router.conns.expire(now)
+		router.conns.Lock()
+		var keys []string
+		for key := range router.conns.clients {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			cc := router.conns.clients[key]
+			resp := connResp{
+				Host:        router.host,
+				Client:      cc.id,
+				User:        cc.user,
+				Active:      cc.active,
+				Connects:    cc.connects,
+				Duplicates:  cc.duplicates,
+				ConnectRate: cc.connectRate.at(now),
+				LastConnect: cc.lastConnect,
+			}
+			resp.Duplicate = cc.id != "" && cc.active > 1
+			resp.Churning = resp.ConnectRate > threshold
+			conns = append(conns, resp)
+		}
+		router.conns.Unlock()
+	}
+	json.NewEncoder(w).Encode(conns)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestConnections(t *testing.T) {
+	s := NewServer()
+	for i := 0; i < 2; i++ {
+		client := s.Client()
+		if err := client.Connect(stomp.WithClientID("worker"), stomp.WithCredentials("janedoe", "")); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+	}
+	client := s.Client()
+	if err := client.Connect(stomp.WithCredentials("johndoe", "")); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	w := httptest.NewRecorder()
+	s.HandleConnections(w, httptest.NewRequest("GET", "/meta/connections?churn=1000", nil))
+
+	var conns []struct {
+		Client     string `json:"client_id"`
+		User       string `json:"username"`
+		Active     int    `json:"active"`
+		Connects   int64  `json:"connects"`
+		Duplicates int64  `json:"duplicates"`
+		Duplicate  bool   `json:"duplicate"`
+		Churning   bool   `json:"churning"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&conns); err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("Want connections grouped into 2 clients, got %d", len(conns))
+	}
+	if got := conns[0]; got.Client != "worker" || got.User != "janedoe" || got.Active != 2 || got.Duplicates != 1 || !got.Duplicate {
+		t.Errorf("Want duplicate connections flagged for client id, got %+v", got)
+	}
+	if got := conns[1]; got.Client != "" || got.User != "johndoe" || got.Active != 1 || got.Duplicate || got.Churning {
+		t.Errorf("Want connection grouped by username, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleConnections(w, httptest.NewRequest("GET", "/meta/connections?churn=0", nil))
+	if err := json.NewDecoder(w.Body).Decode(&conns); err != nil {
+		t.Fatal(err)
+	}
+	if !conns[0].Churning || !conns[1].Churning {
+		t.Errorf("Want clients churning above the threshold, got %+v", conns)
+	}
+}
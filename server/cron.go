@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+var (
+	errCronDest = errors.New("stomp: cron destination required")
+	errNoCron   = errors.New("stomp: no such cron job")
+)
+
+// cronMinInterval is the shortest interval of an @every schedule.
+var cronMinInterval = time.Second
+
+// CronJob configures a broker-managed publisher, which publishes a
+// message to the destination on a cron schedule, such as "*/5 * * * *"
+// for every five minutes. The schedule has the minute, hour, day of
+// month, month and day of week fields, or is one of @yearly, @monthly,
+// @weekly, @daily, @hourly or @every followed by a duration.
+//
+// The body is a text/template executed with the .Time the job fired,
+// the .Seq number of the run, starting at 1, and the .Dest. Messages are
+// subject to the checks of a SEND frame, such as destination transforms
+// and schemas.
+type CronJob struct {
+	Host    string            // virtual host
+	Dest    string            // destination
+	Cron    string            // schedule
+	Body    string            // body template
+	Headers map[string]string // message headers
+}
+
+// cronJob is a running cron job.
+type cronJob struct {
+	CronJob
+	id       string
+	schedule *cronSchedule
+	body     *template.Template
+	router   *router
+	acl      *acl // permissions of the identity that added the job
+	done     chan struct{}
+	fired    int64 // accessed atomically
+	failed   int64 // accessed atomically
+}
+
+// cronJobs holds the cron jobs of the server.
+type cronJobs struct {
+	sync.Mutex
+	jobs    map[string]*cronJob
+	pending []CronJob // configured before the server started
+	seq     int64
+}
+
+func newCronJobs() *cronJobs {
+	return &cronJobs{jobs: make(map[string]*cronJob)}
+}
+
+// AddCron schedules the cron job and returns the job id.
+func (s *Server) AddCron(job CronJob) (string, error) {
+	return s.addCron(job, nil)
+}
+
+// addCron schedules the cron job publishing with the permissions of the
+// acl.
+func (s *Server) addCron(job CronJob, acl *acl) (string, error) {
+	if job.Dest == "" {
+		return "", errCronDest
+	}
+	schedule, err := parseCron(job.Cron)
+	if err != nil {
+		return "", err
+	}
+	body, err := template.New(job.Dest).Parse(job.Body)
+	if err != nil {
+		return "", fmt.Errorf("stomp: cron body: %s", err)
+	}
+	router := s.lookup([]byte(job.Host))
+	if router == nil {
+		return "", ErrUnknownHost
+	}
+
+	s.crons.Lock()
+	s.crons.seq++
+	id := strconv.FormatInt(s.crons.seq, 10)
+	c := &cronJob{
+		CronJob:  job,
+		id:       id,
+		schedule: schedule,
+		body:     body,
+		router:   router,
+		acl:      acl,
+		done:     make(chan struct{}),
+	}
+	s.crons.jobs[id] = c
+	s.crons.Unlock()
+
+	go c.run()
+	logger.Noticef("stomp: cron %s publishing to %s at %q", id, job.Dest, job.Cron)
+	return id, nil
+}
+
+// RemoveCron stops the cron job.
+func (s *Server) RemoveCron(id string) error {
+	s.crons.Lock()
+	c, ok := s.crons.jobs[id]
+	delete(s.crons.jobs, id)
+	s.crons.Unlock()
+	if !ok {
+		return errNoCron
+	}
+	close(c.done)
+	return nil
+}
+
+func (c *cronJob) run() {
+	for {
+		now := time.Now()
+		next := c.schedule.next(now)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			c.fire(next)
+		}
+	}
+}
+
+// fire publishes the message of the run scheduled at the time.
+func (c *cronJob) fire(at time.Time) {
+	seq := atomic.AddInt64(&c.fired, 1)
+
+	var body bytes.Buffer
+	err := c.body.Execute(&body, struct {
+		Time time.Time
+		Seq  int64
+		Dest string
+	}{at, seq, c.Dest})
+	if err != nil {
+		atomic.AddInt64(&c.failed, 1)
+		logger.Warningf("stomp: cron %s: %s", c.id, err)
+		return
+	}
+
+	m := stomp.NewMessage()
+	m.Method = stomp.MethodSend
+	m.Dest = []byte(c.Dest)
+	m.Body = body.Bytes()
+	for k, v := range c.Headers {
+		m.Header.Add([]byte(k), []byte(v))
+	}
+	if err := c.router.publishAs(m, c.acl); err != nil {
+		atomic.AddInt64(&c.failed, 1)
+		logger.Warningf("stomp: cron %s: publish %s: %s", c.id, c.Dest, err)
+	}
+	m.Release()
+}
+
+// HandleCron reads and writes the cron jobs. A GET request writes a
+// JSON-encoded list of cron jobs to the http.Request. A POST request
+// adds a cron job publishing the body form value to the destination
+// on the cron schedule, and a DELETE request removes the job id. POST
+// and DELETE requests require admin authentication, and the job
+// publishes with the permissions of the authenticated identity.
+func (s *Server) HandleCron(w http.ResponseWriter, r *http.Request) {
+	var acl *acl
+	if r.Method != "GET" {
+		var ok bool
+		if acl, ok = s.authorizeAdminACL(w, r); !ok {
+			return
+		}
+	}
+
+	switch r.Method {
+	case "POST":
+		dest := r.FormValue("destination")
+		if !acl.allowed(permSend, []byte(dest)) {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		id, err := s.addCron(CronJob{
+			Host: r.FormValue("host"),
+			Dest: dest,
+			Cron: r.FormValue("cron"),
+			Body: r.FormValue("body"),
+		}, acl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+		return
+	case "DELETE":
+		if err := s.RemoveCron(r.FormValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	type cronResp struct {
+		ID     string    `json:"id"`
+		Host   string    `json:"host,omitempty"`
+		Dest   string    `json:"destination"`
+		Cron   string    `json:"cron"`
+		Next   time.Time `json:"next"`
+		Fired  int64     `json:"fired"`
+		Failed int64     `json:"failed"`
+	}
+
+	s.crons.Lock()
+	var ids []string
+	for id := range s.crons.jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	jobs := []cronResp{}
+	now := time.Now()
+	for _, id := range ids {
+		c := s.crons.jobs[id]
+		jobs = append(jobs, cronResp{
+			ID:     id,
+			Host:   c.Host,
+			Dest:   c.Dest,
+			Cron:   c.Cron,
+			Next:   c.schedule.next(now),
+			Fired:  atomic.LoadInt64(&c.fired),
+			Failed: atomic.LoadInt64(&c.failed),
+		})
+	}
+	s.crons.Unlock()
+
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// cronSchedule is a parsed cron schedule. Each field is a bit set of
+// the matching values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+	every                         time.Duration // fixed interval, if set
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronHorizon bounds the search for the next run of a schedule.
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+// parseCron parses the cron schedule.
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("stomp: cron %q: invalid interval", spec)
+		}
+		if d < cronMinInterval {
+			return nil, fmt.Errorf("stomp: cron %q: interval below %s", spec, cronMinInterval)
+		}
+		return &cronSchedule{every: d}, nil
+	}
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("stomp: cron %q: expected 5 fields", spec)
+	}
+
+	var (
+		c   cronSchedule
+		err error
+	)
+	for i, f := range []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	} {
+		if *f.set, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("stomp: cron %q: %s", spec, err)
+		}
+	}
+	// sunday is 0 or 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("stomp: cron %q: never runs", spec)
+	}
+	return &c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and
+// steps, such as "1,15-20,*/5", into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		lo, hi, step := min, max, 1
+		if i := strings.Index(part, "/"); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step, part = n, part[:i]
+		}
+		switch i := strings.Index(part, "-"); {
+		case part == "*":
+		case i != -1:
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(part[:i])
+			hi, err2 = strconv.Atoi(part[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for n := lo; n <= hi; n += step {
+			set |= 1 << uint(n)
+		}
+	}
+	return set, nil
+}
+
+// next returns the first time the schedule runs after t, or the zero
+// time if the schedule does not run within the search horizon.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every)
+	}
+	end := t.Add(cronHorizon)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchDay returns true if the day matches the schedule. When both the
+// day of month and day of week are restricted either may match.
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
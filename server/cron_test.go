@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func Test_cronSchedule_next(t *testing.T) {
+	// a monday
+	from := time.Date(2017, time.March, 6, 10, 7, 30, 0, time.UTC)
+
+	for _, test := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2017, time.March, 6, 10, 8, 0, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2017, time.March, 6, 10, 10, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2017, time.March, 6, 13, 0, 0, 0, time.UTC)},
+		{"30 2 * * 0", time.Date(2017, time.March, 12, 2, 30, 0, 0, time.UTC)},
+		{"30 2 * * 7", time.Date(2017, time.March, 12, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2017, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 3", time.Date(2017, time.March, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2017, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, time.March, 6, 11, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+	} {
+		c, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("Want %q parsed, got %s", test.spec, err)
+			continue
+		}
+		if got := c.next(from); !got.Equal(test.want) {
+			t.Errorf("Want %q next run at %s, got %s", test.spec, test.want, got)
+		}
+	}
+
+	for _, spec := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"0 0 30 2 *",
+		"@every soon",
+		"@every 1ns",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("Want %q rejected", spec)
+		}
+	}
+}
+
+func TestCron(t *testing.T) {
+	defer func(d time.Duration) { cronMinInterval = d }(cronMinInterval)
+	cronMinInterval = time.Millisecond
+
+	s := NewServer(WithCron(CronJob{
+		Dest:    "/queue/jobs",
+		Cron:    "@every 10ms",
+		Body:    "run {{.Seq}} of {{.Dest}}",
+		Headers: map[string]string{"job": "cleanup"},
+	}))
+
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	c, err := client.Consume("/queue/jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Next() {
+		t.Fatal(c.Err())
+	}
+	m := c.Message()
+	if string(m.Body) != "run 1 of /queue/jobs" || string(m.Header.Get([]byte("job"))) != "cleanup" {
+		t.Errorf("Want templated message published, got %q %s", m.Body, m.Header.Get([]byte("job")))
+	}
+	m.Release()
+
+	w := httptest.NewRecorder()
+	s.HandleCron(w, httptest.NewRequest("GET", "/meta/cron", nil))
+	var jobs []struct {
+		ID    string `json:"id"`
+		Cron  string `json:"cron"`
+		Fired int64  `json:"fired"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Cron != "@every 10ms" || jobs[0].Fired == 0 {
+		t.Fatalf("Want cron job listed, got %+v", jobs)
+	}
+
+	if err := s.RemoveCron(jobs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveCron(jobs[0].ID); err != errNoCron {
+		t.Errorf("Want errNoCron, got %v", err)
+	}
+	if _, err := s.AddCron(CronJob{Dest: "/queue/jobs", Cron: "daily"}); err == nil {
+		t.Errorf("Want invalid schedule rejected")
+	}
+}
+
+func TestHandleCron(t *testing.T) {
+	s := NewServer(WithCredentials("admin", "secret"))
+	defer s.Close()
+
+	post := func(admin bool) *httptest.ResponseRecorder {
+		form := url.Values{"destination": {"/queue/jobs"}, "cron": {"@daily"}}
+		r := httptest.NewRequest("POST", "/meta/cron", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("admin", "secret")
+		if admin {
+			r.Header.Set(HeaderAdminRequest, "1")
+		}
+		w := httptest.NewRecorder()
+		s.HandleCron(w, r)
+		return w
+	}
+	if w := post(false); w.Code != http.StatusForbidden {
+		t.Errorf("Want cron job rejected without the admin header, got %d", w.Code)
+	}
+	if w := post(true); w.Code != http.StatusOK {
+		t.Errorf("Want cron job added by the admin, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCronPublishChecks(t *testing.T) {
+	s := NewServer(WithTransform("/queue/checked", TransformerFunc(func(m *stomp.Message) error {
+		return errors.New("rejected")
+	})))
+	defer s.Close()
+
+	publish := func(dest string, a *acl) error {
+		m := stomp.NewMessage()
+		defer m.Release()
+		m.Method = stomp.MethodSend
+		m.Dest = []byte(dest)
+		return s.router.publishAs(m, a)
+	}
+	if err := publish("/queue/jobs", newACL([]string{"send:/queue/other"})); err != ErrForbidden {
+		t.Errorf("Want publish denied by the acl, got %v", err)
+	}
+	if err := publish("/queue/checked", nil); err == nil {
+		t.Errorf("Want publish rejected by the destination transforms")
+	}
+	if err := publish("/queue/jobs", nil); err != nil {
+		t.Errorf("Want publish allowed, got %s", err)
+	}
+}
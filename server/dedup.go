@@ -0,0 +1,126 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// dedupSize is the default number of dedup ids remembered per virtual
+// host.
+var dedupSize = 100000
+
+// dedupEntry is a dedup id seen at a point in time.
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// dedupCache remembers the dedup ids of published messages for the
+// window, evicting the least recently seen ids once the cache is full.
+type dedupCache struct {
+	sync.Mutex
+	window time.Duration
+	size   int
+	ll     *list.List
+	items  map[string]*list.Element
+}
+
+func newDedupCache(window time.Duration, size int) *dedupCache {
+	if size <= 0 {
+		size = dedupSize
+	}
+	return &dedupCache{
+		window: window,
+		size:   size,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+// key returns the key under which the dedup id of the message is
+// remembered, scoped by destination, or an empty key if the message has
+// no dedup-id header.
+func (c *dedupCache) key(m *stomp.Message) string {
+	if c == nil {
+		return ""
+	}
+	id := m.Header.Get(stomp.HeaderDedupID)
+	if len(id) == 0 {
+		return ""
+	}
+	return string(m.Dest) + "\x00" + string(id)
+}
+
+// reserve records the key of a message about to be published, and
+// returns false if a message with the key was published, or is being
+// published, within the window. The check and the reservation are made
+// under the lock, so that concurrent messages with the same key are not
+// both published. Messages without a key are always reserved.
+func (c *dedupCache) reserve(key string) bool {
+	if c == nil || key == "" {
+		return true
+	}
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+	c.expire(now)
+	if _, ok := c.items[key]; ok {
+		return false
+	}
+	c.items[key] = c.ll.PushFront(&dedupEntry{key: key, seen: now})
+	if c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*dedupEntry).key)
+	}
+	return true
+}
+
+// release removes the reservation of a message that was not published,
+// so that a retry is accepted.
+func (c *dedupCache) release(key string) {
+	if c == nil || key == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+// expire removes the keys seen before the window. The caller must hold
+// the lock.
+func (c *dedupCache) expire(now time.Time) {
+	// entries are ordered by the time they were seen, so expired
+	// entries are removed from the back of the list.
+	for e := c.ll.Back(); e != nil; e = c.ll.Back() {
+		entry := e.Value.(*dedupEntry)
+		if now.Sub(entry.seen) < c.window {
+			break
+		}
+		c.ll.Remove(e)
+		delete(c.items, entry.key)
+	}
+}
+
+// isDuplicate returns true if the message, with the dedup key, is a
+// duplicate that should be dropped. Otherwise the key is reserved, and
+// must be released if the message is not published, so that a retry of
+// a failed publish is accepted.
+func (r *router) isDuplicate(m *stomp.Message, key string) bool {
+	if r.dedup.reserve(key) {
+		return false
+	}
+	logger.Verbosef("stomp: send %s: duplicate dedup-id %s dropped",
+		string(m.Dest),
+		string(m.Header.Get(stomp.HeaderDedupID)),
+	)
+	return true
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestDeduplication(t *testing.T) {
+	s := NewServer(WithDeduplication(time.Minute, 0))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, id := range []string{"order-1", "order-1", "order-2"} {
+		err := client.Send("/queue/orders", []byte(id), stomp.WithDedupID(id), stomp.WithReceipt())
+		if err != nil {
+			t.Fatalf("Want duplicate acknowledged with a receipt, got %s", err)
+		}
+	}
+	if err := client.Send("/queue/invoices", []byte("order-1"), stomp.WithDedupID("order-1"), stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	if got := queueLen(s, "/queue/orders"); got != 2 {
+		t.Errorf("Want duplicate dropped, got %d messages", got)
+	}
+	if got := queueLen(s, "/queue/invoices"); got != 1 {
+		t.Errorf("Want dedup ids scoped by destination, got %d messages", got)
+	}
+}
+
+func TestDeduplicationRetry(t *testing.T) {
+	s := NewServer(WithDeduplication(time.Minute, 0), WithExplicitDestinations())
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	if err := client.Send("/queue/orders", []byte("1"), stomp.WithDedupID("order-1"), stomp.WithReceipt()); err == nil {
+		t.Fatalf("Want publish to a missing destination rejected")
+	}
+	if err := s.CreateDestination("", "/queue/orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send("/queue/orders", []byte("1"), stomp.WithDedupID("order-1"), stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	if got := queueLen(s, "/queue/orders"); got != 1 {
+		t.Errorf("Want retry of a failed publish accepted, got %d messages", got)
+	}
+}
+
+func TestDedupCache(t *testing.T) {
+	c := newDedupCache(20*time.Millisecond, 2)
+	key := func(id string) string {
+		m := stomp.NewMessage()
+		m.Dest = []byte("/queue/test")
+		m.Apply(stomp.WithDedupID(id))
+		return c.key(m)
+	}
+	publish := func(key string) bool {
+		return !c.reserve(key)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if publish(key(id)) {
+			t.Errorf("Want first %s accepted", id)
+		}
+	}
+	if publish(key("a")) {
+		t.Errorf("Want least recently seen id evicted when full")
+	}
+	if !publish(key("c")) {
+		t.Errorf("Want duplicate within the window")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if publish(key("c")) {
+		t.Errorf("Want id expired after the window")
+	}
+	if publish(c.key(stomp.NewMessage())) {
+		t.Errorf("Want message without dedup-id accepted")
+	}
+	c.release(key("c"))
+	if publish(key("c")) {
+		t.Errorf("Want released id accepted")
+	}
+}
+
+func TestDeduplicationConcurrent(t *testing.T) {
+	s := NewServer(WithDeduplication(time.Minute, 0))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		client := s.Client()
+		if err := client.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := strconv.Itoa(j)
+				client.Send("/queue/orders", []byte(id), stomp.WithDedupID(id), stomp.WithReceipt())
+			}
+		}()
+	}
+	wg.Wait()
+	if got := queueLen(s, "/queue/orders"); got != 50 {
+		t.Errorf("Want concurrent duplicates dropped, got %d messages", got)
+	}
+}
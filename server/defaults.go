@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// ErrSelectorDenied is returned when a subscription includes a selector
+// and selectors are not permitted for the destination.
+var ErrSelectorDenied = errors.New("stomp: selector not permitted")
+
+// Selector permissions.
+const (
+	SelectorAllow = "allow"
+	SelectorDeny  = "deny"
+)
+
+// SubscriptionDefaults defines default subscription settings for
+// destinations matching a pattern. Defaults are applied when the client
+// omits the corresponding header. Zero values inherit the settings from
+// less specific patterns.
+type SubscriptionDefaults struct {
+	Ack      string // ack mode
+	Prefetch int    // prefetch count
+	Selector string // selector permission, allow or deny
+}
+
+type subscriptionDefaults struct {
+	pattern string
+	SubscriptionDefaults
+}
+
+// subscriptionDefaults returns the effective subscription defaults for
+// the destination. Matching patterns are merged from least to most
+// specific, where longer patterns are more specific.
+func (r *router) subscriptionDefaults(dest []byte) (d SubscriptionDefaults) {
+	var matches []subscriptionDefaults
+	r.RLock()
+	for _, def := range r.defaults {
+		if ok, _ := path.Match(def.pattern, string(dest)); ok {
+			matches = append(matches, def)
+		}
+	}
+	r.RUnlock()
+	sort.Stable(bySpecificity(matches))
+
+	for _, match := range matches {
+		if match.Ack != "" {
+			d.Ack = match.Ack
+		}
+		if match.Prefetch != 0 {
+			d.Prefetch = match.Prefetch
+		}
+		if match.Selector != "" {
+			d.Selector = match.Selector
+		}
+	}
+	return
+}
+
+// validPattern returns true if the destination pattern is well formed.
+func validPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return pattern != "" && err == nil
+}
+
+// applyDefaults applies the subscription defaults to the subscribe
+// message for headers omitted by the client.
+func (r *router) applyDefaults(m *stomp.Message) error {
+	d := r.subscriptionDefaults(m.Dest)
+	if d.Selector == SelectorDeny && len(m.Selector) != 0 {
+		return ErrSelectorDenied
+	}
+	if len(m.Ack) == 0 && d.Ack != "" {
+		m.Ack = []byte(d.Ack)
+	}
+	if len(m.Prefetch) == 0 && d.Prefetch != 0 {
+		m.Prefetch = strconv.AppendInt(nil, int64(d.Prefetch), 10)
+	}
+	return nil
+}
+
+type bySpecificity []subscriptionDefaults
+
+func (s bySpecificity) Len() int           { return len(s) }
+func (s bySpecificity) Less(i, j int) bool { return len(s[i].pattern) < len(s[j].pattern) }
+func (s bySpecificity) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
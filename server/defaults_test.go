@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func Test_router_subscriptionDefaults(t *testing.T) {
+	s := NewServer(
+		WithSubscriptionDefaults("/queue/orders.eu.*", SubscriptionDefaults{Prefetch: 5}),
+		WithSubscriptionDefaults("/queue/*", SubscriptionDefaults{Ack: "client", Prefetch: 1}),
+		WithSubscriptionDefaults("/topic/*", SubscriptionDefaults{Selector: SelectorDeny}),
+	)
+
+	d := s.router.subscriptionDefaults([]byte("/queue/orders.eu.fr"))
+	if d.Ack != "client" {
+		t.Errorf("expect ack mode inherited from less specific pattern")
+	}
+	if d.Prefetch != 5 {
+		t.Errorf("expect prefetch from most specific pattern, got %d", d.Prefetch)
+	}
+
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/orders.us")
+	m.Ack = stomp.AckAuto
+	defer m.Release()
+	if err := s.router.applyDefaults(m); err != nil {
+		t.Errorf("expect defaults applied, got error %s", err)
+	}
+	if !bytes.Equal(m.Ack, stomp.AckAuto) {
+		t.Errorf("expect client ack header preserved")
+	}
+	if !bytes.Equal(m.Prefetch, []byte("1")) {
+		t.Errorf("expect default prefetch applied when header omitted")
+	}
+
+	m.Reset()
+	m.Dest = []byte("/topic/news")
+	m.Selector = []byte("ram > 2")
+	if err := s.router.applyDefaults(m); err != ErrSelectorDenied {
+		t.Errorf("expect selector denied for destination")
+	}
+}
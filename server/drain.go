@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrDraining is returned to clients connecting, subscribing or
+	// sending to a server that is draining connections for maintenance.
+	ErrDraining = errors.New("stomp: server is draining")
+
+	// errReconnectTarget is returned by HandleDrain when the reconnect-to
+	// address is not allowed by WithReconnectTargets.
+	errReconnectTarget = errors.New("stomp: reconnect-to address not allowed")
+)
+
+// WithReconnectTargets returns an Option which allows the admin API to
+// drain the server redirecting clients to the addresses. Clients
+// following redirects send their credentials to the address, so
+// HandleDrain rejects any other reconnect-to address. Drain is not
+// restricted.
+func WithReconnectTargets(addrs ...string) Option {
+	return func(s *Server) {
+		s.reconnectTargets = append(s.reconnectTargets, addrs...)
+	}
+}
+
+// reconnectAllowed returns true if HandleDrain may redirect clients to
+// the address. An empty address does not redirect clients.
+func (s *Server) reconnectAllowed(addr string) bool {
+	if addr == "" {
+		return true
+	}
+	for _, target := range s.reconnectTargets {
+		if target == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// drainPoll is the interval at which a draining server checks whether
+// sessions have settled their unacknowledged messages.
+var drainPoll = 50 * time.Millisecond
+
+// isDraining returns true if the router is draining connections.
+func (r *router) isDraining() bool {
+	return atomic.LoadInt32(&r.draining) != 0
+}
+
+// rejectDraining sends an error redirecting the client to the reconnect
+// address if the router is draining. It returns true if the message was
+// rejected.
+func (r *router) rejectDraining(sess *session, m *stomp.Message) bool {
+	if !r.isDraining() {
+		return false
+	}
+	logger.Verbosef("stomp: %s %s: rejected, server draining",
+		string(m.Method),
+		string(m.Dest),
+	)
+	sess.sendError(m, ErrDraining, r.reconnectHeaders()...)
+	return true
+}
+
+// reconnectHeaders returns the headers pointing clients at the broker
+// to reconnect to while draining. The redirect header is followed by
+// clients configured with stomp.WithRedirects.
+func (r *router) reconnectHeaders() []stomp.MessageOption {
+	r.RLock()
+	addr := string(r.reconnect)
+	r.RUnlock()
+	if addr == "" {
+		return nil
+	}
+	return []stomp.MessageOption{
+		stomp.WithHeader(string(stomp.HeaderRedirect), addr),
+		stomp.WithHeader(string(stomp.HeaderReconnectTo), addr),
+	}
+}
+
+// advise sends the shutdown-imminent advisory to the connected sessions.
+func (r *router) advise() {
+	r.RLock()
+	var sessions []*session
+	for sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+	addr := r.reconnect
+	r.RUnlock()
+
+	for _, sess := range sessions {
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodAdvisory
+		m.Header.Add(stomp.HeaderAdvisory, stomp.AdvisoryShutdown)
+		if len(addr) != 0 {
+			m.Header.Add(stomp.HeaderReconnectTo, addr)
+		}
+		sess.send(m)
+	}
+}
+
+// settled closes the sessions without unacknowledged messages and
+// returns the number of sessions remaining open.
+func (r *router) settled() int {
+	r.RLock()
+	var sessions []*session
+	for sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+	r.RUnlock()
+
+	var open int
+	for _, sess := range sessions {
+		select {
+		case <-stomp.Closed(sess.peer):
+			continue
+		default:
+		}
+		sess.Lock()
+		unacked := len(sess.ack)
+		sess.Unlock()
+		if unacked == 0 {
+			sess.peer.Close()
+			continue
+		}
+		open++
+	}
+	return open
+}
+
+// closeAll closes every session of the router.
+func (r *router) closeAll() {
+	r.RLock()
+	defer r.RUnlock()
+	for sess := range r.sessions {
+		sess.peer.Close()
+	}
+}
+
+// Drain puts the server into maintenance mode. New connections and new
+// SEND and SUBSCRIBE frames are rejected with an error redirecting the
+// client to reconnectTo, connected clients are sent a shutdown-imminent
+// advisory, queues stop delivering to connected sessions, and each
+// session is closed once its unacknowledged messages are settled. Drain
+// returns when every session is closed. If the context ends first the
+// remaining sessions are closed and the context error is returned.
+func (s *Server) Drain(ctx context.Context, reconnectTo string) error {
+	routers := s.routers()
+	for _, r := range routers {
+		r.Lock()
+		r.reconnect = []byte(reconnectTo)
+		r.Unlock()
+		atomic.StoreInt32(&r.draining, 1)
+	}
+	for _, r := range routers {
+		r.advise()
+	}
+	logger.Noticef("stomp: draining connections, reconnect to %q", reconnectTo)
+
+	tick := time.NewTicker(drainPoll)
+	defer tick.Stop()
+	for {
+		var remaining int
+		for _, r := range routers {
+			remaining += r.settled()
+		}
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, r := range routers {
+				r.closeAll()
+			}
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// Undrain ends maintenance mode and accepts connections again.
+func (s *Server) Undrain() {
+	for _, r := range s.routers() {
+		atomic.StoreInt32(&r.draining, 0)
+	}
+	logger.Noticef("stomp: accepting connections")
+}
+
+// HandleDrain reads and changes the maintenance mode. A GET request
+// writes a JSON-encoded drain status to the http.Request. A POST request
+// drains the server, redirecting clients to the reconnect-to query
+// parameter and waiting up to the timeout query parameter, 30s by
+// default, for sessions to settle. The reconnect-to address must be
+// allowed by WithReconnectTargets. A DELETE request ends maintenance
+// mode. POST and DELETE requests require admin authentication.
+func (s *Server) HandleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && !s.authorizeAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		var sessions int
+		for _, router := range s.routers() {
+			router.RLock()
+			sessions += len(router.sessions)
+			router.RUnlock()
+		}
+		json.NewEncoder(w).Encode(struct {
+			Draining bool `json:"draining"`
+			Sessions int  `json:"sessions"`
+		}{s.router.isDraining(), sessions})
+	case "POST", "PUT":
+		timeout := 30 * time.Second
+		if v := r.FormValue("timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			timeout = d
+		}
+		addr := r.FormValue("reconnect-to")
+		if !s.reconnectAllowed(addr) {
+			http.Error(w, errReconnectTarget.Error(), http.StatusForbidden)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := s.Drain(ctx, addr); err != nil {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		s.Undrain()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+	"golang.org/x/net/context"
+)
+
+func TestDrain(t *testing.T) {
+	s := NewServer()
+
+	a, b := stomp.Pipe()
+	go s.ServePeer(b)
+
+	connect := stomp.NewMessage()
+	connect.Method = stomp.MethodStomp
+	a.Send(connect)
+	if m := receive(t, a); !bytes.Equal(m.Method, stomp.MethodConnected) {
+		t.Fatalf("Expect CONNECTED, got %s", m.Method)
+	}
+
+	sub := stomp.NewMessage()
+	sub.Method = stomp.MethodSubscribe
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/queue/test")
+	sub.Ack = stomp.AckClientIndividual
+	sub.Receipt = []byte("2")
+	a.Send(sub)
+	receive(t, a)
+
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	producer.Send("/queue/test", []byte("hello"), stomp.WithReceipt())
+	msg := receive(t, a)
+	if !bytes.Equal(msg.Method, stomp.MethodMessage) {
+		t.Fatalf("Expect MESSAGE, got %s", msg.Method)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Drain(ctx, "tcp://standby:61613")
+	}()
+
+	m := receive(t, a)
+	if !bytes.Equal(m.Method, stomp.MethodAdvisory) {
+		t.Fatalf("Expect ADVISORY, got %s", m.Method)
+	}
+	if got := m.Header.Get(stomp.HeaderAdvisory); !bytes.Equal(got, stomp.AdvisoryShutdown) {
+		t.Errorf("Expect shutdown-imminent advisory, got %q", got)
+	}
+	if got := m.Header.GetString(string(stomp.HeaderReconnectTo)); got != "tcp://standby:61613" {
+		t.Errorf("Expect reconnect-to header, got %q", got)
+	}
+
+	send := stomp.NewMessage()
+	send.Method = stomp.MethodSend
+	send.Dest = []byte("/queue/test")
+	a.Send(send)
+	m = receive(t, a)
+	if !bytes.Equal(m.Method, stomp.MethodError) {
+		t.Fatalf("Expect draining server to reject SEND, got %s", m.Method)
+	}
+	if got := m.Header.GetString(string(stomp.HeaderRedirect)); got != "tcp://standby:61613" {
+		t.Errorf("Expect redirect header, got %q", got)
+	}
+
+	if err := s.Client().Connect(); err == nil {
+		t.Errorf("Expect draining server to reject connections")
+	}
+
+	// the session is closed once the delivered message is settled.
+	select {
+	case err := <-done:
+		t.Fatalf("Expect drain to wait for unacked messages, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	ack := stomp.NewMessage()
+	ack.Method = stomp.MethodAck
+	ack.ID = append([]byte(nil), msg.Ack...)
+	a.Send(ack)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expect drain to complete, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for drain")
+	}
+
+	s.Undrain()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Errorf("Expect server to accept connections after drain, got %s", err)
+	}
+	client.Disconnect()
+}
+
+func TestDrainTimeout(t *testing.T) {
+	s := NewServer()
+	defer s.Undrain()
+
+	a, b := stomp.Pipe()
+	go s.ServePeer(b)
+
+	connect := stomp.NewMessage()
+	connect.Method = stomp.MethodStomp
+	a.Send(connect)
+	receive(t, a)
+
+	// the unacked message is never settled.
+	s.router.RLock()
+	for sess := range s.router.sessions {
+		sess.Lock()
+		sess.ack["1"] = stomp.NewMessage()
+		sess.Unlock()
+	}
+	s.router.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx, ""); err != context.DeadlineExceeded {
+		t.Errorf("Expect drain to time out, got %v", err)
+	}
+}
+
+func TestHandleDrain(t *testing.T) {
+	s := NewServer(WithReconnectTargets("tcp://standby:61613"))
+	tests := []struct {
+		method string
+		url    string
+		header bool
+		code   int
+	}{
+		{"POST", "/meta/drain?reconnect-to=tcp://standby:61613", false, http.StatusForbidden},
+		{"POST", "/meta/drain?reconnect-to=tcp://attacker:61613", true, http.StatusForbidden},
+		{"POST", "/meta/drain?reconnect-to=tcp://standby:61613", true, http.StatusNoContent},
+		{"DELETE", "/meta/drain", false, http.StatusForbidden},
+		{"DELETE", "/meta/drain", true, http.StatusNoContent},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		if test.header {
+			r.Header.Set(HeaderAdminRequest, "1")
+		}
+		w := httptest.NewRecorder()
+		s.HandleDrain(w, r)
+		if w.Code != test.code {
+			t.Errorf("test %d: want status %d, got %d", i, test.code, w.Code)
+		}
+	}
+	if s.router.isDraining() {
+		t.Errorf("Expect maintenance mode ended")
+	}
+}
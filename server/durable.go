@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// ErrDurableUnavailable is returned when a durable subscription is
+	// requested and the server does not persist messages.
+	ErrDurableUnavailable = errors.New("stomp: durable subscription requires persistence")
+
+	// ErrDurableTopic is returned when a durable subscription is
+	// requested for a destination other than a topic.
+	ErrDurableTopic = errors.New("stomp: durable subscription requires a topic")
+
+	// ErrDurableClientID is returned when a durable subscription is
+	// requested by a session connected without a client-id.
+	ErrDurableClientID = errors.New("stomp: durable subscription requires a client-id")
+
+	// ErrDurableActive is returned when a durable subscription is already
+	// attached to another session.
+	ErrDurableActive = errors.New("stomp: durable subscription in use")
+
+	// ErrDurableOwner is returned when a durable subscription is
+	// requested with the client-id and name of a subscription owned by
+	// another user.
+	ErrDurableOwner = errors.New("stomp: durable subscription owned by another user")
+)
+
+// durablePrefix prefixes the keys of durable subscriptions in the
+// datastore.
+var durablePrefix = []byte("\xffdurable\x00")
+
+// durable is a durable topic subscription. The subscription and the
+// offset of the last message delivered are persisted, so that messages
+// logged while the subscriber is offline, including across restarts,
+// are delivered when it subscribes again.
+type durable struct {
+	key  []byte // datastore key
+	log  *messageLog
+	user []byte // authenticated identity of the owner
+
+	mu       sync.Mutex
+	dest     []byte
+	selector []byte
+	ack      []byte
+	id       []byte // subscription id
+	offset   int64  // offset of the last message delivered
+	active   bool   // attached to a session
+}
+
+// durableKey returns the datastore key of the client's named durable
+// subscription owned by the user. The keys of the subscriptions with
+// the client-id and name share the key with an empty user as a prefix.
+func (l *messageLog) durableKey(client, name, user []byte) []byte {
+	key := make([]byte, 0, len(l.scope)+len(durablePrefix)+len(client)+len(name)+len(user)+2)
+	key = append(append(key, l.scope...), durablePrefix...)
+	key = append(append(append(key, client...), 0), name...)
+	return append(append(key, 0), user...)
+}
+
+// frame returns the SUBSCRIBE frame of the subscription.
+func (d *durable) frame() *stomp.Message {
+	m := stomp.NewMessage()
+	m.Method = stomp.MethodSubscribe
+	m.Dest = append(m.Dest, d.dest...)
+	m.Selector = append(m.Selector, d.selector...)
+	m.Ack = append(m.Ack, d.ack...)
+	m.ID = append(m.ID, d.id...)
+	return m
+}
+
+// save writes the subscription to the datastore. The caller must hold
+// the lock.
+func (d *durable) save() error {
+	m := d.frame()
+	if len(d.user) != 0 {
+		m.Header.Add(stomp.HeaderLogin, d.user)
+	}
+	m.Header.Add(stomp.HeaderOffset, strconv.AppendInt(nil, d.offset, 10))
+	err := d.log.db.Put(d.key, m.Bytes(), nil)
+	m.Release()
+	return err
+}
+
+// delivered advances the offset of the subscription to the offset of
+// the delivered message, if it was logged.
+func (d *durable) delivered(m *stomp.Message) {
+	if d == nil {
+		return
+	}
+	offset := m.Header.GetInt64(string(stomp.HeaderOffset))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if offset <= d.offset {
+		return
+	}
+	d.offset = offset
+	if err := d.save(); err != nil {
+		logger.Warningf("stomp: durable subscription %s: %s", d.dest, err)
+	}
+}
+
+// loadDurables reads the durable subscriptions from the datastore.
+func (l *messageLog) loadDurables() (map[string]*durable, error) {
+	durables := make(map[string]*durable)
+	prefix := append(append([]byte(nil), l.scope...), durablePrefix...)
+	iter := l.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		m := stomp.NewMessage()
+		if err := m.Parse(append([]byte(nil), iter.Value()...)); err != nil {
+			m.Release()
+			return nil, err
+		}
+		d := &durable{
+			key:      append([]byte(nil), iter.Key()...),
+			log:      l,
+			user:     append([]byte(nil), m.User...),
+			dest:     append([]byte(nil), m.Dest...),
+			selector: append([]byte(nil), m.Selector...),
+			ack:      append([]byte(nil), m.Ack...),
+			id:       append([]byte(nil), m.ID...),
+			offset:   m.Header.GetInt64(string(stomp.HeaderOffset)),
+		}
+		m.Release()
+		durables[string(d.key)] = d
+	}
+	return durables, iter.Error()
+}
+
+// subscribeDurable attaches the session to the named durable
+// subscription, creating it if it does not exist, and delivers the
+// messages logged since the last message delivered to the subscription.
+// A subscription to another destination or with another selector
+// replaces the durable subscription, starting from the next message.
+// The subscription is owned by the authenticated user, and another
+// user cannot attach to it.
+func (r *router) subscribeDurable(sess *session, m *stomp.Message, name []byte) error {
+	if r.log == nil {
+		return ErrDurableUnavailable
+	}
+	if !bytes.HasPrefix(m.Dest, routeTopic) {
+		return ErrDurableTopic
+	}
+	client := sess.msg.Header.Get(stomp.HeaderClientID)
+	if len(client) == 0 {
+		return ErrDurableClientID
+	}
+
+	user := []byte(identity(sess))
+	key := r.log.durableKey(client, name, user)
+	r.Lock()
+	d, ok := r.durables[string(key)]
+	if ok && !bytes.Equal(d.user, user) || !ok && r.ownedByOther(client, name, key) {
+		r.Unlock()
+		return ErrDurableOwner
+	}
+	if ok && d.active {
+		r.Unlock()
+		return ErrDurableActive
+	}
+	if !ok {
+		d = &durable{key: key, log: r.log, user: user}
+		r.durables[string(key)] = d
+	}
+	d.active = true
+	r.Unlock()
+
+	d.mu.Lock()
+	if !ok || !bytes.Equal(d.dest, m.Dest) || !bytes.Equal(d.selector, m.Selector) {
+		r.log.mu.Lock()
+		d.offset = r.log.last(m.Dest)
+		r.log.mu.Unlock()
+		d.dest = append(d.dest[:0], m.Dest...)
+		d.selector = append(d.selector[:0], m.Selector...)
+	}
+	d.ack = append(d.ack[:0], m.Ack...)
+	d.id = append(d.id[:0], m.ID...)
+	offset := d.offset + 1
+	err := d.save()
+	d.mu.Unlock()
+	if err != nil {
+		r.deactivate(d)
+		return err
+	}
+
+	if err = r.replayFrom(sess, m, offset, d); err != nil {
+		r.deactivate(d)
+	}
+	return err
+}
+
+// ownedByOther returns true if a durable subscription with the client-id
+// and name is owned by a user other than that of the key. The caller
+// must hold the router lock.
+func (r *router) ownedByOther(client, name, key []byte) bool {
+	prefix := string(r.log.durableKey(client, name, nil))
+	for k := range r.durables {
+		if k != string(key) && strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deactivate detaches the durable subscription from its session. The
+// subscription remains persisted.
+func (r *router) deactivate(d *durable) {
+	r.Lock()
+	d.active = false
+	r.Unlock()
+}
+
+// dropDurable removes the durable subscription.
+func (r *router) dropDurable(d *durable) {
+	r.Lock()
+	delete(r.durables, string(d.key))
+	r.Unlock()
+	if err := r.log.db.Delete(d.key, nil); err != nil {
+		logger.Warningf("stomp: durable subscription %s: %s", d.dest, err)
+	}
+}
+
+// resumeDurable delivers the messages logged while the parked durable
+// subscription was detached, and subscribes it to live messages.
+func (r *router) resumeDurable(sess *session, sub *subscription) {
+	d := sub.durable
+	sess.unsub(sub)
+
+	d.mu.Lock()
+	m := d.frame()
+	offset := d.offset + 1
+	d.mu.Unlock()
+	if err := r.replayFrom(sess, m, offset, d); err != nil {
+		logger.Warningf("stomp: resume durable subscription %s: %s", m.Dest, err)
+		r.deactivate(d)
+	}
+	m.Release()
+}
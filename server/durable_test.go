@@ -0,0 +1,188 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// durableClient connects a client with the client-id and subscribes to
+// the durable subscription, returning the received messages.
+func durableClient(t *testing.T, s *Server, id string) (*stomp.Client, *stomp.Subscription, chan *stomp.Message) {
+	client := s.Client()
+	if err := client.Connect(stomp.WithClientID(id)); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *stomp.Message, 10)
+	sub, err := client.Subscribe("/topic/orders", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m.Clone()
+	}), stomp.WithDurable("audit"), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, sub, received
+}
+
+// waitInactive waits until the durable subscriptions are detached from
+// their sessions.
+func waitInactive(t *testing.T, r *router) {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		active := false
+		r.RLock()
+		for _, d := range r.durables {
+			active = active || d.active
+		}
+		r.RUnlock()
+		if !active {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Want durable subscriptions detached")
+		}
+	}
+}
+
+func TestDurableSubscription(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer(WithStore(dir))
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	publish := func(bodies ...string) {
+		for _, body := range bodies {
+			producer.Send("/topic/orders", []byte(body), stomp.WithPersistence(), stomp.WithReceipt())
+		}
+	}
+
+	// messages published before the subscription are not delivered.
+	publish("0")
+	client, _, received := durableClient(t, s, "billing")
+	publish("1")
+	if m := waitMessage(t, received); string(m.Body) != "1" {
+		t.Errorf("Want 1 delivered, got %s", m.Body)
+	}
+
+	// a second session cannot attach to the subscription in use.
+	other := s.Client()
+	if err := other.Connect(stomp.WithClientID("billing")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Subscribe("/topic/orders", stomp.HandlerFunc(func(*stomp.Message) {}),
+		stomp.WithDurable("audit"), stomp.WithReceipt())
+	if e, ok := err.(*stomp.BrokerError); !ok || e.Message != ErrDurableActive.Error() {
+		t.Errorf("Want ErrDurableActive, got %v", err)
+	}
+	other.Disconnect()
+
+	// messages published while offline are delivered on reconnect.
+	client.Disconnect()
+	waitInactive(t, s.router)
+	publish("2")
+	client, _, received = durableClient(t, s, "billing")
+	if m := waitMessage(t, received); string(m.Body) != "2" {
+		t.Errorf("Want backlog delivered on reconnect, got %s", m.Body)
+	}
+	client.Disconnect()
+	waitInactive(t, s.router)
+	publish("3", "4")
+	producer.Disconnect()
+	s.router.store.close()
+
+	// the subscription and its backlog survive a restart.
+	s = NewServer(WithStore(dir))
+	defer s.router.store.close()
+	client, sub, received := durableClient(t, s, "billing")
+	for _, want := range []string{"3", "4"} {
+		if m := waitMessage(t, received); string(m.Body) != want {
+			t.Errorf("Want %s delivered after restart, got %s", want, m.Body)
+		}
+	}
+
+	// unsubscribing removes the durable subscription.
+	if err := sub.Unsubscribe(stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+	s.router.RLock()
+	n := len(s.router.durables)
+	s.router.RUnlock()
+	if n != 0 {
+		t.Errorf("Want durable subscription removed, got %d", n)
+	}
+}
+
+func TestDurableSubscriptionErrors(t *testing.T) {
+	client := NewServer().Client()
+	if err := client.Connect(stomp.WithClientID("billing")); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	_, err := client.Subscribe("/topic/orders", stomp.HandlerFunc(func(*stomp.Message) {}),
+		stomp.WithDurable("audit"), stomp.WithReceipt())
+	if e, ok := err.(*stomp.BrokerError); !ok || e.Message != ErrDurableUnavailable.Error() {
+		t.Errorf("Want ErrDurableUnavailable, got %v", err)
+	}
+}
+
+func TestDurableSubscriptionOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auth := WithAuth(func(m *stomp.Message) error {
+		if string(m.Pass) != "secret" {
+			return ErrNotAuthorized
+		}
+		return nil
+	})
+	s := NewServer(WithStore(dir), auth)
+	subscribe := func(user string) error {
+		client := s.Client()
+		if err := client.Connect(stomp.WithCredentials(user, "secret"), stomp.WithClientID("billing")); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+		_, err := client.Subscribe("/topic/orders", stomp.HandlerFunc(func(*stomp.Message) {}),
+			stomp.WithDurable("audit"), stomp.WithReceipt())
+		return err
+	}
+
+	if err := subscribe("alice"); err != nil {
+		t.Fatal(err)
+	}
+	waitInactive(t, s.router)
+
+	// another user cannot take over the subscription.
+	err = subscribe("bob")
+	if e, ok := err.(*stomp.BrokerError); !ok || e.Message != ErrDurableOwner.Error() {
+		t.Errorf("Want ErrDurableOwner, got %v", err)
+	}
+	waitInactive(t, s.router)
+	if err := subscribe("alice"); err != nil {
+		t.Errorf("Want owner to attach to the subscription, got %v", err)
+	}
+	waitInactive(t, s.router)
+	s.router.store.close()
+
+	// the owner survives a restart.
+	s = NewServer(WithStore(dir), auth)
+	defer s.router.store.close()
+	err = subscribe("bob")
+	if e, ok := err.(*stomp.BrokerError); !ok || e.Message != ErrDurableOwner.Error() {
+		t.Errorf("Want ErrDurableOwner after restart, got %v", err)
+	}
+	if err := subscribe("alice"); err != nil {
+		t.Errorf("Want owner to attach to the subscription after restart, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// ErrBrokerClosed is returned when a client is requested from a closed
+// embedded broker.
+var ErrBrokerClosed = errors.New("stomp: broker closed")
+
+// Embedded is a broker running in process, for single-binary
+// deployments and tests. Clients are connected over in-memory pipes
+// and no network ports are opened. The embedded Server serves the
+// admin handlers, and may also serve network listeners.
+type Embedded struct {
+	*Server
+
+	mu     sync.Mutex
+	closed bool
+	peers  map[stomp.Peer]struct{} // client ends of open pipes
+	wg     sync.WaitGroup
+}
+
+// NewEmbedded returns an embedded broker configured with the options.
+func NewEmbedded(options ...Option) *Embedded {
+	return &Embedded{
+		Server: NewServer(options...),
+		peers:  make(map[stomp.Peer]struct{}),
+	}
+}
+
+// Client returns a client connected to the broker, establishing the
+// session with the options, such as stomp.WithCredentials.
+func (e *Embedded) Client(opts ...stomp.MessageOption) (*stomp.Client, error) {
+	a, b := stomp.Pipe()
+
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil, ErrBrokerClosed
+	}
+	e.peers[a] = struct{}{}
+	e.wg.Add(1)
+	e.mu.Unlock()
+
+	go func() {
+		defer e.wg.Done()
+		e.ServePeer(b)
+	}()
+	go func() {
+		<-stomp.Closed(a)
+		e.mu.Lock()
+		delete(e.peers, a)
+		e.mu.Unlock()
+	}()
+
+	client := stomp.New(a)
+	if err := client.Connect(opts...); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close disconnects the clients of the broker and waits for their
+// sessions to end. Clients may not be requested after Close.
+func (e *Embedded) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return ErrBrokerClosed
+	}
+	e.closed = true
+	peers := make([]stomp.Peer, 0, len(e.peers))
+	for peer := range e.peers {
+		peers = append(peers, peer)
+	}
+	e.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.Close()
+	}
+	e.wg.Wait()
+	return nil
+}
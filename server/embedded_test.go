@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestEmbedded(t *testing.T) {
+	broker := NewEmbedded(WithCredentials("admin", "secret"))
+
+	if _, err := broker.Client(); err == nil {
+		t.Errorf("Want client without credentials rejected")
+	}
+
+	consumer, err := broker.Client(stomp.WithCredentials("admin", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := consumer.Consume("/queue/test", stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer, err := broker.Client(stomp.WithCredentials("admin", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Send("/queue/test", []byte("hello"), stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Next() || string(c.Message().Body) != "hello" {
+		t.Fatalf("Want message received in process, got %v", c.Err())
+	}
+	c.Message().Release()
+
+	done := make(chan struct{})
+	go func() {
+		broker.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Want close to end the sessions")
+	}
+	if c.Next() {
+		t.Errorf("Want consumer stopped when the broker is closed")
+	}
+	if _, err := broker.Client(); err != ErrBrokerClosed {
+		t.Errorf("Want ErrBrokerClosed, got %v", err)
+	}
+}
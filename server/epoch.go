@@ -0,0 +1,64 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// nextEpoch returns an epoch later than the previous epoch. Epochs are
+// derived from the clock, in milliseconds, so that the epoch increases
+// when the server restarts.
+func nextEpoch(prev int64) int64 {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if now <= prev {
+		now = prev + 1
+	}
+	return now
+}
+
+// advanceEpoch starts a new epoch, for example when a standby node is
+// promoted to primary. Messages accepted in earlier epochs may be
+// replays of messages already processed by consumers.
+func (r *router) advanceEpoch() {
+	for {
+		prev := atomic.LoadInt64(&r.epoch)
+		next := nextEpoch(prev)
+		if atomic.CompareAndSwapInt64(&r.epoch, prev, next) {
+			logger.Noticef("stomp: epoch advanced to %d", next)
+			return
+		}
+	}
+}
+
+// stamp adds the current epoch to the message, unless the message was
+// accepted in an earlier epoch and is being replicated or redelivered.
+// Messages sent by clients and restored from the datastore are stamped
+// with the current epoch.
+func (r *router) stamp(m *stomp.Message) {
+	if len(m.Header.Get(stomp.HeaderEpoch)) == 0 {
+		m.Header.Add(stomp.HeaderEpoch, r.epochBytes())
+	}
+}
+
+// epochText is the formatted epoch, shared by the messages stamped
+// during the epoch.
+type epochText struct {
+	epoch int64
+	text  []byte
+}
+
+// epochBytes returns the formatted current epoch, formatting the epoch
+// once rather than for every message.
+func (r *router) epochBytes() []byte {
+	epoch := atomic.LoadInt64(&r.epoch)
+	t, _ := r.epochText.Load().(*epochText)
+	if t == nil || t.epoch != epoch {
+		t = &epochText{epoch: epoch, text: strconv.AppendInt(nil, epoch, 10)}
+		r.epochText.Store(t)
+	}
+	return t.text
+}
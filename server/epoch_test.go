@@ -0,0 +1,105 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestEpoch(t *testing.T) {
+	router := newRouter()
+	epoch := router.epoch
+
+	m := stomp.NewMessage()
+	router.stamp(m)
+	if got := stomp.ParseInt64(m.Header.Get(stomp.HeaderEpoch)); got != epoch {
+		t.Errorf("Expect message stamped with epoch %d, got %d", epoch, got)
+	}
+
+	router.advanceEpoch()
+	if router.epoch <= epoch {
+		t.Errorf("Expect epoch advanced")
+	}
+
+	// messages keep the epoch in which they were accepted.
+	router.stamp(m)
+	if got := stomp.ParseInt64(m.Header.Get(stomp.HeaderEpoch)); got != epoch {
+		t.Errorf("Expect restored message to keep epoch %d, got %d", epoch, got)
+	}
+}
+
+func TestEpochFence(t *testing.T) {
+	s := NewServer()
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+
+	// messages queued before the epoch advances are stale.
+	for _, dest := range []string{"/queue/ignore", "/queue/report"} {
+		producer.Send(dest, []byte("replay"), stomp.WithReceipt())
+	}
+	s.router.advanceEpoch()
+
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if client.Epoch() != s.router.epoch {
+		t.Errorf("Want client epoch %d, got %d", s.router.epoch, client.Epoch())
+	}
+
+	received := make(chan *stomp.Message, 10)
+	handler := stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m
+	})
+	var stale []string
+	client.Subscribe("/queue/ignore", handler, stomp.WithEpochFence(nil),
+		stomp.WithAck("client-individual"), stomp.WithReceipt())
+	client.Subscribe("/queue/report", handler, stomp.WithEpochFence(func(m *stomp.Message) bool {
+		stale = append(stale, string(m.Body))
+		return true
+	}), stomp.WithReceipt())
+
+	// the broker stamps the epoch of sent messages.
+	old := strconv.FormatInt(s.router.epoch-1, 10)
+	for _, dest := range []string{"/queue/ignore", "/queue/report"} {
+		producer.Send(dest, []byte("current"), stomp.WithHeader("epoch", old))
+	}
+
+	var got []string
+	timeout := time.After(time.Second)
+	for len(got) < 3 {
+		select {
+		case m := <-received:
+			got = append(got, string(m.Dest)+" "+string(m.Body))
+		case <-timeout:
+			t.Fatalf("Want 3 messages, got %v", got)
+		}
+	}
+	for _, m := range got {
+		if m == "/queue/ignore replay" {
+			t.Errorf("Want stale message ignored")
+		}
+	}
+	if len(stale) != 1 || stale[0] != "replay" {
+		t.Errorf("Want stale message reported, got %v", stale)
+	}
+
+	// the ignored message is nacked and dead-lettered.
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats, _ := s.Stats("", "/queue/dlq/ignore")
+		if stats.Depth == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Want stale message dead-lettered, got depth %d", stats.Depth)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
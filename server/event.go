@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// eventBuffer is the capacity of the event channel.
+var eventBuffer = 1024
+
+// EventType identifies the kind of session event.
+type EventType int
+
+// Session event types.
+const (
+	SessionConnected EventType = iota
+	SessionDisconnected
+	Subscribed
+	Unsubscribed
+	MessagePublished
+)
+
+var eventNames = [...]string{
+	SessionConnected:    "session-connected",
+	SessionDisconnected: "session-disconnected",
+	Subscribed:          "subscribed",
+	Unsubscribed:        "unsubscribed",
+	MessagePublished:    "message-published",
+}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventNames) {
+		return "unknown"
+	}
+	return eventNames[t]
+}
+
+// Event describes a change to a client session. Subscriptions ended by
+// a disconnect are not reported individually; the SessionDisconnected
+// event implies them.
+type Event struct {
+	Type         EventType
+	Time         time.Time
+	Host         string // virtual host
+	Session      string // remote address of the session
+	ClientID     string // client-id connect header
+	User         string
+	Dest         string // destination, for subscription and publish events
+	Subscription string // subscription id, for subscription events
+}
+
+// eventStream delivers events to the embedding application. Events are
+// only recorded once the application asks for the channel.
+type eventStream struct {
+	on      int32 // accessed atomically
+	dropped int64 // accessed atomically
+	ch      chan Event
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{ch: make(chan Event, eventBuffer)}
+}
+
+// emit sends the event for the session without blocking. Events are
+// dropped if the channel is full.
+func (e *eventStream) emit(t EventType, sess *session, dest, subs []byte) {
+	if e == nil || atomic.LoadInt32(&e.on) == 0 {
+		return
+	}
+	ev := Event{
+		Type:         t,
+		Time:         time.Now(),
+		Session:      sess.peer.Addr(),
+		Dest:         string(dest),
+		Subscription: string(subs),
+	}
+	if sess.router != nil {
+		ev.Host = sess.router.host
+	}
+	if sess.msg != nil {
+		ev.ClientID = string(sess.msg.Header.Get(stomp.HeaderClientID))
+		ev.User = string(sess.msg.User)
+	}
+	select {
+	case e.ch <- ev:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Events returns the channel of session events, which embedding
+// applications can use to track who is connected and what they are
+// subscribed to. The channel is shared by all callers and buffers 1024
+// events; events are dropped rather than blocking the broker when the
+// channel is full.
+func (s *Server) Events() <-chan Event {
+	atomic.StoreInt32(&s.events.on, 1)
+	return s.events.ch
+}
+
+// DroppedEvents returns the number of events dropped because the event
+// channel was full.
+func (s *Server) DroppedEvents() int64 {
+	return atomic.LoadInt64(&s.events.dropped)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestEvents(t *testing.T) {
+	s := NewServer()
+	events := s.Events()
+
+	client := s.Client()
+	if err := client.Connect(stomp.WithClientID("presence"), stomp.WithCredentials("janedoe", "")); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := client.Subscribe("/topic/room", stomp.HandlerFunc(func(m *stomp.Message) {
+		m.Release()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send("/topic/room", []byte("hello"))
+	sub.Unsubscribe()
+	client.Disconnect()
+
+	want := []struct {
+		typ  EventType
+		dest string
+	}{
+		{SessionConnected, ""},
+		{Subscribed, "/topic/room"},
+		{MessagePublished, "/topic/room"},
+		{Unsubscribed, "/topic/room"},
+		{SessionDisconnected, ""},
+	}
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != w.typ || ev.Dest != w.dest {
+				t.Fatalf("Want %s event for %q, got %s for %q", w.typ, w.dest, ev.Type, ev.Dest)
+			}
+			if ev.ClientID != "presence" || ev.User != "janedoe" {
+				t.Errorf("Want event attributed to the client, got %+v", ev)
+			}
+			if ev.Type == Subscribed && ev.Subscription != string(sub.ID()) {
+				t.Errorf("Want subscription id %s, got %s", sub.ID(), ev.Subscription)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Want %s event", w.typ)
+		}
+	}
+}
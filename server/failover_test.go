@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestClientFailover(t *testing.T) {
+	addr, closer := listen(t, NewServer())
+	defer closer()
+
+	// unreachable host.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := l.Addr().String()
+	l.Close()
+
+	// host accepting connections without establishing sessions.
+	broken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broken.Close()
+	go func() {
+		for {
+			conn, err := broken.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	client, err := stomp.Dial("tcp://" + unreachable + "," + broken.Addr().String() + "," + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Want session established with the live host, got %s", err)
+	}
+	if err := client.Send("/queue/failover", []byte("hello"), stomp.WithReceipt()); err != nil {
+		t.Errorf("Want message sent after failover, got %s", err)
+	}
+
+	if _, err := stomp.Dial("tcp://" + unreachable); err == nil {
+		t.Errorf("Want error dialing unreachable host")
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+)
+
+// Experimental broker behaviors gated by feature flags. Features are
+// disabled by default.
+const (
+	// FeatureWorkStealing delivers queued messages to the subscribers
+	// holding the fewest unacknowledged messages first, instead of in
+	// random order.
+	FeatureWorkStealing = "work-stealing"
+)
+
+// ErrUnknownFeature is returned when enabling or disabling a feature
+// that is not registered.
+var ErrUnknownFeature = errors.New("stomp: unknown feature")
+
+// knownFeatures is the registry of feature flags.
+var knownFeatures = []string{
+	FeatureWorkStealing,
+}
+
+// feature is the state of a feature flag.
+type feature struct {
+	Name    string    `json:"name"`
+	Enabled bool      `json:"enabled"`
+	Changed time.Time `json:"changed"`
+}
+
+// features holds the feature flags of the server.
+type features struct {
+	sync.RWMutex
+	flags map[string]*feature
+}
+
+func newFeatures() *features {
+	f := &features{flags: make(map[string]*feature)}
+	for _, name := range knownFeatures {
+		f.flags[name] = &feature{Name: name}
+	}
+	return f
+}
+
+// enabled returns true if the feature is enabled.
+func (f *features) enabled(name string) bool {
+	if f == nil {
+		return false
+	}
+	f.RLock()
+	defer f.RUnlock()
+	flag, ok := f.flags[name]
+	return ok && flag.Enabled
+}
+
+// set enables or disables the feature.
+func (f *features) set(name string, enabled bool) error {
+	f.Lock()
+	defer f.Unlock()
+	flag, ok := f.flags[name]
+	if !ok {
+		return ErrUnknownFeature
+	}
+	if flag.Enabled != enabled {
+		flag.Enabled = enabled
+		flag.Changed = time.Now()
+		logger.Noticef("stomp: feature %s: enabled=%v", name, enabled)
+	}
+	return nil
+}
+
+// list returns the feature flags sorted by name.
+func (f *features) list() []feature {
+	f.RLock()
+	defer f.RUnlock()
+	var names []string
+	for name := range f.flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []feature
+	for _, name := range names {
+		list = append(list, *f.flags[name])
+	}
+	return list
+}
+
+// Enabled returns true if the experimental feature is enabled.
+func (s *Server) Enabled(name string) bool {
+	return s.features.enabled(name)
+}
+
+// HandleFeatures reads and writes the feature flags. A GET request writes
+// a JSON-encoded list of feature flags to the http.Request. A POST request
+// enables or disables the feature named by the name query parameter
+// according to the enabled query parameter, and requires admin
+// authentication.
+func (s *Server) HandleFeatures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(s.features.list())
+	case "POST", "PUT":
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.features.set(r.FormValue("name"), enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
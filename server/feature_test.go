@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	if NewServer().Enabled(FeatureWorkStealing) {
+		t.Errorf("Want feature disabled by default")
+	}
+	s := NewServer(WithFeatures(FeatureWorkStealing, "unknown"))
+	if !s.Enabled(FeatureWorkStealing) {
+		t.Errorf("Want feature enabled by option")
+	}
+	if s.Enabled("unknown") {
+		t.Errorf("Want unknown feature disabled")
+	}
+	if err := s.features.set("unknown", true); err != ErrUnknownFeature {
+		t.Errorf("Want ErrUnknownFeature, got %v", err)
+	}
+}
+
+func TestHandleFeatures(t *testing.T) {
+	s := NewServer(WithCredentials("admin", "secret"))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/meta/features?name=work-stealing&enabled=true", nil)
+	r.Header.Set(HeaderAdminRequest, "1")
+	s.HandleFeatures(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Want status 401 without credentials, got %d", w.Code)
+	}
+	if s.Enabled(FeatureWorkStealing) {
+		t.Errorf("Want feature unchanged by unauthenticated request")
+	}
+
+	w = httptest.NewRecorder()
+	r.SetBasicAuth("admin", "secret")
+	s.HandleFeatures(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Want status 204, got %d", w.Code)
+	}
+	if !s.Enabled(FeatureWorkStealing) {
+		t.Errorf("Want feature enabled by admin request")
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/meta/features?name=unknown&enabled=true", nil)
+	r.Header.Set(HeaderAdminRequest, "1")
+	r.SetBasicAuth("admin", "secret")
+	s.HandleFeatures(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Want status 404 for unknown feature, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/meta/features", nil)
+	s.HandleFeatures(w, r)
+	var flags []feature
+	if err := json.NewDecoder(w.Body).Decode(&flags); err != nil {
+		t.Fatal(err)
+	}
+	if len(flags) != len(knownFeatures) {
+		t.Errorf("Want %d feature flags, got %d", len(knownFeatures), len(flags))
+	}
+	for _, flag := range flags {
+		if flag.Enabled != (flag.Name == FeatureWorkStealing) {
+			t.Errorf("Want feature %s enabled=%v", flag.Name, !flag.Enabled)
+		}
+	}
+}
+
+func TestWorkStealing(t *testing.T) {
+	q := newQueue([]byte("/queue/test"))
+	q.features = newFeatures()
+	q.features.set(FeatureWorkStealing, true)
+
+	busy, idle := &subscription{}, &subscription{}
+	busy.track([]byte("1"))
+	q.subs[busy] = struct{}{}
+	q.subs[idle] = struct{}{}
+	for i := 0; i < 10; i++ {
+		if subs := q.consumers(); subs[0] != idle {
+			t.Fatalf("Want idle subscription first with work stealing")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s := NewServer(WithFeatures(FeatureWorkStealing))
+	s.HandleHosts(w, httptest.NewRequest("GET", "/meta/hosts", nil))
+	var hosts []struct {
+		Features []string `json:"features"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&hosts); err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || len(hosts[0].Features) != 1 || hosts[0].Features[0] != FeatureWorkStealing {
+		t.Errorf("Want enabled feature reported, got %+v", hosts)
+	}
+}
@@ -0,0 +1,264 @@
+// Package gateway implements a gRPC gateway in front of the broker, so
+// gRPC services can publish and subscribe to broker destinations without
+// a STOMP client. The service is defined in broker.proto. Message headers
+// are mapped to the headers field, and protobuf payloads are carried in
+// the body with the type url in the type-url header.
+//
+// The gateway is an http.Handler. gRPC requires HTTP/2, which net/http
+// negotiates for servers using TLS; Serve also accepts unencrypted
+// HTTP/2 connections.
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/server"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// HeaderTypeURL is the message header holding the type url of protobuf
+// payloads.
+const HeaderTypeURL = "type-url"
+
+// gRPC method paths.
+const (
+	pathPublish   = "/mq.Broker/Publish"
+	pathSubscribe = "/mq.Broker/Subscribe"
+)
+
+// gRPC status codes.
+const (
+	statusOK              = "0"
+	statusInvalidArgument = "3"
+	statusUnimplemented   = "12"
+	statusInternal        = "13"
+	statusUnauthenticated = "16"
+)
+
+// maxMessageSize is the maximum size of a request message.
+const maxMessageSize = 4 << 20
+
+var (
+	errCompressed = errors.New("gateway: compressed messages not supported")
+	errTooLarge   = errors.New("gateway: message too large")
+)
+
+// Gateway serves the gRPC Broker service.
+type Gateway struct {
+	server *server.Server
+}
+
+// New returns a gateway to the server.
+func New(s *server.Server) *Gateway {
+	return &Gateway{server: s}
+}
+
+// ServeHTTP serves the gRPC request.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var code, msg string
+	switch r.URL.Path {
+	case pathPublish:
+		code, msg = g.publish(w, r)
+	case pathSubscribe:
+		code, msg = g.subscribe(w, r)
+	default:
+		code, msg = statusUnimplemented, "unknown method "+r.URL.Path
+	}
+	w.Header().Set("Grpc-Status", code)
+	w.Header().Set("Grpc-Message", msg)
+}
+
+// publish sends the request message to the destination.
+func (g *Gateway) publish(w http.ResponseWriter, r *http.Request) (string, string) {
+	data, err := readMessage(r.Body)
+	if err != nil {
+		return statusInvalidArgument, err.Error()
+	}
+	var m message
+	if err := m.unmarshal(data); err != nil {
+		return statusInvalidArgument, err.Error()
+	}
+	if m.dest == "" {
+		return statusInvalidArgument, "destination required"
+	}
+
+	client, code, msg := g.connect(r)
+	if client == nil {
+		return code, msg
+	}
+	defer client.Disconnect()
+
+	opts := []stomp.MessageOption{
+		stomp.WithHeaders(m.headers),
+		stomp.WithReceipt(),
+	}
+	body := m.body
+	if m.payload != nil {
+		body = m.payload.value
+		opts = append(opts, stomp.WithHeader(HeaderTypeURL, m.payload.typeURL))
+	}
+	if err := client.Send(m.dest, body, opts...); err != nil {
+		return statusInternal, err.Error()
+	}
+	writeMessage(w, nil)
+	return statusOK, ""
+}
+
+// subscribe streams the messages sent to the destination until the
+// request is cancelled. Messages are acknowledged once written to the
+// response, and negatively acknowledged if the write fails, so that the
+// broker delivers them again.
+func (g *Gateway) subscribe(w http.ResponseWriter, r *http.Request) (string, string) {
+	data, err := readMessage(r.Body)
+	if err != nil {
+		return statusInvalidArgument, err.Error()
+	}
+	var req subscribeRequest
+	if err := req.unmarshal(data); err != nil {
+		return statusInvalidArgument, err.Error()
+	}
+	if req.dest == "" {
+		return statusInvalidArgument, "destination required"
+	}
+
+	client, code, msg := g.connect(r)
+	if client == nil {
+		return code, msg
+	}
+	defer client.Disconnect()
+
+	var (
+		mu     sync.Mutex
+		closed bool
+	)
+	handler := stomp.HandlerFunc(func(sm *stomp.Message) {
+		m := message{
+			dest:    string(sm.Dest),
+			id:      string(sm.ID),
+			headers: map[string]string{},
+		}
+		for i := 0; i < sm.Header.Len(); i++ {
+			k, v := sm.Header.Index(i)
+			m.headers[string(k)] = string(v)
+		}
+		if typeURL := m.headers[HeaderTypeURL]; typeURL != "" {
+			m.payload = &protoAny{typeURL: typeURL, value: sm.Body}
+		} else {
+			m.body = sm.Body
+		}
+
+		data := m.marshal()
+		ack := append([]byte(nil), sm.Ack...)
+		sm.Release()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			client.Nack(ack)
+			return
+		}
+		if err := writeMessage(w, data); err != nil {
+			logger.Warningf("gateway: subscribe %s: %s", req.dest, err)
+			client.Nack(ack)
+			return
+		}
+		client.Ack(ack)
+	})
+
+	// the response headers are sent before subscribing, as messages
+	// may be written as soon as the subscription is registered.
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	opts := []stomp.MessageOption{
+		stomp.WithAck(string(stomp.AckClientIndividual)),
+	}
+	if req.selector != "" {
+		opts = append(opts, stomp.WithSelector(req.selector))
+	}
+	opts = append(opts, stomp.WithReceipt())
+	if _, err := client.Subscribe(req.dest, handler, opts...); err != nil {
+		return statusInvalidArgument, err.Error()
+	}
+
+	select {
+	case <-r.Context().Done():
+	case <-client.Done():
+	}
+
+	// the handler must not write to the response once the request
+	// completes.
+	mu.Lock()
+	closed = true
+	mu.Unlock()
+	return statusOK, ""
+}
+
+// connect connects a client to the server using the login and passcode
+// request metadata as credentials. On failure the gRPC status is
+// returned.
+func (g *Gateway) connect(r *http.Request) (*stomp.Client, string, string) {
+	client := g.server.Client()
+	err := client.Connect(stomp.WithCredentials(
+		r.Header.Get("login"),
+		r.Header.Get("passcode"),
+	))
+	if err != nil {
+		client.Disconnect()
+		return nil, statusUnauthenticated, err.Error()
+	}
+	return client, "", ""
+}
+
+// readMessage reads a length-prefixed gRPC message.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errCompressed
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, errTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeMessage writes a length-prefixed gRPC message and flushes the
+// response.
+func writeMessage(w http.ResponseWriter, data []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/server"
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestGateway(t *testing.T) {
+	ts := httptest.NewServer(New(server.NewServer()))
+	defer ts.Close()
+
+	req := message{
+		dest:    "/queue/test",
+		headers: map[string]string{"kind": "greeting"},
+		payload: &protoAny{typeURL: "type.googleapis.com/test.Greeting", value: []byte("hello")},
+	}
+	resp := call(t, ts.URL+pathPublish, req.marshal())
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := resp.Trailer.Get("Grpc-Status"); got != statusOK {
+		t.Fatalf("Want message published, got status %s: %s", got, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	sub := subscribeRequest{dest: "/queue/test"}
+	var b []byte
+	b = appendString(b, 1, sub.dest)
+	resp = call(t, ts.URL+pathSubscribe, b)
+	data, err := readMessage(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got message
+	if err := got.unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.dest != "/queue/test" || got.id == "" {
+		t.Errorf("Want destination and message id, got %q %q", got.dest, got.id)
+	}
+	if got.headers["kind"] != "greeting" {
+		t.Errorf("Want headers mapped, got %v", got.headers)
+	}
+	if got.payload == nil || got.payload.typeURL != req.payload.typeURL || string(got.payload.value) != "hello" {
+		t.Errorf("Want protobuf payload delivered, got %v", got.payload)
+	}
+
+	resp = call(t, ts.URL+pathPublish, nil)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := resp.Trailer.Get("Grpc-Status"); got != statusInvalidArgument {
+		t.Errorf("Want invalid argument publishing without a destination, got %s", got)
+	}
+}
+
+// call sends the gRPC request message to the url.
+func call(t *testing.T, url string, data []byte) *http.Response {
+	body := new(bytes.Buffer)
+	body.Write([]byte{0, 0, 0, 0, byte(len(data))})
+	body.Write(data)
+	resp, err := http.Post(url, "application/grpc", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Want status 200, got %d", resp.StatusCode)
+	}
+	return resp
+}
+
+// failWriter is a response writer whose writes fail, as when the gRPC
+// client goes away.
+type failWriter struct {
+	header http.Header
+}
+
+func (w *failWriter) Header() http.Header       { return w.header }
+func (w *failWriter) WriteHeader(int)           {}
+func (w *failWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestGatewayWriteFailure(t *testing.T) {
+	s := server.NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	client.Send("/queue/test", []byte("hello"), stomp.WithReceipt())
+
+	var b []byte
+	b = appendString(b, 1, "/queue/test")
+	body := new(bytes.Buffer)
+	body.Write([]byte{0, 0, 0, 0, byte(len(b))})
+	body.Write(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("POST", pathSubscribe, body).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/grpc")
+
+	done := make(chan struct{})
+	go func() {
+		New(s).ServeHTTP(&failWriter{header: http.Header{}}, r)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	// messages which could not be written remain queued.
+	for i := 0; i < 100; i++ {
+		if stats, _ := s.Stats("", "/queue/test"); stats.Depth == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Want message requeued after the write failed")
+}
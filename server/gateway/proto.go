@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// protobuf wire types.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errMalformed = errors.New("gateway: malformed protobuf message")
+
+// message is the protobuf Message defined in broker.proto.
+type message struct {
+	dest    string
+	headers map[string]string
+	body    []byte
+	payload *protoAny
+	id      string
+}
+
+// protoAny is the protobuf google.protobuf.Any message.
+type protoAny struct {
+	typeURL string
+	value   []byte
+}
+
+// subscribeRequest is the protobuf SubscribeRequest defined in
+// broker.proto.
+type subscribeRequest struct {
+	dest     string
+	selector string
+}
+
+func (m *message) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.dest)
+	keys := make([]string, 0, len(m.headers))
+	for k := range m.headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, m.headers[k])
+		b = appendBytes(b, 2, entry)
+	}
+	b = appendBytes(b, 3, m.body)
+	if m.payload != nil {
+		var v []byte
+		v = appendString(v, 1, m.payload.typeURL)
+		v = appendBytes(v, 2, m.payload.value)
+		b = appendBytes(b, 4, v)
+	}
+	b = appendString(b, 5, m.id)
+	return b
+}
+
+func (m *message) unmarshal(b []byte) error {
+	return fields(b, func(num int, v []byte) error {
+		switch num {
+		case 1:
+			m.dest = string(v)
+		case 2:
+			var k, val string
+			err := fields(v, func(num int, v []byte) error {
+				switch num {
+				case 1:
+					k = string(v)
+				case 2:
+					val = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if m.headers == nil {
+				m.headers = map[string]string{}
+			}
+			m.headers[k] = val
+		case 3:
+			m.body = v
+		case 4:
+			m.payload = new(protoAny)
+			return fields(v, func(num int, v []byte) error {
+				switch num {
+				case 1:
+					m.payload.typeURL = string(v)
+				case 2:
+					m.payload.value = v
+				}
+				return nil
+			})
+		case 5:
+			m.id = string(v)
+		}
+		return nil
+	})
+}
+
+func (r *subscribeRequest) unmarshal(b []byte) error {
+	return fields(b, func(num int, v []byte) error {
+		switch num {
+		case 1:
+			r.dest = string(v)
+		case 2:
+			r.selector = string(v)
+		}
+		return nil
+	})
+}
+
+// fields calls fn with the number and value of each length-delimited
+// field of the encoded message. Varint fields are skipped.
+func fields(b []byte, fn func(num int, v []byte) error) error {
+	for len(b) != 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformed
+		}
+		b = b[n:]
+		switch key & 7 {
+		case wireVarint:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errMalformed
+			}
+			b = b[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errMalformed
+			}
+			v := b[n : n+int(size)]
+			b = b[n+int(size):]
+			if err := fn(int(key>>3), v); err != nil {
+				return err
+			}
+		default:
+			return errMalformed
+		}
+	}
+	return nil
+}
+
+func appendString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendBytes(b, num, []byte(s))
+}
+
+func appendBytes(b []byte, num int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(num)<<3|wireBytes)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(b, tmp[:n]...)
+}
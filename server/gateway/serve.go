@@ -0,0 +1,21 @@
+//go:build go1.24
+// +build go1.24
+
+package gateway
+
+import (
+	"net"
+	"net/http"
+)
+
+// Serve serves HTTP requests on the listener using the handler, or
+// http.DefaultServeMux if nil. Connections using HTTP/2 without TLS, as
+// gRPC clients do when TLS is not configured, are accepted as well as
+// HTTP/1 connections.
+func Serve(l net.Listener, handler http.Handler) error {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Handler: handler, Protocols: protocols}
+	return srv.Serve(l)
+}
@@ -0,0 +1,16 @@
+//go:build !go1.24
+// +build !go1.24
+
+package gateway
+
+import (
+	"net"
+	"net/http"
+)
+
+// Serve serves HTTP requests on the listener using the handler, or
+// http.DefaultServeMux if nil. HTTP/2 without TLS requires Go 1.24, so
+// gRPC clients must connect using TLS.
+func Serve(l net.Listener, handler http.Handler) error {
+	return http.Serve(l, handler)
+}
@@ -0,0 +1,45 @@
+//go:build go1.24
+// +build go1.24
+
+package gateway
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/mrwill84/mq/server"
+)
+
+func TestServeUnencryptedHTTP2(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l, New(server.NewServer()))
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	req := message{dest: "/queue/test", body: []byte("hello")}
+	data := req.marshal()
+	body := new(bytes.Buffer)
+	body.Write([]byte{0, 0, 0, 0, byte(len(data))})
+	body.Write(data)
+	resp, err := client.Post("http://"+l.Addr().String()+pathPublish, "application/grpc", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Want HTTP/2 without TLS, got %s", resp.Proto)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != statusOK {
+		t.Errorf("Want message published, got status %s", got)
+	}
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// hash functions used by the signing algorithms.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// ErrInvalidToken is returned when the token presented on CONNECT is
+// malformed, expired, or not signed by a configured key.
+var ErrInvalidToken = errors.New("stomp: invalid token")
+
+// ErrTokenExpired is the reason a session is closed when the token it
+// authenticated with expires.
+var ErrTokenExpired = errors.New("stomp: token expired")
+
+// JWKS defaults.
+var (
+	jwksRefresh = time.Hour
+	jwksTimeout = time.Second * 10
+	jwtLeeway   = time.Minute
+)
+
+// JWTOptions configures JWT authentication. Clients pass the token in
+// the token header, or as the passcode, on CONNECT. Tokens are verified
+// with the HMAC secret, the public keys, the PEM-encoded public key
+// file, or the keys published at the JWKS url. The token subject is the
+// session username, and the scope or scopes claim grants destination
+// permissions, such as "send:/queue/orders.*" or "subscribe". Tokens
+// must have an exp claim unless AllowNoExpiry is set, and sessions are
+// closed when their token expires.
+type JWTOptions struct {
+	Secret        []byte             // HMAC secret for HS256, HS384 and HS512
+	Keys          []crypto.PublicKey // RSA or ECDSA public keys
+	KeyFile       string             // PEM-encoded public key file
+	JWKSURL       string             // JSON web key set url
+	Issuer        string             // required iss claim, optional
+	Audience      string             // required aud claim, optional
+	AllowNoExpiry bool               // accept tokens without an exp claim
+}
+
+// jwtVerifier verifies tokens and caches the keys of the key file and
+// key set.
+type jwtVerifier struct {
+	JWTOptions
+
+	mu      sync.Mutex
+	file    []crypto.PublicKey
+	jwks    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newJWTVerifier(opts JWTOptions) *jwtVerifier {
+	return &jwtVerifier{JWTOptions: opts}
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the claims of a verified token.
+type jwtClaims map[string]interface{}
+
+// authenticate verifies the token of the connect message, passed in the
+// token header or the passcode, sets the username to the token subject,
+// and returns the access control list granted by the token scopes and
+// the time the token expires, or the zero time if it does not.
+func (v *jwtVerifier) authenticate(m *stomp.Message) (*acl, time.Time, error) {
+	token := m.Header.Get(stomp.HeaderToken)
+	if len(token) == 0 {
+		token = m.Pass
+	}
+	claims, err := v.verify(string(token), time.Now())
+	if err != nil {
+		logger.Noticef("stomp: connect: %s", err)
+		return nil, time.Time{}, ErrInvalidToken
+	}
+	if sub, ok := claims["sub"].(string); ok {
+		m.User = append(m.User[:0], sub...)
+	}
+	var expires time.Time
+	if exp, ok := claims.time("exp"); ok {
+		expires = exp.Add(jwtLeeway)
+	}
+	return newACL(claims.scopes()), expires, nil
+}
+
+// verify checks the signature and registered claims of the token.
+func (v *jwtVerifier) verify(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("jwt: malformed signature")
+	}
+	if err := v.verifySignature(header, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	exp, ok := claims.time("exp")
+	switch {
+	case !ok && !v.AllowNoExpiry:
+		return nil, errors.New("jwt: token has no expiry")
+	case ok && now.After(exp.Add(jwtLeeway)):
+		return nil, errors.New("jwt: token expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return nil, errors.New("jwt: token not yet valid")
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return nil, fmt.Errorf("jwt: issuer %v not accepted", claims["iss"])
+	}
+	if v.Audience != "" && !claims.audience(v.Audience) {
+		return nil, fmt.Errorf("jwt: audience %v not accepted", claims["aud"])
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("jwt: malformed token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("jwt: malformed token")
+	}
+	return nil
+}
+
+// verifySignature verifies the signature of the signed content with
+// the configured keys for the algorithm.
+func (v *jwtVerifier) verifySignature(header jwtHeader, signed, sig []byte) error {
+	if len(header.Alg) != 5 {
+		return fmt.Errorf("jwt: algorithm %q not supported", header.Alg)
+	}
+	var hash crypto.Hash
+	switch header.Alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("jwt: algorithm %q not supported", header.Alg)
+	}
+
+	switch header.Alg[:2] {
+	case "HS":
+		if len(v.Secret) == 0 {
+			break
+		}
+		mac := hmac.New(hash.New, v.Secret)
+		mac.Write(signed)
+		if hmac.Equal(mac.Sum(nil), sig) {
+			return nil
+		}
+		return errors.New("jwt: invalid signature")
+	case "RS", "ES":
+		h := hash.New()
+		h.Write(signed)
+		digest := h.Sum(nil)
+		for _, key := range v.keys(header.Kid) {
+			if verifyKey(header.Alg[:2], key, hash, digest, sig) {
+				return nil
+			}
+		}
+		return errors.New("jwt: invalid signature")
+	}
+	return fmt.Errorf("jwt: algorithm %q not supported", header.Alg)
+}
+
+func verifyKey(kind string, key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return kind == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if kind != "ES" || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// keys returns the public keys that may have signed a token with the
+// key id. The key set is fetched when first needed, when it is stale,
+// and when the key id is unknown. The key set is fetched without holding
+// the lock, so that connections verified meanwhile use the cached keys
+// rather than wait for the identity provider.
+func (v *jwtVerifier) keys(kid string) []crypto.PublicKey {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := append([]crypto.PublicKey(nil), v.Keys...)
+	if v.KeyFile != "" && v.file == nil {
+		file, err := readPublicKeys(v.KeyFile)
+		if err != nil {
+			logger.Warningf("stomp: jwt key file: %s", err)
+		}
+		v.file = file
+	}
+	keys = append(keys, v.file...)
+
+	if v.JWKSURL == "" {
+		return keys
+	}
+	_, known := v.jwks[kid]
+	stale := time.Since(v.fetched) > jwksRefresh
+	// unknown key ids refetch the key set at most once a minute, so
+	// that forged key ids cannot flood the identity provider.
+	if stale || !known && time.Since(v.fetched) > time.Minute {
+		// the fetch time is set first, so that a single connection
+		// fetches the key set.
+		v.fetched = time.Now()
+		v.mu.Unlock()
+		jwks, err := fetchJWKS(v.JWKSURL)
+		v.mu.Lock()
+		if err != nil {
+			logger.Warningf("stomp: jwks %s: %s", v.JWKSURL, err)
+		} else {
+			v.jwks = jwks
+		}
+	}
+	if key, ok := v.jwks[kid]; ok {
+		return append(keys, key)
+	}
+	if kid == "" {
+		for _, key := range v.jwks {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// readPublicKeys reads the PEM-encoded public keys of the file.
+func readPublicKeys(file string) ([]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys", file)
+	}
+	return keys, nil
+}
+
+// fetchJWKS fetches the RSA and EC keys of the JSON web key set.
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	client := http.Client{Timeout: jwksTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decodeBigInt(k.N)
+			e, err2 := decodeBigInt(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err1 := decodeBigInt(k.X)
+			y, err2 := decodeBigInt(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// time returns the numeric date claim.
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+// audience returns true if the aud claim, a string or list of strings,
+// includes the audience.
+func (c jwtClaims) audience(aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, item := range v {
+			if item == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopes returns the scopes of the space-separated scope claim, or of
+// the scopes list claim.
+func (c jwtClaims) scopes() []string {
+	var scopes []string
+	if s, ok := c["scope"].(string); ok {
+		scopes = strings.Fields(s)
+	}
+	if list, ok := c["scopes"].([]interface{}); ok {
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
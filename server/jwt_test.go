@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// signJWT returns a token with the claims signed by the key, an HMAC
+// secret, RSA or ECDSA private key.
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(crypto.SHA256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func Test_jwtVerifier_verify(t *testing.T) {
+	secret := []byte("secret")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newJWTVerifier(JWTOptions{
+		Secret:   secret,
+		Keys:     []crypto.PublicKey{&ecKey.PublicKey},
+		Issuer:   "https://id.example.com",
+		Audience: "mq",
+	})
+	now := time.Now()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://id.example.com",
+			"aud": []string{"web", "mq"},
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"hmac", signJWT(t, "HS256", "", secret, claims(nil)), true},
+		{"ecdsa", signJWT(t, "ES256", "", ecKey, claims(nil)), true},
+		{"wrong secret", signJWT(t, "HS256", "", []byte("guess"), claims(nil)), false},
+		{"expired", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), false},
+		{"not before", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), false},
+		{"issuer", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"audience", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"aud": "web"})), false},
+		{"no expiry", signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"exp": nil})), false},
+		{"none", "eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSJ9.", false},
+		{"malformed", "token", false},
+	} {
+		_, err := v.verify(test.token, now)
+		if (err == nil) != test.valid {
+			t.Errorf("Want %s token valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	v.AllowNoExpiry = true
+	if _, err := v.verify(signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"exp": nil})), now); err != nil {
+		t.Errorf("Want token without expiry accepted when allowed, got %s", err)
+	}
+}
+
+func Test_jwtVerifier_jwks(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		)
+	}))
+	defer ts.Close()
+
+	v := newJWTVerifier(JWTOptions{JWKSURL: ts.URL})
+	token := signJWT(t, "RS256", "k1", key, map[string]interface{}{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := v.verify(token, time.Now()); err != nil {
+			t.Fatalf("Want token verified with the key set, got %s", err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Want key set cached, fetched %d times", fetches)
+	}
+}
+
+func Test_jwtVerifier_jwksUnlocked(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `{"keys":[]}`)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	v := newJWTVerifier(JWTOptions{
+		Keys:    []crypto.PublicKey{&key.PublicKey},
+		JWKSURL: ts.URL,
+	})
+	token := signJWT(t, "ES256", "", key, map[string]interface{}{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	go v.verify(signJWT(t, "ES256", "k1", key, nil), time.Now())
+	for {
+		v.mu.Lock()
+		fetching := !v.fetched.IsZero()
+		v.mu.Unlock()
+		if fetching {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	verified := make(chan error, 1)
+	go func() {
+		_, err := v.verify(token, time.Now())
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Errorf("Want token verified with the configured key, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Want tokens verified while the key set is fetched")
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	secret := []byte("secret")
+	s := NewServer(WithJWT(JWTOptions{Secret: secret}))
+
+	connect := func(token string) (stomp.Peer, *stomp.Message) {
+		a, b := stomp.Pipe()
+		go s.ServePeer(b)
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodStomp
+		m.Header.Add(stomp.HeaderToken, []byte(token))
+		a.Send(m)
+		select {
+		case m, ok := <-a.Receive():
+			if ok {
+				return a, m
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for message")
+		}
+		return a, nil
+	}
+
+	if _, m := connect("forged"); m != nil && bytes.Equal(m.Method, stomp.MethodConnected) {
+		t.Errorf("Want invalid token rejected")
+	}
+
+	token := signJWT(t, "HS256", "", secret, map[string]interface{}{
+		"sub":   "alice",
+		"scope": "subscribe:/topic/* send:/queue/orders.*",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	a, m := connect(token)
+	defer a.Close()
+	if m == nil || !bytes.Equal(m.Method, stomp.MethodConnected) {
+		t.Fatalf("Want token accepted, got %v", m)
+	}
+
+	request := func(method []byte, dest string) *stomp.Message {
+		m := stomp.NewMessage()
+		m.Method = method
+		m.ID = []byte("1")
+		m.Dest = []byte(dest)
+		m.Receipt = []byte("1")
+		a.Send(m)
+		return receive(t, a)
+	}
+	for _, test := range []struct {
+		method  []byte
+		dest    string
+		allowed bool
+	}{
+		{stomp.MethodSubscribe, "/topic/news", true},
+		{stomp.MethodSubscribe, "/queue/orders.eu", false},
+		{stomp.MethodSend, "/queue/orders.eu", true},
+		{stomp.MethodSend, "/topic/news", false},
+	} {
+		m := request(test.method, test.dest)
+		if allowed := !bytes.Equal(m.Method, stomp.MethodError); allowed != test.allowed {
+			t.Errorf("Want %s %s allowed %v, got %s", test.method, test.dest, test.allowed, m)
+		}
+	}
+
+	s.router.RLock()
+	var user string
+	for sess := range s.router.sessions {
+		user = string(sess.msg.User)
+	}
+	s.router.RUnlock()
+	if user != "alice" {
+		t.Errorf("Want token subject as the username, got %q", user)
+	}
+}
+
+func Test_session_expireAt(t *testing.T) {
+	a, b := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = b
+	sess.expireAt(time.Now().Add(10 * time.Millisecond))
+	defer sess.release()
+
+	select {
+	case _, ok := <-a.Receive():
+		if ok {
+			t.Errorf("Want no message before the session is closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want session closed when the token expires")
+	}
+	if err := stomp.CloseErr(b); err != ErrTokenExpired {
+		t.Errorf("Want session closed with ErrTokenExpired, got %v", err)
+	}
+}
+
+func Test_acl_allowed(t *testing.T) {
+	a := newACL([]string{"send", "subscribe:/queue/orders.*", "admin"})
+	if !a.allowed(permSend, []byte("/topic/anything")) {
+		t.Errorf("Want scope without a pattern to grant every destination")
+	}
+	if !a.allowed(permSubscribe, []byte("/queue/orders.eu")) || a.allowed(permSubscribe, []byte("/queue/other")) {
+		t.Errorf("Want subscribe permission by pattern")
+	}
+	var none *acl
+	if !none.allowed(permSend, []byte("/queue/a")) {
+		t.Errorf("Want unrestricted sessions allowed")
+	}
+}
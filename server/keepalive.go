@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// ErrSessionIdle is the reason a session is closed after the session
+// idle timeout.
+var ErrSessionIdle = errors.New("stomp: session idle timeout")
+
+// activePeer is implemented by peers that record the time of the last
+// frame or heart-beat read from the connection.
+type activePeer interface {
+	LastRead() time.Time
+	Heartbeats() int64
+}
+
+// touch records a frame received from the session.
+func (s *session) touch(now time.Time) {
+	atomic.StoreInt64(&s.lastFrame, now.UnixNano())
+	atomic.AddInt64(&s.frames, 1)
+}
+
+// lastActivity returns the time of the last frame or heart-beat
+// received from the session, or the connect time if there was none.
+func (s *session) lastActivity() time.Time {
+	last := s.connected
+	if t := atomic.LoadInt64(&s.lastFrame); t != 0 && time.Unix(0, t).After(last) {
+		last = time.Unix(0, t)
+	}
+	if p, ok := s.peer.(activePeer); ok {
+		if t := p.LastRead(); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// heartbeats returns the number of heart-beats received from the
+// session, or zero if the transport does not count them.
+func (s *session) heartbeats() int64 {
+	if p, ok := s.peer.(activePeer); ok {
+		return p.Heartbeats()
+	}
+	return 0
+}
+
+// sweepSessions closes sessions without frames or heart-beats for
+// longer than the session idle timeout.
+func (r *router) sweepSessions(now time.Time) {
+	var idle []*session
+	r.RLock()
+	for sess := range r.sessions {
+		if now.Sub(sess.lastActivity()) >= r.sessionIdle {
+			idle = append(idle, sess)
+		}
+	}
+	r.RUnlock()
+
+	for _, sess := range idle {
+		logger.Noticef("stomp: closing idle session %s", sess.peer.Addr())
+		stomp.CloseWithError(sess.peer, ErrSessionIdle)
+	}
+}
+
+// expireAt closes the session at the time its credentials expire, unless
+// the time is zero.
+func (s *session) expireAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	peer := s.peer
+	s.expiry = time.AfterFunc(t.Sub(time.Now()), func() {
+		logger.Noticef("stomp: closing session %s: token expired", peer.Addr())
+		stomp.CloseWithError(peer, ErrTokenExpired)
+	})
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionKeepalive(t *testing.T) {
+	s := NewServer()
+	addr, closer := listen(t, s)
+	defer closer()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("CONNECT\naccept-version:1.2\n\n\x00"))
+	if _, err := r.ReadString(0); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("\x00\x00"))
+	conn.Write([]byte("SUBSCRIBE\nid:1\ndestination:/topic/a\nreceipt:1\n\n\x00"))
+	if _, err := r.ReadString(0); err != nil {
+		t.Fatal(err)
+	}
+
+	type sessionResp struct {
+		LastActivity time.Time `json:"last_activity"`
+		Frames       int64     `json:"frames"`
+		Heartbeats   int64     `json:"heartbeats"`
+	}
+	sessions := func(query string) []sessionResp {
+		w := httptest.NewRecorder()
+		s.HandleSessions(w, httptest.NewRequest("GET", "/meta/sessions"+query, nil))
+		var resp []sessionResp
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := sessions("")
+	if len(resp) != 1 {
+		t.Fatalf("Want 1 session, got %d", len(resp))
+	}
+	if resp[0].Frames != 1 || resp[0].Heartbeats != 2 {
+		t.Errorf("Want 1 frame and 2 heart-beats, got %d and %d", resp[0].Frames, resp[0].Heartbeats)
+	}
+	if time.Since(resp[0].LastActivity) > time.Second {
+		t.Errorf("Want recent last activity, got %s", resp[0].LastActivity)
+	}
+	if resp := sessions("?idle=1h"); len(resp) != 0 {
+		t.Errorf("Want no sessions idle for an hour, got %d", len(resp))
+	}
+
+	s.router.sessionIdle = time.Minute
+	s.router.sweepSessions(time.Now())
+	if len(sessions("")) != 1 {
+		t.Errorf("Want active session kept open")
+	}
+	s.router.sweepSessions(time.Now().Add(time.Minute))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, err := r.ReadByte(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Errorf("Want idle session closed")
+			}
+			break
+		}
+	}
+}
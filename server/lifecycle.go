@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// ErrDestinationInUse is returned when deleting a destination that has
+// subscribers.
+var ErrDestinationInUse = errors.New("stomp: destination has subscribers")
+
+// errInvalidDestination is returned when creating a destination outside
+// the queue and topic namespaces.
+var errInvalidDestination = errors.New("stomp: invalid destination")
+
+// declare creates the destination, if it does not exist, and exempts the
+// destination from automatic deletion.
+func (r *router) declare(dest string) error {
+	if !bytes.HasPrefix([]byte(dest), routeQueue) && !bytes.HasPrefix([]byte(dest), routeTopic) {
+		return errInvalidDestination
+	}
+
+	m := stomp.NewMessage()
+	m.Dest = append(m.Dest, dest...)
+	defer m.Release()
+
+	r.Lock()
+	defer r.Unlock()
+	_, created := r.destinations.loadOrCreate(dest, func() handler {
+		return r.createHandler(m)
+	})
+	if created {
+		logger.Noticef("stomp: destination %s created", dest)
+	}
+	r.declared[dest] = struct{}{}
+	return nil
+}
+
+// undeclare deletes the destination, discarding queued messages. A
+// destination with subscribers cannot be deleted.
+func (r *router) undeclare(dest string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	h, ok := r.destinations.load(dest)
+	if !ok {
+		return errNoDestination
+	}
+	if r.subscribed()[dest] != 0 {
+		return ErrDestinationInUse
+	}
+	r.destinations.remove(dest)
+	delete(r.declared, dest)
+	r.usage.remove(dest)
+	if q, ok := h.(*queue); ok {
+		q.discard()
+	}
+	logger.Noticef("stomp: destination %s deleted", dest)
+	return nil
+}
+
+// isDeclared returns true if the destination was created explicitly. The
+// caller must hold the router lock.
+func (r *router) isDeclared(dest string) bool {
+	_, ok := r.declared[dest]
+	return ok
+}
+
+// CreateDestination creates the destination on the named virtual host,
+// or the default host if empty. Destinations created explicitly are not
+// deleted when idle or when the last subscriber leaves.
+func (s *Server) CreateDestination(host, dest string) error {
+	r := s.lookup([]byte(host))
+	if r == nil {
+		return ErrUnknownHost
+	}
+	return r.declare(dest)
+}
+
+// DeleteDestination deletes the destination on the named virtual host,
+// or the default host if empty, discarding queued messages.
+func (s *Server) DeleteDestination(host, dest string) error {
+	r := s.lookup([]byte(host))
+	if r == nil {
+		return ErrUnknownHost
+	}
+	return r.undeclare(dest)
+}
+
+// handleDestLifecycle creates or deletes the destination query parameter.
+// It requires admin authentication.
+func (s *Server) handleDestLifecycle(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	host, dest := r.FormValue("host"), r.FormValue("destination")
+
+	var err error
+	if r.Method == "DELETE" {
+		err = s.DeleteDestination(host, dest)
+	} else {
+		err = s.CreateDestination(host, dest)
+	}
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errNoDestination, ErrUnknownHost:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrDestinationInUse:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestExplicitDestinations(t *testing.T) {
+	s := NewServer(WithExplicitDestinations())
+	router := s.router
+
+	_, server := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = server
+
+	msg := stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	if err := router.publish(msg); err != errNoDestination {
+		t.Errorf("Expect publish rejected before the destination is created, got %v", err)
+	}
+	sub := stomp.NewMessage()
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/queue/test")
+	if err := router.subscribe(sess, sub); err != errNoDestination {
+		t.Errorf("Expect subscribe rejected before the destination is created, got %v", err)
+	}
+
+	if err := s.CreateDestination("", "/queue/test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.subscribe(sess, sub); err != nil {
+		t.Errorf("Expect subscribe accepted, got %v", err)
+	}
+	router.Lock()
+	router.sessions[sess] = struct{}{}
+	router.Unlock()
+	if err := s.DeleteDestination("", "/queue/test"); err != ErrDestinationInUse {
+		t.Errorf("Expect ErrDestinationInUse, got %v", err)
+	}
+
+	// declared destinations are not recycled when the last subscriber
+	// leaves.
+	unsub := stomp.NewMessage()
+	unsub.ID = []byte("1")
+	router.unsubscribe(sess, unsub)
+	if _, ok := router.destinations.load("/queue/test"); !ok {
+		t.Errorf("Expect declared destination retained")
+	}
+
+	if err := s.DeleteDestination("", "/queue/test"); err != nil {
+		t.Errorf("Expect destination deleted, got %v", err)
+	}
+	if _, ok := router.destinations.load("/queue/test"); ok {
+		t.Errorf("Expect destination removed")
+	}
+	if err := s.CreateDestination("", "/invalid"); err != errInvalidDestination {
+		t.Errorf("Expect errInvalidDestination, got %v", err)
+	}
+}
+
+func TestHandleDestLifecycle(t *testing.T) {
+	s := NewServer()
+
+	w := httptest.NewRecorder()
+	s.HandleDests(w, httptest.NewRequest("POST", "/meta/destinations?destination=/topic/test", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Want create rejected without the admin header, got %d", w.Code)
+	}
+	if s.router.isDeclared("/topic/test") {
+		t.Errorf("Want destination not declared")
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleDests(w, adminRequest("POST", "/meta/destinations?destination=/topic/test"))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Want status 204, got %d", w.Code)
+	}
+	if !s.router.isDeclared("/topic/test") {
+		t.Errorf("Want destination declared")
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleDests(w, adminRequest("DELETE", "/meta/destinations?destination=/topic/test"))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Want status 204, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleDests(w, adminRequest("DELETE", "/meta/destinations?destination=/topic/test"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Want status 404, got %d", w.Code)
+	}
+}
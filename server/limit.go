@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a message exceeds the configured rate
+// limit and the limit is configured to reject messages.
+var ErrRateLimited = errors.New("stomp: rate limit exceeded")
+
+// Limit defines message rate limits. A zero value for Messages or Bytes
+// disables the respective limit.
+type Limit struct {
+	Messages float64 `json:"messages"` // messages per second
+	Bytes    float64 `json:"bytes"`    // bytes per second
+	Reject   bool    `json:"reject"`   // reject instead of apply backpressure
+}
+
+// limiter is a token bucket rate limiter for messages and bytes. The
+// bucket holds up to one second of tokens.
+type limiter struct {
+	mu    sync.Mutex
+	limit Limit
+	msgs  float64
+	bytes float64
+	last  time.Time
+}
+
+func newLimiter(limit Limit) *limiter {
+	return &limiter{
+		limit: limit,
+		msgs:  limit.Messages,
+		bytes: limit.Bytes,
+		last:  time.Now(),
+	}
+}
+
+// set updates the limits.
+func (l *limiter) set(limit Limit) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+}
+
+// get returns the limits.
+func (l *limiter) get() (limit Limit) {
+	l.mu.Lock()
+	limit = l.limit
+	l.mu.Unlock()
+	return
+}
+
+// reserve consumes tokens for a message of size n and returns the
+// duration the caller must wait before sending. If the limit is
+// configured to reject messages no tokens are consumed and an error
+// is returned when the caller would need to wait.
+func (l *limiter) reserve(n int) (time.Duration, error) {
+	wait, reject := l.check(n)
+	if wait > 0 && reject {
+		return 0, ErrRateLimited
+	}
+	l.take(n)
+	return wait, nil
+}
+
+// check refills the bucket and returns the duration the caller must
+// wait before sending a message of size n, without consuming tokens,
+// and whether the limit rejects messages instead.
+func (l *limiter) check(n int) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+
+	var wait float64
+	if rate := l.limit.Messages; rate > 0 {
+		l.msgs = refill(l.msgs, rate, elapsed)
+		if l.msgs < 1 {
+			wait = (1 - l.msgs) / rate
+		}
+	}
+	if rate := l.limit.Bytes; rate > 0 {
+		l.bytes = refill(l.bytes, rate, elapsed)
+		if need := float64(n); l.bytes < need {
+			if w := (need - l.bytes) / rate; w > wait {
+				wait = w
+			}
+		}
+	}
+	return time.Duration(wait * float64(time.Second)), l.limit.Reject
+}
+
+// take consumes the tokens of a message of size n.
+func (l *limiter) take(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit.Messages > 0 {
+		l.msgs--
+	}
+	if l.limit.Bytes > 0 {
+		l.bytes -= float64(n)
+	}
+}
+
+// helper function to refill the token bucket, capped at the
+// one second burst size.
+func refill(tokens, rate, elapsed float64) float64 {
+	tokens += rate * elapsed
+	if tokens > rate {
+		tokens = rate
+	}
+	return tokens
+}
+
+// HandleLimits reads and writes the rate limits. A GET request writes a
+// JSON-encoded map of destination rate limits to the http.Request. A POST
+// request updates the rate limit for the destination query parameter, or
+// the per-session rate limit when the destination is omitted. A DELETE
+// request removes the rate limit. POST, PUT and DELETE requests require
+// admin authentication.
+func (s *Server) HandleLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "PUT", "DELETE":
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+	}
+	router := s.lookup([]byte(r.FormValue("host")))
+	if router == nil {
+		http.Error(w, ErrUnknownHost.Error(), http.StatusNotFound)
+		return
+	}
+	dest := r.FormValue("destination")
+
+	switch r.Method {
+	case "GET":
+		dests, session := router.rateLimits()
+		json.NewEncoder(w).Encode(struct {
+			Session      *Limit           `json:"session,omitempty"`
+			Destinations map[string]Limit `json:"destinations"`
+		}{session, dests})
+	case "POST", "PUT":
+		limit := Limit{}
+		if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		router.setRateLimit(dest, &limit)
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		router.setRateLimit(dest, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
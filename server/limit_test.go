@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func Test_limiter_reserve(t *testing.T) {
+	l := newLimiter(Limit{Messages: 2})
+
+	for i := 0; i < 2; i++ {
+		if wait, err := l.reserve(0); err != nil || wait != 0 {
+			t.Errorf("expect message %d within burst allowed", i)
+		}
+	}
+	if wait, err := l.reserve(0); err != nil || wait == 0 {
+		t.Errorf("expect backpressure when message rate exceeded")
+	}
+}
+
+func Test_limiter_reject(t *testing.T) {
+	l := newLimiter(Limit{Bytes: 10, Reject: true})
+
+	if _, err := l.reserve(8); err != nil {
+		t.Errorf("expect message within byte limit allowed")
+	}
+	if _, err := l.reserve(8); err != ErrRateLimited {
+		t.Errorf("expect message rejected when byte rate exceeded")
+	}
+
+	l.set(Limit{})
+	if _, err := l.reserve(8); err != nil {
+		t.Errorf("expect message allowed when limit removed")
+	}
+}
+
+func Test_router_throttle(t *testing.T) {
+	r := newRouter()
+	r.setRateLimit("/queue/test", &Limit{Messages: 1, Reject: true})
+
+	sess := requestSession()
+	defer sess.release()
+
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/test")
+	defer m.Release()
+
+	if _, err := r.throttle(sess, m); err != nil {
+		t.Errorf("expect first message allowed")
+	}
+	if _, err := r.throttle(sess, m); err != ErrRateLimited {
+		t.Errorf("expect second message rejected")
+	}
+
+	dests, _ := r.rateLimits()
+	if dests["/queue/test"].Messages != 1 {
+		t.Errorf("expect destination rate limit listed")
+	}
+
+	r.setRateLimit("/queue/test", nil)
+	if _, err := r.throttle(sess, m); err != nil {
+		t.Errorf("expect message allowed after limit removed")
+	}
+}
+
+func Test_router_throttle_spend(t *testing.T) {
+	r := newRouter()
+	r.setRateLimit("/queue/test", &Limit{Messages: 1, Reject: true})
+
+	sess := requestSession()
+	defer sess.release()
+	sess.limiter = newLimiter(Limit{Messages: 2, Reject: true})
+
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/test")
+	defer m.Release()
+
+	r.throttle(sess, m)
+	if _, err := r.throttle(sess, m); err != ErrRateLimited {
+		t.Fatalf("expect destination limit exceeded")
+	}
+	// the rejected message spent no session tokens.
+	m.Dest = []byte("/queue/other")
+	if _, err := r.throttle(sess, m); err != nil {
+		t.Errorf("expect session tokens left, got %s", err)
+	}
+}
+
+func Test_router_throttle_backpressure(t *testing.T) {
+	r := newRouter()
+	r.setRateLimit("/queue/test", &Limit{Messages: 1})
+
+	sess := requestSession()
+	defer sess.release()
+
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/test")
+	defer m.Release()
+
+	r.throttle(sess, m)
+	if wait, err := r.throttle(sess, m); err != nil || wait == 0 {
+		t.Errorf("expect session paused, got %s, %v", wait, err)
+	}
+}
+
+func TestRateLimitVirtualHost(t *testing.T) {
+	s := NewServer(
+		WithVirtualHost("tenant", nil),
+		WithRateLimit("/queue/test", Limit{Messages: 1}),
+		WithSessionRateLimit(Limit{Messages: 5}),
+	)
+	dests, session := s.lookup([]byte("tenant")).rateLimits()
+	if dests["/queue/test"].Messages != 1 || session == nil {
+		t.Errorf("expect rate limits applied to the virtual host")
+	}
+	if s.lookup([]byte("tenant")).limits["/queue/test"] == s.router.limits["/queue/test"] {
+		t.Errorf("expect virtual host limited independently")
+	}
+}
+
+func TestHandleLimits(t *testing.T) {
+	s := NewServer()
+	body := `{"messages": 10}`
+	w := httptest.NewRecorder()
+	s.HandleLimits(w, httptest.NewRequest("POST", "/meta/limits?destination=/queue/test", strings.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expect rate limit rejected without the admin header, got %d", w.Code)
+	}
+	if dests, _ := s.router.rateLimits(); len(dests) != 0 {
+		t.Errorf("expect rate limit not set, got %v", dests)
+	}
+
+	r := httptest.NewRequest("POST", "/meta/limits?destination=/queue/test", strings.NewReader(body))
+	r.Header.Set(HeaderAdminRequest, "1")
+	w = httptest.NewRecorder()
+	s.HandleLimits(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expect rate limit set, got %d", w.Code)
+	}
+	if dests, _ := s.router.rateLimits(); dests["/queue/test"].Messages != 10 {
+		t.Errorf("expect rate limit for the destination, got %v", dests)
+	}
+}
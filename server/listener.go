@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+)
+
+// ListenerOption configures a listener served by Serve.
+type ListenerOption func(*listenerOptions)
+
+type listenerOptions struct {
+	tls      *tls.Config
+	maxConns int
+}
+
+// WithListenerTLS returns a ListenerOption which serves TLS on the
+// listener using the configuration.
+func WithListenerTLS(config *tls.Config) ListenerOption {
+	return func(o *listenerOptions) {
+		o.tls = config
+	}
+}
+
+// WithMaxConnections returns a ListenerOption which limits the open
+// connections of the listener. Connections accepted beyond the limit
+// are closed.
+func WithMaxConnections(n int) ListenerOption {
+	return func(o *listenerOptions) {
+		o.maxConns = n
+	}
+}
+
+// Serve accepts connections on the listener, serving each connection
+// in its own goroutine, until the listener fails or is closed. A server
+// may serve several listeners concurrently, such as tcp, tls and unix
+// listeners, which share the destinations and sessions of the server.
+func (s *Server) Serve(l net.Listener, options ...ListenerOption) error {
+	var o listenerOptions
+	for _, option := range options {
+		option(&o)
+	}
+	if o.maxConns > 0 {
+		l = LimitListener(l, o.maxConns)
+	}
+	if o.tls != nil {
+		l = tls.NewListener(l, o.tls)
+	}
+	defer l.Close()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logger.Warningf("stomp: accept: %s; retrying in %s", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		delay = 0
+		go s.ServeConn(conn)
+	}
+}
+
+// ListenAndServe listens on each address and serves the listeners
+// concurrently, returning when any listener fails. An address is either
+// host:port, served as tcp, or a url with the tcp, unix or ws scheme,
+// such as unix:///var/run/mq.sock or ws://:8000/ws. Websocket
+// listeners serve the server on the url path. Listeners requiring
+// other options, such as tls, are served with Serve.
+func (s *Server) ListenAndServe(addrs ...string) error {
+	var (
+		listeners []net.Listener
+		serves    []func() error
+	)
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, addr := range addrs {
+		network, address, route, err := parseListenAddr(addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		l, err := net.Listen(network, address)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, l)
+		if route == "" {
+			serves = append(serves, func() error { return s.Serve(l) })
+			continue
+		}
+		mux := http.NewServeMux()
+		mux.Handle(route, s)
+		serves = append(serves, func() error { return http.Serve(l, mux) })
+	}
+	if len(serves) == 0 {
+		return nil
+	}
+
+	var once sync.Once
+	errc := make(chan error, len(serves))
+	for _, serve := range serves {
+		go func(serve func() error) {
+			err := serve()
+			once.Do(closeAll)
+			errc <- err
+		}(serve)
+	}
+	err := <-errc
+	for range serves[1:] {
+		<-errc
+	}
+	return err
+}
+
+// parseListenAddr returns the network and address of the listen
+// address, and the path of a websocket listener.
+func parseListenAddr(addr string) (network, address, route string, err error) {
+	if !strings.Contains(addr, "://") {
+		return "tcp", addr, "", nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", "", err
+	}
+	switch u.Scheme {
+	case "tcp":
+		return "tcp", u.Host, "", nil
+	case "unix":
+		return "unix", u.Host + u.Path, "", nil
+	case "ws":
+		route = u.Path
+		if route == "" {
+			route = "/"
+		}
+		return "tcp", u.Host, route, nil
+	}
+	return "", "", "", fmt.Errorf("stomp: unsupported listen address %q", addr)
+}
+
+// LimitListener returns a listener accepting at most n simultaneous
+// connections. Connections accepted beyond the limit are closed
+// immediately, rather than waiting in the accept backlog.
+func LimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{Listener: l, sem: make(chan struct{}, n)}
+}
+
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+		default:
+			logger.Noticef("stomp: connection limit reached, closing %s", conn.RemoteAddr())
+			conn.Close()
+		}
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestServeListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix, err := net.Listen("unix", filepath.Join(dir, "mq.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	errc := make(chan error, 2)
+	go func() { errc <- s.Serve(tcp) }()
+	go func() { errc <- s.Serve(unix, WithMaxConnections(1)) }()
+
+	dial := func(network, addr string) *stomp.Client {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := stomp.New(stomp.Conn(conn))
+		if err := client.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	subscriber := dial("unix", unix.Addr().String())
+	received := make(chan *stomp.Message, 1)
+	if _, err := subscriber.Subscribe("/topic/shared", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m.Clone()
+	}), stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	publisher := dial("tcp", tcp.Addr().String())
+	publisher.Send("/topic/shared", []byte("hello"), stomp.WithReceipt())
+	if m := waitMessage(t, received); string(m.Body) != "hello" {
+		t.Errorf("Want message routed between listeners, got %s", m.Body)
+	}
+
+	conn, err := net.Dial("unix", unix.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Want connection beyond the listener limit closed")
+	}
+	conn.Close()
+
+	publisher.Disconnect()
+	subscriber.Disconnect()
+	tcp.Close()
+	unix.Close()
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err == nil {
+			t.Errorf("Want Serve to return the accept error of a closed listener")
+		}
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ll := LimitListener(l, 1)
+
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+	first, err := ll.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	first.Close()
+	// the second connection is closed, and the slot released by the
+	// first connection is taken by the third.
+	third, err := ll.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Close()
+}
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		addr, network, address, route string
+		err                           bool
+	}{
+		{addr: ":9000", network: "tcp", address: ":9000"},
+		{addr: "tcp://127.0.0.1:9000", network: "tcp", address: "127.0.0.1:9000"},
+		{addr: "unix:///var/run/mq.sock", network: "unix", address: "/var/run/mq.sock"},
+		{addr: "ws://:8000", network: "tcp", address: ":8000", route: "/"},
+		{addr: "ws://:8000/ws", network: "tcp", address: ":8000", route: "/ws"},
+		{addr: "udp://:9000", err: true},
+	}
+	for _, test := range tests {
+		network, address, route, err := parseListenAddr(test.addr)
+		if test.err {
+			if err == nil {
+				t.Errorf("Want error parsing %s", test.addr)
+			}
+			continue
+		}
+		if err != nil || network != test.network || address != test.address || route != test.route {
+			t.Errorf("Want %s parsed as %s %s %s, got %s %s %s %v", test.addr,
+				test.network, test.address, test.route, network, address, route, err)
+		}
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer()
+	sock := filepath.Join(dir, "mq.sock")
+	if err := s.ListenAndServe("unix://"+sock, "udp://:9000"); err == nil {
+		t.Errorf("Want error for unsupported listen address")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("Want listeners closed when a listen address fails")
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"sync/atomic"
+)
+
+// ErrOverloaded is returned when the server is under memory pressure and
+// rejects messages sent to non-critical destinations.
+var ErrOverloaded = errors.New("stomp: server overloaded")
+
+// retryAfter is the number of seconds a client is asked to wait before
+// retrying a message rejected due to server overload.
+var retryAfter = "1"
+
+// memory tracks the number of bytes held by queued messages.
+type memory struct {
+	used  int64 // accessed atomically
+	limit int64 // accessed atomically
+}
+
+// alloc records n bytes held by the broker.
+func (m *memory) alloc(n int) {
+	if m != nil {
+		atomic.AddInt64(&m.used, int64(n))
+	}
+}
+
+// free records n bytes released by the broker.
+func (m *memory) free(n int) {
+	if m != nil {
+		atomic.AddInt64(&m.used, -int64(n))
+	}
+}
+
+// usage returns the number of bytes held by the broker.
+func (m *memory) usage() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.used)
+}
+
+// pressure returns true if the bytes held by the broker exceed the
+// configured memory limit.
+func (m *memory) pressure() bool {
+	if m == nil {
+		return false
+	}
+	limit := atomic.LoadInt64(&m.limit)
+	return limit > 0 && m.usage() >= limit
+}
+
+// admit returns an error if the server is under memory pressure and the
+// message destination is not tagged as critical.
+func (r *router) admit(dest []byte) error {
+	if !r.mem.pressure() {
+		return nil
+	}
+	r.RLock()
+	defer r.RUnlock()
+	for _, pattern := range r.critical {
+		if ok, _ := path.Match(pattern, string(dest)); ok {
+			return nil
+		}
+	}
+	return ErrOverloaded
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func Test_memory_pressure(t *testing.T) {
+	m := &memory{limit: 10}
+	m.alloc(5)
+	if m.pressure() {
+		t.Errorf("expect no memory pressure below limit")
+	}
+	m.alloc(5)
+	if !m.pressure() {
+		t.Errorf("expect memory pressure at limit")
+	}
+	m.free(5)
+	if m.pressure() {
+		t.Errorf("expect memory pressure relieved after free")
+	}
+
+	var none *memory
+	none.alloc(5)
+	if none.pressure() {
+		t.Errorf("expect no memory pressure when accounting disabled")
+	}
+}
+
+func Test_router_admit(t *testing.T) {
+	s := NewServer(
+		WithMemoryLimit(5),
+		WithCriticalDestinations("/queue/critical.*"),
+	)
+	r := s.router
+
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/test")
+	m.Body = []byte("hello")
+	defer m.Release()
+	r.publish(m)
+
+	if got := r.mem.usage(); got != 5 {
+		t.Errorf("expect queued message accounted, got %d bytes", got)
+	}
+	if err := r.admit([]byte("/queue/test")); err != ErrOverloaded {
+		t.Errorf("expect non-critical destination rejected under pressure")
+	}
+	if err := r.admit([]byte("/queue/critical.orders")); err != nil {
+		t.Errorf("expect critical destination admitted under pressure")
+	}
+}
+
+func Test_router_admit_virtual_host(t *testing.T) {
+	s := NewServer(
+		WithVirtualHost("tenant", nil),
+		WithMemoryLimit(1),
+		WithCriticalDestinations("/queue/critical.*"),
+	)
+	r := s.lookup([]byte("tenant"))
+	r.mem.alloc(1)
+	defer r.mem.free(1)
+
+	if err := r.admit([]byte("/queue/test")); err != ErrOverloaded {
+		t.Errorf("expect non-critical destination rejected under pressure")
+	}
+	if err := r.admit([]byte("/queue/critical.orders")); err != nil {
+		t.Errorf("expect critical destination admitted on the virtual host")
+	}
+}
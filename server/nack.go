@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// deadLetterPrefix is the destination prefix of dead-letter queues. A
+// message rejected from /queue/orders is sent to /queue/dlq/orders.
+var deadLetterPrefix = []byte("/queue/dlq/")
+
+// headerOriginalDest records the destination of a dead-lettered message.
+var headerOriginalDest = []byte("original-destination")
+
+// errDeadLetterLoop is returned when a message rejected from a
+// dead-letter queue would be dead-lettered into the same queue.
+var errDeadLetterLoop = errors.New("stomp: message rejected from a dead-letter queue")
+
+// maxRetryAfter bounds the redelivery delay requested by a nack.
+var maxRetryAfter = time.Hour
+
+// redeliver requeues, delays or dead-letters the negatively acknowledged
+// message according to the requeue and retry-after headers of the nack.
+// A message that cannot be delayed is requeued immediately.
+func (r *router) redeliver(m, nack *stomp.Message) error {
+	if bytes.Equal(nack.Header.Get(stomp.HeaderRequeue), []byte("false")) {
+		return r.deadLetter(m)
+	}
+	if d := retryAfterDelay(nack); d > 0 {
+		err := r.schedule(m, time.Now().Add(d))
+		if err == nil {
+			return nil
+		}
+		logger.Warningf("stomp: nack %s: delay: %s; message requeued",
+			string(m.Dest),
+			err,
+		)
+	}
+	return r.publish(m)
+}
+
+// retryAfterDelay returns the redelivery delay requested by the nack
+// retry-after header, in seconds, up to maxRetryAfter.
+func retryAfterDelay(nack *stomp.Message) time.Duration {
+	v := nack.Header.Get(stomp.HeaderRetryAfter)
+	if len(v) == 0 {
+		return 0
+	}
+	secs, err := strconv.ParseFloat(string(v), 64)
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	if secs >= maxRetryAfter.Seconds() {
+		return maxRetryAfter
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// deadLetter sends the message to the dead-letter queue of its
+// destination. A message rejected from a dead-letter queue, or that
+// cannot be published to the dead-letter queue, is requeued to its
+// destination instead, so that the message is not lost.
+func (r *router) deadLetter(m *stomp.Message) error {
+	if bytes.HasPrefix(m.Dest, deadLetterPrefix) {
+		logger.Noticef("stomp: nack %s: dead-letter message requeued",
+			string(m.Dest),
+		)
+		return r.publish(m)
+	}
+	dest := append([]byte(nil), m.Dest...)
+	m.Header.Add(headerOriginalDest, dest)
+	m.Dest = deadLetterDest(dest)
+	err := r.publish(m)
+	if err != nil {
+		logger.Warningf("stomp: nack %s: dead-letter: %s; message requeued",
+			string(dest),
+			err,
+		)
+		m.Header.Del(headerOriginalDest)
+		m.Dest = dest
+		return r.publish(m)
+	}
+	logger.Noticef("stomp: nack %s: message dead-lettered",
+		string(dest),
+	)
+	return nil
+}
+
+// reject sends a message that cannot be delivered to the dead-letter
+// queue of its destination. Unlike deadLetter, the message is never
+// published back to its destination, which would deliver it again, so
+// a message rejected from a dead-letter queue, or that cannot be
+// published to one, is returned as an error and left to the caller.
+func (r *router) reject(m *stomp.Message) error {
+	if bytes.HasPrefix(m.Dest, deadLetterPrefix) {
+		return errDeadLetterLoop
+	}
+	dest := append([]byte(nil), m.Dest...)
+	m.Header.Add(headerOriginalDest, dest)
+	m.Dest = deadLetterDest(dest)
+	if err := r.publish(m); err != nil {
+		m.Header.Del(headerOriginalDest)
+		m.Dest = dest
+		return err
+	}
+	logger.Noticef("stomp: message to %s dead-lettered",
+		string(dest),
+	)
+	return nil
+}
+
+// deadLetterDest returns the dead-letter queue for the destination.
+func deadLetterDest(dest []byte) []byte {
+	name := dest
+	switch {
+	case bytes.HasPrefix(dest, routeQueue):
+		name = dest[len(routeQueue):]
+	case bytes.HasPrefix(dest, routeTopic):
+		name = dest[len(routeTopic):]
+	}
+	return append(append([]byte(nil), deadLetterPrefix...), name...)
+}
@@ -1,5 +1,12 @@
 package server
 
+import (
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
 // Option configures server options.
 type Option func(*Server)
 
@@ -11,8 +18,443 @@ func WithAuth(auth Authorizer) Option {
 	}
 }
 
+// WithJWT returns an Option which authenticates connections with JSON
+// web tokens instead of the authorizer.
+func WithJWT(opts JWTOptions) Option {
+	return func(s *Server) {
+		s.router.jwt = newJWTVerifier(opts)
+	}
+}
+
+// WithClientCerts returns an Option which authenticates connections by
+// their verified TLS client certificate, mapped to a broker identity by
+// the authorizer, instead of the authorizer and JWT authentication.
+// Connections without a client certificate are rejected. The TLS
+// listener must request and verify client certificates.
+func WithClientCerts(auth CertAuthorizer) Option {
+	return func(s *Server) {
+		s.router.certs = auth
+	}
+}
+
 // WithCredentials returns an Option which configures basic authorization
 // using the given username and password
 func WithCredentials(username, password string) Option {
 	return WithAuth(BasicAuth(username, password))
 }
+
+// WithVirtualHost returns an Option which configures a virtual host with
+// its own destination namespace. Clients select the virtual host using the
+// host header when connecting. If auth is non-nil it is used to authorize
+// connections to the virtual host instead of the server authentication.
+// The virtual host copies the configuration of the default host once all
+// options are applied, regardless of their order.
+func WithVirtualHost(host string, auth Authorizer) Option {
+	return func(s *Server) {
+		s.vhosts = append(s.vhosts, virtualHost{host, auth})
+	}
+}
+
+// virtualHost is a virtual host configured by WithVirtualHost.
+type virtualHost struct {
+	host string
+	auth Authorizer
+}
+
+// addHost creates the router of the virtual host with a copy of the
+// configuration of the default router. A virtual host without its own
+// authorizer uses the authentication of the default host. Rate limits,
+// sample policies, the dedup window and the replication stream apply to
+// each host separately, and the datastore is opened for every host by
+// loadDatastore.
+func (s *Server) addHost(host string, auth Authorizer) {
+	r := newRouter()
+	r.host = host
+	r.routerConfig = s.router.routerConfig
+	if auth != nil {
+		r.authorizer = auth
+		r.jwt = nil
+		r.certs = nil
+	}
+	r.transforms = append([]transform(nil), s.router.transforms...)
+	r.critical = append([]string(nil), s.router.critical...)
+	r.compacted = append([]string(nil), s.router.compacted...)
+	r.defaults = append([]subscriptionDefaults(nil), s.router.defaults...)
+
+	r.destinations = newDestMap(len(s.router.destinations.shards))
+	r.wheel.limit = s.router.wheel.limit
+	for dest, l := range s.router.limits {
+		r.limits[dest] = newLimiter(l.get())
+	}
+	for dest, policy := range s.router.samplePolicies() {
+		r.setSamplePolicy(dest, &policy)
+	}
+	if d := s.router.dedup; d != nil {
+		r.dedup = newDedupCache(d.window, d.size)
+	}
+	if rs := s.router.replicas; rs != nil {
+		r.replicas = newReplicaSet(rs.users()...)
+	}
+	s.hosts[host] = r
+}
+
+// WithRateLimit returns an Option which configures a rate limit for the
+// named destination.
+func WithRateLimit(dest string, limit Limit) Option {
+	return func(s *Server) {
+		s.router.setRateLimit(dest, &limit)
+	}
+}
+
+// WithSessionRateLimit returns an Option which configures a rate limit
+// applied to messages sent by each session.
+func WithSessionRateLimit(limit Limit) Option {
+	return func(s *Server) {
+		s.router.setRateLimit("", &limit)
+	}
+}
+
+// WithQuota returns an Option which configures the quota of each
+// session.
+func WithQuota(quota Quota) Option {
+	return func(s *Server) {
+		s.router.quota = quota
+	}
+}
+
+// WithUserQuota returns an Option which configures the quota of the
+// sessions of the authenticated user. Non-zero values replace those of
+// the session quota.
+func WithUserQuota(username string, quota Quota) Option {
+	return func(s *Server) {
+		s.router.userQuotas[username] = quota
+	}
+}
+
+// WithMemoryLimit returns an Option which configures the number of bytes
+// queued messages may hold before the server sheds load by rejecting
+// messages sent to non-critical destinations.
+func WithMemoryLimit(limit int64) Option {
+	return func(s *Server) {
+		s.router.mem.limit = limit
+	}
+}
+
+// WithScheduleLimits returns an Option which bounds the delay of
+// scheduled messages and the number of scheduled messages the server
+// holds. Messages exceeding either limit are rejected. A zero limit
+// removes the bound.
+func WithScheduleLimits(maxDelay time.Duration, maxMessages int) Option {
+	return func(s *Server) {
+		s.router.maxDelay = maxDelay
+		s.router.wheel.limit = maxMessages
+	}
+}
+
+// WithOverflow returns an Option which spills the backlog of queues
+// holding more than limit messages in memory to segment files in dir,
+// so a slow consumer cannot exhaust broker memory. Spilled messages are
+// paged back into memory as consumers catch up. The segments are not
+// recovered after a restart; use WithStore for durable messages.
+func WithOverflow(dir string, limit int) Option {
+	return func(s *Server) {
+		p := s.overflowPolicy()
+		p.dir = dir
+		p.limit = limit
+	}
+}
+
+// WithQueueMemory returns an Option which bounds the bytes each queue
+// holds in memory. Messages published beyond the bound are spilled to
+// temporary segment files, in the directory configured by WithOverflow
+// or the default temporary directory, and reloaded as the queue drains.
+func WithQueueMemory(limit int) Option {
+	return func(s *Server) {
+		s.overflowPolicy().bytes = limit
+	}
+}
+
+// WithCriticalDestinations returns an Option which tags destinations
+// matching the given patterns as critical. Messages sent to critical
+// destinations are accepted when the server is under memory pressure.
+func WithCriticalDestinations(patterns ...string) Option {
+	return func(s *Server) {
+		s.router.critical = append(s.router.critical, patterns...)
+	}
+}
+
+// WithTransform returns an Option which configures a chain of
+// transformers applied to messages sent by producers to destinations
+// matching the pattern, before the messages are delivered. Chains of
+// matching patterns are applied in the order they are configured.
+func WithTransform(pattern string, chain ...Transformer) Option {
+	return func(s *Server) {
+		s.router.transforms = append(s.router.transforms, transform{
+			pattern: pattern,
+			chain:   chain,
+		})
+	}
+}
+
+// WithCompaction returns an Option which compacts destinations matching
+// the patterns by the key header. The message log and the messages
+// retained with retain:all keep only the latest message for each key.
+func WithCompaction(patterns ...string) Option {
+	return func(s *Server) {
+		s.router.compacted = append(s.router.compacted, patterns...)
+	}
+}
+
+// WithSubscriptionDefaults returns an Option which configures default
+// subscription settings for destinations matching the pattern.
+func WithSubscriptionDefaults(pattern string, defaults SubscriptionDefaults) Option {
+	return func(s *Server) {
+		s.router.defaults = append(s.router.defaults,
+			subscriptionDefaults{pattern, defaults},
+		)
+	}
+}
+
+// WithClientVersions returns an Option which configures the minimum
+// supported client library version and the client library versions known
+// to be incompatible with the server. A warning is logged when a client
+// with an outdated or incompatible version connects.
+func WithClientVersions(minimum string, incompatible ...string) Option {
+	return func(s *Server) {
+		p := &versionPolicy{
+			minimum:      minimum,
+			incompatible: make(map[string]struct{}),
+		}
+		for _, version := range incompatible {
+			p.incompatible[version] = struct{}{}
+		}
+		for _, r := range s.routers() {
+			r.versions = p
+		}
+	}
+}
+
+// WithCopyOnDeliver returns an Option which configures the server to
+// deliver a deep copy of each message to every subscriber, so that
+// subscribers never share message buffers.
+func WithCopyOnDeliver() Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.clone = true
+		}
+	}
+}
+
+// WithSequencing returns an Option which configures the server to stamp
+// each message with a monotonically increasing per-destination sequence
+// header. Queued messages are delivered in sequence order, including
+// messages redelivered after a negative acknowledgement or disconnect.
+func WithSequencing() Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.sequence = true
+		}
+	}
+}
+
+// WithSampling returns an Option which configures the server to log a
+// sampled subset of messages sent to the named destination.
+func WithSampling(dest string, policy SamplePolicy) Option {
+	return func(s *Server) {
+		if err := s.router.setSamplePolicy(dest, &policy); err != nil {
+			logger.Warningf("stomp: invalid sample policy for %s: %s", dest, err)
+		}
+	}
+}
+
+// WithAffinity returns an Option which configures the node name issued
+// as the session affinity token. The token is set as a cookie in the
+// websocket handshake and reported to clients when connecting, so that
+// load balancers can route reconnections to the same node.
+func WithAffinity(node string) Option {
+	return func(s *Server) {
+		s.router.affinity = []byte(node)
+	}
+}
+
+// WithStore returns an Option which persists messages sent to queues
+// with the persist header, or with the fsync ack level, to the datastore
+// at path. Persisted messages are restored when the server starts.
+// Persisted messages sent to queues and topics are also logged, and
+// subscriptions with the replay-from header receive the logged messages
+// before live messages.
+func WithStore(path string) Option {
+	return func(s *Server) {
+		s.store = path
+	}
+}
+
+// WithReplication returns an Option which streams queue state to standby
+// nodes. Replication is asynchronous unless messages are sent with the
+// majority ack level, in which case the receipt is sent once a majority
+// of the cluster holds the message. Only sessions authenticated as one
+// of the standby users may subscribe to the replication stream.
+func WithReplication(standbys ...string) Option {
+	return func(s *Server) {
+		s.router.replicas = newReplicaSet(standbys...)
+	}
+}
+
+// WithStandby returns an Option which runs the server as a warm standby
+// of the primary at the target address. The standby replicates queue
+// state from the primary and rejects client connections until promoted.
+// If failover is non-zero the standby promotes itself once the primary
+// is unreachable for longer than the failover duration. The options are
+// used to connect to the primary.
+func WithStandby(target string, failover time.Duration, opts ...stomp.MessageOption) Option {
+	return func(s *Server) {
+		s.standby = newStandby(target, failover, s.router, opts)
+		s.router.standby = s.standby
+	}
+}
+
+// WithReadOnly returns an Option which runs the server as a read-only
+// replica that accepts subscriptions and acknowledgements but rejects
+// messages sent by clients. Rejected messages receive an error with a
+// redirect header set to the primary address, if not empty. When used
+// with WithStandby the replica accepts client connections and
+// subscriptions while replicating from the primary, but delivers no
+// replicated messages until promoted, so that a message is not
+// delivered by both nodes.
+func WithReadOnly(primary string) Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.readOnly = []byte(primary)
+		}
+	}
+}
+
+// WithIdleTimeout returns an Option which deletes destinations without
+// subscribers that have no activity for longer than the timeout.
+// Messages held by deleted queues are discarded.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.idle = timeout
+		}
+	}
+}
+
+// WithSessionIdleTimeout returns an Option which closes sessions that
+// send no frames or heart-beats for longer than the timeout, such as
+// connections leaked by clients.
+func WithSessionIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.sessionIdle = timeout
+		}
+	}
+}
+
+// WithDeduplication returns an Option which drops messages sent with a
+// dedup-id header already seen for the destination within the window.
+// Up to size ids are remembered per virtual host, or 100000 if size is
+// zero.
+func WithDeduplication(window time.Duration, size int) Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.dedup = newDedupCache(window, size)
+		}
+	}
+}
+
+// WithSlowConsumerPolicy returns an Option which applies the policy to
+// sessions with more than limit messages awaiting an ack or waiting to
+// be written to the connection for longer than the window, preventing a
+// client that does not keep up from buffering the server out of memory.
+func WithSlowConsumerPolicy(limit int, window time.Duration, policy SlowConsumerPolicy) Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.slow = &slowPolicy{
+				limit:  limit,
+				window: window,
+				policy: policy,
+			}
+		}
+	}
+}
+
+// WithShards returns an Option which spreads destinations across n
+// locks, so that publishes to different destinations do not contend.
+// The default is 32 shards.
+func WithShards(n int) Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.destinations = r.destinations.resize(n)
+		}
+	}
+}
+
+// WithResumption returns an Option which issues a session token to each
+// client. When a session ends without a DISCONNECT its subscriptions and
+// unacknowledged messages are held for the timeout, and a client that
+// reconnects with the token resumes the session.
+func WithResumption(timeout time.Duration) Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.resume = timeout
+		}
+	}
+}
+
+// WithFeatures returns an Option which enables the named experimental
+// features. Unknown feature names are logged and ignored.
+func WithFeatures(names ...string) Option {
+	return func(s *Server) {
+		for _, name := range names {
+			if err := s.features.set(name, true); err != nil {
+				logger.Warningf("stomp: cannot enable feature %s: %s", name, err)
+			}
+		}
+	}
+}
+
+// WithExplicitDestinations returns an Option which requires destinations
+// to be created explicitly, using the admin API, before clients may send
+// or subscribe to them. By default destinations are created on first
+// use. Dead-letter queues must also be created explicitly.
+func WithExplicitDestinations() Option {
+	return func(s *Server) {
+		for _, r := range s.routers() {
+			r.explicit = true
+		}
+	}
+}
+
+// WithWebhook returns an Option which configures a webhook subscription
+// that POSTs messages sent to the destination to the url.
+func WithWebhook(hook Webhook) Option {
+	return func(s *Server) {
+		s.webhooks.pending = append(s.webhooks.pending, hook)
+	}
+}
+
+// WithCron returns an Option which configures a cron job publishing a
+// message to the destination on a schedule.
+func WithCron(job CronJob) Option {
+	return func(s *Server) {
+		s.crons.pending = append(s.crons.pending, job)
+	}
+}
+
+// WithMaxFrameSize returns an Option which configures the maximum size of
+// frames accepted from and sent to network connections. A client sending
+// a larger frame receives an ERROR frame and is disconnected.
+func WithMaxFrameSize(size int) Option {
+	return func(s *Server) {
+		s.conn.MaxFrameSize = size
+	}
+}
+
+// WithConnConfig returns an Option which configures the buffers and
+// heart-beats of network connections.
+func WithConnConfig(config stomp.ConnConfig) Option {
+	return func(s *Server) {
+		s.conn = config
+	}
+}
@@ -1,7 +1,11 @@
 package server
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/mrwill84/mq/stomp"
 )
@@ -24,3 +28,182 @@ func TestOptions(t *testing.T) {
 		t.Errorf("Expect successful authorization, got error %s", err)
 	}
 }
+
+func TestVirtualHostOption(t *testing.T) {
+	s := NewServer(WithVirtualHost("tenant", BasicAuth("janedoe", "password")))
+
+	r := s.lookup([]byte("tenant"))
+	if r == s.router {
+		t.Errorf("Expect virtual host router distinct from default router")
+	}
+	if r.host != "tenant" {
+		t.Errorf("Expect virtual host name assigned, got %q", r.host)
+	}
+	if r.authorizer == nil {
+		t.Errorf("Expect virtual host authorizer configured")
+	}
+	if s.lookup([]byte("unknown")) != nil {
+		t.Errorf("Expect unknown virtual host rejected")
+	}
+	if s.lookup(nil) != s.router {
+		t.Errorf("Expect empty virtual host uses default router")
+	}
+
+	s = NewServer(WithVirtualHost("tenant", nil), WithCredentials("janedoe", "password"))
+	if s.lookup([]byte("tenant")).authorizer == nil {
+		t.Errorf("Expect virtual host inherits the server authorizer")
+	}
+	if NewServer().lookup([]byte("broker.example.com")) == nil {
+		t.Errorf("Expect host ignored without virtual hosts")
+	}
+}
+
+func TestUnknownVirtualHost(t *testing.T) {
+	s := NewServer(WithVirtualHost("tenant", nil))
+	client := s.Client()
+	defer client.Disconnect()
+	if err := client.Connect(stomp.WithHost("other")); err == nil {
+		t.Errorf("Expect connection to an unknown virtual host rejected")
+	}
+}
+
+func TestVirtualHostConfig(t *testing.T) {
+	s := NewServer(
+		WithVirtualHost("tenant", nil),
+		WithSubscriptionDefaults("/queue/*", SubscriptionDefaults{Selector: SelectorDeny}),
+		WithSampling("/queue/orders", SamplePolicy{Rate: 1}),
+	)
+	client := s.Client()
+	if err := client.Connect(stomp.WithHost("tenant")); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	_, err := client.Subscribe("/queue/orders", nil, stomp.WithSelector("priority > 1"), stomp.WithReceipt())
+	if err == nil {
+		t.Errorf("Expect subscription defaults applied to the virtual host")
+	}
+	if _, ok := s.lookup([]byte("tenant")).samplePolicies()["/queue/orders"]; !ok {
+		t.Errorf("Expect sample policies applied to the virtual host")
+	}
+}
+
+func TestVirtualHostStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer(WithVirtualHost("tenant", nil), WithStore(dir), WithCompaction("/topic/prices/*"))
+	client := s.Client()
+	if err := client.Connect(stomp.WithHost("tenant")); err != nil {
+		t.Fatal(err)
+	}
+	err = client.Send("/queue/test", []byte("hello"), stomp.WithAckLevel(stomp.AckLevelFsync))
+	if err != nil {
+		t.Errorf("Expect receipt for fsync ack level on the virtual host, got error %s", err)
+	}
+	for _, body := range []string{"a1", "a2"} {
+		client.Send("/topic/prices/eur", []byte(body),
+			stomp.WithKey("a"),
+			stomp.WithPersistence(),
+			stomp.WithReceipt(),
+		)
+	}
+	client.Disconnect()
+	s.router.store.close()
+
+	// the persisted messages are restored to the virtual host.
+	s = NewServer(WithVirtualHost("tenant", nil), WithStore(dir), WithCompaction("/topic/prices/*"))
+	defer s.router.store.close()
+	if got := queueLen(s, "/queue/test"); got != 0 {
+		t.Errorf("Expect message of the virtual host not restored to the default host, got %d", got)
+	}
+	h, ok := s.lookup([]byte("tenant")).destinations.load("/queue/test")
+	if !ok {
+		t.Fatalf("Expect persisted queue restored to the virtual host")
+	}
+	if got := h.(*queue).list.Len(); got != 1 {
+		t.Errorf("Expect persisted message restored, got %d messages", got)
+	}
+
+	client = s.Client()
+	if err := client.Connect(stomp.WithHost("tenant")); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	replayed := make(chan *stomp.Message, 10)
+	_, err = client.Subscribe("/topic/prices/eur", stomp.HandlerFunc(func(m *stomp.Message) {
+		replayed <- m.Clone()
+	}), stomp.WithReplayFrom(stomp.ReplayBeginning), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := waitMessage(t, replayed); string(m.Body) != "a2" {
+		t.Errorf("Expect compacted log replayed on the virtual host, got %q", m.Body)
+	}
+	if len(replayed) != 0 {
+		t.Errorf("Expect earlier message with the key compacted, got %d more", len(replayed))
+	}
+}
+
+func TestVirtualHostReplication(t *testing.T) {
+	primary := NewServer(
+		WithVirtualHost("tenant", nil),
+		WithCredentials("standby", "secret"),
+		WithReplication("standby"),
+	)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go primary.ServeConn(conn)
+		}
+	}()
+
+	standby := NewServer(WithVirtualHost("tenant", nil), WithStandby("tcp://"+l.Addr().String(), 0,
+		stomp.WithCredentials("standby", "secret"),
+	))
+	defer standby.Promote()
+
+	tenant := primary.lookup([]byte("tenant"))
+	for i := 0; i < 200 && tenant.replicas.len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tenant.replicas.len() != 1 {
+		t.Fatalf("Expect standby subscribed to the replication stream of the virtual host")
+	}
+
+	producer := primary.Client()
+	if err := producer.Connect(stomp.WithCredentials("standby", "secret"), stomp.WithHost("tenant")); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+	err = producer.Send("/queue/test", []byte("hello"),
+		stomp.WithAckLevel(stomp.AckLevelMajority),
+	)
+	if err != nil {
+		t.Errorf("Expect receipt once the standby holds the message, got error %s", err)
+	}
+	h, ok := standby.lookup([]byte("tenant")).destinations.load("/queue/test")
+	if !ok {
+		t.Fatalf("Expect message replicated to the virtual host of the standby")
+	}
+	q := h.(*queue)
+	q.RLock()
+	if got := q.list.Len(); got != 1 {
+		t.Errorf("Expect message replicated to the virtual host of the standby, got %d", got)
+	}
+	q.RUnlock()
+	if got := queueLen(standby, "/queue/test"); got != 0 {
+		t.Errorf("Expect message not replicated to the default host, got %d", got)
+	}
+}
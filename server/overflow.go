@@ -0,0 +1,279 @@
+package server
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// overflowPage is the maximum number of messages written to each
+// overflow segment. Segments are paged back into memory one at a time.
+var overflowPage = 1000
+
+// overflowPolicy configures disk overflow for deep queues.
+type overflowPolicy struct {
+	dir   string // directory holding the segment files
+	limit int    // messages held in memory before spilling
+	bytes int    // bytes held in memory before spilling
+}
+
+// open returns the overflow for a new queue.
+func (p *overflowPolicy) open() *overflow {
+	if p == nil {
+		return nil
+	}
+	return &overflow{dir: p.dir, limit: p.limit, bytes: p.bytes}
+}
+
+// overflowPolicy returns the overflow policy shared by the routers,
+// creating the policy if not configured.
+func (s *Server) overflowPolicy() *overflowPolicy {
+	if s.router.overflow == nil {
+		p := new(overflowPolicy)
+		for _, r := range s.routers() {
+			r.overflow = p
+		}
+	}
+	return s.router.overflow
+}
+
+// overflow holds the backlog of a queue that exceeds the in-memory
+// thresholds in segment files on disk. Once a queue spills, newly
+// published messages are appended to the segments, preserving order,
+// until the backlog is paged back into memory as consumers catch up.
+// The queue lock must be held when calling overflow methods.
+type overflow struct {
+	dir      string
+	limit    int
+	bytes    int
+	segments []*segment
+	count    int
+}
+
+// spill writes the message to the overflow segments and releases the
+// message. It returns false if the message cannot be written, in which
+// case the message is held in memory.
+func (q *queue) spill(m *stomp.Message) bool {
+	if err := q.overflow.push(m); err != nil {
+		logger.Warningf("stomp: send %s: cannot spill to disk: %s",
+			string(q.dest),
+			err,
+		)
+		return false
+	}
+	m.Release()
+	return true
+}
+
+// pageIn moves the next overflow segment into memory once the queue
+// drains below half the overflow thresholds.
+func (q *queue) pageIn() {
+	for _, m := range q.overflow.fill(q.list.Len(), q.size) {
+		q.list.PushBack(m)
+		q.alloc(m)
+	}
+}
+
+// segment is a file of length-prefixed messages. The file is open
+// while messages are appended, and closed once the segment is full.
+type segment struct {
+	name  string
+	file  *os.File // nil once the segment is full
+	size  int64    // bytes written
+	count int
+}
+
+// spill returns true if the message should be written to disk given the
+// number of messages and bytes held in memory. Messages are spilled
+// while any segment remains on disk so they are delivered in order.
+func (o *overflow) spill(n, size int) bool {
+	return o != nil && (len(o.segments) != 0 ||
+		o.limit > 0 && n >= o.limit ||
+		o.bytes > 0 && size >= o.bytes)
+}
+
+// push appends the message to the last segment.
+func (o *overflow) push(m *stomp.Message) error {
+	var tail *segment
+	if n := len(o.segments); n != 0 {
+		tail = o.segments[n-1]
+	}
+	if tail == nil || tail.file == nil {
+		file, err := ioutil.TempFile(o.dir, "overflow-")
+		if err != nil {
+			return err
+		}
+		tail = &segment{name: file.Name(), file: file}
+		o.segments = append(o.segments, tail)
+	}
+	if err := tail.write(m.Bytes()); err != nil {
+		return err
+	}
+	o.count++
+	if o.full(tail) {
+		return tail.close()
+	}
+	return nil
+}
+
+// full returns true if no more messages are appended to the segment.
+// Segments hold at most half the overflow thresholds, so that paging a
+// segment in, once the queue drains below half the thresholds, keeps the
+// messages held in memory within the thresholds.
+func (o *overflow) full(s *segment) bool {
+	page := overflowPage
+	if o.limit > 0 && o.limit/2 < page {
+		page = o.limit / 2
+	}
+	if page < 1 {
+		page = 1
+	}
+	return s.count >= page ||
+		o.bytes > 0 && s.size >= int64(o.bytes/2)
+}
+
+// fill returns the messages of the first segment once the messages and
+// bytes held in memory drop below half the thresholds, or nil if the
+// messages remain on disk. A segment which cannot be read remains on
+// disk, and is read again when the queue next drains.
+func (o *overflow) fill(n, size int) []*stomp.Message {
+	if o == nil || len(o.segments) == 0 ||
+		o.limit > 0 && n > o.limit/2 ||
+		o.bytes > 0 && size > o.bytes/2 {
+		return nil
+	}
+	name := o.segments[0].name
+	messages, err := o.shift()
+	if err != nil {
+		logger.Warningf("stomp: overflow segment %s: %s", name, err)
+		return nil
+	}
+	return messages
+}
+
+// shift removes the first segment and returns its messages. A segment
+// which cannot be read remains on disk.
+func (o *overflow) shift() ([]*stomp.Message, error) {
+	if o == nil || len(o.segments) == 0 {
+		return nil, nil
+	}
+	head := o.segments[0]
+	messages, err := head.read()
+	if err != nil {
+		return nil, err
+	}
+	o.segments = o.segments[1:]
+	o.count -= head.count
+	head.remove()
+	return messages, nil
+}
+
+// each calls fn with the messages on disk, in order, until fn returns
+// false. The messages remain on disk, and fn owns the copies read.
+func (o *overflow) each(fn func(m *stomp.Message) bool) error {
+	if o == nil {
+		return nil
+	}
+	for _, s := range o.segments {
+		messages, err := s.read()
+		if err != nil {
+			return err
+		}
+		for i, m := range messages {
+			if !fn(m) {
+				for _, m := range messages[i+1:] {
+					m.Release()
+				}
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// len returns the number of messages on disk.
+func (o *overflow) len() int {
+	if o == nil {
+		return 0
+	}
+	return o.count
+}
+
+// discard removes the segments.
+func (o *overflow) discard() {
+	if o == nil {
+		return
+	}
+	for _, s := range o.segments {
+		s.remove()
+	}
+	o.segments = nil
+	o.count = 0
+}
+
+// write appends the length-prefixed message to the segment. If the
+// message cannot be written in full, the segment is truncated to the
+// previous message and the segment is closed.
+func (s *segment) write(data []byte) error {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	if _, err := s.file.Write(buf); err != nil {
+		if terr := s.file.Truncate(s.size); terr != nil {
+			logger.Warningf("stomp: overflow segment %s: %s", s.name, terr)
+		}
+		s.close()
+		return err
+	}
+	s.size += int64(len(buf))
+	s.count++
+	return nil
+}
+
+// close closes the segment file, once no more messages are appended.
+func (s *segment) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// read reads the messages of the segment. Messages which cannot be
+// parsed are skipped.
+func (s *segment) read() ([]*stomp.Message, error) {
+	data, err := ioutil.ReadFile(s.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*stomp.Message
+	for len(data) >= 4 {
+		size := int(binary.BigEndian.Uint32(data))
+		if len(data) < 4+size {
+			break
+		}
+		m := stomp.NewMessage()
+		if err := m.Parse(append([]byte(nil), data[4:4+size]...)); err != nil {
+			logger.Warningf("stomp: overflow segment %s: skipping message: %s", s.name, err)
+			m.Release()
+		} else {
+			messages = append(messages, m)
+		}
+		data = data[4+size:]
+	}
+	if len(data) != 0 {
+		logger.Warningf("stomp: overflow segment %s: %d bytes truncated", s.name, len(data))
+	}
+	return messages, nil
+}
+
+// remove closes and deletes the segment file.
+func (s *segment) remove() {
+	s.close()
+	os.Remove(s.name)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := newQueue([]byte("/queue/test"))
+	q.mem = new(memory)
+	q.overflow = (&overflowPolicy{dir: dir, limit: 4}).open()
+
+	for i := 0; i < 10; i++ {
+		m := stomp.NewMessage()
+		m.Dest = q.dest
+		m.Body = []byte(strconv.Itoa(i))
+		q.publish(m)
+		m.Release()
+	}
+	if got := q.list.Len(); got != 4 {
+		t.Errorf("Want 4 messages held in memory, got %d", got)
+	}
+	if got := q.overflow.len(); got != 6 {
+		t.Errorf("Want 6 messages spilled to disk, got %d", got)
+	}
+	if got := q.mem.usage(); got != 4 {
+		t.Errorf("Want memory usage of messages held in memory, got %d", got)
+	}
+	if q.recycle() {
+		t.Errorf("Want queue with spilled messages retained")
+	}
+
+	peer, client := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = peer
+	defer sess.release()
+
+	sub := stomp.NewMessage()
+	sub.Dest = q.dest
+	defer sub.Release()
+	q.subscribe(sess.subs(sub), sub)
+
+	for i := 0; i < 10; i++ {
+		if i != 0 {
+			q.process()
+		}
+		select {
+		case m := <-client.Receive():
+			if got := string(m.Body); got != strconv.Itoa(i) {
+				t.Errorf("Want message %d delivered in order, got %s", i, got)
+			}
+		default:
+			t.Fatalf("Want message %d delivered", i)
+		}
+	}
+	if q.overflow.len() != 0 {
+		t.Errorf("Want spilled messages paged back into memory")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Want segment files removed, got %d", len(files))
+	}
+}
+
+func TestQueueMemory(t *testing.T) {
+	s := NewServer(WithQueueMemory(10))
+	for i := 0; i < 5; i++ {
+		m := stomp.NewMessage()
+		m.Dest = []byte("/queue/test")
+		m.Body = []byte("data")
+		s.router.publish(m)
+		m.Release()
+	}
+
+	h, _ := s.router.destinations.load("/queue/test")
+	q := h.(*queue)
+	defer q.discard()
+	if q.size != 12 || q.list.Len() != 3 {
+		t.Errorf("Want messages held in memory up to the bound, got %d bytes", q.size)
+	}
+	if q.overflow.len() != 2 {
+		t.Errorf("Want messages beyond the bound spilled, got %d", q.overflow.len())
+	}
+	if q.overflow.dir != "" {
+		t.Errorf("Want segments in the default temporary directory")
+	}
+}
+
+func TestOverflowSegments(t *testing.T) {
+	defer func(page int) { overflowPage = page }(overflowPage)
+	overflowPage = 2
+
+	dir, err := ioutil.TempDir("", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := (&overflowPolicy{dir: dir}).open()
+	for i := 0; i < 5; i++ {
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodSend
+		m.Dest = []byte("/queue/test")
+		m.Body = []byte(strconv.Itoa(i))
+		if err := o.push(m); err != nil {
+			t.Fatal(err)
+		}
+		m.Release()
+	}
+	if len(o.segments) != 3 {
+		t.Fatalf("Want 3 segments, got %d", len(o.segments))
+	}
+	for i, s := range o.segments[:2] {
+		if s.file != nil {
+			t.Errorf("Want full segment %d closed", i)
+		}
+	}
+
+	// a segment which cannot be read remains on disk.
+	name := o.segments[0].name
+	o.segments[0].name = name + ".missing"
+	if messages := o.fill(0, 0); messages != nil || o.len() != 5 {
+		t.Errorf("Want unreadable segment retained, got %d messages and %d on disk", len(messages), o.len())
+	}
+	o.segments[0].name = name
+	if messages := o.fill(0, 0); len(messages) != 2 || o.len() != 3 {
+		t.Errorf("Want segment paged in once readable, got %d messages and %d on disk", len(messages), o.len())
+	}
+	o.discard()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Want segment files removed, got %d", len(files))
+	}
+}
+
+func TestOverflowRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		policy   overflowPolicy
+		segments int
+	}{
+		{overflowPolicy{dir: dir}, 1},
+		{overflowPolicy{dir: dir, limit: 4}, 5},
+		{overflowPolicy{dir: dir, bytes: 200}, 10},
+	}
+	for _, test := range tests {
+		o := test.policy.open()
+		for i := 0; i < 10; i++ {
+			m := stomp.NewMessage()
+			m.Method = stomp.MethodSend
+			m.Dest = []byte("/queue/test")
+			m.Body = make([]byte, 100)
+			if err := o.push(m); err != nil {
+				t.Fatal(err)
+			}
+			m.Release()
+		}
+		if len(o.segments) != test.segments {
+			t.Errorf("%+v: want %d segments, got %d", test.policy, test.segments, len(o.segments))
+		}
+		o.discard()
+	}
+}
+
+func TestOverflowSequence(t *testing.T) {
+	q := newQueue([]byte("/queue/test"))
+	q.mem = new(memory)
+	q.sequence = true
+	q.overflow = (&overflowPolicy{dir: "/nonexistent/overflow", limit: 1}).open()
+
+	for i := 0; i < 3; i++ {
+		m := stomp.NewMessage()
+		m.Dest = q.dest
+		q.publish(m)
+		m.Release()
+	}
+	// messages that cannot be spilled are held in memory, stamped once.
+	seq := 1
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		m := e.Value.(*stomp.Message)
+		if got := string(m.Header.Get(stomp.HeaderSequence)); got != strconv.Itoa(seq) {
+			t.Errorf("Want sequence %d, got %s", seq, got)
+		}
+		seq++
+	}
+	if seq != 4 {
+		t.Errorf("Want 3 messages held in memory, got %d", seq-1)
+	}
+}
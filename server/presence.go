@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// errPresenceSend is returned when a client sends a message to a
+// presence destination, which only the broker publishes to.
+var errPresenceSend = errors.New("stomp: presence destinations are read-only")
+
+// routePresence prefixes the presence destination of a topic. Clients
+// subscribed to /presence/topic/foo are notified when subscribers join
+// or leave /topic/foo.
+var routePresence = []byte("/presence/")
+
+// presence is the JSON body of a presence notification.
+type presence struct {
+	Event        string `json:"event"` // join or leave
+	Destination  string `json:"destination"`
+	Subscription string `json:"subscription"`
+	Session      string `json:"session"`
+	ClientID     string `json:"client_id,omitempty"`
+	User         string `json:"username,omitempty"`
+	Subscribers  int    `json:"subscribers"`
+}
+
+// isPresence returns true if the destination is a presence destination.
+func isPresence(dest []byte) bool {
+	return bytes.HasPrefix(dest, routePresence)
+}
+
+// announce publishes a join or leave notification for the subscription
+// to the presence destination of the topic, if it has subscribers.
+func (r *router) announce(event string, sess *session, dest, subs []byte) {
+	if !bytes.HasPrefix(dest, routeTopic) {
+		return
+	}
+	pdest := append([]byte("/presence"), dest...)
+
+	p, ok := r.destinations.load(string(pdest))
+	h, _ := r.destinations.load(string(dest))
+	if !ok {
+		return
+	}
+
+	notice := presence{
+		Event:        event,
+		Destination:  string(dest),
+		Subscription: string(subs),
+		Session:      sess.peer.Addr(),
+	}
+	if sess.msg != nil {
+		notice.ClientID = string(sess.msg.Header.Get(stomp.HeaderClientID))
+		notice.User = string(sess.msg.User)
+	}
+	if t, ok := h.(*topic); ok {
+		t.RLock()
+		notice.Subscribers = len(t.subs)
+		t.RUnlock()
+	}
+
+	m := stomp.NewMessage()
+	m.Method = stomp.MethodSend
+	m.Dest = pdest
+	m.Body, _ = json.Marshal(notice)
+	m.Header.Add([]byte("content-type"), []byte("application/json"))
+	p.publish(m)
+	m.Release()
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestPresence(t *testing.T) {
+	s := NewServer()
+
+	notices := make(chan presence, 10)
+	watcher := s.Client()
+	if err := watcher.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Disconnect()
+	_, err := watcher.Subscribe("/presence/topic/room", stomp.HandlerFunc(func(m *stomp.Message) {
+		var p presence
+		json.Unmarshal(m.Body, &p)
+		notices <- p
+		m.Release()
+	}), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member := s.Client()
+	if err := member.Connect(stomp.WithCredentials("janedoe", "")); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := member.Subscribe("/topic/room", stomp.HandlerFunc(func(m *stomp.Message) {
+		m.Release()
+	}), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	member.Disconnect()
+
+	for _, want := range []presence{
+		{Event: "join", Subscription: string(sub.ID()), Subscribers: 1},
+		{Event: "leave", Subscription: string(sub.ID()), Subscribers: 0},
+	} {
+		select {
+		case got := <-notices:
+			if got.Event != want.Event || got.Destination != "/topic/room" || got.Subscription != want.Subscription ||
+				got.User != "janedoe" || got.Subscribers != want.Subscribers {
+				t.Errorf("Want %s notification, got %+v", want.Event, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Want %s notification", want.Event)
+		}
+	}
+
+	if err := watcher.Send("/presence/topic/room", []byte("spoof"), stomp.WithReceipt()); err == nil {
+		t.Errorf("Want send to presence destination rejected")
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time a connection may take to send its
+// PROXY protocol header.
+var proxyHeaderTimeout = 10 * time.Second
+
+var errProxyHeader = errors.New("stomp: invalid proxy protocol header")
+
+// errNoTrustedProxies is returned by ProxyListener without trusted
+// networks, since any client could then spoof its address.
+var errNoTrustedProxies = errors.New("stomp: proxy protocol requires a trusted network")
+
+// proxySignature begins a PROXY protocol v2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyListener returns a listener accepting connections which begin
+// with a HAProxy PROXY protocol v1 or v2 header, such as connections
+// from a load balancer. The RemoteAddr of an accepted connection is the
+// client address sent in the header, and the header is consumed before
+// the connection is read. Connections from addresses outside of the
+// trusted networks, in CIDR notation, are served with their own address
+// and may not send a header. At least one network is required.
+func ProxyListener(l net.Listener, trusted ...string) (net.Listener, error) {
+	if len(trusted) == 0 {
+		return nil, errNoTrustedProxies
+	}
+	nets, err := parseNetworks(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyListener{Listener: l, trusted: nets}, nil
+}
+
+// parseNetworks parses the networks in CIDR notation.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("stomp: trusted proxy %q: %s", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// Accept returns the next connection. The header is read on the first
+// read, or the first call to RemoteAddr, so that a slow client does not
+// block accepting other connections.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !l.trust(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReaderSize(conn, 512)}, nil
+}
+
+func (l *proxyListener) trust(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection beginning with a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr // client address, nil for local connections
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address sent in the header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = readProxyHeader(c.r)
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the
+// source address, or nil if the header does not carry one.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxySignature))
+	if err == nil && bytes.Equal(sig, proxySignature) {
+		return readProxyV2(r)
+	}
+	if sig, err := r.Peek(6); err != nil || string(sig) != "PROXY " {
+		return nil, errProxyHeader
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 reads a header such as "PROXY TCP4 src dst sport dport".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the header is at most 107 bytes.
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, errProxyHeader
+	}
+	if head[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errProxyHeader
+	}
+
+	// LOCAL connections, such as health checks, carry no address.
+	if head[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[:4]...)),
+			Port: int(binary.BigEndian.Uint16(body[8:])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), body[:16]...)),
+			Port: int(binary.BigEndian.Uint16(body[32:])),
+		}, nil
+	}
+	return nil, nil
+}
+
+// remoteConn is a connection with the remote address of the http
+// request, as the remote address of a websocket is its origin.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// remoteAddr parses the remote address of an http request.
+func remoteAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return stringAddr(addr)
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestProxyListener(t *testing.T) {
+	v2 := func(cmd, family byte, addr []byte) string {
+		head := append([]byte(nil), proxySignature...)
+		head = append(head, 0x20|cmd, family, 0, 0)
+		binary.BigEndian.PutUint16(head[14:], uint16(len(addr)))
+		return string(append(head, addr...))
+	}
+	ipv4 := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0x23, 0x28}
+	ipv6 := make([]byte, 36)
+	ipv6[0], ipv6[15], ipv6[32], ipv6[33] = 0x20, 1, 0x30, 0x39
+	tlv := append(append([]byte(nil), ipv4...), 4, 0, 1, 'x')
+
+	tests := []struct {
+		header string
+		trust  []string
+		addr   string // want remote address, local address if empty
+		err    bool
+	}{
+		{header: "PROXY TCP4 192.0.2.1 10.0.0.1 12345 9000\r\n", addr: "192.0.2.1:12345"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 9000\r\n", addr: "[2001:db8::1]:12345"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: v2(1, 0x11, ipv4), addr: "192.0.2.1:12345"},
+		{header: v2(1, 0x21, ipv6), addr: "[2000::1]:12345"},
+		{header: v2(1, 0x11, tlv), addr: "192.0.2.1:12345"},
+		{header: v2(0, 0x00, nil)},
+		{header: "PROXY TCP4 192.0.2.1 10.0.0.1 12345\r\n", err: true},
+		{header: "PROXY TCP4 nope 10.0.0.1 12345 9000\r\n", err: true},
+		{header: "CONNECT\n", err: true},
+		{header: v2(1, 0x11, ipv4[:8]), err: true},
+		{header: "", trust: []string{"192.0.2.0/24"}},
+	}
+	for _, test := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trust := test.trust
+		if trust == nil {
+			trust = []string{"127.0.0.0/8"}
+		}
+		pl, err := ProxyListener(l, trust...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte(test.header + "CONNECT\n\n\x00"))
+		client.Close()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := test.addr
+		if want == "" {
+			want = client.LocalAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != want && !test.err {
+			t.Errorf("Want remote address %s for header %q, got %s", want, test.header, got)
+		}
+		b, err := ioutil.ReadAll(conn)
+		if test.err {
+			if err == nil {
+				t.Errorf("Want error for header %q", test.header)
+			}
+		} else if string(b) != "CONNECT\n\n\x00" {
+			t.Errorf("Want header %q consumed, got %q, %v", test.header, b, err)
+		}
+		conn.Close()
+		pl.Close()
+	}
+
+	if _, err := ProxyListener(nil, "10.0.0.1"); err == nil {
+		t.Errorf("Want error for network not in cidr notation")
+	}
+	if _, err := ProxyListener(nil); err != errNoTrustedProxies {
+		t.Errorf("Want error without trusted networks, got %v", err)
+	}
+}
+
+func TestProxySessionAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, _ := ProxyListener(l, "127.0.0.0/8")
+	defer pl.Close()
+
+	s := NewServer()
+	go func() {
+		conn, err := pl.Accept()
+		if err == nil {
+			s.ServeConn(conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 9000\r\n"))
+	client := stomp.New(stomp.Conn(conn))
+	defer client.Disconnect()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.router.RLock()
+	defer s.router.RUnlock()
+	for sess := range s.router.sessions {
+		if addr := sess.peer.Addr(); addr != "192.0.2.1:12345" {
+			t.Errorf("Want session address from proxy header, got %s", addr)
+		}
+		return
+	}
+	t.Errorf("Want session")
+}
@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"container/list"
 	"math/rand"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,25 +15,82 @@ import (
 type queue struct {
 	sync.RWMutex
 
-	dest []byte
-	subs map[*subscription]struct{}
-	list *list.List
+	dest  []byte
+	subs  map[*subscription]struct{}
+	list  *list.List
+	size  int                          // bytes held in memory
+	since map[*stomp.Message]time.Time // time each message was queued
+	mem   *memory
+	store store
+	clone bool // deliver a deep copy to each subscriber
+
+	overflow *overflow // backlog spilled to disk
+
+	replicas *replicaSet // standby nodes
+
+	sequence bool  // stamp messages with a sequence number
+	seq      int64 // last sequence number
+
+	idle *time.Timer // re-processes the queue once an exclusive subscription may have stalled
+
+	features *features // experimental behaviors
 }
 
 func newQueue(dest []byte) *queue {
 	return &queue{
-		dest: dest,
-		subs: make(map[*subscription]struct{}),
-		list: list.New(),
+		dest:  append([]byte(nil), dest...),
+		subs:  make(map[*subscription]struct{}),
+		list:  list.New(),
+		since: make(map[*stomp.Message]time.Time),
 	}
 }
 
 func (q *queue) publish(m *stomp.Message) error {
-	c := m.Copy()
+	return q.publishWait(m, nil)
+}
+
+// publishWait publishes the message once wait, if not nil, returns
+// after the message is streamed to the replicas. If wait fails the
+// message is removed from the store and the replicas and is never
+// visible to subscribers, so that a retrying producer does not create a
+// duplicate.
+func (q *queue) publishWait(m *stomp.Message, wait func() error) error {
+	var c *stomp.Message
+	if q.clone {
+		c = m.Clone()
+	} else {
+		c = m.Copy()
+	}
 	c.ID = stomp.Rand()
 	c.Method = stomp.MethodMessage
+	if q.store != nil && shouldPersist(m) {
+		c.Persist = stomp.PersistTrue
+		if err := q.store.put(c, shouldSync(m)); err != nil {
+			c.Release()
+			return err
+		}
+	}
+	q.replicas.publish(c)
+	if wait != nil {
+		if err := wait(); err != nil {
+			q.replicas.remove(c)
+			if q.store != nil && shouldPersist(m) {
+				q.store.delete(c)
+			}
+			c.Release()
+			return err
+		}
+	}
 	q.Lock()
+	if q.sequence {
+		q.stamp(c)
+	}
+	if q.overflow.spill(q.list.Len(), q.size) && q.spill(c) {
+		q.Unlock()
+		return q.process()
+	}
 	q.list.PushBack(c)
+	q.alloc(c)
 	q.Unlock()
 	return q.process()
 }
@@ -46,7 +106,8 @@ func (q *queue) unsubscribe(s *subscription, m *stomp.Message) error {
 	q.Lock()
 	delete(q.subs, s)
 	q.Unlock()
-	return nil
+	// a standby exclusive subscription may take over.
+	return q.process()
 }
 
 func (q *queue) disconnect(s *session) error {
@@ -55,14 +116,15 @@ func (q *queue) disconnect(s *session) error {
 		delete(q.subs, subscription)
 	}
 	q.Unlock()
-	return nil
+	// a standby exclusive subscription may take over.
+	return q.process()
 }
 
 // returns true if the topic has zero subscribers indicating
 // that it can be recycled.
 func (q *queue) recycle() (ok bool) {
 	q.RLock()
-	ok = len(q.subs) == 0 && q.list.Len() == 0
+	ok = len(q.subs) == 0 && q.list.Len() == 0 && q.overflow.len() == 0
 	q.RUnlock()
 	return
 }
@@ -72,9 +134,39 @@ func (q *queue) destination() string {
 	return string(q.dest)
 }
 
+// stamp stamps the message with the next sequence number of the queue,
+// replacing any sequence number supplied by the producer.
+func (q *queue) stamp(m *stomp.Message) {
+	q.seq++
+	m.Header.Set(stomp.HeaderSequence, strconv.AppendInt(nil, q.seq, 10))
+}
+
+// insert inserts a redelivered or restored message, stamped by the
+// queue, into the list in sequence order.
+func (q *queue) insert(m *stomp.Message) {
+	seq := stomp.ParseInt64(m.Header.Get(stomp.HeaderSequence))
+	if seq > q.seq {
+		q.seq = seq
+	}
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		v := e.Value.(*stomp.Message)
+		if stomp.ParseInt64(v.Header.Get(stomp.HeaderSequence)) > seq {
+			q.list.InsertBefore(m, e)
+			return
+		}
+	}
+	q.list.PushBack(m)
+}
+
 func (q *queue) restore(m *stomp.Message) error {
+	q.replicas.publish(m)
 	q.Lock()
-	q.list.PushFront(m)
+	if q.sequence {
+		q.insert(m)
+	} else {
+		q.list.PushFront(m)
+	}
+	q.alloc(m)
 	q.Unlock()
 	return q.process()
 }
@@ -82,6 +174,7 @@ func (q *queue) restore(m *stomp.Message) error {
 func (q *queue) process() error {
 	q.Lock()
 	defer q.Unlock()
+	q.pageIn()
 
 	var next *list.Element
 	for e := q.list.Front(); e != nil; e = next {
@@ -91,15 +184,40 @@ func (q *queue) process() error {
 		// if the message expires we can remove it from the list
 		if len(m.Expires) != 0 && stomp.ParseInt64(m.Expires) < time.Now().Unix() {
 			q.list.Remove(e)
+			q.free(m)
+			q.forget(m)
 			continue
 		}
 
-		for _, sub := range shuffle(q.subs) {
+		for _, sub := range q.consumers() {
+			// sessions of a draining server only settle messages
+			// already delivered.
+			if sub.session.router != nil && sub.session.router.isDraining() {
+				continue
+			}
+			// a standby holds the replicated messages, which the
+			// primary delivers, until it is promoted.
+			if sub.session.router != nil && sub.session.router.isStandby() {
+				continue
+			}
+			// slow sessions are skipped, if the policy drops their
+			// messages, leaving messages queued for other subscribers.
+			// Sessions closed by the policy are skipped until they are
+			// disconnected.
+			if sub.session.router != nil && sub.session.router.skipSlow(sub.session) {
+				continue
+			}
+			if sub.session.out.isClosed() {
+				continue
+			}
+			// sessions holding their quota of unacked messages are
+			// skipped until they acknowledge messages.
+			if sub.ack && sub.session.skipUnacked() {
+				continue
+			}
 			// evaluate against the sql selector
-			if sub.selector != nil {
-				if ok, _ := sub.selector.Eval(m.Header); !ok {
-					continue
-				}
+			if !sub.matches(m) {
+				continue
 			}
 
 			if sub.prefetch != 0 && sub.prefetch == sub.Pending() {
@@ -109,23 +227,167 @@ func (q *queue) process() error {
 			if sub.prefetch != 0 {
 				sub.PendingIncr()
 			}
+			// the replication headers are internal to the cluster.
+			m.Header.Del(headerReplicaID)
+			m.Header.Del(headerReplicaSync)
 			if sub.ack {
 				m.Subs = sub.id
 				m.Ack = stomp.Rand()
 				sub.session.Lock()
 				sub.session.ack[string(m.Ack)] = m.Copy()
 				sub.session.Unlock()
+				sub.track(m.Ack)
+			}
+
+			if sub.exclusive && sub.ack {
+				q.watch()
 			}
 
 			m.Subs = sub.id
-			sub.session.send(m)
+			// messages requiring an ack are kept in the datastore
+			// and the standby nodes until they are settled.
+			if !sub.ack {
+				q.forget(m)
+			}
 			q.list.Remove(e)
+			q.free(m)
+			sub.session.send(m)
 			return nil
 		}
 	}
 	return nil
 }
 
+// alloc records the message held by the queue.
+func (q *queue) alloc(m *stomp.Message) {
+	q.size += len(m.Body)
+	q.mem.alloc(len(m.Body))
+	q.since[m] = time.Now()
+}
+
+// free records the message released by the queue.
+func (q *queue) free(m *stomp.Message) {
+	q.size -= len(m.Body)
+	q.mem.free(len(m.Body))
+	delete(q.since, m)
+}
+
+// depth returns the number of queued messages, including messages
+// spilled to disk, and the time the message at the head of the queue
+// was queued in memory.
+func (q *queue) depth() (n int, oldest time.Time) {
+	q.RLock()
+	defer q.RUnlock()
+	if e := q.list.Front(); e != nil {
+		oldest = q.since[e.Value.(*stomp.Message)]
+	}
+	return q.list.Len() + q.overflow.len(), oldest
+}
+
+// forget removes the message from the datastore and standby nodes once
+// the message is delivered or expires. Messages delivered to
+// subscriptions requiring an ack are removed by router.settle instead.
+func (q *queue) forget(m *stomp.Message) {
+	if q.store != nil && shouldPersist(m) {
+		q.store.delete(m)
+	}
+	q.replicas.remove(m)
+}
+
+// discard removes and releases all queued messages, and returns the
+// number of messages removed.
+func (q *queue) discard() int {
+	q.Lock()
+	defer q.Unlock()
+	n := q.list.Len() + q.overflow.len()
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		m := e.Value.(*stomp.Message)
+		q.free(m)
+		q.forget(m)
+		m.Release()
+	}
+	q.list.Init()
+	q.overflow.discard()
+	return n
+}
+
+// removeReplica removes the replicated message with the given replica
+// id from a standby queue.
+func (q *queue) removeReplica(id []byte) {
+	q.Lock()
+	defer q.Unlock()
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		m := e.Value.(*stomp.Message)
+		if bytes.Equal(m.Header.Get(headerReplicaID), id) {
+			q.list.Remove(e)
+			q.free(m)
+			m.Release()
+			return
+		}
+	}
+}
+
+// consumers returns the subscriptions eligible to receive messages. If
+// the queue has exclusive subscriptions, only the oldest exclusive
+// subscription is eligible and the others are on standby. An exclusive
+// subscription that has stalled, holding unacknowledged messages without
+// acking, is passed over for the next exclusive subscription or, if all
+// have stalled, for the remaining subscriptions.
+func (q *queue) consumers() []*subscription {
+	var exclusive, live []*subscription
+	now := time.Now()
+	for sub := range q.subs {
+		if sub.exclusive {
+			exclusive = append(exclusive, sub)
+			if !sub.stalled(now) {
+				live = append(live, sub)
+			}
+		}
+	}
+	if sub := oldest(live); sub != nil {
+		return []*subscription{sub}
+	}
+	if len(exclusive) == 0 {
+		return q.balance(shuffle(q.subs))
+	}
+	var subs []*subscription
+	for _, sub := range q.balance(shuffle(q.subs)) {
+		if !sub.exclusive {
+			subs = append(subs, sub)
+		}
+	}
+	return append(subs, exclusive...)
+}
+
+// balance orders the subscriptions by the number of messages they hold
+// unacknowledged if work stealing is enabled, so that idle subscribers
+// take messages before busy ones.
+func (q *queue) balance(subs []*subscription) []*subscription {
+	if q.features.enabled(FeatureWorkStealing) {
+		sort.Stable(byLoad(subs))
+	}
+	return subs
+}
+
+// byLoad sorts subscriptions by the number of unacknowledged messages.
+type byLoad []*subscription
+
+func (s byLoad) Len() int           { return len(s) }
+func (s byLoad) Less(i, j int) bool { return s[i].load() < s[j].load() }
+func (s byLoad) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// watch schedules the queue to be processed again once the exclusive
+// subscription that received a message may have stalled, so that queued
+// messages fail over without waiting for the next publish. The caller
+// must hold the lock.
+func (q *queue) watch() {
+	if q.idle == nil {
+		q.idle = time.AfterFunc(exclusiveIdle, func() { q.process() })
+		return
+	}
+	q.idle.Reset(exclusiveIdle)
+}
+
 // helper function to randomize the list of subscribers in an attempt
 // to more evenly distribute messages in a round robin fashion.
 //
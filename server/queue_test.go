@@ -1,3 +1,151 @@
 package server
 
-// TODO
+import (
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func Test_queue_sequence(t *testing.T) {
+	q := newQueue([]byte("/queue/test"))
+	q.sequence = true
+
+	for i := 0; i < 3; i++ {
+		m := stomp.NewMessage()
+		m.Dest = q.dest
+		// sequence numbers supplied by the producer are replaced.
+		m.Header.Add(stomp.HeaderSequence, []byte("1"))
+		q.publish(m)
+	}
+
+	// simulate the redelivery of the second message.
+	e := q.list.Front().Next()
+	q.list.Remove(e)
+	q.restore(e.Value.(*stomp.Message))
+
+	var got []int64
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		m := e.Value.(*stomp.Message)
+		got = append(got, stomp.ParseInt64(m.Header.Get(stomp.HeaderSequence)))
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("expect messages queued in sequence order, got %v", got)
+	}
+}
+
+func Test_queue_exclusive(t *testing.T) {
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/test")
+	m.Header.Add(stomp.HeaderExclusive, []byte("true"))
+	defer m.Release()
+
+	peer1, client1 := stomp.Pipe()
+	sess1 := requestSession()
+	sess1.peer = peer1
+	defer sess1.release()
+
+	peer2, client2 := stomp.Pipe()
+	sess2 := requestSession()
+	sess2.peer = peer2
+	defer sess2.release()
+
+	q := newQueue(m.Dest)
+	sub1 := sess1.subs(m)
+	sub2 := sess2.subs(m)
+	q.subscribe(sub1, m)
+	q.subscribe(sub2, m)
+
+	for i := 0; i < 5; i++ {
+		q.publish(m)
+		select {
+		case <-client1.Receive():
+		default:
+			t.Errorf("expect message delivered to the active exclusive subscription")
+		}
+		select {
+		case <-client2.Receive():
+			t.Errorf("expect standby exclusive subscription to receive nothing")
+		default:
+		}
+	}
+
+	q.unsubscribe(sub1, m)
+	q.publish(m)
+	select {
+	case <-client2.Receive():
+	default:
+		t.Errorf("expect standby exclusive subscription to take over")
+	}
+}
+
+func Test_queue_exclusive_stalled(t *testing.T) {
+	defer func(d time.Duration) { exclusiveIdle = d }(exclusiveIdle)
+	exclusiveIdle = 20 * time.Millisecond
+
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/test")
+	m.Ack = stomp.AckClientIndividual
+	m.Prefetch = []byte("1")
+	m.Header.Add(stomp.HeaderExclusive, []byte("true"))
+	defer m.Release()
+
+	peer1, client1 := stomp.Pipe()
+	sess1 := requestSession()
+	sess1.peer = peer1
+	defer sess1.release()
+
+	peer2, client2 := stomp.Pipe()
+	sess2 := requestSession()
+	sess2.peer = peer2
+	defer sess2.release()
+
+	q := newQueue(m.Dest)
+	q.subscribe(sess1.subs(m), m)
+	q.subscribe(sess2.subs(m), m)
+
+	q.publish(m)
+	select {
+	case <-client1.Receive():
+	default:
+		t.Fatalf("expect message delivered to the active exclusive subscription")
+	}
+
+	// the active subscription holds its prefetch without acking, so the
+	// standby subscription takes over the queued message.
+	q.publish(m)
+	select {
+	case <-client2.Receive():
+		t.Errorf("expect standby exclusive subscription to receive nothing while the active one may ack")
+	default:
+	}
+	select {
+	case <-client2.Receive():
+	case <-time.After(time.Second):
+		t.Errorf("expect standby exclusive subscription to take over from a stalled subscription")
+	}
+	q.Lock()
+	q.idle.Stop()
+	q.Unlock()
+}
+
+func Test_queue_replica_headers(t *testing.T) {
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/test")
+	m.Header.Add(headerReplicaID, []byte("1"))
+	m.Header.Add(headerReplicaSync, []byte("2"))
+	defer m.Release()
+
+	peer, client := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = peer
+	defer sess.release()
+
+	q := newQueue(m.Dest)
+	q.subscribe(sess.subs(m), m)
+	q.publish(m)
+	got := <-client.Receive()
+	if got.Header.Get(headerReplicaID) != nil || got.Header.Get(headerReplicaSync) != nil {
+		t.Errorf("expect replication headers stripped on delivery")
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// ErrSubscriptionQuota is returned when a session subscribes beyond its
+// subscription quota.
+var ErrSubscriptionQuota = errors.New("stomp: subscription quota exceeded")
+
+// Quota limits the resources used by a session. Zero values are
+// unlimited. Messages published beyond the rate are rejected with
+// ErrRateLimited, subscriptions beyond the limit are rejected with
+// ErrSubscriptionQuota, and queues stop delivering to a session holding
+// the maximum unacked messages until it acknowledges them.
+type Quota struct {
+	Subscriptions int     // concurrent subscriptions
+	Unacked       int     // messages delivered and awaiting an ack
+	Messages      float64 // messages published per second
+	Bytes         float64 // bytes published per second
+}
+
+// merge returns the quota with the non-zero values of q replacing
+// those of the base quota.
+func (base Quota) merge(q Quota) Quota {
+	if q.Subscriptions != 0 {
+		base.Subscriptions = q.Subscriptions
+	}
+	if q.Unacked != 0 {
+		base.Unacked = q.Unacked
+	}
+	if q.Messages != 0 {
+		base.Messages = q.Messages
+	}
+	if q.Bytes != 0 {
+		base.Bytes = q.Bytes
+	}
+	return base
+}
+
+// applyQuota sets the quota of the session from the router quota and
+// the quota of the authenticated user. The login of an unauthenticated
+// session is not verified, so it is not given the quota of the user it
+// claims.
+func (r *router) applyQuota(sess *session, user []byte) {
+	r.RLock()
+	q := r.quota
+	if uq, ok := r.userQuotas[string(user)]; ok && sess.authenticated {
+		q = q.merge(uq)
+	}
+	r.RUnlock()
+
+	sess.quota = q
+	if q.Messages != 0 || q.Bytes != 0 {
+		sess.quotaLimiter = newLimiter(Limit{Messages: q.Messages, Bytes: q.Bytes, Reject: true})
+	}
+}
+
+// checkSubscriptions returns ErrSubscriptionQuota if the session holds
+// the maximum subscriptions.
+func (r *router) checkSubscriptions(sess *session, m *stomp.Message) error {
+	max := sess.quota.Subscriptions
+	if max == 0 {
+		return nil
+	}
+	sess.Lock()
+	n := len(sess.sub)
+	sess.Unlock()
+	if n < max {
+		return nil
+	}
+	logger.Noticef("stomp: subscribe %s: session %s exceeded its subscription quota of %d",
+		string(m.Dest),
+		sess.peer.Addr(),
+		max,
+	)
+	return ErrSubscriptionQuota
+}
+
+// skipUnacked returns true if queues should not deliver to the session
+// because it holds the maximum unacked messages.
+func (s *session) skipUnacked() bool {
+	if s.quota.Unacked == 0 {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return len(s.ack) >= s.quota.Unacked
+}
+
+// resumeUnacked re-processes the queues the session subscribes to once
+// an ack or nack reduces its unacked messages below the quota.
+func (r *router) resumeUnacked(sess *session) {
+	if sess.quota.Unacked == 0 {
+		return
+	}
+	sess.Lock()
+	dests := make(map[string]struct{}, len(sess.sub))
+	for _, sub := range sess.sub {
+		dests[string(sub.dest)] = struct{}{}
+	}
+	sess.Unlock()
+	for dest := range dests {
+		if h, ok := r.destinations.load(dest); ok {
+			h.process()
+		}
+	}
+}
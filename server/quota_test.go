@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestQuota(t *testing.T) {
+	s := NewServer(
+		WithQuota(Quota{Subscriptions: 1, Unacked: 1, Messages: 1}),
+		WithUserQuota("vip", Quota{Subscriptions: 2}),
+		WithAuth(func(*stomp.Message) error { return nil }),
+	)
+	connect := func(user string) stomp.Peer {
+		a, b := stomp.Pipe()
+		go s.ServePeer(b)
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodStomp
+		m.Proto = stomp.STOMP
+		m.User = []byte(user)
+		a.Send(m)
+		if m := receive(t, a); !bytes.Equal(m.Method, stomp.MethodConnected) {
+			t.Fatalf("Expect CONNECTED, got %s", m.Method)
+		}
+		return a
+	}
+	subscribe := func(peer stomp.Peer, id, dest string) *stomp.Message {
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodSubscribe
+		m.ID = []byte(id)
+		m.Dest = []byte(dest)
+		m.Ack = stomp.AckClientIndividual
+		m.Receipt = []byte("r" + id)
+		peer.Send(m)
+		return receive(t, peer)
+	}
+
+	a := connect("guest")
+	defer a.Close()
+	if m := subscribe(a, "1", "/queue/a"); !bytes.Equal(m.Method, stomp.MethodRecipet) {
+		t.Fatalf("Expect subscription within quota, got %s", m.Method)
+	}
+	m := subscribe(a, "2", "/queue/b")
+	if !bytes.Equal(m.Method, stomp.MethodError) ||
+		string(m.Header.Get(stomp.HeaderMessage)) != ErrSubscriptionQuota.Error() {
+		t.Fatalf("Expect subscription quota exceeded, got %s", m)
+	}
+
+	vip := connect("vip")
+	defer vip.Close()
+	subscribe(vip, "1", "/queue/v1")
+	if m := subscribe(vip, "2", "/queue/v2"); !bytes.Equal(m.Method, stomp.MethodRecipet) {
+		t.Errorf("Expect user quota to replace the session quota, got %s", m.Method)
+	}
+
+	producer := connect("producer")
+	defer producer.Close()
+	for i := 0; i < 2; i++ {
+		send := stomp.NewMessage()
+		send.Method = stomp.MethodSend
+		send.Dest = []byte("/queue/c")
+		send.Receipt = []byte("send")
+		producer.Send(send)
+		m := receive(t, producer)
+		if i == 1 && !bytes.Equal(m.Method, stomp.MethodError) {
+			t.Errorf("Expect publish rate quota exceeded, got %s", m.Method)
+		}
+	}
+
+	// the guest holds one unacked message and is not sent the second
+	// until it acknowledges the first.
+	for _, body := range []string{"one", "two"} {
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodSend
+		m.Dest = []byte("/queue/a")
+		m.Body = []byte(body)
+		s.router.publish(m)
+	}
+	first := receive(t, a)
+	if string(first.Body) != "one" {
+		t.Fatalf("Expect first message delivered, got %s", first)
+	}
+	select {
+	case m := <-a.Receive():
+		t.Fatalf("Expect delivery held at the unacked quota, got %s", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ack := stomp.NewMessage()
+	ack.Method = stomp.MethodAck
+	ack.ID = first.Ack
+	a.Send(ack)
+	second := receive(t, a)
+	if string(second.Body) != "two" {
+		t.Fatalf("Expect delivery resumed after the ack, got %s", second)
+	}
+
+	// a nack sending the message to the dead-letter queue also resumes
+	// delivery.
+	m = stomp.NewMessage()
+	m.Method = stomp.MethodSend
+	m.Dest = []byte("/queue/a")
+	m.Body = []byte("three")
+	s.router.publish(m)
+	nack := stomp.NewMessage()
+	nack.Method = stomp.MethodNack
+	nack.ID = second.Ack
+	nack.Header.Add(stomp.HeaderRequeue, []byte("false"))
+	a.Send(nack)
+	if m := receive(t, a); string(m.Body) != "three" {
+		t.Errorf("Expect delivery resumed after the nack, got %s", m)
+	}
+}
+
+func TestQuotaUnauthenticated(t *testing.T) {
+	s := NewServer(
+		WithQuota(Quota{Subscriptions: 1}),
+		WithUserQuota("vip", Quota{Subscriptions: 2}),
+	)
+	a, b := stomp.Pipe()
+	go s.ServePeer(b)
+	defer a.Close()
+	m := stomp.NewMessage()
+	m.Method = stomp.MethodStomp
+	m.User = []byte("vip")
+	a.Send(m)
+	receive(t, a)
+
+	var quota Quota
+	s.router.RLock()
+	for sess := range s.router.sessions {
+		quota = sess.quota
+	}
+	s.router.RUnlock()
+	if quota.Subscriptions != 1 {
+		t.Errorf("Want the user quota withheld from an unauthenticated login, got %+v", quota)
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// ErrReadOnly is returned to clients sending messages to a read-only
+// replica. The error includes a redirect header with the address of a
+// writable node when one is configured.
+var ErrReadOnly = errors.New("stomp: server is a read-only replica")
+
+// rejectSend sends an error to the session if the router is a read-only
+// replica, and returns true if the message was rejected.
+func (r *router) rejectSend(sess *session, m *stomp.Message) bool {
+	if r.readOnly == nil {
+		return false
+	}
+	logger.Verbosef("stomp: send %s: rejected, read-only replica",
+		string(m.Dest),
+	)
+	var opts []stomp.MessageOption
+	if len(r.readOnly) != 0 {
+		opts = append(opts,
+			stomp.WithHeader(string(stomp.HeaderRedirect), string(r.readOnly)),
+		)
+	}
+	sess.sendError(m, ErrReadOnly, opts...)
+	return true
+}
+
+// readOnly returns true if the server is a read-only replica.
+func (s *Server) readOnly() bool {
+	return s.router.readOnly != nil
+}
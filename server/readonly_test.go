@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestReadOnly(t *testing.T) {
+	s := NewServer(WithReadOnly("tcp://primary:61613"))
+
+	a, b := stomp.Pipe()
+	go s.ServePeer(b)
+
+	connect := stomp.NewMessage()
+	connect.Method = stomp.MethodStomp
+	a.Send(connect)
+	if m := receive(t, a); !bytes.Equal(m.Method, stomp.MethodConnected) {
+		t.Fatalf("Expect CONNECTED, got %s", m.Method)
+	}
+
+	sub := stomp.NewMessage()
+	sub.Method = stomp.MethodSubscribe
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/topic/test")
+	sub.Receipt = []byte("2")
+	a.Send(sub)
+	if m := receive(t, a); !bytes.Equal(m.Method, stomp.MethodRecipet) {
+		t.Errorf("Expect read-only replica to accept subscriptions, got %s", m.Method)
+	}
+
+	send := stomp.NewMessage()
+	send.Method = stomp.MethodSend
+	send.Dest = []byte("/topic/test")
+	send.Receipt = []byte("3")
+	a.Send(send)
+	m := receive(t, a)
+	if !bytes.Equal(m.Method, stomp.MethodError) {
+		t.Fatalf("Expect read-only replica to reject SEND, got %s", m.Method)
+	}
+	if got := m.Header.GetString(string(stomp.HeaderRedirect)); got != "tcp://primary:61613" {
+		t.Errorf("Expect redirect header, got %q", got)
+	}
+	if got := m.Header.GetString(string(stomp.HeaderMessage)); got != ErrReadOnly.Error() {
+		t.Errorf("Expect ErrReadOnly, got %q", got)
+	}
+	a.Close()
+}
+
+// receive returns the next message received by the peer.
+func receive(t *testing.T, peer stomp.Peer) *stomp.Message {
+	select {
+	case m := <-peer.Receive():
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for message")
+	}
+	return nil
+}
+
+func TestReadOnlyRedirect(t *testing.T) {
+	primary := NewServer()
+	addr, stop := listen(t, primary)
+	defer stop()
+	replica := NewServer(WithReadOnly("tcp://" + addr))
+	replicaAddr, stopReplica := listen(t, replica)
+	defer stopReplica()
+
+	client, err := stomp.Dial("tcp://"+replicaAddr, stomp.WithRedirects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	received := make(chan *stomp.Message, 1)
+	client.Subscribe("/topic/test", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m
+	}), stomp.WithReceipt())
+
+	if err := client.Send("/topic/test", []byte("hello"), stomp.WithReceipt()); err != nil {
+		t.Fatalf("Expect message sent to the redirect target, got %s", err)
+	}
+	select {
+	case m := <-received:
+		if !bytes.Equal(m.Body, []byte("hello")) {
+			t.Errorf("Expect message delivered to the subscription")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect subscription re-established with the redirect target")
+	}
+}
+
+// listen serves the server on a local tcp listener and returns the
+// listener address, and a function that closes the listener and waits
+// for the served connections to close.
+func listen(t *testing.T, s *Server) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				s.ServeConn(conn)
+				wg.Done()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+		wg.Wait()
+	}
+}
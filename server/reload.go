@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/mrwill84/mq/logger"
+)
+
+// ErrAuthRemoved is returned by Reload when the configuration removes
+// the authentication of a running server without setting auth.anonymous.
+var ErrAuthRemoved = errors.New("stomp: reload removes authentication")
+
+// Reload applies the reloadable settings of the configuration to every
+// virtual host: credentials, token keys, certificate identities, rate
+// limits, destination policies and the memory limit. The settings
+// replace those configured by options, except the authorizer of a
+// virtual host configured with its own. Existing connections are kept
+// and subsequent frames are subject to the new settings; credentials
+// apply to new connections. Changes to other settings take effect after
+// a restart.
+func (s *Server) Reload(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	var (
+		auth       Authorizer
+		jwt        *jwtVerifier
+		certs      CertAuthorizer
+		critical   []string
+		compacted  []string
+		defaults   []subscriptionDefaults
+		transforms []transform
+	)
+	if c.Auth.Username != "" || c.Auth.Password != "" {
+		auth = BasicAuth(c.Auth.Username, c.Auth.Password)
+	}
+	if c.Auth.JWT.enabled() {
+		jwt = newJWTVerifier(c.Auth.JWT.options())
+	}
+	if c.Auth.ClientCerts.Enabled {
+		certs = CertNames(c.Auth.ClientCerts.Scopes)
+	}
+
+	// a configuration missing its auth section must not silently turn
+	// off authentication.
+	if auth == nil && jwt == nil && certs == nil && !c.Auth.Anonymous {
+		s.router.RLock()
+		authenticated := s.router.authorizer != nil || s.router.jwt != nil || s.router.certs != nil
+		s.router.RUnlock()
+		if authenticated {
+			return ErrAuthRemoved
+		}
+	}
+
+	for _, d := range c.Destinations {
+		if d.Critical {
+			critical = append(critical, d.Pattern)
+		}
+		if d.Compact {
+			compacted = append(compacted, d.Pattern)
+		}
+		if d.Ack != "" || d.Prefetch != 0 || d.Selector != "" {
+			defaults = append(defaults, subscriptionDefaults{d.Pattern, SubscriptionDefaults{
+				Ack:      d.Ack,
+				Prefetch: d.Prefetch,
+				Selector: d.Selector,
+			}})
+		}
+		if chain := d.transforms(); len(chain) != 0 {
+			transforms = append(transforms, transform{d.Pattern, chain, true})
+		}
+	}
+
+	// virtual hosts configured with their own authorizer keep it.
+	own := make(map[string]bool)
+	for _, h := range s.vhosts {
+		if h.auth != nil {
+			own[h.host] = true
+		}
+	}
+	for _, r := range s.routers() {
+		r.Lock()
+		// transformers configured in code are kept.
+		var kept []transform
+		for _, t := range r.transforms {
+			if !t.config {
+				kept = append(kept, t)
+			}
+		}
+		r.transforms = append(kept, transforms...)
+		if r == s.router || !own[r.host] {
+			r.authorizer = auth
+			r.jwt = jwt
+			r.certs = certs
+		}
+		r.critical = critical
+		r.compacted = compacted
+		r.defaults = defaults
+		r.Unlock()
+		r.reloadRateLimits(c.RateLimits)
+	}
+	// the memory limit is shared by the virtual hosts.
+	atomic.StoreInt64(&s.router.mem.limit, int64(c.Limits.Memory))
+
+	if s.config != nil && !reflect.DeepEqual(restartSettings(s.config), restartSettings(c)) {
+		logger.Warningf("stomp: reload: listener, limit, timeout and policy changes take effect after a restart")
+	}
+	s.config = c.clone()
+	logger.Noticef("stomp: configuration reloaded")
+	return nil
+}
+
+// reloadRateLimits replaces the rate limits of the router. Limits missing
+// from the configuration are removed, and limiters of existing
+// destinations and sessions are updated in place.
+func (r *router) reloadRateLimits(config []RateLimitConfig) {
+	limits := map[string]*Limit{"": nil}
+	dests, _ := r.rateLimits()
+	for dest := range dests {
+		limits[dest] = nil
+	}
+	for _, l := range config {
+		limits[l.Destination] = &Limit{Messages: l.Messages, Bytes: l.Bytes, Reject: l.Reject}
+	}
+	for dest, limit := range limits {
+		r.setRateLimit(dest, limit)
+	}
+}
+
+// restartSettings returns the settings of the configuration which are
+// not applied by Reload.
+func restartSettings(c *Config) Config {
+	static := *c.clone()
+	static.Auth = AuthConfig{}
+	static.RateLimits = nil
+	static.Destinations = nil
+	static.Limits.Memory = 0
+	return static
+}
+
+// clone returns a deep copy of the configuration.
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.Listeners = append([]ListenerConfig(nil), c.Listeners...)
+	if c.Auth.ClientCerts.Scopes != nil {
+		clone.Auth.ClientCerts.Scopes = make(map[string][]string, len(c.Auth.ClientCerts.Scopes))
+		for name, scopes := range c.Auth.ClientCerts.Scopes {
+			clone.Auth.ClientCerts.Scopes[name] = append([]string(nil), scopes...)
+		}
+	}
+	clone.Policies.Features = append([]string(nil), c.Policies.Features...)
+	clone.RateLimits = append([]RateLimitConfig(nil), c.RateLimits...)
+	clone.Destinations = append([]DestinationConfig(nil), c.Destinations...)
+	for i, d := range c.Destinations {
+		clone.Destinations[i].Require = append([]string(nil), d.Require...)
+		clone.Destinations[i].Redact = append([]string(nil), d.Redact...)
+		if d.Headers != nil {
+			clone.Destinations[i].Headers = make(map[string]string, len(d.Headers))
+			for key, value := range d.Headers {
+				clone.Destinations[i].Headers[key] = value
+			}
+		}
+	}
+	clone.CronJobs = append([]CronConfig(nil), c.CronJobs...)
+	if c.Quotas.Users != nil {
+		clone.Quotas.Users = make(map[string]QuotaConfig, len(c.Quotas.Users))
+		for user, q := range c.Quotas.Users {
+			clone.Quotas.Users[user] = q
+		}
+	}
+	return &clone
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestServerReload(t *testing.T) {
+	s, err := NewFromConfig(&Config{
+		Auth:       AuthConfig{Username: "admin", Password: "old"},
+		RateLimits: []RateLimitConfig{{Destination: "/queue/old", Messages: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := s.router
+
+	sess := requestSession()
+	defer sess.release()
+	r.Lock()
+	r.sessions[sess] = struct{}{}
+	r.Unlock()
+
+	err = s.Reload(&Config{
+		Auth: AuthConfig{Username: "admin", Password: "new"},
+		RateLimits: []RateLimitConfig{
+			{Destination: "/queue/new", Messages: 5},
+			{Messages: 100},
+		},
+		Destinations: []DestinationConfig{
+			{Pattern: "/queue/critical.*", Critical: true, Prefetch: 10},
+		},
+		Limits: LimitsConfig{Memory: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := stomp.NewMessage()
+	defer m.Release()
+	m.User, m.Pass = []byte("admin"), []byte("new")
+	if err := r.authorizer(m); err != nil {
+		t.Errorf("Want reloaded credentials accepted, got %s", err)
+	}
+	m.Pass = []byte("old")
+	if err := r.authorizer(m); err != ErrNotAuthorized {
+		t.Errorf("Want previous credentials rejected")
+	}
+
+	dests, session := r.rateLimits()
+	if _, ok := dests["/queue/old"]; ok || dests["/queue/new"].Messages != 5 {
+		t.Errorf("Want destination rate limits replaced, got %v", dests)
+	}
+	if session == nil || session.Messages != 100 {
+		t.Errorf("Want session rate limit configured, got %v", session)
+	}
+	if sess.limiter == nil || sess.limiter.get().Messages != 100 {
+		t.Errorf("Want session rate limit applied to connected sessions")
+	}
+
+	if d := r.subscriptionDefaults([]byte("/queue/critical.orders")); d.Prefetch != 10 {
+		t.Errorf("Want destination defaults reloaded, got %+v", d)
+	}
+	r.mem.alloc(5)
+	defer r.mem.free(5)
+	if err := r.admit([]byte("/queue/critical.orders")); err != nil {
+		t.Errorf("Want critical destination admitted, got %s", err)
+	}
+	if err := r.admit([]byte("/queue/other")); err != ErrOverloaded {
+		t.Errorf("Want memory limit reloaded, got %v", err)
+	}
+
+	if err := s.Reload(&Config{RateLimits: []RateLimitConfig{{Messages: -1}}}); err == nil {
+		t.Errorf("Want invalid configuration rejected")
+	}
+	if r.authorizer == nil {
+		t.Errorf("Want configuration kept when reload fails")
+	}
+
+	if err := s.Reload(&Config{}); err != ErrAuthRemoved {
+		t.Errorf("Want reload removing authentication rejected, got %v", err)
+	}
+	if r.authorizer == nil {
+		t.Errorf("Want authentication kept when removed implicitly")
+	}
+	if err := s.Reload(&Config{Auth: AuthConfig{Anonymous: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if r.authorizer != nil {
+		t.Errorf("Want authentication removed explicitly")
+	}
+	if _, session := r.rateLimits(); session != nil || sess.limiter != nil {
+		t.Errorf("Want session rate limit removed")
+	}
+}
+
+func TestServerReloadVirtualHosts(t *testing.T) {
+	own := BasicAuth("tenant", "secret")
+	s := NewServer(
+		WithCredentials("admin", "old"),
+		WithVirtualHost("shared", nil),
+		WithVirtualHost("tenant", own),
+	)
+	err := s.Reload(&Config{
+		Auth:       AuthConfig{Username: "admin", Password: "new"},
+		RateLimits: []RateLimitConfig{{Destination: "/queue/new", Messages: 5}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := stomp.NewMessage()
+	defer m.Release()
+	m.User, m.Pass = []byte("admin"), []byte("new")
+	if err := s.hosts["shared"].authorizer(m); err != nil {
+		t.Errorf("Want reloaded credentials applied to the virtual host, got %s", err)
+	}
+	if err := s.hosts["tenant"].authorizer(m); err != ErrNotAuthorized {
+		t.Errorf("Want virtual host authorizer kept, got %v", err)
+	}
+	for _, host := range []string{"shared", "tenant"} {
+		if dests, _ := s.hosts[host].rateLimits(); dests["/queue/new"].Messages != 5 {
+			t.Errorf("Want rate limits reloaded on virtual host %s, got %v", host, dests)
+		}
+	}
+}
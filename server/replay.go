@@ -0,0 +1,267 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+	"github.com/mrwill84/mq/stomp/selector"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// ErrReplayUnavailable is returned when a subscription requests a
+	// replay and the server does not persist messages.
+	ErrReplayUnavailable = errors.New("stomp: replay requires persistence")
+
+	// ErrReplayFrom is returned when the replay-from header is not
+	// beginning, an offset or an RFC 3339 time.
+	ErrReplayFrom = errors.New("stomp: invalid replay-from header")
+)
+
+// Keys of the message log and the compaction index are prefixed to sort
+// after the ids of persisted queue messages.
+var (
+	internalPrefix = []byte("\xff")
+	logPrefix      = []byte("\xfflog\x00")
+	indexPrefix    = []byte("\xffkey\x00")
+)
+
+// logStripes is the number of locks ordering appends and replays.
+const logStripes = 64
+
+// messageLog is the log of persisted messages by destination, kept in
+// the datastore so that subscribers can replay them. Each message is
+// assigned the next offset of its destination.
+type messageLog struct {
+	db      *leveldb.DB
+	scope   []byte // key prefix of the virtual host, see hostScope
+	stripes [logStripes]sync.Mutex
+
+	mu      sync.Mutex
+	offsets map[string]int64 // last offset by destination
+}
+
+func newMessageLog(db *leveldb.DB, scope []byte) *messageLog {
+	return &messageLog{db: db, scope: scope, offsets: make(map[string]int64)}
+}
+
+// lock locks the destination, ordering messages appended to the log and
+// published with subscriptions switching from replay to live delivery.
+func (l *messageLog) lock(dest []byte) func() {
+	h := fnv.New32a()
+	h.Write(dest)
+	mu := &l.stripes[h.Sum32()%logStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// logKey returns the key of the logged message, which sorts by offset
+// within the destination.
+func (l *messageLog) logKey(dest []byte, offset int64) []byte {
+	key := make([]byte, 0, len(l.scope)+len(logPrefix)+len(dest)+9)
+	key = append(append(append(append(key, l.scope...), logPrefix...), dest...), 0)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(offset))
+	return append(key, b[:]...)
+}
+
+// logRange returns the key range of the destination from the offset.
+func (l *messageLog) logRange(dest []byte, from int64) *util.Range {
+	return &util.Range{Start: l.logKey(dest, from), Limit: l.logKey(dest, math.MaxInt64)}
+}
+
+// last returns the last offset of the destination. The caller must hold
+// the lock.
+func (l *messageLog) last(dest []byte) int64 {
+	if offset, ok := l.offsets[string(dest)]; ok {
+		return offset
+	}
+	var offset int64
+	iter := l.db.NewIterator(l.logRange(dest, 0), nil)
+	if iter.Last() {
+		key := iter.Key()
+		offset = int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+	}
+	iter.Release()
+	l.offsets[string(dest)] = offset
+	return offset
+}
+
+// indexKey returns the key of the offset of the latest message with the
+// key in the destination.
+func (l *messageLog) indexKey(dest, key []byte) []byte {
+	k := make([]byte, 0, len(l.scope)+len(indexPrefix)+len(dest)+len(key)+1)
+	k = append(append(k, l.scope...), indexPrefix...)
+	return append(append(append(k, dest...), 0), key...)
+}
+
+// append stamps the message with the next offset of its destination and
+// writes it to the log. If the log is compacted the previous message with
+// the same key is removed, and a message with a key and an empty body
+// removes the key without being logged. The caller must hold the
+// destination lock.
+func (l *messageLog) append(m *stomp.Message, compact bool) error {
+	l.mu.Lock()
+	offset := l.last(m.Dest) + 1
+	l.offsets[string(m.Dest)] = offset
+	l.mu.Unlock()
+
+	m.Header.Set(stomp.HeaderOffset, strconv.AppendInt(nil, offset, 10))
+	var ts, off [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(off[:], uint64(offset))
+
+	batch := new(leveldb.Batch)
+	key := m.Header.Get(stomp.HeaderKey)
+	tombstone := false
+	if compact && len(key) != 0 {
+		idx := l.indexKey(m.Dest, key)
+		prev, err := l.db.Get(idx, nil)
+		switch {
+		case err == nil:
+			batch.Delete(l.logKey(m.Dest, int64(binary.BigEndian.Uint64(prev))))
+		case err != leveldb.ErrNotFound:
+			return err
+		}
+		if tombstone = len(m.Body) == 0; tombstone {
+			batch.Delete(idx)
+		} else {
+			batch.Put(idx, off[:])
+		}
+	}
+	if !tombstone {
+		batch.Put(l.logKey(m.Dest, offset), append(ts[:], m.Bytes()...))
+	}
+	return l.db.Write(batch, nil)
+}
+
+// start returns the first offset replayed for the replay-from header.
+func (l *messageLog) start(dest, from []byte) (int64, error) {
+	if string(from) == stomp.ReplayBeginning {
+		return 1, nil
+	}
+	if offset, err := strconv.ParseInt(string(from), 10, 64); err == nil && offset > 0 {
+		return offset, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(from))
+	if err != nil {
+		return 0, ErrReplayFrom
+	}
+
+	// the first message logged at or after the time.
+	nanos := uint64(t.UnixNano())
+	iter := l.db.NewIterator(l.logRange(dest, 0), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if binary.BigEndian.Uint64(iter.Value()) >= nanos {
+			key := iter.Key()
+			return int64(binary.BigEndian.Uint64(key[len(key)-8:])), nil
+		}
+	}
+	return l.last(dest) + 1, iter.Error()
+}
+
+// replay calls fn with the messages of the destination from the offset,
+// and returns the offset following the last message.
+func (l *messageLog) replay(dest []byte, from int64, fn func(*stomp.Message)) (int64, error) {
+	iter := l.db.NewIterator(l.logRange(dest, from), nil)
+	defer iter.Release()
+	for iter.Next() {
+		m := stomp.NewMessage()
+		if err := m.Parse(append([]byte(nil), iter.Value()[8:]...)); err != nil {
+			m.Release()
+			return from, err
+		}
+		key := iter.Key()
+		from = int64(binary.BigEndian.Uint64(key[len(key)-8:])) + 1
+		fn(m)
+	}
+	return from, iter.Error()
+}
+
+// replay sends the logged messages of the destination to the session
+// and then subscribes to live messages. History is sent without
+// blocking publishers, and the remaining messages are sent with the
+// destination locked so that no message is missed or reordered when
+// switching to live delivery.
+func (r *router) replay(sess *session, m *stomp.Message, from []byte) error {
+	if r.log == nil {
+		return ErrReplayUnavailable
+	}
+	offset, err := r.log.start(m.Dest, from)
+	if err != nil {
+		return err
+	}
+	return r.replayFrom(sess, m, offset, nil)
+}
+
+// replayFrom sends the logged messages of the destination from the
+// offset to the session and then subscribes to live messages. Messages
+// delivered to a durable subscription advance its offset.
+func (r *router) replayFrom(sess *session, m *stomp.Message, offset int64, d *durable) (err error) {
+	var sel *selector.Selector
+	if len(m.Selector) != 0 {
+		if sel, err = selector.Parse(m.Selector); err != nil {
+			return err
+		}
+	}
+	subs := append([]byte(nil), m.ID...)
+	deliver := func(c *stomp.Message) {
+		if sel != nil {
+			if ok, _ := sel.Eval(c.Header); !ok {
+				c.Release()
+				return
+			}
+		}
+		c.Method = stomp.MethodMessage
+		c.Subs = subs
+		c.ID = stomp.Rand()
+		d.delivered(c)
+		sess.send(c)
+	}
+
+	if offset, err = r.log.replay(m.Dest, offset, deliver); err != nil {
+		return err
+	}
+	unlock := r.log.lock(m.Dest)
+	defer unlock()
+	if _, err = r.log.replay(m.Dest, offset, deliver); err != nil {
+		return err
+	}
+	return r.subscribeLive(sess, m, d)
+}
+
+// logMessage appends a persistent message to the log and returns a
+// function releasing the destination lock once the message is published.
+func (r *router) logMessage(m *stomp.Message) func() {
+	if r.log == nil || !shouldPersist(m) {
+		return func() {}
+	}
+	unlock := r.log.lock(m.Dest)
+	if err := r.log.append(m, r.compacts(m.Dest)); err != nil {
+		logger.Warningf("stomp: log %s: %s", m.Dest, err)
+	}
+	return unlock
+}
+
+// compacts returns true if the destination is compacted by message key.
+func (r *router) compacts(dest []byte) bool {
+	r.RLock()
+	defer r.RUnlock()
+	for _, pattern := range r.compacted {
+		if ok, _ := path.Match(pattern, string(dest)); ok {
+			return true
+		}
+	}
+	return false
+}
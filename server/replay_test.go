@@ -0,0 +1,112 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer(WithStore(dir))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"1", "2", "3"} {
+		client.Send("/topic/audit", []byte(body), stomp.WithPersistence(), stomp.WithReceipt())
+	}
+	client.Send("/topic/audit", []byte("transient"), stomp.WithReceipt())
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+	client.Send("/topic/audit", []byte("4"), stomp.WithPersistence(), stomp.WithReceipt())
+
+	received := make(chan *stomp.Message, 10)
+	handler := stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m.Clone()
+	})
+	if _, err := client.Subscribe("/topic/audit", handler,
+		stomp.WithReplayFrom(stomp.ReplayBeginning),
+		stomp.WithReceipt(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	client.Send("/topic/audit", []byte("5"), stomp.WithPersistence(), stomp.WithReceipt())
+	for i, want := range []string{"1", "2", "3", "4", "5"} {
+		m := waitMessage(t, received)
+		if string(m.Body) != want {
+			t.Errorf("Want message %s replayed in order, got %s", want, m.Body)
+		}
+		if offset := m.Header.GetInt(string(stomp.HeaderOffset)); offset != i+1 {
+			t.Errorf("Want offset %d, got %d", i+1, offset)
+		}
+	}
+
+	for from, want := range map[string]string{
+		"4":                            "4",
+		since.Format(time.RFC3339Nano): "4",
+		strings.Repeat("9", 10):        "",
+		"2001-01-01T00:00:00Z":         "1",
+	} {
+		replayed := make(chan *stomp.Message, 10)
+		sub, err := client.Subscribe("/topic/audit", stomp.HandlerFunc(func(m *stomp.Message) {
+			replayed <- m.Clone()
+		}), stomp.WithReplayFrom(from), stomp.WithReceipt())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == "" {
+			if len(replayed) != 0 {
+				t.Errorf("Want nothing replayed from %s, got %d messages", from, len(replayed))
+			}
+		} else if m := waitMessage(t, replayed); string(m.Body) != want {
+			t.Errorf("Want replay from %s to start at %s, got %s", from, want, m.Body)
+		}
+		sub.Unsubscribe()
+	}
+
+	if _, err := client.Subscribe("/topic/audit", handler, stomp.WithReplayFrom("yesterday"), stomp.WithReceipt()); err == nil {
+		t.Errorf("Want error for invalid replay-from header")
+	}
+	client.Disconnect()
+	s.router.store.close()
+
+	// offsets continue after a restart.
+	s = NewServer(WithStore(dir))
+	defer s.router.store.close()
+	client = s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	client.Send("/topic/audit", []byte("6"), stomp.WithPersistence(), stomp.WithReceipt())
+	replayed := make(chan *stomp.Message, 10)
+	client.Subscribe("/topic/audit", stomp.HandlerFunc(func(m *stomp.Message) {
+		replayed <- m.Clone()
+	}), stomp.WithReplayFrom("6"), stomp.WithReceipt())
+	if m := waitMessage(t, replayed); string(m.Body) != "6" {
+		t.Errorf("Want offsets continued after restart, got %s", m.Body)
+	}
+}
+
+func TestReplayUnavailable(t *testing.T) {
+	client := NewServer().Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	_, err := client.Subscribe("/topic/audit", stomp.HandlerFunc(func(*stomp.Message) {}),
+		stomp.WithReplayFrom(stomp.ReplayBeginning), stomp.WithReceipt())
+	if err == nil || !strings.Contains(err.Error(), ErrReplayUnavailable.Error()) {
+		t.Errorf("Want ErrReplayUnavailable, got %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// replicationDest is the reserved destination subscribed to by standby
+// nodes to receive the replication stream.
+var replicationDest = []byte("/replication")
+
+// replication stream headers.
+var (
+	headerReplicaOp   = []byte("replica-op")
+	headerReplicaID   = []byte("replica-id")
+	headerReplicaSync = []byte("replica-sync")
+
+	replicaPublish = []byte("publish")
+	replicaRemove  = []byte("remove")
+)
+
+// replicaTimeout is the time a message sent with the majority ack level
+// waits for standby nodes to acknowledge the message.
+var replicaTimeout = time.Second * 5
+
+// ErrReplicaTimeout is returned when a majority of replicas do not
+// acknowledge a message within the replica timeout.
+var ErrReplicaTimeout = errors.New("stomp: timeout waiting for replicas")
+
+// replicaSet streams queue state changes to standby nodes. Messages
+// published to queues are streamed as publish operations, and messages
+// delivered to consumers or expired are streamed as remove operations.
+// Replication is asynchronous unless the message requests the majority
+// ack level. Only authenticated sessions of the standby users may
+// subscribe to the replication stream.
+type replicaSet struct {
+	sync.Mutex
+	standbys map[string]struct{} // users allowed to replicate
+	subs     map[*subscription]*replica
+	pending  map[string]chan struct{}
+}
+
+// replica is a standby subscribed to the replication stream.
+type replica struct {
+	syncing bool             // the snapshot is being sent
+	backlog []*stomp.Message // operations streamed while syncing
+}
+
+func newReplicaSet(standbys ...string) *replicaSet {
+	rs := &replicaSet{
+		standbys: make(map[string]struct{}),
+		subs:     make(map[*subscription]*replica),
+		pending:  make(map[string]chan struct{}),
+	}
+	for _, user := range standbys {
+		rs.standbys[user] = struct{}{}
+	}
+	return rs
+}
+
+// users returns the standby users.
+func (rs *replicaSet) users() []string {
+	users := make([]string, 0, len(rs.standbys))
+	for user := range rs.standbys {
+		users = append(users, user)
+	}
+	return users
+}
+
+// allowed returns true if the session may subscribe to the replication
+// stream.
+func (rs *replicaSet) allowed(sess *session) bool {
+	if rs == nil || !sess.authenticated {
+		return false
+	}
+	_, ok := rs.standbys[string(sess.msg.User)]
+	return ok
+}
+
+// add adds the standby subscription and sends a snapshot of the queued
+// messages to the standby. Operations streamed while the snapshot is
+// sent are held back, and sent once the snapshot is complete, skipping
+// messages the snapshot already holds.
+func (rs *replicaSet) add(sub *subscription, r *router) {
+	logger.Noticef("stomp: standby %s subscribed to replication stream",
+		sub.session.peer.Addr(),
+	)
+
+	rs.Lock()
+	rs.subs[sub] = &replica{syncing: true}
+	rs.Unlock()
+
+	var queues []*queue
+	r.destinations.each(func(dest string, h handler) {
+		if q, ok := h.(*queue); ok {
+			queues = append(queues, q)
+		}
+	})
+
+	var snapshot []*stomp.Message
+	for _, q := range queues {
+		q.RLock()
+		for e := q.list.Front(); e != nil; e = e.Next() {
+			snapshot = append(snapshot, replicaFrame(sub, e.Value.(*stomp.Message), replicaPublish))
+		}
+		q.RUnlock()
+	}
+	sent := make(map[string]struct{}, len(snapshot))
+	for _, c := range snapshot {
+		sent[string(c.Header.Get(headerReplicaID))] = struct{}{}
+		sub.session.peer.Send(c)
+	}
+
+	for {
+		rs.Lock()
+		rep, ok := rs.subs[sub]
+		if !ok || len(rep.backlog) == 0 {
+			if ok {
+				rep.syncing = false
+			}
+			rs.Unlock()
+			return
+		}
+		backlog := rep.backlog
+		rep.backlog = nil
+		rs.Unlock()
+
+		for _, c := range backlog {
+			_, dup := sent[string(c.Header.Get(headerReplicaID))]
+			if dup && bytes.Equal(c.Header.Get(headerReplicaOp), replicaPublish) {
+				c.Release()
+				continue
+			}
+			sub.session.peer.Send(c)
+		}
+	}
+}
+
+// unsubscribe removes the standby subscription.
+func (rs *replicaSet) unsubscribe(sub *subscription) {
+	rs.Lock()
+	delete(rs.subs, sub)
+	rs.Unlock()
+}
+
+// disconnect removes the standby subscriptions held by the session.
+func (rs *replicaSet) disconnect(sess *session) {
+	if rs == nil {
+		return
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	for sub := range rs.subs {
+		if sub.session == sess {
+			delete(rs.subs, sub)
+		}
+	}
+}
+
+// len returns the number of standby nodes.
+func (rs *replicaSet) len() int {
+	if rs == nil {
+		return 0
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	return len(rs.subs)
+}
+
+// publish streams the queued message to the standby nodes.
+func (rs *replicaSet) publish(m *stomp.Message) {
+	rs.broadcast(m, replicaPublish)
+}
+
+// remove streams the removal of the queued message to the standby nodes.
+func (rs *replicaSet) remove(m *stomp.Message) {
+	rs.broadcast(m, replicaRemove)
+}
+
+// broadcast streams the operation to the standby nodes. The frames are
+// sent outside the lock, so that a slow standby does not block other
+// publishers.
+func (rs *replicaSet) broadcast(m *stomp.Message, op []byte) {
+	if rs == nil {
+		return
+	}
+	var live []*subscription
+	var frames []*stomp.Message
+	rs.Lock()
+	for sub, rep := range rs.subs {
+		c := replicaFrame(sub, m, op)
+		if rep.syncing {
+			rep.backlog = append(rep.backlog, c)
+			continue
+		}
+		live = append(live, sub)
+		frames = append(frames, c)
+	}
+	rs.Unlock()
+
+	// the replication stream bypasses session.send so that it is not
+	// counted as consumption of the destination.
+	for i, sub := range live {
+		sub.session.peer.Send(frames[i])
+	}
+}
+
+// replicaFrame returns the frame streaming the operation on the message
+// to the standby subscription.
+func replicaFrame(sub *subscription, m *stomp.Message, op []byte) *stomp.Message {
+	c := stomp.NewMessage()
+	c.Method = stomp.MethodMessage
+	c.ID = stomp.Rand()
+	c.Dest = append(c.Dest, m.Dest...)
+	c.Subs = sub.id
+	c.Header.Add(headerReplicaOp, op)
+	c.Header.Add(headerReplicaID, append([]byte(nil), m.ID...))
+	if bytes.Equal(op, replicaPublish) {
+		for i := 0; i < m.Header.Len(); i++ {
+			k, v := m.Header.Index(i)
+			c.Header.Add(
+				append([]byte(nil), k...),
+				append([]byte(nil), v...),
+			)
+		}
+		c.Expires = append(c.Expires, m.Expires...)
+		c.Body = append(c.Body, m.Body...)
+	}
+	return c
+}
+
+// expect registers the message to be acknowledged by the standby nodes
+// and returns a function that waits until a majority of the cluster,
+// counting this node, holds the message.
+func (rs *replicaSet) expect(m *stomp.Message) func() error {
+	id := stomp.Rand()
+	m.Header.Add(headerReplicaSync, id)
+
+	rs.Lock()
+	quorum := (len(rs.subs)+1)/2 + 1
+	acks := make(chan struct{}, len(rs.subs))
+	rs.pending[string(id)] = acks
+	rs.Unlock()
+
+	return func() error {
+		defer func() {
+			rs.Lock()
+			delete(rs.pending, string(id))
+			rs.Unlock()
+		}()
+
+		timeout := time.After(replicaTimeout)
+		for n := 1; n < quorum; n++ {
+			select {
+			case <-acks:
+			case <-timeout:
+				return ErrReplicaTimeout
+			}
+		}
+		return nil
+	}
+}
+
+// confirm records the acknowledgement of the message by a standby node.
+// It returns false if the acknowledgement is not for a replicated
+// message, or the session is not a registered standby.
+func (rs *replicaSet) confirm(sess *session, id []byte) bool {
+	if rs == nil {
+		return false
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	if !rs.registered(sess) {
+		return false
+	}
+	acks, ok := rs.pending[string(id)]
+	if ok {
+		select {
+		case acks <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// registered returns true if the session holds a subscription to the
+// replication stream. The caller must hold the lock.
+func (rs *replicaSet) registered(sess *session) bool {
+	for sub := range rs.subs {
+		if sub.session == sess {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// parked holds the state of a session that ended without a DISCONNECT
+// until the client resumes the session or the resumption timeout
+// expires. The session may only be resumed by the same identity.
+type parked struct {
+	user  string // authenticated identity, empty if unauthenticated
+	subs  []*subscription
+	acks  []*stomp.Message
+	timer *time.Timer
+}
+
+// identity returns the authenticated identity of the session, or the
+// empty string if the session is not authenticated.
+func identity(sess *session) string {
+	if !sess.authenticated {
+		return ""
+	}
+	return string(sess.msg.User)
+}
+
+// newToken returns a random session token.
+func newToken() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return []byte(hex.EncodeToString(b))
+}
+
+// park moves the subscriptions and unacknowledged messages of a
+// disconnected session to a holding area for resumption. It returns
+// false if the session is not eligible for resumption.
+func (r *router) park(sess *session) bool {
+	if r.resume == 0 || len(sess.token) == 0 || sess.graceful {
+		return false
+	}
+
+	p := &parked{user: identity(sess)}
+	for id, sub := range sess.sub {
+		delete(sess.sub, id)
+		if bytes.Equal(sub.dest, replicationDest) {
+			sub.release()
+			continue
+		}
+		sub.session = nil
+		sub.pending = 0
+		p.subs = append(p.subs, sub)
+	}
+	for id, m := range sess.ack {
+		delete(sess.ack, id)
+		p.acks = append(p.acks, m)
+	}
+
+	token := string(sess.token)
+	r.Lock()
+	r.parked[token] = p
+	p.timer = time.AfterFunc(r.resume, func() {
+		r.expire(token)
+	})
+	r.Unlock()
+
+	logger.Verbosef("stomp: session parked: %d subscriptions, %d unacknowledged messages",
+		len(p.subs),
+		len(p.acks),
+	)
+	return true
+}
+
+// unpark removes and returns the parked session state for the token,
+// or nil if the token is unknown or expired, or was parked by another
+// identity than the session's.
+func (r *router) unpark(sess *session, token []byte) *parked {
+	r.Lock()
+	p, ok := r.parked[string(token)]
+	if ok && p.user != identity(sess) {
+		r.Unlock()
+		logger.Noticef("stomp: session %s presented the resume token of another identity", sess.peer.Addr())
+		return nil
+	}
+	delete(r.parked, string(token))
+	r.Unlock()
+	if !ok {
+		return nil
+	}
+	p.timer.Stop()
+	return p
+}
+
+// expire discards the parked session state for the token. Subscriptions
+// are released and unacknowledged messages are requeued.
+func (r *router) expire(token string) {
+	r.Lock()
+	p, ok := r.parked[token]
+	delete(r.parked, token)
+	r.Unlock()
+	if !ok {
+		return
+	}
+	logger.Verbosef("stomp: parked session expired")
+
+	for _, sub := range p.subs {
+		r.dropParked(sub)
+	}
+	for _, m := range p.acks {
+		r.requeue(m)
+	}
+}
+
+// dropParked releases the parked subscription.
+func (r *router) dropParked(sub *subscription) {
+	if sub.durable != nil {
+		r.deactivate(sub.durable)
+	}
+	sub.release()
+}
+
+// requeue publishes the unacknowledged message of a parked session
+// again and releases it.
+func (r *router) requeue(m *stomp.Message) {
+	r.republish(m, r.publish)
+	m.Release()
+}
+
+// restore reattaches the parked subscriptions to the session and
+// redelivers the unacknowledged messages. Subscriptions the session is
+// no longer permitted to hold, or whose destination was deleted, are
+// dropped, and their unacknowledged messages requeued.
+func (r *router) restore(sess *session, p *parked) {
+	subs := p.subs[:0]
+	var handlers []handler
+	for _, sub := range p.subs {
+		if !sess.acl.allowed(permSubscribe, sub.dest) {
+			logger.Noticef("stomp: resume subscription %s: %s", sub.dest, ErrForbidden)
+			r.dropParked(sub)
+			continue
+		}
+		var h handler
+		if sub.durable == nil {
+			m := stomp.NewMessage()
+			m.Dest = append(m.Dest, sub.dest...)
+			var err error
+			h, err = r.handler(m, true)
+			m.Release()
+			if err != nil {
+				logger.Noticef("stomp: resume subscription %s: %s", sub.dest, err)
+				r.dropParked(sub)
+				continue
+			}
+		}
+		sub.session = sess
+		sess.Lock()
+		sess.sub[string(sub.id)] = sub
+		sess.Unlock()
+		subs = append(subs, sub)
+		handlers = append(handlers, h)
+	}
+	p.subs = subs
+	for _, m := range p.acks {
+		sess.Lock()
+		sub, ok := sess.sub[string(m.Subs)]
+		if ok {
+			sess.ack[string(m.Ack)] = m
+		}
+		sess.Unlock()
+		if !ok {
+			r.requeue(m)
+			continue
+		}
+		if sub.prefetch != 0 {
+			sub.PendingIncr()
+		}
+		c := m.Copy()
+		c.Header.Add(stomp.HeaderRedelivered, stomp.RedeliveredTrue)
+		sess.send(c)
+	}
+	for i, sub := range p.subs {
+		if sub.durable != nil {
+			r.resumeDurable(sess, sub)
+			continue
+		}
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodSubscribe
+		m.Dest = append(m.Dest, sub.dest...)
+		handlers[i].subscribe(sub, m)
+		m.Release()
+	}
+
+	logger.Verbosef("stomp: session resumed: %d subscriptions, %d unacknowledged messages",
+		len(p.subs),
+		len(p.acks),
+	)
+}
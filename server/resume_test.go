@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestResume(t *testing.T) {
+	router := newRouter()
+	router.resume = time.Minute
+
+	client, server := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = server
+	sess.token = newToken()
+
+	sub := stomp.NewMessage()
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/queue/test")
+	sub.Ack = stomp.AckClient
+	router.subscribe(sess, sub)
+
+	msg := stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	msg.Body = []byte("hello")
+	router.publish(msg)
+	<-client.Receive()
+
+	router.disconnect(sess)
+	if got := len(router.parked); got != 1 {
+		t.Fatalf("Expect session parked, got %d parked sessions", got)
+	}
+
+	// messages sent while the session is parked are queued.
+	msg = stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	msg.Body = []byte("world")
+	router.publish(msg)
+
+	client, server = stomp.Pipe()
+	resumed := requestSession()
+	resumed.peer = server
+	p := router.unpark(resumed, sess.token)
+	if p == nil {
+		t.Fatalf("Expect parked session for token")
+	}
+	router.restore(resumed, p)
+
+	got := <-client.Receive()
+	if !bytes.Equal(got.Body, []byte("hello")) {
+		t.Errorf("Expect unacknowledged message redelivered, got %q", got.Body)
+	}
+	if !bytes.Equal(got.Header.Get(stomp.HeaderRedelivered), stomp.RedeliveredTrue) {
+		t.Errorf("Expect redelivered header")
+	}
+	got = <-client.Receive()
+	if !bytes.Equal(got.Body, []byte("world")) {
+		t.Errorf("Expect queued message delivered, got %q", got.Body)
+	}
+	if !bytes.Equal(got.Subs, []byte("1")) {
+		t.Errorf("Expect subscription reattached, got id %q", got.Subs)
+	}
+	if got := len(resumed.ack); got != 2 {
+		t.Errorf("Expect 2 pending acks, got %d", got)
+	}
+}
+
+func TestResumeExpire(t *testing.T) {
+	router := newRouter()
+	router.resume = time.Millisecond
+
+	client, server := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = server
+	sess.token = newToken()
+
+	sub := stomp.NewMessage()
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/queue/test")
+	sub.Ack = stomp.AckClient
+	router.subscribe(sess, sub)
+
+	msg := stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	msg.Body = []byte("hello")
+	router.publish(msg)
+	<-client.Receive()
+
+	router.disconnect(sess)
+	time.Sleep(50 * time.Millisecond)
+
+	if router.unpark(sess, sess.token) != nil {
+		t.Errorf("Expect parked session expired")
+	}
+	h, _ := router.destinations.load("/queue/test")
+	q, ok := h.(*queue)
+	if !ok {
+		t.Fatalf("Expect unacknowledged message requeued")
+	}
+	q.RLock()
+	n := q.list.Len()
+	q.RUnlock()
+	if n != 1 {
+		t.Errorf("Expect unacknowledged message requeued, got %d messages", n)
+	}
+}
+
+func TestResumeIdentity(t *testing.T) {
+	router := newRouter()
+	router.resume = time.Minute
+
+	_, server := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = server
+	sess.token = newToken()
+	sess.authenticated = true
+	sess.msg = stomp.NewMessage()
+	sess.msg.User = []byte("alice")
+	router.disconnect(sess)
+
+	for _, user := range []string{"", "bob"} {
+		other := requestSession()
+		other.peer = server
+		other.msg = stomp.NewMessage()
+		if user != "" {
+			other.authenticated = true
+			other.msg.User = []byte(user)
+		}
+		if router.unpark(other, sess.token) != nil {
+			t.Errorf("Expect token refused for identity %q", user)
+		}
+	}
+	if router.unpark(sess, sess.token) == nil {
+		t.Errorf("Expect token accepted for the parking identity")
+	}
+}
+
+func TestResumeForbidden(t *testing.T) {
+	router := newRouter()
+	router.resume = time.Minute
+
+	client, server := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = server
+	sess.token = newToken()
+
+	sub := stomp.NewMessage()
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/queue/test")
+	sub.Ack = stomp.AckClient
+	router.subscribe(sess, sub)
+
+	msg := stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	msg.Body = []byte("hello")
+	router.publish(msg)
+	<-client.Receive()
+	router.disconnect(sess)
+
+	_, server = stomp.Pipe()
+	resumed := requestSession()
+	resumed.peer = server
+	resumed.acl = newACL([]string{"subscribe:/queue/other"})
+	p := router.unpark(resumed, sess.token)
+	if p == nil {
+		t.Fatalf("Expect parked session for token")
+	}
+	router.restore(resumed, p)
+
+	if got := len(resumed.sub); got != 0 {
+		t.Errorf("Expect forbidden subscription dropped, got %d", got)
+	}
+	if got := len(resumed.ack); got != 0 {
+		t.Errorf("Expect no pending acks, got %d", got)
+	}
+	h, _ := router.destinations.load("/queue/test")
+	q := h.(*queue)
+	q.RLock()
+	n := q.list.Len()
+	q.RUnlock()
+	if n != 1 {
+		t.Errorf("Expect unacknowledged message requeued, got %d messages", n)
+	}
+}
+
+func TestResumeGraceful(t *testing.T) {
+	router := newRouter()
+	router.resume = time.Minute
+
+	_, server := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = server
+	sess.token = newToken()
+	sess.graceful = true
+
+	router.disconnect(sess)
+	if got := len(router.parked); got != 0 {
+		t.Errorf("Expect graceful disconnect not parked, got %d", got)
+	}
+}
+
+func TestResumeClient(t *testing.T) {
+	s := NewServer(WithResumption(time.Minute))
+
+	a, b := stomp.Pipe()
+	go s.ServePeer(b)
+	client := stomp.New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if client.Session() == "" {
+		t.Fatalf("Want session token")
+	}
+
+	received := make(chan *stomp.Message, 10)
+	handler := stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m
+	})
+	if _, err := client.Subscribe("/queue/test", handler,
+		stomp.WithAck("client"),
+		stomp.WithReceipt(),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Close()
+	for i := 0; i < 100; i++ {
+		s.router.RLock()
+		n := len(s.router.parked)
+		s.router.RUnlock()
+		if n != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	a, b = stomp.Pipe()
+	go s.ServePeer(b)
+	resumed := stomp.New(a)
+	if err := resumed.Resume(client); err != nil {
+		t.Fatalf("Want session resumed, got %s", err)
+	}
+	if resumed.Session() != client.Session() {
+		t.Errorf("Want session token retained")
+	}
+
+	sender := s.Client()
+	if err := sender.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	sender.Send("/queue/test", []byte("hello"))
+
+	select {
+	case m := <-received:
+		if !bytes.Equal(m.Body, []byte("hello")) {
+			t.Errorf("Want message delivered to resumed subscription")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Want message delivered to resumed subscription")
+	}
+
+	a, b = stomp.Pipe()
+	go s.ServePeer(b)
+	if err := stomp.New(a).Resume(client); err != stomp.ErrSessionExpired {
+		t.Errorf("Want ErrSessionExpired resuming an active session, got %v", err)
+	}
+}
+
+func TestResumeExplicit(t *testing.T) {
+	router := newRouter()
+	router.resume = time.Minute
+	router.explicit = true
+	router.declare("/queue/test")
+
+	_, server := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = server
+	sess.token = newToken()
+
+	sub := stomp.NewMessage()
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/queue/test")
+	if err := router.subscribe(sess, sub); err != nil {
+		t.Fatal(err)
+	}
+	router.disconnect(sess)
+	if err := router.undeclare("/queue/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := requestSession()
+	resumed.peer = server
+	p := router.unpark(resumed, sess.token)
+	if p == nil {
+		t.Fatalf("Expect parked session for token")
+	}
+	router.restore(resumed, p)
+	if got := len(resumed.sub); got != 0 {
+		t.Errorf("Expect subscription to deleted destination dropped, got %d", got)
+	}
+	if _, ok := router.destinations.load("/queue/test"); ok {
+		t.Errorf("Expect deleted destination not recreated")
+	}
+}
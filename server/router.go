@@ -3,7 +3,10 @@ package server
 import (
 	"bytes"
 	"errors"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mrwill84/mq/logger"
 	"github.com/mrwill84/mq/stomp"
@@ -32,58 +35,202 @@ type handler interface {
 }
 
 type router struct {
+	published int64        // accessed atomically
+	epoch     int64        // accessed atomically
+	epochText atomic.Value // *epochText
+	samplers  atomic.Value // map[string]*sampler, copied on write
+	draining  int32        // accessed atomically
+
 	sync.RWMutex
-	authorizer   Authorizer
-	destinations map[string]handler
+	routerConfig
+	host         string
+	destinations *destMap
+	declared     map[string]struct{} // explicitly created destinations
+	reconnect    []byte              // broker address, while draining
 	sessions     map[*session]struct{}
+	limits       map[string]*limiter
+	store        store
+	log          *messageLog // nil unless messages are persisted
+	replicas     *replicaSet
+	acks         *ackMetrics
+	usage        *usageTracker
+	conns        *connTracker
+	events       *eventStream
+	dedup        *dedupCache         // nil unless deduplication is enabled
+	temps        map[string]*session // temporary queue scopes
+	parked       map[string]*parked
+	durables     map[string]*durable // durable subscriptions by key
+	wheel        *wheel              // delayed messages
+}
+
+// routerConfig is the configuration of a router set by options. The
+// router of a virtual host is created with a copy of the configuration
+// of the default router; see Server.addHost.
+type routerConfig struct {
+	authorizer   Authorizer
+	jwt          *jwtVerifier    // replaces the authorizer, if set
+	certs        CertAuthorizer  // replaces the authorizer and jwt, if set
+	explicit     bool            // require explicit destination creation
+	readOnly     []byte          // writable node address, if read-only
+	standby      *standby        // nil unless a standby of a primary
+	overflow     *overflowPolicy // disk overflow for deep queues
+	sessionLimit *Limit
+	quota        Quota            // session quota
+	userQuotas   map[string]Quota // session quota by username
+	critical     []string
+	compacted    []string // destination patterns compacted by key
+	defaults     []subscriptionDefaults
+	transforms   []transform
+	versions     *versionPolicy
+	mem          *memory // shared by the virtual hosts
+	clone        bool
+	sequence     bool
+	affinity     []byte        // session affinity token
+	slow         *slowPolicy   // nil unless slow consumers are detected
+	idle         time.Duration // idle destination timeout
+	sessionIdle  time.Duration // idle session timeout
+	resume       time.Duration // session resumption timeout
+	features     *features     // experimental behaviors
+	maxDelay     time.Duration // longest schedule delay, 0 for no limit
 }
 
 func newRouter() *router {
-	return &router{
-		destinations: make(map[string]handler),
+	r := &router{
+		routerConfig: routerConfig{
+			userQuotas: make(map[string]Quota),
+			mem:        new(memory),
+			maxDelay:   defaultMaxDelay,
+		},
+		destinations: newDestMap(defaultShards),
+		declared:     make(map[string]struct{}),
 		sessions:     make(map[*session]struct{}),
+		limits:       make(map[string]*limiter),
+		parked:       make(map[string]*parked),
+		durables:     make(map[string]*durable),
+		temps:        make(map[string]*session),
+		acks:         newAckMetrics(),
+		usage:        newUsageTracker(),
+		conns:        newConnTracker(),
+	}
+	r.wheel = newWheel(scheduleTick, r.deliver)
+	r.wheel.limit = defaultScheduled
+	r.epoch = nextEpoch(0)
+	return r
+}
+
+// publishAs publishes a message originated by the broker, such as by a
+// cron job, on behalf of an identity with the acl. The message is
+// subject to the checks of a SEND frame: read-only and draining mode,
+// the acl, admission and the destination transforms and schemas.
+func (r *router) publishAs(m *stomp.Message, a *acl) error {
+	switch {
+	case r.readOnly != nil:
+		return ErrReadOnly
+	case r.isDraining():
+		return ErrDraining
+	case !a.allowed(permSend, m.Dest):
+		return ErrForbidden
+	case isPresence(m.Dest):
+		return errPresenceSend
+	}
+	m.Header.Del(stomp.HeaderEpoch)
+	m.Header.Del(headerOriginalDest)
+	if err := r.admit(m.Dest); err != nil {
+		return err
 	}
+	if err := r.transform(m); err != nil {
+		return err
+	}
+	if err := r.publish(m); err != errNoDestination || r.explicit {
+		return err
+	}
+	return nil
 }
 
 // publish publishes the message to the brokered destination.
 func (r *router) publish(m *stomp.Message) error {
-	r.RLock()
-	h, ok := r.destinations[string(m.Dest)]
-	r.RUnlock()
+	return r.publishWait(m, nil)
+}
 
-	if !ok && !shouldCreate(m) {
-		return errNoDestination
+// publishWait publishes the message. If wait is not nil the message is
+// replicated and published to the queue once wait returns; see
+// queue.publishWait.
+func (r *router) publishWait(m *stomp.Message, wait func() error) error {
+	r.stamp(m)
+	if at := scheduledTime(m, time.Now()); !at.IsZero() && at.After(time.Now()) {
+		return r.schedule(m, at)
 	}
+	defer r.logMessage(m)()
 
-	// if shouldPersist(m) && r.storage != nil {
-	// 	r.storage.put(m)
-	// }
+	atomic.AddInt64(&r.published, 1)
+	r.sample(m)
 
-	if !ok {
-		r.Lock()
-		// this duplicate check prevents a possible race condition
-		// where the topic didn't exist when we checked above but
-		// exists now.
-		h, ok = r.destinations[string(m.Dest)]
-		if !ok {
-			h = createHandler(m)
-			r.destinations[string(m.Dest)] = h
-		}
-		r.Unlock()
+	h, err := r.handler(m, shouldCreate(m))
+	if err != nil {
+		return err
+	}
+	r.usage.published(m)
+	if q, ok := h.(*queue); ok && wait != nil {
+		return q.publishWait(m, wait)
 	}
 	return h.publish(m)
 }
 
+// publishSend publishes a message sent by a client, at the ack level
+// requested by the message.
+func (r *router) publishSend(m *stomp.Message) error {
+	if level := m.Header.Get(stomp.HeaderAckLevel); len(level) != 0 {
+		return r.publishLevel(m, level)
+	}
+	return r.publish(m)
+}
+
 // subscribe to the brokered destination.
 func (r *router) subscribe(sess *session, m *stomp.Message) (err error) {
-	r.Lock()
-	h, ok := r.destinations[string(m.Dest)]
-	if !ok {
-		h = createHandler(m)
-		r.destinations[string(m.Dest)] = h
+	if m.Header.GetBool("update") {
+		return r.update(sess, m)
 	}
-	r.Unlock()
-	return h.subscribe(sess.subs(m), m)
+	if err = r.applyDefaults(m); err != nil {
+		return err
+	}
+
+	if bytes.Equal(m.Dest, replicationDest) {
+		if !r.replicas.allowed(sess) {
+			return ErrForbidden
+		}
+		r.replicas.add(sess.subs(m), r)
+		return nil
+	}
+	if m.Header.GetBool("browse") {
+		return r.browse(sess, m)
+	}
+	if err = r.checkSubscriptions(sess, m); err != nil {
+		return err
+	}
+	if name := m.Header.Get(stomp.HeaderDurable); len(name) != 0 {
+		return r.subscribeDurable(sess, m, name)
+	}
+	if from := m.Header.Get(stomp.HeaderReplayFrom); len(from) != 0 {
+		return r.replay(sess, m, from)
+	}
+	return r.subscribeLive(sess, m, nil)
+}
+
+// subscribeLive subscribes to the messages published to the destination,
+// attaching the durable subscription if not nil.
+func (r *router) subscribeLive(sess *session, m *stomp.Message, d *durable) (err error) {
+	h, err := r.handler(m, true)
+	if err != nil {
+		return err
+	}
+	sub := sess.subs(m)
+	sub.durable = d
+	if err = h.subscribe(sub, m); err != nil {
+		return err
+	}
+	r.events.emit(Subscribed, sess, m.Dest, m.ID)
+	r.announce("join", sess, m.Dest, m.ID)
+	return nil
 }
 
 // unsubscribe from the brokered destination.
@@ -96,10 +243,16 @@ func (r *router) unsubscribe(sess *session, m *stomp.Message) (err error) {
 		return errNoSubscription
 	}
 	defer sess.unsub(sub)
+	if sub.durable != nil {
+		r.dropDurable(sub.durable)
+	}
 
-	r.Lock()
-	h, ok := r.destinations[string(sub.dest)]
-	r.Unlock()
+	if r.replicas != nil && bytes.Equal(sub.dest, replicationDest) {
+		r.replicas.unsubscribe(sub)
+		return nil
+	}
+
+	h, ok := r.destinations.load(string(sub.dest))
 	if !ok {
 		logger.Noticef("stomp: unsubscribe %s: destination not found: %s",
 			string(m.ID),
@@ -114,46 +267,76 @@ func (r *router) unsubscribe(sess *session, m *stomp.Message) (err error) {
 	)
 
 	defer r.collect(h)
-	return h.unsubscribe(sub, m)
+	if err = h.unsubscribe(sub, m); err != nil {
+		return err
+	}
+	r.events.emit(Unsubscribed, sess, sub.dest, m.ID)
+	r.announce("leave", sess, sub.dest, m.ID)
+	return nil
 }
 
 func (r *router) ack(sess *session, m *stomp.Message) {
+	// standby nodes acknowledge replicated messages sent with the
+	// majority ack level.
+	if r.replicas.confirm(sess, m.ID) {
+		return
+	}
+
 	sess.Lock()
 	ack, ok := sess.ack[string(m.ID)]
-	delete(sess.ack, string(m.ID))
+	var sub *subscription
+	if ok {
+		sub = sess.sub[string(ack.Subs)]
+	}
 	sess.Unlock()
 
-	if ok {
-		logger.Verbosef("stomp: ack %s: successful",
-			string(m.ID),
-		)
-	} else {
+	if !ok {
 		logger.Noticef("stomp: ack %s: message not found",
 			string(m.ID),
 		)
+		return
 	}
 
-	// if the subscription is still active, check the prefetch
-	// count and decrement pending prefetches.
-	// TODO this is probably not threadsafe. need to lock the subscription
-	// in the event that sub.prefetch is being accessed at the same time.
+	// in client mode the ack applies to all messages delivered to the
+	// subscription before the acknowledged message. In client-individual
+	// mode only the acknowledged message is removed.
+	ids := []string{string(m.ID)}
+	if sub != nil {
+		ids = sub.acked(m.ID, sub.cumulative)
+	}
+	var acked []*stomp.Message
 	sess.Lock()
-	sub, ok := sess.sub[string(ack.Subs)]
-	if ok && sub.Pending() > 0 {
-		sub.PendingDecr()
+	for _, id := range ids {
+		if m, ok := sess.ack[id]; ok {
+			acked = append(acked, m)
+		}
+		delete(sess.ack, id)
 	}
 	sess.Unlock()
+	for _, m := range acked {
+		r.settle(m)
+	}
+
+	logger.Verbosef("stomp: ack %s: successful: %d messages",
+		string(m.ID),
+		len(ids),
+	)
+
+	// if the subscription is still active, decrement pending prefetches.
+	if sub != nil {
+		for range ids {
+			sub.PendingDecr()
+		}
+	}
 
 	// if prefetch is enabled for the subscription we should re-process
 	// the queue now that the subscription pending ack cound is reduced.
-	if ok && sub.prefetch != 0 {
-		r.RLock()
-		h, ok := r.destinations[string(sub.dest)]
-		r.RUnlock()
-		if ok {
+	if sub != nil && sub.prefetch != 0 && sess.quota.Unacked == 0 {
+		if h, ok := r.destinations.load(string(sub.dest)); ok {
 			h.process()
 		}
 	}
+	r.resumeUnacked(sess)
 
 	// if r.storage != nil {
 	// 	r.storage.delete(m)
@@ -161,6 +344,25 @@ func (r *router) ack(sess *session, m *stomp.Message) {
 }
 
 func (r *router) nack(sess *session, m *stomp.Message) {
+	nack, ok := r.unack(sess, m)
+	if ok {
+		err := r.republish(nack, func(c *stomp.Message) error {
+			return r.redeliver(c, m)
+		})
+		if err != nil {
+			logger.Warningf("stomp: nack %s: %s; message dropped",
+				string(nack.Dest),
+				err,
+			)
+		}
+		r.resumeUnacked(sess)
+	}
+}
+
+// unack removes the message negatively acknowledged by m from the
+// messages awaiting an ack from the session and returns it. It returns
+// false if the message is not found.
+func (r *router) unack(sess *session, m *stomp.Message) (*stomp.Message, bool) {
 	sess.Lock()
 	nack, ok := sess.ack[string(m.ID)]
 	delete(sess.ack, string(m.ID))
@@ -177,37 +379,77 @@ func (r *router) nack(sess *session, m *stomp.Message) {
 
 	// if the subscription is still active, check the prefetch
 	// count and decrement pending prefetches.
-	sub, subscribed := sess.sub[string(nack.Subs)]
-	if subscribed && sub.Pending() > 0 {
-		sub.PendingDecr()
+	var sub *subscription
+	if ok {
+		sub = sess.sub[string(nack.Subs)]
 	}
 	sess.Unlock()
 
-	if ok {
-		nack.ID = m.Ack
-		nack.Ack = m.Ack[:0]
-		r.publish(nack)
+	// a nack applies to the individual message in all ack modes.
+	if sub != nil {
+		sub.acked(m.ID, false)
+		sub.PendingDecr()
 	}
+	return nack, ok
+}
+
+// settle removes the unacknowledged message from the datastore and the
+// standby nodes once it is acknowledged or published again.
+func (r *router) settle(m *stomp.Message) {
+	if r.store != nil && shouldPersist(m) {
+		r.store.delete(m)
+	}
+	r.replicas.remove(m)
+}
+
+// republish publishes the unacknowledged message again with publish and
+// then settles the delivered message, so that the message is held by
+// the datastore throughout.
+func (r *router) republish(m *stomp.Message, publish func(*stomp.Message) error) error {
+	delivered := m.Copy()
+	defer delivered.Release()
+	m.ID = m.Ack
+	m.Ack = m.Ack[:0]
+	err := publish(m)
+	r.settle(delivered)
+	return err
 }
 
 func (r *router) disconnect(sess *session) {
+	defer r.dropTemp(sess)
+	r.replicas.disconnect(sess)
+	r.conns.disconnect(sess)
+	if sess.msg != nil {
+		r.events.emit(SessionDisconnected, sess, nil, nil)
+	}
+
 	for _, sub := range sess.sub {
-		r.Lock()
-		h, ok := r.destinations[string(sub.dest)]
-		r.Unlock()
+		h, ok := r.destinations.load(string(sub.dest))
 		if !ok {
 			continue
 		}
 		h.disconnect(sess)
+		r.announce("leave", sess, sub.dest, sub.id)
 		r.collect(h)
 	}
 
+	// sessions that end without a DISCONNECT may be resumed, in which
+	// case unacknowledged messages are held for redelivery.
+	if r.park(sess) {
+		r.Lock()
+		delete(r.sessions, sess)
+		r.Unlock()
+		return
+	}
+
+	for _, sub := range sess.sub {
+		if sub.durable != nil {
+			r.deactivate(sub.durable)
+		}
+	}
 	for _, m := range sess.ack {
 		delete(sess.ack, string(m.Ack))
-
-		m.ID = m.Ack
-		m.Ack = m.Ack[:0]
-		r.publish(m)
+		r.republish(m, r.publish)
 	}
 
 	r.Lock()
@@ -215,68 +457,310 @@ func (r *router) disconnect(sess *session) {
 	r.Unlock()
 }
 
-func (r *router) collect(h handler) {
+// throttle applies the session and destination rate limits to the
+// message. It returns the duration the session is paused for, applying
+// backpressure to the producer, or an error if an exceeded limit is
+// configured to reject messages. Every limit is checked before tokens
+// are consumed, so a rejected message spends none.
+func (r *router) throttle(sess *session, m *stomp.Message) (time.Duration, error) {
+	r.RLock()
+	limiters := []*limiter{sess.quotaLimiter, sess.limiter, r.limits[string(m.Dest)]}
+	r.RUnlock()
+
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		d, reject := l.check(len(m.Body))
+		if d > 0 && reject {
+			logger.Noticef("stomp: send %s: rate limit exceeded",
+				string(m.Dest),
+			)
+			return 0, ErrRateLimited
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	for _, l := range limiters {
+		if l != nil {
+			l.take(len(m.Body))
+		}
+	}
+	return wait, nil
+}
+
+// setRateLimit sets the rate limit for the destination. If the
+// destination is empty the per-session rate limit is set. A nil
+// limit removes the rate limit.
+func (r *router) setRateLimit(dest string, limit *Limit) {
 	r.Lock()
-	if h.recycle() {
-		delete(r.destinations, h.destination())
+	defer r.Unlock()
+
+	if dest == "" {
+		r.sessionLimit = limit
+		for sess := range r.sessions {
+			switch {
+			case limit == nil:
+				sess.limiter = nil
+			case sess.limiter == nil:
+				sess.limiter = newLimiter(*limit)
+			default:
+				sess.limiter.set(*limit)
+			}
+		}
+		return
+	}
+
+	switch l, ok := r.limits[dest]; {
+	case limit == nil:
+		delete(r.limits, dest)
+	case ok:
+		l.set(*limit)
+	default:
+		r.limits[dest] = newLimiter(*limit)
 	}
-	r.Unlock()
 }
 
-func (r *router) serve(session *session) error {
-	message, ok := <-session.peer.Receive()
-	if !ok {
-		return nil
+// rateLimits returns the destination rate limits and the per-session
+// rate limit, if configured.
+func (r *router) rateLimits() (dests map[string]Limit, session *Limit) {
+	r.RLock()
+	defer r.RUnlock()
+
+	dests = make(map[string]Limit, len(r.limits))
+	for dest, l := range r.limits {
+		dests[dest] = l.get()
 	}
+	if r.sessionLimit != nil {
+		limit := *r.sessionLimit
+		session = &limit
+	}
+	return
+}
+
+func (r *router) collect(h handler) {
+	r.Lock()
+	if !r.isDeclared(h.destination()) && h.recycle() {
+		r.destinations.remove(h.destination())
+		r.usage.remove(h.destination())
+	}
+	r.Unlock()
+}
 
-	// the first message from the client should be STOMP
-	if !bytes.Equal(message.Method, stomp.MethodStomp) {
+func (r *router) serve(session *session, message *stomp.Message) error {
+	// the first message from the client should be STOMP, or CONNECT
+	// for clients using STOMP 1.0.
+	if !bytes.Equal(message.Method, stomp.MethodStomp) &&
+		!bytes.Equal(message.Method, stomp.MethodConnect) {
 		return errStompMethod
 	}
 
 	// optional message logging
 	logger.Debugf("stomp: received message from client.\n%s", message)
 
-	if r.authorizer != nil {
-		err := r.authorizer(message)
+	r.RLock()
+	auth, jwt, certs := r.authorizer, r.jwt, r.certs
+	r.RUnlock()
+	if certs != nil {
+		acl, err := r.authenticateCert(certs, session, message)
 		if err != nil {
 			return err
 		}
+		session.acl = acl
+	} else if jwt != nil {
+		acl, expires, err := jwt.authenticate(message)
+		if err != nil {
+			return err
+		}
+		session.acl = acl
+		session.expireAt(expires)
+	} else if auth != nil {
+		err := auth(message)
+		if err != nil {
+			return err
+		}
+	}
+	session.authenticated = certs != nil || jwt != nil || auth != nil
+	proto, err := stomp.Negotiate(message.Proto)
+	if err != nil {
+		// the error lists the supported versions in the version header.
+		session.sendError(message, err, func(e *stomp.Message) {
+			e.Proto = stomp.Versions
+		})
+		return err
 	}
+
 	session.init(message)
+	session.proto = proto
+	r.applyQuota(session, message.User)
+	if accept := message.Header.Get(stomp.HeaderAcceptEnc); accept != nil {
+		session.accept = append([]byte{}, accept...)
+	}
+
+	// issue a session token, or resume the previous session if the
+	// client presents a token for a parked session.
+	var resumed *parked
+	if r.resume != 0 {
+		if token := message.Header.Get(stomp.HeaderSession); len(token) != 0 {
+			if resumed = r.unpark(session, token); resumed != nil {
+				session.token = append([]byte(nil), token...)
+			}
+		}
+		if resumed == nil {
+			session.token = newToken()
+		}
+	}
+	r.versions.check(session, string(message.Header.Get(stomp.HeaderClient)))
 
+	r.conns.connect(session)
+	session.connected = time.Now()
 	r.Lock()
 	r.sessions[session] = struct{}{}
+	if r.sessionLimit != nil {
+		session.limiter = newLimiter(*r.sessionLimit)
+	}
 	r.Unlock()
+	r.events.emit(SessionConnected, session, nil, nil)
 
 	// send CONNECTED message indicating the client connection
 	// was accepted by the server.
 	connected := stomp.NewMessage()
 	connected.Method = stomp.MethodConnected
-	connected.Proto = stomp.STOMP
+	connected.Proto = proto
+	connected.Header.Add(stomp.HeaderServer, stomp.UserAgent)
+	connected.Header.Add(stomp.HeaderEpoch,
+		strconv.AppendInt(nil, atomic.LoadInt64(&r.epoch), 10),
+	)
+	if len(r.affinity) != 0 {
+		connected.Header.Add(stomp.HeaderAffinity, r.affinity)
+	}
+	if len(session.token) != 0 {
+		connected.Header.Add(stomp.HeaderSession, session.token)
+	}
+	if resumed != nil {
+		connected.Header.Add(stomp.HeaderResumed, stomp.ResumedTrue)
+	}
 	session.send(connected)
+	if resumed != nil {
+		r.restore(session, resumed)
+	}
 
 	for {
 		message, ok := <-session.peer.Receive()
 		if !ok {
 			return nil
 		}
+		session.touch(time.Now())
 
 		// optional message logging
-		logger.Debugf("stomp: received message from client.\n%s", message)
+		if logger.DebugEnabled() {
+			logger.Debugf("stomp: received message from client.\n%s", message)
+		}
 
 		switch {
 		case bytes.Equal(message.Method, stomp.MethodSend):
-			r.publish(message)
+			r.scopeTemp(session, message)
+			if r.rejectDraining(session, message) || r.rejectSend(session, message) {
+				message.Release()
+				continue
+			}
+			if !session.acl.allowed(permSend, message.Dest) {
+				session.sendError(message, ErrForbidden)
+				message.Release()
+				continue
+			}
+			if isPresence(message.Dest) {
+				session.sendError(message, errPresenceSend)
+				message.Release()
+				continue
+			}
+			// the epoch is stamped by the broker, so that a producer
+			// cannot fence its message into an earlier epoch, and the
+			// original destination is recorded by the broker, so that
+			// a producer cannot have a dead-lettered message moved to
+			// a destination it may not send to.
+			message.Header.Del(stomp.HeaderEpoch)
+			message.Header.Del(headerOriginalDest)
+			if err := r.admit(message.Dest); err != nil {
+				logger.Noticef("stomp: send %s: rejected, server overloaded",
+					string(message.Dest),
+				)
+				session.sendError(message, err,
+					stomp.WithHeader("retry-after", retryAfter),
+				)
+				message.Release()
+				continue
+			}
+			if wait, err := r.throttle(session, message); err != nil {
+				session.sendError(message, err)
+				message.Release()
+				continue
+			} else if !session.pause(wait) {
+				message.Release()
+				continue
+			}
+			if err := r.transform(message); err != nil {
+				session.sendError(message, err)
+				message.Release()
+				continue
+			}
+			// duplicates are acknowledged with a receipt, so that a
+			// retrying producer stops, but are not published.
+			key := r.dedup.key(message)
+			if r.isDuplicate(message, key) {
+				break
+			}
+			switch err := r.publishSend(message); {
+			case err == nil:
+			case err == errNoDestination && !r.explicit:
+				// messages to topics without subscribers are dropped.
+				r.dedup.release(key)
+			default:
+				r.dedup.release(key)
+				session.sendError(message, err)
+				message.Release()
+				continue
+			}
+			r.events.emit(MessagePublished, session, message.Dest, nil)
 		case bytes.Equal(message.Method, stomp.MethodSubscribe):
-			r.subscribe(session, message)
+			r.scopeTemp(session, message)
+			if r.rejectDraining(session, message) {
+				message.Release()
+				continue
+			}
+			if !session.acl.allowed(permSubscribe, message.Dest) {
+				session.sendError(message, ErrForbidden)
+				message.Release()
+				continue
+			}
+			if err := r.subscribe(session, message); err != nil {
+				session.sendError(message, err)
+				message.Release()
+				continue
+			}
 		case bytes.Equal(message.Method, stomp.MethodUnsubscribe):
 			r.unsubscribe(session, message)
 		case bytes.Equal(message.Method, stomp.MethodAck):
 			r.ack(session, message)
 		case bytes.Equal(message.Method, stomp.MethodNack):
+			if !stomp.SupportsNack(session.proto) {
+				session.sendError(message, stomp.ErrNack)
+				message.Release()
+				continue
+			}
 			r.nack(session, message)
 		case bytes.Equal(message.Method, stomp.MethodDisconnect):
+			session.graceful = true
+			// acknowledge the disconnect so the client knows all prior
+			// messages were processed before the connection is closed.
+			if len(message.Receipt) != 0 {
+				receipt := stomp.NewMessage()
+				receipt.Method = stomp.MethodRecipet
+				receipt.Receipt = append([]byte(nil), message.Receipt...)
+				session.send(receipt)
+			}
 			message.Release()
 			return nil
 		}
@@ -284,28 +768,80 @@ func (r *router) serve(session *session) error {
 		if len(message.Receipt) != 0 {
 			receipt := stomp.NewMessage()
 			receipt.Method = stomp.MethodRecipet
-			receipt.Receipt = message.Receipt
+			receipt.Receipt = append([]byte(nil), message.Receipt...)
+			if bytes.Equal(message.Method, stomp.MethodSubscribe) {
+				echoSubscription(receipt, message)
+			}
 			session.send(receipt)
 		}
 		message.Release()
 	}
 }
 
+// echoSubscription adds the effective subscription settings to the
+// receipt message.
+func echoSubscription(receipt, m *stomp.Message) {
+	ack := m.Ack
+	if len(ack) == 0 {
+		ack = stomp.AckAuto
+	}
+	receipt.Header.Add(stomp.HeaderAck, ack)
+	if len(m.Prefetch) != 0 {
+		receipt.Header.Add(stomp.HeaderPrefetch, m.Prefetch)
+	}
+}
+
 func shouldPersist(m *stomp.Message) bool {
-	return len(m.Persist) != 0 && bytes.Equal(m.Persist, stomp.PersistTrue)
+	return len(m.Persist) != 0 && bytes.Equal(m.Persist, stomp.PersistTrue) ||
+		shouldSync(m)
+}
+
+// shouldSync returns true if the message requests the fsync ack level.
+func shouldSync(m *stomp.Message) bool {
+	return bytes.Equal(m.Header.Get(stomp.HeaderAckLevel), stomp.AckLevelFsync)
 }
 
 func shouldCreate(m *stomp.Message) bool {
 	return bytes.HasPrefix(m.Dest, routeTopic) == false || len(m.Retain) != 0
 }
 
-func createHandler(m *stomp.Message) handler {
+// handler returns the handler of the message destination, creating the
+// destination if it does not exist and create is true. Destinations are
+// only created if declared, unless the router creates destinations on
+// demand or the destination is temporary or a presence topic.
+func (r *router) handler(m *stomp.Message, create bool) (handler, error) {
+	if h, ok := r.destinations.load(string(m.Dest)); ok {
+		return h, nil
+	}
+	if !create || r.explicit && !isTemp(m.Dest) && !isPresence(m.Dest) {
+		return nil, errNoDestination
+	}
+	h, _ := r.destinations.loadOrCreate(string(m.Dest), func() handler {
+		return r.createHandler(m)
+	})
+	return h, nil
+}
+
+// createHandler returns the handler of a new destination. Callers other
+// than declare create destinations through handler.
+func (r *router) createHandler(m *stomp.Message) handler {
+	r.usage.track(m.Dest)
 	switch {
-	case bytes.HasPrefix(m.Dest, routeTopic):
-		return newTopic(m.Dest)
-	case bytes.HasPrefix(m.Dest, routeQueue):
-		return newQueue(m.Dest)
+	case bytes.HasPrefix(m.Dest, routeTopic), isPresence(m.Dest):
+		t := newTopic(m.Dest)
+		t.clone = r.clone
+		t.sequence = r.sequence
+		t.compacts = r.compacts
+		return t
 	default:
-		return newQueue(m.Dest)
+		q := newQueue(m.Dest)
+		q.mem = r.mem
+		q.store = r.store
+		q.replicas = r.replicas
+		q.clone = r.clone
+		q.sequence = r.sequence
+		q.features = r.features
+		q.overflow = r.overflow.open()
+		return q
 	}
 }
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/mrwill84/mq/stomp"
 )
@@ -41,6 +42,51 @@ func TestAck(t *testing.T) {
 	}
 }
 
+func TestAckModes(t *testing.T) {
+	tests := []struct {
+		mode    []byte
+		pending int
+	}{
+		// in client mode the ack applies to all prior messages.
+		{stomp.AckClient, 1},
+		// in client-individual mode the ack applies to one message.
+		{stomp.AckClientIndividual, 2},
+	}
+
+	for _, test := range tests {
+		client, server := stomp.Pipe()
+
+		sub := stomp.NewMessage()
+		sub.Dest = []byte("/queue/test")
+		sub.Ack = test.mode
+		sess := requestSession()
+		sess.peer = server
+
+		router := newRouter()
+		router.subscribe(sess, sub)
+
+		var acks [][]byte
+		for i := 0; i < 3; i++ {
+			msg := stomp.NewMessage()
+			msg.Dest = []byte("/queue/test")
+			msg.Body = []byte("hello")
+			router.publish(msg)
+			got := <-client.Receive()
+			acks = append(acks, got.Ack)
+		}
+
+		ack := stomp.NewMessage()
+		ack.ID = acks[1]
+		router.ack(sess, ack)
+		if got := len(sess.ack); got != test.pending {
+			t.Errorf("Expect %d pending acks in %s mode, got %d", test.pending, test.mode, got)
+		}
+		if _, ok := sess.ack[string(acks[2])]; !ok {
+			t.Errorf("Expect later message ack pending in %s mode", test.mode)
+		}
+	}
+}
+
 func TestAckDisconnect(t *testing.T) {
 	client, server := stomp.Pipe()
 
@@ -59,7 +105,8 @@ func TestAckDisconnect(t *testing.T) {
 	router := newRouter()
 	router.publish(msg)
 
-	queue := router.destinations["/queue/test"].(*queue)
+	h, _ := router.destinations.load("/queue/test")
+	queue := h.(*queue)
 	// verify the queue has a single item
 	if got := queue.list.Len(); got != 1 {
 		t.Errorf("Expect queue has 1 message enqueued. Got %d", got)
@@ -97,3 +144,170 @@ func TestAckDisconnect(t *testing.T) {
 		t.Errorf("Expect message re-added to the queue")
 	}
 }
+
+func TestVirtualHostNamespace(t *testing.T) {
+	s := NewServer(WithVirtualHost("tenant", nil))
+
+	msg := stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	msg.Body = []byte("bonjour")
+	s.lookup([]byte("tenant")).publish(msg)
+
+	if _, ok := s.router.destinations.load("/queue/test"); ok {
+		t.Errorf("Expect virtual host destination hidden from default router")
+	}
+	if _, ok := s.hosts["tenant"].destinations.load("/queue/test"); !ok {
+		t.Errorf("Expect destination created in virtual host")
+	}
+	if got := s.hosts["tenant"].published; got != 1 {
+		t.Errorf("Expect virtual host published count 1, got %d", got)
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	s := NewServer()
+	a, b := stomp.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServePeer(b)
+		close(done)
+	}()
+
+	connect := stomp.NewMessage()
+	connect.Method = stomp.MethodConnect
+	connect.Proto = []byte("1.0")
+	a.Send(connect)
+
+	connected := <-a.Receive()
+	if !bytes.Equal(connected.Method, stomp.MethodConnected) {
+		t.Fatalf("Expect CONNECTED, got %s", connected.Method)
+	}
+	if !bytes.Equal(connected.Proto, stomp.STOMP10) {
+		t.Errorf("Expect negotiated version 1.0, got %s", connected.Proto)
+	}
+
+	nack := stomp.NewMessage()
+	nack.Method = stomp.MethodNack
+	nack.ID = []byte("1")
+	a.Send(nack)
+
+	if got := <-a.Receive(); !bytes.Equal(got.Method, stomp.MethodError) {
+		t.Errorf("Expect ERROR sending NACK using STOMP 1.0, got %s", got.Method)
+	}
+	a.Close()
+	<-done
+}
+
+func TestVersionUnsupported(t *testing.T) {
+	s := NewServer()
+	a, b := stomp.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServePeer(b)
+		close(done)
+	}()
+
+	connect := stomp.NewMessage()
+	connect.Method = stomp.MethodStomp
+	connect.Proto = []byte("2.0")
+	a.Send(connect)
+
+	got := <-a.Receive()
+	if !bytes.Equal(got.Method, stomp.MethodError) {
+		t.Errorf("Expect ERROR for unsupported version, got %s", got.Method)
+	}
+	if !bytes.Equal(got.Proto, stomp.Versions) {
+		t.Errorf("Expect supported versions in ERROR, got %q", got.Proto)
+	}
+	<-done
+}
+
+func TestNackRequeue(t *testing.T) {
+	tests := []struct {
+		src      string
+		opts     []stomp.MessageOption
+		dest     string
+		delayed  bool
+		explicit bool
+	}{
+		{"/queue/test", nil, "/queue/test", false, false},
+		{"/queue/test", []stomp.MessageOption{stomp.WithRequeue(true)}, "/queue/test", false, false},
+		{"/queue/test", []stomp.MessageOption{stomp.WithRequeue(false)}, "/queue/dlq/test", false, false},
+		{"/queue/test", []stomp.MessageOption{stomp.WithRetryAfter(time.Minute)}, "/queue/test", true, false},
+		// a dead-lettered message is not dead-lettered again.
+		{"/queue/dlq/test", []stomp.MessageOption{stomp.WithRequeue(false)}, "/queue/dlq/test", false, false},
+		// a message is kept if the dead-letter queue does not exist.
+		{"/queue/test", []stomp.MessageOption{stomp.WithRequeue(false)}, "/queue/test", false, true},
+	}
+
+	for _, test := range tests {
+		client, server := stomp.Pipe()
+
+		sub := stomp.NewMessage()
+		sub.Dest = []byte(test.src)
+		sub.Ack = stomp.AckClientIndividual
+		sess := requestSession()
+		sess.peer = server
+
+		router := newRouter()
+		if test.explicit {
+			router.declare(test.src)
+		}
+		router.subscribe(sess, sub)
+
+		msg := stomp.NewMessage()
+		msg.Dest = []byte(test.src)
+		msg.Body = []byte("hello")
+		router.publish(msg)
+		got := <-client.Receive()
+		router.explicit = test.explicit
+
+		// unsubscribe so the requeued message remains in the queue.
+		unsub := stomp.NewMessage()
+		unsub.ID = sub.ID
+		router.unsubscribe(sess, unsub)
+
+		nack := stomp.NewMessage()
+		nack.ID = got.Ack
+		nack.Apply(test.opts...)
+		router.nack(sess, nack)
+
+		if got := router.wheel.len() == 1; got != test.delayed {
+			t.Errorf("Expect message delayed %v, got %v", test.delayed, got)
+		}
+		if test.delayed {
+			continue
+		}
+		h, _ := router.destinations.load(test.dest)
+		q, ok := h.(*queue)
+		if !ok || q.list.Len() != 1 {
+			t.Errorf("Expect message redelivered to %s", test.dest)
+			continue
+		}
+		m := q.list.Front().Value.(*stomp.Message)
+		if test.dest != test.src && string(m.Header.Get(headerOriginalDest)) != test.src {
+			t.Errorf("Expect dead-lettered message to record the original destination")
+		}
+		if router.destinations.len() != 1 && test.dest == test.src {
+			t.Errorf("Expect no dead-letter queue created for %s", test.src)
+		}
+	}
+}
+
+func TestRetryAfterDelay(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		delay time.Duration
+	}{
+		{"", 0},
+		{"-1", 0},
+		{"1.5", 1500 * time.Millisecond},
+		{"1e12", maxRetryAfter},
+	} {
+		nack := stomp.NewMessage()
+		nack.Header.Add(stomp.HeaderRetryAfter, []byte(test.value))
+		if got := retryAfterDelay(nack); got != test.delay {
+			t.Errorf("Expect retry-after %q delay %s, got %s", test.value, test.delay, got)
+		}
+	}
+}
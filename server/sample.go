@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// redacted replaces redacted header values and body content.
+var redacted = []byte("[REDACTED]")
+
+// SamplePolicy defines how messages sent to a destination are sampled
+// to the log for troubleshooting.
+type SamplePolicy struct {
+	Rate     float64  `json:"rate"`     // fraction of messages logged, from 0 to 1
+	MaxBody  int      `json:"max_body"` // maximum body bytes logged
+	Headers  []string `json:"headers"`  // header names with redacted values
+	Patterns []string `json:"patterns"` // regular expressions redacted from the body
+}
+
+// sampler logs a sampled subset of messages.
+type sampler struct {
+	policy   SamplePolicy
+	headers  map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+func newSampler(policy SamplePolicy) (*sampler, error) {
+	s := &sampler{
+		policy:  policy,
+		headers: make(map[string]struct{}),
+	}
+	for _, name := range policy.Headers {
+		s.headers[strings.ToLower(name)] = struct{}{}
+	}
+	for _, pattern := range policy.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s, nil
+}
+
+// sample logs the message if selected by the sample rate.
+func (s *sampler) sample(m *stomp.Message) {
+	if rand.Float64() >= s.policy.Rate {
+		return
+	}
+
+	var headers bytes.Buffer
+	for i := 0; i < m.Header.Len(); i++ {
+		k, v := m.Header.Index(i)
+		if _, ok := s.headers[strings.ToLower(string(k))]; ok {
+			v = redacted
+		}
+		headers.Write(k)
+		headers.WriteByte(':')
+		headers.Write(v)
+		headers.WriteByte(' ')
+	}
+
+	// the body is redacted before it is truncated, so that a match cut
+	// off at the boundary is still redacted.
+	body := m.Body
+	for _, re := range s.patterns {
+		body = re.ReplaceAll(body, redacted)
+	}
+	truncated := false
+	if s.policy.MaxBody > 0 && len(body) > s.policy.MaxBody {
+		body = body[:s.policy.MaxBody]
+		truncated = true
+	}
+
+	logger.Printf("stomp: sample: destination=%s size=%d truncated=%v headers=%q body=%q",
+		string(m.Dest),
+		len(m.Body),
+		truncated,
+		strings.TrimSpace(headers.String()),
+		body,
+	)
+}
+
+// setSamplePolicy sets the sample policy for the destination. A nil
+// policy disables sampling for the destination.
+func (r *router) setSamplePolicy(dest string, policy *SamplePolicy) error {
+	var s *sampler
+	if policy != nil {
+		var err error
+		if s, err = newSampler(*policy); err != nil {
+			return err
+		}
+	}
+
+	// the samplers are copied on write, so that publishing reads them
+	// without taking the router lock.
+	r.Lock()
+	defer r.Unlock()
+	prev := r.loadSamplers()
+	samplers := make(map[string]*sampler, len(prev)+1)
+	for k, v := range prev {
+		samplers[k] = v
+	}
+	if s == nil {
+		delete(samplers, dest)
+	} else {
+		samplers[dest] = s
+	}
+	r.samplers.Store(samplers)
+	return nil
+}
+
+// loadSamplers returns the destination samplers, which must not be
+// modified.
+func (r *router) loadSamplers() map[string]*sampler {
+	samplers, _ := r.samplers.Load().(map[string]*sampler)
+	return samplers
+}
+
+// samplePolicies returns the destination sample policies.
+func (r *router) samplePolicies() map[string]SamplePolicy {
+	samplers := r.loadSamplers()
+	policies := make(map[string]SamplePolicy, len(samplers))
+	for dest, s := range samplers {
+		policies[dest] = s.policy
+	}
+	return policies
+}
+
+// sample logs the message if sampling is enabled for the destination.
+func (r *router) sample(m *stomp.Message) {
+	if s, ok := r.loadSamplers()[string(m.Dest)]; ok {
+		s.sample(m)
+	}
+}
+
+// HandleSampling reads and writes the message sample policies. A GET
+// request writes a JSON-encoded map of destination sample policies to the
+// http.Request. A POST request sets the sample policy for the destination
+// query parameter, and a DELETE request disables sampling. POST, PUT
+// and DELETE requests require admin authentication.
+func (s *Server) HandleSampling(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "PUT", "DELETE":
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+	}
+	router := s.lookup([]byte(r.FormValue("host")))
+	if router == nil {
+		http.Error(w, ErrUnknownHost.Error(), http.StatusNotFound)
+		return
+	}
+	dest := r.FormValue("destination")
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(router.samplePolicies())
+	case "POST", "PUT":
+		policy := SamplePolicy{}
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := router.setSamplePolicy(dest, &policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		router.setSamplePolicy(dest, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// recorder is a logger that records default messages.
+type recorder struct {
+	lines []string
+}
+
+func (r *recorder) Debugf(string, ...interface{})   {}
+func (r *recorder) Verbosef(string, ...interface{}) {}
+func (r *recorder) Noticef(string, ...interface{})  {}
+func (r *recorder) Warningf(string, ...interface{}) {}
+func (r *recorder) Printf(format string, args ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+func Test_sampler(t *testing.T) {
+	rec := &recorder{}
+	defer logger.SetLogger(logger.GetLogger())
+	logger.SetLogger(rec)
+
+	s, err := newSampler(SamplePolicy{
+		Rate:     1,
+		MaxBody:  24,
+		Headers:  []string{"Authorization"},
+		Patterns: []string{`\d{4}-\d{4}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/orders")
+	m.Header.Add([]byte("authorization"), []byte("secret"))
+	m.Body = []byte("card 1234-5678 ordered three widgets")
+	defer m.Release()
+	s.sample(m)
+
+	if len(rec.lines) != 1 {
+		t.Fatalf("expect sampled message logged")
+	}
+	line := rec.lines[0]
+	if strings.Contains(line, "secret") || strings.Contains(line, "1234-5678") {
+		t.Errorf("expect header and body redacted, got %s", line)
+	}
+	if strings.Contains(line, "widgets") || !strings.Contains(line, "truncated=true") {
+		t.Errorf("expect body truncated, got %s", line)
+	}
+
+	// a match cut off by the body limit is redacted.
+	s.policy.MaxBody = 8
+	s.sample(m)
+	if line := rec.lines[1]; strings.Contains(line, "123") {
+		t.Errorf("expect body redacted before truncation, got %s", line)
+	}
+
+	if _, err := newSampler(SamplePolicy{Patterns: []string{"("}}); err == nil {
+		t.Errorf("expect error compiling invalid redaction pattern")
+	}
+}
+
+func TestHandleSampling(t *testing.T) {
+	s := NewServer()
+	body := `{"rate": 1}`
+	w := httptest.NewRecorder()
+	s.HandleSampling(w, httptest.NewRequest("POST", "/meta/sampling?destination=/queue/test", strings.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Want sample policy rejected without the admin header, got %d", w.Code)
+	}
+	if _, ok := s.router.samplePolicies()["/queue/test"]; ok {
+		t.Errorf("Want sample policy not set")
+	}
+
+	r := httptest.NewRequest("POST", "/meta/sampling?destination=/queue/test", strings.NewReader(body))
+	r.Header.Set(HeaderAdminRequest, "1")
+	w = httptest.NewRecorder()
+	s.HandleSampling(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Want sample policy set, got %d", w.Code)
+	}
+	if _, ok := s.router.samplePolicies()["/queue/test"]; !ok {
+		t.Errorf("Want sample policy for the destination")
+	}
+}
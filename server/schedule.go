@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+var (
+	// ErrScheduleDelay is returned when a message is scheduled further
+	// ahead than the maximum delay.
+	ErrScheduleDelay = errors.New("stomp: scheduled delay too long")
+
+	// ErrScheduleFull is returned when a message is scheduled and the
+	// server already holds the maximum number of scheduled messages.
+	ErrScheduleFull = errors.New("stomp: too many scheduled messages")
+)
+
+// Default scheduling limits, see WithScheduleLimits.
+var (
+	defaultMaxDelay  = 7 * 24 * time.Hour
+	defaultScheduled = 100000
+)
+
+// scheduleTick is the resolution of the delayed delivery timer wheel.
+var scheduleTick = 10 * time.Millisecond
+
+// wheelSize is the number of slots in the timer wheel. Messages delayed
+// longer than a full rotation wait additional rounds in their slot.
+const wheelSize = 512
+
+// scheduled is a message waiting in the timer wheel.
+type scheduled struct {
+	m      *stomp.Message
+	rounds int
+}
+
+// wheel is a hashed timer wheel holding delayed messages until they are
+// due. The wheel only ticks while it holds messages.
+type wheel struct {
+	sync.Mutex
+	slots   [wheelSize][]scheduled
+	pos     int
+	count   int
+	running bool
+	limit   int // messages held, 0 for no limit
+
+	interval time.Duration // slot duration
+	fire     func(*stomp.Message)
+}
+
+func newWheel(interval time.Duration, fire func(*stomp.Message)) *wheel {
+	return &wheel{interval: interval, fire: fire}
+}
+
+// add inserts the message into the wheel to fire after the delay. It
+// returns false if the wheel is full.
+func (w *wheel) add(m *stomp.Message, delay time.Duration) bool {
+	ticks := int((delay + w.interval - 1) / w.interval)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if w.limit > 0 && w.count >= w.limit {
+		return false
+	}
+	slot := (w.pos + ticks) % wheelSize
+	w.slots[slot] = append(w.slots[slot], scheduled{m: m, rounds: (ticks - 1) / wheelSize})
+	w.count++
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	return true
+}
+
+// len returns the number of messages in the wheel.
+func (w *wheel) len() (n int) {
+	w.Lock()
+	n = w.count
+	w.Unlock()
+	return
+}
+
+func (w *wheel) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !w.tick() {
+			return
+		}
+	}
+}
+
+// tick advances the wheel by one slot and fires the due messages. It
+// returns false once the wheel is empty and stops ticking.
+func (w *wheel) tick() bool {
+	w.Lock()
+	w.pos = (w.pos + 1) % wheelSize
+	var due []*stomp.Message
+	pending := w.slots[w.pos][:0]
+	for _, s := range w.slots[w.pos] {
+		if s.rounds > 0 {
+			s.rounds--
+			pending = append(pending, s)
+			continue
+		}
+		due = append(due, s.m)
+	}
+	w.slots[w.pos] = pending
+	w.count -= len(due)
+	running := w.count != 0
+	w.running = running
+	w.Unlock()
+
+	for _, m := range due {
+		w.fire(m)
+	}
+	return running
+}
+
+// scheduledTime returns the time at which the message should be
+// delivered, or the zero time if the message is not delayed. The
+// scheduled-time header, in milliseconds since the Unix epoch, takes
+// precedence over the delay header, in milliseconds.
+func scheduledTime(m *stomp.Message, now time.Time) time.Time {
+	if ms := m.Header.GetInt64(string(stomp.HeaderSchedule)); ms != 0 {
+		return time.Unix(0, ms*int64(time.Millisecond))
+	}
+	if ms := m.Header.GetInt64(string(stomp.HeaderDelay)); ms > 0 {
+		return now.Add(time.Duration(ms) * time.Millisecond)
+	}
+	return time.Time{}
+}
+
+// schedule holds a copy of the message until the scheduled time. The
+// delay is converted to a scheduled time so that messages restored from
+// the datastore after a restart are delivered at the original time.
+// Scheduled messages count against the memory limit.
+func (r *router) schedule(m *stomp.Message, at time.Time) error {
+	if r.maxDelay > 0 && at.Sub(time.Now()) > r.maxDelay {
+		return ErrScheduleDelay
+	}
+	c := m.Copy()
+	c.ID = stomp.Rand()
+	if len(c.Header.Get(stomp.HeaderSchedule)) == 0 {
+		ms := at.UnixNano() / int64(time.Millisecond)
+		c.Header.Add(stomp.HeaderSchedule, strconv.AppendInt(nil, ms, 10))
+	}
+	if r.store != nil {
+		if err := r.store.put(c, shouldSync(m)); err != nil {
+			c.Release()
+			return err
+		}
+	}
+	r.mem.alloc(len(c.Body))
+	if !r.wheel.add(c, at.Sub(time.Now())) {
+		r.unschedule(c)
+		c.Release()
+		return ErrScheduleFull
+	}
+	logger.Verbosef("stomp: send %s: scheduled for %s",
+		string(m.Dest),
+		at.Format(time.RFC3339),
+	)
+	return nil
+}
+
+// unschedule removes the scheduled message from the memory usage and
+// the datastore.
+func (r *router) unschedule(m *stomp.Message) {
+	r.mem.free(len(m.Body))
+	if r.store != nil {
+		r.store.delete(m)
+	}
+}
+
+// deliver publishes a scheduled message once it is due.
+func (r *router) deliver(m *stomp.Message) {
+	r.unschedule(m)
+	if err := r.publish(m); err != nil {
+		logger.Noticef("stomp: send %s: scheduled message dropped: %s",
+			string(m.Dest),
+			err,
+		)
+	}
+	m.Release()
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestWheel(t *testing.T) {
+	var fired []*stomp.Message
+	w := newWheel(time.Hour, func(m *stomp.Message) {
+		fired = append(fired, m)
+	})
+
+	// the ticker does not fire during the test, the wheel is advanced
+	// manually.
+	w.add(stomp.NewMessage(), 3*time.Hour)
+	w.add(stomp.NewMessage(), (wheelSize+2)*time.Hour)
+	if got := w.len(); got != 2 {
+		t.Errorf("Expect 2 scheduled messages, got %d", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		w.tick()
+	}
+	if len(fired) != 0 {
+		t.Errorf("Expect message not fired before it is due")
+	}
+	w.tick()
+	if len(fired) != 1 {
+		t.Errorf("Expect message fired when due")
+	}
+	for i := 3; i < wheelSize+1; i++ {
+		w.tick()
+	}
+	if len(fired) != 1 {
+		t.Errorf("Expect message delayed a full rotation not fired early")
+	}
+	if running := w.tick(); running {
+		t.Errorf("Expect wheel stopped once empty")
+	}
+	if len(fired) != 2 {
+		t.Errorf("Expect message delayed a full rotation fired when due")
+	}
+}
+
+func TestScheduledTime(t *testing.T) {
+	now := time.Unix(100, 0)
+
+	m := stomp.NewMessage()
+	if got := scheduledTime(m, now); !got.IsZero() {
+		t.Errorf("Expect zero time for messages without delay")
+	}
+	stomp.WithDelay(time.Second)(m)
+	if got := scheduledTime(m, now); !got.Equal(now.Add(time.Second)) {
+		t.Errorf("Expect delay relative to now, got %s", got)
+	}
+	stomp.WithScheduledTime(time.Unix(200, 0))(m)
+	if got := scheduledTime(m, now); !got.Equal(time.Unix(200, 0)) {
+		t.Errorf("Expect scheduled time takes precedence over delay, got %s", got)
+	}
+}
+
+func TestDelayedDelivery(t *testing.T) {
+	client, server := stomp.Pipe()
+	sess := requestSession()
+	sess.peer = server
+
+	sub := stomp.NewMessage()
+	sub.Dest = []byte("/queue/test")
+
+	router := newRouter()
+	router.subscribe(sess, sub)
+
+	msg := stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	msg.Body = []byte("later")
+	stomp.WithDelay(50 * time.Millisecond)(msg)
+	sent := time.Now()
+	if err := router.publish(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := router.wheel.len(); got != 1 {
+		t.Errorf("Expect message held by the timer wheel, got %d", got)
+	}
+
+	select {
+	case got := <-client.Receive():
+		if !bytes.Equal(got.Body, msg.Body) {
+			t.Errorf("Expect delayed message delivered")
+		}
+		if time.Since(sent) < 50*time.Millisecond {
+			t.Errorf("Expect message delivered after the delay")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect delayed message delivered")
+	}
+}
+
+func TestScheduleLimits(t *testing.T) {
+	router := newRouter()
+	router.maxDelay = time.Hour
+	router.wheel.limit = 1
+
+	msg := stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	msg.Body = []byte("later")
+	stomp.WithDelay(2 * time.Hour)(msg)
+	if err := router.publish(msg); err != ErrScheduleDelay {
+		t.Errorf("Expect ErrScheduleDelay, got %v", err)
+	}
+
+	msg = stomp.NewMessage()
+	msg.Dest = []byte("/queue/test")
+	msg.Body = []byte("later")
+	stomp.WithDelay(time.Minute)(msg)
+	if err := router.publish(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := router.mem.usage(); got != int64(len(msg.Body)) {
+		t.Errorf("Expect scheduled message counted against memory, got %d bytes", got)
+	}
+	if err := router.publish(msg); err != ErrScheduleFull {
+		t.Errorf("Expect ErrScheduleFull, got %v", err)
+	}
+	if got := router.mem.usage(); got != int64(len(msg.Body)) {
+		t.Errorf("Expect rejected message not counted, got %d bytes", got)
+	}
+}
+
+func TestScheduleLimitsSend(t *testing.T) {
+	s := NewServer(WithScheduleLimits(time.Hour, 1), WithDeduplication(time.Minute, 0))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err := client.Send("/queue/test", []byte("later"),
+		stomp.WithDelay(2*time.Hour),
+		stomp.WithDedupID("later"),
+		stomp.WithReceipt(),
+	)
+	if err == nil {
+		t.Fatalf("Expect send beyond the maximum delay rejected")
+	}
+	err = client.Send("/queue/test", []byte("later"),
+		stomp.WithDelay(time.Minute),
+		stomp.WithDedupID("later"),
+		stomp.WithReceipt(),
+	)
+	if err != nil {
+		t.Fatalf("Expect dedup id of a rejected send not recorded, got %s", err)
+	}
+	err = client.Send("/queue/test", []byte("later"),
+		stomp.WithDelay(time.Minute),
+		stomp.WithReceipt(),
+	)
+	if err == nil {
+		t.Errorf("Expect send rejected once the schedule is full")
+	}
+	if got := s.router.wheel.len(); got != 1 {
+		t.Errorf("Expect one scheduled message, got %d", got)
+	}
+}
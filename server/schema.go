@@ -0,0 +1,566 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// schemaErrorLimit is the maximum number of validation failures reported
+// for a message.
+const schemaErrorLimit = 10
+
+// JSONSchema returns a Transformer which rejects messages with a body
+// that is not valid JSON for the JSON Schema, reporting the validation
+// failures in the error. The validator supports the draft-07 keywords
+// for types, enumerations, numbers, strings, arrays and objects, the
+// boolean combinators, and local $ref references. Formats are ignored
+// and remote references are not supported.
+func JSONSchema(schema []byte) (Transformer, error) {
+	s, err := compileSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	return TransformerFunc(s.transform), nil
+}
+
+// loadSchema returns a Transformer for the JSON Schema file.
+func loadSchema(file string) (Transformer, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return JSONSchema(b)
+}
+
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+func compileSchema(b []byte) (*jsonSchema, error) {
+	root, err := decodeJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("stomp: schema: %s", err)
+	}
+	s := &jsonSchema{root: root, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.check(root, "#"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// decodeJSON decodes a single JSON value, keeping numbers exact.
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err == nil {
+		return nil, fmt.Errorf("unexpected data after the value")
+	}
+	return v, nil
+}
+
+func (s *jsonSchema) transform(m *stomp.Message) error {
+	v, err := decodeJSON(m.Body)
+	if err != nil {
+		return &ValidationError{Reason: "body must be json: " + err.Error()}
+	}
+	var errs []string
+	s.validate(s.root, v, "", &errs)
+	if len(errs) != 0 {
+		return &ValidationError{Reason: strings.Join(errs, "; ")}
+	}
+	return nil
+}
+
+// check checks the keywords of the schema, and compiles the patterns.
+func (s *jsonSchema) check(schema interface{}, at string) error {
+	fail := func(key, format string, args ...interface{}) error {
+		return fmt.Errorf("stomp: schema %s/%s: %s", at, key, fmt.Sprintf(format, args...))
+	}
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+	obj, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("stomp: schema %s: must be an object or boolean", at)
+	}
+	for key, v := range obj {
+		switch key {
+		case "$ref":
+			ref, ok := v.(string)
+			if !ok {
+				return fail(key, "must be a string")
+			}
+			if _, err := s.resolve(ref); err != nil {
+				return fail(key, "%s", err)
+			}
+		case "type":
+			types, ok := v.([]interface{})
+			if !ok {
+				types = []interface{}{v}
+			}
+			for _, t := range types {
+				switch t {
+				case "null", "boolean", "object", "array", "number", "integer", "string":
+				default:
+					return fail(key, "unknown type %v", t)
+				}
+			}
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				return fail(key, "must be a string")
+			}
+			if err := s.compile(p); err != nil {
+				return fail(key, "%s", err)
+			}
+		case "required":
+			names, ok := v.([]interface{})
+			if !ok {
+				return fail(key, "must be an array")
+			}
+			for _, name := range names {
+				if _, ok := name.(string); !ok {
+					return fail(key, "must be an array of strings")
+				}
+			}
+		case "enum":
+			if _, ok := v.([]interface{}); !ok {
+				return fail(key, "must be an array")
+			}
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf",
+			"minLength", "maxLength", "minItems", "maxItems", "minProperties", "maxProperties":
+			if _, ok := v.(json.Number); !ok {
+				return fail(key, "must be a number")
+			}
+		case "properties", "patternProperties", "definitions", "$defs":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return fail(key, "must be an object")
+			}
+			for name, sub := range props {
+				if key == "patternProperties" {
+					if err := s.compile(name); err != nil {
+						return fail(key, "%s", err)
+					}
+				}
+				if err := s.check(sub, at+"/"+key+"/"+escapePointer(name)); err != nil {
+					return err
+				}
+			}
+		case "allOf", "anyOf", "oneOf":
+			subs, ok := v.([]interface{})
+			if !ok || len(subs) == 0 {
+				return fail(key, "must be a non-empty array")
+			}
+			for i, sub := range subs {
+				if err := s.check(sub, at+"/"+key+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		case "items":
+			if subs, ok := v.([]interface{}); ok {
+				for i, sub := range subs {
+					if err := s.check(sub, at+"/"+key+"/"+strconv.Itoa(i)); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := s.check(v, at+"/"+key); err != nil {
+				return err
+			}
+		case "additionalItems", "additionalProperties", "contains", "propertyNames", "not":
+			if err := s.check(v, at+"/"+key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) compile(pattern string) error {
+	if _, ok := s.patterns[pattern]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	s.patterns[pattern] = re
+	return nil
+}
+
+// resolve returns the schema of a local reference, such as
+// #/definitions/address.
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference %q", ref)
+	}
+	v := s.root
+	if ref == "#" {
+		return v, nil
+	}
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("unresolved reference %q", ref)
+			}
+			v = node[i]
+		default:
+			v = nil
+		}
+		if v == nil {
+			return nil, fmt.Errorf("unresolved reference %q", ref)
+		}
+	}
+	return v, nil
+}
+
+// validate appends the validation failures of the value to errs. The
+// path is the JSON pointer of the value.
+func (s *jsonSchema) validate(schema, v interface{}, path string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		if len(*errs) < schemaErrorLimit {
+			at := path
+			if at == "" {
+				at = "/"
+			}
+			*errs = append(*errs, at+": "+fmt.Sprintf(format, args...))
+		}
+	}
+	if b, ok := schema.(bool); ok {
+		if !b {
+			fail("not allowed")
+		}
+		return
+	}
+	obj := schema.(map[string]interface{})
+	if ref, ok := obj["$ref"].(string); ok {
+		// references were resolved when the schema was compiled, and
+		// keywords beside a reference are ignored.
+		target, _ := s.resolve(ref)
+		s.validate(target, v, path, errs)
+		return
+	}
+
+	if t, ok := obj["type"]; ok {
+		types, ok := t.([]interface{})
+		if !ok {
+			types = []interface{}{t}
+		}
+		var match bool
+		for _, t := range types {
+			if isType(v, t.(string)) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			fail("must be %s", joinTypes(types))
+			return
+		}
+	}
+	if enum, ok := obj["enum"].([]interface{}); ok {
+		var match bool
+		for _, e := range enum {
+			if equalJSON(v, e) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			fail("must be one of the enumerated values")
+		}
+	}
+	if c, ok := obj["const"]; ok && !equalJSON(v, c) {
+		fail("must be %s", encodeJSON(c))
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		s.validateNumber(obj, v, fail)
+	case string:
+		s.validateString(obj, v, fail)
+	case []interface{}:
+		s.validateArray(obj, v, path, errs, fail)
+	case map[string]interface{}:
+		s.validateObject(obj, v, path, errs, fail)
+	}
+
+	if all, ok := obj["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			s.validate(sub, v, path, errs)
+		}
+	}
+	if anyOf, ok := obj["anyOf"].([]interface{}); ok {
+		if s.matches(anyOf, v, path) == 0 {
+			fail("must match a schema in anyOf")
+		}
+	}
+	if oneOf, ok := obj["oneOf"].([]interface{}); ok {
+		if n := s.matches(oneOf, v, path); n != 1 {
+			fail("must match exactly one schema in oneOf, matched %d", n)
+		}
+	}
+	if not, ok := obj["not"]; ok {
+		if s.matches([]interface{}{not}, v, path) == 1 {
+			fail("must not match the schema in not")
+		}
+	}
+}
+
+// matches returns the number of schemas the value is valid for.
+func (s *jsonSchema) matches(schemas []interface{}, v interface{}, path string) (n int) {
+	for _, sub := range schemas {
+		var errs []string
+		s.validate(sub, v, path, &errs)
+		if len(errs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *jsonSchema) validateNumber(obj map[string]interface{}, v json.Number, fail func(string, ...interface{})) {
+	f, _ := v.Float64()
+	if min, ok := number(obj, "minimum"); ok && f < min {
+		fail("must be >= %v", min)
+	}
+	if max, ok := number(obj, "maximum"); ok && f > max {
+		fail("must be <= %v", max)
+	}
+	if min, ok := number(obj, "exclusiveMinimum"); ok && f <= min {
+		fail("must be > %v", min)
+	}
+	if max, ok := number(obj, "exclusiveMaximum"); ok && f >= max {
+		fail("must be < %v", max)
+	}
+	if div, ok := number(obj, "multipleOf"); ok && div > 0 {
+		if q := f / div; math.Abs(q-math.Floor(q+0.5)) > 1e-9 {
+			fail("must be a multiple of %v", div)
+		}
+	}
+}
+
+func (s *jsonSchema) validateString(obj map[string]interface{}, v string, fail func(string, ...interface{})) {
+	n := float64(utf8.RuneCountInString(v))
+	if min, ok := number(obj, "minLength"); ok && n < min {
+		fail("must be at least %v characters", min)
+	}
+	if max, ok := number(obj, "maxLength"); ok && n > max {
+		fail("must be at most %v characters", max)
+	}
+	if p, ok := obj["pattern"].(string); ok && !s.patterns[p].MatchString(v) {
+		fail("must match pattern %q", p)
+	}
+}
+
+func (s *jsonSchema) validateArray(obj map[string]interface{}, v []interface{}, path string, errs *[]string, fail func(string, ...interface{})) {
+	n := float64(len(v))
+	if min, ok := number(obj, "minItems"); ok && n < min {
+		fail("must have at least %v items", min)
+	}
+	if max, ok := number(obj, "maxItems"); ok && n > max {
+		fail("must have at most %v items", max)
+	}
+	if unique, _ := obj["uniqueItems"].(bool); unique {
+	loop:
+		for i := range v {
+			for j := 0; j < i; j++ {
+				if equalJSON(v[i], v[j]) {
+					fail("must have unique items")
+					break loop
+				}
+			}
+		}
+	}
+	switch items := obj["items"].(type) {
+	case []interface{}:
+		for i, item := range v {
+			at := path + "/" + strconv.Itoa(i)
+			if i < len(items) {
+				s.validate(items[i], item, at, errs)
+			} else if extra, ok := obj["additionalItems"]; ok {
+				s.validate(extra, item, at, errs)
+			}
+		}
+	case nil:
+	default:
+		for i, item := range v {
+			s.validate(items, item, path+"/"+strconv.Itoa(i), errs)
+		}
+	}
+	if contains, ok := obj["contains"]; ok {
+		var found bool
+		for _, item := range v {
+			if s.matches([]interface{}{contains}, item, path) == 1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must contain an item matching the schema in contains")
+		}
+	}
+}
+
+func (s *jsonSchema) validateObject(obj map[string]interface{}, v map[string]interface{}, path string, errs *[]string, fail func(string, ...interface{})) {
+	n := float64(len(v))
+	if min, ok := number(obj, "minProperties"); ok && n < min {
+		fail("must have at least %v properties", min)
+	}
+	if max, ok := number(obj, "maxProperties"); ok && n > max {
+		fail("must have at most %v properties", max)
+	}
+	if required, ok := obj["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				fail("missing property %q", name)
+			}
+		}
+	}
+	props, _ := obj["properties"].(map[string]interface{})
+	patterns, _ := obj["patternProperties"].(map[string]interface{})
+	extra, hasExtra := obj["additionalProperties"]
+	names, hasNames := obj["propertyNames"]
+
+	for _, name := range sortedKeys(v) {
+		at := path + "/" + escapePointer(name)
+		if hasNames {
+			s.validate(names, name, at, errs)
+		}
+		matched := false
+		if sub, ok := props[name]; ok {
+			s.validate(sub, v[name], at, errs)
+			matched = true
+		}
+		for p, sub := range patterns {
+			if s.patterns[p].MatchString(name) {
+				s.validate(sub, v[name], at, errs)
+				matched = true
+			}
+		}
+		if !matched && hasExtra {
+			s.validate(extra, v[name], at, errs)
+		}
+	}
+}
+
+// number returns the numeric keyword of the schema.
+func number(obj map[string]interface{}, key string) (float64, bool) {
+	n, ok := obj[key].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func isType(v interface{}, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case []interface{}:
+		return t == "array"
+	case map[string]interface{}:
+		return t == "object"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		f, err := v.Float64()
+		return t == "integer" && err == nil && f == math.Trunc(f)
+	}
+	return false
+}
+
+// sortedKeys returns the keys of the object in order, so that failures
+// are reported in a stable order.
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinTypes(types []interface{}) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.(string)
+	}
+	return strings.Join(names, " or ")
+}
+
+// equalJSON returns true if the values are equal, comparing numbers by
+// value.
+func equalJSON(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fa, _ := a.Float64()
+		fb, _ := b.Float64()
+		return fa == fb
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalJSON(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equalJSON(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func encodeJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// escapePointer escapes the key as a JSON pointer token.
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
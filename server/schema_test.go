@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "qty"],
+	"properties": {
+		"id": {"type": "string", "pattern": "^o-[0-9]+$"},
+		"qty": {"type": "integer", "minimum": 1, "maximum": 100},
+		"status": {"enum": ["new", "paid"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true, "maxItems": 3},
+		"address": {"$ref": "#/definitions/address"},
+		"note": {"anyOf": [{"type": "string", "maxLength": 5}, {"type": "null"}]}
+	},
+	"additionalProperties": false,
+	"definitions": {
+		"address": {
+			"type": "object",
+			"required": ["city"],
+			"properties": {"city": {"type": "string", "minLength": 1}}
+		}
+	}
+}`
+
+func TestJSONSchema(t *testing.T) {
+	schema, err := JSONSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body string
+		err  string // expected failure, valid if empty
+	}{
+		{body: `{"id":"o-1","qty":2}`},
+		{body: `{"id":"o-1","qty":2.0,"status":"paid","tags":["a","b"],"address":{"city":"Oslo"},"note":null}`},
+		{body: `not json`, err: "body must be json"},
+		{body: `[]`, err: "/: must be object"},
+		{body: `{"id":"o-1"}`, err: `/: missing property "qty"`},
+		{body: `{"id":"x","qty":2}`, err: `/id: must match pattern`},
+		{body: `{"id":"o-1","qty":0}`, err: "/qty: must be >= 1"},
+		{body: `{"id":"o-1","qty":1.5}`, err: "/qty: must be integer"},
+		{body: `{"id":"o-1","qty":1,"status":"lost"}`, err: "/status: must be one of"},
+		{body: `{"id":"o-1","qty":1,"tags":["a","a"]}`, err: "/tags: must have unique items"},
+		{body: `{"id":"o-1","qty":1,"tags":["a",1]}`, err: "/tags/1: must be string"},
+		{body: `{"id":"o-1","qty":1,"address":{}}`, err: `/address: missing property "city"`},
+		{body: `{"id":"o-1","qty":1,"note":"too long"}`, err: "/note: must match a schema in anyOf"},
+		{body: `{"id":"o-1","qty":1,"extra":true}`, err: "/extra: not allowed"},
+	}
+	for _, test := range tests {
+		m := stomp.NewMessage()
+		m.Body = []byte(test.body)
+		err := schema.Transform(m)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("Want %s valid, got %s", test.body, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("Want %s invalid with %q, got %v", test.body, test.err, err)
+		}
+	}
+
+	for _, invalid := range []string{
+		`[]`,
+		`{"type": "decimal"}`,
+		`{"pattern": "("}`,
+		`{"$ref": "#/definitions/missing"}`,
+		`{"$ref": "http://example.com/schema.json"}`,
+		`{"properties": {"a": 1}}`,
+	} {
+		if _, err := JSONSchema([]byte(invalid)); err == nil {
+			t.Errorf("Want error compiling schema %s", invalid)
+		}
+	}
+}
+
+func TestSchemaRejectsSend(t *testing.T) {
+	schema, err := JSONSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithTransform("/queue/orders", schema))
+
+	a, b := stomp.Pipe()
+	go s.ServePeer(b)
+	defer a.Close()
+
+	connect := stomp.NewMessage()
+	connect.Method = stomp.MethodStomp
+	a.Send(connect)
+	receive(t, a)
+
+	send := stomp.NewMessage()
+	send.Method = stomp.MethodSend
+	send.Dest = []byte("/queue/orders")
+	send.Receipt = []byte("1")
+	send.Body = []byte(`{"id":"o-1","qty":0}`)
+	a.Send(send)
+	m := receive(t, a)
+	if !bytes.Equal(m.Method, stomp.MethodError) {
+		t.Fatalf("Want ERROR for invalid message, got %s", m.Method)
+	}
+	if msg := m.Header.GetString(string(stomp.HeaderMessage)); !strings.Contains(msg, "/qty: must be >= 1") {
+		t.Errorf("Want validation failure in the error, got %q", msg)
+	}
+}
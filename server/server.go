@@ -1,9 +1,15 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mrwill84/mq/logger"
 	"github.com/mrwill84/mq/stomp"
@@ -11,42 +17,151 @@ import (
 	"golang.org/x/net/websocket"
 )
 
+// ErrUnknownHost is returned when a client or request names a virtual
+// host which is not configured.
+var ErrUnknownHost = errors.New("stomp: unknown virtual host")
+
 // Server ...
 type Server struct {
-	router *router
+	router   *router
+	hosts    map[string]*router
+	vhosts   []virtualHost // configured by WithVirtualHost
+	store    string        // datastore path configured by WithStore
+	standby  *standby
+	features *features
+	admin    Authorizer // authenticates admin requests, if set
+	webhooks *webhooks
+	crons    *cronJobs
+	events   *eventStream
+	conn     stomp.ConnConfig
+
+	reconnectTargets []string // addresses HandleDrain may redirect clients to
+
+	reloading sync.Mutex
+	config    *Config // configuration applied by NewFromConfig or Reload
+
+	done      chan struct{} // closed when the server is closed
+	closeOnce sync.Once
 }
 
 // NewServer returns a new STOMP server.
 func NewServer(options ...Option) *Server {
 	server := &Server{
-		router: newRouter(),
+		router:   newRouter(),
+		hosts:    make(map[string]*router),
+		features: newFeatures(),
+		webhooks: newWebhooks(),
+		crons:    newCronJobs(),
+		events:   newEventStream(),
+		done:     make(chan struct{}),
 	}
+	server.router.features = server.features
 	for _, option := range options {
 		option(server)
 	}
+	for _, h := range server.vhosts {
+		server.addHost(h.host, h.auth)
+	}
+	// the datastore is loaded once every option is applied, so that
+	// restored messages are published with the final configuration.
+	if server.store != "" {
+		if err := loadDatastore(server.store, server.routers()); err != nil {
+			logger.Warningf("stomp: cannot open datastore %s: %s", server.store, err)
+		}
+	}
+	for _, r := range server.routers() {
+		r.events = server.events
+	}
+	for _, hook := range server.webhooks.pending {
+		if _, err := server.AddWebhook(hook); err != nil {
+			logger.Warningf("stomp: webhook %s: %s", hook.URL, err)
+		}
+	}
+	for _, job := range server.crons.pending {
+		if _, err := server.AddCron(job); err != nil {
+			logger.Warningf("stomp: cron %s: %s", job.Dest, err)
+		}
+	}
+	if server.standby != nil {
+		server.standby.hosts = server.hosts
+		go server.standby.run()
+	}
+	for _, r := range server.routers() {
+		if r.idle > 0 || r.sessionIdle > 0 {
+			go server.sweep()
+			break
+		}
+	}
 	return server
 }
 
-// Serve accepts incoming net.Conn requests.
-func (s *Server) Serve(conn net.Conn) {
+// Close stops the background tasks of the server, such as the sweeper
+// of idle destinations and sessions. It does not close the sessions of
+// the server; use Drain to close them gracefully.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// ServeConn serves the connection until it is closed. The verified
+// client certificate of a TLS connection authenticates the session if
+// client certificate authentication is enabled.
+func (s *Server) ServeConn(conn net.Conn) {
+	var cert *x509.Certificate
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			logger.Noticef("stomp: tls handshake: %s", err)
+			conn.Close()
+			return
+		}
+		state := tc.ConnectionState()
+		cert = clientCert(&state)
+	}
+	s.servePeer(stomp.ConnWithConfig(conn, s.conn), cert)
+}
+
+// ServePeer accepts incoming requests from the peer. This can be used
+// to serve peers using alternate transports, such as broker links.
+func (s *Server) ServePeer(peer stomp.Peer) {
+	s.servePeer(peer, nil)
+}
+
+// clientCert returns the verified client certificate of the TLS
+// connection, if any.
+func clientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+func (s *Server) servePeer(peer stomp.Peer, cert *x509.Certificate) {
 	logger.Verbosef("stomp: session opened.")
 
 	session := requestSession()
-	session.peer = stomp.Conn(conn)
+	session.id = atomic.AddInt64(&sessionSeq, 1)
+	session.peer = peer
+	session.cert = cert
+	session.maxFrameSize = s.conn.MaxFrameSize
 
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Warningf("stomp: server panic: %s", r)
 		}
 
-		s.router.disconnect(session)
+		if session.router != nil {
+			session.router.disconnect(session)
+		}
 		session.peer.Close()
+		session.closeOutbox()
 		session.release()
 
 		logger.Verbosef("stomp: session released.")
 	}()
 
-	err := s.router.serve(session)
+	err := s.serve(session)
 	if err == nil {
 		logger.Verbosef("stomp: session closed gracefully.")
 		return
@@ -55,72 +170,207 @@ func (s *Server) Serve(conn net.Conn) {
 	logger.Warningf("stomp: server error. %s", err)
 }
 
+// serve reads the connect message from the session and hands the
+// session to the router for the requested virtual host.
+func (s *Server) serve(session *session) error {
+	message, ok := <-session.peer.Receive()
+	if !ok {
+		return nil
+	}
+	if s.standby.active() && !s.readOnly() {
+		session.sendError(message, ErrStandby)
+		return ErrStandby
+	}
+	session.router = s.lookup(message.Host)
+	if session.router == nil {
+		session.sendError(message, ErrUnknownHost)
+		return ErrUnknownHost
+	}
+	if session.router.rejectDraining(session, message) {
+		return ErrDraining
+	}
+	session.openOutbox()
+	return session.router.serve(session, message)
+}
+
+// lookup returns the router for the named virtual host, or the default
+// router if the host is empty. If virtual hosts are configured and the
+// named host does not exist, nil is returned; otherwise the host is
+// ignored, since clients commonly send the broker hostname.
+func (s *Server) lookup(host []byte) *router {
+	if len(host) == 0 || len(s.hosts) == 0 {
+		return s.router
+	}
+	return s.hosts[string(host)]
+}
+
+// routers returns the default router and the virtual host routers.
+func (s *Server) routers() []*router {
+	routers := []*router{s.router}
+	for _, r := range s.hosts {
+		routers = append(routers, r)
+	}
+	return routers
+}
+
 // ServeHTTP accepts incoming http.Request, upgrades to a websocket and
 // begins sending and receiving STOMP messages.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger.Verbosef("stomp: handle websocket request.")
-	websocket.Handler(func(conn *websocket.Conn) {
-		s.Serve(conn)
-	}).ServeHTTP(w, r)
+	handler := func(conn *websocket.Conn) {
+		c := remoteConn{conn, remoteAddr(conn.Request().RemoteAddr)}
+		s.servePeer(stomp.ConnWithConfig(c, s.conn), clientCert(conn.Request().TLS))
+	}
+	if len(s.router.affinity) == 0 {
+		websocket.Handler(handler).ServeHTTP(w, r)
+		return
+	}
+	websocket.Server{
+		Handler:   handler,
+		Handshake: s.handshake,
+	}.ServeHTTP(w, r)
 }
 
-// HandleSessions writes a JSON-encoded list of sessions to the http.Request.
+// HandleSessions writes a JSON-encoded list of sessions to the http.Request,
+// with the time of the last frame or heart-beat received from each
+// session. Only sessions idle for longer than the idle query parameter
+// are listed, if given. A DELETE request closes the session with the id
+// query parameter and requires admin authentication.
 func (s *Server) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		s.handleCloseSession(w, r)
+		return
+	}
+
+	var idle time.Duration
+	if v := r.FormValue("idle"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		idle = d
+	}
+
 	type sessionResp struct {
-		Addr    string            `json:"address"`
-		User    string            `json:"username"`
-		Headers map[string]string `json:"headers"`
+		ID           int64             `json:"id"`
+		Host         string            `json:"host,omitempty"`
+		Addr         string            `json:"address"`
+		User         string            `json:"username"`
+		Client       string            `json:"client,omitempty"`
+		Headers      map[string]string `json:"headers"`
+		Connected    time.Time         `json:"connected"`
+		LastActivity time.Time         `json:"last_activity"`
+		Idle         float64           `json:"idle_seconds"`
+		Frames       int64             `json:"frames"`
+		Heartbeats   int64             `json:"heartbeats"`
 	}
 
+	now := time.Now()
 	var sessions []sessionResp
-	s.router.RLock()
-	for sess := range s.router.sessions {
-		headers := map[string]string{}
-		for i := 0; i < sess.msg.Header.Len(); i++ {
-			k, v := sess.msg.Header.Index(i)
-			headers[string(k)] = string(v)
+	for _, router := range s.routers() {
+		router.RLock()
+		for sess := range router.sessions {
+			last := sess.lastActivity()
+			if now.Sub(last) < idle {
+				continue
+			}
+			headers := map[string]string{}
+			for i := 0; i < sess.msg.Header.Len(); i++ {
+				k, v := sess.msg.Header.Index(i)
+				headers[string(k)] = string(v)
+			}
+			sessions = append(sessions, sessionResp{
+				ID:      sess.id,
+				Host:    router.host,
+				Addr:    sess.peer.Addr(),
+				User:    string(sess.msg.User),
+				Client:  string(sess.msg.Header.Get(stomp.HeaderClient)),
+				Headers: headers,
+
+				Connected:    sess.connected,
+				LastActivity: last,
+				Idle:         now.Sub(last).Seconds(),
+				Frames:       atomic.LoadInt64(&sess.frames),
+				Heartbeats:   sess.heartbeats(),
+			})
 		}
-		sessions = append(sessions, sessionResp{
-			Addr:    sess.peer.Addr(),
-			User:    string(sess.msg.User),
-			Headers: headers,
-		})
+		router.RUnlock()
 	}
-	s.router.RUnlock()
 
 	json.NewEncoder(w).Encode(sessions)
 }
 
 // HandleDests writes a JSON-encoded list of destinations to the http.Request.
+// A POST request creates the destination query parameter and a DELETE
+// request deletes the destination. POST, PUT and DELETE requests require
+// admin authentication.
 func (s *Server) HandleDests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "PUT", "DELETE":
+		s.handleDestLifecycle(w, r)
+		return
+	}
+
 	type destionatResp struct {
-		Dest string `json:"destination"`
+		Host     string `json:"host,omitempty"`
+		Dest     string `json:"destination"`
+		Declared bool   `json:"declared,omitempty"`
 	}
 
 	var dests []destionatResp
-	s.router.RLock()
-	for dest := range s.router.destinations {
-		d := destionatResp{
-			Dest: dest,
-		}
-		dests = append(dests, d)
+	for _, router := range s.routers() {
+		router.RLock()
+		router.destinations.each(func(dest string, h handler) {
+			dests = append(dests, destionatResp{
+				Host:     router.host,
+				Dest:     dest,
+				Declared: router.isDeclared(dest),
+			})
+		})
+		router.RUnlock()
 	}
-	s.router.RUnlock()
 
 	json.NewEncoder(w).Encode(dests)
 }
 
+// HandleHosts writes a JSON-encoded list of virtual hosts and their
+// statistics, including the enabled feature flags, to the http.Request.
+func (s *Server) HandleHosts(w http.ResponseWriter, r *http.Request) {
+	type hostResp struct {
+		Host         string   `json:"host"`
+		Sessions     int      `json:"sessions"`
+		Destinations int      `json:"destinations"`
+		Published    int64    `json:"published"`
+		Features     []string `json:"features"`
+	}
+
+	features := []string{}
+	for _, f := range s.features.list() {
+		if f.Enabled {
+			features = append(features, f.Name)
+		}
+	}
+	var hosts []hostResp
+	for _, router := range s.routers() {
+		router.RLock()
+		hosts = append(hosts, hostResp{
+			Host:         router.host,
+			Sessions:     len(router.sessions),
+			Destinations: router.destinations.len(),
+			Published:    atomic.LoadInt64(&router.published),
+			Features:     features,
+		})
+		router.RUnlock()
+	}
+
+	json.NewEncoder(w).Encode(hosts)
+}
+
 // Client returns a stomp.Client that has a direct peer connection
 // to the server.
 func (s *Server) Client() *stomp.Client {
 	a, b := stomp.Pipe()
-
-	go func() {
-		session := requestSession()
-		session.peer = b
-		if err := s.router.serve(session); err != nil {
-			logger.Warningf("stomp: server error. %s", err)
-		}
-	}()
+	go s.ServePeer(b)
 	return stomp.New(a)
 }
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+
+	"golang.org/x/net/context"
+)
+
+func TestClientClose(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Close(ctx); err != nil {
+		t.Errorf("Expect disconnect receipt before close, got error %s", err)
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	body := bytes.Repeat([]byte("hello world "), 200)
+	received := make(chan []byte, 1)
+	_, err := client.Subscribe("/topic/test", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- append([]byte(nil), m.Body...)
+	}), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Send("/topic/test", body,
+		stomp.WithCompression(stomp.EncodingGzip),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, body) {
+			t.Errorf("Expect subscriber to receive the decompressed body")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect compressed message delivered")
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	body := bytes.Repeat([]byte("0123456789"), 300000)
+	received := make(chan []byte, 1)
+	_, err := client.SubscribeStream("/topic/test", stomp.StreamHandlerFunc(func(m *stomp.Message, r io.Reader) {
+		b, _ := ioutil.ReadAll(r)
+		received <- b
+	}), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.SendReader("/topic/test", bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, body) {
+			t.Errorf("Expect subscriber to receive the streamed body")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expect streamed message delivered")
+	}
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"bytes"
+	"crypto/x509"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mrwill84/mq/logger"
 	"github.com/mrwill84/mq/stomp"
@@ -11,7 +14,35 @@ import (
 
 // session represents a single client session (ie connection)
 type session struct {
-	peer stomp.Peer
+	id      int64 // session number, unique within the server
+	peer    stomp.Peer
+	router  *router
+	limiter *limiter
+	quota   Quota
+	proto   []byte // negotiated protocol version
+	token   []byte // session resumption token
+	accept  []byte // accepted content encodings
+	temp    []byte // prefix of the session's temporary queues
+
+	maxFrameSize int // bound on bodies decompressed for the client
+
+	quotaLimiter *limiter          // publish rate quota
+	acl          *acl              // destination permissions, nil if unrestricted
+	cert         *x509.Certificate // verified client certificate, if any
+
+	authenticated bool        // identity verified by the authorizer, a JWT or a client certificate
+	expiry        *time.Timer // closes the session when its token expires
+
+	graceful bool // session ended with a DISCONNECT
+
+	out         *outbox // frames waiting to be written, under a slow consumer policy
+	inflight    int32   // messages blocked writing to the connection, accessed atomically
+	slowSince   int64   // time the session became slow, accessed atomically
+	slowNoticed int32   // slow consumer policy applied, accessed atomically
+
+	connected time.Time // time the session connected
+	lastFrame int64     // time of the last frame received, accessed atomically
+	frames    int64     // frames received, accessed atomically
 
 	sub map[string]*subscription
 	ack map[string]*stomp.Message
@@ -24,41 +55,202 @@ func (s *session) init(m *stomp.Message) {
 	s.msg = m
 }
 
-// send writes the message to the transport.
+// send writes the message to the transport or, under a slow consumer
+// policy, queues it to be written.
 func (s *session) send(m *stomp.Message) {
-	logger.Debugf("stomp: sending message to client.\n%s", m)
-	s.peer.Send(m)
+	if logger.DebugEnabled() {
+		logger.Debugf("stomp: sending message to client.\n%s", m)
+	}
+	if s.router != nil && bytes.Equal(m.Method, stomp.MethodMessage) {
+		if s.router.slowConsumer(s, m) {
+			return
+		}
+		s.router.usage.consumed(m)
+		c, err := s.decode(m)
+		if err != nil {
+			s.reject(m, err)
+			return
+		}
+		m = c
+	}
+	if s.out != nil {
+		// the caller may hold a queue lock, so a message queued after
+		// the outbox closed is returned to its queue asynchronously.
+		if !s.out.push(m, s.router.slow) {
+			go s.router.undeliver([]*stomp.Message{m})
+		}
+		return
+	}
+	s.write(m)
+}
+
+// write writes the message to the connection, blocking until the peer
+// takes it. It returns false if the session is closed.
+func (s *session) write(m *stomp.Message) bool {
+	atomic.AddInt32(&s.inflight, 1)
+	err := s.peer.Send(m)
+	atomic.AddInt32(&s.inflight, -1)
+	if err != stomp.ErrFrameTooLarge {
+		return err == nil
+	}
+	// the peer does not take an oversized frame, so a message is
+	// dead-lettered rather than lost with its delivery pending.
+	if s.router != nil && bytes.Equal(m.Method, stomp.MethodMessage) {
+		s.reject(m, err)
+		return true
+	}
+	logger.Warningf("stomp: %s frame to %s exceeds the maximum frame size", m.Method, m.Dest)
+	m.Release()
+	return true
+}
+
+// decode returns a decompressed copy of the message, releasing the
+// message, if the client advertised the encodings it accepts and the
+// message content encoding is not among them. It returns an error if
+// the message cannot be decompressed or the decompressed body exceeds
+// the maximum frame size.
+func (s *session) decode(m *stomp.Message) (*stomp.Message, error) {
+	encoding := m.Header.Get(stomp.HeaderEncoding)
+	if len(encoding) == 0 || s.accept == nil || stomp.AcceptsEncoding(s.accept, encoding) {
+		return m, nil
+	}
+	c := m.Clone()
+	if err := stomp.DecompressLimit(c, s.maxFrameSize); err != nil {
+		c.Release()
+		return nil, err
+	}
+	m.Release()
+	return c, nil
+}
+
+// reject dead-letters and releases a message that cannot be delivered
+// to the client. A message delivered with an ack id is negatively
+// acknowledged first. The message is never published back to its
+// destination, where it would be delivered to the client again. The
+// caller may hold a queue lock, so the message is published
+// asynchronously.
+func (s *session) reject(m *stomp.Message, err error) {
+	logger.Warningf("stomp: message to %s: %s", m.Dest, err)
+	r := s.router
+	if len(m.Ack) != 0 {
+		nack := stomp.NewMessage()
+		nack.ID = append(nack.ID, m.Ack...)
+		c, ok := r.unack(s, nack)
+		nack.Release()
+		m.Release()
+		if !ok {
+			return
+		}
+		go func() {
+			if err := r.republish(c, r.reject); err != nil {
+				logger.Warningf("stomp: message to %s: %s; message dropped", c.Dest, err)
+			}
+		}()
+		return
+	}
+	m.Subs = m.Subs[:0]
+	go func() {
+		if err := r.reject(m); err != nil {
+			logger.Warningf("stomp: message to %s: %s; message dropped", m.Dest, err)
+		}
+		m.Release()
+	}()
+}
+
+// sendError writes an error message to the transport in response
+// to message m.
+func (s *session) sendError(m *stomp.Message, err error, opts ...stomp.MessageOption) {
+	e := stomp.NewMessage()
+	e.Method = stomp.MethodError
+	e.Receipt = append([]byte(nil), m.Receipt...)
+	e.Header.Add(stomp.HeaderMessage, []byte(err.Error()))
+	e.Apply(opts...)
+	s.send(e)
+}
+
+// pause stops reading frames from the session for d, applying
+// backpressure to the producer. It returns false if the session is
+// closed in the meantime.
+func (s *session) pause(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stomp.Closed(s.peer):
+		return false
+	}
 }
 
 // create a subscription for the current session using the
 // subscription settings from the given message.
 func (s *session) subs(m *stomp.Message) *subscription {
+	// the id and destination are copied, since the frame is released
+	// to the pool once the subscription is created.
 	sub := requestSubscription()
-	sub.id = m.ID
-	sub.dest = m.Dest
-	sub.ack = bytes.Equal(m.Ack, stomp.AckClient) || len(m.Prefetch) != 0
+	sub.id = append([]byte(nil), m.ID...)
+	sub.dest = append([]byte(nil), m.Dest...)
+	sub.cumulative = bytes.Equal(m.Ack, stomp.AckClient)
+	sub.ack = sub.cumulative || bytes.Equal(m.Ack, stomp.AckClientIndividual) ||
+		len(m.Prefetch) != 0
 	sub.prefetch = stomp.ParseInt(m.Prefetch)
 	sub.session = s
+	sub.exclusive = m.Header.GetBool("exclusive")
+	sub.group = m.Header.GetString("group")
+	sub.since = atomic.AddInt64(&subscriptionSeq, 1)
+	sub.seen = time.Now()
 
 	if len(m.Selector) != 0 {
 		sub.selector, _ = selector.Parse(m.Selector)
 	}
 
+	s.Lock()
 	s.sub[string(sub.id)] = sub
+	s.Unlock()
 	return sub
 }
 
 // remove the subscription from the session and release
 // to the session pool.
 func (s *session) unsub(sub *subscription) {
+	s.Lock()
 	delete(s.sub, string(sub.id))
+	s.Unlock()
 	sub.release()
 }
 
 // reset the session properties to zero values.
 func (s *session) reset() {
+	s.id = 0
 	s.msg = nil
 	s.peer = nil
+	s.router = nil
+	s.limiter = nil
+	s.quota = Quota{}
+	s.quotaLimiter = nil
+	s.acl = nil
+	s.cert = nil
+	s.authenticated = false
+	s.proto = nil
+	s.token = nil
+	s.accept = nil
+	s.temp = nil
+	s.maxFrameSize = 0
+	s.graceful = false
+	s.out = nil
+	s.inflight = 0
+	s.slowSince = 0
+	s.slowNoticed = 0
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.connected = time.Time{}
+	s.lastFrame = 0
+	s.frames = 0
 	for id := range s.sub {
 		delete(s.sub, id)
 	}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/mrwill84/mq/stomp"
 )
@@ -92,3 +95,135 @@ func Test_session_pool(t *testing.T) {
 	}
 	s.release()
 }
+
+func TestSessionDecode(t *testing.T) {
+	body := bytes.Repeat([]byte("hello world "), 200)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+	compressed := func() *stomp.Message {
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodMessage
+		m.Dest = []byte("/queue/test")
+		m.Body = append([]byte(nil), buf.Bytes()...)
+		m.Header.Add(stomp.HeaderEncoding, []byte(stomp.EncodingGzip))
+		return m
+	}
+
+	sess := requestSession()
+	m := compressed()
+	if got, err := sess.decode(m); got != m || err != nil {
+		t.Errorf("Expect message unchanged when the client does not advertise encodings")
+	}
+	sess.accept = []byte("gzip")
+	if got, err := sess.decode(m); got != m || err != nil {
+		t.Errorf("Expect message unchanged when the client accepts the encoding")
+	}
+	sess.accept = []byte("deflate")
+	got, err := sess.decode(m)
+	if err != nil || got == m || !bytes.Equal(got.Body, body) {
+		t.Errorf("Expect message decompressed when the client does not accept the encoding")
+	}
+
+	sess.maxFrameSize = len(body) - 1
+	if _, err := sess.decode(compressed()); err != stomp.ErrFrameTooLarge {
+		t.Errorf("Expect ErrFrameTooLarge decompressing beyond the frame size, got %v", err)
+	}
+
+	// messages that cannot be decoded are dead-lettered.
+	client, server := stomp.Pipe()
+	sess.peer = server
+	sess.router = newRouter()
+	sess.send(compressed())
+	select {
+	case m := <-client.Receive():
+		t.Errorf("Expect oversize message not delivered, got %s", m.Body)
+	default:
+	}
+	if !waitQueueLen(sess.router, "/queue/dlq/test", 1) {
+		t.Errorf("Expect oversize message dead-lettered")
+	}
+
+	// a message delivered from a dead-letter queue, under its lock, is
+	// dropped rather than published back to the queue.
+	h, _ := sess.router.destinations.load("/queue/dlq/test")
+	q := h.(*queue)
+	dead := compressed()
+	dead.Dest = []byte("/queue/dlq/test")
+	q.Lock()
+	sess.send(dead)
+	q.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if !waitQueueLen(sess.router, "/queue/dlq/test", 1) {
+		t.Errorf("Expect message rejected from the dead-letter queue dropped")
+	}
+}
+
+func TestSessionSendTooLarge(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	peer := stomp.ConnWithConfig(b, stomp.ConnConfig{MaxFrameSize: 64})
+	defer peer.Close()
+
+	sess := requestSession()
+	sess.peer = peer
+	sess.router = newRouter()
+	m := stomp.NewMessage()
+	m.Method = stomp.MethodMessage
+	m.Dest = []byte("/queue/test")
+	m.Body = bytes.Repeat([]byte("x"), 128)
+	sess.send(m)
+
+	if !waitQueueLen(sess.router, "/queue/dlq/test", 1) {
+		t.Errorf("Expect message exceeding the frame size dead-lettered")
+	}
+}
+
+func TestSessionSendTooLargeDeadLetter(t *testing.T) {
+	for _, ack := range [][]byte{stomp.AckAuto, stomp.AckClientIndividual} {
+		s := NewServer()
+		a, b := net.Pipe()
+		go s.ServePeer(stomp.ConnWithConfig(b, stomp.ConnConfig{MaxFrameSize: 256}))
+		client := stomp.Conn(a)
+
+		connect := stomp.NewMessage()
+		connect.Method = stomp.MethodStomp
+		client.Send(connect)
+		receive(t, client)
+		sub := stomp.NewMessage()
+		sub.Method = stomp.MethodSubscribe
+		sub.ID = []byte("1")
+		sub.Dest = []byte("/queue/dlq/test")
+		sub.Ack = ack
+		sub.Receipt = []byte("2")
+		client.Send(sub)
+		receive(t, client)
+
+		// a message rejected from a dead-letter queue is not published
+		// back to the queue it is delivered from.
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodSend
+		m.Dest = []byte("/queue/dlq/test")
+		m.Body = bytes.Repeat([]byte("x"), 1024)
+		done := make(chan error, 1)
+		go func() { done <- s.router.publish(m) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Expect message published, got %s", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expect publish to return with ack mode %s", ack)
+		}
+		if !waitQueueLen(s.router, "/queue/dlq/test", 0) {
+			t.Errorf("Expect message exceeding the frame size dropped with ack mode %s", ack)
+		}
+		select {
+		case m := <-client.Receive():
+			t.Errorf("Expect oversize message not delivered, got %s", m.Method)
+		case <-time.After(50 * time.Millisecond):
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import "sync"
+
+// defaultShards is the default number of destination map shards.
+const defaultShards = 32
+
+// destMap maps destinations to their handlers. Destinations are
+// distributed across shards by hash, each with its own lock, so that
+// publishes and subscribes to different destinations rarely contend.
+type destMap struct {
+	shards []destShard
+}
+
+type destShard struct {
+	sync.RWMutex
+	m map[string]handler
+}
+
+func newDestMap(n int) *destMap {
+	if n < 1 {
+		n = 1
+	}
+	d := &destMap{shards: make([]destShard, n)}
+	for i := range d.shards {
+		d.shards[i].m = make(map[string]handler)
+	}
+	return d
+}
+
+// hashDest returns the FNV-1a hash of the destination.
+func hashDest(dest string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(dest); i++ {
+		h ^= uint32(dest[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// shard returns the shard of the destination, selected by the hash of
+// the destination.
+func (d *destMap) shard(dest string) *destShard {
+	return &d.shards[hashDest(dest)%uint32(len(d.shards))]
+}
+
+// load returns the handler of the destination.
+func (d *destMap) load(dest string) (handler, bool) {
+	s := d.shard(dest)
+	s.RLock()
+	h, ok := s.m[dest]
+	s.RUnlock()
+	return h, ok
+}
+
+// loadOrCreate returns the handler of the destination, storing the
+// handler returned by create if the destination does not exist. It
+// returns true if the handler was created.
+func (d *destMap) loadOrCreate(dest string, create func() handler) (handler, bool) {
+	s := d.shard(dest)
+	s.RLock()
+	h, ok := s.m[dest]
+	s.RUnlock()
+	if ok {
+		return h, false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	// the destination may have been created since the check above.
+	if h, ok = s.m[dest]; ok {
+		return h, false
+	}
+	h = create()
+	s.m[dest] = h
+	return h, true
+}
+
+// remove removes the destination.
+func (d *destMap) remove(dest string) {
+	s := d.shard(dest)
+	s.Lock()
+	delete(s.m, dest)
+	s.Unlock()
+}
+
+// each calls fn for every destination. The shards are not locked while
+// fn runs, so fn may add and remove destinations.
+func (d *destMap) each(fn func(dest string, h handler)) {
+	type entry struct {
+		dest string
+		h    handler
+	}
+	var entries []entry
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.RLock()
+		for dest, h := range s.m {
+			entries = append(entries, entry{dest, h})
+		}
+		s.RUnlock()
+	}
+	for _, e := range entries {
+		fn(e.dest, e.h)
+	}
+}
+
+// len returns the number of destinations.
+func (d *destMap) len() int {
+	var n int
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.RLock()
+		n += len(s.m)
+		s.RUnlock()
+	}
+	return n
+}
+
+// resize returns a copy of the map with n shards.
+func (d *destMap) resize(n int) *destMap {
+	c := newDestMap(n)
+	d.each(func(dest string, h handler) {
+		c.shard(dest).m[dest] = h
+	})
+	return c
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func Test_destMap(t *testing.T) {
+	d := newDestMap(4)
+	for i := 0; i < 100; i++ {
+		dest := fmt.Sprintf("/topic/%d", i)
+		_, created := d.loadOrCreate(dest, func() handler {
+			return newTopic([]byte(dest))
+		})
+		if !created {
+			t.Fatalf("Want %s created", dest)
+		}
+	}
+	if _, created := d.loadOrCreate("/topic/1", func() handler {
+		t.Fatalf("Want existing destination not created again")
+		return nil
+	}); created {
+		t.Errorf("Want existing destination loaded")
+	}
+	if got := d.len(); got != 100 {
+		t.Errorf("Want 100 destinations, got %d", got)
+	}
+
+	d.remove("/topic/1")
+	if _, ok := d.load("/topic/1"); ok {
+		t.Errorf("Want destination removed")
+	}
+
+	c := d.resize(16)
+	if got := c.len(); got != 99 {
+		t.Errorf("Want 99 destinations after resize, got %d", got)
+	}
+	c.each(func(dest string, h handler) {
+		if got, ok := c.load(dest); !ok || got != h {
+			t.Errorf("Want %s found in its shard after resize", dest)
+		}
+	})
+}
+
+func Test_destMapOne(t *testing.T) {
+	d := newDestMap(0)
+	if len(d.shards) != 1 {
+		t.Errorf("Want at least one shard, got %d", len(d.shards))
+	}
+}
+
+func TestWithShards(t *testing.T) {
+	s := NewServer(WithShards(8), WithVirtualHost("tenant", nil))
+	if got := len(s.router.destinations.shards); got != 8 {
+		t.Errorf("Want 8 shards, got %d", got)
+	}
+	if got := len(s.hosts["tenant"].destinations.shards); got != 8 {
+		t.Errorf("Want virtual host created with 8 shards, got %d", got)
+	}
+}
+
+func BenchmarkPublishParallel(b *testing.B) {
+	for _, shards := range []int{1, defaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			r := newRouter()
+			r.destinations = newDestMap(shards)
+			var n int32
+			b.RunParallel(func(pb *testing.PB) {
+				dest := []byte(fmt.Sprintf("/topic/%d", atomic.AddInt32(&n, 1)))
+				for pb.Next() {
+					m := stomp.NewMessage()
+					m.Method = stomp.MethodSend
+					m.Dest = append(m.Dest, dest...)
+					r.publish(m)
+					m.Release()
+				}
+			})
+		})
+	}
+}
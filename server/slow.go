@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// ErrSlowConsumer is the reason a session is closed by the
+// SlowConsumerClose policy.
+var ErrSlowConsumer = errors.New("stomp: slow consumer")
+
+// routeSlowAdvisory is the topic of slow consumer advisories.
+var routeSlowAdvisory = []byte("/topic/advisory/slow-consumer")
+
+// SlowConsumerPolicy defines how the server treats a session that does
+// not keep up with the messages delivered to it.
+type SlowConsumerPolicy string
+
+// Slow consumer policies.
+const (
+	// SlowConsumerDrop drops the oldest messages waiting to be written
+	// to the session until it catches up. Topic messages are discarded
+	// and queue messages are returned to the queue for other
+	// subscribers. Messages delivered with an ack mode are never
+	// dropped.
+	SlowConsumerDrop SlowConsumerPolicy = "drop"
+
+	// SlowConsumerClose closes the session.
+	SlowConsumerClose SlowConsumerPolicy = "close"
+
+	// SlowConsumerAdvisory publishes an advisory to the
+	// /topic/advisory/slow-consumer topic and continues delivering
+	// messages to the session.
+	SlowConsumerAdvisory SlowConsumerPolicy = "advisory"
+)
+
+// slowPolicy is the slow consumer configuration of a router.
+type slowPolicy struct {
+	limit  int           // pending messages before a session is slow
+	window time.Duration // time a session is slow before the policy applies
+	policy SlowConsumerPolicy
+}
+
+// slowAdvisory is the JSON body of a slow consumer advisory.
+type slowAdvisory struct {
+	Session  string `json:"session"`
+	ClientID string `json:"client_id,omitempty"`
+	User     string `json:"username,omitempty"`
+	Pending  int    `json:"pending"`
+}
+
+// outbox is the queue of frames waiting to be written to the connection
+// of a session under a slow consumer policy. Frames are written by a
+// goroutine of the session, so a client that does not keep up is
+// measured by the messages it holds whatever its ack mode, and the drop
+// policy can drop its oldest messages.
+type outbox struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	frames []*stomp.Message
+	auto   int   // queued messages without an ack id
+	closed int32 // the session ended, set under mu and read atomically
+	done   chan struct{}
+}
+
+func newOutbox() *outbox {
+	o := &outbox{done: make(chan struct{})}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// droppable returns true if the frame is a message delivered without an
+// ack mode, which the slow consumer policy may drop.
+func droppable(m *stomp.Message) bool {
+	return bytes.Equal(m.Method, stomp.MethodMessage) && len(m.Ack) == 0
+}
+
+// push queues the frame. Under the advisory policy, which neither drops
+// messages nor closes the session, it waits while the outbox is full,
+// as a blocking write would. It returns false if the outbox is closed.
+func (o *outbox) push(m *stomp.Message, p *slowPolicy) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if p.policy == SlowConsumerAdvisory {
+		for o.closed == 0 && len(o.frames) > p.limit {
+			o.cond.Wait()
+		}
+	}
+	if o.closed != 0 {
+		return false
+	}
+	o.frames = append(o.frames, m)
+	if droppable(m) {
+		o.auto++
+	}
+	o.cond.Broadcast()
+	return true
+}
+
+// pop returns the oldest frame, waiting until a frame is queued. It
+// returns false once the outbox is closed.
+func (o *outbox) pop() (*stomp.Message, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.closed == 0 && len(o.frames) == 0 {
+		o.cond.Wait()
+	}
+	if o.closed != 0 {
+		return nil, false
+	}
+	m := o.frames[0]
+	o.frames[0] = nil
+	o.frames = o.frames[1:]
+	if droppable(m) {
+		o.auto--
+	}
+	o.cond.Broadcast()
+	return m, true
+}
+
+// dropOldest removes and returns the oldest droppable message, or nil
+// if none is queued.
+func (o *outbox) dropOldest() *stomp.Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, m := range o.frames {
+		if droppable(m) {
+			o.frames = append(o.frames[:i], o.frames[i+1:]...)
+			o.auto--
+			return m
+		}
+	}
+	return nil
+}
+
+// pending returns the number of queued messages without an ack id.
+// Messages with an ack id are counted as awaiting an ack.
+func (o *outbox) pending() int {
+	if o == nil {
+		return 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.auto
+}
+
+// close closes the outbox and returns the frames not written.
+func (o *outbox) close() []*stomp.Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	frames := o.frames
+	o.frames = nil
+	o.auto = 0
+	atomic.StoreInt32(&o.closed, 1)
+	o.cond.Broadcast()
+	return frames
+}
+
+// isClosed returns true if the outbox is closed.
+func (o *outbox) isClosed() bool {
+	return o != nil && atomic.LoadInt32(&o.closed) != 0
+}
+
+// openOutbox queues the frames written to the session, if the router
+// applies a slow consumer policy.
+func (s *session) openOutbox() {
+	if s.router.slow == nil {
+		return
+	}
+	s.out = newOutbox()
+	go s.flush(s.out)
+}
+
+// flush writes the frames of the outbox to the connection until the
+// outbox is closed. Messages without an ack id that cannot be written
+// are returned to their queue.
+func (s *session) flush(o *outbox) {
+	defer close(o.done)
+	for {
+		m, ok := o.pop()
+		if !ok {
+			return
+		}
+		if !s.write(m) {
+			s.router.undeliver([]*stomp.Message{m})
+		}
+	}
+}
+
+// closeOutbox stops writing frames to the connection, returning the
+// messages not written to their queue, and waits until the outbox is
+// flushed. The connection must be closed, so that a blocked write
+// returns.
+func (s *session) closeOutbox() {
+	if s.out == nil {
+		return
+	}
+	s.router.undeliver(s.out.close())
+	<-s.out.done
+}
+
+// undeliver returns the messages without an ack id, which were not
+// written to the connection, to their queue and releases the messages.
+// Messages with an ack id are redelivered when the session ends.
+func (r *router) undeliver(messages []*stomp.Message) {
+	for _, m := range messages {
+		if droppable(m) && bytes.HasPrefix(m.Dest, routeQueue) {
+			m.Subs = m.Subs[:0]
+			r.publish(m)
+		}
+		m.Release()
+	}
+}
+
+// pending returns the number of messages delivered to the session that
+// are awaiting an ack or waiting to be written to the connection.
+func (s *session) pending() int {
+	s.Lock()
+	n := len(s.ack)
+	s.Unlock()
+	return n + s.out.pending() + int(atomic.LoadInt32(&s.inflight))
+}
+
+// slow returns true if the session exceeded the pending limit for longer
+// than the window of the policy.
+func (s *session) slow(p *slowPolicy) bool {
+	if s.pending() <= p.limit {
+		atomic.StoreInt64(&s.slowSince, 0)
+		atomic.StoreInt32(&s.slowNoticed, 0)
+		return false
+	}
+	now := time.Now().UnixNano()
+	if !atomic.CompareAndSwapInt64(&s.slowSince, 0, now) {
+		now = time.Now().UnixNano()
+	}
+	return time.Duration(now-atomic.LoadInt64(&s.slowSince)) >= p.window
+}
+
+// skipSlow returns true if queues should not deliver to the session
+// because it is slow and the policy drops its messages.
+func (r *router) skipSlow(sess *session) bool {
+	p := r.slow
+	return p != nil && p.policy == SlowConsumerDrop && sess.slow(p)
+}
+
+// slowConsumer applies the slow consumer policy to a message delivered
+// to the session. It returns true if the message was dropped.
+func (r *router) slowConsumer(sess *session, m *stomp.Message) bool {
+	p := r.slow
+	if p == nil || !sess.slow(p) {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&sess.slowNoticed, 0, 1) {
+		logger.Warningf("stomp: slow consumer %s: %d messages pending, policy %s",
+			sess.peer.Addr(),
+			sess.pending(),
+			p.policy,
+		)
+		if p.policy == SlowConsumerAdvisory {
+			r.adviseSlow(sess)
+		}
+	}
+
+	switch p.policy {
+	case SlowConsumerDrop:
+		if sess.out == nil {
+			return false
+		}
+		// the oldest messages are dropped to make room for the
+		// message. The caller may hold a queue lock, so dropped queue
+		// messages are returned to their queue asynchronously.
+		var dropped []*stomp.Message
+		for sess.pending() >= p.limit {
+			old := sess.out.dropOldest()
+			if old == nil {
+				break
+			}
+			dropped = append(dropped, old)
+		}
+		if len(dropped) != 0 {
+			logger.Verbosef("stomp: slow consumer %s: %d messages dropped", sess.peer.Addr(), len(dropped))
+			go r.undeliver(dropped)
+		}
+		return false
+	case SlowConsumerClose:
+		stomp.CloseWithError(sess.peer, ErrSlowConsumer)
+		var undelivered []*stomp.Message
+		if sess.out != nil {
+			undelivered = sess.out.close()
+		}
+		go r.undeliver(append(undelivered, m))
+		return true
+	}
+	return false
+}
+
+// adviseSlow publishes a slow consumer advisory for the session, if the
+// advisory topic has subscribers.
+func (r *router) adviseSlow(sess *session) {
+	h, ok := r.destinations.load(string(routeSlowAdvisory))
+	if !ok {
+		return
+	}
+
+	notice := slowAdvisory{
+		Session: sess.peer.Addr(),
+		Pending: sess.pending(),
+	}
+	if sess.msg != nil {
+		notice.ClientID = string(sess.msg.Header.Get(stomp.HeaderClientID))
+		notice.User = string(sess.msg.User)
+	}
+
+	m := stomp.NewMessage()
+	m.Method = stomp.MethodSend
+	m.Dest = append(m.Dest, routeSlowAdvisory...)
+	m.Body, _ = json.Marshal(notice)
+	m.Header.Add(stomp.HeaderContentType, []byte("application/json"))
+	h.publish(m)
+	m.Release()
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// connectPipe connects an in-memory peer to the server and subscribes to
+// the destination with the ack mode.
+func connectPipe(t *testing.T, s *Server, dest string, ack []byte) stomp.Peer {
+	a, b := stomp.Pipe()
+	go s.ServePeer(b)
+
+	connect := stomp.NewMessage()
+	connect.Method = stomp.MethodStomp
+	a.Send(connect)
+	if m := receive(t, a); !bytes.Equal(m.Method, stomp.MethodConnected) {
+		t.Fatalf("Expect CONNECTED, got %s", m.Method)
+	}
+
+	sub := stomp.NewMessage()
+	sub.Method = stomp.MethodSubscribe
+	sub.ID = []byte("1")
+	sub.Dest = []byte(dest)
+	sub.Ack = ack
+	sub.Receipt = []byte("2")
+	a.Send(sub)
+	receive(t, a)
+	return a
+}
+
+func TestSlowConsumerDrop(t *testing.T) {
+	s := NewServer(WithSlowConsumerPolicy(2, 0, SlowConsumerDrop))
+	a := connectPipe(t, s, "/queue/test", stomp.AckClientIndividual)
+
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+
+	// the pipe is synchronous, so each delivery is received before the
+	// next message is sent.
+	for i := 0; i < 3; i++ {
+		go producer.Send("/queue/test", []byte("hello"))
+		receive(t, a)
+	}
+	for i := 0; i < 2; i++ {
+		producer.Send("/queue/test", []byte("hello"), stomp.WithReceipt())
+	}
+
+	// the slow session holds three unacked messages, so the remaining
+	// messages stay queued.
+	if !waitQueueLen(s.router, "/queue/test", 2) {
+		t.Errorf("Expect messages queued while the consumer is slow, got %d",
+			queueLen(s, "/queue/test"))
+	}
+	select {
+	case m := <-a.Receive():
+		t.Errorf("Expect no delivery to the slow consumer, got %s", m.Method)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	s := NewServer(WithSlowConsumerPolicy(2, 0, SlowConsumerDrop))
+	a := connectPipe(t, s, "/topic/test", nil)
+
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+
+	// the client does not read, so once the pipe buffer is full the
+	// messages wait in the outbox until the oldest are dropped.
+	for i := 1; i <= 20; i++ {
+		producer.Send("/topic/test", []byte(strconv.Itoa(i)), stomp.WithReceipt())
+	}
+	got := drain(a)
+	if len(got) == 20 || len(got) == 0 || string(got[len(got)-1].Body) != "20" {
+		t.Errorf("Expect the oldest messages dropped, got %d messages", len(got))
+	}
+}
+
+func TestSlowConsumerCloseRequeue(t *testing.T) {
+	s := NewServer(WithSlowConsumerPolicy(1, 0, SlowConsumerClose))
+	a := connectPipe(t, s, "/queue/test", nil)
+
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+
+	for i := 0; i < 20; i++ {
+		producer.Send("/queue/test", []byte("hello"), stomp.WithReceipt())
+	}
+
+	// the messages not written to the closed session are requeued.
+	received := len(drain(a))
+	if received == 20 {
+		t.Fatalf("Expect slow consumer closed")
+	}
+	if !waitQueueLen(s.router, "/queue/test", 20-received) {
+		t.Errorf("Expect %d undelivered messages requeued, got %d", 20-received, queueLen(s, "/queue/test"))
+	}
+}
+
+// drain returns the messages received from the peer until it is closed
+// or no message is received for 50ms.
+func drain(peer stomp.Peer) []*stomp.Message {
+	var messages []*stomp.Message
+	for {
+		select {
+		case m, ok := <-peer.Receive():
+			if !ok {
+				return messages
+			}
+			messages = append(messages, m)
+		case <-time.After(50 * time.Millisecond):
+			return messages
+		}
+	}
+}
+
+func TestSlowConsumerClose(t *testing.T) {
+	s := NewServer(WithSlowConsumerPolicy(1, 0, SlowConsumerClose))
+	a := connectPipe(t, s, "/queue/test", stomp.AckClientIndividual)
+
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			producer.Send("/queue/test", []byte("hello"), stomp.WithReceipt())
+		}
+		close(sent)
+	}()
+	receive(t, a)
+	receive(t, a)
+	defer func() { <-sent }()
+
+	select {
+	case m, ok := <-a.Receive():
+		if ok {
+			t.Errorf("Expect slow consumer closed, got %s", m.Method)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timeout waiting for the slow consumer to be closed")
+	}
+}
+
+func TestSlowConsumerAdvisory(t *testing.T) {
+	s := NewServer(WithSlowConsumerPolicy(0, 0, SlowConsumerAdvisory))
+	advisories := connectPipe(t, s, string(routeSlowAdvisory), nil)
+	a := connectPipe(t, s, "/queue/test", stomp.AckClientIndividual)
+
+	producer := s.Client()
+	if err := producer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+
+	go producer.Send("/queue/test", []byte("hello"))
+
+	m := receive(t, advisories)
+	var notice slowAdvisory
+	if err := json.Unmarshal(m.Body, &notice); err != nil {
+		t.Fatal(err)
+	}
+	if notice.Pending != 1 {
+		t.Errorf("Expect advisory with 1 pending message, got %d", notice.Pending)
+	}
+
+	// the advisory policy continues delivering to the session.
+	if m := receive(t, a); !bytes.Equal(m.Method, stomp.MethodMessage) {
+		t.Errorf("Expect MESSAGE, got %s", m.Method)
+	}
+}
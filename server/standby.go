@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+var (
+	// ErrStandby is returned to clients connecting to a standby node
+	// that has not been promoted.
+	ErrStandby = errors.New("stomp: server is in standby mode")
+
+	errNotStandby = errors.New("stomp: server is not a standby")
+)
+
+// standbyRetry is the time a standby waits before reconnecting to the
+// primary after the replication stream is interrupted.
+var standbyRetry = time.Second
+
+// standby replicates queue state from a primary node until promoted.
+// Each virtual host is replicated over its own connection. While in
+// standby mode the server rejects client connections.
+type standby struct {
+	target   string
+	opts     []stomp.MessageOption
+	failover time.Duration
+	router   *router
+	hosts    map[string]*router // virtual hosts
+
+	mu       sync.Mutex
+	promoted bool
+	seen     time.Time // last time the primary was reachable
+	clients  map[*stomp.Client]struct{}
+	done     chan struct{}
+}
+
+func newStandby(target string, failover time.Duration, r *router, opts []stomp.MessageOption) *standby {
+	return &standby{
+		target:   target,
+		opts:     opts,
+		failover: failover,
+		router:   r,
+		seen:     time.Now(),
+		clients:  make(map[*stomp.Client]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// active returns true if the server is in standby mode.
+func (s *standby) active() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.promoted
+}
+
+// promote stops replication and promotes the standby to primary. The
+// replicated queues are delivered to their subscribers once promoted.
+func (s *standby) promote() error {
+	if s == nil {
+		return errNotStandby
+	}
+	s.mu.Lock()
+	if s.promoted {
+		s.mu.Unlock()
+		return nil
+	}
+	logger.Noticef("stomp: standby promoted to primary")
+	s.promoted = true
+	for _, r := range s.routers() {
+		r.advanceEpoch()
+	}
+	close(s.done)
+	for client := range s.clients {
+		client.Disconnect()
+	}
+	s.mu.Unlock()
+
+	for _, r := range s.routers() {
+		r.destinations.each(func(dest string, h handler) {
+			h.process()
+		})
+	}
+	return nil
+}
+
+// routers returns the default router and the virtual host routers.
+func (s *standby) routers() []*router {
+	routers := []*router{s.router}
+	for _, r := range s.hosts {
+		routers = append(routers, r)
+	}
+	return routers
+}
+
+// isStandby returns true if the router holds the replicated state of a
+// standby that has not been promoted.
+func (r *router) isStandby() bool {
+	return r.standby.active()
+}
+
+// run replicates every host from the primary until the standby is
+// promoted.
+func (s *standby) run() {
+	for host, r := range s.hosts {
+		go s.runHost(host, r)
+	}
+	s.runHost("", s.router)
+}
+
+// runHost replicates the host from the primary, reconnecting when the
+// replication stream is interrupted, until the standby is promoted. If
+// failover is enabled the replication of the default host promotes the
+// standby once the primary is unreachable for longer than the failover
+// duration.
+func (s *standby) runHost(host string, r *router) {
+	for {
+		err := s.replicate(host, r)
+		if !s.active() {
+			return
+		}
+		logger.Warningf("stomp: standby: replication from %s interrupted: %v", s.target, err)
+
+		s.mu.Lock()
+		down := time.Since(s.seen)
+		s.mu.Unlock()
+		if host == "" && s.failover > 0 && down > s.failover {
+			logger.Warningf("stomp: standby: primary %s unreachable for %s", s.target, down)
+			s.promote()
+			return
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(standbyRetry):
+		}
+	}
+}
+
+// replicate connects to the host of the primary and applies the
+// replication stream to the router until the connection is closed.
+func (s *standby) replicate(host string, r *router) error {
+	client, err := stomp.Dial(s.target)
+	if err != nil {
+		return err
+	}
+	opts := s.opts
+	if host != "" {
+		opts = append(opts[:len(opts):len(opts)], stomp.WithHost(host))
+	}
+	if err := client.Connect(opts...); err != nil {
+		client.Disconnect()
+		return err
+	}
+
+	s.mu.Lock()
+	if s.promoted {
+		s.mu.Unlock()
+		return client.Disconnect()
+	}
+	s.clients[client] = struct{}{}
+	s.seen = time.Now()
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, client)
+		s.seen = time.Now()
+		s.mu.Unlock()
+	}()
+
+	// the primary sends a snapshot of its queues when the standby
+	// subscribes, which replaces the replicated state.
+	r.resetQueues()
+	_, err = client.Subscribe(string(replicationDest), stomp.HandlerFunc(func(m *stomp.Message) {
+		applyReplica(client, r, m)
+	}))
+	if err != nil {
+		client.Disconnect()
+		return err
+	}
+	return <-client.Done()
+}
+
+// applyReplica applies the replicated operation to the standby router.
+func applyReplica(client *stomp.Client, r *router, m *stomp.Message) {
+	op := m.Header.Get(headerReplicaOp)
+	switch {
+	case bytes.Equal(op, replicaPublish):
+		r.publish(m)
+		if id := m.Header.Get(headerReplicaSync); len(id) != 0 {
+			client.Ack(id)
+		}
+	case bytes.Equal(op, replicaRemove):
+		h, ok := r.destinations.load(string(m.Dest))
+		if q, isQueue := h.(*queue); ok && isQueue {
+			q.removeReplica(m.Header.Get(headerReplicaID))
+		}
+	}
+}
+
+// resetQueues removes all queues from the router.
+func (r *router) resetQueues() {
+	r.destinations.each(func(dest string, h handler) {
+		if _, ok := h.(*queue); ok {
+			r.destinations.remove(dest)
+		}
+	})
+}
+
+// Promote promotes a standby server to primary. The server stops
+// replicating from the primary and begins accepting client connections.
+func (s *Server) Promote() error {
+	return s.standby.promote()
+}
+
+// HandleStandby writes the JSON-encoded standby status to the
+// http.Request. A POST request promotes the standby to primary and
+// requires admin authentication.
+func (s *Server) HandleStandby(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+		if err := s.Promote(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	type standbyResp struct {
+		Standby  bool   `json:"standby"`
+		ReadOnly bool   `json:"read_only,omitempty"`
+		Primary  string `json:"primary,omitempty"`
+		Replicas int    `json:"replicas"`
+	}
+	resp := standbyResp{
+		Standby:  s.standby.active(),
+		ReadOnly: s.readOnly(),
+		Replicas: s.router.replicas.len(),
+	}
+	if s.standby != nil {
+		resp.Primary = s.standby.target
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestStandby(t *testing.T) {
+	primary := NewServer(WithCredentials("standby", "secret"), WithReplication("standby"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go primary.ServeConn(conn)
+		}
+	}()
+
+	producer := primary.Client()
+	if err := producer.Connect(stomp.WithCredentials("standby", "secret")); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+	producer.Send("/queue/test", []byte("hello"), stomp.WithReceipt())
+
+	standby := NewServer(WithStandby("tcp://"+l.Addr().String(), 0,
+		stomp.WithCredentials("standby", "secret"),
+	))
+	defer standby.Promote()
+
+	// the standby receives a snapshot of the primary queues.
+	if !waitQueueLen(standby.router, "/queue/test", 1) {
+		t.Errorf("Expect queued message replicated to the standby")
+	}
+
+	if err := standby.Client().Connect(); err == nil {
+		t.Errorf("Expect standby to reject client connections")
+	}
+
+	err = producer.Send("/queue/test", []byte("hello"),
+		stomp.WithAckLevel(stomp.AckLevelMajority),
+	)
+	if err != nil {
+		t.Errorf("Expect receipt once the standby holds the message, got error %s", err)
+	}
+	if !waitQueueLen(standby.router, "/queue/test", 2) {
+		t.Errorf("Expect published message replicated to the standby")
+	}
+
+	// messages delivered by the primary are removed from the standby.
+	producer.Subscribe("/queue/test", stomp.HandlerFunc(func(*stomp.Message) {}))
+	if !waitQueueLen(standby.router, "/queue/test", 1) {
+		t.Errorf("Expect delivered messages removed from the standby")
+	}
+
+	if err := standby.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	client := standby.Client()
+	if err := client.Connect(); err != nil {
+		t.Errorf("Expect promoted standby to accept client connections, got %s", err)
+	}
+	client.Disconnect()
+}
+
+func TestReplicationForbidden(t *testing.T) {
+	for _, s := range []*Server{
+		NewServer(),
+		NewServer(WithReplication("standby")),
+		NewServer(WithCredentials("guest", "guest"), WithReplication("standby")),
+	} {
+		client := s.Client()
+		if err := client.Connect(stomp.WithCredentials("guest", "guest")); err != nil {
+			t.Fatal(err)
+		}
+		_, err := client.Subscribe(string(replicationDest), nil, stomp.WithReceipt())
+		if err == nil {
+			t.Errorf("Expect replication stream forbidden to sessions that are not standbys")
+		}
+
+		// acks are only accepted from standbys.
+		if r := s.router.replicas; r != nil {
+			acks := make(chan struct{}, 1)
+			r.Lock()
+			r.pending["sync"] = acks
+			r.Unlock()
+			client.Ack([]byte("sync"))
+			client.Send("/queue/test", []byte("hello"), stomp.WithReceipt())
+			if len(acks) != 0 {
+				t.Errorf("Expect ack from a session that is not a standby ignored")
+			}
+		}
+		client.Disconnect()
+	}
+}
+
+// waitQueueLen waits for the named queue to hold n messages.
+func waitQueueLen(r *router, dest string, n int) bool {
+	for i := 0; i < 200; i++ {
+		h, ok := r.destinations.load(dest)
+		if ok {
+			q := h.(*queue)
+			q.RLock()
+			got := q.list.Len()
+			q.RUnlock()
+			if got == n {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestStandbyReadOnly(t *testing.T) {
+	primary := NewServer(WithCredentials("standby", "secret"), WithReplication("standby"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go primary.ServeConn(conn)
+		}
+	}()
+
+	producer := primary.Client()
+	if err := producer.Connect(stomp.WithCredentials("standby", "secret")); err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Disconnect()
+	producer.Send("/queue/test", []byte("hello"), stomp.WithReceipt())
+
+	standby := NewServer(WithReadOnly(""), WithStandby("tcp://"+l.Addr().String(), 0,
+		stomp.WithCredentials("standby", "secret"),
+	))
+	defer standby.Promote()
+	if !waitQueueLen(standby.router, "/queue/test", 1) {
+		t.Fatalf("Expect queued message replicated to the standby")
+	}
+
+	// the read-only standby accepts subscriptions, but delivers nothing
+	// the primary may deliver.
+	client := standby.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	received := make(chan *stomp.Message, 1)
+	_, err = client.Subscribe("/queue/test", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m.Copy()
+	}), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+		t.Errorf("Expect standby to hold replicated messages")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := standby.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received:
+		if string(m.Body) != "hello" {
+			t.Errorf("Expect replicated message delivered, got %q", m.Body)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect held messages delivered once promoted")
+	}
+}
+
+func TestHandleStandbyPromote(t *testing.T) {
+	s := NewServer()
+	w := httptest.NewRecorder()
+	s.HandleStandby(w, httptest.NewRequest("POST", "/meta/standby", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expect promote rejected without the admin header, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.HandleStandby(w, adminRequest("POST", "/meta/standby"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expect promote of a primary rejected, got %d", w.Code)
+	}
+}
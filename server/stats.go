@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Stats are the statistics of a destination. Counters start when the
+// destination is created, and are reset if an unused destination is
+// removed.
+type Stats struct {
+	Host        string        `json:"host,omitempty"`
+	Dest        string        `json:"destination"`
+	Enqueued    int64         `json:"enqueued"`    // messages published
+	Dequeued    int64         `json:"dequeued"`    // messages delivered to subscribers
+	Depth       int           `json:"depth"`       // messages queued for delivery
+	Subscribers int           `json:"subscribers"` // active subscriptions
+	OldestAge   time.Duration `json:"-"`           // age of the message at the head of the queue
+	BytesIn     int64         `json:"bytes_in"`    // body bytes published
+	BytesOut    int64         `json:"bytes_out"`   // body bytes delivered
+}
+
+// stats returns the statistics of the destination, or false if the
+// destination does not exist.
+func (r *router) stats(dest string) (Stats, bool) {
+	h, ok := r.destinations.load(dest)
+	if !ok {
+		return Stats{}, false
+	}
+	r.RLock()
+	subs := r.subscribed()
+	r.RUnlock()
+	return r.destStats(dest, h, subs[dest], time.Now()), true
+}
+
+// snapshot returns the statistics of all destinations, sorted by
+// destination.
+func (r *router) snapshot() []Stats {
+	now := time.Now()
+	handlers := map[string]handler{}
+	r.RLock()
+	subs := r.subscribed()
+	r.destinations.each(func(dest string, h handler) {
+		handlers[dest] = h
+	})
+	r.RUnlock()
+
+	dests := make([]string, 0, len(handlers))
+	for dest := range handlers {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+
+	stats := make([]Stats, 0, len(dests))
+	for _, dest := range dests {
+		stats = append(stats, r.destStats(dest, handlers[dest], subs[dest], now))
+	}
+	return stats
+}
+
+// destStats returns the statistics of the destination handler.
+func (r *router) destStats(dest string, h handler, subs int, now time.Time) Stats {
+	u := r.usage.get(dest)
+	stats := Stats{
+		Host:        r.host,
+		Dest:        dest,
+		Enqueued:    u.enqueued,
+		Dequeued:    u.dequeued,
+		Subscribers: subs,
+		BytesIn:     u.bytesIn,
+		BytesOut:    u.bytesOut,
+	}
+	if q, ok := h.(*queue); ok {
+		var oldest time.Time
+		stats.Depth, oldest = q.depth()
+		if !oldest.IsZero() {
+			stats.OldestAge = now.Sub(oldest)
+		}
+	}
+	return stats
+}
+
+// Stats returns the statistics of the destination on the named virtual
+// host, or the default host if empty, or false if the destination does
+// not exist.
+func (s *Server) Stats(host, dest string) (Stats, bool) {
+	r := s.lookup([]byte(host))
+	if r == nil {
+		return Stats{}, false
+	}
+	return r.stats(dest)
+}
+
+// Snapshot returns the statistics of the destinations of every virtual
+// host.
+func (s *Server) Snapshot() []Stats {
+	var stats []Stats
+	for _, r := range s.routers() {
+		stats = append(stats, r.snapshot()...)
+	}
+	return stats
+}
+
+// HandleStats writes the JSON-encoded statistics of the destination
+// query parameter to the http.Request, or of all destinations if the
+// destination is empty.
+func (s *Server) HandleStats(w http.ResponseWriter, r *http.Request) {
+	type statsResp struct {
+		Stats
+		OldestAge float64 `json:"oldest_age_seconds"`
+	}
+	resp := func(stats Stats) statsResp {
+		return statsResp{Stats: stats, OldestAge: stats.OldestAge.Seconds()}
+	}
+
+	if dest := r.FormValue("destination"); dest != "" {
+		stats, ok := s.Stats(r.FormValue("host"), dest)
+		if !ok {
+			http.Error(w, errNoDestination.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(resp(stats))
+		return
+	}
+
+	report := []statsResp{}
+	for _, stats := range s.Snapshot() {
+		report = append(report, resp(stats))
+	}
+	json.NewEncoder(w).Encode(report)
+}
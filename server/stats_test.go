@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestStats(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	received := make(chan *stomp.Message, 10)
+	client.Subscribe("/topic/prices", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m
+	}), stomp.WithReceipt())
+	client.Send("/topic/prices", []byte("hello"), stomp.WithReceipt())
+	waitMessage(t, received)
+	client.Send("/queue/orders", []byte("first"), stomp.WithReceipt())
+	time.Sleep(10 * time.Millisecond)
+	client.Send("/queue/orders", []byte("second"), stomp.WithReceipt())
+
+	stats, ok := s.Stats("", "/queue/orders")
+	if !ok {
+		t.Fatal("Want stats of the queue")
+	}
+	if stats.Enqueued != 2 || stats.Dequeued != 0 || stats.Depth != 2 || stats.BytesIn != 11 {
+		t.Errorf("Want 2 queued messages of 11 bytes, got %+v", stats)
+	}
+	if stats.OldestAge < 10*time.Millisecond {
+		t.Errorf("Want age of the first message, got %s", stats.OldestAge)
+	}
+
+	stats, _ = s.Stats("", "/topic/prices")
+	if stats.Enqueued != 1 || stats.Dequeued != 1 || stats.BytesOut != 5 || stats.Subscribers != 1 || stats.Depth != 0 {
+		t.Errorf("Want 1 message delivered to 1 subscriber, got %+v", stats)
+	}
+	if _, ok := s.Stats("", "/queue/missing"); ok {
+		t.Errorf("Want no stats for a missing destination")
+	}
+
+	// consuming the head of the queue reduces its depth.
+	client.Subscribe("/queue/orders", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m
+	}), stomp.WithReceipt())
+	if m := waitMessage(t, received); string(m.Body) != "first" {
+		t.Fatalf("Want first message, got %s", m.Body)
+	}
+	stats, _ = s.Stats("", "/queue/orders")
+	if stats.Dequeued != 1 || stats.Depth != 1 || stats.BytesOut != 5 || stats.OldestAge == 0 {
+		t.Errorf("Want second message at the head of the queue, got %+v", stats)
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleStats(w, httptest.NewRequest("GET", "/meta/stats", nil))
+	var report []struct {
+		Dest     string `json:"destination"`
+		Enqueued int64  `json:"enqueued"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 || report[0].Dest != "/queue/orders" || report[0].Enqueued != 2 {
+		t.Errorf("Want snapshot of both destinations, got %+v", report)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleStats(w, httptest.NewRequest("GET", "/meta/stats?destination=/queue/missing", nil))
+	if w.Code != 404 {
+		t.Errorf("Want 404 for a missing destination, got %d", w.Code)
+	}
+}
@@ -6,47 +6,98 @@ import (
 	"github.com/mrwill84/mq/stomp"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type store interface {
-	put(*stomp.Message) error
+	put(m *stomp.Message, sync bool) error
 	delete(*stomp.Message) error
 	close() error
 }
 
+// datastore persists queue messages in the leveldb database, with keys
+// prefixed by the scope of the virtual host.
 type datastore struct {
-	db *leveldb.DB
+	db    *leveldb.DB
+	scope []byte
 }
 
-func (d *datastore) put(m *stomp.Message) error {
-	return d.db.Put(m.ID, m.Bytes(), nil)
+func (d *datastore) key(m *stomp.Message) []byte {
+	return append(append([]byte(nil), d.scope...), m.ID...)
+}
+
+func (d *datastore) put(m *stomp.Message, sync bool) error {
+	return d.db.Put(d.key(m), m.Bytes(), &opt.WriteOptions{Sync: sync})
 }
 
 func (d *datastore) delete(m *stomp.Message) error {
-	return d.db.Delete(m.ID, nil)
+	return d.db.Delete(d.key(m), nil)
 }
 
 func (d *datastore) close() error {
 	return d.db.Close()
 }
 
-// loadDatastore reads the datastore from disk and restores
-// persisted message to the appropriate queues.
-func loadDatastore(path string, b *router) (store, error) {
+// hostPrefix prefixes the keys of virtual hosts in the datastore, so
+// that they sort after the keys of the default host.
+var hostPrefix = []byte("\xffhost\x00")
+
+// hostScope returns the prefix of the datastore keys of the virtual
+// host. The keys of the default host are not prefixed.
+func hostScope(host string) []byte {
+	if host == "" {
+		return nil
+	}
+	scope := append(append([]byte(nil), hostPrefix...), host...)
+	return append(scope, 0)
+}
+
+// loadDatastore reads the datastore from disk and restores the
+// persisted messages of each router.
+func loadDatastore(path string, routers []*router) error {
 	db, err := leveldb.RecoverFile(path, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	for _, r := range routers {
+		if err := restoreHost(db, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreHost configures the router to persist messages to the datastore,
+// and restores persisted messages to the appropriate queues. Persisted
+// messages are then logged for replay, and durable subscriptions are
+// restored.
+func restoreHost(db *leveldb.DB, b *router) error {
+	scope := hostScope(b.host)
+	b.store = &datastore{db: db, scope: scope}
 
-	// iterate through the persisted messages
-	// and send to the broker.
-	iter := db.NewIterator(nil, nil)
+	// iterate through the persisted messages and send to the broker.
+	// Messages are assigned a new id when published, and are persisted
+	// again using the new id.
+	limit := append(append([]byte(nil), scope...), internalPrefix...)
+	iter := db.NewIterator(&util.Range{Start: scope, Limit: limit}, nil)
 	for iter.Next() {
 		m := stomp.NewMessage()
-		m.Parse(iter.Value())
+		m.Parse(append([]byte(nil), iter.Value()...))
+		m.Persist = stomp.PersistTrue
+		// restored messages are stamped with the current epoch, so
+		// that consumers fencing earlier epochs do not drop them.
+		m.Header.Del(stomp.HeaderEpoch)
+		db.Delete(iter.Key(), nil)
 		b.publish(m)
+		m.Release()
 	}
 	iter.Release()
-
-	return &datastore{db: db}, nil
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	b.log = newMessageLog(db, scope)
+	var err error
+	b.durables, err = b.log.loadDurables()
+	return err
 }
@@ -2,7 +2,9 @@ package server
 
 import (
 	"sync"
+	"time"
 
+	"github.com/mrwill84/mq/stomp"
 	"github.com/mrwill84/mq/stomp/selector"
 )
 
@@ -18,6 +20,17 @@ type subscription struct {
 	pending  int
 	session  *session
 	selector *selector.Selector
+
+	cumulative bool     // acks apply to all prior messages
+	unacked    []string // unacknowledged messages in delivery order
+
+	exclusive bool   // exclusive subscription
+	group     string // shared subscription group
+	since     int64  // subscription order
+
+	seen time.Time // time of the last ack or nack, or of subscribing
+
+	durable *durable // persisted subscription, if durable
 }
 
 // reset the subscription properties to zero values.
@@ -27,8 +40,15 @@ func (s *subscription) reset() {
 	s.ack = false
 	s.prefetch = 0
 	s.pending = 0
+	s.cumulative = false
+	s.unacked = s.unacked[:0]
 	s.session = nil
 	s.selector = nil
+	s.exclusive = false
+	s.group = ""
+	s.since = 0
+	s.seen = time.Time{}
+	s.durable = nil
 }
 
 // release releases the subscription to the pool.
@@ -37,6 +57,19 @@ func (s *subscription) release() {
 	subscriptionPool.Put(s)
 }
 
+// matches returns true if the message matches the selector of the
+// subscription, if any.
+func (s *subscription) matches(m *stomp.Message) bool {
+	s.mu.Lock()
+	sel := s.selector
+	s.mu.Unlock()
+	if sel == nil {
+		return true
+	}
+	ok, _ := sel.Eval(m.Header)
+	return ok
+}
+
 // Pending returns the pending message count.
 func (s *subscription) Pending() (i int) {
 	s.mu.Lock()
@@ -61,6 +94,68 @@ func (s *subscription) PendingDecr() {
 	s.mu.Unlock()
 }
 
+// track records the message ack id as unacknowledged.
+func (s *subscription) track(id []byte) {
+	s.mu.Lock()
+	s.unacked = append(s.unacked, string(id))
+	s.mu.Unlock()
+}
+
+// acked removes the message ack id from the unacknowledged messages and
+// returns the ack ids acknowledged. If cumulative is true the messages
+// delivered before the message are acknowledged as well.
+func (s *subscription) acked(id []byte, cumulative bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen = time.Now()
+	for i, v := range s.unacked {
+		if v != string(id) {
+			continue
+		}
+		if cumulative {
+			ids := append([]string(nil), s.unacked[:i+1]...)
+			s.unacked = append(s.unacked[:0], s.unacked[i+1:]...)
+			return ids
+		}
+		s.unacked = append(s.unacked[:i], s.unacked[i+1:]...)
+		break
+	}
+	return []string{string(id)}
+}
+
+// load returns the number of unacknowledged messages.
+func (s *subscription) load() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.unacked)
+}
+
+// exclusiveIdle is the time an exclusive subscription may hold
+// unacknowledged messages without acking before another subscription
+// takes over.
+var exclusiveIdle = 30 * time.Second
+
+// stalled returns true if the subscription holds unacknowledged
+// messages and has not acked or nacked a message for exclusiveIdle.
+func (s *subscription) stalled(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.unacked) != 0 && !now.Before(s.seen.Add(exclusiveIdle))
+}
+
+// subscriptionSeq orders subscriptions by creation.
+var subscriptionSeq int64
+
+// oldest returns the subscription created first.
+func oldest(subs []*subscription) (sub *subscription) {
+	for _, s := range subs {
+		if sub == nil || s.since < sub.since {
+			sub = s
+		}
+	}
+	return
+}
+
 //
 // subscription pool
 //
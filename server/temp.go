@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// routeTemp prefixes temporary queues. A temporary queue is scoped to the
+// session that uses it: /temp-queue/foo is rewritten to
+// /temp-queue/<scope>/foo, where the scope is unique to the session, and
+// the queue is deleted when the session ends.
+var routeTemp = []byte("/temp-queue/")
+
+// isTemp returns true if the destination is a temporary queue.
+func isTemp(dest []byte) bool {
+	return bytes.HasPrefix(dest, routeTemp)
+}
+
+// tempScope returns the prefix of the session's temporary queues,
+// allocating the scope on first use.
+func (r *router) tempScope(sess *session) []byte {
+	if sess.temp == nil {
+		id := newToken()
+		sess.temp = append(append(append([]byte(nil), routeTemp...), id...), '/')
+		r.Lock()
+		r.temps[string(id)] = sess
+		r.Unlock()
+	}
+	return sess.temp
+}
+
+// tempOwner returns true if the destination is a temporary queue scoped
+// to a connected session.
+func (r *router) tempOwner(dest []byte) bool {
+	id := dest[len(routeTemp):]
+	if i := bytes.IndexByte(id, '/'); i != -1 {
+		id = id[:i]
+	} else {
+		return false
+	}
+	r.RLock()
+	_, ok := r.temps[string(id)]
+	r.RUnlock()
+	return ok
+}
+
+// tempDest resolves the destination of a message from the session. A
+// temporary queue is scoped to the session, unless the message is sent
+// to a queue already scoped to a connected session, which is how replies
+// reach the requester. Other destinations are returned unchanged.
+func (r *router) tempDest(sess *session, dest []byte, send bool) []byte {
+	if !isTemp(dest) {
+		return dest
+	}
+	if sess.temp != nil && bytes.HasPrefix(dest, sess.temp) {
+		return dest
+	}
+	if send && r.tempOwner(dest) {
+		return dest
+	}
+	scope := r.tempScope(sess)
+	scoped := make([]byte, 0, len(scope)+len(dest)-len(routeTemp))
+	scoped = append(scoped, scope...)
+	return append(scoped, dest[len(routeTemp):]...)
+}
+
+// scopeTemp rewrites temporary queues in the destination and reply-to
+// headers of the message to the session scope.
+func (r *router) scopeTemp(sess *session, m *stomp.Message) {
+	send := bytes.Equal(m.Method, stomp.MethodSend)
+	m.Dest = r.tempDest(sess, m.Dest, send)
+	if replyTo := m.Header.Get(stomp.HeaderReplyTo); isTemp(replyTo) {
+		m.Header.Set(stomp.HeaderReplyTo, r.tempDest(sess, replyTo, true))
+	}
+}
+
+// dropTemp deletes the temporary queues of the session, discarding
+// queued messages.
+func (r *router) dropTemp(sess *session) {
+	if sess.temp == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	delete(r.temps, string(sess.temp[len(routeTemp):len(sess.temp)-1]))
+	r.destinations.each(func(dest string, h handler) {
+		if !bytes.HasPrefix([]byte(dest), sess.temp) {
+			return
+		}
+		r.destinations.remove(dest)
+		r.usage.remove(dest)
+		if q, ok := h.(*queue); ok {
+			q.discard()
+		}
+		logger.Verbosef("stomp: temporary queue %s deleted", dest)
+	})
+}
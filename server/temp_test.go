@@ -0,0 +1,91 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestTempQueue(t *testing.T) {
+	s := NewServer(WithExplicitDestinations())
+	if err := s.CreateDestination("", "/queue/requests"); err != nil {
+		t.Fatal(err)
+	}
+
+	responder := s.Client()
+	if err := responder.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Disconnect()
+	replyTo := make(chan string, 1)
+	_, err := responder.Subscribe("/queue/requests", stomp.HandlerFunc(func(m *stomp.Message) {
+		replyTo <- m.ReplyTo()
+		responder.Send(m.ReplyTo(), []byte("pong"), stomp.WithCorrelationID(m.CorrelationID()))
+		m.Release()
+	}), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requester := s.Client()
+	if err := requester.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	replies := make(chan string, 1)
+	_, err = requester.Subscribe("/temp-queue/replies", stomp.HandlerFunc(func(m *stomp.Message) {
+		replies <- m.CorrelationID()
+		m.Release()
+	}), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requester.Send("/queue/requests", []byte("ping"),
+		stomp.WithReplyTo("/temp-queue/replies"),
+		stomp.WithCorrelationID("req-1"),
+	)
+
+	var scoped string
+	select {
+	case scoped = <-replyTo:
+		if scoped == "/temp-queue/replies" || !strings.HasPrefix(scoped, "/temp-queue/") {
+			t.Errorf("Want reply-to scoped to the requester session, got %s", scoped)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want request delivered")
+	}
+	select {
+	case id := <-replies:
+		if id != "req-1" {
+			t.Errorf("Want reply correlated with the request, got %q", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want reply delivered to the temporary queue")
+	}
+
+	// other sessions cannot consume from the requester's queue.
+	_, ok := s.router.destinations.load(scoped)
+	if !ok {
+		t.Fatalf("Want temporary queue %s created", scoped)
+	}
+	if _, err := responder.Subscribe(scoped, stomp.HandlerFunc(func(m *stomp.Message) {
+		t.Errorf("Want temporary queue unreachable from other sessions")
+		m.Release()
+	}), stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	requester.Send("/queue/requests", []byte("ping"), stomp.WithReplyTo("/temp-queue/replies"))
+	<-replyTo
+	<-replies
+
+	requester.Disconnect()
+	for i := 0; i < 100; i++ {
+		_, ok = s.router.destinations.load(scoped)
+		if !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Want temporary queue deleted when the session ends")
+}
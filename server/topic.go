@@ -2,6 +2,8 @@ package server
 
 import (
 	"bytes"
+	"math/rand"
+	"strconv"
 	"sync"
 
 	"github.com/mrwill84/mq/stomp"
@@ -13,14 +15,20 @@ import (
 type topic struct {
 	sync.RWMutex
 
-	dest []byte
-	hist []*stomp.Message
-	subs map[*subscription]struct{}
+	dest  []byte
+	hist  []*stomp.Message
+	subs  map[*subscription]struct{}
+	clone bool // deliver a deep copy to each subscriber
+
+	sequence bool  // stamp messages with a sequence number
+	seq      int64 // last sequence number
+
+	compacts func(dest []byte) bool // retain the latest message by key
 }
 
 func newTopic(dest []byte) *topic {
 	return &topic{
-		dest: dest,
+		dest: append([]byte(nil), dest...),
 		subs: make(map[*subscription]struct{}),
 	}
 }
@@ -32,20 +40,18 @@ func newTopic(dest []byte) *topic {
 func (t *topic) publish(m *stomp.Message) error {
 	id := stomp.Rand()
 
-	t.RLock()
-	for sub := range t.subs {
-		if sub.selector != nil {
-			if ok, _ := sub.selector.Eval(m.Header); !ok {
-				continue
-			}
-		}
-		c := m.Copy()
-		c.ID = id
-		c.Method = stomp.MethodMessage
-		c.Subs = sub.id
-		sub.session.send(c)
+	// when sequencing is enabled the topic is locked for writing so
+	// that sequence numbers are delivered in order.
+	if t.sequence {
+		t.Lock()
+		t.seq++
+		t.fanout(m, id, strconv.AppendInt(nil, t.seq, 10))
+		t.Unlock()
+	} else {
+		t.RLock()
+		t.fanout(m, id, nil)
+		t.RUnlock()
 	}
-	t.RUnlock()
 
 	// if a message has the retain header set we should either
 	// retain the message, or remove the existing retained message.
@@ -62,7 +68,11 @@ func (t *topic) publish(m *stomp.Message) error {
 				t.hist = append(t.hist, c)
 			}
 		case bytes.Equal(m.Retain, stomp.RetainAll):
-			t.hist = append(t.hist, c)
+			if t.compacts != nil && t.compacts(t.dest) {
+				t.hist = compact(t.hist, c)
+			} else {
+				t.hist = append(t.hist, c)
+			}
 		case bytes.Equal(m.Retain, stomp.RetainRemove):
 			t.hist = t.hist[:0]
 		}
@@ -72,6 +82,77 @@ func (t *topic) publish(m *stomp.Message) error {
 	return nil
 }
 
+// compact adds the message to the retained messages, replacing the
+// message with the same key. A message with a key and an empty body
+// removes the message with the key.
+func compact(hist []*stomp.Message, m *stomp.Message) []*stomp.Message {
+	key := m.Header.Get(stomp.HeaderKey)
+	if len(key) == 0 {
+		return append(hist, m)
+	}
+	for i, h := range hist {
+		if bytes.Equal(h.Header.Get(stomp.HeaderKey), key) {
+			hist = append(hist[:i], hist[i+1:]...)
+			break
+		}
+	}
+	if len(m.Body) == 0 {
+		return hist
+	}
+	return append(hist, m)
+}
+
+// sends a copy of the message to each subscriber. If seq is non-nil
+// the copy is stamped with the sequence number.
+func (t *topic) fanout(m *stomp.Message, id, seq []byte) {
+	var (
+		exclusive []*subscription
+		groups    map[string][]*subscription
+	)
+
+	for sub := range t.subs {
+		if !sub.matches(m) {
+			continue
+		}
+		switch {
+		case sub.exclusive:
+			exclusive = append(exclusive, sub)
+		case sub.group != "":
+			if groups == nil {
+				groups = map[string][]*subscription{}
+			}
+			groups[sub.group] = append(groups[sub.group], sub)
+		default:
+			t.deliver(m, sub, id, seq)
+		}
+	}
+
+	// the oldest exclusive subscription receives the message while
+	// the remaining exclusive subscriptions are on standby.
+	if sub := oldest(exclusive); sub != nil {
+		t.deliver(m, sub, id, seq)
+	}
+
+	// a single member of each shared subscription group receives the
+	// message, distributing messages across the group.
+	for _, members := range groups {
+		t.deliver(m, members[rand.Intn(len(members))], id, seq)
+	}
+}
+
+// sends a copy of the message to the subscriber.
+func (t *topic) deliver(m *stomp.Message, sub *subscription, id, seq []byte) {
+	c := t.copy(m)
+	c.ID = id
+	c.Method = stomp.MethodMessage
+	c.Subs = sub.id
+	if seq != nil {
+		c.Header.Set(stomp.HeaderSequence, seq)
+	}
+	sub.durable.delivered(c)
+	sub.session.send(c)
+}
+
 // registers the subscription with the topic broker and
 // sends the last retained message, if one exists.
 func (t *topic) subscribe(s *subscription, m *stomp.Message) error {
@@ -85,7 +166,7 @@ func (t *topic) subscribe(s *subscription, m *stomp.Message) error {
 	t.RUnlock()
 
 	for _, m := range hist {
-		c := m.Copy()
+		c := t.copy(m)
 		c.Method = stomp.MethodMessage
 		c.Subs = s.id
 		c.ID = stomp.Rand()
@@ -111,6 +192,16 @@ func (t *topic) disconnect(s *session) error {
 	return nil
 }
 
+// purge removes the retained messages and returns the number of
+// messages removed.
+func (t *topic) purge() int {
+	t.Lock()
+	n := len(t.hist)
+	t.hist = t.hist[:0]
+	t.Unlock()
+	return n
+}
+
 func (t *topic) process() error {
 	return nil
 }
@@ -132,3 +223,11 @@ func (t *topic) recycle() (ok bool) {
 func (t *topic) destination() string {
 	return string(t.dest)
 }
+
+// returns a copy of the message for delivery to a subscriber.
+func (t *topic) copy(m *stomp.Message) *stomp.Message {
+	if t.clone {
+		return m.Clone()
+	}
+	return m.Copy()
+}
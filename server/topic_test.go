@@ -174,3 +174,79 @@ func Test_topic_dest(t *testing.T) {
 		t.Errorf("want destingation name /topic/test got %s", got)
 	}
 }
+
+func Test_topic_publish_group(t *testing.T) {
+	m := stomp.NewMessage()
+	m.Dest = []byte("/topic/test")
+	m.Header.Add(stomp.HeaderGroup, []byte("workers"))
+	defer m.Release()
+
+	b := newTopic(m.Dest)
+
+	var clients []stomp.Peer
+	for i := 0; i < 3; i++ {
+		peer, client := stomp.Pipe()
+		sess := requestSession()
+		sess.peer = peer
+		defer sess.release()
+		b.subscribe(sess.subs(m), m)
+		clients = append(clients, client)
+	}
+
+	for i := 0; i < 10; i++ {
+		b.publish(m)
+		got := 0
+		for _, client := range clients {
+			select {
+			case <-client.Receive():
+				got++
+			default:
+			}
+		}
+		if got != 1 {
+			t.Errorf("expect message delivered to one group member, got %d", got)
+		}
+	}
+}
+
+func Test_topic_publish_exclusive(t *testing.T) {
+	m := stomp.NewMessage()
+	m.Dest = []byte("/topic/test")
+	m.Header.Add(stomp.HeaderExclusive, []byte("true"))
+	defer m.Release()
+
+	peer1, client1 := stomp.Pipe()
+	sess1 := requestSession()
+	sess1.peer = peer1
+	defer sess1.release()
+
+	peer2, client2 := stomp.Pipe()
+	sess2 := requestSession()
+	sess2.peer = peer2
+	defer sess2.release()
+
+	b := newTopic(m.Dest)
+	sub1 := sess1.subs(m)
+	b.subscribe(sub1, m)
+	b.subscribe(sess2.subs(m), m)
+
+	b.publish(m)
+	select {
+	case <-client1.Receive():
+	default:
+		t.Errorf("expect message delivered to the active exclusive subscription")
+	}
+	select {
+	case <-client2.Receive():
+		t.Errorf("expect standby exclusive subscription to receive nothing")
+	default:
+	}
+
+	b.unsubscribe(sub1, m)
+	b.publish(m)
+	select {
+	case <-client2.Receive():
+	default:
+		t.Errorf("expect standby exclusive subscription to take over")
+	}
+}
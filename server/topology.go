@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// topology represents the broker topology as a graph of nodes and the
+// edges along which messages flow.
+type topology struct {
+	Nodes []topologyNode `json:"nodes"`
+	Edges []topologyEdge `json:"edges"`
+}
+
+type topologyNode struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+}
+
+type topologyEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label,omitempty"`
+}
+
+// topology returns a snapshot of the broker topology.
+func (s *Server) topology() *topology {
+	t := new(topology)
+	t.node("broker", "broker", "broker")
+
+	for _, r := range s.routers() {
+		host := "host:" + r.host
+		label := r.host
+		if label == "" {
+			label = "default"
+		}
+		t.node(host, "host", label)
+		t.edge("broker", host, "")
+
+		r.RLock()
+		var dests []string
+		r.destinations.each(func(dest string, h handler) {
+			dests = append(dests, dest)
+		})
+		sort.Strings(dests)
+		for _, dest := range dests {
+			id := host + "/dest:" + dest
+			t.node(id, "destination", dest)
+			t.edge(host, id, "")
+		}
+
+		for sess := range r.sessions {
+			id := fmt.Sprintf("%s/session:%p", host, sess)
+			t.node(id, "session", sess.peer.Addr())
+
+			sess.Lock()
+			for _, sub := range sess.sub {
+				t.edge(host+"/dest:"+string(sub.dest), id, string(sub.id))
+			}
+			sess.Unlock()
+		}
+		r.RUnlock()
+	}
+	return t
+}
+
+func (t *topology) node(id, kind, label string) {
+	t.Nodes = append(t.Nodes, topologyNode{id, kind, label})
+}
+
+func (t *topology) edge(from, to, label string) {
+	t.Edges = append(t.Edges, topologyEdge{from, to, label})
+}
+
+// writeDOT writes the topology in Graphviz DOT format.
+func (t *topology) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph mq {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	for _, n := range t.Nodes {
+		fmt.Fprintf(w, "\t%q [label=%q shape=%s];\n", n.ID, n.Label, shapes[n.Kind])
+	}
+	for _, e := range t.Edges {
+		fmt.Fprintf(w, "\t%q -> %q [label=%q];\n", e.From, e.To, e.Label)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+var shapes = map[string]string{
+	"broker":      "box3d",
+	"host":        "folder",
+	"destination": "cylinder",
+	"session":     "ellipse",
+}
+
+// HandleTopology writes the broker topology to the http.Request, including
+// virtual hosts, destinations and the sessions subscribed to each
+// destination. The topology is JSON-encoded, or encoded in Graphviz DOT
+// format if the format query parameter is dot.
+func (s *Server) HandleTopology(w http.ResponseWriter, r *http.Request) {
+	t := s.topology()
+	if r.FormValue("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		t.writeDOT(w)
+		return
+	}
+	json.NewEncoder(w).Encode(t)
+}
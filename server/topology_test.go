@@ -0,0 +1,38 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func Test_server_topology(t *testing.T) {
+	s := NewServer()
+
+	client, peer := stomp.Pipe()
+	defer client.Close()
+	sess := requestSession()
+	sess.peer = peer
+	s.router.sessions[sess] = struct{}{}
+
+	sub := stomp.NewMessage()
+	sub.ID = []byte("1")
+	sub.Dest = []byte("/topic/test")
+	s.router.subscribe(sess, sub)
+
+	top := s.topology()
+	if len(top.Nodes) != 4 {
+		t.Errorf("expect broker, host, destination and session nodes, got %d", len(top.Nodes))
+	}
+	if len(top.Edges) != 3 {
+		t.Errorf("expect host, destination and subscription edges, got %d", len(top.Edges))
+	}
+
+	var buf bytes.Buffer
+	top.writeDOT(&buf)
+	if !strings.Contains(buf.String(), `"host:/dest:/topic/test"`) {
+		t.Errorf("expect destination node in DOT output, got %s", buf.String())
+	}
+}
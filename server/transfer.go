@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+	"github.com/mrwill84/mq/stomp/selector"
+)
+
+var errSameDestination = errors.New("stomp: source and target destinations are the same")
+
+// take removes and returns up to limit queued messages matching the
+// selector, including messages spilled to disk. A limit of zero removes
+// all matching messages. Messages read from disk which do not match are
+// held in memory. The messages remain in the datastore until forgotten.
+func (q *queue) take(sel *selector.Selector, limit int) []*stomp.Message {
+	q.Lock()
+	defer q.Unlock()
+
+	var messages []*stomp.Message
+	var next = q.list.Front()
+	for e := next; e != nil; e = next {
+		next = e.Next()
+		m := e.Value.(*stomp.Message)
+		if sel != nil {
+			if ok, _ := sel.Eval(m.Header); !ok {
+				continue
+			}
+		}
+		q.list.Remove(e)
+		q.free(m)
+		messages = append(messages, m)
+		if limit > 0 && len(messages) == limit {
+			return messages
+		}
+	}
+
+	for q.overflow.len() != 0 && (limit == 0 || len(messages) < limit) {
+		spilled, err := q.overflow.shift()
+		if err != nil {
+			logger.Warningf("stomp: transfer %s: overflow: %s", string(q.dest), err)
+			break
+		}
+		for _, m := range spilled {
+			if limit == 0 || len(messages) < limit {
+				ok := sel == nil
+				if !ok {
+					ok, _ = sel.Eval(m.Header)
+				}
+				if ok {
+					messages = append(messages, m)
+					continue
+				}
+			}
+			q.list.PushBack(m)
+			q.alloc(m)
+		}
+	}
+	return messages
+}
+
+// transfer moves, or copies, up to limit messages matching the selector
+// from the source queue to the target destination and returns the number
+// of messages transferred. If the target is empty each message is sent
+// to the destination recorded when the message was dead-lettered, which
+// re-drives messages from a dead-letter queue; messages without a
+// recorded destination remain queued.
+func (r *router) transfer(source, target string, sel *selector.Selector, limit int, move bool) (int, error) {
+	if source == target {
+		return 0, errSameDestination
+	}
+	h, ok := r.destinations.load(source)
+	q, isQueue := h.(*queue)
+	if !ok || !isQueue {
+		return 0, errNoDestination
+	}
+
+	var messages []*stomp.Message
+	if move {
+		messages = q.take(sel, limit)
+	} else {
+		messages = q.snapshot(sel, limit)
+	}
+
+	var n int
+	for i, m := range messages {
+		dest := target
+		if dest == "" {
+			dest = string(m.Header.Get(headerOriginalDest))
+		}
+		if dest == "" || dest == source {
+			q.requeue(messages[i:i+1], move)
+			continue
+		}
+		orig := append([]byte(nil), m.Dest...)
+		m.Dest = append(m.Dest[:0], dest...)
+		m.Subs = m.Subs[:0]
+		m.Ack = m.Ack[:0]
+		if err := r.publish(m); err != nil {
+			m.Dest = append(m.Dest[:0], orig...)
+			q.requeue(messages[i:], move)
+			return n, err
+		}
+		// moved messages are removed from the datastore once held by
+		// the target.
+		if move {
+			m.Dest = append(m.Dest[:0], orig...)
+			q.forget(m)
+		}
+		m.Release()
+		n++
+	}
+
+	logger.Noticef("stomp: transferred %d messages from %s", n, source)
+	return n, nil
+}
+
+// requeue returns moved messages to the queue, or releases copies.
+// Moved messages were not forgotten, so they remain in the datastore and
+// on standby nodes.
+func (q *queue) requeue(messages []*stomp.Message, move bool) {
+	if !move {
+		for _, m := range messages {
+			m.Release()
+		}
+		return
+	}
+	q.Lock()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if q.sequence {
+			q.insert(messages[i])
+		} else {
+			q.list.PushFront(messages[i])
+		}
+		q.alloc(messages[i])
+	}
+	q.Unlock()
+	q.process()
+}
+
+// MoveMessages moves up to limit messages matching the selector from the
+// source queue of the virtual host to the target destination, and
+// returns the number of messages moved. If the target is empty messages
+// are moved back to the destination they were dead-lettered from.
+func (s *Server) MoveMessages(host, source, target, sel string, limit int) (int, error) {
+	return s.transfer(host, source, target, sel, limit, true)
+}
+
+// CopyMessages copies up to limit messages matching the selector from
+// the source queue of the virtual host to the target destination, and
+// returns the number of messages copied.
+func (s *Server) CopyMessages(host, source, target, sel string, limit int) (int, error) {
+	return s.transfer(host, source, target, sel, limit, false)
+}
+
+func (s *Server) transfer(host, source, target, sel string, limit int, move bool) (int, error) {
+	var expr *selector.Selector
+	if sel != "" {
+		var err error
+		if expr, err = selector.Parse([]byte(sel)); err != nil {
+			return 0, err
+		}
+	}
+	router := s.lookup([]byte(host))
+	if router == nil {
+		return 0, ErrUnknownHost
+	}
+	return router.transfer(source, target, expr, limit, move)
+}
+
+// HandleTransfer moves messages from the source queue query parameter to
+// the destination query parameter, or copies messages if the copy query
+// parameter is true. Messages are selected by the selector and limit
+// query parameters. The number of messages transferred is written to the
+// http.Request as JSON.
+func (s *Server) HandleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+
+	var limit int
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	transfer := s.MoveMessages
+	if r.FormValue("copy") == "true" {
+		transfer = s.CopyMessages
+	}
+
+	n, err := transfer(
+		r.FormValue("host"),
+		r.FormValue("source"),
+		r.FormValue("destination"),
+		r.FormValue("selector"),
+		limit,
+	)
+	switch err {
+	case nil:
+	case errNoDestination, ErrUnknownHost:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type transferResp struct {
+		Transferred int `json:"transferred"`
+	}
+	json.NewEncoder(w).Encode(transferResp{Transferred: n})
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestTransfer(t *testing.T) {
+	s := NewServer()
+	for i := 0; i < 3; i++ {
+		m := stomp.NewMessage()
+		m.Dest = []byte("/queue/orders")
+		m.Body = []byte(strconv.Itoa(i))
+		m.Header.Add([]byte("n"), []byte(strconv.Itoa(i)))
+		s.router.deadLetter(m)
+		m.Release()
+	}
+
+	n, err := s.CopyMessages("", "/queue/dlq/orders", "/queue/audit", "n >= 1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || queueLen(s, "/queue/audit") != 1 {
+		t.Errorf("Want 1 message copied, got %d", n)
+	}
+	if queueLen(s, "/queue/dlq/orders") != 3 {
+		t.Errorf("Want copied messages retained in the source queue")
+	}
+
+	// messages moved without a target are re-driven to the destination
+	// they were dead-lettered from.
+	n, err = s.MoveMessages("", "/queue/dlq/orders", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || queueLen(s, "/queue/orders") != 3 {
+		t.Errorf("Want 3 messages re-driven, got %d", n)
+	}
+	if queueLen(s, "/queue/dlq/orders") != 0 {
+		t.Errorf("Want moved messages removed from the source queue")
+	}
+
+	if _, err := s.MoveMessages("", "/queue/unknown", "/queue/orders", "", 0); err != errNoDestination {
+		t.Errorf("Want errNoDestination, got %v", err)
+	}
+	if _, err := s.MoveMessages("", "/queue/orders", "/queue/orders", "", 0); err != errSameDestination {
+		t.Errorf("Want errSameDestination, got %v", err)
+	}
+}
+
+func TestTransferOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer(WithOverflow(dir, 2))
+	for i := 0; i < 6; i++ {
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodSend
+		m.Dest = []byte("/queue/source")
+		m.Header.Add([]byte("n"), []byte(strconv.Itoa(i)))
+		s.router.publish(m)
+		m.Release()
+	}
+
+	n, err := s.CopyMessages("", "/queue/source", "/queue/copy", "n >= 3", 0)
+	if err != nil || n != 3 {
+		t.Errorf("Want spilled messages copied, got %d, %v", n, err)
+	}
+	n, err = s.MoveMessages("", "/queue/source", "/queue/target", "n >= 1", 4)
+	if err != nil || n != 4 {
+		t.Errorf("Want spilled messages moved, got %d, %v", n, err)
+	}
+	if stats, _ := s.Stats("", "/queue/target"); stats.Depth != 4 {
+		t.Errorf("Want moved messages queued, got depth %d", stats.Depth)
+	}
+	if stats, _ := s.Stats("", "/queue/source"); stats.Depth != 2 {
+		t.Errorf("Want unmatched messages retained, got depth %d", stats.Depth)
+	}
+}
+
+func TestTransferOriginalDestination(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// the original destination is recorded by the broker only.
+	client.Send("/queue/dlq/orders", []byte("forged"),
+		stomp.WithHeader(string(headerOriginalDest), "/queue/private"),
+		stomp.WithReceipt(),
+	)
+	n, err := s.MoveMessages("", "/queue/dlq/orders", "", "", 0)
+	if err != nil || n != 0 || queueLen(s, "/queue/private") != 0 {
+		t.Errorf("Want forged original destination ignored, got %d, %v", n, err)
+	}
+}
+
+func TestHandleTransfer(t *testing.T) {
+	s := NewServer()
+	m := stomp.NewMessage()
+	m.Dest = []byte("/queue/source")
+	s.router.publish(m)
+	m.Release()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/meta/transfer?source=/queue/source&destination=/queue/target", nil)
+	s.HandleTransfer(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Want status 405, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/meta/transfer?source=/queue/source&destination=/queue/target", nil)
+	s.HandleTransfer(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Want status 403 without the admin header, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/meta/transfer?source=/queue/source&destination=/queue/target", nil)
+	r.Header.Set(HeaderAdminRequest, "1")
+	s.HandleTransfer(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "{\"transferred\":1}\n" {
+		t.Errorf("Want 1 message transferred, got %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/meta/transfer?source=/queue/unknown&destination=/queue/target", nil)
+	r.Header.Set(HeaderAdminRequest, "1")
+	s.HandleTransfer(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Want status 404, got %d", w.Code)
+	}
+}
+
+// queueLen returns the number of messages held by the named queue.
+func queueLen(s *Server, dest string) int {
+	h, ok := s.router.destinations.load(dest)
+	if !ok {
+		return 0
+	}
+	q := h.(*queue)
+	q.RLock()
+	defer q.RUnlock()
+	return q.list.Len()
+}
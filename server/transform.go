@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// Transformer transforms messages sent to a destination before they are
+// delivered to subscribers. Returning an error rejects the message, and
+// the error is sent to the producer.
+type Transformer interface {
+	Transform(m *stomp.Message) error
+}
+
+// TransformerFunc is an adapter to allow the use of ordinary functions
+// as a Transformer.
+type TransformerFunc func(m *stomp.Message) error
+
+// Transform calls f(m).
+func (f TransformerFunc) Transform(m *stomp.Message) error {
+	return f(m)
+}
+
+// ValidationError is returned by transformers rejecting a message which
+// fails validation.
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return "stomp: invalid message: " + e.Reason
+}
+
+type transform struct {
+	pattern string
+	chain   []Transformer
+	config  bool // configured by Config, and replaced by Reload
+}
+
+// transform applies the transformers of the destination to the message
+// sent by a producer. Chains are applied in the order they were added.
+func (r *router) transform(m *stomp.Message) error {
+	r.RLock()
+	transforms := r.transforms
+	r.RUnlock()
+
+	for _, t := range transforms {
+		if ok, _ := path.Match(t.pattern, string(m.Dest)); !ok {
+			continue
+		}
+		for _, tr := range t.chain {
+			if err := tr.Transform(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StampHeaders returns a Transformer which sets the headers, replacing
+// the values sent by the producer.
+func StampHeaders(headers map[string]string) Transformer {
+	return TransformerFunc(func(m *stomp.Message) error {
+		for key, value := range headers {
+			m.Header.Set([]byte(key), []byte(value))
+		}
+		return nil
+	})
+}
+
+// RedactJSON returns a Transformer which replaces the values of the
+// fields of JSON object bodies. Fields are dotted paths, such as
+// user.ssn. Bodies which are not JSON objects are not modified.
+func RedactJSON(fields ...string) Transformer {
+	return TransformerFunc(func(m *stomp.Message) error {
+		obj, ok := jsonObject(m.Body)
+		if !ok {
+			return nil
+		}
+		var changed bool
+		for _, field := range fields {
+			parent, key, ok := lookupField(obj, field)
+			if ok {
+				parent[key] = string(redacted)
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		body, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		m.Body = body
+		return nil
+	})
+}
+
+// RequireFields returns a Transformer which rejects messages unless the
+// body is a JSON object with the fields. Fields are dotted paths, such
+// as user.id.
+func RequireFields(fields ...string) Transformer {
+	return TransformerFunc(func(m *stomp.Message) error {
+		obj, ok := jsonObject(m.Body)
+		if !ok {
+			return &ValidationError{Reason: "body must be a json object"}
+		}
+		for _, field := range fields {
+			if _, _, ok := lookupField(obj, field); !ok {
+				return &ValidationError{Reason: "missing field " + field}
+			}
+		}
+		return nil
+	})
+}
+
+// jsonObject decodes the body if it is a JSON object.
+func jsonObject(body []byte) (map[string]interface{}, bool) {
+	if b := bytes.TrimSpace(body); len(b) == 0 || b[0] != '{' {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+// lookupField returns the object containing the dotted field, and the
+// key of the field in it.
+func lookupField(obj map[string]interface{}, field string) (map[string]interface{}, string, bool) {
+	keys := strings.Split(field, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+		obj = next
+	}
+	key := keys[len(keys)-1]
+	_, ok := obj[key]
+	return obj, key, ok
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestTransform(t *testing.T) {
+	e := NewEmbedded(WithTransform("/queue/orders.*",
+		RequireFields("id"),
+		RedactJSON("card.number", "missing.field"),
+		StampHeaders(map[string]string{"x-source": "broker"}),
+	))
+	defer e.Close()
+	client, err := e.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *stomp.Message, 2)
+	handler := stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m.Clone()
+	})
+	client.Subscribe("/queue/orders.new", handler, stomp.WithReceipt())
+	client.Subscribe("/queue/other", handler, stomp.WithReceipt())
+
+	body := `{"id":1,"card":{"number":"4111111111111111","exp":"12/30"}}`
+	if err := client.Send("/queue/orders.new", []byte(body), stomp.WithReceipt(), stomp.WithHeader("x-source", "client")); err != nil {
+		t.Fatal(err)
+	}
+	m := waitMessage(t, received)
+	var got struct {
+		ID   int
+		Card map[string]string
+	}
+	if err := json.Unmarshal(m.Body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 1 || got.Card["number"] != string(redacted) || got.Card["exp"] != "12/30" {
+		t.Errorf("Want card number redacted, got %s", m.Body)
+	}
+	if source := m.Header.GetString("x-source"); source != "broker" {
+		t.Errorf("Want stamped header to replace the producer value, got %q", source)
+	}
+
+	err = client.Send("/queue/orders.new", []byte(`{"card":{}}`), stomp.WithReceipt())
+	if err == nil || !strings.Contains(err.Error(), "missing field id") {
+		t.Errorf("Want message without required field rejected, got %v", err)
+	}
+
+	if err := client.Send("/queue/other", []byte("plain"), stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	if m := waitMessage(t, received); string(m.Body) != "plain" || m.Header.GetString("x-source") != "" {
+		t.Errorf("Want other destinations not transformed, got %s", m)
+	}
+}
+
+func TestTransformReload(t *testing.T) {
+	s := NewServer(WithTransform("/queue/*", StampHeaders(nil)))
+	c := &Config{Destinations: []DestinationConfig{
+		{Pattern: "/queue/a", Headers: map[string]string{"x-source": "broker"}},
+	}}
+	if err := s.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.router.transforms); n != 2 {
+		t.Errorf("Want configured transforms added, got %d", n)
+	}
+	if err := s.Reload(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.router.transforms); n != 1 {
+		t.Errorf("Want configured transforms removed and others kept, got %d", n)
+	}
+}
+
+// waitMessage returns the next message from the channel.
+func waitMessage(t *testing.T, c <-chan *stomp.Message) *stomp.Message {
+	select {
+	case m := <-c:
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for message")
+	}
+	return nil
+}
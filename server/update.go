@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+	"github.com/mrwill84/mq/stomp/selector"
+)
+
+// update replaces the selector and prefetch count of an existing
+// subscription with the settings of the subscribe message. The
+// subscription is updated while the destination is locked, so no
+// messages are missed or delivered twice as they would be when
+// unsubscribing and subscribing again.
+func (r *router) update(sess *session, m *stomp.Message) error {
+	sess.Lock()
+	sub, ok := sess.sub[string(m.ID)]
+	sess.Unlock()
+	if !ok {
+		return errNoSubscription
+	}
+
+	var sel *selector.Selector
+	if len(m.Selector) != 0 {
+		var err error
+		if sel, err = selector.Parse(m.Selector); err != nil {
+			return err
+		}
+	}
+
+	h, ok := r.destinations.load(string(sub.dest))
+	if !ok {
+		return errNoDestination
+	}
+
+	l, _ := h.(sync.Locker)
+	if l != nil {
+		l.Lock()
+	}
+	sub.mu.Lock()
+	sub.selector = sel
+	sub.prefetch = stomp.ParseInt(m.Prefetch)
+	sub.ack = sub.ack || sub.prefetch != 0
+	sub.mu.Unlock()
+	if l != nil {
+		l.Unlock()
+	}
+
+	logger.Noticef("stomp: subscribe %s: updated: selector %q prefetch %d",
+		string(m.ID),
+		string(m.Selector),
+		sub.prefetch,
+	)
+
+	// queued messages may now match the selector or fit within the
+	// prefetch count.
+	return h.process()
+}
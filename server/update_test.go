@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestUpdateSubscription(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	received := make(chan *stomp.Message, 10)
+	sub, err := client.Subscribe("/queue/test", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m
+	}), stomp.WithSelector("color = 'red'"), stomp.WithReceipt())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Send("/queue/test", []byte("blue"),
+		stomp.WithHeader("color", "blue"),
+		stomp.WithReceipt(),
+	)
+	select {
+	case <-received:
+		t.Errorf("Expect message not matching the selector queued")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = client.Update(sub.ID(), stomp.WithSelector("color = 'blue'"), stomp.WithReceipt())
+	if err != nil {
+		t.Fatalf("Expect subscription updated, got %s", err)
+	}
+	select {
+	case m := <-received:
+		if string(m.Body) != "blue" {
+			t.Errorf("Expect queued message delivered, got %s", m.Body)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect queued message delivered once the selector matches")
+	}
+
+	if err := client.Update([]byte("unknown"), stomp.WithReceipt()); err == nil {
+		t.Errorf("Expect error updating an unknown subscription")
+	}
+	if err := client.Update(sub.ID(), stomp.WithSelector("color ="), stomp.WithReceipt()); err == nil {
+		t.Errorf("Expect error updating with an invalid selector")
+	}
+}
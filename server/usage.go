@@ -0,0 +1,291 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// usageWindow is the time window of the rolling publish and consume
+// rates.
+var usageWindow = time.Minute
+
+// usageIdle is the default time after which a destination without
+// activity is reported as idle.
+var usageIdle = time.Hour
+
+// sweepInterval is the interval at which idle destinations are deleted
+// and idle sessions are closed
+// when an idle timeout is configured.
+var sweepInterval = time.Minute
+
+// rate is an exponentially weighted moving average of events per second.
+type rate struct {
+	value float64
+	last  time.Time
+}
+
+func (r *rate) add(now time.Time) {
+	r.value = r.at(now) + 1/usageWindow.Seconds()
+	r.last = now
+}
+
+// at returns the rate decayed to the given time.
+func (r *rate) at(now time.Time) float64 {
+	if r.last.IsZero() {
+		return 0
+	}
+	return r.value * math.Exp(-now.Sub(r.last).Seconds()/usageWindow.Seconds())
+}
+
+// destUsage tracks the activity of a destination.
+type destUsage struct {
+	created     time.Time
+	lastPublish time.Time
+	lastConsume time.Time
+	publishRate rate
+	consumeRate rate
+
+	enqueued int64 // messages published
+	dequeued int64 // messages delivered
+	bytesIn  int64 // body bytes published
+	bytesOut int64 // body bytes delivered
+}
+
+// active returns the time of the last activity.
+func (u *destUsage) active() time.Time {
+	last := u.created
+	if u.lastPublish.After(last) {
+		last = u.lastPublish
+	}
+	if u.lastConsume.After(last) {
+		last = u.lastConsume
+	}
+	return last
+}
+
+// usageTracker tracks the activity of each destination. Destinations
+// are distributed across shards by hash, like the destination map, so
+// that publishes to different destinations do not contend.
+type usageTracker struct {
+	shards [defaultShards]usageShard
+}
+
+type usageShard struct {
+	sync.Mutex
+	dests map[string]*destUsage
+}
+
+func newUsageTracker() *usageTracker {
+	u := new(usageTracker)
+	for i := range u.shards {
+		u.shards[i].dests = make(map[string]*destUsage)
+	}
+	return u
+}
+
+// shard returns the shard of the destination.
+func (u *usageTracker) shard(dest string) *usageShard {
+	return &u.shards[hashDest(dest)%defaultShards]
+}
+
+// track begins tracking a new destination. Only tracked destinations
+// record activity, so that messages sent to destinations that do not
+// exist do not grow the tracker.
+func (u *usageTracker) track(dest []byte) {
+	s := u.shard(string(dest))
+	s.Lock()
+	if _, ok := s.dests[string(dest)]; !ok {
+		s.dests[string(dest)] = &destUsage{created: time.Now()}
+	}
+	s.Unlock()
+}
+
+// published records a message published to the destination.
+func (u *usageTracker) published(m *stomp.Message) {
+	now := time.Now()
+	s := u.shard(string(m.Dest))
+	s.Lock()
+	if d, ok := s.dests[string(m.Dest)]; ok {
+		d.lastPublish = now
+		d.publishRate.add(now)
+		d.enqueued++
+		d.bytesIn += int64(len(m.Body))
+	}
+	s.Unlock()
+}
+
+// consumed records a message delivered from the destination.
+func (u *usageTracker) consumed(m *stomp.Message) {
+	now := time.Now()
+	s := u.shard(string(m.Dest))
+	s.Lock()
+	if d, ok := s.dests[string(m.Dest)]; ok {
+		d.lastConsume = now
+		d.consumeRate.add(now)
+		d.dequeued++
+		d.bytesOut += int64(len(m.Body))
+	}
+	s.Unlock()
+}
+
+// get returns a copy of the destination usage.
+func (u *usageTracker) get(dest string) (d destUsage) {
+	s := u.shard(dest)
+	s.Lock()
+	if v, ok := s.dests[dest]; ok {
+		d = *v
+	}
+	s.Unlock()
+	return
+}
+
+// remove stops tracking the destination.
+func (u *usageTracker) remove(dest string) {
+	s := u.shard(dest)
+	s.Lock()
+	delete(s.dests, dest)
+	s.Unlock()
+}
+
+// len returns the number of destinations tracked.
+func (u *usageTracker) len() int {
+	var n int
+	for i := range u.shards {
+		s := &u.shards[i]
+		s.Lock()
+		n += len(s.dests)
+		s.Unlock()
+	}
+	return n
+}
+
+// subscribed returns the number of subscriptions to each destination.
+// The caller must hold the router lock.
+func (r *router) subscribed() map[string]int {
+	subs := map[string]int{}
+	for sess := range r.sessions {
+		sess.Lock()
+		for _, sub := range sess.sub {
+			subs[string(sub.dest)]++
+		}
+		sess.Unlock()
+	}
+	return subs
+}
+
+// sweepIdle deletes destinations without subscribers that have been
+// idle for longer than the idle timeout. Messages held by deleted
+// queues are discarded.
+func (r *router) sweepIdle(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	subs := r.subscribed()
+	r.destinations.each(func(dest string, h handler) {
+		if subs[dest] != 0 || r.isDeclared(dest) {
+			return
+		}
+		u := r.usage.get(dest)
+		if now.Sub(u.active()) < r.idle {
+			return
+		}
+		logger.Noticef("stomp: deleting idle destination %s", dest)
+		r.destinations.remove(dest)
+		r.usage.remove(dest)
+		if q, ok := h.(*queue); ok {
+			q.discard()
+		}
+	})
+}
+
+// sweep periodically deletes idle destinations and closes idle
+// sessions of routers with an idle timeout, until the server is closed.
+func (s *Server) sweep() {
+	tick := time.NewTicker(sweepInterval)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-s.done:
+			return
+		case now = <-tick.C:
+		}
+		for _, r := range s.routers() {
+			if r.idle > 0 {
+				r.sweepIdle(now)
+			}
+			if r.sessionIdle > 0 {
+				r.sweepSessions(now)
+			}
+		}
+	}
+}
+
+// HandleUsage writes a JSON-encoded report of destination activity to
+// the http.Request. Destinations without activity for longer than the
+// idle query parameter, one hour by default, are reported as idle, and
+// destinations without subscribers are reported as orphaned.
+func (s *Server) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	idle := usageIdle
+	if v := r.FormValue("idle"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		idle = d
+	}
+
+	type usageResp struct {
+		Host        string     `json:"host,omitempty"`
+		Dest        string     `json:"destination"`
+		LastPublish *time.Time `json:"last_publish,omitempty"`
+		LastConsume *time.Time `json:"last_consume,omitempty"`
+		PublishRate float64    `json:"publish_rate"`
+		ConsumeRate float64    `json:"consume_rate"`
+		Subscribers int        `json:"subscribers"`
+		Idle        bool       `json:"idle"`
+		Orphaned    bool       `json:"orphaned"`
+	}
+
+	now := time.Now()
+	report := []usageResp{}
+	for _, router := range s.routers() {
+		router.RLock()
+		subs := router.subscribed()
+		var dests []string
+		router.destinations.each(func(dest string, h handler) {
+			dests = append(dests, dest)
+		})
+		router.RUnlock()
+		sort.Strings(dests)
+
+		for _, dest := range dests {
+			u := router.usage.get(dest)
+			resp := usageResp{
+				Host:        router.host,
+				Dest:        dest,
+				PublishRate: u.publishRate.at(now),
+				ConsumeRate: u.consumeRate.at(now),
+				Subscribers: subs[dest],
+				Idle:        now.Sub(u.active()) >= idle,
+				Orphaned:    subs[dest] == 0,
+			}
+			if !u.lastPublish.IsZero() {
+				resp.LastPublish = &u.lastPublish
+			}
+			if !u.lastConsume.IsZero() {
+				resp.LastConsume = &u.lastConsume
+			}
+			report = append(report, resp)
+		}
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func Test_rate(t *testing.T) {
+	now := time.Now()
+	var r rate
+	for i := 0; i < 60; i++ {
+		r.add(now)
+	}
+	if got := r.at(now); math.Abs(got-1) > 1e-9 {
+		t.Errorf("Want rate of 1 per second, got %f", got)
+	}
+	if got := r.at(now.Add(usageWindow)); got >= 0.5 {
+		t.Errorf("Want rate decayed after the window, got %f", got)
+	}
+}
+
+func TestUsageReport(t *testing.T) {
+	s := NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	client.Subscribe("/topic/active", stomp.HandlerFunc(func(*stomp.Message) {}), stomp.WithReceipt())
+	client.Send("/topic/active", []byte("hello"), stomp.WithReceipt())
+	client.Send("/queue/orphan", []byte("hello"), stomp.WithReceipt())
+
+	w := httptest.NewRecorder()
+	s.HandleUsage(w, httptest.NewRequest("GET", "/meta/usage?idle=0s", nil))
+
+	var report []struct {
+		Dest        string     `json:"destination"`
+		LastPublish *time.Time `json:"last_publish"`
+		LastConsume *time.Time `json:"last_consume"`
+		Subscribers int        `json:"subscribers"`
+		Idle        bool       `json:"idle"`
+		Orphaned    bool       `json:"orphaned"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 {
+		t.Fatalf("Want 2 destinations in the report, got %d", len(report))
+	}
+	if got := report[0]; got.Dest != "/queue/orphan" || !got.Orphaned || got.LastPublish == nil {
+		t.Errorf("Want orphaned queue with last publish time, got %+v", got)
+	}
+	if got := report[1]; got.Dest != "/topic/active" || got.Orphaned || got.Subscribers != 1 || got.LastConsume == nil {
+		t.Errorf("Want subscribed topic with last consume time, got %+v", got)
+	}
+	if !report[0].Idle {
+		t.Errorf("Want destinations reported idle with zero idle threshold")
+	}
+}
+
+func TestSweepIdle(t *testing.T) {
+	s := NewServer(WithIdleTimeout(time.Minute))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	client.Subscribe("/queue/subscribed", stomp.HandlerFunc(func(*stomp.Message) {}), stomp.WithReceipt())
+	client.Send("/queue/orphan", []byte("hello"), stomp.WithReceipt())
+
+	s.router.sweepIdle(time.Now())
+	if _, ok := s.router.destinations.load("/queue/orphan"); !ok {
+		t.Errorf("Want recently active destination retained")
+	}
+
+	s.router.sweepIdle(time.Now().Add(2 * time.Minute))
+	if _, ok := s.router.destinations.load("/queue/orphan"); ok {
+		t.Errorf("Want idle orphaned destination deleted")
+	}
+	if _, ok := s.router.destinations.load("/queue/subscribed"); !ok {
+		t.Errorf("Want idle destination with subscribers retained")
+	}
+}
+
+func TestUsageMissingDestination(t *testing.T) {
+	s := NewServer(WithExplicitDestinations())
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	client.Send("/queue/missing", []byte("hello"), stomp.WithReceipt())
+	if n := s.router.usage.len(); n != 0 {
+		t.Errorf("Want no usage tracked for missing destinations, got %d", n)
+	}
+}
+
+func TestSweepClose(t *testing.T) {
+	s := NewServer(WithIdleTimeout(time.Minute))
+	done := make(chan struct{})
+	go func() {
+		s.sweep()
+		close(done)
+	}()
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Want sweeper stopped when the server is closed")
+	}
+}
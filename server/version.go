@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// versionPolicy defines the client library versions supported by the
+// server. Connections from unsupported versions are logged.
+type versionPolicy struct {
+	minimum      string
+	incompatible map[string]struct{}
+}
+
+// check logs a warning if the client version is outdated or known to
+// be incompatible with the server.
+func (p *versionPolicy) check(sess *session, client string) {
+	if p == nil || client == "" {
+		return
+	}
+	version := clientVersion(client)
+	if _, ok := p.incompatible[version]; ok {
+		logger.Warningf("stomp: incompatible client version: addr=%s client=%s",
+			sess.peer.Addr(),
+			client,
+		)
+		return
+	}
+	if p.minimum != "" && compareVersions(version, p.minimum) < 0 {
+		logger.Warningf("stomp: outdated client version: addr=%s client=%s minimum=%s",
+			sess.peer.Addr(),
+			client,
+			p.minimum,
+		)
+	}
+}
+
+// HandleVersions writes a JSON-encoded map of client versions and the
+// number of connected sessions using each version to the http.Request.
+func (s *Server) HandleVersions(w http.ResponseWriter, r *http.Request) {
+	versions := map[string]int{}
+	for _, router := range s.routers() {
+		router.RLock()
+		for sess := range router.sessions {
+			client := string(sess.msg.Header.Get(stomp.HeaderClient))
+			if client == "" {
+				client = "unknown"
+			}
+			versions[client]++
+		}
+		router.RUnlock()
+	}
+	json.NewEncoder(w).Encode(versions)
+}
+
+// helper function returns the version from the client header, which is
+// formatted as product/version.
+func clientVersion(client string) string {
+	if i := strings.LastIndex(client, "/"); i != -1 {
+		return client[i+1:]
+	}
+	return client
+}
+
+// helper function compares two dot-separated version strings, returning
+// -1, 0 or 1 if version a is less than, equal to or greater than b.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func Test_compareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"1.2.0", "1.10.0", -1},
+		{"2.0.0", "1.9.9", 1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("Want compare %s to %s = %d, got %d", test.a, test.b, test.want, got)
+		}
+	}
+}
+
+func Test_clientVersion(t *testing.T) {
+	if got := clientVersion("mq/1.2.3"); got != "1.2.3" {
+		t.Errorf("Want version parsed from client header, got %s", got)
+	}
+	if got := clientVersion("1.2.3"); got != "1.2.3" {
+		t.Errorf("Want version without product name, got %s", got)
+	}
+}
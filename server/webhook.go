@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// Webhook delivery defaults.
+var (
+	webhookAttempts   = 5
+	webhookBackoff    = time.Second
+	webhookMaxBackoff = time.Minute
+	webhookTimeout    = time.Second * 10
+)
+
+// Webhook request headers.
+const (
+	headerWebhookDest      = "Mq-Destination"
+	headerWebhookMessageID = "Mq-Message-Id"
+	headerWebhookTimestamp = "Mq-Timestamp"
+	headerWebhookSignature = "Mq-Signature"
+	headerWebhookPrefix    = "Mq-Header-"
+)
+
+var (
+	errWebhookURL     = errors.New("stomp: webhook url must be http or https")
+	errWebhookDest    = errors.New("stomp: webhook destination required")
+	errNoWebhook      = errors.New("stomp: no such webhook")
+	errWebhookFailure = errors.New("stomp: webhook delivery failed")
+	errWebhookSecret  = errors.New("stomp: webhook secret must be sent in the request body")
+)
+
+// Webhook configures an HTTP push subscription. Messages sent to the
+// destination are POSTed to the url, and retried with exponential
+// backoff until the endpoint responds with a 2xx status. Messages that
+// cannot be delivered are sent to the dead-letter queue.
+//
+// If a secret is set, the Mq-Signature header of each request holds the
+// hex-encoded HMAC-SHA256, keyed by the secret, of the Mq-Timestamp
+// header, the Mq-Message-Id header and the body, joined by periods.
+// Endpoints reject requests with an old timestamp or a message id
+// already seen, so that a captured request cannot be replayed.
+type Webhook struct {
+	Host     string        // virtual host
+	Dest     string        // subscribed destination
+	URL      string        // endpoint url
+	Secret   string        // key used to sign requests, optional
+	Attempts int           // delivery attempts before dead-lettering
+	Backoff  time.Duration // delay before the first retry
+}
+
+// webhook is a running webhook subscription.
+type webhook struct {
+	Webhook
+	id        string
+	client    *stomp.Client
+	router    *router
+	done      chan struct{}
+	delivered int64 // accessed atomically
+	failed    int64 // accessed atomically
+}
+
+// webhooks holds the webhook subscriptions of the server.
+type webhooks struct {
+	sync.Mutex
+	hooks   map[string]*webhook
+	pending []Webhook // configured before the server started
+	seq     int64
+}
+
+func newWebhooks() *webhooks {
+	return &webhooks{hooks: make(map[string]*webhook)}
+}
+
+// AddWebhook subscribes the webhook to its destination and returns the
+// webhook id.
+func (s *Server) AddWebhook(hook Webhook) (string, error) {
+	if hook.Dest == "" {
+		return "", errWebhookDest
+	}
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", errWebhookURL
+	}
+	router := s.lookup([]byte(hook.Host))
+	if router == nil {
+		return "", ErrUnknownHost
+	}
+	if hook.Attempts <= 0 {
+		hook.Attempts = webhookAttempts
+	}
+	if hook.Backoff <= 0 {
+		hook.Backoff = webhookBackoff
+	}
+
+	s.webhooks.Lock()
+	s.webhooks.seq++
+	id := strconv.FormatInt(s.webhooks.seq, 10)
+	s.webhooks.Unlock()
+
+	w := &webhook{
+		Webhook: hook,
+		id:      id,
+		client:  s.Client(),
+		router:  router,
+		done:    make(chan struct{}),
+	}
+	if err := w.client.Connect(stomp.WithHost(hook.Host)); err != nil {
+		w.client.Disconnect()
+		return "", err
+	}
+	_, err = w.client.Subscribe(hook.Dest, stomp.HandlerFunc(w.handle),
+		stomp.WithAck(string(stomp.AckClientIndividual)),
+		stomp.WithReceipt(),
+	)
+	if err != nil {
+		w.client.Disconnect()
+		return "", err
+	}
+
+	s.webhooks.Lock()
+	s.webhooks.hooks[id] = w
+	s.webhooks.Unlock()
+
+	logger.Noticef("stomp: webhook %s subscribed to %s", id, hook.Dest)
+	return id, nil
+}
+
+// RemoveWebhook unsubscribes the webhook. Messages not yet delivered
+// remain queued.
+func (s *Server) RemoveWebhook(id string) error {
+	s.webhooks.Lock()
+	w, ok := s.webhooks.hooks[id]
+	delete(s.webhooks.hooks, id)
+	s.webhooks.Unlock()
+	if !ok {
+		return errNoWebhook
+	}
+	close(w.done)
+	return w.client.Disconnect()
+}
+
+// handle delivers the message to the webhook endpoint, retrying with
+// exponential backoff, and dead-letters the message if every attempt
+// fails.
+func (w *webhook) handle(m *stomp.Message) {
+	defer m.Release()
+
+	backoff := w.Backoff
+	for attempt := 1; ; attempt++ {
+		err := w.deliver(m)
+		if err == nil {
+			atomic.AddInt64(&w.delivered, 1)
+			w.ack(m)
+			return
+		}
+		logger.Warningf("stomp: webhook %s: attempt %d: %s", w.id, attempt, err)
+		if attempt == w.Attempts {
+			break
+		}
+		select {
+		case <-w.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+
+	atomic.AddInt64(&w.failed, 1)
+	d := m.Clone()
+	d.Subs = d.Subs[:0]
+	d.Ack = d.Ack[:0]
+	if err := w.router.deadLetter(d); err != nil {
+		logger.Warningf("stomp: webhook %s: dead-letter: %s", w.id, err)
+	}
+	d.Release()
+	w.ack(m)
+}
+
+// ack acknowledges the delivered message.
+func (w *webhook) ack(m *stomp.Message) {
+	if len(m.Ack) != 0 {
+		w.client.Ack(append([]byte(nil), m.Ack...))
+	}
+}
+
+// deliver POSTs the message to the webhook endpoint.
+func (w *webhook) deliver(m *stomp.Message) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(m.Body))
+	if err != nil {
+		return err
+	}
+	contentType := "application/octet-stream"
+	for i := 0; i < m.Header.Len(); i++ {
+		k, v := m.Header.Index(i)
+		if bytes.Equal(k, []byte("content-type")) {
+			contentType = string(v)
+			continue
+		}
+		req.Header.Set(headerWebhookPrefix+string(k), string(v))
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(headerWebhookDest, string(m.Dest))
+	req.Header.Set(headerWebhookMessageID, string(m.ID))
+	if w.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(headerWebhookTimestamp, timestamp)
+		req.Header.Set(headerWebhookSignature, "sha256="+sign(w.Secret, timestamp, string(m.ID), m.Body))
+	}
+
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", errWebhookFailure, resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex-encoded HMAC-SHA256, keyed by the secret, of the
+// timestamp, message id and body joined by periods.
+func sign(secret, timestamp, id string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + id + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HandleWebhooks writes a JSON-encoded list of webhooks to the
+// http.Request. A POST request adds a webhook for the destination and
+// url parameters, optionally configured by the host, attempts and
+// backoff parameters, and writes the webhook id. The secret parameter
+// must be sent in the form-encoded request body, so that it is not
+// logged with the url. A DELETE request removes the webhook with the id
+// parameter. POST and DELETE requests are admin requests.
+func (s *Server) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+	}
+	switch r.Method {
+	case "POST":
+		if r.URL.Query().Get("secret") != "" {
+			http.Error(w, errWebhookSecret.Error(), http.StatusBadRequest)
+			return
+		}
+		hook := Webhook{
+			Host:   r.FormValue("host"),
+			Dest:   r.FormValue("destination"),
+			URL:    r.FormValue("url"),
+			Secret: r.PostFormValue("secret"),
+		}
+		if v := r.FormValue("attempts"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			hook.Attempts = n
+		}
+		if v := r.FormValue("backoff"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			hook.Backoff = d
+		}
+		id, err := s.AddWebhook(hook)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+		return
+	case "DELETE":
+		if err := s.RemoveWebhook(r.FormValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	type webhookResp struct {
+		ID        string `json:"id"`
+		Host      string `json:"host,omitempty"`
+		Dest      string `json:"destination"`
+		URL       string `json:"url"`
+		Attempts  int    `json:"attempts"`
+		Backoff   string `json:"backoff"`
+		Signed    bool   `json:"signed"`
+		Delivered int64  `json:"delivered"`
+		Failed    int64  `json:"failed"`
+	}
+
+	s.webhooks.Lock()
+	var ids []string
+	for id := range s.webhooks.hooks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	hooks := []webhookResp{}
+	for _, id := range ids {
+		hook := s.webhooks.hooks[id]
+		hooks = append(hooks, webhookResp{
+			ID:        id,
+			Host:      hook.Host,
+			Dest:      hook.Dest,
+			URL:       hook.URL,
+			Attempts:  hook.Attempts,
+			Backoff:   hook.Backoff.String(),
+			Signed:    hook.Secret != "",
+			Delivered: atomic.LoadInt64(&hook.delivered),
+			Failed:    atomic.LoadInt64(&hook.failed),
+		})
+	}
+	s.webhooks.Unlock()
+
+	json.NewEncoder(w).Encode(hooks)
+}
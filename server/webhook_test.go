@@ -0,0 +1,145 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestWebhook(t *testing.T) {
+	type request struct {
+		body, signature, timestamp, id, dest, header string
+	}
+	requests := make(chan request, 1)
+	var failures int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures < 2 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{
+			body:      string(body),
+			signature: r.Header.Get(headerWebhookSignature),
+			timestamp: r.Header.Get(headerWebhookTimestamp),
+			id:        r.Header.Get(headerWebhookMessageID),
+			dest:      r.Header.Get(headerWebhookDest),
+			header:    r.Header.Get(headerWebhookPrefix + "kind"),
+		}
+	}))
+	defer ts.Close()
+
+	s := NewServer(WithWebhook(Webhook{
+		Dest:    "/queue/hooks",
+		URL:     ts.URL,
+		Secret:  "secret",
+		Backoff: time.Millisecond,
+	}))
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	client.Send("/queue/hooks", []byte("hello"), stomp.WithHeader("kind", "greeting"))
+
+	select {
+	case got := <-requests:
+		if got.body != "hello" || got.dest != "/queue/hooks" || got.header != "greeting" {
+			t.Errorf("Want message POSTed to the webhook, got %+v", got)
+		}
+		if got.timestamp == "" || got.id == "" {
+			t.Errorf("Want timestamp and message id headers, got %+v", got)
+		}
+		if want := "sha256=" + sign("secret", got.timestamp, got.id, []byte("hello")); got.signature != want {
+			t.Errorf("Want request signed %s, got %s", want, got.signature)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want message delivered after retries")
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	s := NewServer()
+	id, err := s.AddWebhook(Webhook{
+		Dest:     "/queue/failing",
+		URL:      ts.URL,
+		Attempts: 2,
+		Backoff:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.RemoveWebhook(id)
+
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	client.Send("/queue/failing", []byte("hello"))
+
+	if !waitQueueLen(s.router, "/queue/dlq/failing", 1) {
+		t.Errorf("Want undeliverable message dead-lettered")
+	}
+
+	if _, err := s.AddWebhook(Webhook{Dest: "/queue/failing", URL: "ftp://example.com"}); err != errWebhookURL {
+		t.Errorf("Want error for non-http url, got %v", err)
+	}
+	if err := s.RemoveWebhook("unknown"); err != errNoWebhook {
+		t.Errorf("Want error removing unknown webhook, got %v", err)
+	}
+}
+
+func TestHandleWebhooks(t *testing.T) {
+	s := NewServer()
+	tests := []struct {
+		url    string
+		body   string
+		header bool
+		code   int
+	}{
+		{"/meta/webhooks?destination=/queue/hooks&url=http://localhost/hook", "", false, http.StatusForbidden},
+		{"/meta/webhooks?destination=/queue/hooks&url=http://localhost/hook&secret=s", "", true, http.StatusBadRequest},
+		{"/meta/webhooks?destination=/queue/hooks&url=http://localhost/hook", "secret=s", true, http.StatusOK},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("POST", test.url, strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header {
+			r.Header.Set(HeaderAdminRequest, "1")
+		}
+		w := httptest.NewRecorder()
+		s.HandleWebhooks(w, r)
+		if w.Code != test.code {
+			t.Errorf("test %d: want status %d, got %d: %s", i, test.code, w.Code, w.Body)
+		}
+	}
+
+	s.webhooks.Lock()
+	var hook *webhook
+	for _, h := range s.webhooks.hooks {
+		hook = h
+	}
+	s.webhooks.Unlock()
+	if hook == nil || hook.Secret != "s" {
+		t.Fatalf("Want webhook added with the secret of the request body")
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleWebhooks(w, httptest.NewRequest("DELETE", "/meta/webhooks?id="+hook.id, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Want admin request required to remove a webhook, got %d", w.Code)
+	}
+	s.RemoveWebhook(hook.id)
+}
@@ -0,0 +1,28 @@
+package stomp
+
+import "github.com/mrwill84/mq/logger"
+
+// WithAdvisoryHandler returns an Option which configures the handler of
+// advisory frames sent by the broker, such as the shutdown-imminent
+// advisory sent when the broker drains connections for maintenance. The
+// advisory header names the advisory and the reconnect-to header, if
+// present, is the address of a broker to reconnect to. By default
+// advisories are logged.
+func WithAdvisoryHandler(h Handler) Option {
+	return func(c *Client) {
+		c.advisory = h
+	}
+}
+
+// handleAdvisory passes the advisory to the advisory handler.
+func (c *Client) handleAdvisory(m *Message) {
+	if c.advisory != nil {
+		c.advisory.Handle(m)
+		return
+	}
+	logger.Noticef("stomp client: broker advisory %s, reconnect to %q",
+		string(m.Header.Get(HeaderAdvisory)),
+		string(m.Header.Get(HeaderReconnectTo)),
+	)
+	m.Release()
+}
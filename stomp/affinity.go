@@ -0,0 +1,30 @@
+package stomp
+
+import (
+	"net/http"
+)
+
+// AffinityCookie is the name of the cookie carrying the affinity token
+// in the websocket handshake. Load balancers configured for cookie-based
+// session affinity use the token to route reconnections to the node
+// holding the client session state.
+const AffinityCookie = "mq-affinity"
+
+// Affinity returns the affinity token reported by the server when the
+// connection was established. The token should be passed to DialAffinity
+// when reconnecting.
+func (c *Client) Affinity() string {
+	return c.affinity
+}
+
+// DialAffinity creates a client connection to the given target,
+// presenting the affinity token in the websocket handshake so that the
+// connection is routed to the node that issued the token.
+func DialAffinity(target, token string, opts ...Option) (*Client, error) {
+	header := http.Header{}
+	if token != "" {
+		cookie := &http.Cookie{Name: AffinityCookie, Value: token}
+		header.Set("Cookie", cookie.String())
+	}
+	return dial(target, header, opts)
+}
@@ -0,0 +1,92 @@
+package stomp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrMatchValue is returned by Match when a string field contains a
+// single quote, which cannot be represented in a selector.
+var ErrMatchValue = errors.New("stomp: selector value contains a quote")
+
+// Field is a header bound to a field of a message payload, created with
+// StringField, IntField, UintField, FloatField or BoolField.
+type Field struct {
+	name   string
+	value  string
+	quoted bool // string value, quoted in selectors
+}
+
+// StringField returns a Field binding the header name to a string.
+func StringField(name, value string) Field {
+	return Field{name: name, value: value, quoted: true}
+}
+
+// IntField returns a Field binding the header name to an integer.
+func IntField(name string, value int64) Field {
+	return Field{name: name, value: strconv.FormatInt(value, 10)}
+}
+
+// UintField returns a Field binding the header name to an unsigned
+// integer.
+func UintField(name string, value uint64) Field {
+	return Field{name: name, value: strconv.FormatUint(value, 10)}
+}
+
+// FloatField returns a Field binding the header name to a number.
+func FloatField(name string, value float64) Field {
+	return Field{name: name, value: strconv.FormatFloat(value, 'f', -1, 64)}
+}
+
+// BoolField returns a Field binding the header name to a boolean.
+func BoolField(name string, value bool) Field {
+	return Field{name: name, value: strconv.FormatBool(value)}
+}
+
+// Fielder is implemented by message payloads whose fields are sent as
+// headers, so that subscribers may filter messages on them using
+// selectors.
+//
+//	func (o Order) Fields() []stomp.Field {
+//		return []stomp.Field{
+//			stomp.StringField("region", o.Region),
+//			stomp.IntField("priority", int64(o.Priority)),
+//		}
+//	}
+type Fielder interface {
+	Fields() []Field
+}
+
+// WithFields returns a MessageOption which sets a header for each
+// field. Messages sent with SendJSON or SendObject include the fields of
+// a payload implementing Fielder automatically.
+func WithFields(fields ...Field) MessageOption {
+	return func(m *Message) {
+		for _, f := range fields {
+			WithHeader(f.name, f.value)(m)
+		}
+	}
+}
+
+// Match returns a selector matching messages whose headers equal the
+// fields. Subscribers build the fields with the same helpers as the
+// Fielder of the payload, keeping selectors in sync with the headers
+// set by WithFields.
+//
+//	selector, err := stomp.Match(stomp.StringField("region", "eu"))
+//	client.Subscribe("/topic/orders", handler, stomp.WithSelector(selector))
+func Match(fields ...Field) (string, error) {
+	conds := make([]string, 0, len(fields))
+	for _, f := range fields {
+		value := f.value
+		if f.quoted {
+			if strings.Contains(value, "'") {
+				return "", ErrMatchValue
+			}
+			value = "'" + value + "'"
+		}
+		conds = append(conds, f.name+" == "+value)
+	}
+	return strings.Join(conds, " AND "), nil
+}
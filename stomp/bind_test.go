@@ -0,0 +1,80 @@
+package stomp
+
+import (
+	"testing"
+
+	"github.com/mrwill84/mq/stomp/selector"
+)
+
+type order struct {
+	ID       string  `json:"id"`
+	Region   string  `json:"region"`
+	Priority int     `json:"priority"`
+	Express  bool    `json:"express"`
+	Total    float64 `json:"total"`
+}
+
+func (o order) Fields() []Field {
+	return []Field{
+		StringField("region", o.Region),
+		IntField("priority", int64(o.Priority)),
+		BoolField("express", o.Express),
+		FloatField("total", o.Total),
+	}
+}
+
+func TestWithFields(t *testing.T) {
+	m := NewMessage()
+	m.Apply(WithFields(order{ID: "1", Region: "eu", Priority: 2, Total: 9.5}.Fields()...))
+
+	tests := map[string]string{
+		"region":   "eu",
+		"priority": "2",
+		"express":  "false",
+		"total":    "9.5",
+	}
+	for k, v := range tests {
+		if got := m.Header.GetString(k); got != v {
+			t.Errorf("Want header %s=%s, got %q", k, v, got)
+		}
+	}
+	if got := m.Header.Len(); got != len(tests) {
+		t.Errorf("Want %d headers from the fields, got %d", len(tests), got)
+	}
+
+	m = NewMessage()
+	m.Apply(WithFields(UintField("count", 3)))
+	if got := m.Header.GetString("count"); got != "3" {
+		t.Errorf("Want header count=3, got %q", got)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	query, err := Match(StringField("region", "eu"), BoolField("express", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "region == 'eu' AND express == true"; query != want {
+		t.Errorf("Want selector %q, got %q", want, query)
+	}
+
+	// the selector matches the headers set by WithFields.
+	sel, err := selector.Parse([]byte(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMessage()
+	m.Apply(WithFields(order{Region: "eu", Priority: 1, Express: true}.Fields()...))
+	if ok, _ := sel.Eval(m.Header); !ok {
+		t.Errorf("Want selector to match message headers")
+	}
+	m = NewMessage()
+	m.Apply(WithFields(order{Region: "us", Express: true}.Fields()...))
+	if ok, _ := sel.Eval(m.Header); ok {
+		t.Errorf("Want selector not to match message headers")
+	}
+
+	if _, err := Match(StringField("region", "o'hare")); err != ErrMatchValue {
+		t.Errorf("Want ErrMatchValue for quoted values, got %v", err)
+	}
+}
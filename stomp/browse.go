@@ -0,0 +1,46 @@
+package stomp
+
+import "sync"
+
+// Browse returns copies of the messages queued for the destination
+// without consuming them. Messages may be filtered with the selector
+// option. The caller is responsible for releasing the messages.
+func (c *Client) Browse(dest string, opts ...MessageOption) ([]*Message, error) {
+	id := c.incr()
+
+	var (
+		mu       sync.Mutex
+		messages []*Message
+	)
+	handler := HandlerFunc(func(m *Message) {
+		mu.Lock()
+		messages = append(messages, m)
+		mu.Unlock()
+	})
+
+	m := NewMessage()
+	m.Method = MethodSubscribe
+	m.ID = id
+	m.Dest = []byte(dest)
+	m.Apply(opts...)
+	m.Header.Add(HeaderBrowse, []byte("true"))
+	m.Receipt = Rand()
+
+	c.subs.add(string(id), handler)
+
+	// the receipt follows the last queued message, and messages are
+	// handled in order before the receipt.
+	err := c.sendMessage(m)
+
+	c.subs.remove(string(id))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		for _, m := range messages {
+			m.Release()
+		}
+		return nil, err
+	}
+	return messages, nil
+}
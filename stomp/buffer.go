@@ -0,0 +1,51 @@
+package stomp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBuffer is the maximum capacity of a buffer returned to the
+// buffer pool. Larger buffers are left to the garbage collector.
+const maxPooledBuffer = 1 << 20 // 1MB
+
+// buffer is a reference-counted frame buffer. Messages decoded from the
+// buffer, and copies of those messages, share the buffer and hold a
+// reference. The buffer is returned to the pool when the last reference
+// is released.
+//
+// A shared buffer is immutable: the fields of the messages referencing
+// it are sealed, so that appending to a field copies it, and the fields
+// must be replaced rather than modified in place.
+type buffer struct {
+	refs int32
+	b    []byte
+}
+
+// retain adds a reference to the buffer.
+func (b *buffer) retain() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+// release removes a reference from the buffer and returns the buffer
+// to the pool when no references remain.
+func (b *buffer) release() {
+	if atomic.AddInt32(&b.refs, -1) != 0 {
+		return
+	}
+	if cap(b.b) <= maxPooledBuffer {
+		b.b = b.b[:0]
+		bufferPool.Put(b)
+	}
+}
+
+// newBuffer returns a buffer from the buffer pool with a single reference.
+func newBuffer() *buffer {
+	b := bufferPool.Get().(*buffer)
+	b.refs = 1
+	return b
+}
+
+var bufferPool = sync.Pool{New: func() interface{} {
+	return &buffer{b: make([]byte, 0, bufferSize)}
+}}
@@ -0,0 +1,60 @@
+package stomp
+
+import "testing"
+
+func TestBufferRefcount(t *testing.T) {
+	buf := newBuffer()
+	buf.b = append(buf.b, "hello"...)
+
+	m := NewMessage()
+	m.Body = buf.b
+	m.buf = buf
+
+	a := m.Copy()
+	b := m.Copy()
+	if got := buf.refs; got != 3 {
+		t.Errorf("Want buffer referenced by message and copies, got %d", got)
+	}
+
+	m.Release()
+	a.Release()
+	if got := buf.refs; got != 1 {
+		t.Errorf("Want buffer retained until last copy released, got %d", got)
+	}
+	if string(b.Body) != "hello" {
+		t.Errorf("Want body readable while buffer retained")
+	}
+	b.Release()
+	if got := buf.refs; got != 0 {
+		t.Errorf("Want buffer released, got %d references", got)
+	}
+}
+
+func TestBufferSealed(t *testing.T) {
+	buf := newBuffer()
+	buf.b = append(buf.b, "SEND\ndestination:/queue/a\nkey:value\n\nhello"...)
+
+	m := NewMessage()
+	if err := m.Parse(buf.b); err != nil {
+		t.Fatal(err)
+	}
+	m.buf = buf
+	m.seal()
+
+	c := m.Copy()
+	c.Dest = append(c.Dest, "bc"...)
+	c.Body = append(c.Body, " world"...)
+	if string(m.Dest) != "/queue/a" || string(m.Body) != "hello" {
+		t.Errorf("Want appending to a copy to leave the shared buffer unchanged, got %s %s", m.Dest, m.Body)
+	}
+	if v := m.Header.Get([]byte("key")); string(v) != "value" {
+		t.Errorf("Want header unchanged, got %s", v)
+	}
+
+	m.Reset()
+	if m.Dest != nil || m.Body != nil {
+		t.Errorf("Want reset message to drop the fields referencing the buffer")
+	}
+	m.Release()
+	c.Release()
+}
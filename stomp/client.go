@@ -2,15 +2,19 @@ package stomp
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/mrwill84/mq/logger"
 	"github.com/mrwill84/mq/stomp/dialer"
+
+	"golang.org/x/net/context"
 )
 
 // Client defines a client connection to a STOMP server.
@@ -18,15 +22,44 @@ type Client struct {
 	mu sync.Mutex
 
 	peer Peer
-	subs map[string]Handler
-	wait map[string]chan struct{}
+	subs *handlerMap
+	wait map[string]chan error
 	done chan error
 
-	seq int64
+	seq      int64
+	epoch    int64
+	server   string
+	proto    []byte
+	affinity string
+	session  string
+	resumed  bool
+	outbox   Outbox
+
+	follow        bool                // follow server redirects
+	redirectHosts []string            // hosts followed besides the dialed host
+	host          string              // host dialed
+	connectOpts   []MessageOption     // options used to establish the session
+	frames        map[string]*Message // subscribe frames, if following redirects
+
+	stats       map[string]*handlerStats // handler outcomes by destination
+	instruments map[string]*instrument   // subscription instruments by id
+	advisory    Handler                  // broker advisory handler
 
 	skipVerify      bool
+	proxy           func(*url.URL) (*url.URL, error)
+	header          http.Header // websocket handshake header
+	targets         []string    // hosts not yet dialed, for failover
+	connectTimeout  time.Duration
+	connectDefaults []MessageOption // connect options of the dial target
 	readBufferSize  int
 	writeBufferSize int
+	flushInterval   time.Duration
+	flushStrategy   FlushStrategy
+	flushSize       int
+	heartbeat       time.Duration
+	heartbeatWait   time.Duration
+	maxFrameSize    int
+	frameLogger     io.Writer
 	timeout         time.Duration
 }
 
@@ -34,19 +67,125 @@ type Client struct {
 func New(peer Peer) *Client {
 	return &Client{
 		peer: peer,
-		subs: make(map[string]Handler),
-		wait: make(map[string]chan struct{}),
+		subs: newHandlerMap(),
+		wait: make(map[string]chan error),
 		done: make(chan error, 1),
 	}
 }
 
-// Dial creates a client connection to the given target.
-func Dial(target string) (*Client, error) {
-	conn, err := dialer.Dial(target)
+// Dial creates a client connection to the given target. Connections
+// are made through the proxy configured in the environment, unless the
+// WithProxy option is given.
+//
+// The target may list several hosts, such as tcp://a:9000,b:9000, or
+// name SRV records, such as stomp+srv://_stomp._tcp.example.com. The
+// hosts are dialed in order, and Connect fails over to the next host if
+// the session cannot be established.
+//
+// Query parameters of the target configure the client, such as
+// stomp://host:61613?heartbeat=10s,30s&login=u&passcode=p&connect-timeout=5s.
+// The parameters are heartbeat, connect-timeout, receipt-timeout,
+// flush-interval, read-buffer, write-buffer, max-frame-size, proxy,
+// redirects, and the connect headers login, passcode, token, host and
+// client-id. Options override the query parameters.
+func Dial(target string, opts ...Option) (*Client, error) {
+	return dial(target, nil, opts)
+}
+
+// dial returns a new STOMP client connected to the target and configured
+// with the client options. The header is included in the websocket
+// handshake.
+func dial(target string, header http.Header, opts []Option) (*Client, error) {
+	c := New(nil)
+	target, err := c.parseTarget(target)
 	if err != nil {
 		return nil, err
 	}
-	return New(Conn(conn)), nil
+	for _, opt := range opts {
+		opt(c)
+	}
+	targets, err := dialer.Resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	c.header = header
+	c.targets = targets
+	peer, err := c.dialNext()
+	if err != nil {
+		return nil, err
+	}
+	c.peer = peer
+	return c, nil
+}
+
+// dialNext connects to the next host of the target, skipping hosts
+// which cannot be reached.
+func (c *Client) dialNext() (Peer, error) {
+	err := dialer.ErrNoHosts
+	for len(c.targets) != 0 {
+		target := c.targets[0]
+		c.targets = c.targets[1:]
+
+		var conn net.Conn
+		if conn, err = dialer.DialConfig(target, c.dialConfig(c.header)); err == nil {
+			c.host = dialHost(target)
+			return c.newPeer(conn), nil
+		}
+		logger.Warningf("stomp client: dial %s: %s", target, err)
+	}
+	return nil, err
+}
+
+// newClient returns a new STOMP client using the network connection
+// configured with the client options.
+func newClient(conn net.Conn, opts []Option) *Client {
+	c := configure(opts)
+	c.peer = c.newPeer(conn)
+	return c
+}
+
+// configure returns a new STOMP client without a connection configured
+// with the client options.
+func configure(opts []Option) *Client {
+	c := New(nil)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// dialConfig returns the dialer configuration of the client.
+func (c *Client) dialConfig(header http.Header) dialer.Config {
+	proxy := c.proxy
+	if proxy == nil {
+		proxy = dialer.ProxyFromEnvironment
+	}
+	return dialer.Config{Header: header, Proxy: proxy, Timeout: c.connectTimeout}
+}
+
+// newPeer returns a peer for the network connection configured with the
+// client options.
+func (c *Client) newPeer(conn net.Conn) Peer {
+	return newConnPeer(conn, TextCodec, ConnConfig{
+		ReadBufferSize:    c.readBufferSize,
+		WriteBufferSize:   c.writeBufferSize,
+		FlushInterval:     c.flushInterval,
+		FlushStrategy:     c.flushStrategy,
+		FlushSize:         c.flushSize,
+		HeartbeatInterval: c.heartbeat,
+		HeartbeatTimeout:  c.heartbeatWait,
+		MaxFrameSize:      c.maxFrameSize,
+		MonitorHeartbeats: true,
+		FrameLogger:       c.frameLogger,
+	})
+}
+
+// conn returns the peer of the current connection, which changes when
+// the client follows a redirect.
+func (c *Client) conn() Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peer
 }
 
 // Send sends the data to the given destination.
@@ -56,50 +195,160 @@ func (c *Client) Send(dest string, data []byte, opts ...MessageOption) error {
 	m.Dest = []byte(dest)
 	m.Body = data
 	m.Apply(opts...)
+	return c.send(m)
+}
+
+// send compresses and sends the message.
+func (c *Client) send(m *Message) error {
+	if err := compress(m); err != nil {
+		m.Release()
+		return err
+	}
+	if m.guarantee {
+		return c.sendGuaranteed(m)
+	}
 	return c.sendMessage(m)
 }
 
-// SendJSON sends the JSON encoding of v to the given destination.
-func (c *Client) SendJSON(dest string, v interface{}, opts ...MessageOption) error {
-	data, err := json.Marshal(v)
+// SetOutbox sets the outbox used to persist messages sent with
+// guaranteed delivery.
+func (c *Client) SetOutbox(outbox Outbox) {
+	c.mu.Lock()
+	c.outbox = outbox
+	c.mu.Unlock()
+}
+
+// sendGuaranteed writes the message to the outbox, sends the message and
+// waits for the receipt, and removes the message from the outbox.
+func (c *Client) sendGuaranteed(m *Message) error {
+	c.mu.Lock()
+	outbox := c.outbox
+	c.mu.Unlock()
+	if outbox == nil {
+		m.Release()
+		return ErrNoOutbox
+	}
+	if len(m.Receipt) == 0 {
+		m.Receipt = Rand()
+	}
+	id := string(m.Receipt)
+	if err := outbox.Put(id, m.Bytes()); err != nil {
+		m.Release()
+		return err
+	}
+	if err := c.sendMessage(m); err != nil {
+		return err
+	}
+	return outbox.Delete(id)
+}
+
+// resend sends the messages remaining in the outbox.
+func (c *Client) resend() error {
+	messages, err := c.outbox.List()
 	if err != nil {
 		return err
 	}
-	opts = append(opts,
-		WithHeader("content-type", "application/json"),
-	)
-	return c.Send(dest, data, opts...)
+	for id, data := range messages {
+		m := NewMessage()
+		if err := m.Parse(data); err != nil {
+			logger.Warningf("stomp client: invalid outbox message %s: %s", id, err)
+			m.Release()
+			continue
+		}
+		m.Receipt = []byte(id)
+		if err := c.sendMessage(m); err != nil {
+			return err
+		}
+		if err := c.outbox.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendJSON sends the JSON encoding of v to the given destination.
+func (c *Client) SendJSON(dest string, v interface{}, opts ...MessageOption) error {
+	opts = append([]MessageOption{WithContentType(ContentTypeJSON)}, opts...)
+	return c.SendObject(dest, v, opts...)
 }
 
-// Subscribe subscribes to the given destination.
-func (c *Client) Subscribe(dest string, handler Handler, opts ...MessageOption) (id []byte, err error) {
-	id = c.incr()
+// Subscribe subscribes to the given destination. If the handler is nil,
+// messages are delivered to the Messages channel of the subscription.
+func (c *Client) Subscribe(dest string, handler Handler, opts ...MessageOption) (*Subscription, error) {
+	id := c.incr()
 
+	sub := &Subscription{
+		client: c,
+		id:     id,
+		dest:   dest,
+	}
 	m := NewMessage()
 	m.Method = MethodSubscribe
 	m.ID = id
 	m.Dest = []byte(dest)
+	m.sub = sub
 	m.Apply(opts...)
+	m.sub = nil
 
+	if handler == nil {
+		sub.messages = newChanHandler()
+		handler = sub.messages
+	}
+
+	if sub.offsets != nil {
+		handler = &onceHandler{handler: handler, store: sub.offsets, client: c}
+	}
+	sub.inst = &instrument{
+		handler:  handler,
+		stats:    c.destStats(dest),
+		limit:    c.maxFrameSize,
+		client:   c,
+		id:       id,
+		dest:     dest,
+		budget:   sub.budget,
+		selector: append([]byte(nil), m.Selector...),
+		prefetch: append([]byte(nil), m.Prefetch...),
+	}
+	handler = sub.inst
+	if sub.gapFunc != nil {
+		handler = &gapDetector{handler: handler, report: sub.gapFunc}
+	}
+	if sub.workers > 1 {
+		handler = newDispatcher(handler, sub.workers, sub.orderKey)
+	}
+	if sub.fence {
+		handler = &epochFence{handler: handler, stale: sub.staleFunc}
+	}
+
+	c.subs.add(string(id), handler)
 	c.mu.Lock()
-	c.subs[string(id)] = handler
+	if c.instruments == nil {
+		c.instruments = make(map[string]*instrument)
+	}
+	c.instruments[string(id)] = sub.inst
+	if c.follow {
+		c.frames[string(id)] = subscribeFrame(m)
+	}
 	c.mu.Unlock()
 
-	err = c.sendMessage(m)
-	if err != nil {
+	if err := c.sendMessage(m); err != nil {
+		c.subs.remove(string(id))
 		c.mu.Lock()
-		delete(c.subs, string(id))
+		c.forget(string(id))
 		c.mu.Unlock()
-		return
+		stopHandler(handler)
+		return nil, err
 	}
-	return
+	return sub, nil
 }
 
 // Unsubscribe unsubscribes to the destination.
 func (c *Client) Unsubscribe(id []byte, opts ...MessageOption) error {
+	handler := c.subs.remove(string(id))
 	c.mu.Lock()
-	delete(c.subs, string(id))
+	c.forget(string(id))
 	c.mu.Unlock()
+	stopHandler(handler)
 
 	m := NewMessage()
 	m.Method = MethodUnsubscribe
@@ -121,46 +370,211 @@ func (c *Client) Ack(id []byte, opts ...MessageOption) error {
 
 // Nack negative-acknowledges the messages with the given id.
 func (c *Client) Nack(id []byte, opts ...MessageOption) error {
+	if len(c.proto) != 0 && !SupportsNack(c.proto) {
+		return ErrNack
+	}
 	m := NewMessage()
 	m.Method = MethodNack
 	m.ID = id
 	m.Apply(opts...)
 
-	return c.peer.Send(m)
+	return c.write(m)
 }
 
-// Connect opens the connection and establishes the session.
+// Connect opens the connection and establishes the session. If the
+// client was dialed with several hosts, hosts not yet tried are dialed
+// in turn until a session is established.
 func (c *Client) Connect(opts ...MessageOption) error {
+	if len(c.connectDefaults) != 0 {
+		opts = append(append([]MessageOption(nil), c.connectDefaults...), opts...)
+	}
+	if c.follow {
+		c.mu.Lock()
+		c.connectOpts = opts
+		c.mu.Unlock()
+	}
+	peer := c.conn()
+	if peer == nil {
+		return ErrNotConnected
+	}
+	err := c.connect(peer, connectFrame(opts), 0)
+	for err != nil && len(c.targets) != 0 {
+		logger.Warningf("stomp client: connect: %s, failing over", err)
+		next, derr := c.dialNext()
+		if derr != nil {
+			return err
+		}
+		c.mu.Lock()
+		prev := c.peer
+		c.peer = next
+		c.mu.Unlock()
+		prev.Close()
+		err = c.connect(next, connectFrame(opts), 0)
+	}
+	return err
+}
+
+// connectFrame returns the message used to establish the session.
+func connectFrame(opts []MessageOption) *Message {
 	m := NewMessage()
-	m.Proto = STOMP
+	m.Proto = Versions
 	m.Method = MethodStomp
 	m.Apply(opts...)
-	if err := c.sendMessage(m); err != nil {
+	if len(m.Header.Get(HeaderClient)) == 0 {
+		m.Header.Add(HeaderClient, UserAgent)
+	}
+	if len(m.Header.Get(HeaderAcceptEnc)) == 0 {
+		m.Header.Add(HeaderAcceptEnc, []byte(strings.Join(Encodings(), ",")))
+	}
+	return m
+}
+
+// connect sends the connect message to the peer and establishes the
+// session. If the server redirects the client, and the client follows
+// redirects, the session is established with the redirect target.
+func (c *Client) connect(peer Peer, connect *Message, hops int) error {
+	var retry *Message
+	if c.follow {
+		retry = connect.Clone()
+		defer retry.Release()
+	}
+	if err := peer.Send(connect); err != nil {
 		return err
 	}
 
-	m, ok := <-c.peer.Receive()
-	if !ok {
-		return io.EOF
+	m, err := c.receiveConnected(peer)
+	if err != nil {
+		return err
 	}
 	defer m.Release()
 
-	if !bytes.Equal(m.Method, MethodConnected) {
-		return fmt.Errorf("stomp: inbound message: unexpected method, want connected")
+	if target := c.redirectTarget(m); target != "" {
+		if hops == redirectLimit {
+			return ErrRedirectLimit
+		}
+		next, err := c.dial(target)
+		if err != nil {
+			return err
+		}
+		peer.Close()
+		c.mu.Lock()
+		c.peer = next
+		c.mu.Unlock()
+		return c.connect(next, retry.Clone(), hops+1)
+	}
+	switch {
+	case bytes.Equal(m.Method, MethodError):
+		return brokerError(m)
+	case !bytes.Equal(m.Method, MethodConnected):
+		return &BadFrameError{Reason: "unexpected " + string(m.Method) + " frame, want CONNECTED"}
+	}
+	c.server = string(m.Header.Get(HeaderServer))
+	c.affinity = string(m.Header.Get(HeaderAffinity))
+	c.session = string(m.Header.Get(HeaderSession))
+	c.epoch = ParseInt64(m.Header.Get(HeaderEpoch))
+	c.resumed = bytes.Equal(m.Header.Get(HeaderResumed), ResumedTrue)
+	c.proto = append([]byte(nil), m.Proto...)
+	if len(c.proto) == 0 {
+		c.proto = STOMP10
+	}
+	go c.listen(peer)
+
+	if c.outbox != nil {
+		go func() {
+			if err := c.resend(); err != nil {
+				logger.Warningf("stomp client: resend outbox: %s", err)
+			}
+		}()
 	}
-	go c.listen()
 	return nil
 }
 
-// Disconnect terminates the session and closes the connection.
+// receiveConnected returns the reply to the connect message, waiting at
+// most the connect timeout.
+func (c *Client) receiveConnected(peer Peer) (*Message, error) {
+	var timeout <-chan time.Time
+	if c.connectTimeout != 0 {
+		timer := time.NewTimer(c.connectTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case m, ok := <-peer.Receive():
+		if !ok {
+			return nil, closedErr(peer)
+		}
+		return m, nil
+	case <-timeout:
+		return nil, ErrConnectTimeout
+	}
+}
+
+// Close gracefully terminates the session. The client sends a DISCONNECT
+// message and waits for the server to acknowledge receipt, ensuring that
+// all prior messages were processed by the server, before closing the
+// connection. The connection is closed without waiting for the receipt
+// if the context is cancelled.
+func (c *Client) Close(ctx context.Context) error {
+	m := NewMessage()
+	m.Method = MethodDisconnect
+	m.Receipt = Rand()
+	err := c.sendMessageContext(ctx, m)
+	if cerr := c.shutdown(ctx); err == nil {
+		err = cerr
+	}
+	c.stopHandlers()
+	return err
+}
+
+// shutdown closes the peer, waiting for pending messages to be flushed
+// if the peer supports an ordered shutdown.
+func (c *Client) shutdown(ctx context.Context) error {
+	if p, ok := c.conn().(interface {
+		Shutdown(context.Context) error
+	}); ok {
+		return p.Shutdown(ctx)
+	}
+	return c.conn().Close()
+}
+
+// Disconnect terminates the session and closes the connection. The
+// subscriptions end and their Messages channels are closed.
 func (c *Client) Disconnect() error {
 	m := NewMessage()
 	m.Method = MethodDisconnect
 	c.sendMessage(m)
-	return c.peer.Close()
+	err := c.conn().Close()
+	c.stopHandlers()
+	return err
+}
+
+// stopHandlers ends every subscription of the client and stops the
+// handlers, so that receivers of the Messages channels return.
+func (c *Client) stopHandlers() {
+	handlers := c.subs.clear()
+	c.mu.Lock()
+	for id := range handlers {
+		c.forget(id)
+	}
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		stopHandler(handler)
+	}
+}
+
+// Server returns the server product name and version reported by the
+// server when the connection was established.
+func (c *Client) Server() string {
+	return c.server
 }
 
-// Done returns a channel
+// Proto returns the protocol version negotiated with the server.
+func (c *Client) Proto() string {
+	return string(c.proto)
+}
+
+// Done returns a channel which receives the error that closed the
+// connection, ErrClosed if it was closed without error.
 func (c *Client) Done() <-chan error {
 	return c.done
 }
@@ -173,7 +587,7 @@ func (c *Client) incr() []byte {
 	return strconv.AppendInt(nil, i, 10)
 }
 
-func (c *Client) listen() {
+func (c *Client) listen(peer Peer) {
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Warningf("stomp client: recover panic: %s", r)
@@ -182,9 +596,19 @@ func (c *Client) listen() {
 	}()
 
 	for {
-		m, ok := <-c.peer.Receive()
+		m, ok := <-peer.Receive()
 		if !ok {
-			c.done <- io.EOF
+			// the connection was replaced after a redirect.
+			if c.conn() != peer {
+				return
+			}
+			err := closedErr(peer)
+			c.abort(err)
+			// the handlers of a resumable session are kept for Resume.
+			if c.session == "" {
+				c.stopHandlers()
+			}
+			c.done <- err
 			return
 		}
 
@@ -193,6 +617,10 @@ func (c *Client) listen() {
 			c.handleMessage(m)
 		case bytes.Equal(m.Method, MethodRecipet):
 			c.handleReceipt(m)
+		case bytes.Equal(m.Method, MethodError):
+			c.handleError(peer, m)
+		case bytes.Equal(m.Method, MethodAdvisory):
+			c.handleAdvisory(m)
 		default:
 			logger.Noticef("stomp client: unknown message type: %s",
 				string(m.Method),
@@ -201,6 +629,20 @@ func (c *Client) listen() {
 	}
 }
 
+// helper function stops the handler workers, if the handler
+// dispatches messages to a worker pool.
+func stopHandler(handler Handler) {
+	if s, ok := handler.(stopper); ok {
+		s.stop()
+	}
+}
+
+// stopper is implemented by handlers that hold resources, such as
+// worker goroutines, that are released when the subscription ends.
+type stopper interface {
+	stop()
+}
+
 func (c *Client) handleReceipt(m *Message) {
 	c.mu.Lock()
 	receiptc, ok := c.wait[string(m.Receipt)]
@@ -211,41 +653,120 @@ func (c *Client) handleReceipt(m *Message) {
 		)
 		return
 	}
-	receiptc <- struct{}{}
+	receiptc <- nil
 }
 
-func (c *Client) handleMessage(m *Message) {
+func (c *Client) handleError(peer Peer, m *Message) {
+	var err error = brokerError(m)
+	if target := c.redirectTarget(m); target != "" {
+		// errors received after the client was redirected are not
+		// followed again.
+		if c.conn() != peer {
+			err = errRedirected
+		} else if rerr := c.redirect(target); rerr != nil {
+			logger.Warningf("stomp client: redirect to %s: %s", target, rerr)
+		} else {
+			err = errRedirected
+		}
+	}
+
 	c.mu.Lock()
-	handler, ok := c.subs[string(m.Subs)]
+	receiptc, ok := c.wait[string(m.Receipt)]
 	c.mu.Unlock()
+	if !ok {
+		logger.Warningf("stomp client: %s", err)
+		return
+	}
+	receiptc <- err
+}
+
+func (c *Client) handleMessage(m *Message) {
+	handler, ok := c.subs.load(m.Subs)
 	if !ok {
 		logger.Noticef("stomp client: subscription not found: %s",
 			string(m.Subs),
 		)
 		return
 	}
+	if f, ok := handler.(*epochFence); ok {
+		f.handle(m, c)
+		return
+	}
 	handler.Handle(m)
 }
 
+// write sends the frame to the current connection. It returns
+// ErrNotConnected if the client has no connection.
+func (c *Client) write(m *Message) error {
+	peer := c.conn()
+	if peer == nil {
+		return ErrNotConnected
+	}
+	return peer.Send(m)
+}
+
+// closedErr returns the reason the peer was closed, or ErrClosed if it
+// was closed without error.
+func closedErr(peer Peer) error {
+	if err := CloseErr(peer); err != nil {
+		return err
+	}
+	return ErrClosed
+}
+
 func (c *Client) sendMessage(m *Message) error {
+	return c.sendMessageContext(context.Background(), m)
+}
+
+func (c *Client) sendMessageContext(ctx context.Context, m *Message) error {
 	if len(m.Receipt) == 0 {
-		return c.peer.Send(m)
+		return c.write(m)
+	}
+	if !c.follow {
+		return c.sendReceipt(ctx, m)
+	}
+
+	// messages rejected by a server that redirects the client are sent
+	// again once the client is connected to the redirect target.
+	for hops := 0; ; hops++ {
+		retry := m.Clone()
+		err := c.sendReceipt(ctx, m)
+		if err != errRedirected {
+			retry.Release()
+			return err
+		}
+		if hops == redirectLimit {
+			retry.Release()
+			return ErrRedirectLimit
+		}
+		m = retry
 	}
+}
+
+// sendReceipt sends the message and waits for the receipt.
+func (c *Client) sendReceipt(ctx context.Context, m *Message) error {
 
-	receiptc := make(chan struct{}, 1)
-	c.wait[string(m.Receipt)] = receiptc
+	receipt := string(m.Receipt)
+	receiptc := make(chan error, 1)
+	c.mu.Lock()
+	c.wait[receipt] = receiptc
+	c.mu.Unlock()
 
 	defer func() {
-		delete(c.wait, string(m.Receipt))
+		c.mu.Lock()
+		delete(c.wait, receipt)
+		c.mu.Unlock()
 	}()
 
-	err := c.peer.Send(m)
+	err := c.write(m)
 	if err != nil {
 		return err
 	}
 
 	select {
-	case <-receiptc:
-		return nil
+	case err := <-receiptc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
@@ -0,0 +1,146 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds the maximum frame
+// size of the connection.
+var ErrFrameTooLarge = errors.New("stomp: frame too large")
+
+// FrameCodec encodes and decodes messages to and from the wire format.
+type FrameCodec interface {
+	// Name returns the codec name used to negotiate the codec.
+	Name() string
+
+	// ReadFrame reads the next raw frame from the reader, appending the
+	// frame to the buffer. An empty frame indicates a heart-beat.
+	ReadFrame(*bufio.Reader, []byte) ([]byte, error)
+
+	// Decode decodes the raw frame into the message.
+	Decode([]byte, *Message) error
+
+	// Encode writes the message frame to the writer.
+	Encode(*bufio.Writer, *Message) error
+
+	// Heartbeat writes a heart-beat frame to the writer.
+	Heartbeat(*bufio.Writer) error
+}
+
+// frameLimiter is implemented by codecs that reject a frame exceeding
+// the limit before it is read in full.
+type frameLimiter interface {
+	readFrameLimit(r *bufio.Reader, buf []byte, limit int) ([]byte, error)
+}
+
+// vectorEncoder is implemented by codecs that encode the frame head
+// separately from the body, so that the connection writes large bodies
+// from the message without copying them.
+type vectorEncoder interface {
+	// encodeHead writes the frame up to the body. Nothing is written
+	// if the frame cannot be encoded.
+	encodeHead(w io.Writer, m *Message) error
+
+	// trailer returns the bytes written after the body.
+	trailer() []byte
+}
+
+// methodPeeker is implemented by codecs that read the method of a raw
+// frame without decoding the frame.
+type methodPeeker interface {
+	peekMethod(b []byte) []byte
+}
+
+// TextCodec is the default codec that reads and writes STOMP text frames.
+var TextCodec FrameCodec = textCodec{}
+
+// textCodec reads and writes STOMP text frames. Header names and values
+// are escaped once a protocol version that requires escaping is
+// negotiated.
+type textCodec struct {
+	escape bool
+}
+
+func (textCodec) Name() string {
+	return "stomp"
+}
+
+func (c textCodec) ReadFrame(r *bufio.Reader, buf []byte) ([]byte, error) {
+	return c.readFrameLimit(r, buf, 0)
+}
+
+func (textCodec) readFrameLimit(r *bufio.Reader, buf []byte, limit int) ([]byte, error) {
+	off := len(buf)
+	for {
+		line, err := r.ReadSlice(0)
+		buf = append(buf, line...)
+		if limit > 0 && len(buf)-off > limit+1 {
+			return nil, ErrFrameTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:len(buf)-1], nil
+	}
+}
+
+func (textCodec) peekMethod(b []byte) []byte {
+	b = bytes.TrimLeft(b, "\r\n")
+	if i := bytes.IndexAny(b, "\r\n"); i != -1 {
+		b = b[:i]
+	}
+	return b
+}
+
+func (c textCodec) Decode(b []byte, m *Message) error {
+	return readFrame(b, m, c.escape)
+}
+
+func (c textCodec) Encode(w *bufio.Writer, m *Message) error {
+	writeFrame(w, m, c.escape)
+	return w.WriteByte(0)
+}
+
+func (c textCodec) encodeHead(w io.Writer, m *Message) error {
+	writeHead(w, m, c.escape)
+	return nil
+}
+
+func (textCodec) trailer() []byte {
+	return terminator
+}
+
+func (textCodec) Heartbeat(w *bufio.Writer) error {
+	return w.WriteByte(0)
+}
+
+// RegisterCodec registers the codec so that it may be negotiated by
+// connections using the codec name.
+func RegisterCodec(codec FrameCodec) {
+	codecsMu.Lock()
+	codecs[codec.Name()] = codec
+	codecsMu.Unlock()
+}
+
+// lookupCodec returns the named codec.
+func lookupCodec(name string) (codec FrameCodec, ok bool) {
+	codecsMu.RLock()
+	codec, ok = codecs[name]
+	codecsMu.RUnlock()
+	return
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]FrameCodec{
+		TextCodec.Name():   TextCodec,
+		BinaryCodec.Name(): BinaryCodec,
+	}
+)
@@ -0,0 +1,202 @@
+package stomp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// BinaryCodec is a codec that reads and writes length-prefixed binary
+// frames. Each frame is prefixed with its length as a 32-bit big endian
+// integer, where a zero length frame is a heart-beat. The message fields
+// are encoded in a fixed order as length-prefixed byte strings, followed
+// by the custom headers and the message body, so that decoding a frame
+// does not require parsing text.
+var BinaryCodec FrameCodec = binaryCodec{}
+
+var errBinaryFrame error = &BadFrameError{Reason: "malformed binary frame"}
+
+// maxFrameSize is the maximum size of a binary frame.
+const maxFrameSize = 64 << 20 // 64MB
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (c binaryCodec) ReadFrame(r *bufio.Reader, buf []byte) ([]byte, error) {
+	return c.readFrameLimit(r, buf, maxFrameSize)
+}
+
+func (binaryCodec) readFrameLimit(r *bufio.Reader, buf []byte, limit int) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(size[:]))
+	if n > limit {
+		return nil, ErrFrameTooLarge
+	}
+	off := len(buf)
+	if cap(buf)-off < n {
+		grown := make([]byte, off, off+n)
+		copy(grown, buf)
+		buf = grown
+	}
+	buf = buf[:off+n]
+	if _, err := io.ReadFull(r, buf[off:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (binaryCodec) peekMethod(b []byte) []byte {
+	d := binaryDecoder{buf: b}
+	return d.next()
+}
+
+func (binaryCodec) Decode(b []byte, m *Message) error {
+	d := binaryDecoder{buf: b}
+	for _, field := range m.fields() {
+		*field = d.next()
+	}
+	count := d.uvarint()
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		name := d.next()
+		data := d.next()
+		m.Header.Add(name, data)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.buf) != 0 {
+		m.Body = d.buf
+	}
+	return nil
+}
+
+func (c binaryCodec) Encode(w *bufio.Writer, m *Message) error {
+	if err := c.encodeHead(w, m); err != nil {
+		return err
+	}
+	_, err := w.Write(m.Body)
+	return err
+}
+
+// encodeHead writes the length prefix and the frame up to the body. It
+// returns ErrFrameTooLarge, writing nothing, if the frame exceeds the
+// maximum frame size, which also keeps the length within 32 bits.
+func (binaryCodec) encodeHead(w io.Writer, m *Message) error {
+	m.checkReleased()
+
+	var size int
+	for _, field := range m.fields() {
+		size += uvarintLen(len(*field)) + len(*field)
+	}
+	size += uvarintLen(m.Header.itemc)
+	for i := 0; i < m.Header.itemc; i++ {
+		item := m.Header.items[i]
+		size += uvarintLen(len(item.name)) + len(item.name)
+		size += uvarintLen(len(item.data)) + len(item.data)
+	}
+	size += len(m.Body)
+	if size > maxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(size))
+	w.Write(buf[:4])
+
+	writeBytes := func(b []byte) {
+		n := binary.PutUvarint(buf[:], uint64(len(b)))
+		w.Write(buf[:n])
+		w.Write(b)
+	}
+	for _, field := range m.fields() {
+		writeBytes(*field)
+	}
+	n := binary.PutUvarint(buf[:], uint64(m.Header.itemc))
+	w.Write(buf[:n])
+	for i := 0; i < m.Header.itemc; i++ {
+		writeBytes(m.Header.items[i].name)
+		writeBytes(m.Header.items[i].data)
+	}
+	return nil
+}
+
+func (binaryCodec) trailer() []byte {
+	return nil
+}
+
+func (binaryCodec) Heartbeat(w *bufio.Writer) error {
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// numFields is the number of message fields in the binary encoding.
+const numFields = 15
+
+// fields returns the message fields in binary encoding order. The fields
+// are returned as an array, which does not escape to the heap.
+func (m *Message) fields() [numFields]*[]byte {
+	return [numFields]*[]byte{
+		&m.Method,
+		&m.Proto,
+		&m.ID,
+		&m.User,
+		&m.Pass,
+		&m.Host,
+		&m.Dest,
+		&m.Subs,
+		&m.Ack,
+		&m.Persist,
+		&m.Retain,
+		&m.Prefetch,
+		&m.Expires,
+		&m.Receipt,
+		&m.Selector,
+	}
+}
+
+type binaryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errBinaryFrame
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *binaryDecoder) next() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errBinaryFrame
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+// helper function returns the number of bytes required to encode
+// the integer as an unsigned varint.
+func uvarintLen(x int) (n int) {
+	for n = 1; x >= 0x80; n++ {
+		x >>= 7
+	}
+	return n
+}
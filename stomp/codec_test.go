@@ -0,0 +1,114 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestBinaryCodec(t *testing.T) {
+	for _, test := range payloads {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		if err := BinaryCodec.Encode(w, test.message); err != nil {
+			t.Errorf("error encoding message %q", test.payload)
+			continue
+		}
+		w.Flush()
+
+		frame, err := BinaryCodec.ReadFrame(bufio.NewReader(&buf), nil)
+		if err != nil {
+			t.Errorf("error reading frame for message %q", test.payload)
+			continue
+		}
+		m := NewMessage()
+		if err := BinaryCodec.Decode(frame, m); err != nil {
+			t.Errorf("error decoding message %q", test.payload)
+			continue
+		}
+		if got := m.String(); got != test.payload {
+			t.Errorf("Want decoded message %q, got %q", test.payload, got)
+		}
+	}
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+	var tests = [][]byte{
+		{},     // no fields
+		{5, 1}, // field length exceeds frame
+	}
+	for _, test := range tests {
+		if err := BinaryCodec.Decode(test, NewMessage()); err == nil {
+			t.Errorf("Want error decoding malformed frame %v", test)
+		}
+	}
+}
+
+func TestBinaryCodecHeartbeat(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	BinaryCodec.Heartbeat(w)
+	w.Flush()
+
+	frame, err := BinaryCodec.ReadFrame(bufio.NewReader(&buf), nil)
+	if err != nil || len(frame) != 0 {
+		t.Errorf("Want heart-beat frame, got %v %v", frame, err)
+	}
+}
+
+func TestConnCodec(t *testing.T) {
+	a, b := net.Pipe()
+
+	server := Conn(b)
+	defer server.Close()
+	client, err := ConnCodec(a, BinaryCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sent := NewMessage()
+	sent.Method = MethodSend
+	sent.Dest = []byte("/queue/test")
+	sent.Body = []byte("hello")
+	client.Send(sent)
+
+	recv := <-server.Receive()
+	if string(recv.Body) != "hello" || string(recv.Dest) != "/queue/test" {
+		t.Errorf("Want message received using negotiated codec, got %q", recv)
+	}
+	if got := server.(*connPeer).getCodec(); got != BinaryCodec {
+		t.Errorf("Want binary codec negotiated, got %s", got.Name())
+	}
+}
+
+func TestBinaryCodecTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Body = make([]byte, maxFrameSize)
+	if err := BinaryCodec.Encode(w, m); err != ErrFrameTooLarge {
+		t.Errorf("Want ErrFrameTooLarge encoding an oversized frame, got %v", err)
+	}
+	w.Flush()
+	if buf.Len() != 0 {
+		t.Errorf("Want nothing written for an oversized frame, got %d bytes", buf.Len())
+	}
+}
+
+func TestConnDecodeError(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	server := Conn(b)
+	go a.Write([]byte("SEND\nnocolon\n\nhello\x00"))
+
+	if m, ok := <-server.Receive(); ok {
+		t.Errorf("Want malformed frame to close the connection, got %q", m)
+	}
+	if _, ok := CloseErr(server).(*BadFrameError); !ok {
+		t.Errorf("Want connection closed with a bad frame error, got %v", CloseErr(server))
+	}
+}
@@ -0,0 +1,190 @@
+package stomp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Supported content encodings.
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// CompressThreshold is the minimum body size, in bytes, compressed by
+// messages sent using WithCompression. Smaller bodies are sent as-is
+// since compression would not reduce their size.
+var CompressThreshold = 1 << 10
+
+// ErrEncoding is returned when a message uses an unknown content encoding.
+var ErrEncoding = errors.New("stomp: unknown content encoding")
+
+// Encoding compresses and decompresses message bodies for a content
+// encoding.
+type Encoding interface {
+	// NewWriter returns a writer that compresses to w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader that decompresses from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// RegisterEncoding registers the content encoding, such as zstd or
+// snappy, so that it may be used with WithCompression and decompressed by
+// clients and servers. Clients advertise the registered encodings when
+// connecting.
+func RegisterEncoding(name string, encoding Encoding) {
+	encodingsMu.Lock()
+	encodings[name] = encoding
+	encodingsMu.Unlock()
+}
+
+// Encodings returns the names of the registered content encodings.
+func Encodings() []string {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	var names []string
+	for name := range encodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupEncoding returns the named content encoding.
+func lookupEncoding(name string) (encoding Encoding, ok bool) {
+	encodingsMu.RLock()
+	encoding, ok = encodings[name]
+	encodingsMu.RUnlock()
+	return
+}
+
+var (
+	encodingsMu sync.RWMutex
+	encodings   = map[string]Encoding{
+		EncodingGzip:    gzipEncoding{},
+		EncodingDeflate: deflateEncoding{},
+	}
+)
+
+type gzipEncoding struct{}
+
+func (gzipEncoding) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipEncoding) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type deflateEncoding struct{}
+
+func (deflateEncoding) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (deflateEncoding) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// WithCompression returns a MessageOption which compresses the message
+// body using the named encoding if the body exceeds CompressThreshold.
+// The encoding must be registered; gzip and deflate are registered by
+// default. The content-encoding header is set so that the receiving
+// client decompresses the body before invoking the handler. The server
+// delivers the compressed body without decompressing it, unless the
+// subscriber does not accept the encoding.
+func WithCompression(encoding string) MessageOption {
+	return func(m *Message) {
+		m.compress = encoding
+	}
+}
+
+// compress compresses the message body if compression is enabled and
+// the body exceeds the compression threshold.
+func compress(m *Message) error {
+	if m.compress == "" || len(m.Body) < CompressThreshold {
+		return nil
+	}
+	encoding, ok := lookupEncoding(m.compress)
+	if !ok {
+		return ErrEncoding
+	}
+
+	var buf bytes.Buffer
+	w, err := encoding.NewWriter(&buf)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.Body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	m.Body = buf.Bytes()
+	m.Header.Add(HeaderEncoding, []byte(m.compress))
+	return nil
+}
+
+// Decompress decompresses the message body according to the
+// content-encoding header and removes the header. Bodies with an
+// unregistered content encoding are left untouched. It returns
+// ErrFrameTooLarge if the decompressed body exceeds the default maximum
+// frame size.
+func Decompress(m *Message) error {
+	return DecompressLimit(m, bufferLimit)
+}
+
+// DecompressLimit is like Decompress, but returns ErrFrameTooLarge if
+// the decompressed body exceeds limit bytes. A limit of zero or less
+// applies the default maximum frame size.
+func DecompressLimit(m *Message, limit int) error {
+	if limit <= 0 {
+		limit = bufferLimit
+	}
+	name := m.Header.Get(HeaderEncoding)
+	if len(name) == 0 {
+		return nil
+	}
+	encoding, ok := lookupEncoding(string(name))
+	if !ok {
+		return nil
+	}
+
+	r, err := encoding.NewReader(bytes.NewReader(m.Body))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > limit {
+		return ErrFrameTooLarge
+	}
+	m.Body = body
+	m.Header.Del(HeaderEncoding)
+	return nil
+}
+
+// AcceptsEncoding returns true if the comma-separated list of accepted
+// encodings, as advertised by the accept-encoding header, includes the
+// named encoding.
+func AcceptsEncoding(accept []byte, name []byte) bool {
+	for _, v := range strings.Split(string(accept), ",") {
+		if strings.TrimSpace(v) == string(name) {
+			return true
+		}
+	}
+	return false
+}
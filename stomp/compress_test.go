@@ -0,0 +1,131 @@
+package stomp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestCompress(t *testing.T) {
+	body := bytes.Repeat([]byte("hello world "), 200)
+
+	for _, encoding := range []string{EncodingGzip, EncodingDeflate} {
+		m := NewMessage()
+		m.Body = body
+		m.Apply(WithCompression(encoding))
+		if err := compress(m); err != nil {
+			t.Errorf("Want %s compression without error, got %s", encoding, err)
+			continue
+		}
+		if got := m.Header.GetString("content-encoding"); got != encoding {
+			t.Errorf("Want content-encoding %s, got %q", encoding, got)
+		}
+		if len(m.Body) >= len(body) {
+			t.Errorf("Want %s compressed body smaller than %d bytes, got %d", encoding, len(body), len(m.Body))
+		}
+
+		if err := Decompress(m); err != nil {
+			t.Errorf("Want %s decompression without error, got %s", encoding, err)
+			continue
+		}
+		if !bytes.Equal(m.Body, body) {
+			t.Errorf("Want %s decompressed body to match the original", encoding)
+		}
+		if m.Header.Len() != 0 {
+			t.Errorf("Want content-encoding header removed after decompression")
+		}
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	m := NewMessage()
+	m.Body = []byte("hello")
+	m.Apply(WithCompression(EncodingGzip))
+	compress(m)
+	if string(m.Body) != "hello" || m.Header.Len() != 0 {
+		t.Errorf("Want body below the threshold sent uncompressed")
+	}
+}
+
+func TestCompressUnknown(t *testing.T) {
+	m := NewMessage()
+	m.Body = bytes.Repeat([]byte("a"), CompressThreshold)
+	m.Apply(WithCompression("br"))
+	if err := compress(m); err != ErrEncoding {
+		t.Errorf("Want ErrEncoding, got %v", err)
+	}
+}
+
+// snappyEncoding is a custom content encoding used to test the registry.
+type snappyEncoding struct{}
+
+func (snappyEncoding) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyEncoding) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(snappy.NewReader(r)), nil
+}
+
+func TestRegisterEncoding(t *testing.T) {
+	RegisterEncoding("snappy", snappyEncoding{})
+	defer func() {
+		encodingsMu.Lock()
+		delete(encodings, "snappy")
+		encodingsMu.Unlock()
+	}()
+
+	if got, want := strings.Join(Encodings(), ","), "deflate,gzip,snappy"; got != want {
+		t.Errorf("Want registered encodings %s, got %s", want, got)
+	}
+
+	body := bytes.Repeat([]byte("hello world "), 200)
+	m := NewMessage()
+	m.Body = body
+	m.Apply(WithCompression("snappy"))
+	if err := compress(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Body) >= len(body) {
+		t.Errorf("Want snappy compressed body")
+	}
+	if err := Decompress(m); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.Body, body) {
+		t.Errorf("Want snappy decompressed body to match the original")
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	accept := []byte("deflate, gzip")
+	if !AcceptsEncoding(accept, []byte("gzip")) {
+		t.Errorf("Want gzip accepted")
+	}
+	if AcceptsEncoding(accept, []byte("snappy")) {
+		t.Errorf("Want snappy not accepted")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	m := NewMessage()
+	m.Body = bytes.Repeat([]byte{0}, 4<<10)
+	m.Apply(WithCompression(EncodingGzip))
+	if err := compress(m); err != nil {
+		t.Fatal(err)
+	}
+	compressed := m.Body
+	if err := DecompressLimit(m, 1<<10); err != ErrFrameTooLarge {
+		t.Errorf("Want ErrFrameTooLarge inflating past the limit, got %v", err)
+	}
+	if !bytes.Equal(m.Body, compressed) || m.Header.GetString("content-encoding") != EncodingGzip {
+		t.Errorf("Want message left compressed when the limit is exceeded")
+	}
+	if err := DecompressLimit(m, 4<<10); err != nil || len(m.Body) != 4<<10 {
+		t.Errorf("Want body decompressed within the limit, got %d bytes, %v", len(m.Body), err)
+	}
+}
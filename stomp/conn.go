@@ -2,155 +2,677 @@ package stomp
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mrwill84/mq/logger"
+	"golang.org/x/net/context"
 )
 
 const (
 	bufferSize  = 32 << 10 // default buffer size 32KB
-	bufferLimit = 32 << 15 // default buffer limit 1MB
+	bufferLimit = 32 << 15 // default maximum frame size 1MB
 )
 
 var (
 	never    time.Time
 	deadline = time.Second * 5
 
+	flushInterval = time.Millisecond * 100
+
 	heartbeatTime = time.Second * 30
 	heartbeatWait = time.Second * 60
 )
 
 type connPeer struct {
-	conn net.Conn
-	done chan bool
+	lastRead int64 // time of the last frame or heart-beat read, accessed atomically
+	beats    int64 // heart-beats read, accessed atomically
+
+	once  sync.Once // begins the shutdown
+	mu    sync.Mutex
+	err   error
+	conn  net.Conn
+	done  chan struct{} // closed when shutdown begins
+	codec FrameCodec
+	proto []byte // negotiated protocol version
+
+	wg       sync.WaitGroup
+	finished chan struct{} // closed when the reader and writer exit
+
+	flush     time.Duration // interval at which buffered writes are flushed
+	strategy  FlushStrategy // when buffered writes are flushed
+	flushSize int           // buffered bytes flushed by FlushOnSize
+	beat      time.Duration // interval at which heart-beats are written
+	wait      time.Duration // read deadline extended by each heart-beat, negotiated under mu
+
+	monitor bool // extend the read deadline by every frame read
+	limit   int  // maximum frame size, or zero for the codec default
+
+	connected bool // received CONNECTED, so the remote peer is a broker
+
+	frames *frameLogger // debug sink of frames read and written, if any
 
 	reader   *bufio.Reader
-	writer   *bufio.Writer
+	writer   *vectorWriter
+	staging  *bufio.Writer // frames of codecs that are not vector encoders
 	incoming chan *Message
 	outgoing chan *Message
 }
 
 // Conn creates a network-connected peer that reads and writes
-// messages using net.Conn c.
+// messages using net.Conn c. The peer uses STOMP text frames unless
+// the remote peer negotiates an alternate codec.
 func Conn(c net.Conn) Peer {
+	return newConnPeer(c, TextCodec, ConnConfig{})
+}
+
+// ConnWithConfig creates a network-connected peer that reads and writes
+// messages using net.Conn c, with buffers and heart-beats configured by
+// the config.
+func ConnWithConfig(c net.Conn, config ConnConfig) Peer {
+	return newConnPeer(c, TextCodec, config)
+}
+
+// ConnCodec creates a network-connected peer that reads and writes
+// messages using net.Conn c and the given codec. The codec must be
+// registered with the remote peer, which adopts the codec upon reading
+// the codec preamble written to the connection.
+func ConnCodec(c net.Conn, codec FrameCodec) (Peer, error) {
+	if codec.Name() != TextCodec.Name() {
+		name := codec.Name()
+		preamble := append([]byte{codecPreamble, byte(len(name))}, name...)
+		if _, err := c.Write(preamble); err != nil {
+			return nil, err
+		}
+	}
+	return newConnPeer(c, codec, ConnConfig{}), nil
+}
+
+// FlushStrategy defines when a connection flushes buffered writes,
+// trading latency for throughput.
+type FlushStrategy string
+
+// Flush strategies.
+const (
+	// FlushOnInterval flushes buffered writes every FlushInterval. Bursts
+	// of frames are written together at the cost of up to an interval
+	// of latency.
+	FlushOnInterval FlushStrategy = "interval"
+
+	// FlushImmediate flushes as soon as the frames waiting to be sent
+	// are written, giving the lowest latency.
+	FlushImmediate FlushStrategy = "immediate"
+
+	// FlushOnSize flushes once FlushSize bytes are buffered, and every
+	// FlushInterval so that a trickle of frames is not held back.
+	FlushOnSize FlushStrategy = "size"
+)
+
+// ConnConfig configures the connection buffers and heart-beats. Zero
+// values select the defaults.
+type ConnConfig struct {
+	ReadBufferSize    int           // default 32KB
+	WriteBufferSize   int           // default 32KB
+	FlushInterval     time.Duration // default 100ms
+	FlushStrategy     FlushStrategy // default FlushOnInterval
+	FlushSize         int           // default half the write buffer
+	HeartbeatInterval time.Duration // default 30s
+	HeartbeatTimeout  time.Duration // default 60s
+	MaxFrameSize      int           // default 1MB, or 64MB with BinaryCodec
+
+	// MonitorHeartbeats enables failure detection once the remote peer
+	// negotiates heart-beating: the connection is closed with
+	// ErrHeartbeatTimeout if nothing is read within HeartbeatTimeout.
+	MonitorHeartbeats bool
+
+	// FrameLogger receives every frame and heart-beat read and written,
+	// with a timestamp, for protocol debugging. Credentials are redacted.
+	FrameLogger io.Writer
+}
+
+func newConnPeer(c net.Conn, codec FrameCodec, config ConnConfig) *connPeer {
+	if config.ReadBufferSize <= 0 {
+		config.ReadBufferSize = bufferSize
+	}
+	if config.WriteBufferSize <= 0 {
+		config.WriteBufferSize = bufferSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = flushInterval
+	}
+	if config.FlushStrategy == "" {
+		config.FlushStrategy = FlushOnInterval
+	}
+	if config.FlushSize <= 0 || config.FlushSize > config.WriteBufferSize {
+		config.FlushSize = config.WriteBufferSize / 2
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = heartbeatTime
+	}
+	if config.HeartbeatTimeout <= 0 {
+		config.HeartbeatTimeout = heartbeatWait
+	}
+
 	p := &connPeer{
-		reader:   bufio.NewReaderSize(c, bufferSize),
-		writer:   bufio.NewWriterSize(c, bufferSize),
-		incoming: make(chan *Message),
-		outgoing: make(chan *Message),
-		done:     make(chan bool),
-		conn:     c,
+		reader:    bufio.NewReaderSize(c, config.ReadBufferSize),
+		writer:    newVectorWriter(c, config.WriteBufferSize),
+		flush:     config.FlushInterval,
+		strategy:  config.FlushStrategy,
+		flushSize: config.FlushSize,
+		beat:      config.HeartbeatInterval,
+		wait:      config.HeartbeatTimeout,
+		monitor:   config.MonitorHeartbeats,
+		limit:     config.MaxFrameSize,
+		incoming:  make(chan *Message),
+		outgoing:  make(chan *Message),
+		done:      make(chan struct{}),
+		finished:  make(chan struct{}),
+		conn:      c,
+		codec:     codec,
+		frames:    newFrameLogger(config.FrameLogger),
 	}
 
+	p.staging = bufio.NewWriterSize(p.writer, stagingSize)
+
+	p.wg.Add(2)
 	go p.readInto(p.incoming)
 	go p.writeFrom(p.outgoing)
+	go func() {
+		p.wg.Wait()
+		close(p.finished)
+	}()
 	return p
 }
 
+// codecPreamble is the first byte of the codec preamble. The preamble
+// is followed by the length of the codec name and the codec name.
+const codecPreamble = 0xff
+
+// errCodec is returned when the remote peer negotiates an unknown codec.
+var errCodec = errors.New("stomp: unknown codec")
+
+// ErrHeartbeatTimeout is returned when the remote peer misses its
+// heart-beats and the connection is closed.
+var ErrHeartbeatTimeout = errors.New("stomp: heart-beat timeout")
+
+// negotiate reads the optional codec preamble from the connection and
+// adopts the requested codec.
+func (c *connPeer) negotiate() error {
+	b, err := c.reader.Peek(1)
+	if err != nil || b[0] != codecPreamble {
+		return err
+	}
+	c.reader.Discard(1)
+	size, err := c.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	name := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, name); err != nil {
+		return err
+	}
+	codec, ok := lookupCodec(string(name))
+	if !ok {
+		return errCodec
+	}
+	logger.Verbosef("stomp: negotiated codec %s", codec.Name())
+
+	c.mu.Lock()
+	c.codec = codec
+	c.mu.Unlock()
+	return nil
+}
+
+// getCodec returns the connection codec.
+func (c *connPeer) getCodec() FrameCodec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.codec
+}
+
+// setProto records the protocol version negotiated by the CONNECTED
+// message and adjusts the framing of subsequent messages.
+func (c *connPeer) setProto(proto []byte) {
+	c.mu.Lock()
+	c.proto = append([]byte(nil), proto...)
+	if _, ok := c.codec.(textCodec); ok {
+		c.codec = textCodec{escape: escapesHeaders(proto)}
+	}
+	c.mu.Unlock()
+}
+
+// heartbeats returns true if the negotiated protocol version supports
+// heart-beating.
+func (c *connPeer) heartbeats() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.proto) == 0 || supportsHeartbeat(c.proto)
+}
+
+// negotiatesHeartbeat returns true if the message is a CONNECT, STOMP or
+// CONNECTED frame, which negotiate heart-beating.
+func negotiatesHeartbeat(m *Message) bool {
+	return bytes.Equal(m.Method, MethodConnected) ||
+		bytes.Equal(m.Method, MethodConnect) ||
+		bytes.Equal(m.Method, MethodStomp)
+}
+
+// heartbeatHeader returns the heart-beat header advertised by the peer:
+// the interval at which it sends heart-beats and the interval at which
+// it expects them, in milliseconds.
+func (c *connPeer) heartbeatHeader() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := strconv.AppendInt(nil, int64(c.beat/time.Millisecond), 10)
+	b = append(b, ',')
+	return strconv.AppendInt(b, int64(c.wait/2/time.Millisecond), 10)
+}
+
+// negotiateHeartbeat extends the read deadline to twice the interval at
+// which the remote peer sends heart-beats, as advertised by its
+// heart-beat header, so that a peer sending heart-beats less often than
+// the configured timeout is not disconnected.
+func (c *connPeer) negotiateHeartbeat(header []byte) {
+	i := bytes.IndexByte(header, ',')
+	if i < 0 {
+		return
+	}
+	ms, err := strconv.ParseInt(string(header[:i]), 10, 64)
+	if err != nil || ms <= 0 {
+		return
+	}
+	c.mu.Lock()
+	if wait := 2 * time.Duration(ms) * time.Millisecond; wait > c.wait {
+		c.wait = wait
+	}
+	c.mu.Unlock()
+}
+
+// LastRead returns the time the last frame or heart-beat was read from
+// the connection, or the zero time if nothing has been read.
+func (c *connPeer) LastRead() time.Time {
+	if t := atomic.LoadInt64(&c.lastRead); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// Heartbeats returns the number of heart-beats read from the connection.
+func (c *connPeer) Heartbeats() int64 {
+	return atomic.LoadInt64(&c.beats)
+}
+
 func (c *connPeer) Receive() <-chan *Message {
 	return c.incoming
 }
 
 func (c *connPeer) Send(message *Message) error {
+	if frameSize(message) > c.frameLimit(c.getCodec()) {
+		return ErrFrameTooLarge
+	}
 	select {
 	case <-c.done:
-		return io.EOF
+		return ErrClosed
 	default:
-		c.outgoing <- message
+	}
+	select {
+	case <-c.done:
+		return ErrClosed
+	case c.outgoing <- message:
 		return nil
 	}
 }
 
 func (c *connPeer) Addr() string {
+	return c.RemoteAddr()
+}
+
+func (c *connPeer) LocalAddr() string {
+	return c.conn.LocalAddr().String()
+}
+
+func (c *connPeer) RemoteAddr() string {
 	return c.conn.RemoteAddr().String()
 }
 
+func (c *connPeer) Closed() <-chan struct{} {
+	return c.done
+}
+
+func (c *connPeer) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
 func (c *connPeer) Close() error {
-	return c.close()
+	return c.close(nil)
+}
+
+func (c *connPeer) CloseWithError(err error) error {
+	return c.close(err)
 }
 
-func (c *connPeer) close() error {
+// Shutdown closes the connection and waits until pending outgoing
+// messages are flushed and the reader and writer exit. If the context
+// expires first, the connection is closed immediately and the context
+// error is returned.
+func (c *connPeer) Shutdown(ctx context.Context) error {
+	err := c.close(nil)
 	select {
-	case <-c.done:
-		return io.EOF
-	default:
+	case <-c.finished:
+		return err
+	case <-ctx.Done():
+		c.conn.Close()
+		<-c.finished
+		return ctx.Err()
+	}
+}
+
+// close begins an ordered shutdown, once. The writer flushes messages
+// accepted by Send and closes the connection, which unblocks the
+// reader. The incoming channel is closed by the reader, its only
+// sender, once it exits, and the outgoing channel is never closed.
+func (c *connPeer) close(err error) error {
+	closed := false
+	c.once.Do(func() {
+		closed = true
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
 		close(c.done)
-		close(c.incoming)
-		close(c.outgoing)
-		return nil
+	})
+	if !closed {
+		return ErrClosed
 	}
+	return nil
 }
 
 func (c *connPeer) readInto(messages chan<- *Message) {
-	defer c.close()
+	var err error
+	defer func() {
+		if err == io.EOF {
+			err = nil
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			err = ErrHeartbeatTimeout
+		}
+		if err == ErrFrameTooLarge && !c.connected {
+			c.reject("frame too large")
+		}
+		c.close(err)
+		close(messages)
+		c.wg.Done()
+	}()
 
-	for {
-		// lim := io.LimitReader(c.conn, bufferLimit)
-		// buf := bufio.NewReaderSize(lim, bufferSize)
+	if err = c.negotiate(); err != nil {
+		return
+	}
 
-		buf, err := c.reader.ReadBytes(0)
+	for {
+		codec := c.getCodec()
+		buf := newBuffer()
+		buf.b, err = c.readFrame(codec, buf.b)
 		if err != nil {
 			break
 		}
-		if len(buf) == 1 {
-			c.conn.SetReadDeadline(time.Now().Add(heartbeatWait))
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		if len(buf.b) == 0 {
+			atomic.AddInt64(&c.beats, 1)
+			if c.frames != nil {
+				c.frames.log("<<<", nil)
+			}
+			buf.release()
+			c.conn.SetReadDeadline(time.Now().Add(c.wait))
 			logger.Verbosef("stomp: received heart-beat")
 			continue
 		}
 
+		// the frame buffer is shared by copies of SEND messages fanned
+		// out to subscribers, and returned to the pool once every copy
+		// is released. MESSAGE frames are released by the handler that
+		// receives them. Other messages may be retained by the receiver,
+		// so they are decoded from an exact copy of the frame and the
+		// pooled buffer is returned at once.
 		msg := NewMessage()
-		msg.Parse(buf[:len(buf)-1])
+		if pooledFrame(codec, buf.b) {
+			err = codec.Decode(buf.b, msg)
+			msg.buf = buf
+			msg.seal()
+		} else {
+			b := append([]byte(nil), buf.b...)
+			buf.release()
+			err = codec.Decode(b, msg)
+		}
+		if err != nil {
+			msg.Release()
+			break
+		}
+		if bytes.Equal(msg.Method, MethodConnected) {
+			c.setProto(msg.Proto)
+			c.connected = true
+		}
+		if negotiatesHeartbeat(msg) {
+			c.negotiateHeartbeat(msg.Header.Get(HeaderHeartbeat))
+		}
+		if c.frames != nil {
+			c.frames.log("<<<", msg)
+		}
+		if c.monitor && c.heartbeats() {
+			c.conn.SetReadDeadline(time.Now().Add(c.wait))
+		}
 
 		select {
 		case <-c.done:
-			break
-		default:
-			messages <- msg
+			msg.Release()
+			err = nil
+			return
+		case messages <- msg:
 		}
 	}
 }
 
+// pooledFrame returns true if the raw frame is a SEND or MESSAGE frame,
+// which is decoded in place from the pooled frame buffer.
+func pooledFrame(codec FrameCodec, b []byte) bool {
+	p, ok := codec.(methodPeeker)
+	if !ok {
+		return false
+	}
+	method := p.peekMethod(b)
+	return bytes.Equal(method, MethodSend) || bytes.Equal(method, MethodMessage)
+}
+
+// readFrame reads the next raw frame with the codec, rejecting frames
+// larger than the maximum frame size.
+func (c *connPeer) readFrame(codec FrameCodec, buf []byte) ([]byte, error) {
+	if l, ok := codec.(frameLimiter); ok {
+		return l.readFrameLimit(c.reader, buf, c.frameLimit(codec))
+	}
+	buf, err := codec.ReadFrame(c.reader, buf)
+	if err == nil && len(buf) > c.frameLimit(codec) {
+		return nil, ErrFrameTooLarge
+	}
+	return buf, err
+}
+
+// frameLimit returns the maximum frame size: the configured size or, if
+// none is configured, the default of the codec.
+func (c *connPeer) frameLimit(codec FrameCodec) int {
+	if c.limit > 0 {
+		return c.limit
+	}
+	if _, ok := codec.(binaryCodec); ok {
+		return maxFrameSize
+	}
+	return bufferLimit
+}
+
+// reject sends an ERROR frame with the message to the remote peer
+// before the connection is closed.
+func (c *connPeer) reject(message string) {
+	e := NewMessage()
+	e.Method = MethodError
+	e.Header.Add(HeaderMessage, []byte(message))
+	select {
+	case c.outgoing <- e:
+	case <-c.done:
+		e.Release()
+	}
+}
+
+// frameSize returns the approximate encoded size of the message frame.
+func frameSize(m *Message) int {
+	n := len(m.Body)
+	for _, field := range m.fields() {
+		n += len(*field)
+	}
+	for i := 0; i < m.Header.Len(); i++ {
+		name, data := m.Header.Index(i)
+		n += len(name) + len(data)
+	}
+	return n
+}
+
 func (c *connPeer) writeFrom(messages <-chan *Message) {
-	tick := time.NewTicker(time.Millisecond * 100).C
-	heartbeat := time.NewTicker(heartbeatTime).C
+	defer c.wg.Done()
+
+	tick := time.NewTicker(c.flush)
+	defer tick.Stop()
+	heartbeat := time.NewTicker(c.beat)
+	defer heartbeat.Stop()
 
 loop:
 	for {
 		select {
 		case <-c.done:
 			break loop
-		case <-heartbeat:
+		case <-heartbeat.C:
+			if !c.heartbeats() {
+				continue
+			}
 			logger.Verbosef("stomp: send heart-beat.")
-			c.writer.WriteByte(0)
-		case <-tick:
-			c.conn.SetWriteDeadline(time.Now().Add(deadline))
-			if err := c.writer.Flush(); err != nil {
+			if c.frames != nil {
+				c.frames.log(">>>", nil)
+			}
+			c.getCodec().Heartbeat(c.staging)
+			c.staging.Flush()
+			if c.strategy == FlushImmediate && !c.flushWrites() {
 				break loop
 			}
-			c.conn.SetWriteDeadline(never)
-		case msg, ok := <-messages:
-			if !ok {
+		case <-tick.C:
+			if !c.flushWrites() {
+				break loop
+			}
+		case msg := <-messages:
+			c.encodeBatch(msg, messages)
+			if c.shouldFlush() && !c.flushWrites() {
 				break loop
 			}
-			writeTo(c.writer, msg)
-			c.writer.WriteByte(0)
-			msg.Release()
 		}
 	}
 
 	c.drain()
 }
 
-func (c *connPeer) drain() error {
+// shouldFlush returns true if the flush strategy flushes the frames
+// just written.
+func (c *connPeer) shouldFlush() bool {
+	switch c.strategy {
+	case FlushImmediate:
+		return true
+	case FlushOnSize:
+		return c.writer.Buffered() >= c.flushSize
+	}
+	return false
+}
+
+// flushWrites flushes buffered writes to the connection. It returns false
+// and closes the peer if the write fails.
+func (c *connPeer) flushWrites() bool {
 	c.conn.SetWriteDeadline(time.Now().Add(deadline))
-	for msg := range c.outgoing {
-		writeTo(c.writer, msg)
-		c.writer.WriteByte(0)
-		msg.Release()
+	if err := c.writer.Flush(); err != nil {
+		c.close(err)
+		return false
 	}
 	c.conn.SetWriteDeadline(never)
+	return true
+}
+
+// maxBatch is the maximum number of messages encoded by the writer
+// before it checks for flushes, heart-beats and shutdown.
+const maxBatch = 64
+
+// stagingSize is the buffer size of codecs that are not vector encoders,
+// whose frames are copied to the vector writer as they are encoded.
+const stagingSize = 4 << 10
+
+// encodeBatch encodes the message and the messages already waiting to be
+// sent, so that a burst of messages is encoded with a single codec
+// lookup and written by the same flush.
+func (c *connPeer) encodeBatch(msg *Message, messages <-chan *Message) {
+	codec := c.getCodec()
+	for i := 1; ; i++ {
+		if c.frames != nil {
+			c.frames.log(">>>", msg)
+		}
+		if negotiatesHeartbeat(msg) && msg.Header.Get(HeaderHeartbeat) == nil {
+			msg.Header.Add(HeaderHeartbeat, c.heartbeatHeader())
+		}
+		held := c.encode(codec, msg)
+		if bytes.Equal(msg.Method, MethodConnected) {
+			c.setProto(msg.Proto)
+			codec = c.getCodec()
+		}
+		if !held {
+			msg.Release()
+		}
+		if i == maxBatch {
+			return
+		}
+		select {
+		case msg = <-messages:
+		default:
+			return
+		}
+	}
+}
+
+// encode writes the message frame. It returns true if the writer holds
+// the message until the frame is written, in which case the writer
+// releases the message.
+func (c *connPeer) encode(codec FrameCodec, m *Message) bool {
+	v, ok := codec.(vectorEncoder)
+	if !ok {
+		if err := codec.Encode(c.staging, m); err != nil {
+			logger.Warningf("stomp: encode %s frame: %s", m.Method, err)
+		}
+		c.staging.Flush()
+		return false
+	}
+	if err := v.encodeHead(c.writer, m); err != nil {
+		logger.Warningf("stomp: encode %s frame: %s", m.Method, err)
+		return false
+	}
+	held := c.writer.body(m)
+	c.writer.Write(v.trailer())
+	return held
+}
+
+// drain flushes the messages written by the writer and closes the
+// connection. Once the writer stops receiving, a concurrent Send can
+// only select the closed done channel, so every message accepted by
+// Send has been encoded and there is nothing left to receive. The
+// outgoing channel is never closed, so a concurrent Send cannot panic;
+// it returns ErrClosed instead.
+func (c *connPeer) drain() error {
+	c.conn.SetWriteDeadline(time.Now().Add(deadline))
 	c.writer.Flush()
 	return c.conn.Close()
 }
@@ -1 +1,317 @@
 package stomp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+)
+
+func TestConnShutdown(t *testing.T) {
+	a, b := net.Pipe()
+	server := Conn(b)
+	client := Conn(a)
+
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte("/topic/test")
+	m.Body = []byte("hello")
+	client.Send(m)
+
+	done := make(chan error)
+	go func() {
+		done <- client.(*connPeer).Shutdown(context.Background())
+	}()
+
+	got, ok := <-server.Receive()
+	if !ok {
+		t.Fatalf("Expect pending message flushed before shutdown")
+	}
+	if !bytes.Equal(got.Body, []byte("hello")) {
+		t.Errorf("Expect message body %q, got %q", "hello", got.Body)
+	}
+	got.Release()
+
+	if err := <-done; err != nil {
+		t.Errorf("Expect clean shutdown, got %s", err)
+	}
+	if _, ok := <-server.Receive(); ok {
+		t.Errorf("Expect remote incoming channel closed")
+	}
+	// the reader and writer of both peers exit.
+	<-server.(*connPeer).finished
+	<-client.(*connPeer).finished
+
+	if err := client.Send(NewMessage()); err != ErrClosed {
+		t.Errorf("Expect ErrClosed sending to a closed peer, got %v", err)
+	}
+	if err := client.Close(); err != ErrClosed {
+		t.Errorf("Expect ErrClosed closing a closed peer, got %v", err)
+	}
+}
+
+func TestConnShutdownDeadline(t *testing.T) {
+	a, _ := net.Pipe()
+	client := Conn(a)
+
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte("/topic/test")
+	client.Send(m)
+
+	// the remote end never reads, so the flush blocks until the
+	// context expires and the connection is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.(*connPeer).Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expect context.DeadlineExceeded, got %v", err)
+	}
+	select {
+	case <-client.(*connPeer).finished:
+	default:
+		t.Errorf("Expect reader and writer exited")
+	}
+}
+
+func TestConnCloseLeak(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	a, b := net.Pipe()
+	server := Conn(b)
+	client := Conn(a)
+
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte("/topic/test")
+	client.Send(m)
+	if got, ok := <-server.Receive(); ok {
+		got.Release()
+	}
+	client.Close()
+	server.Close()
+	<-server.(*connPeer).finished
+	<-client.(*connPeer).finished
+}
+
+func TestConnShutdownDeadlineLeak(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	a, b := net.Pipe()
+	defer b.Close()
+	client := Conn(a)
+
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte("/topic/test")
+	client.Send(m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.(*connPeer).Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expect context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestConnReaderStopsLeak(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	a, b := net.Pipe()
+	server := Conn(b)
+	client := Conn(a)
+
+	// the client sends until the peer is closed, while the server
+	// stops receiving after the first message.
+	sent := make(chan error)
+	go func() {
+		for {
+			m := NewMessage()
+			m.Method = MethodSend
+			m.Dest = []byte("/topic/test")
+			m.Body = make([]byte, 1024)
+			if err := client.Send(m); err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+	got, ok := <-server.Receive()
+	if !ok {
+		t.Fatalf("Expect message received")
+	}
+	got.Release()
+	time.Sleep(50 * time.Millisecond)
+
+	server.Close()
+	if err := <-sent; err != ErrClosed {
+		t.Errorf("Expect ErrClosed sending to a closed peer, got %v", err)
+	}
+	<-server.(*connPeer).finished
+	<-client.(*connPeer).finished
+}
+
+func TestConnConfig(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	client := newClient(a, []Option{
+		WithReadBuffer(64 << 10),
+		WithWriteBuffer(16 << 10),
+		WithFlushInterval(10 * time.Millisecond),
+	})
+	defer client.peer.Close()
+
+	peer := client.peer.(*connPeer)
+	if got := peer.reader.Size(); got != 64<<10 {
+		t.Errorf("Expect read buffer size %d, got %d", 64<<10, got)
+	}
+	if got := peer.writer.Size(); got != 16<<10 {
+		t.Errorf("Expect write buffer size %d, got %d", 16<<10, got)
+	}
+	if peer.flush != 10*time.Millisecond {
+		t.Errorf("Expect flush interval 10ms, got %s", peer.flush)
+	}
+
+	peer = Conn(b).(*connPeer)
+	defer peer.Close()
+	if peer.reader.Size() != bufferSize || peer.writer.Size() != bufferSize || peer.flush != flushInterval {
+		t.Errorf("Expect default buffer sizes and flush interval")
+	}
+}
+
+func TestConnFlushStrategy(t *testing.T) {
+	tests := []struct {
+		config  ConnConfig
+		flushed bool
+	}{
+		{ConnConfig{FlushInterval: time.Hour}, false},
+		{ConnConfig{FlushInterval: time.Hour, FlushStrategy: FlushImmediate}, true},
+		{ConnConfig{FlushInterval: time.Hour, FlushStrategy: FlushOnSize, FlushSize: 16}, true},
+		{ConnConfig{FlushInterval: time.Hour, FlushStrategy: FlushOnSize, FlushSize: 1 << 10}, false},
+	}
+	for _, test := range tests {
+		a, b := net.Pipe()
+		client := ConnWithConfig(a, test.config)
+		server := Conn(b)
+
+		m := NewMessage()
+		m.Method = MethodSend
+		m.Dest = []byte("/topic/test")
+		m.Body = []byte("hello")
+		client.Send(m)
+
+		select {
+		case got := <-server.Receive():
+			if !test.flushed {
+				t.Errorf("Expect %s strategy to buffer the frame", test.config.FlushStrategy)
+			}
+			got.Release()
+		case <-time.After(100 * time.Millisecond):
+			if test.flushed {
+				t.Errorf("Expect %s strategy to flush the frame", test.config.FlushStrategy)
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestConnHeartbeatTimeout(t *testing.T) {
+	a, b := net.Pipe()
+
+	// the broker advertises heart-beats it never sends within the client
+	// timeout.
+	broker := ConnWithConfig(b, ConnConfig{HeartbeatInterval: time.Hour})
+	defer broker.Close()
+	go func() {
+		<-broker.Receive()
+		reply := NewMessage()
+		reply.Method = MethodConnected
+		reply.Header.Add(HeaderHeartbeat, []byte("10,0"))
+		broker.Send(reply)
+	}()
+
+	client := newClient(a, []Option{WithHeartbeat(time.Hour, 50*time.Millisecond)})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-client.Done():
+		if err != ErrHeartbeatTimeout {
+			t.Errorf("Expect heart-beat timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect connection closed after missed heart-beats")
+	}
+}
+
+func TestConnHeartbeatNegotiated(t *testing.T) {
+	a, b := net.Pipe()
+
+	// the broker sends heart-beats less often than the client timeout,
+	// and advertises its interval in the CONNECTED frame.
+	broker := ConnWithConfig(b, ConnConfig{HeartbeatInterval: 100 * time.Millisecond})
+	defer broker.Close()
+	go fakeBroker(broker)
+
+	client := newClient(a, []Option{WithHeartbeat(time.Hour, 50*time.Millisecond)})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	select {
+	case err := <-client.Done():
+		t.Errorf("Expect timeout derived from the broker heart-beats, got %v", err)
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestConnMaxFrameSize(t *testing.T) {
+	a, b := net.Pipe()
+
+	broker := ConnWithConfig(b, ConnConfig{MaxFrameSize: 64})
+	client := Conn(a)
+	defer client.Close()
+
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte("/queue/test")
+	m.Body = bytes.Repeat([]byte("x"), 128)
+	if err := broker.Send(m.Copy()); err != ErrFrameTooLarge {
+		t.Errorf("Expect sending an oversized frame rejected, got %v", err)
+	}
+	if err := client.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case reply := <-client.Receive():
+		if !bytes.Equal(reply.Method, MethodError) || reply.Header.GetString("message") != "frame too large" {
+			t.Errorf("Expect ERROR frame too large, got %s", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expect ERROR frame before the connection is closed")
+	}
+	<-Closed(broker)
+	if err := CloseErr(broker); err != ErrFrameTooLarge {
+		t.Errorf("Expect broker closed with frame too large, got %v", err)
+	}
+}
+
+func TestConnFrameLimit(t *testing.T) {
+	a, b := net.Pipe()
+	c := newConnPeer(a, TextCodec, ConnConfig{})
+	defer c.Close()
+	if c.frameLimit(TextCodec) != bufferLimit || c.frameLimit(BinaryCodec) != maxFrameSize {
+		t.Errorf("Expect the default frame size of each codec")
+	}
+	c = newConnPeer(b, TextCodec, ConnConfig{MaxFrameSize: 1024})
+	defer c.Close()
+	if c.frameLimit(TextCodec) != 1024 || c.frameLimit(BinaryCodec) != 1024 {
+		t.Errorf("Expect the configured frame size for every codec")
+	}
+}
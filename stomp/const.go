@@ -17,28 +17,68 @@ var (
 	MethodMessage     = []byte("MESSAGE")
 	MethodRecipet     = []byte("RECEIPT")
 	MethodError       = []byte("ERROR")
+	MethodAdvisory    = []byte("ADVISORY")
 )
 
 // STOMP protocol headers.
 var (
 	HeaderAccept       = []byte("accept-version")
+	HeaderAcceptEnc    = []byte("accept-encoding")
 	HeaderAck          = []byte("ack")
+	HeaderAckLevel     = []byte("ack-level")
+	HeaderAdvisory     = []byte("advisory")
+	HeaderAffinity     = []byte("affinity")
+	HeaderBrowse       = []byte("browse")
+	HeaderChunk        = []byte("chunk")
+	HeaderClient       = []byte("client")
+	HeaderClientID     = []byte("client-id")
+	HeaderContentType  = []byte("content-type")
+	HeaderCorrelation  = []byte("correlation-id")
+	HeaderDedupID      = []byte("dedup-id")
+	HeaderDelay        = []byte("delay")
+	HeaderEncoding     = []byte("content-encoding")
+	HeaderEpoch        = []byte("epoch")
+	HeaderExclusive    = []byte("exclusive")
 	HeaderExpires      = []byte("expires")
+	HeaderGroup        = []byte("group")
+	HeaderHeartbeat    = []byte("heart-beat")
 	HeaderDest         = []byte("destination")
+	HeaderDurable      = []byte("durable")
 	HeaderHost         = []byte("host")
 	HeaderLogin        = []byte("login")
+	HeaderMessage      = []byte("message")
 	HeaderPass         = []byte("passcode")
 	HeaderID           = []byte("id")
+	HeaderKey          = []byte("key")
 	HeaderMessageID    = []byte("message-id")
+	HeaderMessageType  = []byte("message-type")
+	HeaderOffset       = []byte("offset")
 	HeaderPersist      = []byte("persist")
 	HeaderPrefetch     = []byte("prefetch-count")
 	HeaderReceipt      = []byte("receipt")
 	HeaderReceiptID    = []byte("receipt-id")
+	HeaderRedelivered  = []byte("redelivered")
+	HeaderReconnectTo  = []byte("reconnect-to")
+	HeaderRedirect     = []byte("redirect")
+	HeaderReplayFrom   = []byte("replay-from")
+	HeaderRequeue      = []byte("requeue")
+	HeaderResumed      = []byte("resumed")
 	HeaderRetain       = []byte("retain")
+	HeaderReplyTo      = []byte("reply-to")
+	HeaderRetryAfter   = []byte("retry-after")
+	HeaderSchedule     = []byte("scheduled-time")
 	HeaderSelector     = []byte("selector")
+	HeaderSequence     = []byte("sequence")
+	HeaderStream       = []byte("stream")
+	HeaderStreamAbort  = []byte("stream-abort")
+	HeaderStreamEnd    = []byte("stream-end")
+	HeaderStreamSize   = []byte("stream-size")
 	HeaderServer       = []byte("server")
 	HeaderSession      = []byte("session")
 	HeaderSubscription = []byte("subscription")
+	HeaderTimestamp    = []byte("timestamp")
+	HeaderToken        = []byte("token")
+	HeaderUpdate       = []byte("update")
 	HeaderVersion      = []byte("version")
 )
 
@@ -51,6 +91,17 @@ var (
 	RetainLast   = []byte("last")
 	RetainAll    = []byte("all")
 	RetainRemove = []byte("remove")
+
+	AckClientIndividual = []byte("client-individual")
+
+	RedeliveredTrue = []byte("true")
+	ResumedTrue     = []byte("true")
+
+	AckLevelLeader   = []byte("leader")
+	AckLevelMajority = []byte("majority")
+	AckLevelFsync    = []byte("fsync")
+
+	AdvisoryShutdown = []byte("shutdown-imminent")
 )
 
 var headerLookup = map[string]struct{}{
@@ -0,0 +1,85 @@
+package stomp
+
+// Consumer iterates over the messages of a subscription. Successive
+// calls to Next step through the messages, in the style of bufio.Scanner:
+//
+//	consumer, err := client.Consume("/queue/orders")
+//	if err != nil {
+//		return err
+//	}
+//	defer consumer.Close()
+//	for consumer.Next() {
+//		m := consumer.Message()
+//		...
+//		m.Release()
+//	}
+//	return consumer.Err()
+type Consumer struct {
+	client *Client
+	sub    *Subscription
+	msg    *Message
+	err    error
+}
+
+// Consume subscribes to the given destination and returns a Consumer
+// iterating over the messages received.
+func (c *Client) Consume(dest string, opts ...MessageOption) (*Consumer, error) {
+	sub, err := c.Subscribe(dest, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Consumer{client: c, sub: sub}, nil
+}
+
+// Next waits for the next message, which is then available through the
+// Message method. It returns false when the subscription ends or the
+// connection is closed, after which Err reports the reason.
+func (c *Consumer) Next() bool {
+	c.msg = nil
+	for c.err == nil {
+		peer := c.client.conn()
+		select {
+		case m, ok := <-c.sub.Messages():
+			if !ok {
+				// the channel is also closed when the connection ends.
+				select {
+				case <-Closed(peer):
+					c.err = closedErr(peer)
+				default:
+				}
+				return false
+			}
+			c.msg = m
+			return true
+		case <-Closed(peer):
+			// the connection was replaced after a redirect.
+			if c.client.conn() != peer {
+				continue
+			}
+			c.err = closedErr(peer)
+		}
+	}
+	return false
+}
+
+// Message returns the message received by the last call to Next. The
+// caller owns the message and must release it.
+func (c *Consumer) Message() *Message {
+	return c.msg
+}
+
+// Err returns the error that ended the iteration, or nil if the
+// subscription was closed.
+func (c *Consumer) Err() error {
+	return c.err
+}
+
+// Subscription returns the subscription of the consumer.
+func (c *Consumer) Subscription() *Subscription {
+	return c.sub
+}
+
+// Close unsubscribes, ending the iteration.
+func (c *Consumer) Close() error {
+	return c.sub.Unsubscribe()
+}
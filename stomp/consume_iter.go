@@ -0,0 +1,23 @@
+//go:build go1.23
+// +build go1.23
+
+package stomp
+
+import "iter"
+
+// All returns an iterator over the messages of the consumer, for use
+// with range. The iteration ends when the subscription ends, yielding
+// the error if the connection was closed. Breaking out of the loop does
+// not unsubscribe. The caller owns and releases each message.
+func (c *Consumer) All() iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		for c.Next() {
+			if !yield(c.msg, nil) {
+				return
+			}
+		}
+		if c.err != nil {
+			yield(nil, c.err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+//go:build go1.23
+// +build go1.23
+
+package stomp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConsumerAll(t *testing.T) {
+	a, b := Pipe()
+	subscribed := make(chan []byte, 1)
+	go func() {
+		for m := range b.Receive() {
+			switch {
+			case bytes.Equal(m.Method, MethodStomp):
+				reply := NewMessage()
+				reply.Method = MethodConnected
+				b.Send(reply)
+			case bytes.Equal(m.Method, MethodSubscribe):
+				subscribed <- append([]byte(nil), m.ID...)
+			}
+			m.Release()
+		}
+	}()
+
+	client := New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	consumer, err := client.Consume("/queue/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := <-subscribed
+	go func() {
+		m := NewMessage()
+		m.Method = MethodMessage
+		m.Subs = id
+		m.Body = []byte("hello")
+		b.Send(m)
+	}()
+
+	for m, err := range consumer.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Body) != "hello" {
+			t.Errorf("Want message yielded, got %q", m.Body)
+		}
+		m.Release()
+		break
+	}
+}
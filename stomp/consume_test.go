@@ -0,0 +1,84 @@
+package stomp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConsume(t *testing.T) {
+	a, b := Pipe()
+	subscribed := make(chan []byte, 1)
+	go func() {
+		for m := range b.Receive() {
+			switch {
+			case bytes.Equal(m.Method, MethodStomp):
+				reply := NewMessage()
+				reply.Method = MethodConnected
+				b.Send(reply)
+			case bytes.Equal(m.Method, MethodSubscribe):
+				subscribed <- append([]byte(nil), m.ID...)
+			}
+			m.Release()
+		}
+	}()
+
+	client := New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := client.Consume("/queue/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := <-subscribed
+
+	go func() {
+		for _, body := range []string{"one", "two"} {
+			m := NewMessage()
+			m.Method = MethodMessage
+			m.Dest = []byte("/queue/test")
+			m.Subs = id
+			m.Body = []byte(body)
+			b.Send(m)
+		}
+	}()
+
+	var got []string
+	for consumer.Next() {
+		m := consumer.Message()
+		got = append(got, string(m.Body))
+		m.Release()
+		if len(got) == 2 {
+			client.Disconnect()
+		}
+	}
+	if len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Errorf("Want messages consumed in order, got %q", got)
+	}
+	if consumer.Err() != ErrClosed {
+		t.Errorf("Want ErrClosed once the connection is closed, got %v", consumer.Err())
+	}
+}
+
+func TestConsumeClose(t *testing.T) {
+	a, b := Pipe()
+	go func() {
+		for m := range b.Receive() {
+			m.Release()
+		}
+	}()
+	client := New(a)
+	defer client.Disconnect()
+
+	consumer, err := client.Consume("/queue/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer.Close()
+	if consumer.Next() {
+		t.Errorf("Want iteration ended once closed")
+	}
+	if consumer.Err() != nil {
+		t.Errorf("Want no error once closed, got %s", consumer.Err())
+	}
+}
@@ -0,0 +1,175 @@
+package stomp
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/mrwill84/mq/logger"
+)
+
+// Common content types.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+var (
+	// ErrContentType is returned when no codec is registered for the
+	// message content type.
+	ErrContentType = errors.New("stomp: no codec for content type")
+
+	// ErrProtobuf is returned by the protobuf codec for values that are
+	// not protobuf messages.
+	ErrProtobuf = errors.New("stomp: value is not a protobuf message")
+)
+
+// MarshalFunc encodes a value as a message body.
+type MarshalFunc func(v interface{}) ([]byte, error)
+
+// UnmarshalFunc decodes a message body into the value.
+type UnmarshalFunc func(data []byte, v interface{}) error
+
+type contentCodec struct {
+	marshal   MarshalFunc
+	unmarshal UnmarshalFunc
+}
+
+var (
+	contentMu     sync.RWMutex
+	contentCodecs = map[string]contentCodec{
+		ContentTypeJSON:          {json.Marshal, json.Unmarshal},
+		ContentTypeProtobuf:      {marshalProto, unmarshalProto},
+		"application/x-protobuf": {marshalProto, unmarshalProto},
+	}
+)
+
+// RegisterContentCodec registers the functions used to encode and decode
+// message bodies of the content type, replacing any codec registered for
+// the content type. JSON and protobuf codecs are registered by default;
+// other formats, such as MsgPack, are registered by the application.
+//
+//	stomp.RegisterContentCodec("application/msgpack", msgpack.Marshal, msgpack.Unmarshal)
+func RegisterContentCodec(contentType string, marshal MarshalFunc, unmarshal UnmarshalFunc) {
+	contentMu.Lock()
+	contentCodecs[contentType] = contentCodec{marshal, unmarshal}
+	contentMu.Unlock()
+}
+
+// lookupContentCodec returns the codec for the content type.
+func lookupContentCodec(contentType string) (codec contentCodec, ok bool) {
+	contentMu.RLock()
+	codec, ok = contentCodecs[contentType]
+	contentMu.RUnlock()
+	return
+}
+
+// protobuf messages generated with marshalling methods, such as gogo
+// protobuf messages, implement these interfaces.
+type (
+	protoMarshaler interface {
+		Marshal() ([]byte, error)
+	}
+	protoUnmarshaler interface {
+		Unmarshal([]byte) error
+	}
+)
+
+func marshalProto(v interface{}) ([]byte, error) {
+	if pm, ok := v.(protoMarshaler); ok {
+		return pm.Marshal()
+	}
+	return nil, ErrProtobuf
+}
+
+func unmarshalProto(data []byte, v interface{}) error {
+	if pu, ok := v.(protoUnmarshaler); ok {
+		return pu.Unmarshal(data)
+	}
+	return ErrProtobuf
+}
+
+// WithContentType returns a MessageOption which sets the content type.
+func WithContentType(contentType string) MessageOption {
+	return func(m *Message) {
+		m.SetContentType(contentType)
+	}
+}
+
+// codecType returns the content type used to select the codec, JSON by
+// default.
+func (m *Message) codecType() string {
+	if ct := m.ContentType(); ct != "" {
+		return ct
+	}
+	return ContentTypeJSON
+}
+
+// SendObject encodes v using the codec for the content type set with
+// WithContentType, JSON by default, and sends it to the given
+// destination. If v implements Fielder the message includes a header
+// for each of its fields, as set by WithFields.
+func (c *Client) SendObject(dest string, v interface{}, opts ...MessageOption) error {
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte(dest)
+	m.Apply(opts...)
+	if m.ContentType() == "" {
+		m.SetContentType(ContentTypeJSON)
+	}
+	codec, ok := lookupContentCodec(m.codecType())
+	if !ok {
+		m.Release()
+		return ErrContentType
+	}
+	data, err := codec.marshal(v)
+	if err != nil {
+		m.Release()
+		return err
+	}
+	m.Body = data
+	if f, ok := v.(Fielder); ok {
+		WithFields(f.Fields()...)(m)
+	}
+	return c.send(m)
+}
+
+// Decode decodes the message body into v using the codec for the message
+// content type, JSON by default.
+func (m *Message) Decode(v interface{}) error {
+	codec, ok := lookupContentCodec(m.codecType())
+	if !ok {
+		return ErrContentType
+	}
+	return codec.unmarshal(m.Body, v)
+}
+
+// DecodeHandler returns a Handler that decodes each message body
+// according to its content type and calls fn, which must be a function
+// of the form func(*Message, *T). Messages that cannot be decoded are
+// logged and released.
+//
+//	client.Subscribe("/queue/orders", stomp.DecodeHandler(func(m *stomp.Message, order *Order) {
+//		defer m.Release()
+//	}))
+func DecodeHandler(fn interface{}) Handler {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 ||
+		ft.In(0) != reflect.TypeOf((*Message)(nil)) ||
+		ft.In(1).Kind() != reflect.Ptr {
+		panic("stomp: DecodeHandler requires a func(*Message, *T)")
+	}
+	elem := ft.In(1).Elem()
+
+	return HandlerFunc(func(m *Message) {
+		v := reflect.New(elem)
+		if err := m.Decode(v.Interface()); err != nil {
+			logger.Warningf("stomp client: decode %s message: %s", m.codecType(), err)
+			m.Release()
+			return
+		}
+		fv.Call([]reflect.Value{reflect.ValueOf(m), v})
+	})
+}
@@ -0,0 +1,74 @@
+package stomp
+
+import "testing"
+
+// greeting is a protobuf message with a single string field.
+type greeting struct {
+	text string
+}
+
+func (g *greeting) Marshal() ([]byte, error) {
+	return append([]byte{0x0a, byte(len(g.text))}, g.text...), nil
+}
+
+func (g *greeting) Unmarshal(data []byte) error {
+	g.text = string(data[2:])
+	return nil
+}
+
+func TestSendObject(t *testing.T) {
+	a, b := Pipe()
+	client := New(a)
+
+	if err := client.SendObject("/queue/orders", &order{Region: "eu"}); err != nil {
+		t.Fatal(err)
+	}
+	m := <-b.Receive()
+	if got := string(m.Header.Get(HeaderContentType)); got != ContentTypeJSON {
+		t.Errorf("Want JSON content type by default, got %s", got)
+	}
+	if got := string(m.Header.Get([]byte("region"))); got != "eu" {
+		t.Errorf("Want tagged fields sent as headers, got %s", got)
+	}
+
+	var handled *order
+	DecodeHandler(func(m *Message, o *order) {
+		handled = o
+	}).Handle(m)
+	if handled == nil || handled.Region != "eu" {
+		t.Errorf("Want message decoded by content type, got %v", handled)
+	}
+
+	err := client.SendObject("/queue/greetings", &greeting{text: "hi"}, WithContentType(ContentTypeProtobuf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = <-b.Receive()
+	if got := string(m.Body); got != "\x0a\x02hi" {
+		t.Errorf("Want protobuf encoded body, got %q", got)
+	}
+	var g greeting
+	if err := m.Decode(&g); err != nil || g.text != "hi" {
+		t.Errorf("Want protobuf body decoded, got %q %v", g.text, err)
+	}
+	if err := m.Decode(&order{}); err != ErrProtobuf {
+		t.Errorf("Want error decoding protobuf into a non protobuf value, got %v", err)
+	}
+
+	err = client.SendObject("/queue/orders", &order{}, WithContentType("application/msgpack"))
+	if err != ErrContentType {
+		t.Errorf("Want error for unregistered content type, got %v", err)
+	}
+
+	RegisterContentCodec("text/plain",
+		func(v interface{}) ([]byte, error) { return []byte(*v.(*string)), nil },
+		func(data []byte, v interface{}) error { *v.(*string) = string(data); return nil },
+	)
+	text := "hello"
+	if err := client.SendObject("/queue/text", &text, WithContentType("text/plain")); err != nil {
+		t.Fatal(err)
+	}
+	if m = <-b.Receive(); string(m.Body) != "hello" {
+		t.Errorf("Want body encoded by registered codec, got %q", m.Body)
+	}
+}
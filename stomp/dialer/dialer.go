@@ -1,8 +1,11 @@
 package dialer
 
 import (
+	"crypto/tls"
 	"net"
+	"net/http"
 	"net/url"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
@@ -13,26 +16,80 @@ const (
 	protoWS    = "ws"
 	protoWSS   = "wss"
 	protoTCP   = "tcp"
+	protoSTOMP = "stomp"
 )
 
-// Dial creates a client connection to the given target.
+// Config configures a client connection.
+type Config struct {
+	// Header is included in the websocket handshake and is ignored for
+	// other protocols.
+	Header http.Header
+
+	// Proxy returns the proxy for the target, or nil if the connection
+	// is direct. Connections are direct if the function is nil.
+	Proxy func(target *url.URL) (*url.URL, error)
+
+	// Timeout is the maximum time each host is dialed, including the
+	// proxy and websocket handshakes. There is no timeout if zero.
+	Timeout time.Duration
+}
+
+// Dial creates a client connection to the given target, through the
+// proxy configured in the environment.
 func Dial(target string) (net.Conn, error) {
+	return DialHeader(target, nil)
+}
+
+// DialHeader creates a client connection to the given target, through
+// the proxy configured in the environment. The header is included in
+// the websocket handshake and is ignored for other protocols.
+func DialHeader(target string, header http.Header) (net.Conn, error) {
+	return DialConfig(target, Config{
+		Header: header,
+		Proxy:  ProxyFromEnvironment,
+	})
+}
+
+// DialConfig creates a client connection to the given target. If the
+// target resolves to several hosts, they are dialed in turn until a
+// connection is established.
+func DialConfig(target string, config Config) (net.Conn, error) {
+	targets, err := Resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	return dialTargets(targets, config)
+}
+
+// dialTarget creates a client connection to a single host target.
+func dialTarget(target string, config Config) (net.Conn, error) {
 	u, err := url.Parse(target)
 	if err != nil {
 		return nil, err
 	}
+	var proxy *url.URL
+	if config.Proxy != nil {
+		if proxy, err = config.Proxy(u); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &net.Dialer{Timeout: config.Timeout}
+	if config.Timeout != 0 {
+		d.Deadline = time.Now().Add(config.Timeout)
+	}
 
 	switch u.Scheme {
 	case protoHTTP, protoHTTPS, protoWS, protoWSS:
-		return dialWebsocket(u)
-	case protoTCP:
-		return dialSocket(u)
+		return dialWebsocket(d, u, config.Header, proxy)
+	case protoTCP, protoSTOMP:
+		return dialSocket(d, u, proxy)
 	default:
 		panic("stomp: invalid protocol")
 	}
 }
 
-func dialWebsocket(target *url.URL) (net.Conn, error) {
+func dialWebsocket(d *net.Dialer, target *url.URL, header http.Header, proxy *url.URL) (net.Conn, error) {
 	origin, err := target.Parse("/")
 	if err != nil {
 		return nil, err
@@ -43,9 +100,45 @@ func dialWebsocket(target *url.URL) (net.Conn, error) {
 	case protoWSS:
 		origin.Scheme = protoHTTPS
 	}
-	return websocket.Dial(target.String(), "", origin.String())
+	config, err := websocket.NewConfig(target.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		config.Header[key] = values
+	}
+	config.Dialer = d
+	if proxy == nil {
+		return websocket.DialConfig(config)
+	}
+
+	secure := target.Scheme == protoWSS || target.Scheme == protoHTTPS
+	port := "80"
+	if secure {
+		port = "443"
+	}
+	conn, err := dialProxy(d, proxy, hostPort(target, port))
+	if err != nil {
+		return nil, err
+	}
+	if !d.Deadline.IsZero() {
+		conn.SetDeadline(d.Deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if secure {
+		conn = tls.Client(conn, &tls.Config{ServerName: hostname(target)})
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
 }
 
-func dialSocket(target *url.URL) (net.Conn, error) {
-	return net.Dial(protoTCP, target.Host)
+func dialSocket(d *net.Dialer, target *url.URL, proxy *url.URL) (net.Conn, error) {
+	if proxy != nil {
+		return dialProxy(d, proxy, target.Host)
+	}
+	return d.Dial(protoTCP, target.Host)
 }
@@ -0,0 +1,308 @@
+package dialer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrProxyScheme is returned when dialing through a proxy which is not a
+// socks5, socks5h, http or https url.
+var ErrProxyScheme = errors.New("stomp: unsupported proxy scheme")
+
+// ProxyURL returns a Config.Proxy function which always returns the
+// proxy url.
+func ProxyURL(proxy *url.URL) func(*url.URL) (*url.URL, error) {
+	return func(*url.URL) (*url.URL, error) {
+		return proxy, nil
+	}
+}
+
+// ProxyFromEnvironment returns the proxy for the target from the
+// HTTPS_PROXY environment variable for secure websocket targets, the
+// HTTP_PROXY variable for other websocket targets, and the ALL_PROXY
+// variable for tcp targets or when the former are unset. Targets
+// matching NO_PROXY, and loopback targets, are not proxied.
+func ProxyFromEnvironment(target *url.URL) (*url.URL, error) {
+	var proxy string
+	switch target.Scheme {
+	case protoHTTPS, protoWSS:
+		proxy = getenv("HTTPS_PROXY")
+	case protoHTTP, protoWS:
+		proxy = getenv("HTTP_PROXY")
+	}
+	if proxy == "" {
+		proxy = getenv("ALL_PROXY")
+	}
+	if proxy == "" || !useProxy(hostname(target)) {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		// proxies are commonly given as host:port.
+		if u, err := url.Parse("http://" + proxy); err == nil {
+			return u, nil
+		}
+		return nil, fmt.Errorf("stomp: invalid proxy %q", proxy)
+	}
+	return u, nil
+}
+
+// getenv returns the environment variable, in upper or lower case.
+func getenv(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(key))
+}
+
+// useProxy reports whether connections to the host are proxied.
+func useProxy(host string) bool {
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return false
+	}
+	for _, p := range strings.Split(getenv("NO_PROXY"), ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if h, _, err := net.SplitHostPort(p); err == nil {
+			p = h
+		}
+		switch {
+		case p == "":
+		case p == "*":
+			return false
+		case p[0] == '.' && strings.HasSuffix(host, p):
+			return false
+		case host == p || strings.HasSuffix(host, "."+p):
+			return false
+		}
+	}
+	return true
+}
+
+// dialProxy connects to the address through the proxy. The proxy
+// handshake must complete before the dialer deadline.
+func dialProxy(d *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		conn, err := d.Dial(protoTCP, hostPort(proxy, "1080"))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(d.Deadline)
+		if err := socksConnect(conn, proxy, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	case protoHTTP, protoHTTPS:
+		port := "80"
+		if proxy.Scheme == protoHTTPS {
+			port = "443"
+		}
+		conn, err := d.Dial(protoTCP, hostPort(proxy, port))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(d.Deadline)
+		defer conn.SetDeadline(time.Time{})
+		if proxy.Scheme == protoHTTPS {
+			conn = tls.Client(conn, &tls.Config{ServerName: hostname(proxy)})
+		}
+		tunnel, err := httpConnect(conn, proxy, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tunnel, nil
+	}
+	return nil, ErrProxyScheme
+}
+
+// httpConnect opens a tunnel to the address with an HTTP CONNECT request.
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := proxy.User.Username() + ":" + pass
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("stomp: proxy connect: %s", res.Status)
+	}
+	if br.Buffered() != 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection with data read ahead from the proxy.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// socks5 reply messages by code.
+var socksReplies = []string{
+	1: "general failure",
+	2: "connection not allowed",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "ttl expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksConnect connects to the address through a socks5 proxy. The
+// socks5 scheme resolves the address locally, while socks5h leaves
+// name resolution to the proxy.
+func socksConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("stomp: invalid port %q", portStr)
+	}
+	if proxy.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ip, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return err
+		}
+		host = ip.String()
+	}
+
+	// negotiate the authentication method.
+	methods := []byte{5, 1, 0}
+	if proxy.User != nil {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	var b [4]byte
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	switch {
+	case b[0] != 5:
+		return errors.New("stomp: proxy is not socks5")
+	case b[1] == 2 && proxy.User != nil:
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("stomp: socks5 credentials too long")
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return errors.New("stomp: socks5 authentication failed")
+		}
+	case b[1] != 0:
+		return errors.New("stomp: no acceptable socks5 authentication method")
+	}
+
+	// request the connection.
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("stomp: socks5 host name too long")
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		reply := "unknown error"
+		if int(b[1]) < len(socksReplies) {
+			reply = socksReplies[b[1]]
+		}
+		return fmt.Errorf("stomp: socks5 connect: %s", reply)
+	}
+
+	// discard the bound address.
+	var n int
+	switch b[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case 3:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return errors.New("stomp: invalid socks5 reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// hostPort returns the host and port of the url, with the default port
+// if the url has none.
+func hostPort(u *url.URL, port string) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	return net.JoinHostPort(strings.Trim(u.Host, "[]"), port)
+}
+
+// hostname returns the host of the url without the port.
+func hostname(u *url.URL) string {
+	if host, _, err := net.SplitHostPort(u.Host); err == nil {
+		return host
+	}
+	return strings.Trim(u.Host, "[]")
+}
@@ -0,0 +1,196 @@
+package dialer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestDialProxy(t *testing.T) {
+	echo := serve(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	defer echo.Close()
+
+	ws := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	defer ws.Close()
+
+	socks := serve(t, socksProxy(t))
+	defer socks.Close()
+	connect := serve(t, connectProxy)
+	defer connect.Close()
+
+	tests := []struct {
+		target, proxy string
+	}{
+		{"tcp://" + echo.Addr().String(), "socks5h://" + socks.Addr().String()},
+		{"tcp://" + echo.Addr().String(), "socks5://user:pass@" + socks.Addr().String()},
+		{"tcp://" + echo.Addr().String(), "http://" + connect.Addr().String()},
+		{"ws" + ws.URL[4:], "http://" + connect.Addr().String()},
+		{"ws" + ws.URL[4:], "socks5://" + socks.Addr().String()},
+	}
+	for _, test := range tests {
+		proxy, _ := url.Parse(test.proxy)
+		conn, err := DialConfig(test.target, Config{Proxy: ProxyURL(proxy)})
+		if err != nil {
+			t.Errorf("Want %s dialed through %s, got %s", test.target, test.proxy, err)
+			continue
+		}
+		conn.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Errorf("Want echo through %s, got %q, %v", test.proxy, b, err)
+		}
+		conn.Close()
+	}
+
+	proxy, _ := url.Parse("socks5://user:wrong@" + socks.Addr().String())
+	if _, err := DialConfig("tcp://"+echo.Addr().String(), Config{Proxy: ProxyURL(proxy)}); err == nil {
+		t.Errorf("Want error for rejected socks5 credentials")
+	}
+	proxy, _ = url.Parse("ftp://" + connect.Addr().String())
+	if _, err := DialConfig("tcp://"+echo.Addr().String(), Config{Proxy: ProxyURL(proxy)}); err != ErrProxyScheme {
+		t.Errorf("Want ErrProxyScheme, got %v", err)
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, key := range []string{"ALL_PROXY", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Unsetenv(key)
+		os.Unsetenv(strings.ToLower(key))
+	}
+	os.Setenv("ALL_PROXY", "socks5://socks:1080")
+	os.Setenv("HTTPS_PROXY", "proxy:3128")
+	os.Setenv("NO_PROXY", "internal.example, .corp:80")
+
+	tests := []struct {
+		target, proxy string
+	}{
+		{"tcp://broker.example:9000", "socks5://socks:1080"},
+		{"ws://broker.example/ws", "socks5://socks:1080"},
+		{"wss://broker.example/ws", "http://proxy:3128"},
+		{"tcp://localhost:9000", ""},
+		{"tcp://127.0.0.1:9000", ""},
+		{"tcp://internal.example:9000", ""},
+		{"tcp://mq.internal.example:9000", ""},
+		{"tcp://mq.corp:9000", ""},
+		{"tcp://corp:9000", "socks5://socks:1080"},
+	}
+	for _, test := range tests {
+		target, _ := url.Parse(test.target)
+		proxy, err := ProxyFromEnvironment(target)
+		if err != nil {
+			t.Errorf("Want proxy for %s, got error %s", test.target, err)
+			continue
+		}
+		var got string
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != test.proxy {
+			t.Errorf("Want proxy %q for %s, got %q", test.proxy, test.target, got)
+		}
+	}
+}
+
+// serve accepts connections with the handler until the listener is
+// closed.
+func serve(t *testing.T, handler func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// tunnel copies data between the client and the address.
+func tunnel(client net.Conn, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go io.Copy(conn, client)
+	io.Copy(client, conn)
+}
+
+// connectProxy is an HTTP CONNECT proxy.
+func connectProxy(conn net.Conn) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	tunnel(conn, req.Host)
+}
+
+// socksProxy returns a socks5 proxy accepting user:pass credentials.
+func socksProxy(t *testing.T) func(net.Conn) {
+	return func(conn net.Conn) {
+		b := make([]byte, 262)
+		io.ReadFull(conn, b[:2])
+		methods := b[:b[1]]
+		io.ReadFull(conn, methods)
+		if methods[len(methods)-1] == 2 {
+			conn.Write([]byte{5, 2})
+			io.ReadFull(conn, b[:2])
+			user := make([]byte, b[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, b[:1])
+			pass := make([]byte, b[0])
+			io.ReadFull(conn, pass)
+			if string(user) != "user" || string(pass) != "pass" {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		} else {
+			conn.Write([]byte{5, 0})
+		}
+
+		io.ReadFull(conn, b[:4])
+		var host string
+		switch b[3] {
+		case 1:
+			io.ReadFull(conn, b[:4])
+			host = net.IP(b[:4]).String()
+		case 3:
+			io.ReadFull(conn, b[:1])
+			name := make([]byte, b[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			t.Errorf("Want ipv4 or domain address, got type %d", b[3])
+			return
+		}
+		io.ReadFull(conn, b[:2])
+		port := binary.BigEndian.Uint16(b)
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		tunnel(conn, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+}
@@ -0,0 +1,79 @@
+package dialer
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const protoSRV = "stomp+srv"
+
+// ErrNoHosts is returned when a target resolves to no hosts.
+var ErrNoHosts = errors.New("stomp: no hosts to dial")
+
+// lookupSRV is replaced in tests.
+var lookupSRV = net.LookupSRV
+
+// Resolve returns the single host targets of the target, in the order
+// they should be dialed. A target with a comma-separated list of hosts,
+// such as tcp://a:9000,b:9000, resolves to a target for each host. A
+// stomp+srv target, such as stomp+srv://_stomp._tcp.example.com,
+// resolves to a tcp target for each SRV record of the name, ordered by
+// priority and randomized by weight.
+func Resolve(target string) ([]string, error) {
+	i := strings.Index(target, "://")
+	if i < 0 {
+		return []string{target}, nil
+	}
+	scheme, rest := target[:i], target[i+3:]
+	hosts, path := rest, ""
+	if j := strings.IndexAny(rest, "/?#"); j >= 0 {
+		hosts, path = rest[:j], rest[j:]
+	}
+
+	if scheme == protoSRV {
+		_, records, err := lookupSRV("", "", hosts)
+		if err != nil {
+			return nil, err
+		}
+		var targets []string
+		for _, r := range records {
+			// a target of "." means the service is unavailable.
+			host := strings.TrimSuffix(r.Target, ".")
+			if host == "" {
+				continue
+			}
+			addr := net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+			targets = append(targets, protoTCP+"://"+addr+path)
+		}
+		if len(targets) == 0 {
+			return nil, ErrNoHosts
+		}
+		return targets, nil
+	}
+
+	var targets []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			targets = append(targets, scheme+"://"+host+path)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, ErrNoHosts
+	}
+	return targets, nil
+}
+
+// dialTargets dials the targets in order and returns the first
+// connection established, or the last error.
+func dialTargets(targets []string, config Config) (net.Conn, error) {
+	err := ErrNoHosts
+	for _, target := range targets {
+		var conn net.Conn
+		if conn, err = dialTarget(target, config); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,72 @@
+package dialer
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	defer func(f func(string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = f
+	}(lookupSRV)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_stomp._tcp.example.com" {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name}
+		}
+		return name, []*net.SRV{
+			{Target: "a.example.com.", Port: 9000, Priority: 1},
+			{Target: ".", Port: 0, Priority: 2},
+			{Target: "b.example.com.", Port: 9001, Priority: 3},
+		}, nil
+	}
+
+	tests := []struct {
+		target string
+		want   []string
+		err    bool
+	}{
+		{target: "tcp://a:9000", want: []string{"tcp://a:9000"}},
+		{target: "tcp://a:9000,b:9000", want: []string{"tcp://a:9000", "tcp://b:9000"}},
+		{target: "ws://a, b/ws?x=1", want: []string{"ws://a/ws?x=1", "ws://b/ws?x=1"}},
+		{target: "stomp+srv://_stomp._tcp.example.com", want: []string{"tcp://a.example.com:9000", "tcp://b.example.com:9001"}},
+		{target: "stomp+srv://_stomp._tcp.example.org", err: true},
+		{target: "tcp://,", err: true},
+	}
+	for _, test := range tests {
+		got, err := Resolve(test.target)
+		if test.err {
+			if err == nil {
+				t.Errorf("Want error resolving %s, got %v", test.target, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Want %s resolved to %v, got %v, %v", test.target, test.want, got, err)
+		}
+	}
+}
+
+func TestDialFailover(t *testing.T) {
+	live := serve(t, func(conn net.Conn) {
+		io.WriteString(conn, "live")
+	})
+	defer live.Close()
+	dead := serve(t, func(net.Conn) {})
+	dead.Close()
+
+	conn, err := DialConfig("tcp://"+dead.Addr().String()+","+live.Addr().String(), Config{})
+	if err != nil {
+		t.Fatalf("Want failover to live host, got %s", err)
+	}
+	defer conn.Close()
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "live" {
+		t.Errorf("Want connection to live host, got %q, %v", b, err)
+	}
+
+	if _, err := DialConfig("tcp://"+dead.Addr().String(), Config{}); err == nil {
+		t.Errorf("Want error dialing dead host")
+	}
+}
@@ -0,0 +1,94 @@
+package stomp
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// dispatcher is a Handler that dispatches messages to a bounded pool of
+// workers, so that a slow handler does not stall other subscriptions.
+type dispatcher struct {
+	handler Handler
+	key     []byte
+	queues  []chan *Message
+	done    chan struct{}
+	once    sync.Once
+
+	sending sync.RWMutex // held for reading by Handle calls in progress
+}
+
+// newDispatcher returns a dispatcher that handles messages using n
+// workers. If key is non-empty messages with the same key header value
+// are handled by the same worker, in the order they were received.
+func newDispatcher(handler Handler, n int, key []byte) *dispatcher {
+	d := &dispatcher{
+		handler: handler,
+		key:     key,
+		done:    make(chan struct{}),
+	}
+	if len(key) == 0 {
+		// unordered workers share a single queue.
+		queue := make(chan *Message, n)
+		for i := 0; i < n; i++ {
+			d.start(queue)
+		}
+		d.queues = append(d.queues, queue)
+		return d
+	}
+	for i := 0; i < n; i++ {
+		queue := make(chan *Message, 1)
+		d.start(queue)
+		d.queues = append(d.queues, queue)
+	}
+	return d
+}
+
+func (d *dispatcher) start(queue <-chan *Message) {
+	go func() {
+		for m := range queue {
+			d.handler.Handle(m)
+		}
+	}()
+}
+
+// Handle queues the message for a worker, blocking if all workers
+// are busy. Messages handled once the dispatcher is stopped are
+// released.
+func (d *dispatcher) Handle(m *Message) {
+	d.sending.RLock()
+	defer d.sending.RUnlock()
+	select {
+	case <-d.done:
+		m.Release()
+		return
+	default:
+	}
+
+	queue := d.queues[0]
+	if len(d.queues) != 1 {
+		h := fnv.New32a()
+		h.Write(m.Header.Get(d.key))
+		queue = d.queues[h.Sum32()%uint32(len(d.queues))]
+	}
+	select {
+	case queue <- m:
+	case <-d.done:
+		m.Release()
+	}
+}
+
+// stop stops the workers once the queued messages are handled, and
+// stops the next handler so that workers blocked delivering to a
+// channel subscription are released. It does not wait for the workers,
+// so that a handler may end its own subscription.
+func (d *dispatcher) stop() {
+	d.once.Do(func() {
+		close(d.done)
+		d.sending.Lock()
+		for _, queue := range d.queues {
+			close(queue)
+		}
+		d.sending.Unlock()
+		stopHandler(d.handler)
+	})
+}
@@ -0,0 +1,96 @@
+package stomp
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcher(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(10)
+
+	d := newDispatcher(HandlerFunc(func(m *Message) {
+		wg.Done()
+	}), 4, nil)
+
+	for i := 0; i < 10; i++ {
+		d.Handle(NewMessage())
+	}
+	wg.Wait()
+	d.stop()
+}
+
+func TestDispatcherOrdered(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		got = map[string][]int{}
+	)
+	wg.Add(100)
+
+	d := newDispatcher(HandlerFunc(func(m *Message) {
+		mu.Lock()
+		key := m.Header.GetString("group")
+		got[key] = append(got[key], m.Header.GetInt("seq"))
+		mu.Unlock()
+		wg.Done()
+	}), 4, []byte("group"))
+
+	for i := 0; i < 100; i++ {
+		m := NewMessage()
+		m.Header.Add([]byte("group"), []byte(strconv.Itoa(i%3)))
+		m.Header.Add([]byte("seq"), []byte(strconv.Itoa(i)))
+		d.Handle(m)
+	}
+	wg.Wait()
+	d.stop()
+
+	for key, seqs := range got {
+		for i := 1; i < len(seqs); i++ {
+			if seqs[i] < seqs[i-1] {
+				t.Errorf("Want messages in group %s handled in order, got %v", key, seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestDispatcherStopped(t *testing.T) {
+	d := newDispatcher(HandlerFunc(func(m *Message) {}), 2, nil)
+	d.stop()
+	d.stop()
+	// handling a message once stopped must not panic.
+	d.Handle(NewMessage())
+}
+
+func TestDispatcherStopFromHandler(t *testing.T) {
+	stopped := make(chan struct{})
+	var d *dispatcher
+	d = newDispatcher(HandlerFunc(func(m *Message) {
+		d.stop()
+		close(stopped)
+	}), 2, nil)
+	d.Handle(NewMessage())
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Want a handler able to stop its own dispatcher")
+	}
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	m := NewMessage()
+	m.Apply(WithConcurrency(4), WithOrdered("group"))
+	if m.sub != nil || m.Header.Len() != 0 {
+		t.Errorf("Want subscription options to leave other messages unchanged")
+	}
+
+	s := &Subscription{}
+	m.sub = s
+	m.Apply(WithConcurrency(4), WithOrdered("group"))
+	if s.workers != 4 || string(s.orderKey) != "group" {
+		t.Errorf("Want settings held by the subscription, got %d %q", s.workers, s.orderKey)
+	}
+}
@@ -0,0 +1,60 @@
+package stomp
+
+import "github.com/mrwill84/mq/logger"
+
+// Epoch returns the server epoch reported when the connection was
+// established. The epoch advances when the server fails over or
+// restarts.
+func (c *Client) Epoch() int64 {
+	return c.epoch
+}
+
+// StaleFunc is invoked with messages accepted by the server in an epoch
+// earlier than the epoch of the connection. The message is passed to the
+// subscription handler if the function returns true.
+type StaleFunc func(m *Message) bool
+
+// WithEpochFence returns a MessageOption which configures a subscription
+// to detect messages from stale epochs. A message from a stale epoch was
+// accepted before a failover and may be a replay of a message the
+// consumer already processed. If fn is nil messages from stale epochs
+// are ignored. Ignored messages are negatively acknowledged without
+// requeue, so that the server dead-letters them instead of redelivering
+// them.
+func WithEpochFence(fn StaleFunc) MessageOption {
+	return subscriptionOption(func(s *Subscription) {
+		s.fence = true
+		s.staleFunc = fn
+	})
+}
+
+// epochFence is a Handler that filters messages from stale epochs before
+// invoking the next handler.
+type epochFence struct {
+	handler Handler
+	stale   StaleFunc
+}
+
+func (f *epochFence) Handle(m *Message) {
+	f.handler.Handle(m)
+}
+
+// handle invokes the next handler unless the message is from an epoch
+// earlier than the connection epoch and is rejected by the stale func.
+func (f *epochFence) handle(m *Message, c *Client) {
+	e := ParseInt64(m.Header.Get(HeaderEpoch))
+	if e != 0 && e < c.epoch && (f.stale == nil || !f.stale(m)) {
+		if len(m.Ack) != 0 {
+			if err := c.Nack(m.Ack, WithRequeue(false)); err != nil {
+				logger.Warningf("stomp client: nack stale message: %s", err)
+			}
+		}
+		return
+	}
+	f.handler.Handle(m)
+}
+
+// stop stops the next handler.
+func (f *epochFence) stop() {
+	stopHandler(f.handler)
+}
@@ -0,0 +1,36 @@
+package stomp
+
+import "errors"
+
+// ErrNotConnected is returned when a client sends a frame before the
+// session is established.
+var ErrNotConnected = errors.New("stomp: not connected")
+
+// BadFrameError is returned when a malformed frame is read, or a frame
+// is received that the protocol does not allow at that point.
+type BadFrameError struct {
+	Reason string
+}
+
+func (e *BadFrameError) Error() string {
+	return "stomp: " + e.Reason
+}
+
+// BrokerError is an ERROR frame sent by the broker, such as the rejection
+// of a message sent with a receipt.
+type BrokerError struct {
+	Message string // message header, a short description of the error
+	Body    []byte // details of the error, if any
+}
+
+func (e *BrokerError) Error() string {
+	return "stomp: server error: " + e.Message
+}
+
+// brokerError returns the error reported by the ERROR frame.
+func brokerError(m *Message) *BrokerError {
+	return &BrokerError{
+		Message: string(m.Header.Get(HeaderMessage)),
+		Body:    append([]byte(nil), m.Body...),
+	}
+}
@@ -0,0 +1,70 @@
+package stomp
+
+import "testing"
+
+func TestBrokerError(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	go func() {
+		m := <-b.Receive()
+		m.Release()
+		e := NewMessage()
+		e.Method = MethodError
+		e.Header.Add(HeaderMessage, []byte("access denied"))
+		e.Body = []byte("bad credentials")
+		b.Send(e)
+	}()
+
+	err := New(a).Connect()
+	e, ok := err.(*BrokerError)
+	if !ok {
+		t.Fatalf("Want *BrokerError, got %v", err)
+	}
+	if e.Message != "access denied" || string(e.Body) != "bad credentials" {
+		t.Errorf("Want broker error details, got %q %q", e.Message, e.Body)
+	}
+}
+
+func TestBadFrameError(t *testing.T) {
+	err := NewMessage().Parse([]byte("stomp\n\n"))
+	if _, ok := err.(*BadFrameError); !ok {
+		t.Errorf("Want *BadFrameError, got %v", err)
+	}
+	if err != ErrInvalidMethod {
+		t.Errorf("Want ErrInvalidMethod, got %v", err)
+	}
+
+	a, b := Pipe()
+	defer a.Close()
+	go func() {
+		m := <-b.Receive()
+		m.Release()
+		r := NewMessage()
+		r.Method = MethodRecipet
+		b.Send(r)
+	}()
+	if err := New(a).Connect(); err == nil {
+		t.Errorf("Want error connecting without CONNECTED")
+	} else if _, ok := err.(*BadFrameError); !ok {
+		t.Errorf("Want *BadFrameError, got %v", err)
+	}
+}
+
+func TestConnectionErrors(t *testing.T) {
+	if err := New(nil).Send("/queue/test", nil); err != ErrNotConnected {
+		t.Errorf("Want ErrNotConnected, got %v", err)
+	}
+	if err := New(nil).Connect(); err != ErrNotConnected {
+		t.Errorf("Want ErrNotConnected connecting, got %v", err)
+	}
+
+	a, b := Pipe()
+	go func() {
+		m := <-b.Receive()
+		m.Release()
+		b.Close()
+	}()
+	if err := New(a).Connect(); err != ErrClosed {
+		t.Errorf("Want ErrClosed when the broker closes, got %v", err)
+	}
+}
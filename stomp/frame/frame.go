@@ -0,0 +1,263 @@
+// Package frame implements the STOMP text frame format: parsing and
+// writing frames and escaping header names and values. The package has
+// no dependency on the client or broker, so proxies, sniffers and test
+// tools can reuse the wire implementation.
+//
+// Frames are terminated by a NUL byte and the body extends to the
+// terminator; the content-length header is not used to delimit the
+// body. Header names and values are escaped as defined by STOMP 1.1 and
+// later, except in CONNECT, STOMP and CONNECTED frames.
+package frame
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	// ErrCommand is returned when a frame has no command line, or the
+	// command is not upper case ASCII letters.
+	ErrCommand = errors.New("frame: invalid command")
+
+	// ErrEOF is returned when a frame ends before the blank line that
+	// separates the headers from the body.
+	ErrEOF = errors.New("frame: unexpected eof")
+
+	// ErrHeader is returned when a header line has no colon or name, or
+	// contains a carriage return or an undefined escape sequence.
+	ErrHeader = errors.New("frame: invalid header")
+)
+
+// Header is a frame header.
+type Header struct {
+	Name  []byte
+	Value []byte
+}
+
+// Frame is a STOMP frame.
+type Frame struct {
+	Command []byte
+	Headers []Header
+	Body    []byte
+}
+
+// Get returns the value of the first header with the name, or nil.
+func (f *Frame) Get(name string) []byte {
+	for _, h := range f.Headers {
+		if string(h.Name) == name {
+			return h.Value
+		}
+	}
+	return nil
+}
+
+// Add appends the header to the frame.
+func (f *Frame) Add(name, value string) {
+	f.Headers = append(f.Headers, Header{[]byte(name), []byte(value)})
+}
+
+// IsHeartbeat returns true if the frame is a heart-beat.
+func (f *Frame) IsHeartbeat() bool {
+	return len(f.Command) == 0
+}
+
+// Parse parses the raw frame, without the NUL terminator, unescaping
+// header names and values if esc is true. The frame references the
+// data, which must not be modified while the frame is in use.
+func Parse(data []byte, esc bool) (*Frame, error) {
+	f := new(Frame)
+	command, body, err := Split(data, esc, func(name, value []byte) {
+		f.Headers = append(f.Headers, Header{name, value})
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.Command = command
+	f.Body = body
+	return f, nil
+}
+
+// Split parses the raw frame, without the NUL terminator, calling fn
+// with each header in order, and returns the command and body. Header
+// names and values are unescaped in place if esc is true.
+func Split(data []byte, esc bool, fn func(name, value []byte)) (command, body []byte, err error) {
+	return SplitLimits(data, esc, Limits{}, fn)
+}
+
+// SplitLimits is like Split, but rejects frames exceeding the header
+// limits. The frame is parsed in a single pass without allocating; the
+// command, header names and values and body reference the data.
+//
+// End-of-line bytes preceding the command are skipped, and lines may end
+// with a carriage return. The command must consist of upper case ASCII
+// letters, every header line must contain a colon after a non-empty name
+// and no carriage return other than the line ending, and escaped headers
+// must only use the escape sequences defined by STOMP 1.2.
+func SplitLimits(data []byte, esc bool, limits Limits, fn func(name, value []byte)) (command, body []byte, err error) {
+	off := 0
+	for off < len(data) && (data[off] == '\n' || data[off] == '\r') {
+		off++
+	}
+
+	// parse the command
+	n := bytes.IndexByte(data[off:], '\n')
+	if n == -1 {
+		return nil, nil, ErrCommand
+	}
+	command = trimCR(data[off : off+n])
+	off += n + 1
+	if !validCommand(command) {
+		return nil, nil, ErrCommand
+	}
+	if IsConnect(command) {
+		esc = false
+	}
+
+	// parse the headers, which end with a blank line
+	for headers := 0; ; headers++ {
+		n = bytes.IndexByte(data[off:], '\n')
+		if n == -1 {
+			return nil, nil, ErrEOF
+		}
+		line := trimCR(data[off : off+n])
+		off += n + 1
+		if len(line) == 0 {
+			break
+		}
+		if limits.MaxHeaders > 0 && headers == limits.MaxHeaders {
+			return nil, nil, ErrTooManyHeaders
+		}
+		if limits.MaxHeaderSize > 0 && len(line) > limits.MaxHeaderSize {
+			return nil, nil, ErrHeaderTooLarge
+		}
+
+		i := bytes.IndexByte(line, ':')
+		if i < 1 || bytes.IndexByte(line, '\r') != -1 {
+			return nil, nil, ErrHeader
+		}
+		name, value := line[:i], line[i+1:]
+		if esc {
+			if !validEscapes(name) || !validEscapes(value) {
+				return nil, nil, ErrHeader
+			}
+			name = Unescape(name)
+			value = Unescape(value)
+		}
+		fn(name, value)
+	}
+
+	if off < len(data) {
+		body = data[off:]
+	}
+	return command, body, nil
+}
+
+// trimCR removes a trailing carriage return from the line.
+func trimCR(line []byte) []byte {
+	if n := len(line); n != 0 && line[n-1] == '\r' {
+		return line[:n-1]
+	}
+	return line
+}
+
+// validCommand returns true if the command is non-empty and consists of
+// upper case ASCII letters.
+func validCommand(command []byte) bool {
+	if len(command) == 0 {
+		return false
+	}
+	for _, c := range command {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// validEscapes returns true if every backslash in the escaped header
+// name or value begins a defined escape sequence.
+func validEscapes(b []byte) bool {
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\\' {
+			continue
+		}
+		i++
+		if i == len(b) {
+			return false
+		}
+		switch b[i] {
+		case 'n', 'r', 'c', '\\':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// IsConnect returns true if the command is CONNECT, STOMP or CONNECTED,
+// whose headers are exempt from escaping.
+func IsConnect(command []byte) bool {
+	return bytes.Equal(command, []byte("STOMP")) ||
+		bytes.Equal(command, []byte("CONNECT")) ||
+		bytes.Equal(command, []byte("CONNECTED"))
+}
+
+// AppendEscaped appends the header name or value to the buffer, escaping
+// colons, newlines, carriage returns and backslashes.
+func AppendEscaped(buf, b []byte) []byte {
+	for _, c := range b {
+		switch c {
+		case '\\':
+			buf = append(buf, '\\', '\\')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case ':':
+			buf = append(buf, '\\', 'c')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// NeedsEscape returns true if the header name or value contains
+// characters that must be escaped.
+func NeedsEscape(b []byte) bool {
+	for _, c := range b {
+		switch c {
+		case '\\', '\n', '\r', ':':
+			return true
+		}
+	}
+	return false
+}
+
+// Unescape decodes the escaped header name or value in place.
+func Unescape(b []byte) []byte {
+	i := bytes.IndexByte(b, '\\')
+	if i == -1 {
+		return b
+	}
+	n := i
+	for ; i < len(b); i++ {
+		c := b[i]
+		if c == '\\' && i+1 < len(b) {
+			i++
+			switch b[i] {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 'c':
+				c = ':'
+			default:
+				c = b[i]
+			}
+		}
+		b[n] = c
+		n++
+	}
+	return b[:n]
+}
@@ -0,0 +1,118 @@
+package frame
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	f, err := Parse([]byte("SEND\ndestination:/queue/a\\cb\nempty:\n\nhello"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Command) != "SEND" || string(f.Body) != "hello" {
+		t.Errorf("Want command and body parsed, got %q %q", f.Command, f.Body)
+	}
+	if got := string(f.Get("destination")); got != "/queue/a:b" {
+		t.Errorf("Want header value unescaped, got %q", got)
+	}
+	if got := f.Get("empty"); got == nil || len(got) != 0 {
+		t.Errorf("Want empty header value, got %q", got)
+	}
+
+	f, err = Parse([]byte("CONNECT\nlogin:a\\cb\n\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(f.Get("login")); got != "a\\cb" {
+		t.Errorf("Want connect headers not unescaped, got %q", got)
+	}
+
+	if _, err := Parse([]byte("SEND"), false); err != ErrCommand {
+		t.Errorf("Want invalid command error, got %v", err)
+	}
+	if _, err := Parse([]byte("SEND\ndestination:/queue/a"), false); err != ErrEOF {
+		t.Errorf("Want unexpected eof error, got %v", err)
+	}
+
+	f, err = Parse([]byte("\r\n\nSEND\r\ndestination:/queue/a\r\n\r\nhello"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Command) != "SEND" || string(f.Get("destination")) != "/queue/a" || string(f.Body) != "hello" {
+		t.Errorf("Want leading EOLs skipped and CRLF line endings, got %q %q %q", f.Command, f.Get("destination"), f.Body)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{"send\n\n", ErrCommand},
+		{"SE\xc3\xa9ND\n\n", ErrCommand},
+		{"SEND\ndestination\n\n", ErrHeader},
+		{"SEND\n:value\n\n", ErrHeader},
+		{"SEND\ndestination:a\rb\n\n", ErrHeader},
+		{"SEND\ndestination:/queue/a\\x\n\n", ErrHeader},
+		{"SEND\ndestination:/queue/a\\\n\n", ErrHeader},
+	}
+	for _, test := range tests {
+		if _, err := Parse([]byte(test.input), true); err != test.err {
+			t.Errorf("Want error %v parsing %q, got %v", test.err, test.input, err)
+		}
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Escape = true
+	f := &Frame{Command: []byte("MESSAGE"), Body: []byte("hello")}
+	f.Add("destination", "/topic/a:b")
+	w.WriteFrame(f)
+	w.WriteHeartbeat()
+	w.WriteFrame(f)
+	w.Flush()
+	buf.WriteString("\n")
+
+	r := NewReader(&buf)
+	r.Escape = true
+	for _, heartbeat := range []bool{false, true, false, true} {
+		got, err := r.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.IsHeartbeat() != heartbeat {
+			t.Fatalf("Want heart-beat %v, got %q", heartbeat, got.Command)
+		}
+		if !heartbeat && (string(got.Get("destination")) != "/topic/a:b" || string(got.Body) != "hello") {
+			t.Errorf("Want frame read back, got %q %q", got.Get("destination"), got.Body)
+		}
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("Want io.EOF, got %v", err)
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	tests := []struct {
+		limits Limits
+		input  string
+		err    error
+	}{
+		{Limits{MaxFrameSize: 8}, "SEND\n\nhello world\x00", ErrFrameTooLarge},
+		{Limits{MaxHeaders: 1}, "SEND\na:1\nb:2\n\n\x00", ErrTooManyHeaders},
+		{Limits{MaxHeaderSize: 4}, "SEND\nname:value\n\n\x00", ErrHeaderTooLarge},
+		{Limits{}, "SEND\n\nhello", io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		r := NewReader(strings.NewReader(test.input))
+		r.Limits = test.limits
+		if _, err := r.ReadFrame(); err != test.err {
+			t.Errorf("Want error %v reading %q, got %v", test.err, test.input, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package frame
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzParse checks that parsing arbitrary input never panics, and that a
+// parsed frame survives encoding and parsing again unchanged.
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"SEND\ndestination:/queue/a\\cb\n\nhello",
+		"CONNECT\nlogin:a\\cb\naccept-version:1.2\n\n",
+		"\r\nMESSAGE\r\nsubscription:1\r\nmessage-id:2\r\n\r\n",
+		"SEND\ndestination\n\n",
+		"SEND\ndestination:a\\x\n\n",
+	} {
+		f.Add([]byte(seed), true)
+		f.Add([]byte(seed), false)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, esc bool) {
+		frame, err := Parse(append([]byte(nil), data...), esc)
+		if err != nil {
+			return
+		}
+		encoded := Append(nil, frame, esc)
+		again, err := Parse(encoded[:len(encoded)-1], esc)
+		if err != nil {
+			t.Fatalf("Parse(Append(%q)) failed: %s", data, err)
+		}
+		if !bytes.Equal(frame.Command, again.Command) || !bytes.Equal(frame.Body, again.Body) || len(frame.Headers) != len(again.Headers) {
+			t.Fatalf("Want frame unchanged after round trip of %q, got %q", data, encoded)
+		}
+		for i, h := range frame.Headers {
+			if !bytes.Equal(h.Name, again.Headers[i].Name) || !bytes.Equal(h.Value, again.Headers[i].Value) {
+				t.Fatalf("Want header %q:%q after round trip, got %q:%q", h.Name, h.Value, again.Headers[i].Name, again.Headers[i].Value)
+			}
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package frame
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrFrameTooLarge is returned when a frame exceeds the maximum
+	// frame size.
+	ErrFrameTooLarge = errors.New("frame: frame too large")
+
+	// ErrTooManyHeaders is returned when a frame exceeds the maximum
+	// number of headers.
+	ErrTooManyHeaders = errors.New("frame: too many headers")
+
+	// ErrHeaderTooLarge is returned when a header exceeds the maximum
+	// header size.
+	ErrHeaderTooLarge = errors.New("frame: header too large")
+)
+
+// Limits bounds the frames accepted by a Reader. Zero values disable
+// the limit.
+type Limits struct {
+	MaxFrameSize  int // maximum size of a frame, including the body
+	MaxHeaders    int // maximum number of headers
+	MaxHeaderSize int // maximum size of a header line
+}
+
+// DefaultLimits are the limits of a Reader created with NewReader.
+var DefaultLimits = Limits{
+	MaxFrameSize:  64 << 20,
+	MaxHeaders:    1000,
+	MaxHeaderSize: 64 << 10,
+}
+
+// Reader reads frames from an input stream.
+type Reader struct {
+	// Escape enables unescaping of header names and values, which is
+	// used by STOMP 1.1 and later.
+	Escape bool
+
+	// Limits bounds the frames read.
+	Limits Limits
+
+	r *bufio.Reader
+}
+
+// NewReader returns a Reader reading from r with the default limits.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		Limits: DefaultLimits,
+		r:      bufio.NewReader(r),
+	}
+}
+
+// ReadFrame reads the next frame. Heart-beats, either end-of-line bytes
+// between frames or empty frames, are returned as a Frame without a
+// command.
+func (r *Reader) ReadFrame() (*Frame, error) {
+	c, err := r.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case '\n':
+		return new(Frame), nil
+	case '\r':
+		if next, err := r.r.ReadByte(); err != nil || next != '\n' {
+			return nil, ErrCommand
+		}
+		return new(Frame), nil
+	}
+	r.r.UnreadByte()
+
+	var data []byte
+	for {
+		line, err := r.r.ReadSlice(0)
+		data = append(data, line...)
+		if r.Limits.MaxFrameSize > 0 && len(data) > r.Limits.MaxFrameSize+1 {
+			return nil, ErrFrameTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(data) != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		break
+	}
+	data = data[:len(data)-1]
+	if len(data) == 0 {
+		return new(Frame), nil
+	}
+
+	f := new(Frame)
+	f.Command, f.Body, err = SplitLimits(data, r.Escape, r.Limits, func(name, value []byte) {
+		f.Headers = append(f.Headers, Header{name, value})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
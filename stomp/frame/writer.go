@@ -0,0 +1,69 @@
+package frame
+
+import (
+	"bufio"
+	"io"
+)
+
+// Writer writes frames to an output stream. Frames are buffered until
+// Flush is called.
+type Writer struct {
+	// Escape enables escaping of header names and values, which is used
+	// by STOMP 1.1 and later.
+	Escape bool
+
+	w   *bufio.Writer
+	buf []byte
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// WriteFrame writes the frame followed by the NUL terminator. A frame
+// without a command is written as a heart-beat.
+func (w *Writer) WriteFrame(f *Frame) error {
+	if f.IsHeartbeat() {
+		return w.WriteHeartbeat()
+	}
+	w.buf = Append(w.buf[:0], f, w.Escape)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// WriteHeartbeat writes a heart-beat, an empty NUL terminated frame.
+func (w *Writer) WriteHeartbeat() error {
+	return w.w.WriteByte(0)
+}
+
+// Flush writes buffered frames to the output stream.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Append appends the encoded frame, including the NUL terminator, to
+// the buffer, escaping header names and values if esc is true.
+func Append(buf []byte, f *Frame, esc bool) []byte {
+	if IsConnect(f.Command) {
+		esc = false
+	}
+	buf = append(buf, f.Command...)
+	buf = append(buf, '\n')
+	for _, h := range f.Headers {
+		buf = appendValue(buf, h.Name, esc)
+		buf = append(buf, ':')
+		buf = appendValue(buf, h.Value, esc)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, '\n')
+	buf = append(buf, f.Body...)
+	return append(buf, 0)
+}
+
+func appendValue(buf, b []byte, esc bool) []byte {
+	if esc {
+		return AppendEscaped(buf, b)
+	}
+	return append(buf, b...)
+}
@@ -0,0 +1,69 @@
+package stomp
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// redactedHeaders are the credential headers whose values are replaced
+// in logged frames.
+var redactedHeaders = [][]byte{HeaderPass, HeaderToken}
+
+// frameLogger writes the frames read and written by a connection to a
+// debug sink.
+type frameLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newFrameLogger returns a frame logger writing to w, or nil if w is nil.
+func newFrameLogger(w io.Writer) *frameLogger {
+	if w == nil {
+		return nil
+	}
+	return &frameLogger{w: w}
+}
+
+// log writes the frame of the message in text wire format, preceded by
+// the time and the direction, >>> for frames written and <<< for frames
+// read. A nil message logs a heart-beat.
+func (l *frameLogger) log(dir string, m *Message) {
+	var buf bytes.Buffer
+	buf.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(' ')
+	buf.WriteString(dir)
+	if m == nil {
+		buf.WriteString(" heart-beat\n")
+	} else {
+		buf.WriteByte('\n')
+		var frame bytes.Buffer
+		writeTo(&frame, m)
+		buf.Write(redact(frame.Bytes()))
+		buf.WriteString("^@\n")
+	}
+
+	l.mu.Lock()
+	l.w.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+// redact replaces the values of credential headers in the head of the
+// text frame.
+func redact(frame []byte) []byte {
+	end := bytes.Index(frame, []byte("\n\n"))
+	if end == -1 {
+		end = len(frame)
+	}
+	head, body := frame[:end], frame[end:]
+	lines := bytes.Split(head, newline)
+	for i, line := range lines {
+		for _, name := range redactedHeaders {
+			if len(line) > len(name) && line[len(name)] == ':' && bytes.HasPrefix(line, name) {
+				lines[i] = append(append([]byte(nil), line[:len(name)+1]...), "****"...)
+			}
+		}
+	}
+	return append(bytes.Join(lines, newline), body...)
+}
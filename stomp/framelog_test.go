@@ -0,0 +1,75 @@
+package stomp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFrameLogger(t *testing.T) {
+	a, b := net.Pipe()
+	broker := ConnWithConfig(b, ConnConfig{HeartbeatInterval: 10 * time.Millisecond})
+	defer broker.Close()
+	go fakeBroker(broker)
+
+	var log syncBuffer
+	client := newClient(a, []Option{WithFrameLogger(&log)})
+	defer client.peer.Close()
+	if err := client.Connect(WithCredentials("guest", "s3cret"), WithToken("t0ken")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send("/queue/test", []byte("hello"), WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); !strings.Contains(log.String(), "<<< heart-beat"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Want heart-beats logged, got\n%s", log.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	out := log.String()
+	for _, want := range []string{
+		">>>\nSTOMP\n",
+		"login:guest\n",
+		"passcode:****\n",
+		"token:****\n",
+		">>>\nSEND\ndestination:/queue/test\n",
+		"\n\nhello^@\n",
+		"<<<\nCONNECTED\n",
+		"<<<\nRECEIPT\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Want %q logged, got\n%s", want, out)
+		}
+	}
+	for _, secret := range []string{"s3cret", "t0ken"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Want %s redacted, got\n%s", secret, out)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, strings.Fields(out)[0]); err != nil {
+		t.Errorf("Want frames logged with a timestamp, got %s", err)
+	}
+}
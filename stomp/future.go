@@ -0,0 +1,140 @@
+package stomp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrReceiptTimeout is returned by a Future when the broker receipt is
+// not received before the receipt timeout.
+var ErrReceiptTimeout = errors.New("stomp: receipt timeout")
+
+// defaultReceiptTimeout is the default time a Future waits for the
+// broker receipt.
+var defaultReceiptTimeout = time.Second * 30
+
+// Future is the pending result of an asynchronous send. The future
+// resolves when the broker receipt arrives, the receipt times out, or
+// the connection is closed.
+type Future struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// resolve sets the result of the future. Only the first result is kept.
+func (f *Future) resolve(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
+
+// Done returns a channel that is closed when the future resolves.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err waits for the future to resolve and returns the error, or nil if
+// the broker confirmed the message.
+func (f *Future) Err() error {
+	<-f.done
+	return f.err
+}
+
+// Wait waits for the future to resolve, or for the context to be done.
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitAll waits for the futures to resolve and returns the first error.
+func WaitAll(futures ...*Future) error {
+	var err error
+	for _, f := range futures {
+		if ferr := f.Err(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// SendAsync sends the data to the given destination with a receipt
+// request and returns without waiting for the receipt. The returned
+// Future resolves when the broker confirms the message. Messages are
+// written in the order SendAsync is called, so many sends can be
+// pipelined and their confirmations awaited together.
+func (c *Client) SendAsync(dest string, data []byte, opts ...MessageOption) *Future {
+	f := newFuture()
+
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte(dest)
+	m.Body = data
+	m.Apply(opts...)
+	if len(m.Receipt) == 0 {
+		m.Receipt = Rand()
+	}
+	if err := compress(m); err != nil {
+		m.Release()
+		f.resolve(err)
+		return f
+	}
+
+	receipt := string(m.Receipt)
+	receiptc := make(chan error, 1)
+	c.mu.Lock()
+	c.wait[receipt] = receiptc
+	timeout := c.timeout
+	c.mu.Unlock()
+	if timeout == 0 {
+		timeout = defaultReceiptTimeout
+	}
+
+	if err := c.write(m); err != nil {
+		c.mu.Lock()
+		delete(c.wait, receipt)
+		c.mu.Unlock()
+		f.resolve(err)
+		return f
+	}
+
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case err := <-receiptc:
+			f.resolve(err)
+		case <-timer.C:
+			f.resolve(ErrReceiptTimeout)
+		}
+		c.mu.Lock()
+		delete(c.wait, receipt)
+		c.mu.Unlock()
+	}()
+	return f
+}
+
+// abort fails the sends waiting for a receipt when the connection is
+// closed.
+func (c *Client) abort(err error) {
+	c.mu.Lock()
+	for _, receiptc := range c.wait {
+		select {
+		case receiptc <- err:
+		default:
+		}
+	}
+	c.mu.Unlock()
+}
@@ -0,0 +1,62 @@
+package stomp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// fakeBroker accepts the connection and acknowledges messages sent to
+// every destination except /queue/unconfirmed.
+func fakeBroker(peer Peer) {
+	for m := range peer.Receive() {
+		reply := NewMessage()
+		switch {
+		case bytes.Equal(m.Method, MethodStomp):
+			reply.Method = MethodConnected
+		case bytes.Equal(m.Dest, []byte("/queue/unconfirmed")):
+			continue
+		case len(m.Receipt) != 0:
+			reply.Method = MethodRecipet
+			reply.Receipt = append(reply.Receipt, m.Receipt...)
+		default:
+			continue
+		}
+		peer.Send(reply)
+	}
+}
+
+func TestSendAsync(t *testing.T) {
+	a, b := Pipe()
+	go fakeBroker(b)
+	client := New(a)
+	client.timeout = 50 * time.Millisecond
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var futures []*Future
+	for i := 0; i < 10; i++ {
+		futures = append(futures, client.SendAsync("/queue/test", []byte("hello")))
+	}
+	if err := WaitAll(futures...); err != nil {
+		t.Errorf("Want pipelined sends confirmed, got %s", err)
+	}
+
+	f := client.SendAsync("/queue/unconfirmed", []byte("hello"))
+	if err := f.Err(); err != ErrReceiptTimeout {
+		t.Errorf("Want receipt timeout, got %v", err)
+	}
+
+	client.timeout = time.Minute
+	f = client.SendAsync("/queue/unconfirmed", []byte("hello"))
+	b.Close()
+	select {
+	case <-f.Done():
+		if f.Err() == nil {
+			t.Errorf("Want error when the connection closes")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Want future resolved when the connection closes")
+	}
+}
@@ -1,5 +1,11 @@
 package stomp
 
+import (
+	"github.com/mrwill84/mq/logger"
+
+	"golang.org/x/net/context"
+)
+
 // Handler handles a STOMP message.
 type Handler interface {
 	Handle(*Message)
@@ -11,3 +17,84 @@ type HandlerFunc func(*Message)
 
 // Handle calls f(m).
 func (f HandlerFunc) Handle(m *Message) { f(m) }
+
+// FailureHandler is a Handler that is notified of messages the client
+// cannot pass to the handler, such as a message whose body cannot be
+// decompressed. Such messages are otherwise logged and dropped.
+type FailureHandler interface {
+	Handler
+	HandleFailure(*Message, error)
+}
+
+// handleFailure notifies the handler, if it is a FailureHandler, that
+// the message cannot be handled.
+func handleFailure(h Handler, m *Message, err error) {
+	if h, ok := h.(FailureHandler); ok {
+		h.HandleFailure(m, err)
+		return
+	}
+	logger.Warningf("stomp client: cannot handle message %s: %s", m.ID, err)
+}
+
+// Handler2 handles a STOMP message with a context that is cancelled when
+// the subscription ends or the connection is closed, so that a handler
+// can abandon long running work on disconnect.
+type Handler2 interface {
+	HandleContext(context.Context, *Message)
+}
+
+// The HandlerFunc2 type is an adapter to allow the use of an ordinary
+// function as a context-aware STOMP message handler.
+type HandlerFunc2 func(context.Context, *Message)
+
+// HandleContext calls f(ctx, m).
+func (f HandlerFunc2) HandleContext(ctx context.Context, m *Message) { f(ctx, m) }
+
+// SubscribeContext subscribes to the given destination, handling
+// messages with a context that is cancelled when the subscription ends
+// or the connection is closed.
+func (c *Client) SubscribeContext(dest string, handler Handler2, opts ...MessageOption) (*Subscription, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := c.Subscribe(dest, &ctxHandler{handler, ctx, cancel}, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go c.cancelOnClose(ctx, cancel)
+	return sub, nil
+}
+
+// cancelOnClose cancels the context when the connection is closed,
+// following the connection across redirects.
+func (c *Client) cancelOnClose(ctx context.Context, cancel context.CancelFunc) {
+	for {
+		peer := c.conn()
+		select {
+		case <-ctx.Done():
+			return
+		case <-Closed(peer):
+			if c.conn() != peer {
+				continue
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// ctxHandler is a Handler that calls a Handler2 with the context of the
+// subscription.
+type ctxHandler struct {
+	handler Handler2
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (h *ctxHandler) Handle(m *Message) {
+	h.handler.HandleContext(h.ctx, m)
+}
+
+// stop cancels the context of the subscription.
+func (h *ctxHandler) stop() {
+	h.cancel()
+}
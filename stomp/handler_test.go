@@ -0,0 +1,78 @@
+package stomp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSubscribeContext(t *testing.T) {
+	a, b := Pipe()
+	subscribed := make(chan []byte, 2)
+	go func() {
+		for m := range b.Receive() {
+			switch {
+			case bytes.Equal(m.Method, MethodStomp):
+				reply := NewMessage()
+				reply.Method = MethodConnected
+				b.Send(reply)
+			case bytes.Equal(m.Method, MethodSubscribe):
+				subscribed <- append([]byte(nil), m.ID...)
+			}
+			m.Release()
+		}
+	}()
+
+	client := New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	contexts := make(chan context.Context, 2)
+	handler := HandlerFunc2(func(ctx context.Context, m *Message) {
+		contexts <- ctx
+		m.Release()
+	})
+	deliver := func(id []byte) context.Context {
+		m := NewMessage()
+		m.Method = MethodMessage
+		m.Subs = id
+		b.Send(m)
+		select {
+		case ctx := <-contexts:
+			return ctx
+		case <-time.After(time.Second):
+			t.Fatalf("Want message handled")
+		}
+		return nil
+	}
+
+	first, err := client.SubscribeContext("/queue/first", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SubscribeContext("/queue/second", handler); err != nil {
+		t.Fatal(err)
+	}
+	firstCtx := deliver(<-subscribed)
+	secondCtx := deliver(<-subscribed)
+
+	first.Unsubscribe()
+	select {
+	case <-firstCtx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Want context cancelled on unsubscribe")
+	}
+	if secondCtx.Err() != nil {
+		t.Errorf("Want other subscriptions unaffected")
+	}
+
+	client.Disconnect()
+	select {
+	case <-secondCtx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Want context cancelled when the connection is closed")
+	}
+}
@@ -0,0 +1,83 @@
+package stomp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// handlerMap maps subscription ids to handlers. Lookups load an immutable
+// map without locking, so that inbound messages on many subscriptions do
+// not serialize on a lock. Updates copy the map, since subscriptions
+// change rarely compared with message delivery.
+type handlerMap struct {
+	mu sync.Mutex // serializes updates
+	v  atomic.Value
+}
+
+func newHandlerMap() *handlerMap {
+	h := new(handlerMap)
+	h.v.Store(map[string]Handler{})
+	return h
+}
+
+// load returns the handler of the subscription.
+func (h *handlerMap) load(id []byte) (Handler, bool) {
+	handler, ok := h.v.Load().(map[string]Handler)[string(id)]
+	return handler, ok
+}
+
+// snapshot returns the current handlers. The map must not be modified.
+func (h *handlerMap) snapshot() map[string]Handler {
+	return h.v.Load().(map[string]Handler)
+}
+
+// store adds the handlers, replacing existing handlers with the same
+// subscription ids.
+func (h *handlerMap) store(handlers map[string]Handler) {
+	h.update(func(m map[string]Handler) {
+		for id, handler := range handlers {
+			m[id] = handler
+		}
+	})
+}
+
+// add adds the handler of the subscription.
+func (h *handlerMap) add(id string, handler Handler) {
+	h.update(func(m map[string]Handler) {
+		m[id] = handler
+	})
+}
+
+// remove removes the handlers of the subscriptions and returns the last
+// removed handler.
+func (h *handlerMap) remove(ids ...string) (handler Handler) {
+	h.update(func(m map[string]Handler) {
+		for _, id := range ids {
+			handler = m[id]
+			delete(m, id)
+		}
+	})
+	return
+}
+
+// clear removes and returns every handler.
+func (h *handlerMap) clear() map[string]Handler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev := h.v.Load().(map[string]Handler)
+	h.v.Store(map[string]Handler{})
+	return prev
+}
+
+// update applies fn to a copy of the map and stores the copy.
+func (h *handlerMap) update(fn func(map[string]Handler)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev := h.v.Load().(map[string]Handler)
+	next := make(map[string]Handler, len(prev)+1)
+	for id, handler := range prev {
+		next[id] = handler
+	}
+	fn(next)
+	h.v.Store(next)
+}
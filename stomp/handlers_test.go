@@ -0,0 +1,55 @@
+package stomp
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHandlerMap(t *testing.T) {
+	h := newHandlerMap()
+	a := HandlerFunc(func(*Message) {})
+	h.add("1", a)
+	if _, ok := h.load([]byte("1")); !ok {
+		t.Errorf("Expect handler found")
+	}
+
+	snapshot := h.snapshot()
+	h.store(map[string]Handler{"2": a, "3": a})
+	if len(snapshot) != 1 {
+		t.Errorf("Expect snapshot unchanged by updates, got %d handlers", len(snapshot))
+	}
+	if got := len(h.snapshot()); got != 3 {
+		t.Errorf("Expect 3 handlers, got %d", got)
+	}
+
+	if handler := h.remove("1", "2"); handler == nil {
+		t.Errorf("Expect removed handler returned")
+	}
+	if _, ok := h.load([]byte("1")); ok {
+		t.Errorf("Expect handler removed")
+	}
+	if _, ok := h.load([]byte("3")); !ok {
+		t.Errorf("Expect remaining handler found")
+	}
+}
+
+func BenchmarkHandlerLookup(b *testing.B) {
+	h := newHandlerMap()
+	ids := make([][]byte, 100)
+	for i := range ids {
+		ids[i] = strconv.AppendInt(nil, int64(i), 10)
+		h.add(string(ids[i]), HandlerFunc(func(*Message) {}))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			if _, ok := h.load(ids[i%len(ids)]); !ok {
+				b.Fatal("handler not found")
+			}
+			i++
+		}
+	})
+}
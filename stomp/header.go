@@ -13,6 +13,13 @@ type item struct {
 }
 
 // Header represents the header section of the STOMP message.
+//
+// Header names are case-sensitive, as defined by the STOMP protocol, and
+// are stored as received; Get, GetAll, Set and Del match names exactly.
+// The standard headers use lower case names, so applications should use
+// lower case names for custom headers. A header may occur more than once,
+// in which case Get returns the first value, as required for repeated
+// headers by the protocol.
 type Header struct {
 	items []item
 	itemc int
@@ -44,6 +51,9 @@ func (h *Header) GetString(name string) string {
 // GetBool returns the named header value.
 func (h *Header) GetBool(name string) bool {
 	s := h.GetString(name)
+	if s == "" {
+		return false
+	}
 	b, _ := strconv.ParseBool(s)
 	return b
 }
@@ -51,6 +61,9 @@ func (h *Header) GetBool(name string) bool {
 // GetInt returns the named header value.
 func (h *Header) GetInt(name string) int {
 	s := h.GetString(name)
+	if s == "" {
+		return 0
+	}
 	i, _ := strconv.Atoi(s)
 	return i
 }
@@ -58,6 +71,9 @@ func (h *Header) GetInt(name string) int {
 // GetInt64 returns the named header value.
 func (h *Header) GetInt64(name string) int64 {
 	s := h.GetString(name)
+	if s == "" {
+		return 0
+	}
 	i, _ := strconv.ParseInt(s, 10, 64)
 	return i
 }
@@ -68,6 +84,17 @@ func (h *Header) Field(name []byte) []byte {
 	return h.Get(name)
 }
 
+// GetAll returns the values of every header with the name, in order.
+func (h *Header) GetAll(name []byte) [][]byte {
+	var values [][]byte
+	for i := 0; i < h.itemc; i++ {
+		if v := h.items[i]; bytes.Equal(v.name, name) {
+			values = append(values, v.data)
+		}
+	}
+	return values
+}
+
 // Add appens the key value pair to the header.
 func (h *Header) Add(name, data []byte) {
 	h.grow()
@@ -76,9 +103,48 @@ func (h *Header) Add(name, data []byte) {
 	h.itemc++
 }
 
+// Set sets the named header to the value, replacing the first existing
+// value in place and removing any others.
+func (h *Header) Set(name, data []byte) {
+	for i := 0; i < h.itemc; i++ {
+		if bytes.Equal(h.items[i].name, name) {
+			h.items[i].data = data
+			h.delAfter(name, i+1)
+			return
+		}
+	}
+	h.Add(name, data)
+}
+
+// Del removes every header with the name.
+func (h *Header) Del(name []byte) {
+	h.delAfter(name, 0)
+}
+
+// Each calls fn for each header in order until fn returns false.
+func (h *Header) Each(fn func(name, data []byte) bool) {
+	for i := 0; i < h.itemc; i++ {
+		if !fn(h.items[i].name, h.items[i].data) {
+			return
+		}
+	}
+}
+
+// delAfter removes the headers with the name from index i onwards.
+func (h *Header) delAfter(name []byte, i int) {
+	for ; i < h.itemc; i++ {
+		if bytes.Equal(h.items[i].name, name) {
+			copy(h.items[i:h.itemc], h.items[i+1:h.itemc])
+			h.itemc--
+			h.items[h.itemc] = item{zeroBytes, zeroBytes}
+			i--
+		}
+	}
+}
+
 // Index returns the keypair at index i.
 func (h *Header) Index(i int) (k, v []byte) {
-	if i > h.itemc {
+	if i < 0 || i >= h.itemc {
 		return
 	}
 	k = h.items[i].name
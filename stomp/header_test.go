@@ -77,3 +77,56 @@ func TestHeader(t *testing.T) {
 		t.Errorf("Expect header.GetBool parses the boolean value false")
 	}
 }
+
+func TestHeaderDel(t *testing.T) {
+	header := newHeader()
+	header.Add([]byte("foo"), []byte("1"))
+	header.Add([]byte("bar"), []byte("2"))
+	header.Add([]byte("foo"), []byte("3"))
+	header.Del([]byte("foo"))
+
+	if got := header.Len(); got != 1 {
+		t.Errorf("Want header len 1 after deleting, got %d", got)
+	}
+	if got := header.GetString("bar"); got != "2" {
+		t.Errorf("Want remaining header preserved, got %q", got)
+	}
+	if got := header.Get([]byte("foo")); len(got) != 0 {
+		t.Errorf("Want deleted header removed, got %q", got)
+	}
+}
+
+func TestHeaderSet(t *testing.T) {
+	header := newHeader()
+	header.Add([]byte("foo"), []byte("1"))
+	header.Add([]byte("bar"), []byte("2"))
+	header.Add([]byte("foo"), []byte("3"))
+
+	if got := header.GetAll([]byte("foo")); len(got) != 2 || string(got[0]) != "1" || string(got[1]) != "3" {
+		t.Errorf("Want all values of the repeated header, got %q", got)
+	}
+
+	header.Set([]byte("foo"), []byte("4"))
+	header.Set([]byte("baz"), []byte("5"))
+	var names, values []string
+	header.Each(func(name, data []byte) bool {
+		names = append(names, string(name))
+		values = append(values, string(data))
+		return true
+	})
+	if fmt.Sprint(names, values) != "[foo bar baz] [4 2 5]" {
+		t.Errorf("Want value replaced in place and duplicates removed, got %v %v", names, values)
+	}
+
+	var n int
+	header.Each(func(name, data []byte) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Want iteration stopped, got %d calls", n)
+	}
+	if k, v := header.Index(header.Len()); k != nil || v != nil {
+		t.Errorf("Want no header beyond the length, got %q:%q", k, v)
+	}
+}
@@ -0,0 +1,311 @@
+package stomp
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+)
+
+// pauseSelector is a selector that matches no messages, used to pause a
+// subscription in place.
+const pauseSelector = "1 == 2"
+
+// defaultBudgetWindow is the default number of recent messages over
+// which the handler error rate is computed.
+const defaultBudgetWindow = 100
+
+// ErrorHandler is a Handler that reports whether the message was handled
+// successfully. Failures are recorded by the client handler statistics
+// and count against the subscription error budget.
+type ErrorHandler interface {
+	Handler
+	HandleErr(*Message) error
+}
+
+// The HandlerErrFunc type is an adapter to allow the use of an ordinary
+// function that returns an error as a STOMP message handler.
+type HandlerErrFunc func(*Message) error
+
+// Handle calls f(m).
+func (f HandlerErrFunc) Handle(m *Message) { f(m) }
+
+// HandleErr calls f(m).
+func (f HandlerErrFunc) HandleErr(m *Message) error { return f(m) }
+
+// ErrorBudget configures a subscription to pause when the rate of
+// handler errors exceeds the budget.
+type ErrorBudget struct {
+	Rate   float64       // maximum fraction of failed messages
+	Window int           // number of recent messages, 100 by default
+	Pause  time.Duration // time the subscription is paused
+}
+
+// HandlerStats reports the outcomes of the subscription handlers for a
+// destination. Outcomes are counted for handlers implementing
+// ErrorHandler, and failures for messages which cannot be decompressed.
+type HandlerStats struct {
+	Success  int64
+	Failure  int64
+	Duration time.Duration // total time spent in handlers
+	Paused   int64         // number of subscriptions paused
+}
+
+// handlerStats records handler outcomes. Fields are accessed atomically.
+type handlerStats struct {
+	success  int64
+	failure  int64
+	duration int64
+	paused   int64
+}
+
+// Stats returns the handler statistics of the client subscriptions by
+// destination.
+func (c *Client) Stats() map[string]HandlerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make(map[string]HandlerStats, len(c.stats))
+	for dest, s := range c.stats {
+		stats[dest] = HandlerStats{
+			Success:  atomic.LoadInt64(&s.success),
+			Failure:  atomic.LoadInt64(&s.failure),
+			Duration: time.Duration(atomic.LoadInt64(&s.duration)),
+			Paused:   atomic.LoadInt64(&s.paused),
+		}
+	}
+	return stats
+}
+
+// destStats returns the handler statistics of the destination, creating
+// them if necessary.
+func (c *Client) destStats(dest string) *handlerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]*handlerStats)
+	}
+	s, ok := c.stats[dest]
+	if !ok {
+		s = new(handlerStats)
+		c.stats[dest] = s
+	}
+	return s
+}
+
+// instrument is a Handler that decompresses each message, records the
+// outcome and duration of each message handled, pauses the subscription
+// if the error budget is exceeded, and holds the messages received while
+// the subscription is paused.
+type instrument struct {
+	handler Handler
+	stats   *handlerStats
+	limit   int // maximum decompressed body size
+
+	client *Client
+	id     []byte
+	dest   string
+	budget *ErrorBudget
+
+	mu        sync.Mutex
+	selector  []byte     // current subscription selector, restored on resume
+	prefetch  []byte     // current subscription prefetch, restored on resume
+	held      []*Message // messages received while paused
+	paused    bool       // paused by Subscription.Pause
+	exhausted bool       // paused by the error budget
+	draining  bool       // handling held messages
+	outcomes  []bool     // ring of recent outcomes, true if failed
+	next      int
+	failures  int
+}
+
+func (i *instrument) Handle(m *Message) {
+	i.mu.Lock()
+	if i.paused || i.exhausted || i.draining {
+		i.held = append(i.held, m)
+		i.mu.Unlock()
+		return
+	}
+	i.mu.Unlock()
+	i.handle(m)
+}
+
+// handle handles the message. Outcomes are recorded for handlers
+// implementing ErrorHandler, and for messages which cannot be
+// decompressed.
+func (i *instrument) handle(m *Message) {
+	if err := DecompressLimit(m, i.limit); err != nil {
+		atomic.AddInt64(&i.stats.failure, 1)
+		handleFailure(i.handler, m, err)
+		if i.budget != nil {
+			i.record(true)
+		}
+		return
+	}
+
+	h, ok := i.handler.(ErrorHandler)
+	if !ok {
+		start := time.Now()
+		i.handler.Handle(m)
+		atomic.AddInt64(&i.stats.duration, int64(time.Since(start)))
+		return
+	}
+	start := time.Now()
+	err := h.HandleErr(m)
+	atomic.AddInt64(&i.stats.duration, int64(time.Since(start)))
+	if err != nil {
+		atomic.AddInt64(&i.stats.failure, 1)
+	} else {
+		atomic.AddInt64(&i.stats.success, 1)
+	}
+	if i.budget != nil {
+		i.record(err != nil)
+	}
+}
+
+// stop releases the held messages and stops the next handler.
+func (i *instrument) stop() {
+	i.mu.Lock()
+	held := i.held
+	i.held = nil
+	i.mu.Unlock()
+	for _, m := range held {
+		m.Release()
+	}
+	stopHandler(i.handler)
+}
+
+// record adds the outcome to the error budget window, and pauses the
+// subscription once the window is full and the error rate exceeds the
+// budget.
+func (i *instrument) record(failed bool) {
+	i.mu.Lock()
+	if i.outcomes == nil {
+		window := i.budget.Window
+		if window <= 0 {
+			window = defaultBudgetWindow
+		}
+		i.outcomes = make([]bool, 0, window)
+	}
+	if len(i.outcomes) < cap(i.outcomes) {
+		i.outcomes = append(i.outcomes, failed)
+	} else {
+		if i.outcomes[i.next] {
+			i.failures--
+		}
+		i.outcomes[i.next] = failed
+		i.next = (i.next + 1) % len(i.outcomes)
+	}
+	if failed {
+		i.failures++
+	}
+	exceeded := !i.exhausted && len(i.outcomes) == cap(i.outcomes) &&
+		float64(i.failures)/float64(len(i.outcomes)) > i.budget.Rate
+	wasPaused := i.paused
+	if exceeded {
+		i.exhausted = true
+	}
+	i.mu.Unlock()
+	if !exceeded {
+		return
+	}
+
+	atomic.AddInt64(&i.stats.paused, 1)
+	logger.Warningf("stomp client: subscription %s exceeded error budget, pausing for %s",
+		string(i.id), i.budget.Pause,
+	)
+	if !wasPaused && !i.topic() {
+		go i.client.update(i.id, WithSelector(pauseSelector))
+	}
+	time.AfterFunc(i.budget.Pause, func() {
+		atomic.AddInt64(&i.stats.paused, -1)
+		logger.Noticef("stomp client: subscription %s resumed", string(i.id))
+		i.resume(true)
+	})
+}
+
+// topic returns true if the subscription is to a topic.
+func (i *instrument) topic() bool {
+	return strings.HasPrefix(i.dest, "/topic/")
+}
+
+// pause holds the messages received by the subscription until resumed.
+// The server stops delivering queued messages to the subscription,
+// leaving them to other subscribers. Topic messages are held by the
+// client, since the server does not retain them.
+func (i *instrument) pause() error {
+	i.mu.Lock()
+	wasPaused := i.paused || i.exhausted
+	i.paused = true
+	i.mu.Unlock()
+	if wasPaused || i.topic() {
+		return nil
+	}
+	return i.client.update(i.id, WithSelector(pauseSelector))
+}
+
+// resume restores the current selector and prefetch count of the
+// subscription, and handles the messages held while paused. Resuming
+// after the error budget pause also resets the error budget window.
+func (i *instrument) resume(exhausted bool) error {
+	i.mu.Lock()
+	if exhausted {
+		i.exhausted = false
+		i.outcomes = i.outcomes[:0]
+		i.next = 0
+		i.failures = 0
+	} else {
+		i.paused = false
+	}
+	if i.paused || i.exhausted {
+		i.mu.Unlock()
+		return nil
+	}
+	i.draining = true
+	selector := append([]byte(nil), i.selector...)
+	prefetch := append([]byte(nil), i.prefetch...)
+	i.mu.Unlock()
+
+	var err error
+	if !i.topic() {
+		err = i.client.update(i.id, func(m *Message) {
+			m.Selector = append(m.Selector[:0], selector...)
+			m.Prefetch = append(m.Prefetch[:0], prefetch...)
+		})
+	}
+	for {
+		i.mu.Lock()
+		if len(i.held) == 0 || i.paused || i.exhausted {
+			i.draining = false
+			i.mu.Unlock()
+			return err
+		}
+		m := i.held[0]
+		i.held[0] = nil
+		i.held = i.held[1:]
+		i.mu.Unlock()
+		i.handle(m)
+	}
+}
+
+// updated records the selector and prefetch count of the subscription
+// update, and returns true if the update is deferred until the paused
+// subscription resumes.
+func (i *instrument) updated(m *Message) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.selector = append(i.selector[:0], m.Selector...)
+	i.prefetch = append(i.prefetch[:0], m.Prefetch...)
+	return (i.paused || i.exhausted) && !i.topic()
+}
+
+// WithErrorBudget returns a MessageOption which configures the
+// subscription to pause, for the budget pause duration, when the rate of
+// handler errors over the budget window exceeds the budget rate. Only
+// handlers implementing ErrorHandler report errors.
+func WithErrorBudget(budget ErrorBudget) MessageOption {
+	return subscriptionOption(func(s *Subscription) {
+		s.budget = &budget
+	})
+}
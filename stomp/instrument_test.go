@@ -0,0 +1,199 @@
+package stomp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorBudget(t *testing.T) {
+	a, b := Pipe()
+	updates := make(chan string, 2)
+	go func() {
+		for m := range b.Receive() {
+			switch {
+			case bytes.Equal(m.Method, MethodStomp):
+				reply := NewMessage()
+				reply.Method = MethodConnected
+				b.Send(reply)
+			case len(m.Header.Get(HeaderUpdate)) != 0:
+				updates <- string(m.Selector)
+			}
+		}
+	}()
+
+	client := New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	handled := make(chan struct{}, 4)
+	handler := HandlerErrFunc(func(m *Message) error {
+		defer func() { handled <- struct{}{} }()
+		if string(m.Body) == "bad" {
+			return errors.New("bad message")
+		}
+		return nil
+	})
+	sub, err := client.Subscribe("/queue/test", handler,
+		WithSelector("kind == 'order'"),
+		WithErrorBudget(ErrorBudget{Rate: 0.5, Window: 4, Pause: 50 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"ok", "bad", "bad", "bad"} {
+		m := NewMessage()
+		m.Method = MethodMessage
+		m.Dest = []byte("/queue/test")
+		m.Subs = sub.ID()
+		m.Body = []byte(body)
+		b.Send(m)
+		<-handled
+	}
+
+	stats := client.Stats()["/queue/test"]
+	if stats.Success != 1 || stats.Failure != 3 {
+		t.Errorf("Want handler outcomes recorded, got %+v", stats)
+	}
+	if stats.Paused != 1 {
+		t.Errorf("Want subscription paused, got %+v", stats)
+	}
+
+	for _, want := range []string{pauseSelector, "kind == 'order'"} {
+		select {
+		case got := <-updates:
+			if got != want {
+				t.Errorf("Want subscription updated with selector %q, got %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Want subscription updated with selector %q", want)
+		}
+	}
+	if stats := client.Stats()["/queue/test"]; stats.Paused != 0 {
+		t.Errorf("Want subscription resumed, got %+v", stats)
+	}
+}
+
+type failureHandler struct {
+	handled int
+	err     error
+}
+
+func (h *failureHandler) Handle(m *Message) { h.handled++ }
+
+func (h *failureHandler) HandleFailure(m *Message, err error) { h.err = err }
+
+func TestInstrumentDecompress(t *testing.T) {
+	m := NewMessage()
+	m.Body = bytes.Repeat([]byte{0}, 4<<10)
+	m.Apply(WithCompression(EncodingGzip))
+	if err := compress(m); err != nil {
+		t.Fatal(err)
+	}
+
+	h := new(failureHandler)
+	i := &instrument{handler: h, stats: new(handlerStats), limit: 1 << 10}
+	i.Handle(m)
+	if h.handled != 0 || h.err != ErrFrameTooLarge {
+		t.Errorf("Want oversized body reported to the handler, got %d handled, %v", h.handled, h.err)
+	}
+	if i.stats.failure != 1 {
+		t.Errorf("Want failure recorded, got %d", i.stats.failure)
+	}
+
+	i.limit = 0
+	i.Handle(m)
+	if h.handled != 1 || len(m.Body) != 4<<10 {
+		t.Errorf("Want body decompressed before the handler, got %d handled, %d bytes", h.handled, len(m.Body))
+	}
+}
+
+func TestInstrumentPause(t *testing.T) {
+	a, b := Pipe()
+	updates := make(chan string, 4)
+	go func() {
+		for m := range b.Receive() {
+			switch {
+			case bytes.Equal(m.Method, MethodStomp):
+				reply := NewMessage()
+				reply.Method = MethodConnected
+				b.Send(reply)
+			case len(m.Header.Get(HeaderUpdate)) != 0:
+				updates <- string(m.Selector)
+			}
+		}
+	}()
+
+	client := New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	handled := make(chan string, 4)
+	deliver := func(sub *Subscription, body string) {
+		m := NewMessage()
+		m.Method = MethodMessage
+		m.Dest = []byte(sub.Destination())
+		m.Subs = sub.ID()
+		m.Body = []byte(body)
+		b.Send(m)
+	}
+
+	// topic messages received while paused are held by the client.
+	topic, err := client.Subscribe("/topic/test", HandlerFunc(func(m *Message) {
+		handled <- string(m.Body)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.Pause()
+	deliver(topic, "held")
+	select {
+	case body := <-handled:
+		t.Errorf("Want message held while paused, got %s", body)
+	case <-time.After(20 * time.Millisecond):
+	}
+	topic.Resume()
+	select {
+	case body := <-handled:
+		if body != "held" {
+			t.Errorf("Want held message handled on resume, got %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want held message handled on resume")
+	}
+	select {
+	case got := <-updates:
+		t.Errorf("Want topic subscription paused by the client, got update %q", got)
+	default:
+	}
+	if stats := client.Stats()["/topic/test"]; stats.Success != 0 || stats.Failure != 0 {
+		t.Errorf("Want no outcomes counted for a plain handler, got %+v", stats)
+	}
+
+	// a queue subscription updated while paused resumes with the update.
+	queue, err := client.Subscribe("/queue/test", HandlerFunc(func(m *Message) {}),
+		WithSelector("kind == 'order'"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Pause()
+	client.Update(queue.ID(), WithSelector("kind == 'refund'"))
+	queue.Resume()
+	for _, want := range []string{pauseSelector, "kind == 'refund'"} {
+		select {
+		case got := <-updates:
+			if got != want {
+				t.Errorf("Want subscription updated with selector %q, got %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Want subscription updated with selector %q", want)
+		}
+	}
+}
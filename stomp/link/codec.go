@@ -0,0 +1,214 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+// token values used to encode byte strings. Values greater than or
+// equal to tokenIndex reference a dictionary entry.
+const (
+	tokenEmpty   = 0 // empty byte string
+	tokenLiteral = 1 // literal byte string
+	tokenLearn   = 2 // literal byte string added to the dictionary
+	tokenIndex   = 3 // dictionary index offset
+)
+
+// maxDictionary is the maximum number of dictionary entries.
+const maxDictionary = 4096
+
+// maxDictionaryEntry is the maximum length of a dictionary entry.
+const maxDictionaryEntry = 256
+
+var errMalformed = errors.New("link: malformed batch")
+
+// encoder encodes batches of messages. The encoder maintains a dictionary
+// of header names and frequently repeated values that is shared with the
+// decoder on the remote end of the link.
+type encoder struct {
+	dict map[string]uint64
+	buf  []byte
+	tmp  [binary.MaxVarintLen64]byte
+}
+
+func newEncoder() *encoder {
+	return &encoder{dict: make(map[string]uint64)}
+}
+
+// encode encodes the messages as a batch and returns the batch, which
+// is valid until the next call to encode.
+func (e *encoder) encode(messages []*stomp.Message) []byte {
+	e.buf = e.buf[:0]
+	e.uvarint(uint64(len(messages)))
+	for _, m := range messages {
+		e.learn(m.Method)
+		e.literal(m.Proto)
+		e.literal(m.ID)
+		e.literal(m.User)
+		e.literal(m.Pass)
+		e.learn(m.Host)
+		e.learn(m.Dest)
+		e.learn(m.Subs)
+		e.literal(m.Ack)
+		e.learn(m.Persist)
+		e.learn(m.Retain)
+		e.learn(m.Prefetch)
+		e.literal(m.Expires)
+		e.literal(m.Receipt)
+		e.learn(m.Selector)
+
+		e.uvarint(uint64(m.Header.Len()))
+		for i := 0; i < m.Header.Len(); i++ {
+			k, v := m.Header.Index(i)
+			e.learn(k)
+			e.learn(v)
+		}
+		e.uvarint(uint64(len(m.Body)))
+		e.buf = append(e.buf, m.Body...)
+	}
+	return e.buf
+}
+
+// learn encodes the byte string using the dictionary, adding the byte
+// string to the dictionary if not already present.
+func (e *encoder) learn(b []byte) {
+	if len(b) == 0 {
+		e.uvarint(tokenEmpty)
+		return
+	}
+	if i, ok := e.dict[string(b)]; ok {
+		e.uvarint(i + tokenIndex)
+		return
+	}
+	if len(e.dict) >= maxDictionary || len(b) > maxDictionaryEntry {
+		e.literal(b)
+		return
+	}
+	e.dict[string(b)] = uint64(len(e.dict))
+	e.uvarint(tokenLearn)
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// literal encodes the byte string without using the dictionary.
+func (e *encoder) literal(b []byte) {
+	if len(b) == 0 {
+		e.uvarint(tokenEmpty)
+		return
+	}
+	e.uvarint(tokenLiteral)
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) uvarint(x uint64) {
+	n := binary.PutUvarint(e.tmp[:], x)
+	e.buf = append(e.buf, e.tmp[:n]...)
+}
+
+// decoder decodes batches of messages encoded by the remote encoder.
+type decoder struct {
+	dict [][]byte
+	buf  []byte
+	err  error
+}
+
+// decode decodes the batch. The decoded messages reference the batch
+// buffer, which must not be modified while the messages are in use.
+func (d *decoder) decode(b []byte) ([]*stomp.Message, error) {
+	d.buf = b
+	d.err = nil
+
+	count := d.uvarint()
+	if count > uint64(len(b)) {
+		return nil, errMalformed
+	}
+	messages := make([]*stomp.Message, 0, count)
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		m := stomp.NewMessage()
+		m.Method = d.next()
+		m.Proto = d.next()
+		m.ID = d.next()
+		m.User = d.next()
+		m.Pass = d.next()
+		m.Host = d.next()
+		m.Dest = d.next()
+		m.Subs = d.next()
+		m.Ack = d.next()
+		m.Persist = d.next()
+		m.Retain = d.next()
+		m.Prefetch = d.next()
+		m.Expires = d.next()
+		m.Receipt = d.next()
+		m.Selector = d.next()
+
+		headers := d.uvarint()
+		for j := uint64(0); j < headers && d.err == nil; j++ {
+			k := d.next()
+			v := d.next()
+			m.Header.Add(k, v)
+		}
+		m.Body = d.bytes(d.uvarint())
+		messages = append(messages, m)
+	}
+	if d.err != nil {
+		for _, m := range messages {
+			m.Release()
+		}
+		return nil, d.err
+	}
+	return messages, nil
+}
+
+// next decodes the next byte string.
+func (d *decoder) next() []byte {
+	switch token := d.uvarint(); {
+	case d.err != nil:
+		return nil
+	case token == tokenEmpty:
+		return nil
+	case token == tokenLiteral:
+		return d.bytes(d.uvarint())
+	case token == tokenLearn:
+		b := d.bytes(d.uvarint())
+		if d.err == nil {
+			d.dict = append(d.dict, append([]byte(nil), b...))
+		}
+		return b
+	default:
+		i := token - tokenIndex
+		if i >= uint64(len(d.dict)) {
+			d.err = errMalformed
+			return nil
+		}
+		return d.dict[i]
+	}
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errMalformed
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errMalformed
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
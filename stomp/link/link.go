@@ -0,0 +1,267 @@
+// Package link implements a compact, batched binary protocol for
+// broker-to-broker links. Many messages are written per network frame and
+// header names and repeated values are replaced with references to a
+// dictionary shared by both ends of the link, reducing the CPU and
+// bandwidth used by federation and mirroring traffic.
+package link
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+const (
+	bufferSize = 32 << 10 // default buffer size 32KB
+	maxBatch   = 256      // maximum number of messages per batch
+	maxFrame   = 64 << 20 // maximum frame size 64MB
+)
+
+var heartbeatTime = time.Second * 30
+
+// drainTimeout bounds the time spent writing pending messages when the
+// link is closed.
+var drainTimeout = time.Second * 5
+
+// ErrFrameTooLarge is returned when a frame exceeds the maximum
+// frame size.
+var ErrFrameTooLarge = errors.New("link: frame too large")
+
+type linkPeer struct {
+	once sync.Once // begins the shutdown
+	mu   sync.Mutex
+	err  error
+	conn net.Conn
+	done chan struct{}
+
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	incoming chan *stomp.Message
+	outgoing chan *stomp.Message
+}
+
+// Conn creates a broker link peer that reads and writes batches of
+// messages using net.Conn c.
+func Conn(c net.Conn) stomp.Peer {
+	p := &linkPeer{
+		reader:   bufio.NewReaderSize(c, bufferSize),
+		writer:   bufio.NewWriterSize(c, bufferSize),
+		incoming: make(chan *stomp.Message, maxBatch),
+		outgoing: make(chan *stomp.Message, maxBatch),
+		done:     make(chan struct{}),
+		conn:     c,
+	}
+
+	go p.readInto(p.incoming)
+	go p.writeFrom(p.outgoing)
+	return p
+}
+
+func (p *linkPeer) Receive() <-chan *stomp.Message {
+	return p.incoming
+}
+
+func (p *linkPeer) Send(m *stomp.Message) error {
+	select {
+	case <-p.done:
+		return stomp.ErrClosed
+	default:
+	}
+	select {
+	case <-p.done:
+		return stomp.ErrClosed
+	case p.outgoing <- m:
+		return nil
+	}
+}
+
+func (p *linkPeer) Close() error {
+	return p.close(nil)
+}
+
+func (p *linkPeer) CloseWithError(err error) error {
+	return p.close(err)
+}
+
+func (p *linkPeer) Closed() <-chan struct{} {
+	return p.done
+}
+
+func (p *linkPeer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *linkPeer) Addr() string {
+	return p.RemoteAddr()
+}
+
+func (p *linkPeer) LocalAddr() string {
+	return p.conn.LocalAddr().String()
+}
+
+func (p *linkPeer) RemoteAddr() string {
+	return p.conn.RemoteAddr().String()
+}
+
+// close begins the shutdown, once. The writer flushes the messages
+// accepted by Send and closes the connection, which unblocks the reader.
+// The incoming channel is closed by the reader, its only sender, and the
+// outgoing channel is never closed, so a concurrent Send cannot panic.
+func (p *linkPeer) close(err error) error {
+	closed := false
+	p.once.Do(func() {
+		closed = true
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		close(p.done)
+	})
+	if !closed {
+		return stomp.ErrClosed
+	}
+	return nil
+}
+
+func (p *linkPeer) readInto(messages chan<- *stomp.Message) {
+	var err error
+	defer func() {
+		if err == io.EOF {
+			err = nil
+		}
+		p.close(err)
+		close(messages)
+	}()
+
+	var (
+		d    decoder
+		size [4]byte
+	)
+	for {
+		if _, err = io.ReadFull(p.reader, size[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			logger.Verbosef("link: received heart-beat")
+			continue
+		}
+		if n > maxFrame {
+			err = ErrFrameTooLarge
+			return
+		}
+		frame := make([]byte, n)
+		if _, err = io.ReadFull(p.reader, frame); err != nil {
+			return
+		}
+
+		var batch []*stomp.Message
+		if batch, err = d.decode(frame); err != nil {
+			return
+		}
+		for i, m := range batch {
+			select {
+			case <-p.done:
+				for _, m := range batch[i:] {
+					m.Release()
+				}
+				return
+			case messages <- m:
+			}
+		}
+	}
+}
+
+func (p *linkPeer) writeFrom(messages <-chan *stomp.Message) {
+	var (
+		e     = newEncoder()
+		batch = make([]*stomp.Message, 0, maxBatch)
+		size  [4]byte
+	)
+
+	heartbeat := time.NewTicker(heartbeatTime)
+	defer heartbeat.Stop()
+
+	write := func(frame []byte) error {
+		binary.BigEndian.PutUint32(size[:], uint32(len(frame)))
+		p.writer.Write(size[:])
+		p.writer.Write(frame)
+		return p.writer.Flush()
+	}
+
+	for {
+		select {
+		case <-p.done:
+			p.drain(e, write)
+			return
+		case <-heartbeat.C:
+			if err := write(nil); err != nil {
+				p.close(err)
+			}
+			continue
+		case m := <-messages:
+			batch = append(batch, m)
+		}
+
+		// gather the messages that are immediately available into
+		// the batch, without waiting for additional messages.
+	gather:
+		for len(batch) < maxBatch {
+			select {
+			case m := <-messages:
+				batch = append(batch, m)
+			default:
+				break gather
+			}
+		}
+
+		err := write(e.encode(batch))
+		for i, m := range batch {
+			m.Release()
+			batch[i] = nil
+		}
+		batch = batch[:0]
+		if err != nil {
+			p.close(err)
+		}
+	}
+}
+
+// drain writes the messages accepted by Send before the shutdown began
+// and closes the connection.
+func (p *linkPeer) drain(e *encoder, write func([]byte) error) {
+	p.conn.SetWriteDeadline(time.Now().Add(drainTimeout))
+	batch := make([]*stomp.Message, 0, maxBatch)
+	for {
+	gather:
+		for len(batch) < maxBatch {
+			select {
+			case m := <-p.outgoing:
+				batch = append(batch, m)
+			default:
+				break gather
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		err := write(e.encode(batch))
+		for i, m := range batch {
+			m.Release()
+			batch[i] = nil
+		}
+		batch = batch[:0]
+		if err != nil {
+			break
+		}
+	}
+	p.conn.Close()
+}
@@ -0,0 +1,119 @@
+package link
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestCodec(t *testing.T) {
+	var (
+		e = newEncoder()
+		d decoder
+	)
+
+	for i := 0; i < 2; i++ {
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodMessage
+		m.Dest = []byte("/topic/test")
+		m.ID = []byte("123")
+		m.Header.Add([]byte("content-type"), []byte("text/plain"))
+		m.Body = []byte("hello")
+
+		got, err := d.decode(e.encode([]*stomp.Message{m, m}))
+		if err != nil {
+			t.Fatalf("Want batch decoded, got error %s", err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("Want 2 messages decoded, got %d", len(got))
+		}
+		if !reflect.DeepEqual(got[1].Bytes(), m.Bytes()) {
+			t.Errorf("Want message %q, got %q", m, got[1])
+		}
+	}
+	if len(d.dict) != len(e.dict) || len(d.dict) == 0 {
+		t.Errorf("Want shared dictionary, got %d and %d entries", len(e.dict), len(d.dict))
+	}
+}
+
+func TestCodecMalformed(t *testing.T) {
+	var tests = [][]byte{
+		{},        // no message count
+		{1},       // missing message fields
+		{1, 9},    // unknown dictionary reference
+		{1, 1, 9}, // literal exceeds batch
+	}
+	for _, test := range tests {
+		var d decoder
+		if _, err := d.decode(test); err == nil {
+			t.Errorf("Want error decoding malformed batch %v", test)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	a, b := net.Pipe()
+	client := Conn(a)
+	server := Conn(b)
+	defer client.Close()
+	defer server.Close()
+
+	for i := 0; i < 10; i++ {
+		m := stomp.NewMessage()
+		m.Method = stomp.MethodSend
+		m.Dest = []byte("/queue/test")
+		m.Body = []byte("hello")
+		client.Send(m)
+	}
+	for i := 0; i < 10; i++ {
+		m := <-server.Receive()
+		if string(m.Dest) != "/queue/test" || string(m.Body) != "hello" {
+			t.Errorf("Want message received over link, got %q", m)
+		}
+	}
+}
+
+func TestConnConcurrentClose(t *testing.T) {
+	a, b := net.Pipe()
+	client := Conn(a)
+	server := Conn(b)
+	defer server.Close()
+	go func() {
+		for m := range server.Receive() {
+			m.Release()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m := stomp.NewMessage()
+				m.Method = stomp.MethodSend
+				m.Dest = []byte("/queue/test")
+				if err := client.Send(m); err == stomp.ErrClosed {
+					return
+				}
+			}
+		}()
+	}
+	client.Close()
+	wg.Wait()
+	if err := client.Send(stomp.NewMessage()); err != stomp.ErrClosed {
+		t.Errorf("Want ErrClosed sending after close, got %v", err)
+	}
+	if err := client.Close(); err != stomp.ErrClosed {
+		t.Errorf("Want ErrClosed closing twice, got %v", err)
+	}
+	select {
+	case <-stomp.Closed(server):
+	case <-time.After(time.Second):
+		t.Errorf("Want remote end closed after the link closes")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"math/rand"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -17,6 +19,7 @@ type Message struct {
 	Method   []byte // stomp method
 	User     []byte // username header
 	Pass     []byte // password header
+	Host     []byte // virtual host header
 	Dest     []byte // destination header
 	Subs     []byte // subscription id
 	Ack      []byte // ack id
@@ -30,17 +33,30 @@ type Message struct {
 	Body     []byte
 	Header   *Header // custom headers
 
-	ctx context.Context
+	ctx      context.Context
+	buf      *buffer // shared frame buffer
+	released bool
+
+	// subscription created by Client.Subscribe from the frame, which
+	// holds the settings of subscription options.
+	sub *Subscription
+
+	// client send settings
+	guarantee bool
+	compress  string
 }
 
-// Copy returns a copy of the Message.
+// Copy returns a copy of the Message. The copy shares the underlying
+// header and body buffers with the original message.
 func (m *Message) Copy() *Message {
+	m.checkReleased()
 	c := NewMessage()
 	c.ID = m.ID
 	c.Proto = m.Proto
 	c.Method = m.Method
 	c.User = m.User
 	c.Pass = m.Pass
+	c.Host = m.Host
 	c.Dest = m.Dest
 	c.Subs = m.Subs
 	c.Ack = m.Ack
@@ -52,8 +68,63 @@ func (m *Message) Copy() *Message {
 	c.Expires = m.Expires
 	c.Body = m.Body
 	c.ctx = m.ctx
-	c.Header.itemc = m.Header.itemc
-	copy(c.Header.items, m.Header.items)
+	for i := 0; i < m.Header.itemc; i++ {
+		c.Header.Add(m.Header.items[i].name, m.Header.items[i].data)
+	}
+	if m.buf != nil {
+		m.buf.retain()
+		c.buf = m.buf
+		c.seal()
+	}
+	return c
+}
+
+// seal caps the fields and headers of a message referencing a shared
+// frame buffer at their length, so that appending to them copies the
+// field instead of overwriting the buffer seen by the other holders.
+func (m *Message) seal() {
+	for _, field := range m.fields() {
+		*field = (*field)[:len(*field):len(*field)]
+	}
+	m.Msg = m.Msg[:len(m.Msg):len(m.Msg)]
+	m.Body = m.Body[:len(m.Body):len(m.Body)]
+	for i := 0; i < m.Header.itemc; i++ {
+		item := &m.Header.items[i]
+		item.name = item.name[:len(item.name):len(item.name)]
+		item.data = item.data[:len(item.data):len(item.data)]
+	}
+}
+
+// Clone returns a deep copy of the Message. The copy does not share any
+// buffers with the original message, and may be retained after the
+// original message is released.
+func (m *Message) Clone() *Message {
+	m.checkReleased()
+	c := NewMessage()
+	c.ID = clone(m.ID)
+	c.Proto = clone(m.Proto)
+	c.Method = clone(m.Method)
+	c.User = clone(m.User)
+	c.Pass = clone(m.Pass)
+	c.Host = clone(m.Host)
+	c.Dest = clone(m.Dest)
+	c.Subs = clone(m.Subs)
+	c.Ack = clone(m.Ack)
+	c.Msg = clone(m.Msg)
+	c.Prefetch = clone(m.Prefetch)
+	c.Selector = clone(m.Selector)
+	c.Persist = clone(m.Persist)
+	c.Retain = clone(m.Retain)
+	c.Receipt = clone(m.Receipt)
+	c.Expires = clone(m.Expires)
+	c.Body = clone(m.Body)
+	c.ctx = m.ctx
+	for i := 0; i < m.Header.itemc; i++ {
+		c.Header.Add(
+			clone(m.Header.items[i].name),
+			clone(m.Header.items[i].data),
+		)
+	}
 	return c
 }
 
@@ -83,10 +154,31 @@ func (m *Message) String() string {
 
 // Release releases the message back to the message pool.
 func (m *Message) Release() {
+	if atomic.LoadInt32(&poolDebug) == 1 {
+		m.poison()
+		return
+	}
 	m.Reset()
 	pool.Put(m)
 }
 
+// poison resets the message and marks it released without returning it
+// to the pool, so that later use of the message is detected.
+func (m *Message) poison() {
+	m.checkReleased()
+	m.Reset()
+	m.Method = poisonMethod
+	m.released = true
+}
+
+// checkReleased panics if the message was released while the pool
+// debug mode is enabled.
+func (m *Message) checkReleased() {
+	if m.released {
+		panic("stomp: use of released message")
+	}
+}
+
 // Reset resets the meesage fields to their zero values.
 func (m *Message) Reset() {
 	m.ID = m.ID[:0]
@@ -94,6 +186,7 @@ func (m *Message) Reset() {
 	m.Method = m.Method[:0]
 	m.User = m.User[:0]
 	m.Pass = m.Pass[:0]
+	m.Host = m.Host[:0]
 	m.Dest = m.Dest[:0]
 	m.Subs = m.Subs[:0]
 	m.Ack = m.Ack[:0]
@@ -105,7 +198,21 @@ func (m *Message) Reset() {
 	m.Expires = m.Expires[:0]
 	m.Body = m.Body[:0]
 	m.ctx = nil
+	m.sub = nil
+	m.guarantee = false
+	m.compress = ""
 	m.Header.reset()
+	if m.buf != nil {
+		// drop the fields referencing the shared buffer, which the
+		// pooled message must not append to.
+		for _, field := range m.fields() {
+			*field = nil
+		}
+		m.Msg = nil
+		m.Body = nil
+		m.buf.release()
+		m.buf = nil
+	}
 }
 
 // Context returns the request's context.
@@ -135,6 +242,33 @@ func NewMessage() *Message {
 	return pool.Get().(*Message)
 }
 
+// SetPoolDebug enables or disables the message pool debug mode. When
+// enabled, released messages are poisoned and never returned to the pool,
+// and any attempt to write, copy or release a released message panics.
+// This helps detect handlers that retain messages after release, at the
+// cost of disabling message reuse.
+func SetPoolDebug(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&poolDebug, 1)
+	} else {
+		atomic.StoreInt32(&poolDebug, 0)
+	}
+}
+
+var poolDebug int32
+
+var poisonMethod = []byte("RELEASED")
+
+// helper function returns a copy of the byte slice.
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
 var pool = sync.Pool{New: func() interface{} {
 	return &Message{Header: newHeader()}
 }}
@@ -144,3 +278,52 @@ var pool = sync.Pool{New: func() interface{} {
 func Rand() []byte {
 	return strconv.AppendInt(nil, rand.Int63(), 10)
 }
+
+// ContentType returns the content-type header.
+func (m *Message) ContentType() string {
+	return string(m.Header.Get(HeaderContentType))
+}
+
+// SetContentType sets the content-type header.
+func (m *Message) SetContentType(contentType string) {
+	m.Header.Set(HeaderContentType, []byte(contentType))
+}
+
+// CorrelationID returns the correlation-id header, which relates a reply
+// to its request.
+func (m *Message) CorrelationID() string {
+	return string(m.Header.Get(HeaderCorrelation))
+}
+
+// SetCorrelationID sets the correlation-id header.
+func (m *Message) SetCorrelationID(id string) {
+	m.Header.Set(HeaderCorrelation, []byte(id))
+}
+
+// ReplyTo returns the reply-to header, the destination replies to the
+// message are sent to.
+func (m *Message) ReplyTo() string {
+	return string(m.Header.Get(HeaderReplyTo))
+}
+
+// SetReplyTo sets the reply-to header.
+func (m *Message) SetReplyTo(dest string) {
+	m.Header.Set(HeaderReplyTo, []byte(dest))
+}
+
+// Timestamp returns the timestamp header, in milliseconds since the
+// epoch, or the zero time if the header is missing or invalid.
+func (m *Message) Timestamp() time.Time {
+	ms := ParseInt64(m.Header.Get(HeaderTimestamp))
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// SetTimestamp sets the timestamp header, in milliseconds since the
+// epoch.
+func (m *Message) SetTimestamp(t time.Time) {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	m.Header.Set(HeaderTimestamp, strconv.AppendInt(nil, ms, 10))
+}
@@ -3,6 +3,7 @@ package stomp
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -14,6 +15,7 @@ func TestMessageCopy(t *testing.T) {
 	m.Method = MethodSend
 	m.User = []byte("username")
 	m.Pass = []byte("password")
+	m.Host = []byte("example.com")
 	m.Dest = []byte("/topic/test")
 	m.Subs = []byte("1")
 	m.Ack = AckAuto
@@ -42,6 +44,9 @@ func TestMessageCopy(t *testing.T) {
 	if !bytes.Equal(m.Pass, c.Pass) {
 		t.Errorf("expect Pass value is copied")
 	}
+	if !bytes.Equal(m.Host, c.Host) {
+		t.Errorf("expect Host value is copied")
+	}
 	if !bytes.Equal(m.Dest, c.Dest) {
 		t.Errorf("expect Dest value is copied")
 	}
@@ -91,6 +96,7 @@ func TestMessageRelease(t *testing.T) {
 	m.Method = MethodSend
 	m.User = []byte("username")
 	m.Pass = []byte("password")
+	m.Host = []byte("example.com")
 	m.Dest = []byte("/topic/test")
 	m.Subs = []byte("1")
 	m.Ack = AckAuto
@@ -119,6 +125,9 @@ func TestMessageRelease(t *testing.T) {
 	if len(m.Pass) != 0 {
 		t.Errorf("expect Pass to reset to zero value")
 	}
+	if len(m.Host) != 0 {
+		t.Errorf("expect Host to reset to zero value")
+	}
 	if len(m.Dest) != 0 {
 		t.Errorf("expect Dest to reset to zero value")
 	}
@@ -153,3 +162,72 @@ func TestMessageRelease(t *testing.T) {
 		t.Errorf("expect Context to reset to zero value")
 	}
 }
+
+func TestMessageClone(t *testing.T) {
+	m := NewMessage()
+	m.Dest = []byte("/topic/test")
+	m.Body = []byte("hello world")
+	for i := 0; i < defaultHeaderLen+1; i++ {
+		m.Header.Add([]byte("key"), []byte("val"))
+	}
+
+	c := m.Clone()
+	if !bytes.Equal(m.Body, c.Body) || !bytes.Equal(m.Dest, c.Dest) {
+		t.Errorf("expect Clone copies message values")
+	}
+	if c.Header.Len() != m.Header.Len() {
+		t.Errorf("expect Clone copies all headers, got %d", c.Header.Len())
+	}
+	c.Body[0] = 'j'
+	if m.Body[0] != 'h' {
+		t.Errorf("expect Clone does not share the body buffer")
+	}
+}
+
+func TestMessagePoolDebug(t *testing.T) {
+	SetPoolDebug(true)
+	defer SetPoolDebug(false)
+
+	m := NewMessage()
+	m.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expect panic when using a released message")
+		}
+	}()
+	m.Bytes()
+}
+
+func TestMessageHeaderAccessors(t *testing.T) {
+	m := NewMessage()
+	defer m.Release()
+	if m.ContentType() != "" || !m.Timestamp().IsZero() {
+		t.Errorf("Want empty values for missing headers")
+	}
+
+	now := time.Unix(1500000000, 123*int64(time.Millisecond))
+	m.Apply(WithCorrelationID("req-1"), WithReplyTo("/temp-queue/replies"))
+	m.SetContentType("text/plain")
+	m.SetContentType(ContentTypeJSON)
+	m.SetTimestamp(now)
+
+	if got := m.ContentType(); got != ContentTypeJSON {
+		t.Errorf("Want content type replaced, got %q", got)
+	}
+	if got := len(m.Header.GetAll(HeaderContentType)); got != 1 {
+		t.Errorf("Want a single content-type header, got %d", got)
+	}
+	if got := m.CorrelationID(); got != "req-1" {
+		t.Errorf("Want correlation id, got %q", got)
+	}
+	if got := m.ReplyTo(); got != "/temp-queue/replies" {
+		t.Errorf("Want reply-to destination, got %q", got)
+	}
+	if got := m.Header.GetString("timestamp"); got != "1500000000123" {
+		t.Errorf("Want timestamp in milliseconds, got %q", got)
+	}
+	if got := m.Timestamp(); !got.Equal(now) {
+		t.Errorf("Want timestamp %s, got %s", now, got)
+	}
+}
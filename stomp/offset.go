@@ -0,0 +1,320 @@
+package stomp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mrwill84/mq/logger"
+)
+
+// OffsetStore records the messages processed by a consumer, so that a
+// restarted consumer skips messages that were processed but not yet
+// acknowledged when it stopped. Messages stamped with a sequence number
+// are tracked by the highest sequence number processed; other messages
+// are tracked by their dedup-id. The broker assigns a new message-id to
+// every delivery, so it does not identify a redelivered message.
+type OffsetStore interface {
+	// Offset returns the highest sequence number processed for the
+	// destination, or zero.
+	Offset(dest string) (int64, error)
+
+	// Commit records the sequence number as processed.
+	Commit(dest string, offset int64) error
+
+	// Contains returns true if the message id was processed.
+	Contains(dest, id string) (bool, error)
+
+	// Add records the message id as processed.
+	Add(dest, id string) error
+}
+
+// WithExactlyOnce returns a MessageOption which configures a subscription
+// to record each message in the store after the handler processes it and
+// before the message is acknowledged. Messages already recorded are
+// acknowledged without invoking the handler, giving effectively-once
+// processing on top of at-least-once delivery. Producers identify
+// messages with WithDedupID or a sequence header; messages with neither
+// are handled every time they are delivered.
+//
+// The subscription uses the client-individual ack mode and the client
+// acknowledges messages, so the handler must not. Messages that fail an
+// ErrorHandler, or that cannot be recorded in the store, are negatively
+// acknowledged for redelivery. Sequence
+// offsets assume messages are processed in order.
+func WithExactlyOnce(store OffsetStore) MessageOption {
+	return func(m *Message) {
+		m.Ack = append(m.Ack[:0], AckClientIndividual...)
+		if m.sub != nil {
+			m.sub.offsets = store
+		}
+	}
+}
+
+// onceHandler is a Handler that skips messages recorded in the offset
+// store and records and acknowledges messages once handled.
+type onceHandler struct {
+	handler Handler
+	store   OffsetStore
+	client  *Client
+}
+
+func (o *onceHandler) Handle(m *Message) {
+	o.HandleErr(m)
+}
+
+// HandleFailure notifies the next handler that the message cannot be
+// handled.
+func (o *onceHandler) HandleFailure(m *Message, err error) {
+	handleFailure(o.handler, m, err)
+}
+
+func (o *onceHandler) HandleErr(m *Message) error {
+	dest := string(m.Dest)
+	seq := ParseInt64(m.Header.Get(HeaderSequence))
+	id := string(m.Header.Get(HeaderDedupID))
+	ack := append([]byte(nil), m.Ack...)
+	if len(ack) == 0 {
+		ack = append(ack, m.ID...)
+	}
+
+	done, err := o.processed(dest, seq, id)
+	if err != nil {
+		logger.Warningf("stomp client: offset store: %s", err)
+		m.Release()
+		o.client.Nack(ack)
+		return err
+	}
+	if done {
+		logger.Verbosef("stomp client: message %s already processed", id)
+		m.Release()
+		return o.client.Ack(ack)
+	}
+
+	if h, ok := o.handler.(ErrorHandler); ok {
+		err = h.HandleErr(m)
+	} else {
+		o.handler.Handle(m)
+	}
+	if err != nil {
+		o.client.Nack(ack)
+		return err
+	}
+
+	switch {
+	case seq != 0:
+		err = o.store.Commit(dest, seq)
+	case id != "":
+		err = o.store.Add(dest, id)
+	}
+	if err != nil {
+		// the message is redelivered and processed again, since it
+		// was not recorded.
+		logger.Warningf("stomp client: offset store: %s", err)
+		o.client.Nack(ack)
+		return err
+	}
+	return o.client.Ack(ack)
+}
+
+// processed returns true if the message was recorded in the store.
+// Messages without a sequence number or dedup-id are never recorded.
+func (o *onceHandler) processed(dest string, seq int64, id string) (bool, error) {
+	switch {
+	case seq != 0:
+		offset, err := o.store.Offset(dest)
+		return seq <= offset, err
+	case id != "":
+		return o.store.Contains(dest, id)
+	}
+	return false, nil
+}
+
+// stop stops the next handler.
+func (o *onceHandler) stop() {
+	stopHandler(o.handler)
+}
+
+// NewMemoryOffsetStore returns an OffsetStore that records processed
+// messages in memory, which is useful for tests and consumers that only
+// need to skip duplicates within a process lifetime.
+func NewMemoryOffsetStore() OffsetStore {
+	return &memoryOffsetStore{
+		offsets: make(map[string]int64),
+		ids:     make(map[string]map[string]struct{}),
+	}
+}
+
+type memoryOffsetStore struct {
+	sync.Mutex
+	offsets map[string]int64
+	ids     map[string]map[string]struct{}
+}
+
+func (s *memoryOffsetStore) Offset(dest string) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.offsets[dest], nil
+}
+
+func (s *memoryOffsetStore) Commit(dest string, offset int64) error {
+	s.Lock()
+	if offset > s.offsets[dest] {
+		s.offsets[dest] = offset
+	}
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryOffsetStore) Contains(dest, id string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.ids[dest][id]
+	return ok, nil
+}
+
+func (s *memoryOffsetStore) Add(dest, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.ids[dest] == nil {
+		s.ids[dest] = make(map[string]struct{})
+	}
+	s.ids[dest][id] = struct{}{}
+	return nil
+}
+
+// FileOffsetStore returns an OffsetStore that records processed messages
+// in files in the named directory. Each destination has an offset file
+// and a log of processed message ids, which grows until the files are
+// removed.
+func FileOffsetStore(dir string) (OffsetStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileOffsetStore{
+		dir: dir,
+		ids: make(map[string]map[string]struct{}),
+	}, nil
+}
+
+const (
+	offsetExt = ".offset"
+	idsExt    = ".ids"
+)
+
+type fileOffsetStore struct {
+	sync.Mutex
+	dir string
+	ids map[string]map[string]struct{} // loaded id logs
+}
+
+// path returns the path of the destination file with the extension.
+func (s *fileOffsetStore) path(dest, ext string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(dest))+ext)
+}
+
+func (s *fileOffsetStore) Offset(dest string) (int64, error) {
+	data, err := ioutil.ReadFile(s.path(dest, offsetExt))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (s *fileOffsetStore) Commit(dest string, offset int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// write to a temporary file and rename, so that a crash does not
+	// leave a partially written offset.
+	f, err := ioutil.TempFile(s.dir, "offset")
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(strconv.FormatInt(offset, 10)); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(dest, offsetExt))
+}
+
+func (s *fileOffsetStore) Contains(dest, id string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	ids, err := s.load(dest)
+	if err != nil {
+		return false, err
+	}
+	_, ok := ids[id]
+	return ok, nil
+}
+
+func (s *fileOffsetStore) Add(dest, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	ids, err := s.load(dest)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path(dest, idsExt), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(hex.EncodeToString([]byte(id)) + "\n"); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	ids[id] = struct{}{}
+	return nil
+}
+
+// load returns the processed ids of the destination, reading the id log
+// on first use. The caller must hold the lock.
+func (s *fileOffsetStore) load(dest string) (map[string]struct{}, error) {
+	if ids, ok := s.ids[dest]; ok {
+		return ids, nil
+	}
+	ids := make(map[string]struct{})
+	f, err := os.Open(s.path(dest, idsExt))
+	if os.IsNotExist(err) {
+		s.ids[dest] = ids
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id, err := hex.DecodeString(scanner.Text())
+		if err != nil {
+			// a partially written line from a crash is ignored.
+			continue
+		}
+		ids[string(id)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	s.ids[dest] = ids
+	return ids, nil
+}
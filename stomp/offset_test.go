@@ -0,0 +1,142 @@
+package stomp
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExactlyOnce(t *testing.T) {
+	// the second message is a redelivery of the first, with a new
+	// message-id as the broker assigns on every delivery. The last
+	// message has no dedup-id and is delivered twice.
+	client, acks := onceBroker(t, []string{"1", "1", "2", "", ""})
+	store := NewMemoryOffsetStore()
+	var handled []string
+	_, err := client.Subscribe("/queue/orders", HandlerFunc(func(m *Message) {
+		handled = append(handled, string(m.ID))
+		m.Release()
+	}), WithExactlyOnce(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"ACK m-1", "ACK m-2", "ACK m-3", "ACK m-4", "ACK m-5"} {
+		select {
+		case got := <-acks:
+			if got != want {
+				t.Errorf("Want %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Want %s", want)
+		}
+	}
+	if want := []string{"m-1", "m-3", "m-4", "m-5"}; !reflect.DeepEqual(handled, want) {
+		t.Errorf("Want redelivered message skipped, got %v handled", handled)
+	}
+	if ok, _ := store.Contains("/queue/orders", "2"); !ok {
+		t.Errorf("Want processed message recorded")
+	}
+}
+
+func TestExactlyOnceStoreFailure(t *testing.T) {
+	client, acks := onceBroker(t, []string{"1"})
+	_, err := client.Subscribe("/queue/orders", HandlerFunc(func(m *Message) {
+		m.Release()
+	}), WithExactlyOnce(failingStore{NewMemoryOffsetStore()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-acks:
+		if got != "NACK m-1" {
+			t.Errorf("Want message not recorded nacked, got %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want message not recorded nacked")
+	}
+}
+
+// failingStore is an OffsetStore that cannot record messages.
+type failingStore struct {
+	OffsetStore
+}
+
+func (failingStore) Add(dest, id string) error {
+	return errors.New("disk full")
+}
+
+// onceBroker connects a client to a fake broker which delivers a message
+// with each dedup-id, and a new message-id, on subscribe. The method and
+// id of acknowledgements are sent to the channel.
+func onceBroker(t *testing.T, dedupIDs []string) (*Client, <-chan string) {
+	a, b := Pipe()
+	acks := make(chan string, 10)
+	go func() {
+		for m := range b.Receive() {
+			switch {
+			case bytes.Equal(m.Method, MethodStomp):
+				reply := NewMessage()
+				reply.Method = MethodConnected
+				reply.Proto = append(reply.Proto, STOMP...)
+				b.Send(reply)
+			case bytes.Equal(m.Method, MethodSubscribe):
+				for i, id := range dedupIDs {
+					msg := NewMessage()
+					msg.Method = MethodMessage
+					msg.Dest = []byte("/queue/orders")
+					msg.Subs = append(msg.Subs, m.ID...)
+					msg.ID = []byte("m-" + strconv.Itoa(i+1))
+					msg.Ack = msg.ID
+					if id != "" {
+						msg.Header.Add(HeaderDedupID, []byte(id))
+					}
+					b.Send(msg)
+				}
+			case bytes.Equal(m.Method, MethodAck), bytes.Equal(m.Method, MethodNack):
+				acks <- string(m.Method) + " " + string(m.ID)
+			}
+			m.Release()
+		}
+	}()
+
+	client := New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return client, acks
+}
+
+func TestFileOffsetStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, _ := FileOffsetStore(dir)
+	if err := store.Add("/queue/a", "id\n1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Commit("/topic/b", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted consumer reads the recorded offsets.
+	store, _ = FileOffsetStore(dir)
+	if ok, err := store.Contains("/queue/a", "id\n1"); !ok || err != nil {
+		t.Errorf("Want id recorded, got %v %v", ok, err)
+	}
+	if ok, _ := store.Contains("/queue/b", "id\n1"); ok {
+		t.Errorf("Want ids scoped by destination")
+	}
+	if offset, err := store.Offset("/topic/b"); offset != 42 || err != nil {
+		t.Errorf("Want offset 42, got %d %v", offset, err)
+	}
+}
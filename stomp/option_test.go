@@ -2,7 +2,9 @@ package stomp
 
 import (
 	"bytes"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestOptions(t *testing.T) {
@@ -23,6 +25,13 @@ func TestOptions(t *testing.T) {
 		t.Errorf("Want WithCredentials to apply password header")
 	}
 
+	opt = WithHost("example.com")
+	msg = NewMessage()
+	msg.Apply(opt)
+	if string(msg.Host) != "example.com" {
+		t.Errorf("Want WithHost to apply host header")
+	}
+
 	opt = WithExpires(1234)
 	msg = NewMessage()
 	msg.Apply(opt)
@@ -89,3 +98,41 @@ func TestOptions(t *testing.T) {
 		t.Errorf("Want WithRetain to apply retain header")
 	}
 }
+
+func TestHeaderFuncOptions(t *testing.T) {
+	var calls int
+	opt := WithHeaderFunc("foo", func() string {
+		calls++
+		return strconv.Itoa(calls)
+	})
+	for i := 1; i <= 2; i++ {
+		msg := NewMessage()
+		msg.Apply(opt)
+		if got := msg.Header.GetInt("foo"); got != i {
+			t.Errorf("Want WithHeaderFunc evaluated on each apply, got %d", got)
+		}
+	}
+
+	opt = WithHeaderFunc("destination", func() string { return "/topic/foo" })
+	msg := NewMessage()
+	msg.Apply(opt)
+	if msg.Header.Len() != 0 {
+		t.Errorf("Want WithHeaderFunc to ignore reserved headers")
+	}
+
+	opt = WithCounter("seq")
+	for i := 1; i <= 3; i++ {
+		msg := NewMessage()
+		msg.Apply(opt)
+		if got := msg.Header.GetInt("seq"); got != i {
+			t.Errorf("Want WithCounter header %d, got %d", i, got)
+		}
+	}
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	msg = NewMessage()
+	msg.Apply(WithTimestamp("ts"))
+	if got := msg.Header.GetInt64("ts"); got < before {
+		t.Errorf("Want WithTimestamp to apply the send time, got %d", got)
+	}
+}
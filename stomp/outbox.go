@@ -0,0 +1,112 @@
+package stomp
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoOutbox is returned when a message is sent with guaranteed
+// delivery by a client without an outbox.
+var ErrNoOutbox = errors.New("stomp: guaranteed delivery requires an outbox")
+
+// Outbox persists messages sent with guaranteed delivery until the
+// server acknowledges receipt of the message.
+type Outbox interface {
+	// Put persists the message data using the given id.
+	Put(id string, data []byte) error
+
+	// Delete removes the message with the given id.
+	Delete(id string) error
+
+	// List returns the persisted messages, keyed by id.
+	List() (map[string][]byte, error)
+}
+
+// WithGuarantee returns a MessageOption which configures the message to
+// be written to the client outbox before it is sent, and removed from the
+// outbox when the server acknowledges receipt. Messages remaining in the
+// outbox are resent when the client connects. Sending the message fails
+// with ErrNoOutbox if the client has no outbox.
+func WithGuarantee() MessageOption {
+	return func(m *Message) {
+		m.guarantee = true
+	}
+}
+
+// FileOutbox returns an Outbox that persists each message to a file in
+// the named directory.
+func FileOutbox(dir string) (Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return fileOutbox(dir), nil
+}
+
+type fileOutbox string
+
+const outboxExt = ".msg"
+
+// path returns the path of the file of the message with the given id.
+// The id is hex encoded, so that it cannot name a file outside the
+// directory.
+func (dir fileOutbox) path(id string) string {
+	return filepath.Join(string(dir), hex.EncodeToString([]byte(id))+outboxExt)
+}
+
+func (dir fileOutbox) Put(id string, data []byte) error {
+	path := dir.path(id)
+
+	// write to a temporary file and rename, so that a crash does not
+	// leave a partially written message in the outbox.
+	f, err := ioutil.TempFile(string(dir), "outbox")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (dir fileOutbox) Delete(id string) error {
+	err := os.Remove(dir.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (dir fileOutbox) List() (map[string][]byte, error) {
+	infos, err := ioutil.ReadDir(string(dir))
+	if err != nil {
+		return nil, err
+	}
+	messages := make(map[string][]byte)
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, outboxExt) {
+			continue
+		}
+		id, err := hex.DecodeString(strings.TrimSuffix(name, outboxExt))
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(string(dir), name))
+		if err != nil {
+			return nil, err
+		}
+		messages[string(id)] = data
+	}
+	return messages, nil
+}
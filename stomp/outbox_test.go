@@ -0,0 +1,144 @@
+package stomp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outbox, err := FileOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Put("1", []byte("hello")); err != nil {
+		t.Errorf("Want message written to outbox, got error %s", err)
+	}
+
+	messages, err := outbox.List()
+	if err != nil {
+		t.Errorf("Want outbox listed, got error %s", err)
+	}
+	if string(messages["1"]) != "hello" {
+		t.Errorf("Want message listed in outbox, got %v", messages)
+	}
+
+	if err := outbox.Delete("1"); err != nil {
+		t.Errorf("Want message deleted from outbox, got error %s", err)
+	}
+	if messages, _ = outbox.List(); len(messages) != 0 {
+		t.Errorf("Want empty outbox, got %d messages", len(messages))
+	}
+}
+
+func TestFileOutboxEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outbox, err := FileOutbox(filepath.Join(dir, "outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Put("../escaped", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped"+outboxExt)); err == nil {
+		t.Errorf("Want message written inside the outbox directory")
+	}
+	if messages, _ := outbox.List(); string(messages["../escaped"]) != "hello" {
+		t.Errorf("Want message listed by its id, got %v", messages)
+	}
+}
+
+func TestGuaranteeWithoutOutbox(t *testing.T) {
+	a, b := Pipe()
+	go fakeBroker(b)
+	client := New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	if err := client.Send("/queue/test", []byte("hello"), WithGuarantee()); err != ErrNoOutbox {
+		t.Errorf("Want ErrNoOutbox, got %v", err)
+	}
+}
+
+func TestOutboxResend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outbox, err := FileOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a message left in the outbox by a send that was not confirmed
+	// before the connection was lost.
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte("/queue/test")
+	m.Body = []byte("hello")
+	if err := outbox.Put("1", m.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := Pipe()
+	resent := make(chan string, 1)
+	go func() {
+		for m := range b.Receive() {
+			reply := NewMessage()
+			switch {
+			case bytes.Equal(m.Method, MethodStomp):
+				reply.Method = MethodConnected
+			case len(m.Receipt) != 0:
+				resent <- string(m.Receipt) + " " + string(m.Body)
+				reply.Method = MethodRecipet
+				reply.Receipt = append(reply.Receipt, m.Receipt...)
+			default:
+				continue
+			}
+			b.Send(reply)
+		}
+	}()
+	client := New(a)
+	client.SetOutbox(outbox)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	select {
+	case got := <-resent:
+		if got != "1 hello" {
+			t.Errorf("Want outbox message resent with its receipt, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Want outbox message resent on connect")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		messages, _ := outbox.List()
+		if len(messages) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Want confirmed message removed from the outbox, got %d messages", len(messages))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,12 +1,19 @@
 package stomp
 
 import (
-	"io"
+	"errors"
 	"net"
 	"sync"
 )
 
-// Peer defines a peer-to-peer connection.
+// ErrClosed is returned when sending to a closed peer, or closing a
+// peer that is already closed.
+var ErrClosed = errors.New("stomp: peer closed")
+
+// Peer defines a peer-to-peer connection. The methods of a Peer are safe
+// for concurrent use. Once Close has been called, Send returns ErrClosed
+// and never panics, and the Receive channel is closed after any messages
+// already received are delivered or discarded.
 type Peer interface {
 	// Send sends a message.
 	Send(*Message) error
@@ -21,6 +28,60 @@ type Peer interface {
 	Addr() string
 }
 
+// ClosingPeer is implemented by peers which signal when the connection
+// is closed and record the reason. The peers of this package implement
+// it; use CloseWithError, Closed and CloseErr to support any Peer.
+type ClosingPeer interface {
+	// CloseWithError closes the connection and records err as the
+	// reason the connection was closed.
+	CloseWithError(error) error
+
+	// Closed returns a channel that is closed when the connection
+	// is closed.
+	Closed() <-chan struct{}
+
+	// Err returns the reason the connection was closed. It returns
+	// nil if the connection is open or was closed without error.
+	Err() error
+}
+
+// AddrPeer is implemented by peers which report the network addresses
+// of both ends of the connection.
+type AddrPeer interface {
+	// LocalAddr returns the local network address.
+	LocalAddr() string
+
+	// RemoteAddr returns the remote network address.
+	RemoteAddr() string
+}
+
+// CloseWithError closes the peer, recording err as the reason the
+// connection was closed if the peer is a ClosingPeer.
+func CloseWithError(p Peer, err error) error {
+	if c, ok := p.(ClosingPeer); ok {
+		return c.CloseWithError(err)
+	}
+	return p.Close()
+}
+
+// Closed returns a channel that is closed when the peer is closed, or
+// nil if the peer is not a ClosingPeer.
+func Closed(p Peer) <-chan struct{} {
+	if c, ok := p.(ClosingPeer); ok {
+		return c.Closed()
+	}
+	return nil
+}
+
+// CloseErr returns the reason the peer was closed, or nil if the peer
+// is open, was closed without error or is not a ClosingPeer.
+func CloseErr(p Peer) error {
+	if c, ok := p.(ClosingPeer); ok {
+		return c.Err()
+	}
+	return nil
+}
+
 // Pipe creates a synchronous in-memory pipe, where reads on one end are
 // matched with writes on the other. This is useful for direct, in-memory
 // client-server communication.
@@ -31,19 +92,31 @@ func Pipe() (Peer, Peer) {
 	a := &localPeer{
 		incoming: btoa,
 		outgoing: atob,
-		finished: make(chan bool),
+		finished: make(chan struct{}),
 	}
 	b := &localPeer{
 		incoming: atob,
 		outgoing: btoa,
-		finished: make(chan bool),
+		finished: make(chan struct{}),
 	}
+	a.remote, b.remote = b.finished, a.finished
 
 	return a, b
 }
 
+// localPeer is one end of a pipe. Closing the peer closes finished,
+// which unblocks pending sends, then closes the outgoing channel once
+// no send is in progress, so that the other end receives every message
+// sent before the close and then observes the end of the pipe.
 type localPeer struct {
-	finished chan bool
+	once    sync.Once
+	sending sync.RWMutex // held for reading by sends in progress
+
+	mu  sync.Mutex
+	err error
+
+	finished chan struct{}
+	remote   <-chan struct{} // finished channel of the other end
 	outgoing chan<- *Message
 	incoming <-chan *Message
 }
@@ -53,22 +126,65 @@ func (p *localPeer) Receive() <-chan *Message {
 }
 
 func (p *localPeer) Send(m *Message) error {
+	p.sending.RLock()
+	defer p.sending.RUnlock()
 	select {
 	case <-p.finished:
-		return io.EOF
+		return ErrClosed
 	default:
-		p.outgoing <- m
+	}
+	select {
+	case <-p.finished:
+		return ErrClosed
+	case <-p.remote:
+		return ErrClosed
+	case p.outgoing <- m:
 		return nil
 	}
 }
 
 func (p *localPeer) Close() error {
-	close(p.finished)
-	close(p.outgoing)
+	return p.CloseWithError(nil)
+}
+
+func (p *localPeer) CloseWithError(err error) error {
+	closed := false
+	p.once.Do(func() {
+		closed = true
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		close(p.finished)
+
+		p.sending.Lock()
+		close(p.outgoing)
+		p.sending.Unlock()
+	})
+	if !closed {
+		return ErrClosed
+	}
 	return nil
 }
 
+func (p *localPeer) Closed() <-chan struct{} {
+	return p.finished
+}
+
+func (p *localPeer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
 func (p *localPeer) Addr() string {
+	return p.RemoteAddr()
+}
+
+func (p *localPeer) LocalAddr() string {
+	return p.RemoteAddr()
+}
+
+func (p *localPeer) RemoteAddr() string {
 	peerAddrOnce.Do(func() {
 		// get the local address list
 		addr, _ := net.InterfaceAddrs()
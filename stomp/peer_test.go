@@ -1,8 +1,11 @@
 package stomp
 
 import (
-	"io"
+	"errors"
+	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPeer(t *testing.T) {
@@ -19,10 +22,126 @@ func TestPeer(t *testing.T) {
 	a.Close()
 	b.Close()
 
-	if a.Send(nil) != io.EOF {
+	if a.Send(nil) != ErrClosed {
 		t.Errorf("Want error when sending a message to a closed peer")
 	}
-	if b.Send(nil) != io.EOF {
+	if b.Send(nil) != ErrClosed {
 		t.Errorf("Want error when sending a message to a closed peer")
 	}
 }
+
+func TestPeerCloseWithError(t *testing.T) {
+	a, b := Pipe()
+
+	reason := errors.New("connection reset")
+	if err := CloseWithError(a, reason); err != nil {
+		t.Errorf("Want no error closing peer, got %s", err)
+	}
+
+	select {
+	case <-Closed(a):
+	default:
+		t.Errorf("Want closed channel signaled after close")
+	}
+	if CloseErr(a) != reason {
+		t.Errorf("Want close reason recorded, got %v", CloseErr(a))
+	}
+	if a.Close() != ErrClosed {
+		t.Errorf("Want error when closing a closed peer")
+	}
+	if CloseErr(b) != nil {
+		t.Errorf("Want no close reason for open peer, got %v", CloseErr(b))
+	}
+	if addr, ok := a.(AddrPeer); !ok || addr.LocalAddr() == "" || addr.RemoteAddr() == "" {
+		t.Errorf("Want local and remote address for pipe")
+	}
+}
+
+// minimalPeer implements only the Peer interface.
+type minimalPeer struct {
+	Peer
+}
+
+func TestPeerMinimal(t *testing.T) {
+	a, _ := Pipe()
+	p := minimalPeer{a}
+	if err := CloseWithError(p, errors.New("ignored")); err != nil {
+		t.Errorf("Want peer closed, got %s", err)
+	}
+	if Closed(p) != nil || CloseErr(p) != nil {
+		t.Errorf("Want no close signal or reason from a minimal peer")
+	}
+	if a.Send(nil) != ErrClosed {
+		t.Errorf("Want minimal peer closed")
+	}
+}
+
+// sendWhileClosing sends from several goroutines while the peer is
+// closed, and fails if a send panics or succeeds after the close.
+func sendWhileClosing(t *testing.T, peer Peer) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := peer.Send(NewMessage()); err == ErrClosed {
+					return
+				}
+			}
+		}()
+	}
+	peer.Close()
+	wg.Wait()
+	if err := peer.Send(NewMessage()); err != ErrClosed {
+		t.Errorf("Want ErrClosed sending after close, got %v", err)
+	}
+	if err := CloseWithError(peer, errors.New("again")); err != ErrClosed {
+		t.Errorf("Want ErrClosed closing twice, got %v", err)
+	}
+}
+
+func TestPeerConcurrentClose(t *testing.T) {
+	a, b := Pipe()
+	go func() {
+		for m := range b.Receive() {
+			m.Release()
+		}
+	}()
+	sendWhileClosing(t, a)
+	b.Close()
+
+	// a send blocked on a full pipe returns once the other end closes.
+	c, d := Pipe()
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if err := c.Send(NewMessage()); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	d.Close()
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("Want ErrClosed sending to a closed pipe, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Want blocked send released when the other end closes")
+	}
+	c.Close()
+}
+
+func TestConnConcurrentClose(t *testing.T) {
+	a, b := net.Pipe()
+	server := Conn(b)
+	defer server.Close()
+	go func() {
+		for m := range server.Receive() {
+			m.Release()
+		}
+	}()
+	sendWhileClosing(t, Conn(a))
+}
@@ -0,0 +1,78 @@
+package stomp
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/mrwill84/mq/stomp/frame"
+)
+
+// STOMP protocol versions.
+var (
+	STOMP10 = []byte("1.0")
+	STOMP11 = []byte("1.1")
+	STOMP12 = []byte("1.2")
+)
+
+// Versions is the list of supported protocol versions, in the format
+// of the accept-version header, advertised by the client when
+// connecting.
+var Versions = []byte("1.0,1.1,1.2")
+
+// ErrVersion is returned when the peers do not share a protocol version.
+var ErrVersion = errors.New("stomp: unsupported protocol version")
+
+// ErrNack is returned when a NACK is sent using STOMP 1.0, which does
+// not define the NACK frame.
+var ErrNack = errors.New("stomp: nack requires protocol version 1.1 or later")
+
+// Negotiate returns the highest protocol version listed in the
+// accept-version header that is supported by this library. A missing
+// header indicates the peer only supports STOMP 1.0.
+func Negotiate(accept []byte) ([]byte, error) {
+	if len(accept) == 0 {
+		return STOMP10, nil
+	}
+	var proto []byte
+	for _, v := range bytes.Split(accept, []byte{','}) {
+		v = bytes.TrimSpace(v)
+		for _, supported := range [][]byte{STOMP10, STOMP11, STOMP12} {
+			if bytes.Equal(v, supported) && bytes.Compare(v, proto) > 0 {
+				proto = supported
+			}
+		}
+	}
+	if proto == nil {
+		return nil, ErrVersion
+	}
+	return proto, nil
+}
+
+// SupportsNack returns true if the protocol version defines the NACK
+// frame.
+func SupportsNack(proto []byte) bool {
+	return !isSTOMP10(proto)
+}
+
+// supportsHeartbeat returns true if the protocol version defines
+// heart-beating.
+func supportsHeartbeat(proto []byte) bool {
+	return !isSTOMP10(proto)
+}
+
+// escapesHeaders returns true if the protocol version escapes colons,
+// newlines and backslashes in header names and values.
+func escapesHeaders(proto []byte) bool {
+	return len(proto) != 0 && !isSTOMP10(proto)
+}
+
+func isSTOMP10(proto []byte) bool {
+	return bytes.Equal(proto, STOMP10)
+}
+
+// header escaping is implemented by the frame package.
+var (
+	escape      = frame.AppendEscaped
+	needsEscape = frame.NeedsEscape
+	unescape    = frame.Unescape
+)
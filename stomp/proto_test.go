@@ -0,0 +1,93 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+		err    error
+	}{
+		{"", "1.0", nil},
+		{"1.0", "1.0", nil},
+		{"1.0,1.1", "1.1", nil},
+		{"1.2,1.0", "1.2", nil},
+		{"1.1, 1.2, 2.0", "1.2", nil},
+		{"2.0", "", ErrVersion},
+	}
+	for _, test := range tests {
+		got, err := Negotiate([]byte(test.accept))
+		if err != test.err {
+			t.Errorf("Want error %v negotiating %q, got %v", test.err, test.accept, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("Want version %q negotiating %q, got %q", test.want, test.accept, got)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		raw, escaped string
+	}{
+		{"plain", "plain"},
+		{"a:b", `a\cb`},
+		{"line\nbreak\r", `line\nbreak\r`},
+		{`back\slash`, `back\\slash`},
+	}
+	for _, test := range tests {
+		if got := string(escape(nil, []byte(test.raw))); got != test.escaped {
+			t.Errorf("Want %q escaped to %q, got %q", test.raw, test.escaped, got)
+		}
+		if got := string(unescape([]byte(test.escaped))); got != test.raw {
+			t.Errorf("Want %q unescaped to %q, got %q", test.escaped, test.raw, got)
+		}
+	}
+}
+
+func TestTextCodecEscape(t *testing.T) {
+	codec := textCodec{escape: true}
+
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte("/topic/a:b")
+	m.Header.Add([]byte("key"), []byte("line\nbreak"))
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	codec.Encode(w, m)
+	w.Flush()
+
+	if !bytes.Contains(buf.Bytes(), []byte(`destination:/topic/a\cb`)) {
+		t.Errorf("Want destination escaped, got %q", buf.Bytes())
+	}
+
+	frame, err := codec.ReadFrame(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NewMessage()
+	codec.Decode(frame, got)
+	if string(got.Dest) != "/topic/a:b" {
+		t.Errorf("Want destination unescaped, got %q", got.Dest)
+	}
+	if v := got.Header.GetString("key"); v != "line\nbreak" {
+		t.Errorf("Want header unescaped, got %q", v)
+	}
+
+	// connect frames are never escaped.
+	c := NewMessage()
+	c.Method = MethodStomp
+	c.Proto = Versions
+	c.Pass = []byte("pass:word")
+	buf.Reset()
+	codec.Encode(w, c)
+	w.Flush()
+	if !bytes.Contains(buf.Bytes(), []byte("passcode:pass:word")) {
+		t.Errorf("Want connect frame headers unescaped, got %q", buf.Bytes())
+	}
+}
@@ -0,0 +1,139 @@
+package stomp
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/mrwill84/mq/logger"
+)
+
+// ErrProtoType is returned when sending or receiving a protobuf message
+// of a type which is not registered.
+var ErrProtoType = errors.New("stomp: unregistered protobuf message type")
+
+// ProtoMessage is a protobuf message generated with marshalling methods,
+// such as a gogo protobuf message.
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+// protoNamer is implemented by messages generated with the gogo protobuf
+// messagename plugin.
+type protoNamer interface {
+	XXX_MessageName() string
+}
+
+var (
+	protoMu    sync.RWMutex
+	protoNames = map[reflect.Type]string{}
+	protoTypes = map[string]reflect.Type{}
+)
+
+// RegisterProtoType registers the type of the message under its full
+// protobuf type name, such as example.Order. SendProto sets the name in
+// the message-type header, which subscribers may select on, and
+// SubscribeProto decodes messages into the type registered for it.
+// The message must be a pointer.
+//
+//	stomp.RegisterProtoType("example.Order", (*pb.Order)(nil))
+func RegisterProtoType(name string, m ProtoMessage) {
+	t := reflect.TypeOf(m)
+	if t.Kind() != reflect.Ptr {
+		panic("stomp: RegisterProtoType requires a pointer to a message")
+	}
+	protoMu.Lock()
+	protoNames[t] = name
+	protoTypes[name] = t.Elem()
+	protoMu.Unlock()
+}
+
+// ProtoName returns the full protobuf type name of the message, or an
+// empty string if the type is not registered.
+func ProtoName(m ProtoMessage) string {
+	protoMu.RLock()
+	name, ok := protoNames[reflect.TypeOf(m)]
+	protoMu.RUnlock()
+	if !ok {
+		if n, ok := m.(protoNamer); ok {
+			name = n.XXX_MessageName()
+		}
+	}
+	return name
+}
+
+// newProto returns a new message of the registered type.
+func newProto(name string) (ProtoMessage, bool) {
+	protoMu.RLock()
+	t, ok := protoTypes[name]
+	protoMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return reflect.New(t).Interface().(ProtoMessage), true
+}
+
+// SendProto encodes the protobuf message and sends it to the given
+// destination, with the protobuf content type and the full type name
+// of the message in the message-type header.
+func (c *Client) SendProto(dest string, pm ProtoMessage, opts ...MessageOption) error {
+	name := ProtoName(pm)
+	if name == "" {
+		return ErrProtoType
+	}
+	data, err := pm.Marshal()
+	if err != nil {
+		return err
+	}
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte(dest)
+	m.Apply(opts...)
+	m.SetContentType(ContentTypeProtobuf)
+	m.Header.Set(HeaderMessageType, []byte(name))
+	m.Body = data
+	return c.send(m)
+}
+
+// DecodeProto decodes the message body into a new message of the type
+// registered for the message-type header.
+func (m *Message) DecodeProto() (ProtoMessage, error) {
+	pm, ok := newProto(string(m.Header.Get(HeaderMessageType)))
+	if !ok {
+		return nil, ErrProtoType
+	}
+	if err := pm.Unmarshal(m.Body); err != nil {
+		return nil, err
+	}
+	return pm, nil
+}
+
+// ProtoHandler returns a Handler that decodes each message body into a
+// message of the type registered for its message-type header and calls
+// fn. Messages that cannot be decoded are logged and released.
+func ProtoHandler(fn func(*Message, ProtoMessage)) Handler {
+	return HandlerFunc(func(m *Message) {
+		pm, err := m.DecodeProto()
+		if err != nil {
+			logger.Warningf("stomp client: decode %s message: %s",
+				m.Header.Get(HeaderMessageType), err)
+			m.Release()
+			return
+		}
+		fn(m, pm)
+	})
+}
+
+// SubscribeProto subscribes to the destination, decoding each message
+// body as ProtoHandler does.
+//
+//	client.SubscribeProto("/topic/events", func(m *stomp.Message, pm stomp.ProtoMessage) {
+//		defer m.Release()
+//		switch event := pm.(type) {
+//		case *pb.OrderCreated:
+//		}
+//	})
+func (c *Client) SubscribeProto(dest string, fn func(*Message, ProtoMessage), opts ...MessageOption) (*Subscription, error) {
+	return c.Subscribe(dest, ProtoHandler(fn), opts...)
+}
@@ -0,0 +1,50 @@
+package stomp
+
+import "testing"
+
+// farewell is a protobuf message reporting its name.
+type farewell struct {
+	greeting
+}
+
+func (*farewell) XXX_MessageName() string { return "test.Farewell" }
+
+func TestSendProto(t *testing.T) {
+	a, b := Pipe()
+	client := New(a)
+
+	if err := client.SendProto("/topic/greetings", &greeting{text: "hi"}); err != ErrProtoType {
+		t.Errorf("Want ErrProtoType for unregistered message, got %v", err)
+	}
+	RegisterProtoType("test.Greeting", (*greeting)(nil))
+
+	if err := client.SendProto("/topic/greetings", &greeting{text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	m := <-b.Receive()
+	if got := m.ContentType(); got != ContentTypeProtobuf {
+		t.Errorf("Want protobuf content type, got %s", got)
+	}
+	if got := string(m.Header.Get(HeaderMessageType)); got != "test.Greeting" {
+		t.Errorf("Want message-type header, got %s", got)
+	}
+
+	var decoded ProtoMessage
+	ProtoHandler(func(m *Message, pm ProtoMessage) {
+		decoded = pm
+	}).Handle(m)
+	if g, ok := decoded.(*greeting); !ok || g.text != "hi" {
+		t.Errorf("Want message decoded into the registered type, got %#v", decoded)
+	}
+
+	if err := client.SendProto("/topic/greetings", &farewell{greeting{text: "bye"}}); err != nil {
+		t.Fatal(err)
+	}
+	m = <-b.Receive()
+	if got := string(m.Header.Get(HeaderMessageType)); got != "test.Farewell" {
+		t.Errorf("Want message-type from XXX_MessageName, got %s", got)
+	}
+	if _, err := m.DecodeProto(); err != ErrProtoType {
+		t.Errorf("Want ErrProtoType decoding unregistered type, got %v", err)
+	}
+}
@@ -2,65 +2,25 @@ package stomp
 
 import (
 	"bytes"
-	"fmt"
-)
-
-func read(input []byte, m *Message) (err error) {
-	var (
-		pos int
-		off int
-		tot = len(input)
-	)
-
-	// parse the stomp message
-	for ; ; off++ {
-		if off == tot {
-			return fmt.Errorf("stomp: invalid method")
-		}
-		if input[off] == '\n' {
-			m.Method = input[pos:off]
-			off++
-			pos = off
-			break
-		}
-	}
-
-	// parse the stomp headers
-	for {
-		if off == tot {
-			return fmt.Errorf("stomp: unexpected eof")
-		}
-		if input[off] == '\n' {
-			off++
-			pos = off
-			break
-		}
 
-		var (
-			name  []byte
-			value []byte
-		)
+	"github.com/mrwill84/mq/stomp/frame"
+)
 
-	loop:
-		// parse each individual header
-		for ; ; off++ {
-			if off >= tot {
-				return fmt.Errorf("stomp: unexpected eof")
-			}
+// Errors returned parsing malformed frames, each a *BadFrameError.
+var (
+	ErrInvalidMethod error = &BadFrameError{Reason: "invalid method"}
+	ErrUnexpectedEOF error = &BadFrameError{Reason: "unexpected eof"}
+	ErrInvalidHeader error = &BadFrameError{Reason: "invalid header"}
+)
 
-			switch input[off] {
-			case '\n':
-				value = input[pos:off]
-				off++
-				pos = off
-				break loop
-			case ':':
-				name = input[pos:off]
-				off++
-				pos = off
-			}
-		}
+func read(input []byte, m *Message) error {
+	return readFrame(input, m, false)
+}
 
+// readFrame parses the message frame, unescaping header names and
+// values if esc is true. Headers of connect frames are never escaped.
+func readFrame(input []byte, m *Message, esc bool) error {
+	method, body, err := frame.Split(input, esc, func(name, value []byte) {
 		switch {
 		case bytes.Equal(name, HeaderAccept):
 			m.Proto = value
@@ -70,6 +30,8 @@ func read(input []byte, m *Message) (err error) {
 			m.Dest = value
 		case bytes.Equal(name, HeaderExpires):
 			m.Expires = value
+		case bytes.Equal(name, HeaderHost):
+			m.Host = value
 		case bytes.Equal(name, HeaderLogin):
 			m.User = value
 		case bytes.Equal(name, HeaderPass):
@@ -97,12 +59,21 @@ func read(input []byte, m *Message) (err error) {
 		default:
 			m.Header.Add(name, value)
 		}
+	})
+	switch err {
+	case nil:
+	case frame.ErrCommand:
+		return ErrInvalidMethod
+	case frame.ErrEOF:
+		return ErrUnexpectedEOF
+	default:
+		return ErrInvalidHeader
 	}
-
-	if tot > pos {
-		m.Body = input[pos:]
+	m.Method = method
+	if body != nil {
+		m.Body = body
 	}
-	return
+	return nil
 }
 
 const (
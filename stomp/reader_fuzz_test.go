@@ -0,0 +1,21 @@
+//go:build go1.18
+// +build go1.18
+
+package stomp
+
+import "testing"
+
+// FuzzParse checks that parsing and printing arbitrary input never
+// panics.
+func FuzzParse(f *testing.F) {
+	for _, test := range payloads {
+		f.Add([]byte(test.payload))
+	}
+	f.Add(sampleMessage)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message := NewMessage()
+		if err := message.Parse(data); err == nil {
+			_ = message.String()
+		}
+	})
+}
@@ -33,6 +33,10 @@ func TestReadMalformed(t *testing.T) {
 		"STOMP\nversion:",        // no header value
 		"STOMP\nversion:1.1.2",   // no header newline
 		"STOMP\nversion:1.1.2\n", // no newline before eof
+		"stomp\n\n",              // lower case command
+		"ST\xffMP\n\n",           // invalid command byte
+		"SEND\nversion\n\n",      // no header separator
+		"SEND\n:1.2\n\n",         // no header name
 	}
 
 	for _, test := range tests {
@@ -76,3 +80,17 @@ foo
 bar
 baz
 qux`)
+
+func TestReadEmptyValue(t *testing.T) {
+	message := NewMessage()
+	err := message.Parse([]byte("MESSAGE\nsubscription:\ndestination:/queue/test\n\nhello"))
+	if err != nil {
+		t.Fatalf("error parsing message with an empty header value: %s", err)
+	}
+	if len(message.Subs) != 0 {
+		t.Errorf("expect empty subscription, got %q", message.Subs)
+	}
+	if string(message.Dest) != "/queue/test" || string(message.Body) != "hello" {
+		t.Errorf("expect headers and body following the empty value parsed")
+	}
+}
@@ -0,0 +1,83 @@
+package stomp
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// ReadWriterPeer creates a peer that reads and writes messages using
+// rw, such as an SSH channel, a serial port or a custom tunnel. The
+// peer uses STOMP text frames unless the remote peer negotiates an
+// alternate codec.
+//
+// Capabilities of net.Conn are used if rw implements them: rw is closed
+// with the peer if it is an io.Closer, and heart-beat timeouts and write
+// deadlines apply only if rw has SetReadDeadline and SetWriteDeadline
+// methods. If rw is not an io.Closer, the peer stops reading once the
+// remote peer closes its end.
+func ReadWriterPeer(rw io.ReadWriter) Peer {
+	if c, ok := rw.(net.Conn); ok {
+		return Conn(c)
+	}
+	return newConnPeer(rwConn{rw}, TextCodec, ConnConfig{})
+}
+
+// rwConn adapts an io.ReadWriter to a net.Conn.
+type rwConn struct {
+	io.ReadWriter
+}
+
+func (c rwConn) Close() error {
+	if closer, ok := c.ReadWriter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c rwConn) LocalAddr() net.Addr {
+	if a, ok := c.ReadWriter.(interface {
+		LocalAddr() net.Addr
+	}); ok {
+		return a.LocalAddr()
+	}
+	return rwAddr{}
+}
+
+func (c rwConn) RemoteAddr() net.Addr {
+	if a, ok := c.ReadWriter.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		return a.RemoteAddr()
+	}
+	return rwAddr{}
+}
+
+func (c rwConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c rwConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriter.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c rwConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriter.(interface {
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// rwAddr is the address of a ReadWriter without a network address.
+type rwAddr struct{}
+
+func (rwAddr) Network() string { return "readwriter" }
+func (rwAddr) String() string  { return "readwriter" }
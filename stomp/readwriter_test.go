@@ -0,0 +1,49 @@
+package stomp
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// pipeEnd is one end of a pair of io.Pipes, closing its writer on Close.
+type pipeEnd struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (p pipeEnd) Close() error {
+	return p.WriteCloser.Close()
+}
+
+func TestReadWriterPeer(t *testing.T) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+
+	// the broker end has no Close method.
+	broker := ReadWriterPeer(struct {
+		io.Reader
+		io.Writer
+	}{br, bw})
+	go fakeBroker(broker)
+
+	peer := ReadWriterPeer(pipeEnd{ar, aw})
+	if addr := peer.Addr(); addr != "readwriter" {
+		t.Errorf("Want readwriter address, got %s", addr)
+	}
+	client := New(peer)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send("/queue/test", []byte("hello"), WithReceipt()); err != nil {
+		t.Errorf("Want receipt over the ReadWriter, got %s", err)
+	}
+
+	// closing the client closes its writer, ending the broker reader.
+	peer.Close()
+	select {
+	case <-Closed(broker):
+	case <-time.After(time.Second):
+		t.Errorf("Want broker closed when the client closes its end")
+	}
+}
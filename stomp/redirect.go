@@ -0,0 +1,170 @@
+package stomp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/url"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp/dialer"
+)
+
+// redirectLimit is the maximum number of consecutive redirects followed
+// by the client.
+const redirectLimit = 5
+
+var (
+	// ErrRedirectLimit is returned when the client is redirected more
+	// than the redirect limit, for example when servers redirect to each
+	// other.
+	ErrRedirectLimit = errors.New("stomp: too many redirects")
+
+	// ErrRedirectTarget is returned when the server redirects the client
+	// to an address with an unsupported protocol, or to a host the client
+	// does not follow redirects to.
+	ErrRedirectTarget = errors.New("stomp: invalid redirect target")
+
+	errRedirected = errors.New("stomp: redirected")
+)
+
+// WithRedirects returns an Option which configures the client to follow
+// redirect hints sent by the server, such as a read-only replica
+// rejecting a message. The client connects to the address in the
+// redirect header of the error, subscribes again, and sends the rejected
+// message again if it was sent with a receipt.
+//
+// Since the session credentials are sent to the redirect target, the
+// client only follows redirects to the host it dialed, on any port, and
+// to the hosts named, with or without a port.
+func WithRedirects(hosts ...string) Option {
+	return func(c *Client) {
+		c.follow = true
+		c.frames = make(map[string]*Message)
+		c.redirectHosts = append(c.redirectHosts, hosts...)
+	}
+}
+
+// redirectAllowed returns true if the client follows redirects to the
+// target host.
+func (c *Client) redirectAllowed(u *url.URL) bool {
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+	if host == "" {
+		return false
+	}
+	if host == c.host {
+		return true
+	}
+	for _, allowed := range c.redirectHosts {
+		if allowed == host || allowed == u.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectTarget returns the redirect address of the error message, or
+// an empty string if the message is not a redirect or the client does
+// not follow redirects.
+func (c *Client) redirectTarget(m *Message) string {
+	if !c.follow || !bytes.Equal(m.Method, MethodError) {
+		return ""
+	}
+	return string(m.Header.Get(HeaderRedirect))
+}
+
+// dial opens a connection to the redirect target.
+func (c *Client) dial(target string) (Peer, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp", "stomp", "ws", "wss", "http", "https":
+	default:
+		return nil, ErrRedirectTarget
+	}
+	if !c.redirectAllowed(u) {
+		return nil, ErrRedirectTarget
+	}
+	conn, err := dialer.DialConfig(target, c.dialConfig(nil))
+	if err != nil {
+		return nil, err
+	}
+	return c.newPeer(conn), nil
+}
+
+// dialHost returns the host name of the dial target.
+func dialHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return u.Host
+	}
+	return host
+}
+
+// redirect establishes a session with the redirect target, subscribes
+// again, and closes the previous connection.
+func (c *Client) redirect(target string) error {
+	logger.Noticef("stomp client: redirected to %s", target)
+
+	prev := c.conn()
+	next, err := c.dial(target)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	opts := c.connectOpts
+	c.mu.Unlock()
+
+	c.mu.Lock()
+	c.peer = next
+	c.mu.Unlock()
+	if err := c.connect(next, connectFrame(opts), 1); err != nil {
+		// the connection may have been replaced by further redirects.
+		c.conn().Close()
+		c.mu.Lock()
+		c.peer = prev
+		c.mu.Unlock()
+		return err
+	}
+
+	c.mu.Lock()
+	var frames []*Message
+	for _, f := range c.frames {
+		frames = append(frames, f.Clone())
+	}
+	c.mu.Unlock()
+	for _, f := range frames {
+		if err := c.conn().Send(f); err != nil {
+			return err
+		}
+	}
+	return prev.Close()
+}
+
+// subscribeFrame returns a copy of the subscribe message, without the
+// receipt, used to subscribe again after a redirect.
+func subscribeFrame(m *Message) *Message {
+	f := m.Clone()
+	f.Receipt = f.Receipt[:0]
+	return f
+}
+
+// forget releases the subscribe frame and instrument of the
+// subscription. The caller must hold the lock.
+func (c *Client) forget(id string) {
+	if f, ok := c.frames[id]; ok {
+		f.Release()
+		delete(c.frames, id)
+	}
+	delete(c.instruments, id)
+}
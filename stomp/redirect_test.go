@@ -0,0 +1,38 @@
+package stomp
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedirectAllowed(t *testing.T) {
+	c := New(nil)
+	c.host = dialHost("tcp://primary:61613")
+	WithRedirects("replica", "backup:61614")(c)
+
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{"tcp://primary:61613", true},
+		{"tcp://primary:61614", true},
+		{"tcp://replica:61613", true},
+		{"ws://replica:8080/ws", true},
+		{"tcp://backup:61614", true},
+		{"tcp://backup:61613", false},
+		{"tcp://attacker:61613", false},
+		{"tcp://:61613", false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.redirectAllowed(u); got != test.allowed {
+			t.Errorf("%s: want allowed %v, got %v", test.target, test.allowed, got)
+		}
+	}
+	if _, err := c.dial("tcp://attacker:61613"); err != ErrRedirectTarget {
+		t.Errorf("Want ErrRedirectTarget dialing a host not allowed, got %v", err)
+	}
+}
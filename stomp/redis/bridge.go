@@ -0,0 +1,431 @@
+// Package redis implements a bridge that mirrors STOMP topics into Redis
+// Streams. Messages published to a mirrored topic are added to the
+// stream, and entries added to the stream by other systems are read
+// using a consumer group and sent to the topic, enabling persistence and
+// fan-in from systems already using Redis.
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// HeaderEntry is the header set to the stream entry id on messages read
+// from a stream. Messages with the header are not added to the stream
+// again.
+const HeaderEntry = "redis-entry"
+
+// stream entry fields.
+const (
+	fieldBody   = "body"
+	fieldOrigin = "stomp-origin"
+)
+
+// readCount is the maximum number of entries read from the stream at
+// once.
+const readCount = 100
+
+// readBlock is the time the bridge blocks waiting for stream entries.
+var readBlock = time.Second
+
+// maxBackoff is the maximum time the bridge waits before reading the
+// stream again after an error.
+var maxBackoff = 30 * time.Second
+
+// claimIdle is the time a stream entry read by the group remains
+// unacknowledged before the bridge claims it, such as entries read by a
+// bridge which stopped, or entries which could not be sent.
+var claimIdle = time.Minute
+
+// ErrNotTopic is returned when mirroring a destination other than a
+// topic. Mirroring a queue would take messages from its consumers.
+var ErrNotTopic = errors.New("redis: mirrored destination must be a topic")
+
+// topicPrefix prefixes the mirrored destinations.
+var topicPrefix = []byte("/topic/")
+
+// Bridge mirrors STOMP destinations into Redis Streams.
+type Bridge struct {
+	client *stomp.Client
+	addr   string
+	group  string
+	id     string // consumer name of the bridge in the group
+	maxLen int
+
+	writer *conn
+
+	mu      sync.Mutex
+	readers []*conn
+	subs    []*stomp.Subscription
+	done    chan struct{}
+	wg      sync.WaitGroup // consuming goroutines
+}
+
+// Option configures bridge options.
+type Option func(*Bridge)
+
+// WithGroup returns an Option which configures the consumer group used
+// to read stream entries. Bridges sharing a group divide the entries
+// between them, and the messages published to the topic, which are
+// added to the stream once. Entries are tagged with the group, so that
+// entries added by a bridge of the group are not sent to the topic
+// again. Bridges of different brokers mirroring a stream use different
+// groups. The default group is stomp.
+func WithGroup(group string) Option {
+	return func(b *Bridge) {
+		b.group = group
+	}
+}
+
+// WithMaxLen returns an Option which trims streams to approximately n
+// entries as entries are added.
+func WithMaxLen(n int) Option {
+	return func(b *Bridge) {
+		b.maxLen = n
+	}
+}
+
+// New returns a bridge between the STOMP client, which must be
+// connected, and the Redis server at addr.
+func New(client *stomp.Client, addr string, opts ...Option) (*Bridge, error) {
+	b := &Bridge{
+		client: client,
+		addr:   addr,
+		group:  "stomp",
+		id:     string(stomp.Rand()),
+		done:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	writer, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	b.writer = writer
+	return b, nil
+}
+
+// Mirror adds messages published to the topic to the stream, and sends
+// entries added to the stream by other systems to the topic. Stream
+// entries are acknowledged once the server receives the message.
+func (b *Bridge) Mirror(dest, stream string) error {
+	if !bytes.HasPrefix([]byte(dest), topicPrefix) {
+		return ErrNotTopic
+	}
+	reader, err := dial(b.addr)
+	if err != nil {
+		return err
+	}
+	if err := b.createGroup(reader, stream); err != nil {
+		reader.close()
+		return err
+	}
+
+	sub, err := b.client.Subscribe(dest, stomp.HandlerFunc(func(m *stomp.Message) {
+		b.add(stream, m)
+	}), stomp.WithGroup("redis:"+b.group))
+	if err != nil {
+		reader.close()
+		return err
+	}
+
+	b.mu.Lock()
+	b.readers = append(b.readers, reader)
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go b.consume(reader, dest, stream)
+	return nil
+}
+
+// Close stops mirroring and closes the Redis connections. The STOMP
+// client remains connected.
+func (b *Bridge) Close() error {
+	b.mu.Lock()
+	if b.closed() {
+		b.mu.Unlock()
+		return nil
+	}
+	close(b.done)
+	for _, sub := range b.subs {
+		sub.Unsubscribe()
+	}
+	for _, reader := range b.readers {
+		reader.close()
+	}
+	err := b.writer.close()
+	b.mu.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+// createGroup creates the consumer group of the stream, if it does not
+// exist.
+func (b *Bridge) createGroup(c *conn, stream string) error {
+	_, err := c.do("XGROUP", "CREATE", stream, b.group, "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "redis: BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// closed returns true once the bridge is closed.
+func (b *Bridge) closed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// add adds the message to the stream, unless the message was read from
+// a stream.
+func (b *Bridge) add(stream string, m *stomp.Message) {
+	if len(m.Header.Get([]byte(HeaderEntry))) != 0 {
+		return
+	}
+	args := []string{"XADD", stream}
+	if b.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", strconv.Itoa(b.maxLen))
+	}
+	args = append(args, "*", fieldOrigin, b.group, fieldBody, string(m.Body))
+	for i := 0; i < m.Header.Len(); i++ {
+		k, v := m.Header.Index(i)
+		if string(k) == fieldBody || string(k) == fieldOrigin {
+			continue
+		}
+		args = append(args, string(k), string(v))
+	}
+	if err := b.write(args); err != nil {
+		logger.Warningf("redis bridge: add to stream %s: %s", stream, err)
+	}
+}
+
+// write sends the command to the server, dialing the server again if
+// the connection failed.
+func (b *Bridge) write(args []string) error {
+	b.mu.Lock()
+	w := b.writer
+	b.mu.Unlock()
+	_, err := w.do(args...)
+	if _, ok := err.(Error); ok || err == nil {
+		return err
+	}
+
+	next, derr := dial(b.addr)
+	if derr != nil {
+		return err
+	}
+	b.mu.Lock()
+	if b.closed() {
+		b.mu.Unlock()
+		next.close()
+		return err
+	}
+	b.writer = next
+	b.mu.Unlock()
+	w.close()
+	_, err = next.do(args...)
+	return err
+}
+
+// redial replaces the reader connection after an error.
+func (b *Bridge) redial(reader *conn, stream string) (*conn, error) {
+	next, err := dial(b.addr)
+	if err != nil {
+		return reader, err
+	}
+	if err := b.createGroup(next, stream); err != nil {
+		next.close()
+		return reader, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed() {
+		next.close()
+		return reader, nil
+	}
+	for i, r := range b.readers {
+		if r == reader {
+			b.readers[i] = next
+		}
+	}
+	reader.close()
+	return next, nil
+}
+
+// consume reads entries from the stream and sends them to the
+// destination until the bridge is closed. After an error, the bridge
+// waits, backing off up to maxBackoff, and reads again, reconnecting to
+// the server unless the server replied with an error.
+func (b *Bridge) consume(reader *conn, dest, stream string) {
+	defer b.wg.Done()
+	var (
+		block   = strconv.FormatInt(int64(readBlock/time.Millisecond), 10)
+		backoff time.Duration
+		claimed time.Time
+	)
+	for {
+		var (
+			reply interface{}
+			err   error
+		)
+		if time.Since(claimed) >= claimIdle {
+			claimed = time.Now()
+			err = b.claim(reader, dest, stream)
+		}
+		if err == nil {
+			reply, err = reader.do("XREADGROUP", "GROUP", b.group, b.id,
+				"COUNT", strconv.Itoa(readCount),
+				"BLOCK", block,
+				"STREAMS", stream, ">",
+			)
+		}
+		if b.closed() {
+			return
+		}
+		if err != nil {
+			logger.Warningf("redis bridge: read stream %s: %s", stream, err)
+			if backoff *= 2; backoff < readBlock {
+				backoff = readBlock
+			} else if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			select {
+			case <-b.done:
+				return
+			case <-time.After(backoff):
+			}
+			if rerr, ok := err.(Error); !ok {
+				if reader, err = b.redial(reader, stream); err != nil {
+					logger.Warningf("redis bridge: dial %s: %s", b.addr, err)
+				}
+			} else if strings.HasPrefix(string(rerr), "NOGROUP") {
+				b.createGroup(reader, stream)
+			}
+			continue
+		}
+		backoff = 0
+		for _, e := range entries(reply) {
+			b.forward(reader, dest, stream, e)
+		}
+	}
+}
+
+// claim sends the entries of the stream read by the group, but not
+// acknowledged within claimIdle, to the destination.
+func (b *Bridge) claim(reader *conn, dest, stream string) error {
+	reply, err := reader.do("XPENDING", stream, b.group, "-", "+", strconv.Itoa(readCount))
+	if err != nil {
+		return err
+	}
+	idle := int64(claimIdle / time.Millisecond)
+	args := []string{"XCLAIM", stream, b.group, b.id, strconv.FormatInt(idle, 10)}
+	pending, _ := reply.([]interface{})
+	for _, p := range pending {
+		p, _ := p.([]interface{})
+		if len(p) != 4 {
+			continue
+		}
+		id, _ := p[0].(string)
+		if n, _ := p[2].(int64); n >= idle {
+			args = append(args, id)
+		}
+	}
+	if len(args) == 5 {
+		return nil
+	}
+	if reply, err = reader.do(args...); err != nil {
+		return err
+	}
+	items, _ := reply.([]interface{})
+	for _, e := range parseEntries(items) {
+		b.forward(reader, dest, stream, e)
+	}
+	return nil
+}
+
+// forward sends the stream entry to the destination and acknowledges
+// the entry. Entries added by the bridges of the group are acknowledged
+// without sending. Entries which cannot be sent remain pending, and are
+// claimed again once idle.
+func (b *Bridge) forward(reader *conn, dest, stream string, e entry) {
+	var (
+		body []byte
+		opts = []stomp.MessageOption{
+			stomp.WithHeader(HeaderEntry, e.id),
+			stomp.WithReceipt(),
+		}
+	)
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		k, v := e.fields[i], e.fields[i+1]
+		switch k {
+		case fieldOrigin:
+			if v == b.group {
+				reader.do("XACK", stream, b.group, e.id)
+				return
+			}
+		case fieldBody:
+			body = []byte(v)
+		default:
+			opts = append(opts, stomp.WithHeader(k, v))
+		}
+	}
+	if err := b.client.Send(dest, body, opts...); err != nil {
+		logger.Warningf("redis bridge: send entry %s to %s: %s", e.id, dest, err)
+		return
+	}
+	reader.do("XACK", stream, b.group, e.id)
+}
+
+// entry is a stream entry.
+type entry struct {
+	id     string
+	fields []string
+}
+
+// entries returns the stream entries of the XREADGROUP reply.
+func entries(reply interface{}) []entry {
+	var result []entry
+	streams, _ := reply.([]interface{})
+	for _, s := range streams {
+		s, _ := s.([]interface{})
+		if len(s) != 2 {
+			continue
+		}
+		items, _ := s[1].([]interface{})
+		result = append(result, parseEntries(items)...)
+	}
+	return result
+}
+
+// parseEntries returns the stream entries of the reply items. Entries
+// deleted from the stream, returned as nil, are skipped.
+func parseEntries(items []interface{}) []entry {
+	var result []entry
+	for _, item := range items {
+		item, _ := item.([]interface{})
+		if len(item) != 2 {
+			continue
+		}
+		id, _ := item[0].(string)
+		values, _ := item[1].([]interface{})
+		e := entry{id: id}
+		for _, v := range values {
+			f, _ := v.(string)
+			e.fields = append(e.fields, f)
+		}
+		result = append(result, e)
+	}
+	return result
+}
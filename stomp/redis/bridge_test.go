@@ -0,0 +1,401 @@
+package redis
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/server"
+	"github.com/mrwill84/mq/stomp"
+)
+
+func TestConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		c := newConn(b)
+		c.read()
+		b.Write([]byte("*2\r\n$5\r\nhello\r\n*2\r\n:42\r\n$-1\r\n"))
+		c.read()
+		b.Write([]byte("-ERR unknown command\r\n"))
+	}()
+
+	c := newConn(a)
+	reply, err := c.do("PING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 || items[0] != "hello" {
+		t.Fatalf("Want array reply decoded, got %v", reply)
+	}
+	nested := items[1].([]interface{})
+	if nested[0] != int64(42) || nested[1] != nil {
+		t.Errorf("Want integer and nil replies decoded, got %v", nested)
+	}
+	if _, err := c.do("FOO"); err != Error("ERR unknown command") {
+		t.Errorf("Want error reply, got %v", err)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	readBlock = 10 * time.Millisecond
+
+	fake := newFakeRedis(t)
+	defer fake.close()
+
+	s := server.NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	b, err := New(client, fake.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.Mirror("/topic/events", "events"); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer := s.Client()
+	if err := consumer.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Disconnect()
+	received := make(chan *stomp.Message, 10)
+	consumer.Subscribe("/topic/events", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m.Copy()
+	}), stomp.WithReceipt())
+
+	// messages published to the destination are added to the stream.
+	consumer.Send("/topic/events", []byte("hello"),
+		stomp.WithHeader("kind", "greeting"),
+		stomp.WithReceipt(),
+	)
+	<-received
+	e, ok := fake.wait(1)
+	if !ok {
+		t.Fatalf("Want message added to the stream")
+	}
+	if e.get(fieldBody) != "hello" || e.get("kind") != "greeting" {
+		t.Errorf("Want body and headers added to the stream, got %v", e.fields)
+	}
+
+	// entries added by other systems are sent to the destination.
+	fake.add("events", "body", "from redis", "kind", "external")
+	select {
+	case m := <-received:
+		if string(m.Body) != "from redis" || m.Header.GetString("kind") != "external" {
+			t.Errorf("Want stream entry sent to the destination, got %s", m)
+		}
+		if m.Header.GetString(HeaderEntry) == "" {
+			t.Errorf("Want stream entry id header")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want stream entry sent to the destination")
+	}
+
+	// the entry is not added to the stream again, and the entry added
+	// by the bridge is not sent back to the destination.
+	time.Sleep(50 * time.Millisecond)
+	if n := fake.len(); n != 2 {
+		t.Errorf("Want 2 stream entries, got %d", n)
+	}
+	select {
+	case m := <-received:
+		t.Errorf("Want no echo of mirrored messages, got %s", m.Body)
+	default:
+	}
+	if n := fake.acked(); n != 2 {
+		t.Errorf("Want 2 acknowledged entries, got %d", n)
+	}
+}
+
+func TestBridgeRecover(t *testing.T) {
+	defer func(block, backoff, idle time.Duration) {
+		readBlock, maxBackoff, claimIdle = block, backoff, idle
+	}(readBlock, maxBackoff, claimIdle)
+	readBlock, maxBackoff, claimIdle = 10*time.Millisecond, 20*time.Millisecond, 50*time.Millisecond
+
+	fake := newFakeRedis(t)
+	defer fake.close()
+	fake.readPending("body", "abandoned")
+
+	s := server.NewServer()
+	client := s.Client()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	b, err := New(client, fake.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.Mirror("/queue/events", "events"); err != ErrNotTopic {
+		t.Errorf("Want ErrNotTopic mirroring a queue, got %v", err)
+	}
+
+	received := make(chan *stomp.Message, 10)
+	client.Subscribe("/topic/events", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- m.Copy()
+	}), stomp.WithReceipt())
+	if err := b.Mirror("/topic/events", "events"); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries read and not acknowledged by another consumer are claimed.
+	select {
+	case m := <-received:
+		if string(m.Body) != "abandoned" {
+			t.Errorf("Want pending entry claimed, got %s", m.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want pending entry claimed")
+	}
+
+	// entries added by another bridge of the group are not sent.
+	fake.add("events", fieldOrigin, "stomp", fieldBody, "echo")
+
+	// the bridge reconnects once the connection fails.
+	fake.drop()
+	fake.add("events", fieldBody, "after")
+	select {
+	case m := <-received:
+		if string(m.Body) != "after" {
+			t.Errorf("Want entry read after reconnecting, got %s", m.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want entry read after reconnecting")
+	}
+}
+
+// fakeRedis is a minimal Redis server supporting the stream commands
+// used by the bridge, for a single stream.
+type fakeRedis struct {
+	t *testing.T
+	l net.Listener
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	entries []fakeEntry
+	read    int
+	acks    int
+	pending map[string]time.Time // entries read and not acknowledged
+}
+
+type fakeEntry struct {
+	id     string
+	fields []string
+}
+
+func (e fakeEntry) get(name string) string {
+	for i := 0; i+1 < len(e.fields); i += 2 {
+		if e.fields[i] == name {
+			return e.fields[i+1]
+		}
+	}
+	return ""
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{t: t, l: l, pending: make(map[string]time.Time)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, c)
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.l.Addr().String()
+}
+
+func (f *fakeRedis) close() {
+	f.l.Close()
+	f.drop()
+}
+
+// drop closes the client connections.
+func (f *fakeRedis) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	rc := newConn(c)
+	for {
+		v, err := rc.read()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range v.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		switch args[0] {
+		case "XGROUP":
+			c.Write([]byte("+OK\r\n"))
+		case "XADD":
+			var fields []string
+			for i, arg := range args {
+				if arg == "*" {
+					fields = args[i+1:]
+				}
+			}
+			id := f.add(args[1], fields...)
+			c.Write([]byte("$" + strconv.Itoa(len(id)) + "\r\n" + id + "\r\n"))
+		case "XREADGROUP":
+			c.Write([]byte(f.next(args)))
+		case "XACK":
+			f.mu.Lock()
+			for _, id := range args[3:] {
+				delete(f.pending, id)
+				f.acks++
+			}
+			f.mu.Unlock()
+			c.Write([]byte(":1\r\n"))
+		case "XPENDING":
+			c.Write([]byte(f.idle()))
+		case "XCLAIM":
+			c.Write([]byte(f.claim(args[5:])))
+		default:
+			c.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func (f *fakeRedis) add(stream string, fields ...string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := strconv.Itoa(len(f.entries)+1) + "-0"
+	f.entries = append(f.entries, fakeEntry{id: id, fields: fields})
+	return id
+}
+
+// next returns the encoded entries not yet read by the group, waiting
+// briefly for new entries.
+func (f *fakeRedis) next(args []string) string {
+	stream := args[len(args)-2]
+	for i := 0; i < 10; i++ {
+		f.mu.Lock()
+		pending := f.entries[f.read:]
+		f.read = len(f.entries)
+		for _, e := range pending {
+			f.pending[e.id] = time.Now()
+		}
+		f.mu.Unlock()
+		if len(pending) == 0 {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		return "*1\r\n*2\r\n" + bulk(stream) + encode(pending)
+	}
+	return "*-1\r\n"
+}
+
+// readPending adds an entry read by another consumer of the group which
+// stopped before acknowledging the entry.
+func (f *fakeRedis) readPending(fields ...string) {
+	f.add("", fields...)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.read = len(f.entries)
+	f.pending[f.entries[f.read-1].id] = time.Now().Add(-time.Hour)
+}
+
+// idle returns the encoded XPENDING reply.
+func (f *fakeRedis) idle() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := "*" + strconv.Itoa(len(f.pending)) + "\r\n"
+	for id, since := range f.pending {
+		idle := strconv.FormatInt(int64(time.Since(since)/time.Millisecond), 10)
+		out += "*4\r\n" + bulk(id) + bulk("other") + ":" + idle + "\r\n:1\r\n"
+	}
+	return out
+}
+
+// claim returns the encoded XCLAIM reply for the entry ids.
+func (f *fakeRedis) claim(ids []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var claimed []fakeEntry
+	for _, e := range f.entries {
+		for _, id := range ids {
+			if e.id == id {
+				f.pending[id] = time.Now()
+				claimed = append(claimed, e)
+			}
+		}
+	}
+	return encode(claimed)
+}
+
+// encode returns the encoded stream entries.
+func encode(entries []fakeEntry) string {
+	out := "*" + strconv.Itoa(len(entries)) + "\r\n"
+	for _, e := range entries {
+		out += "*2\r\n" + bulk(e.id) + "*" + strconv.Itoa(len(e.fields)) + "\r\n"
+		for _, field := range e.fields {
+			out += bulk(field)
+		}
+	}
+	return out
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// wait waits for the stream to hold n entries and returns the last.
+func (f *fakeRedis) wait(n int) (fakeEntry, bool) {
+	for i := 0; i < 100; i++ {
+		f.mu.Lock()
+		if len(f.entries) >= n {
+			e := f.entries[n-1]
+			f.mu.Unlock()
+			return e, true
+		}
+		f.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fakeEntry{}, false
+}
+
+func (f *fakeRedis) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.entries)
+}
+
+func (f *fakeRedis) acked() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.acks
+}
@@ -0,0 +1,120 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var errProtocol = errors.New("redis: protocol error")
+
+// Error is an error reply from the Redis server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// conn is a connection to a Redis server using the RESP protocol.
+type conn struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func dial(addr string) (*conn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(c), nil
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{
+		conn:   c,
+		reader: bufio.NewReader(c),
+		writer: bufio.NewWriter(c),
+	}
+}
+
+// do sends the command and returns the reply. Replies are decoded as
+// string, int64, []interface{} or nil. Error replies are returned as an
+// Error.
+func (c *conn) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writer.WriteString("*")
+	c.writer.WriteString(strconv.Itoa(len(args)))
+	c.writer.WriteString("\r\n")
+	for _, arg := range args {
+		c.writer.WriteString("$")
+		c.writer.WriteString(strconv.Itoa(len(arg)))
+		c.writer.WriteString("\r\n")
+		c.writer.WriteString(arg)
+		c.writer.WriteString("\r\n")
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read reads a reply.
+func (c *conn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errProtocol
+}
+
+func (c *conn) close() error {
+	return c.conn.Close()
+}
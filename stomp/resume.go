@@ -0,0 +1,63 @@
+package stomp
+
+import "errors"
+
+// ErrSessionExpired is returned by Resume when the server does not hold
+// the previous session, in which case the application must subscribe
+// again.
+var ErrSessionExpired = errors.New("stomp: session expired")
+
+// Session returns the session token issued by the server when the
+// connection was established, or an empty string if the server does not
+// support session resumption.
+func (c *Client) Session() string {
+	return c.session
+}
+
+// Resume opens the connection and resumes the session of the previous
+// client, which must no longer be connected. The subscriptions of the
+// previous client are reattached by the server without subscribing
+// again, and unacknowledged messages are redelivered to the same
+// handlers. If the session cannot be resumed the connection remains
+// open and ErrSessionExpired is returned.
+func (c *Client) Resume(prev *Client, opts ...MessageOption) error {
+	prev.mu.Lock()
+	token := prev.session
+	subs := prev.subs.snapshot()
+	seq := prev.seq
+	prev.mu.Unlock()
+
+	if token == "" {
+		if err := c.Connect(opts...); err != nil {
+			return err
+		}
+		return ErrSessionExpired
+	}
+
+	// the handlers are registered before connecting so that redelivered
+	// messages, which immediately follow the CONNECTED frame, are handled.
+	c.subs.store(subs)
+	c.mu.Lock()
+	if c.seq < seq {
+		c.seq = seq
+	}
+	c.mu.Unlock()
+
+	opts = append(opts, func(m *Message) {
+		m.Header.Add(HeaderSession, []byte(token))
+	})
+	err := c.Connect(opts...)
+	if err == nil && c.resumed {
+		return nil
+	}
+
+	ids := make([]string, 0, len(subs))
+	for id := range subs {
+		ids = append(ids, id)
+	}
+	c.subs.remove(ids...)
+	if err != nil {
+		return err
+	}
+	return ErrSessionExpired
+}
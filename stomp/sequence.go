@@ -0,0 +1,49 @@
+package stomp
+
+import "sync"
+
+// GapFunc is invoked when a subscription receives a message with a
+// sequence number other than the expected sequence number.
+type GapFunc func(dest string, expected, received int64)
+
+// WithGapDetection returns a MessageOption which configures a subscription
+// to report gaps in the sequence numbers stamped on messages by a server
+// with sequencing enabled. Gap detection is intended for topics and
+// exclusive queue subscriptions, where the subscription receives every
+// message sent to the destination.
+func WithGapDetection(fn GapFunc) MessageOption {
+	return subscriptionOption(func(s *Subscription) {
+		s.gapFunc = fn
+	})
+}
+
+// gapDetector is a Handler that tracks message sequence numbers and
+// reports gaps before invoking the next handler.
+type gapDetector struct {
+	sync.Mutex
+	handler Handler
+	report  GapFunc
+	last    int64
+}
+
+func (g *gapDetector) Handle(m *Message) {
+	seq := ParseInt64(m.Header.Get(HeaderSequence))
+	if seq != 0 {
+		g.Lock()
+		last := g.last
+		if seq > g.last {
+			g.last = seq
+		}
+		g.Unlock()
+
+		if last != 0 && seq != last+1 {
+			g.report(string(m.Dest), last+1, seq)
+		}
+	}
+	g.handler.Handle(m)
+}
+
+// stop stops the next handler.
+func (g *gapDetector) stop() {
+	stopHandler(g.handler)
+}
@@ -0,0 +1,23 @@
+package stomp
+
+import "testing"
+
+func TestGapDetector(t *testing.T) {
+	var gaps [][2]int64
+	g := &gapDetector{
+		handler: HandlerFunc(func(*Message) {}),
+		report: func(dest string, expected, received int64) {
+			gaps = append(gaps, [2]int64{expected, received})
+		},
+	}
+
+	for _, seq := range []string{"1", "2", "4", "5"} {
+		m := NewMessage()
+		m.Header.Add(HeaderSequence, []byte(seq))
+		g.Handle(m)
+	}
+
+	if len(gaps) != 1 || gaps[0] != [2]int64{3, 4} {
+		t.Errorf("Want gap detected between sequence 2 and 4, got %v", gaps)
+	}
+}
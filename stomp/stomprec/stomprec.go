@@ -0,0 +1,281 @@
+// Package stomprec records the frames of a STOMP session and replays
+// them, so that regression tests can capture real broker interactions
+// once and assert client behavior deterministically.
+//
+// A session is recorded by wrapping the client peer:
+//
+//	f, _ := os.Create("testdata/session.rec")
+//	client := stomp.New(stomprec.Record(stomp.Conn(conn), f))
+//
+// and replayed in place of the broker:
+//
+//	script, _ := stomprec.LoadFile("testdata/session.rec")
+//	a, b := stomp.Pipe()
+//	go func() { errc <- script.Serve(b) }()
+//	client := stomp.New(a)
+//
+// A recording is a sequence of entries, each a direction line followed
+// by the frame in STOMP text wire format. Heart-beats are not recorded.
+package stomprec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/stomp"
+	"github.com/mrwill84/mq/stomp/frame"
+)
+
+// Directions of recorded frames.
+const (
+	Sent     = '>' // frame sent by the recorded peer
+	Received = '<' // frame received by the recorded peer
+)
+
+var (
+	// ErrFormat is returned when a recording is malformed.
+	ErrFormat = errors.New("stomprec: invalid recording")
+
+	// ErrClosed is returned when the peer closes before the script ends.
+	ErrClosed = errors.New("stomprec: peer closed")
+
+	// ErrTimeout is returned when the peer does not send an expected
+	// frame within the script timeout.
+	ErrTimeout = errors.New("stomprec: timeout waiting for frame")
+)
+
+// Entry is a recorded frame.
+type Entry struct {
+	Dir     byte // Sent or Received
+	Message *stomp.Message
+}
+
+// Record returns a peer which writes the frames sent and received by
+// the peer to w. A failed write closes the peer with the write error.
+func Record(peer stomp.Peer, w io.Writer) stomp.Peer {
+	r := &recorder{
+		Peer:     peer,
+		w:        bufio.NewWriter(w),
+		incoming: make(chan *stomp.Message),
+	}
+	go r.forward()
+	return r
+}
+
+type recorder struct {
+	stomp.Peer
+
+	mu       sync.Mutex
+	w        *bufio.Writer
+	incoming chan *stomp.Message
+}
+
+func (r *recorder) Send(m *stomp.Message) error {
+	r.record(Sent, m)
+	return r.Peer.Send(m)
+}
+
+func (r *recorder) Receive() <-chan *stomp.Message {
+	return r.incoming
+}
+
+func (r *recorder) CloseWithError(err error) error {
+	return stomp.CloseWithError(r.Peer, err)
+}
+
+func (r *recorder) Closed() <-chan struct{} {
+	return stomp.Closed(r.Peer)
+}
+
+func (r *recorder) Err() error {
+	return stomp.CloseErr(r.Peer)
+}
+
+// forward records the messages received by the peer and passes them to
+// the receiver.
+func (r *recorder) forward() {
+	defer close(r.incoming)
+	for m := range r.Peer.Receive() {
+		r.record(Received, m)
+		select {
+		case r.incoming <- m:
+		case <-stomp.Closed(r.Peer):
+			m.Release()
+			return
+		}
+	}
+}
+
+func (r *recorder) record(dir byte, m *stomp.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := writeEntry(r.w, dir, m); err != nil {
+		stomp.CloseWithError(r.Peer, err)
+	}
+}
+
+// writeEntry writes the direction line and the frame, and flushes the
+// entry to the underlying writer.
+func writeEntry(w *bufio.Writer, dir byte, m *stomp.Message) error {
+	w.WriteByte(dir)
+	w.WriteByte('\n')
+	stomp.TextCodec.Encode(w, m)
+	w.WriteByte('\n')
+	return w.Flush()
+}
+
+// Script is a recorded session replayed against a peer.
+type Script struct {
+	Entries []Entry
+
+	// Ignore lists headers which are not compared, such as timestamps
+	// that change between runs.
+	Ignore []string
+
+	// Timeout is the time to wait for each frame expected from the
+	// peer, five seconds if zero.
+	Timeout time.Duration
+}
+
+// Load reads a recording.
+func Load(r io.Reader) (*Script, error) {
+	br := bufio.NewReader(r)
+	s := new(Script)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return s, nil
+		}
+		if err != nil {
+			return nil, ErrFormat
+		}
+		if line == "\n" {
+			continue
+		}
+		if len(line) != 2 || line[0] != Sent && line[0] != Received {
+			return nil, ErrFormat
+		}
+		b, err := stomp.TextCodec.ReadFrame(br, nil)
+		if err != nil {
+			return nil, ErrFormat
+		}
+		m := stomp.NewMessage()
+		if err := stomp.TextCodec.Decode(b, m); err != nil {
+			return nil, ErrFormat
+		}
+		s.Entries = append(s.Entries, Entry{Dir: line[0], Message: m})
+	}
+}
+
+// LoadFile reads the recording in the named file.
+func LoadFile(name string) (*Script, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Serve replays the script against the peer in place of the recorded
+// remote peer: frames received by the recorded peer are sent, and each
+// frame sent by the recorded peer must next be received from the peer.
+// Serve returns a *MismatchError for an unexpected frame.
+//
+// Receipt ids are random, so they are not compared. Receipts sent in
+// reply carry the receipt id of the matching frame from the peer.
+func (s *Script) Serve(peer stomp.Peer) error {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	receipts := map[string][]byte{} // recorded receipt ids to the peer's
+	for i, e := range s.Entries {
+		if e.Dir == Received {
+			m := e.Message.Clone()
+			if receipt, ok := receipts[string(m.Receipt)]; ok {
+				m.Receipt = receipt
+			}
+			if err := peer.Send(m); err != nil {
+				return err
+			}
+			continue
+		}
+		select {
+		case m, ok := <-peer.Receive():
+			if !ok {
+				return ErrClosed
+			}
+			if len(e.Message.Receipt) != 0 {
+				receipts[string(e.Message.Receipt)] = append([]byte(nil), m.Receipt...)
+			}
+			err := s.compare(i, e.Message, m)
+			m.Release()
+			if err != nil {
+				return err
+			}
+		case <-time.After(timeout):
+			return ErrTimeout
+		}
+	}
+	return nil
+}
+
+// compare returns a *MismatchError if the frames differ in their
+// command, body, or headers not ignored by the script.
+func (s *Script) compare(i int, want, got *stomp.Message) error {
+	w, g := s.normalize(want), s.normalize(got)
+	if !bytes.Equal(w, g) {
+		return &MismatchError{Index: i, Want: string(w), Got: string(g)}
+	}
+	return nil
+}
+
+// normalize returns the text frame of the message without the ignored
+// headers.
+func (s *Script) normalize(m *stomp.Message) []byte {
+	b := m.Bytes()
+	f, err := frame.Parse(b, false)
+	if err != nil {
+		return b
+	}
+	headers := f.Headers[:0]
+	for _, h := range f.Headers {
+		switch {
+		case s.ignored(h.Name):
+		case bytes.Equal(h.Name, stomp.HeaderReceipt):
+			headers = append(headers, frame.Header{Name: h.Name, Value: []byte("*")})
+		default:
+			headers = append(headers, h)
+		}
+	}
+	f.Headers = headers
+	return frame.Append(nil, f, false)
+}
+
+func (s *Script) ignored(name []byte) bool {
+	for _, ignore := range s.Ignore {
+		if string(name) == ignore {
+			return true
+		}
+	}
+	return false
+}
+
+// MismatchError is returned by Serve when the peer sends a frame other
+// than the recorded frame.
+type MismatchError struct {
+	Index int    // index of the script entry
+	Want  string // recorded frame
+	Got   string // frame received from the peer
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("stomprec: frame %d: want\n%s\ngot\n%s", e.Index, e.Want, e.Got)
+}
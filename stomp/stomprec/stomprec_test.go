@@ -0,0 +1,94 @@
+package stomprec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrwill84/mq/server"
+	"github.com/mrwill84/mq/stomp"
+)
+
+// session subscribes to a queue, sends a message to it and waits for the
+// message, returning the message body.
+func session(t *testing.T, client *stomp.Client, body string) string {
+	received := make(chan string, 1)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Subscribe("/queue/rec", stomp.HandlerFunc(func(m *stomp.Message) {
+		received <- string(m.Body)
+	}), stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send("/queue/rec", []byte(body), stomp.WithReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		return got
+	case <-time.After(time.Second):
+		t.Fatal("Want message received")
+	}
+	return ""
+}
+
+func TestRecordReplay(t *testing.T) {
+	a, b := stomp.Pipe()
+	go server.NewServer().ServePeer(b)
+
+	var rec bytes.Buffer
+	client := stomp.New(Record(a, &rec))
+	if got := session(t, client, "hello"); got != "hello" {
+		t.Fatalf("Want hello from the broker, got %s", got)
+	}
+	a.Close()
+
+	script, err := Load(bytes.NewReader(rec.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, e := range script.Entries {
+		dirs = append(dirs, string(e.Dir)+string(e.Message.Method))
+	}
+	if want := ">STOMP <CONNECTED >SUBSCRIBE <RECEIPT >SEND <MESSAGE <RECEIPT"; strings.Join(dirs, " ") != want {
+		t.Fatalf("Want frames %s recorded, got %s", want, strings.Join(dirs, " "))
+	}
+
+	// the replayed session receives the recorded broker frames.
+	a, b = stomp.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- script.Serve(b) }()
+	if got := session(t, stomp.New(a), "hello"); got != "hello" {
+		t.Errorf("Want recorded message replayed, got %s", got)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Want replay to match the recording, got %s", err)
+	}
+
+	// a client sending other frames fails the replay.
+	a, b = stomp.Pipe()
+	go func() { errc <- script.Serve(b) }()
+	client = stomp.New(a)
+	client.Connect()
+	client.Send("/queue/other", nil)
+	err = <-errc
+	if e, ok := err.(*MismatchError); !ok || e.Index != 2 {
+		t.Errorf("Want mismatch at frame 2, got %v", err)
+	}
+	a.Close()
+}
+
+func TestLoadMalformed(t *testing.T) {
+	for _, rec := range []string{
+		"?\nSEND\n\n\x00\n",
+		">\nSEND\n\n",
+		">",
+	} {
+		if _, err := Load(strings.NewReader(rec)); err != ErrFormat {
+			t.Errorf("Want ErrFormat loading %q, got %v", rec, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package stomp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrwill84/mq/logger"
+)
+
+// StreamChunkSize is the maximum body size of each frame sent by
+// SendReader. Streams larger than the chunk size are sent as a sequence
+// of frames, keeping each frame well below the connection buffer limit.
+var StreamChunkSize = 256 << 10
+
+// StreamTimeout is the time a stream receiver waits for the next chunk
+// before the stream is interrupted with ErrStreamTimeout, so that the
+// receiver does not wait forever for a producer that died.
+var StreamTimeout = time.Minute
+
+// StreamBuffer is the number of chunks buffered for each stream while
+// the handler reads the stream. A stream whose handler falls further
+// behind is interrupted with ErrStreamOverflow.
+var StreamBuffer = 16
+
+var (
+	// ErrStreamInterrupted is returned by the stream reader when the
+	// subscription ends before the final chunk is received.
+	ErrStreamInterrupted = errors.New("stomp: stream interrupted")
+
+	// ErrStreamAborted is returned by the stream reader when the
+	// producer aborts the stream.
+	ErrStreamAborted = errors.New("stomp: stream aborted")
+
+	// ErrStreamTimeout is returned by the stream reader when no chunk
+	// is received for StreamTimeout.
+	ErrStreamTimeout = errors.New("stomp: stream timeout")
+
+	// ErrStreamSequence is returned by the stream reader when a chunk
+	// is received out of order.
+	ErrStreamSequence = errors.New("stomp: stream chunk out of sequence")
+
+	// ErrStreamOverflow is returned by the stream reader when the
+	// handler does not keep up with the incoming chunks.
+	ErrStreamOverflow = errors.New("stomp: stream buffer full")
+)
+
+// StreamHandler handles a message stream. The message holds the headers
+// of the first chunk and the reader yields the stream body.
+//
+// The handler is invoked in its own goroutine, so that a handler
+// reading the stream does not block incoming messages, and must read
+// the stream to completion.
+type StreamHandler interface {
+	HandleStream(*Message, io.Reader)
+}
+
+// The StreamHandlerFunc type is an adapter to allow the use of an
+// ordinary function as a stream handler.
+type StreamHandlerFunc func(*Message, io.Reader)
+
+// HandleStream calls f(m, r).
+func (f StreamHandlerFunc) HandleStream(m *Message, r io.Reader) { f(m, r) }
+
+// SendReader sends the contents of the reader to the given destination
+// as a stream of chunked frames. The size is sent to the receiver as a
+// hint, and may be negative if unknown. Stream chunks must be received
+// in order by a single consumer, and should therefore be sent to topics
+// or to queues with an exclusive subscription. If reading fails, the
+// stream is aborted so that the receiver does not wait for the
+// remaining chunks.
+func (c *Client) SendReader(dest string, r io.Reader, size int64, opts ...MessageOption) error {
+	id := Rand()
+	buf := make([]byte, StreamChunkSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			c.abortStream(dest, id, i, err, opts)
+			return err
+		}
+
+		m := NewMessage()
+		m.Method = MethodSend
+		m.Dest = []byte(dest)
+		m.Body = append([]byte(nil), buf[:n]...)
+		m.Header.Add(HeaderStream, id)
+		m.Header.Add(HeaderChunk, strconv.AppendInt(nil, int64(i), 10))
+		if size >= 0 {
+			m.Header.Add(HeaderStreamSize, strconv.AppendInt(nil, size, 10))
+		}
+		if last {
+			m.Header.Add(HeaderStreamEnd, []byte("true"))
+		}
+		m.Apply(opts...)
+		if err := c.sendMessage(m); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// abortStream sends the chunk that aborts the stream.
+func (c *Client) abortStream(dest string, id []byte, i int, err error, opts []MessageOption) {
+	m := NewMessage()
+	m.Method = MethodSend
+	m.Dest = []byte(dest)
+	m.Header.Add(HeaderStream, id)
+	m.Header.Add(HeaderChunk, strconv.AppendInt(nil, int64(i), 10))
+	m.Header.Add(HeaderStreamAbort, []byte(err.Error()))
+	m.Apply(opts...)
+	if err := c.sendMessage(m); err != nil {
+		logger.Warningf("stomp client: abort stream %s: %s", id, err)
+	}
+}
+
+// SubscribeStream subscribes to the given destination, reassembling
+// messages sent with SendReader into streams. Messages that are not
+// part of a stream are handled as single chunk streams.
+func (c *Client) SubscribeStream(dest string, handler StreamHandler, opts ...MessageOption) (*Subscription, error) {
+	return c.Subscribe(dest, newStreamer(handler), opts...)
+}
+
+// streamer is a Handler that reassembles chunked messages into streams.
+// Chunks are handed off to a goroutine per stream, which writes them to
+// the pipe read by the handler.
+type streamer struct {
+	sync.Mutex
+	handler StreamHandler
+	streams map[string]*stream
+}
+
+// stream is a stream in progress.
+type stream struct {
+	w      *io.PipeWriter
+	chunks chan []byte // chunks waiting to be written to the pipe
+	next   int64       // sequence number of the next chunk
+	timer  *time.Timer // interrupts the stream if no chunk arrives
+}
+
+func newStreamer(handler StreamHandler) *streamer {
+	return &streamer{
+		handler: handler,
+		streams: make(map[string]*stream),
+	}
+}
+
+func (s *streamer) Handle(m *Message) {
+	id := m.Header.Get(HeaderStream)
+	if len(id) == 0 {
+		go s.handler.HandleStream(m, bytes.NewReader(m.Body))
+		return
+	}
+	chunk := ParseInt64(m.Header.Get(HeaderChunk))
+
+	s.Lock()
+	defer s.Unlock()
+	st, ok := s.streams[string(id)]
+	if !ok {
+		// the remaining chunks of an interrupted stream are discarded.
+		if chunk != 0 {
+			logger.Noticef("stomp client: discard chunk %d of stream %s", chunk, id)
+			return
+		}
+		st = s.open(string(id), m)
+	}
+
+	switch {
+	case chunk != st.next:
+		s.end(string(id), st, ErrStreamSequence)
+		return
+	case len(m.Header.Get(HeaderStreamAbort)) != 0:
+		s.end(string(id), st, ErrStreamAborted)
+		return
+	}
+	st.next++
+	st.timer.Reset(StreamTimeout)
+
+	select {
+	case st.chunks <- append([]byte(nil), m.Body...):
+	default:
+		s.end(string(id), st, ErrStreamOverflow)
+		return
+	}
+	if m.Header.GetBool(string(HeaderStreamEnd)) {
+		s.end(string(id), st, nil)
+	}
+}
+
+// open starts the stream beginning with the message, and the handler
+// reading it. The caller must hold the lock.
+func (s *streamer) open(id string, m *Message) *stream {
+	r, w := io.Pipe()
+	st := &stream{
+		w:      w,
+		chunks: make(chan []byte, StreamBuffer),
+	}
+	st.timer = time.AfterFunc(StreamTimeout, func() {
+		s.Lock()
+		if s.streams[id] == st {
+			s.end(id, st, ErrStreamTimeout)
+		}
+		s.Unlock()
+	})
+	s.streams[id] = st
+
+	head := m.Clone()
+	head.Body = nil
+	go func() {
+		s.handler.HandleStream(head, r)
+		// unblock writes if the handler returns before reading
+		// the stream to completion.
+		r.CloseWithError(io.ErrClosedPipe)
+	}()
+	go func() {
+		// write errors indicate the handler stopped reading or the
+		// stream was interrupted, in which case remaining chunks are
+		// discarded.
+		for b := range st.chunks {
+			w.Write(b)
+		}
+		w.Close()
+	}()
+	return st
+}
+
+// end removes the stream. The stream ends once the buffered chunks are
+// read, or immediately with err if err is not nil. The caller must hold
+// the lock.
+func (s *streamer) end(id string, st *stream, err error) {
+	delete(s.streams, id)
+	st.timer.Stop()
+	if err != nil {
+		st.w.CloseWithError(err)
+	}
+	close(st.chunks)
+}
+
+// stop interrupts streams that are in progress.
+func (s *streamer) stop() {
+	s.Lock()
+	defer s.Unlock()
+	for id, st := range s.streams {
+		s.end(id, st, ErrStreamInterrupted)
+	}
+}
@@ -0,0 +1,174 @@
+package stomp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSendReader(t *testing.T) {
+	defer func(size int) { StreamChunkSize = size }(StreamChunkSize)
+	StreamChunkSize = 4
+
+	a, b := Pipe()
+	client := New(a)
+
+	body := []byte("hello world")
+	if err := client.SendReader("/topic/test", bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		got    []byte
+		chunks int
+	)
+	for {
+		m := <-b.Receive()
+		chunks++
+		got = append(got, m.Body...)
+		if m.Header.GetInt64("stream-size") != int64(len(body)) {
+			t.Errorf("Want stream-size header %d", len(body))
+		}
+		if m.Header.GetBool("stream-end") {
+			break
+		}
+	}
+	if chunks != 3 {
+		t.Errorf("Want body sent in 3 chunks, got %d", chunks)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("Want chunks to reassemble the body, got %q", got)
+	}
+}
+
+func TestStreamer(t *testing.T) {
+	done := make(chan []byte)
+	s := newStreamer(StreamHandlerFunc(func(m *Message, r io.Reader) {
+		b, _ := ioutil.ReadAll(r)
+		done <- b
+	}))
+
+	s.Handle(streamChunk("1", 0, "hello "))
+	end := streamChunk("1", 1, "world")
+	end.Header.Add(HeaderStreamEnd, []byte("true"))
+	s.Handle(end)
+	if got := <-done; string(got) != "hello world" {
+		t.Errorf("Want stream reassembled, got %q", got)
+	}
+	if len(s.streams) != 0 {
+		t.Errorf("Want completed stream removed")
+	}
+}
+
+// streamChunk returns chunk i of the stream with the given id.
+func streamChunk(id string, i int, body string) *Message {
+	m := NewMessage()
+	m.Header.Add(HeaderStream, []byte(id))
+	m.Header.Add(HeaderChunk, []byte(strconv.Itoa(i)))
+	m.Body = []byte(body)
+	return m
+}
+
+func TestStreamerFailures(t *testing.T) {
+	defer func(d time.Duration) { StreamTimeout = d }(StreamTimeout)
+	StreamTimeout = 20 * time.Millisecond
+
+	abort := streamChunk("1", 1, "")
+	abort.Header.Add(HeaderStreamAbort, []byte("read failed"))
+	tests := []struct {
+		chunks []*Message
+		err    error
+	}{
+		{[]*Message{streamChunk("1", 0, "hello"), streamChunk("1", 2, "world")}, ErrStreamSequence},
+		{[]*Message{streamChunk("1", 0, "hello"), abort}, ErrStreamAborted},
+		{[]*Message{streamChunk("1", 0, "hello")}, ErrStreamTimeout},
+	}
+	for _, test := range tests {
+		done := make(chan error)
+		s := newStreamer(StreamHandlerFunc(func(m *Message, r io.Reader) {
+			_, err := ioutil.ReadAll(r)
+			done <- err
+		}))
+		for _, m := range test.chunks {
+			s.Handle(m)
+		}
+		select {
+		case err := <-done:
+			if err != test.err {
+				t.Errorf("Want %v, got %v", test.err, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Want stream interrupted with %v", test.err)
+		}
+	}
+}
+
+func TestStreamerAsync(t *testing.T) {
+	defer func(n int) { StreamBuffer = n }(StreamBuffer)
+	StreamBuffer = 1
+
+	release := make(chan struct{})
+	done := make(chan error)
+	s := newStreamer(StreamHandlerFunc(func(m *Message, r io.Reader) {
+		<-release
+		_, err := ioutil.ReadAll(r)
+		done <- err
+	}))
+
+	// chunks are handed off without waiting for the handler to read
+	// them, and a handler that falls behind the buffer is interrupted.
+	for i := 0; i < 4; i++ {
+		s.Handle(streamChunk("1", i, "hello"))
+	}
+	close(release)
+	if err := <-done; err != ErrStreamOverflow {
+		t.Errorf("Want ErrStreamOverflow, got %v", err)
+	}
+}
+
+func TestStreamerInterrupted(t *testing.T) {
+	done := make(chan error)
+	s := newStreamer(StreamHandlerFunc(func(m *Message, r io.Reader) {
+		_, err := ioutil.ReadAll(r)
+		done <- err
+	}))
+
+	m := NewMessage()
+	m.Header.Add(HeaderStream, []byte("1"))
+	m.Body = []byte("hello")
+	s.Handle(m)
+	s.stop()
+
+	if err := <-done; err != ErrStreamInterrupted {
+		t.Errorf("Want ErrStreamInterrupted, got %v", err)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) { return 0, r.err }
+
+func TestSendReaderAbort(t *testing.T) {
+	a, b := Pipe()
+	client := New(a)
+
+	failed := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader([]byte("hello")), errReader{failed})
+	go func() {
+		if err := client.SendReader("/topic/test", r, -1); err != failed {
+			t.Errorf("Want read error returned, got %v", err)
+		}
+	}()
+
+	m := <-b.Receive()
+	if got := m.Header.GetString("stream-abort"); got != failed.Error() {
+		t.Errorf("Want stream aborted with the read error, got %q", got)
+	}
+	if got := m.Header.GetInt64("chunk"); got != 0 {
+		t.Errorf("Want abort sent as the next chunk, got chunk %d", got)
+	}
+}
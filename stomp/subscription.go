@@ -0,0 +1,118 @@
+package stomp
+
+import "sync"
+
+// Subscription is a subscription of a client to a destination.
+type Subscription struct {
+	client   *Client
+	id       []byte
+	dest     string
+	inst     *instrument
+	messages *chanHandler
+
+	// settings of subscription options
+	workers   int
+	orderKey  []byte
+	gapFunc   GapFunc
+	fence     bool
+	staleFunc StaleFunc
+	budget    *ErrorBudget
+	offsets   OffsetStore
+}
+
+// subscriptionOption returns a MessageOption which configures the
+// subscription created by Client.Subscribe. It has no effect on the
+// frame or on other messages.
+func subscriptionOption(fn func(*Subscription)) MessageOption {
+	return func(m *Message) {
+		if m.sub != nil {
+			fn(m.sub)
+		}
+	}
+}
+
+// ID returns the subscription id.
+func (s *Subscription) ID() []byte {
+	return s.id
+}
+
+// Destination returns the subscribed destination.
+func (s *Subscription) Destination() string {
+	return s.dest
+}
+
+// Unsubscribe ends the subscription. The Messages channel is closed.
+func (s *Subscription) Unsubscribe(opts ...MessageOption) error {
+	return s.client.Unsubscribe(s.id, opts...)
+}
+
+// Pause stops delivering messages to the subscription, without
+// unsubscribing. Messages sent to a queue while the subscription is
+// paused are delivered to other subscribers or held by the server until
+// it resumes. Messages sent to a topic are held by the client until it
+// resumes.
+func (s *Subscription) Pause() error {
+	return s.inst.pause()
+}
+
+// Resume resumes delivery to a paused subscription, restoring its
+// current selector and prefetch count, and delivers the messages held
+// while paused.
+func (s *Subscription) Resume() error {
+	return s.inst.resume(false)
+}
+
+// Messages returns the channel of messages received by a subscription
+// created with a nil handler, or nil otherwise. The receiver owns and
+// releases the messages. The channel is closed when the subscription
+// ends or the connection closes, unless the session can be resumed, and
+// is unbuffered, so a receiver that falls behind holds back
+// the delivery of messages to the client.
+func (s *Subscription) Messages() <-chan *Message {
+	if s.messages == nil {
+		return nil
+	}
+	return s.messages.c
+}
+
+// chanHandler is a Handler that delivers messages to a channel.
+type chanHandler struct {
+	c    chan *Message
+	done chan struct{}
+	once sync.Once
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newChanHandler() *chanHandler {
+	return &chanHandler{
+		c:    make(chan *Message),
+		done: make(chan struct{}),
+	}
+}
+
+func (h *chanHandler) Handle(m *Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		m.Release()
+		return
+	}
+	select {
+	case h.c <- m:
+	case <-h.done:
+		m.Release()
+	}
+}
+
+// stop closes the channel once pending deliveries are abandoned.
+func (h *chanHandler) stop() {
+	h.once.Do(func() {
+		close(h.done)
+		h.mu.Lock()
+		h.closed = true
+		close(h.c)
+		h.mu.Unlock()
+	})
+}
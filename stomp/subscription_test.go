@@ -0,0 +1,130 @@
+package stomp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSubscription(t *testing.T) {
+	a, b := Pipe()
+	frames := make(chan *Message, 10)
+	go func() {
+		for m := range b.Receive() {
+			if bytes.Equal(m.Method, MethodStomp) {
+				reply := NewMessage()
+				reply.Method = MethodConnected
+				b.Send(reply)
+				continue
+			}
+			frames <- m
+		}
+	}()
+
+	client := New(a)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	sub, err := client.Subscribe("/queue/test", nil, WithSelector("kind == 'order'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Destination() != "/queue/test" {
+		t.Errorf("Want destination /queue/test, got %s", sub.Destination())
+	}
+	<-frames
+
+	m := NewMessage()
+	m.Method = MethodMessage
+	m.Dest = []byte("/queue/test")
+	m.Subs = sub.ID()
+	m.Body = []byte("hello")
+	b.Send(m)
+	select {
+	case got := <-sub.Messages():
+		if string(got.Body) != "hello" {
+			t.Errorf("Want message delivered to the channel, got %q", got.Body)
+		}
+		got.Release()
+	case <-time.After(time.Second):
+		t.Fatalf("Want message delivered to the channel")
+	}
+
+	sub.Pause()
+	sub.Resume()
+	for _, want := range []string{pauseSelector, "kind == 'order'"} {
+		got := <-frames
+		if !bytes.Equal(got.ID, sub.ID()) || string(got.Selector) != want {
+			t.Errorf("Want subscription updated with selector %q, got %q", want, got.Selector)
+		}
+		got.Release()
+	}
+
+	sub.Unsubscribe()
+	if got := <-frames; !bytes.Equal(got.Method, MethodUnsubscribe) || !bytes.Equal(got.ID, sub.ID()) {
+		t.Errorf("Want UNSUBSCRIBE frame, got %s", got.Method)
+	}
+	if _, ok := <-sub.Messages(); ok {
+		t.Errorf("Want messages channel closed on unsubscribe")
+	}
+}
+
+func TestSubscriptionHandler(t *testing.T) {
+	a, b := Pipe()
+	go func() {
+		for m := range b.Receive() {
+			m.Release()
+		}
+	}()
+	client := New(a)
+	defer client.Disconnect()
+
+	sub, err := client.Subscribe("/topic/test", HandlerFunc(func(m *Message) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Messages() != nil {
+		t.Errorf("Want no messages channel for a handler subscription")
+	}
+}
+
+func TestSubscriptionClosed(t *testing.T) {
+	for _, disconnect := range []bool{true, false} {
+		a, b := Pipe()
+		go func() {
+			for m := range b.Receive() {
+				if bytes.Equal(m.Method, MethodStomp) {
+					reply := NewMessage()
+					reply.Method = MethodConnected
+					b.Send(reply)
+				}
+				m.Release()
+			}
+		}()
+
+		client := New(a)
+		if err := client.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		sub, err := client.Subscribe("/queue/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disconnect {
+			client.Disconnect()
+		} else {
+			b.Close()
+		}
+
+		select {
+		case _, ok := <-sub.Messages():
+			if ok {
+				t.Errorf("Want messages channel closed, got message")
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Want messages channel closed when the connection ends, disconnect %v", disconnect)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package stomp
+
+// Update replaces the selector and prefetch count of the subscription
+// in place, without the gap between unsubscribing and subscribing again
+// during which messages may be missed or delivered twice. The
+// subscription takes the selector and prefetch count set by the options;
+// omitting an option clears the setting. Updating a paused subscription
+// takes effect when the subscription resumes.
+func (c *Client) Update(id []byte, opts ...MessageOption) error {
+	m := updateFrame(id, opts)
+	c.mu.Lock()
+	i := c.instruments[string(id)]
+	c.mu.Unlock()
+	if i != nil && i.updated(m) {
+		m.Release()
+		return nil
+	}
+	return c.sendUpdate(m)
+}
+
+// update updates the subscription without changing the settings
+// restored when a paused subscription resumes.
+func (c *Client) update(id []byte, opts ...MessageOption) error {
+	return c.sendUpdate(updateFrame(id, opts))
+}
+
+// updateFrame returns the SUBSCRIBE frame updating the subscription.
+func updateFrame(id []byte, opts []MessageOption) *Message {
+	m := NewMessage()
+	m.Method = MethodSubscribe
+	m.ID = id
+	m.Apply(opts...)
+	m.Header.Add(HeaderUpdate, []byte("true"))
+	return m
+}
+
+// sendUpdate sends the update, and records the settings to subscribe
+// with again after a redirect.
+func (c *Client) sendUpdate(m *Message) error {
+	c.mu.Lock()
+	if f, ok := c.frames[string(m.ID)]; ok {
+		f.Selector = append(f.Selector[:0], m.Selector...)
+		f.Prefetch = append(f.Prefetch[:0], m.Prefetch...)
+	}
+	c.mu.Unlock()
+
+	return c.sendMessage(m)
+}
@@ -0,0 +1,141 @@
+package stomp
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrConnectTimeout is returned when the session is not established
+// within the connect timeout.
+var ErrConnectTimeout = errors.New("stomp: connect timeout")
+
+// WithConnectTimeout returns an Option which configures the maximum time
+// to dial each host and to establish the session. There is no timeout by
+// default.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.connectTimeout = d
+	}
+}
+
+// uriOptions are the client options configured by query parameters of
+// the dial target.
+var uriOptions = map[string]func(c *Client, v string) error{
+	"heartbeat": func(c *Client, v string) error {
+		parts := strings.SplitN(v, ",", 2)
+		interval, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return err
+		}
+		timeout := 2 * interval
+		if len(parts) == 2 {
+			if timeout, err = time.ParseDuration(parts[1]); err != nil {
+				return err
+			}
+		}
+		WithHeartbeat(interval, timeout)(c)
+		return nil
+	},
+	"connect-timeout": durationOption(WithConnectTimeout),
+	"receipt-timeout": durationOption(WithReceiptTimeout),
+	"flush-interval":  durationOption(WithFlushInterval),
+	"read-buffer":     sizeOption(WithReadBuffer),
+	"write-buffer":    sizeOption(WithWriteBuffer),
+	"max-frame-size":  sizeOption(WithMaxFrameSize),
+	"proxy": func(c *Client, v string) error {
+		if _, err := url.Parse(v); err != nil {
+			return err
+		}
+		WithProxy(v)(c)
+		return nil
+	},
+	"redirects": func(c *Client, v string) error {
+		follow, err := strconv.ParseBool(v)
+		if follow {
+			WithRedirects()(c)
+		}
+		return err
+	},
+	"login": connectOption(func(v string) MessageOption {
+		return func(m *Message) { m.User = []byte(v) }
+	}),
+	"passcode": connectOption(func(v string) MessageOption {
+		return func(m *Message) { m.Pass = []byte(v) }
+	}),
+	"token":     connectOption(WithToken),
+	"host":      connectOption(WithHost),
+	"client-id": connectOption(WithClientID),
+}
+
+func durationOption(opt func(time.Duration) Option) func(*Client, string) error {
+	return func(c *Client, v string) error {
+		d, err := time.ParseDuration(v)
+		if err == nil {
+			opt(d)(c)
+		}
+		return err
+	}
+}
+
+func sizeOption(opt func(int) Option) func(*Client, string) error {
+	return func(c *Client, v string) error {
+		n, err := strconv.Atoi(v)
+		if err == nil {
+			opt(n)(c)
+		}
+		return err
+	}
+}
+
+func connectOption(opt func(string) MessageOption) func(*Client, string) error {
+	return func(c *Client, v string) error {
+		c.connectDefaults = append(c.connectDefaults, opt(v))
+		return nil
+	}
+}
+
+// parseTarget configures the client with the query parameters of the
+// target, such as stomp://host:61613?heartbeat=10s,30s&login=u&passcode=p,
+// and returns the target without them. Unknown parameters are an error,
+// except for websocket targets, which keep them in the handshake url.
+func (c *Client) parseTarget(target string) (string, error) {
+	i := strings.IndexByte(target, '?')
+	if i < 0 {
+		return target, nil
+	}
+	query, err := url.ParseQuery(target[i+1:])
+	if err != nil {
+		return "", err
+	}
+	websocket := strings.HasPrefix(target, "ws") || strings.HasPrefix(target, "http")
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		opt, ok := uriOptions[key]
+		if !ok {
+			if !websocket {
+				return "", fmt.Errorf("stomp: unknown target option %q", key)
+			}
+			continue
+		}
+		if err := opt(c, query.Get(key)); err != nil {
+			return "", fmt.Errorf("stomp: target option %s: %s", key, err)
+		}
+		query.Del(key)
+	}
+
+	target = target[:i]
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+	return target, nil
+}
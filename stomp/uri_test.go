@@ -0,0 +1,72 @@
+package stomp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseTarget(t *testing.T) {
+	c := New(nil)
+	target, err := c.parseTarget("stomp://localhost:61613?heartbeat=10s,30s&login=u&passcode=p&connect-timeout=5s&read-buffer=1024&host=vhost&redirects=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "stomp://localhost:61613" {
+		t.Errorf("Want query removed from target, got %s", target)
+	}
+	if c.heartbeat != 10*time.Second || c.heartbeatWait != 30*time.Second {
+		t.Errorf("Want heartbeat 10s,30s, got %s,%s", c.heartbeat, c.heartbeatWait)
+	}
+	if c.connectTimeout != 5*time.Second {
+		t.Errorf("Want connect timeout 5s, got %s", c.connectTimeout)
+	}
+	if c.readBufferSize != 1024 {
+		t.Errorf("Want read buffer 1024, got %d", c.readBufferSize)
+	}
+	if !c.follow {
+		t.Errorf("Want redirects followed")
+	}
+	m := connectFrame(c.connectDefaults)
+	if string(m.User) != "u" || string(m.Pass) != "p" || string(m.Host) != "vhost" {
+		t.Errorf("Want connect credentials and host, got %q %q %q", m.User, m.Pass, m.Host)
+	}
+
+	c = New(nil)
+	if _, err := c.parseTarget("stomp://localhost:61613?heartbeat=10s"); err != nil {
+		t.Fatal(err)
+	}
+	if c.heartbeatWait != 20*time.Second {
+		t.Errorf("Want heartbeat timeout twice the interval, got %s", c.heartbeatWait)
+	}
+
+	target, err = New(nil).parseTarget("ws://localhost/ws?login=u&session=1")
+	if err != nil || target != "ws://localhost/ws?session=1" {
+		t.Errorf("Want websocket parameters kept, got %s, %v", target, err)
+	}
+
+	for _, target := range []string{
+		"tcp://localhost:61613?heartbeet=10s",
+		"tcp://localhost:61613?connect-timeout=soon",
+		"tcp://localhost:61613?read-buffer=big",
+		"tcp://localhost:61613?redirects=maybe",
+	} {
+		if _, err := New(nil).parseTarget(target); err == nil {
+			t.Errorf("Want error parsing %s", target)
+		}
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+
+	client := newClient(a, []Option{WithConnectTimeout(20 * time.Millisecond)})
+	defer client.peer.Close()
+	if err := client.Connect(); err != ErrConnectTimeout {
+		t.Errorf("Want ErrConnectTimeout, got %v", err)
+	}
+}
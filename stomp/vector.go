@@ -0,0 +1,190 @@
+package stomp
+
+import (
+	"bytes"
+)
+
+// Vector is a canonical frame test vector. Clients implemented in other
+// languages can validate their encoders and parsers against the exact
+// bytes written by this implementation.
+type Vector struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version"`
+	Frame   string      `json:"frame"`
+	Command string      `json:"command"`
+	Headers [][2]string `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+// vectorSpec describes a test vector frame.
+type vectorSpec struct {
+	name    string
+	version []byte
+	build   func(*Message)
+}
+
+var vectorSpecs = []vectorSpec{
+	{"connect", STOMP12, func(m *Message) {
+		m.Method = MethodStomp
+		m.Proto = Versions
+		m.Host = []byte("vhost")
+		m.Apply(WithCredentials("guest", "secret"))
+		m.Header.Add(HeaderClient, []byte("client/1.0"))
+	}},
+	{"connect-stomp10", STOMP10, func(m *Message) {
+		m.Method = MethodConnect
+		m.Proto = STOMP10
+	}},
+	{"connected", STOMP12, func(m *Message) {
+		m.Method = MethodConnected
+		m.Proto = STOMP12
+		m.Header.Add(HeaderServer, []byte("mq/1.0"))
+		m.Header.Add(HeaderSession, []byte("f4f1c9a0"))
+	}},
+	{"send", STOMP12, func(m *Message) {
+		m.Method = MethodSend
+		m.Dest = []byte("/queue/test")
+		m.Body = []byte("hello")
+	}},
+	{"send-empty-body", STOMP12, func(m *Message) {
+		m.Method = MethodSend
+		m.Dest = []byte("/topic/test")
+	}},
+	{"send-utf8-body", STOMP12, func(m *Message) {
+		m.Method = MethodSend
+		m.Dest = []byte("/queue/test")
+		m.Body = []byte("héllo, 世界\nline two")
+	}},
+	{"send-headers", STOMP12, func(m *Message) {
+		m.Method = MethodSend
+		m.Dest = []byte("/queue/test")
+		m.Body = []byte("{}")
+		m.Apply(
+			WithExpires(1500000000),
+			WithRetain("last"),
+			WithPersistence(),
+			WithHeader("content-type", "application/json"),
+			WithHeader("x-trace", "abc"),
+		)
+		m.Receipt = []byte("77")
+	}},
+	{"send-escaped-headers", STOMP12, func(m *Message) {
+		m.Method = MethodSend
+		m.Dest = []byte("/queue/a:b")
+		m.Header.Add([]byte("key:colon"), []byte("line\nbreak"))
+		m.Header.Add([]byte("path"), []byte(`c:\dir`))
+		m.Header.Add([]byte("crlf"), []byte("a\r\nb"))
+	}},
+	{"send-unescaped-stomp10", STOMP10, func(m *Message) {
+		m.Method = MethodSend
+		m.Dest = []byte("/queue/test")
+		m.Header.Add([]byte("url"), []byte("http://example.com:8080"))
+	}},
+	{"subscribe", STOMP12, func(m *Message) {
+		m.Method = MethodSubscribe
+		m.ID = []byte("0")
+		m.Dest = []byte("/topic/orders")
+		m.Apply(
+			WithSelector("region == 'eu' AND priority > 1"),
+			WithPrefetch(10),
+			WithAck("client"),
+		)
+	}},
+	{"unsubscribe", STOMP12, func(m *Message) {
+		m.Method = MethodUnsubscribe
+		m.ID = []byte("0")
+	}},
+	{"ack", STOMP12, func(m *Message) {
+		m.Method = MethodAck
+		m.ID = []byte("42")
+	}},
+	{"nack", STOMP12, func(m *Message) {
+		m.Method = MethodNack
+		m.ID = []byte("42")
+	}},
+	{"message", STOMP12, func(m *Message) {
+		m.Method = MethodMessage
+		m.ID = []byte("1001")
+		m.Dest = []byte("/queue/test")
+		m.Subs = []byte("0")
+		m.Ack = []byte("42")
+		m.Header.Add([]byte("content-type"), []byte("text/plain"))
+		m.Body = []byte("hello")
+	}},
+	{"receipt", STOMP12, func(m *Message) {
+		m.Method = MethodRecipet
+		m.Receipt = []byte("77")
+	}},
+	{"error", STOMP12, func(m *Message) {
+		m.Method = MethodError
+		m.Receipt = []byte("77")
+		m.Header.Add(HeaderMessage, []byte("stomp: no such destination"))
+	}},
+	{"error-version", STOMP10, func(m *Message) {
+		m.Method = MethodError
+		m.Proto = Versions
+		m.Header.Add(HeaderMessage, []byte(ErrVersion.Error()))
+	}},
+	{"disconnect", STOMP12, func(m *Message) {
+		m.Method = MethodDisconnect
+		m.Receipt = []byte("99")
+	}},
+}
+
+// Vectors returns the canonical frame test vectors. Each vector holds the
+// frame bytes, including the NUL terminator, as written on a connection
+// that negotiated the vector version, and the parsed command, headers in
+// wire order with escape sequences decoded, and body.
+func Vectors() []Vector {
+	var vectors []Vector
+	for _, spec := range vectorSpecs {
+		m := NewMessage()
+		spec.build(m)
+
+		esc := escapesHeaders(spec.version) && !isConnectFrame(m)
+		var buf bytes.Buffer
+		writeFrame(&buf, m, esc)
+		frame := buf.Bytes()
+		m.Release()
+
+		command, headers, body := splitFrame(frame, esc)
+		vectors = append(vectors, Vector{
+			Name:    spec.name,
+			Version: string(spec.version),
+			Frame:   string(append(frame, 0)),
+			Command: command,
+			Headers: headers,
+			Body:    body,
+		})
+	}
+	return vectors
+}
+
+// firstLine returns the frame command.
+func firstLine(frame []byte) []byte {
+	if i := bytes.IndexByte(frame, '\n'); i != -1 {
+		return frame[:i]
+	}
+	return frame
+}
+
+// splitFrame splits the frame into the command, the headers in wire
+// order, and the body. Header names are separated from values by the
+// first colon.
+func splitFrame(frame []byte, esc bool) (command string, headers [][2]string, body string) {
+	i := bytes.Index(frame, []byte("\n\n"))
+	if i == -1 {
+		return string(firstLine(frame)), nil, ""
+	}
+	lines := bytes.Split(frame[:i], newline)
+	for _, line := range lines[1:] {
+		kv := bytes.SplitN(line, separator, 2)
+		name, value := kv[0], kv[1]
+		if esc {
+			name = unescape(append([]byte(nil), name...))
+			value = unescape(append([]byte(nil), value...))
+		}
+		headers = append(headers, [2]string{string(name), string(value)})
+	}
+	return string(lines[0]), headers, string(frame[i+2:])
+}
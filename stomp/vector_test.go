@@ -0,0 +1,63 @@
+package stomp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVectors(t *testing.T) {
+	for _, v := range Vectors() {
+		frame := []byte(v.Frame)
+		if frame[len(frame)-1] != 0 {
+			t.Errorf("%s: Want frame terminated by NUL", v.Name)
+			continue
+		}
+		frame = frame[:len(frame)-1]
+
+		// the frame must parse and encode to the same bytes.
+		esc := escapesHeaders([]byte(v.Version))
+		m := NewMessage()
+		if err := readFrame(append([]byte(nil), frame...), m, esc); err != nil {
+			t.Errorf("%s: %s", v.Name, err)
+			continue
+		}
+		if string(m.Method) != v.Command {
+			t.Errorf("%s: Want command %s, got %s", v.Name, v.Command, m.Method)
+		}
+		if string(m.Body) != v.Body {
+			t.Errorf("%s: Want body %q, got %q", v.Name, v.Body, m.Body)
+		}
+		var buf bytes.Buffer
+		writeFrame(&buf, m, esc)
+		if !bytes.Equal(buf.Bytes(), frame) {
+			t.Errorf("%s: Want frame round trip\n%q\n%q", v.Name, frame, buf.Bytes())
+		}
+	}
+}
+
+func TestVectorsEscaped(t *testing.T) {
+	for _, v := range Vectors() {
+		if v.Name != "send-escaped-headers" {
+			continue
+		}
+		want := [][2]string{
+			{"destination", "/queue/a:b"},
+			{"key:colon", "line\nbreak"},
+			{"path", `c:\dir`},
+			{"crlf", "a\r\nb"},
+		}
+		if len(v.Headers) != len(want) {
+			t.Fatalf("Want %d headers, got %d", len(want), len(v.Headers))
+		}
+		for i := range want {
+			if v.Headers[i] != want[i] {
+				t.Errorf("Want header %q, got %q", want[i], v.Headers[i])
+			}
+		}
+		if !bytes.Contains([]byte(v.Frame), []byte(`key\ccolon:line\nbreak`)) {
+			t.Errorf("Want escaped header in frame")
+		}
+		return
+	}
+	t.Errorf("Want escaped header vector")
+}
@@ -0,0 +1,113 @@
+package stomp
+
+import (
+	"io"
+	"net"
+)
+
+// vectorMin is the smallest body written from the message instead of
+// being copied into the write buffer.
+const vectorMin = 2 << 10
+
+// vectorWriter buffers frames for a single vectored write. Frame heads
+// and small bodies are copied into a contiguous buffer, while large
+// bodies are referenced in place, so that a batch of frames is written
+// with one writev call on connections that support it and large bodies
+// are never copied.
+type vectorWriter struct {
+	w     io.Writer
+	limit int // buffered bytes that trigger a write
+	size  int // buffered bytes, including referenced bodies
+	err   error
+
+	head   []byte
+	cuts   []int    // head offsets at which bodies are written
+	bodies [][]byte // bodies referenced in place
+	held   []*Message
+	bufs   net.Buffers
+}
+
+func newVectorWriter(w io.Writer, limit int) *vectorWriter {
+	return &vectorWriter{
+		w:     w,
+		limit: limit,
+		head:  make([]byte, 0, limit),
+	}
+}
+
+// Write copies p into the buffer, writing the buffer once it exceeds the
+// limit.
+func (v *vectorWriter) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	v.head = append(v.head, p...)
+	v.size += len(p)
+	if v.size >= v.limit {
+		v.Flush()
+	}
+	return len(p), v.err
+}
+
+// body buffers the message body. A large body is referenced in place and
+// the message is held until the buffer is written. It returns true if
+// the writer holds the message, in which case the writer releases it.
+func (v *vectorWriter) body(m *Message) bool {
+	if len(m.Body) < vectorMin || v.err != nil {
+		v.Write(m.Body)
+		return false
+	}
+	v.cuts = append(v.cuts, len(v.head))
+	v.bodies = append(v.bodies, m.Body)
+	v.held = append(v.held, m)
+	v.size += len(m.Body)
+	return true
+}
+
+// Buffered returns the number of bytes buffered.
+func (v *vectorWriter) Buffered() int {
+	return v.size
+}
+
+// Size returns the number of buffered bytes that triggers a write.
+func (v *vectorWriter) Size() int {
+	return v.limit
+}
+
+// Flush writes the buffered frames and releases the held messages.
+func (v *vectorWriter) Flush() error {
+	if v.err == nil && v.size != 0 {
+		var start int
+		for i, cut := range v.cuts {
+			v.bufs = append(v.bufs, v.head[start:cut], v.bodies[i])
+			start = cut
+		}
+		v.bufs = append(v.bufs, v.head[start:])
+		// WriteTo consumes the slice, so write from a copy of the header
+		// and keep the backing array for the next flush.
+		bufs := v.bufs
+		_, v.err = bufs.WriteTo(v.w)
+	}
+	v.reset()
+	return v.err
+}
+
+// reset empties the buffer and releases the held messages.
+func (v *vectorWriter) reset() {
+	for i, m := range v.held {
+		m.Release()
+		v.held[i] = nil
+	}
+	for i := range v.bodies {
+		v.bodies[i] = nil
+	}
+	for i := range v.bufs {
+		v.bufs[i] = nil
+	}
+	v.head = v.head[:0]
+	v.cuts = v.cuts[:0]
+	v.bodies = v.bodies[:0]
+	v.held = v.held[:0]
+	v.bufs = v.bufs[:0]
+	v.size = 0
+}
@@ -0,0 +1,70 @@
+package stomp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVectorWriter(t *testing.T) {
+	SetPoolDebug(true)
+	defer SetPoolDebug(false)
+
+	var out, want bytes.Buffer
+	w := newVectorWriter(&out, 64<<10)
+	codec := TextCodec.(vectorEncoder)
+
+	var held []*Message
+	for _, size := range []int{0, 10, vectorMin, 4 * vectorMin} {
+		m := NewMessage()
+		m.Method = MethodSend
+		m.Dest = []byte("/queue/test")
+		m.Body = bytes.Repeat([]byte("x"), size)
+		writeFrame(&want, m, true)
+		want.WriteByte(0)
+
+		codec.encodeHead(w, m)
+		if w.body(m) {
+			held = append(held, m)
+		} else {
+			m.Release()
+		}
+		w.Write(codec.trailer())
+	}
+	if len(held) != 2 {
+		t.Fatalf("Want large bodies referenced in place, got %d held", len(held))
+	}
+	if out.Len() != 0 {
+		t.Errorf("Want frames buffered until flushed")
+	}
+	if got := w.Buffered(); got != want.Len() {
+		t.Errorf("Want %d bytes buffered, got %d", want.Len(), got)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want.Bytes()) {
+		t.Errorf("Want vectored frames equal to the encoded frames")
+	}
+	for _, m := range held {
+		if !m.released {
+			t.Errorf("Want held message released once written")
+		}
+	}
+	if w.Buffered() != 0 {
+		t.Errorf("Want buffer empty after flush")
+	}
+}
+
+func TestVectorWriterLimit(t *testing.T) {
+	var out bytes.Buffer
+	w := newVectorWriter(&out, 16)
+	w.Write([]byte("0123456789"))
+	if out.Len() != 0 {
+		t.Errorf("Want writes buffered below the limit")
+	}
+	w.Write([]byte("0123456789"))
+	if out.Len() != 20 {
+		t.Errorf("Want buffer written once the limit is exceeded, got %d bytes", out.Len())
+	}
+}
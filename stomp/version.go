@@ -0,0 +1,8 @@
+package stomp
+
+// Version is the library version sent in the client header when
+// connecting and in the server header when a connection is accepted.
+const Version = "1.0.0"
+
+// UserAgent is the product name and version reported by this library.
+var UserAgent = []byte("mq/" + Version)
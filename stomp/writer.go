@@ -3,6 +3,8 @@ package stomp
 import (
 	"bytes"
 	"io"
+
+	"github.com/mrwill84/mq/stomp/frame"
 )
 
 var (
@@ -13,145 +15,184 @@ var (
 )
 
 func writeTo(w io.Writer, m *Message) {
+	writeFrame(w, m, false)
+}
+
+// writeFrame writes the message frame, escaping header names and values
+// if esc is true. Headers of connect frames are never escaped.
+func writeFrame(w io.Writer, m *Message, esc bool) {
+	writeHead(w, m, esc)
+	w.Write(m.Body)
+}
+
+// writeHead writes the message frame up to the body.
+func writeHead(w io.Writer, m *Message, esc bool) {
+	m.checkReleased()
 	w.Write(m.Method)
 	w.Write(newline)
 
+	if isConnectFrame(m) {
+		esc = false
+	}
+
 	switch {
-	case bytes.Equal(m.Method, MethodStomp):
+	case bytes.Equal(m.Method, MethodStomp), bytes.Equal(m.Method, MethodConnect):
 		// version
 		w.Write(HeaderAccept)
 		w.Write(separator)
-		w.Write(m.Proto)
+		writeValue(w, m.Proto, esc)
 		w.Write(newline)
+		// host
+		if len(m.Host) != 0 {
+			w.Write(HeaderHost)
+			w.Write(separator)
+			writeValue(w, m.Host, esc)
+			w.Write(newline)
+		}
 		// login
 		if len(m.User) != 0 {
 			w.Write(HeaderLogin)
 			w.Write(separator)
-			w.Write(m.User)
+			writeValue(w, m.User, esc)
 			w.Write(newline)
 		}
 		// passcode
 		if len(m.Pass) != 0 {
 			w.Write(HeaderPass)
 			w.Write(separator)
-			w.Write(m.Pass)
+			writeValue(w, m.Pass, esc)
 			w.Write(newline)
 		}
 	case bytes.Equal(m.Method, MethodConnected):
 		// version
 		w.Write(HeaderVersion)
 		w.Write(separator)
-		w.Write(m.Proto)
+		writeValue(w, m.Proto, esc)
 		w.Write(newline)
 	case bytes.Equal(m.Method, MethodSend):
 		// dest
 		w.Write(HeaderDest)
 		w.Write(separator)
-		w.Write(m.Dest)
+		writeValue(w, m.Dest, esc)
 		w.Write(newline)
 		if len(m.Expires) != 0 {
 			w.Write(HeaderExpires)
 			w.Write(separator)
-			w.Write(m.Expires)
+			writeValue(w, m.Expires, esc)
 			w.Write(newline)
 		}
 		if len(m.Retain) != 0 {
 			w.Write(HeaderRetain)
 			w.Write(separator)
-			w.Write(m.Retain)
+			writeValue(w, m.Retain, esc)
 			w.Write(newline)
 		}
 		if len(m.Persist) != 0 {
 			w.Write(HeaderPersist)
 			w.Write(separator)
-			w.Write(m.Persist)
+			writeValue(w, m.Persist, esc)
 			w.Write(newline)
 		}
 	case bytes.Equal(m.Method, MethodSubscribe):
 		// id
 		w.Write(HeaderID)
 		w.Write(separator)
-		w.Write(m.ID)
+		writeValue(w, m.ID, esc)
 		w.Write(newline)
 		// destination
 		w.Write(HeaderDest)
 		w.Write(separator)
-		w.Write(m.Dest)
+		writeValue(w, m.Dest, esc)
 		w.Write(newline)
 		// selector
 		if len(m.Selector) != 0 {
 			w.Write(HeaderSelector)
 			w.Write(separator)
-			w.Write(m.Selector)
+			writeValue(w, m.Selector, esc)
 			w.Write(newline)
 		}
 		// prefetch
 		if len(m.Prefetch) != 0 {
 			w.Write(HeaderPrefetch)
 			w.Write(separator)
-			w.Write(m.Prefetch)
+			writeValue(w, m.Prefetch, esc)
 			w.Write(newline)
 		}
 		if len(m.Ack) != 0 {
 			w.Write(HeaderAck)
 			w.Write(separator)
-			w.Write(m.Ack)
+			writeValue(w, m.Ack, esc)
 			w.Write(newline)
 		}
 	case bytes.Equal(m.Method, MethodUnsubscribe):
 		// id
 		w.Write(HeaderID)
 		w.Write(separator)
-		w.Write(m.ID)
+		writeValue(w, m.ID, esc)
 		w.Write(newline)
 	case bytes.Equal(m.Method, MethodAck):
 		// id
 		w.Write(HeaderID)
 		w.Write(separator)
-		w.Write(m.ID)
+		writeValue(w, m.ID, esc)
 		w.Write(newline)
 	case bytes.Equal(m.Method, MethodNack):
 		// id
 		w.Write(HeaderID)
 		w.Write(separator)
-		w.Write(m.ID)
+		writeValue(w, m.ID, esc)
 		w.Write(newline)
 	case bytes.Equal(m.Method, MethodMessage):
 		// message-id
 		w.Write(HeaderMessageID)
 		w.Write(separator)
-		w.Write(m.ID)
+		writeValue(w, m.ID, esc)
 		w.Write(newline)
 		// destination
 		w.Write(HeaderDest)
 		w.Write(separator)
-		w.Write(m.Dest)
+		writeValue(w, m.Dest, esc)
 		w.Write(newline)
 		// subscription
 		w.Write(HeaderSubscription)
 		w.Write(separator)
-		w.Write(m.Subs)
+		writeValue(w, m.Subs, esc)
 		w.Write(newline)
 		// ack
 		if len(m.Ack) != 0 {
 			w.Write(HeaderAck)
 			w.Write(separator)
-			w.Write(m.Ack)
+			writeValue(w, m.Ack, esc)
 			w.Write(newline)
 		}
 	case bytes.Equal(m.Method, MethodRecipet):
 		// receipt-id
 		w.Write(HeaderReceiptID)
 		w.Write(separator)
-		w.Write(m.Receipt)
+		writeValue(w, m.Receipt, esc)
 		w.Write(newline)
+	case bytes.Equal(m.Method, MethodError):
+		// receipt-id
+		if len(m.Receipt) != 0 {
+			w.Write(HeaderReceiptID)
+			w.Write(separator)
+			writeValue(w, m.Receipt, esc)
+			w.Write(newline)
+		}
+		// supported versions, if the version negotiation failed
+		if len(m.Proto) != 0 {
+			w.Write(HeaderVersion)
+			w.Write(separator)
+			writeValue(w, m.Proto, esc)
+			w.Write(newline)
+		}
 	}
 
 	// receipt header
 	if includeReceiptHeader(m) {
 		w.Write(HeaderReceipt)
 		w.Write(separator)
-		w.Write(m.Receipt)
+		writeValue(w, m.Receipt, esc)
 		w.Write(newline)
 	}
 
@@ -159,15 +200,32 @@ func writeTo(w io.Writer, m *Message) {
 		if m.Header.itemc == i {
 			break
 		}
-		w.Write(item.name)
+		writeValue(w, item.name, esc)
 		w.Write(separator)
-		w.Write(item.data)
+		writeValue(w, item.data, esc)
 		w.Write(newline)
 	}
 	w.Write(newline)
-	w.Write(m.Body)
 }
 
 func includeReceiptHeader(m *Message) bool {
-	return len(m.Receipt) != 0 && !bytes.Equal(m.Method, MethodRecipet)
+	return len(m.Receipt) != 0 &&
+		!bytes.Equal(m.Method, MethodRecipet) &&
+		!bytes.Equal(m.Method, MethodError)
+}
+
+// writeValue writes the header name or value, escaping special
+// characters if esc is true.
+func writeValue(w io.Writer, b []byte, esc bool) {
+	if esc && needsEscape(b) {
+		w.Write(escape(nil, b))
+		return
+	}
+	w.Write(b)
+}
+
+// isConnectFrame returns true if the message is a connect or connected
+// frame, whose headers are exempt from escaping.
+func isConnectFrame(m *Message) bool {
+	return frame.IsConnect(m.Method)
 }
@@ -10,10 +10,11 @@ var payloads = []struct {
 	payload string
 }{
 	{
-		payload: "STOMP\naccept-version:1.2\nlogin:janedoe\npasscode:pa55word\n\n",
+		payload: "STOMP\naccept-version:1.2\nhost:example.com\nlogin:janedoe\npasscode:pa55word\n\n",
 		message: &Message{
 			Method: MethodStomp,
 			Proto:  STOMP,
+			Host:   []byte("example.com"),
 			User:   []byte("janedoe"),
 			Pass:   []byte("pa55word"),
 			Header: newHeader(),